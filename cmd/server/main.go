@@ -2,91 +2,563 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/config"
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/fraud"
+	"github.com/kubo-market/idempotency-shield/internal/fx"
 	"github.com/kubo-market/idempotency-shield/internal/handler"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 	"github.com/kubo-market/idempotency-shield/internal/monitor"
-	"github.com/kubo-market/idempotency-shield/internal/seed"
+	"github.com/kubo-market/idempotency-shield/internal/otlp"
+	"github.com/kubo-market/idempotency-shield/internal/provider"
+	"github.com/kubo-market/idempotency-shield/internal/sdnotify"
 	"github.com/kubo-market/idempotency-shield/internal/service"
+	"github.com/kubo-market/idempotency-shield/internal/siem"
 	"github.com/kubo-market/idempotency-shield/internal/storage"
+	"github.com/kubo-market/idempotency-shield/internal/webhook"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
 	cfg := config.Load()
+	if cfg.ConfigFile != "" {
+		var err error
+		if cfg, err = config.LoadFile(cfg.ConfigFile); err != nil {
+			log.Fatalf("CONFIG_FILE: %v", err)
+		}
+	}
 
-	// Database
-	db, err := storage.NewPostgresDB(cfg.DatabaseDSN)
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	logLevel, ok := logging.ParseLevel(cfg.LogLevel)
+	if !ok {
+		log.Fatalf("unknown LOG_LEVEL %q (want debug, info, warn or error)", cfg.LogLevel)
+	}
+	if err := logging.Setup(cfg.LogFormat, logLevel, os.Stderr); err != nil {
+		log.Fatalf("LOG_FORMAT: %v", err)
+	}
+	switch cfg.DeployEnv {
+	case config.DeployDev, config.DeployStaging:
+	case config.DeployProd:
+		if cfg.SeedOnStart {
+			log.Fatal("SEED_ON_START is refused when DEPLOY_ENV=prod")
+		}
+	default:
+		log.Fatalf("unknown DEPLOY_ENV %q (want dev, staging or prod)", cfg.DeployEnv)
+	}
+	switch cfg.Environment {
+	case domain.EnvironmentProduction, domain.EnvironmentSandbox:
+	default:
+		log.Fatalf("unknown SHIELD_ENVIRONMENT %q (want production or sandbox)", cfg.Environment)
+	}
+
+	// Metrics
+	metrics := monitor.NewMetrics().WithEnvironment(cfg.Environment).WithWindow(cfg.MetricsWindow)
+
+	// Storage. The Redis, SQLite and memory backends store keys and policies
+	// only; pgRepo and db stay nil and the features built on Postgres tables
+	// are left off.
+	var (
+		db     *sql.DB
+		pgRepo *storage.PostgresRepository
+		store  storage.Repository
+		pinger handler.Pinger
+		schema handler.SchemaChecker
+		pool   handler.PoolStater
+	)
+	switch cfg.StorageBackend {
+	case "postgres":
+		var err error
+		db, err = storage.NewPostgresDB(cfg.DatabaseDSN)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		defer db.Close()
+		log.Println("Connected to PostgreSQL")
+
+		pgSchema := storage.NewSchema(db)
+		warnings, err := pgSchema.Validate(context.Background())
+		for _, w := range warnings {
+			log.Printf("Schema warning: %s", w)
+		}
+		if err != nil {
+			log.Fatalf("Schema validation failed: %v", err)
+		}
+
+		// Read replicas
+		var replicas []*sql.DB
+		for _, dsn := range cfg.ReadReplicaDSNs {
+			replica, err := storage.OpenReplica(dsn)
+			if err != nil {
+				log.Printf("Skipping read replica: %v", err)
+				continue
+			}
+			defer replica.Close()
+			replicas = append(replicas, replica)
+		}
+
+		pgRepo = storage.NewPostgresRepository(db).WithEnvironment(cfg.Environment).
+			WithTimeouts(cfg.QueryTimeout, cfg.LockTimeout)
+		if len(replicas) > 0 {
+			pgRepo.WithReplicas(cfg.HedgeDelay, replicas...)
+			log.Printf("Key lookups hedged and reports read across %d replica(s)", len(replicas))
+		}
+		store, pinger, schema, pool = pgRepo, db, pgSchema, db
+	case "redis":
+		client, err := storage.NewRedisClient(cfg.RedisURL, redisPoolSize)
+		if err != nil {
+			log.Fatalf("REDIS_URL: %v", err)
+		}
+		if err := client.Ping(); err != nil {
+			log.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		defer client.Close()
+		log.Println("Connected to Redis; fraud signals, stored digests, metrics history, feature export, DB maintenance and reconciliation are unavailable")
+		store, pinger = storage.NewRedisRepository(client).WithEnvironment(cfg.Environment), client
+	case "sqlite":
+		sqliteDB, err := storage.OpenSQLite(cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("SQLITE_PATH: %v", err)
+		}
+		defer sqliteDB.Close()
+		log.Printf("Storing keys in SQLite at %s; fraud signals, stored digests, metrics history, feature export, DB maintenance and reconciliation are unavailable", cfg.SQLitePath)
+		store, pinger, pool = storage.NewSQLiteRepository(sqliteDB).WithEnvironment(cfg.Environment), sqliteDB, sqliteDB
+	case "memory":
+		memRepo := storage.NewMemoryRepository(cfg.MemoryMaxKeys)
+		log.Printf("Keeping up to %d keys in memory; they are lost on restart, and fraud signals, stored digests, metrics history, feature export, DB maintenance and reconciliation are unavailable", cfg.MemoryMaxKeys)
+		store, pinger = memRepo, memRepo
+	default:
+		log.Fatalf("unknown STORAGE_BACKEND %q (want postgres, redis, sqlite or memory)", cfg.StorageBackend)
 	}
-	defer db.Close()
-	log.Println("Connected to PostgreSQL")
 
 	// Repository
-	repo := storage.NewPostgresRepository(db)
+	breaker := storage.NewCircuitBreaker(cfg.BreakerFailures, cfg.BreakerCooldown, metrics)
+	repo := storage.NewBreakerRepository(
+		storage.NewInstrumentedRepository(store, cfg.SlowQueryThreshold, metrics),
+		breaker,
+	)
 
 	// Services
-	idempotencySvc := service.NewIdempotencyService(repo, cfg.KeyExpiryTTL)
-	reportingSvc := service.NewReportingService(repo)
-
-	// Metrics
-	metrics := monitor.NewMetrics()
+	idempotencySvc := service.NewIdempotencyService(repo, cfg.KeyExpiryTTL).
+		WithMaxExpiry(cfg.MaxKeyExpiryTTL).
+		WithMismatchRecorder(metrics)
+	switch cfg.MismatchDetail {
+	case service.MismatchDetailMasked, service.MismatchDetailHashed, service.MismatchDetailPlain, service.MismatchDetailNone:
+		idempotencySvc.WithMismatchDetail(cfg.MismatchDetail)
+	default:
+		log.Fatalf("unknown MISMATCH_DETAIL %q (want masked, hashed, plain, or none)", cfg.MismatchDetail)
+	}
+	if cfg.RequireMerchantPolicy {
+		idempotencySvc.WithRequiredPolicy()
+	}
+	if len(cfg.AmountLimits) > 0 {
+		limits := make(map[string]service.AmountLimit, len(cfg.AmountLimits))
+		for currency, l := range cfg.AmountLimits {
+			if !domain.IsCurrency(currency) {
+				log.Fatalf("AMOUNT_LIMITS: %q is not an ISO 4217 currency code", currency)
+			}
+			limits[currency] = service.AmountLimit{Min: l[0], Max: l[1]}
+		}
+		idempotencySvc.WithAmountLimits(limits)
+	}
+	switch cfg.RequestHashMode {
+	case "fields":
+	case "body":
+		idempotencySvc.WithBodyHash(cfg.HashExcludedFields)
+		log.Printf("Comparing duplicates by their whole body (excluding %v)", cfg.HashExcludedFields)
+	default:
+		log.Fatalf("unknown REQUEST_HASH_MODE %q (want fields or body)", cfg.RequestHashMode)
+	}
+	if cfg.ProcessingTimeout > 0 {
+		idempotencySvc.WithProcessingTimeout(cfg.ProcessingTimeout, metrics)
+		log.Printf("Keys processing for over %s can be taken over by a duplicate", cfg.ProcessingTimeout)
+	}
+	if pgRepo != nil {
+		idempotencySvc.WithCompletionEstimates(pgRepo).WithReservations(pgRepo, cfg.KeyReservationTTL).
+			WithRestores(pgRepo, cfg.AdminRestoreWindow)
+	}
+	var signals *fraud.Dispatcher
+	if cfg.FraudExportURL != "" {
+		if pgRepo == nil {
+			log.Fatal("FRAUD_EXPORT_URL requires STORAGE_BACKEND=postgres")
+		}
+		switch cfg.FraudExportFormat {
+		case fraud.FormatJSON, fraud.FormatKafkaREST:
+		default:
+			log.Fatalf("unknown FRAUD_EXPORT_FORMAT %q (want json or kafka-rest)", cfg.FraudExportFormat)
+		}
+		signals = fraud.NewDispatcher(fraud.NewHTTPExporter(cfg.FraudExportURL, cfg.FraudExportToken, cfg.FraudExportFormat), cfg.Environment)
+		idempotencySvc.WithSignals(signals, pgRepo)
+	}
+	var audit *siem.Dispatcher
+	if cfg.SIEMExportURL != "" {
+		exporter, err := siem.NewExporter(cfg.SIEMExportFormat, cfg.SIEMExportURL, cfg.SIEMExportToken)
+		if err != nil {
+			log.Fatalf("SIEM_EXPORT: %v", err)
+		}
+		audit = siem.NewDispatcher(exporter, cfg.Environment)
+		idempotencySvc.WithAudit(audit)
+	}
+	rates, err := newRateProvider(cfg)
+	if err != nil {
+		log.Fatalf("FX configuration: %v", err)
+	}
+	// One webhook client for every sender; with Postgres, deliveries that
+	// fail every attempt are kept for an admin to redeliver, merchant
+	// webhooks are kept for replays and every attempt is recorded.
+	webhooks := webhook.NewClient()
+	var webhookSvc *service.WebhookService
+	if pgRepo != nil {
+		webhooks.WithDeadLetters(pgRepo).WithOutbox(pgRepo).WithDeliveries(pgRepo)
+		webhookSvc = service.NewWebhookService(pgRepo, webhooks)
+	}
+	reportingSvc := service.NewReportingService(repo).
+		WithFX(rates, cfg.ReportCurrency).
+		WithDuplicateAlerts(webhooks)
+	if pgRepo != nil {
+		reportingSvc.WithDigests(pgRepo)
+	}
 
 	// Handlers
-	paymentHandler := handler.NewPaymentHandler(idempotencySvc)
+	paymentHandler := handler.NewPaymentHandler(idempotencySvc).WithOutcomes(metrics)
+	if cfg.RequestHashMode == "body" {
+		// Body hashing compares the fields PaymentRequest does not have.
+		paymentHandler.WithUnknownFields()
+	}
+	switch cfg.IdempotencyMode {
+	case "legacy":
+	case "ietf":
+		paymentHandler.WithIETFMode()
+		log.Printf("IETF Idempotency-Key mode: keys are read from the %s header", handler.IdempotencyKeyHeader)
+	default:
+		log.Fatalf("unknown IDEMPOTENCY_MODE %q (want legacy or ietf)", cfg.IdempotencyMode)
+	}
+	var paymentQueue *service.PaymentQueue
+	switch cfg.ProcessingMode {
+	case "sync":
+	case "async":
+		if cfg.DownstreamURL == "" {
+			log.Fatal("PROCESSING_MODE=async requires DOWNSTREAM_URL")
+		}
+		paymentQueue = service.NewPaymentQueue(idempotencySvc, provider.NewHTTPGateway(cfg.DownstreamURL, cfg.DownstreamToken),
+			cfg.AsyncWorkers, cfg.AsyncQueueSize, metrics).
+			WithRetries(cfg.AsyncMaxAttempts, cfg.AsyncRetryBackoff)
+		paymentHandler.WithQueue(paymentQueue)
+	default:
+		log.Fatalf("unknown PROCESSING_MODE %q (want sync or async)", cfg.ProcessingMode)
+	}
+	// Always installed so merchant policies can set limits even when the
+	// deployment default is unlimited.
+	rateLimiter := service.NewRateLimiter(repo, cfg.RateLimitRPS, cfg.RateLimitBurst)
+	paymentHandler.WithRateLimiter(rateLimiter)
+	if cfg.RateLimitRPS > 0 {
+		log.Printf("Rate limiting payments to %g/s per merchant (burst %d)", cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	storms := service.NewStormGuard(repo, cfg.StormThreshold, cfg.StormWindow).WithRecorder(metrics)
+	if audit != nil {
+		storms.WithAudit(audit)
+	}
+	paymentHandler.WithStormGuard(storms)
+	if cfg.StormThreshold > 0 {
+		log.Printf("Throttling keys past %d attempts within %s", cfg.StormThreshold, cfg.StormWindow)
+	}
+	signed := func(h http.HandlerFunc) http.Handler { return h }
+	signedKey := signed
+	if cfg.RequestSigning {
+		verifier := service.NewSignatureVerifier(repo, cfg.SignatureTolerance)
+		signed = func(h http.HandlerFunc) http.Handler { return handler.RequireSignature(verifier, h) }
+		// Completions name only the key, so they are verified for its merchant.
+		keyOwner := func(ctx context.Context, key string) (string, error) {
+			rec, err := repo.GetByKeyPrimary(ctx, key)
+			if err != nil {
+				return "", err
+			}
+			return rec.MerchantID, nil
+		}
+		signedKey = func(h http.HandlerFunc) http.Handler { return handler.RequireKeySignature(verifier, keyOwner, h) }
+		log.Printf("Request signing on: merchants with a signing secret must send %s (tolerance %s)", handler.SignatureHeader, cfg.SignatureTolerance)
+	}
 	reportingHandler := handler.NewReportingHandler(reportingSvc)
-	healthHandler := handler.NewHealthHandler(db, metrics)
+	merchantAnomalies := monitor.NewMerchantAnomalies(cfg.AnomalyWindow, cfg.AnomalyThreshold, cfg.AnomalyMinRequests).
+		WithThresholds(cfg.AnomalyThresholds).
+		WithSinks(monitor.LogSink{})
+	if cfg.AnomalyWebhookURL != "" {
+		merchantAnomalies.WithSinks(webhooks.NewAnomalySink(cfg.AnomalyWebhookURL))
+	}
+	if cfg.AnomalySlackURL != "" {
+		merchantAnomalies.WithSinks(webhooks.NewSlackSink(cfg.AnomalySlackURL))
+	}
+	metrics.WithMerchantAnomalies(merchantAnomalies)
+	anomalyHandler := handler.NewAnomalyHandler(merchantAnomalies)
+	hostname, _ := os.Hostname()
+	healthHandler := handler.NewHealthHandler(pinger, metrics)
+	readinessHandler := handler.NewReadinessHandler(pinger, schema).WithCheckTimeout(cfg.ReadinessTimeout)
+	if pgRepo != nil && cfg.SweepInterval > 0 && cfg.ReadinessMaxExpired > 0 {
+		readinessHandler.WithSweepBacklog(pgRepo, int64(cfg.ReadinessMaxExpired))
+	}
+	var metricsHistory *service.MetricsHistory
+	var featureSvc *service.FeatureService
+	if pgRepo != nil {
+		metricsHistory = service.NewMetricsHistory(pgRepo, metrics, hostname, cfg.MetricsHistoryInterval)
+		healthHandler.WithHistory(metricsHistory)
+		featureSvc = service.NewFeatureService(pgRepo)
+	}
 	policyHandler := handler.NewPolicyHandler(repo)
+	if audit != nil {
+		policyHandler.WithAudit(audit)
+	}
+	dashboardHandler := handler.NewDashboardHandler(reportingSvc, metrics)
+	featureHandler := handler.NewFeatureHandler(featureSvc)
+	webhookHandler := handler.NewWebhookHandler(webhookSvc)
 
-	// Seed data
-	seedData(db)
-
-	// Router
-	mux := http.NewServeMux()
+	// Sample data, never in prod
+	var seeder handler.Seeder
+	if pgRepo != nil {
+		seeder = pgRepo
+	}
+	seedHandler := handler.NewSeedHandler(seeder, cfg.DeployEnv != config.DeployProd)
+	if cfg.SeedOnStart {
+		if pgRepo == nil {
+			log.Fatal("SEED_ON_START requires STORAGE_BACKEND=postgres")
+		}
+		log.Println("Seeding sample data...")
+		if err := pgRepo.Seed(context.Background()); err != nil {
+			log.Printf("Seed data: %v", err)
+		} else {
+			log.Println("Seed data loaded successfully")
+		}
+	}
 
-	// Health
-	mux.HandleFunc("/health", healthHandler.Health)
+	// Background jobs stop when the server shuts down
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	workers := &workerGroup{ctx: bgCtx}
+	anomalies := monitor.NewAnomalyLog(metrics, anomalySampleInterval)
 
-	// Payments
-	mux.HandleFunc("/v1/payments", withMetrics(metrics, paymentHandler.ProcessPayment))
-	mux.HandleFunc("/v1/payments/", func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/complete") {
-			paymentHandler.CompletePayment(w, r)
-			return
+	// Tunables reload without a restart on SIGHUP, or when CONFIG_FILE
+	// changes; the rest of a reloaded configuration waits for one. apply runs
+	// under the watcher's lock, so the rate limits it compares need none.
+	rateLimitRPS, rateLimitBurst := cfg.RateLimitRPS, cfg.RateLimitBurst
+	configWatcher := config.NewWatcher(cfg.ConfigFile, cfg.ConfigReloadInterval, cfg, func(next config.Config) error {
+		level, ok := logging.ParseLevel(next.LogLevel)
+		if !ok {
+			return fmt.Errorf("unknown LOG_LEVEL %q (want debug, info, warn or error)", next.LogLevel)
 		}
-		http.NotFound(w, r)
+		logging.DefaultLevel().Set(level)
+		idempotencySvc.SetExpiryTTL(next.KeyExpiryTTL)
+		if next.RateLimitRPS != rateLimitRPS || next.RateLimitBurst != rateLimitBurst {
+			rateLimiter.SetDefaults(next.RateLimitRPS, next.RateLimitBurst)
+			rateLimitRPS, rateLimitBurst = next.RateLimitRPS, next.RateLimitBurst
+		}
+		merchantAnomalies.SetThresholds(next.AnomalyThreshold, next.AnomalyThresholds)
+		return nil
 	})
+	activeConfig := func() handler.ActiveConfig {
+		active, loadedAt, lastErr := configWatcher.Status()
+		status := handler.ActiveConfig{Source: "environment", LoadedAt: loadedAt, Reloadable: config.Reloadable, Config: active.Masked()}
+		if cfg.ConfigFile != "" {
+			status.Source = cfg.ConfigFile
+		}
+		if lastErr != nil {
+			status.LastReloadError = lastErr.Error()
+		}
+		return status
+	}
+	configHandler := handler.NewConfigHandler(activeConfig)
+	if cfg.ConfigFile != "" {
+		workers.Go("config_watcher", configWatcher.Run)
+		if cfg.ConfigReloadInterval > 0 {
+			log.Printf("Reloading %s on SIGHUP and on change, checked every %s", cfg.ConfigFile, cfg.ConfigReloadInterval)
+		} else {
+			log.Printf("Reloading %s on SIGHUP", cfg.ConfigFile)
+		}
+	}
 
-	// Merchants
-	mux.HandleFunc("/v1/merchants/", func(w http.ResponseWriter, r *http.Request) {
-		path := strings.Trim(r.URL.Path, "/")
-		if strings.HasSuffix(path, "/duplicates") {
-			reportingHandler.GetDuplicates(w, r)
-			return
+	diagnosticsHandler := handler.NewDiagnosticsHandler(pool, metrics, cfg.Masked()).
+		WithConfig(func() map[string]string { return activeConfig().Config }).
+		WithWorkers(workers.Statuses).
+		WithAnomalies(anomalies).
+		WithReadiness(readinessHandler)
+
+	workers.Go("merchant_anomalies", merchantAnomalies.Run)
+
+	// Jobs that must run once per deployment go through singleton, which
+	// with leader election runs them on the leader only.
+	singleton := func(job func(context.Context)) func(context.Context) { return job }
+	if cfg.LeaderElection {
+		if pgRepo == nil {
+			log.Fatal("LEADER_ELECTION requires STORAGE_BACKEND=postgres")
+		}
+		elector := service.NewLeaderElector(pgRepo.LeaderLock("background"), cfg.LeaderElectionInterval).WithRecorder(metrics)
+		workers.Go("leader_election", elector.Run)
+		singleton = elector.Lead
+		log.Printf("Leader election every %s; background cleanup runs on the leader only", cfg.LeaderElectionInterval)
+	}
+
+	var maintenance *service.MaintenanceJob
+	if cfg.MaintenanceInterval > 0 && pgRepo != nil {
+		maintenance = service.NewMaintenanceJob(pgRepo, cfg.MaintenanceInterval)
+		workers.Go("maintenance", singleton(maintenance.Run))
+		log.Printf("DB maintenance job every %s", cfg.MaintenanceInterval)
+	}
+	if cfg.SweepInterval > 0 {
+		sweeper := service.NewSweeper(repo, cfg.SweepInterval, cfg.SweepBatchSize).WithRecorder(metrics)
+		if maintenance != nil {
+			sweeper.WithObserver(maintenance)
 		}
-		if strings.HasSuffix(path, "/policy") {
-			policyHandler.UpdatePolicy(w, r)
-			return
+		if pgRepo != nil {
+			sweeper.WithReservations(pgRepo).WithWebhookEvents(pgRepo, cfg.WebhookEventRetention)
 		}
-		http.NotFound(w, r)
-	})
+		if cfg.ArchiveExpired {
+			if pgRepo == nil {
+				log.Fatal("ARCHIVE_EXPIRED_KEYS requires STORAGE_BACKEND=postgres")
+			}
+			sweeper.WithArchive(pgRepo, cfg.ArchiveRetention)
+			log.Printf("Archiving expired keys every %s, %d at a time, kept for %s", cfg.SweepInterval, cfg.SweepBatchSize, cfg.ArchiveRetention)
+		} else {
+			log.Printf("Deleting expired keys every %s, %d at a time", cfg.SweepInterval, cfg.SweepBatchSize)
+		}
+		workers.Go("expiry_sweeper", singleton(sweeper.Run))
+	}
+
+	workers.Go("digests", singleton(reportingSvc.RunDigests))
+	workers.Go("anomaly_log", anomalies.Run)
+
+	if cfg.MetricsDailyRotation {
+		workers.Go("metrics_rotation", metrics.RunDailyRotation)
+	}
+	if cfg.OTLPMetricsEndpoint != "" {
+		headers, err := otlp.ParseHeaders(cfg.OTLPHeaders)
+		if err != nil {
+			log.Fatalf("OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+		workers.Go("otlp_exporter", otlp.NewExporter(cfg.OTLPMetricsEndpoint, headers, metrics, hostname, cfg.OTLPExportInterval).Run)
+		log.Printf("Exporting metrics over OTLP to %s every %s", cfg.OTLPMetricsEndpoint, cfg.OTLPExportInterval)
+	}
+	if cfg.MetricsHistoryInterval > 0 && metricsHistory != nil {
+		workers.Go("metrics_history", metricsHistory.Run)
+		log.Printf("Flushing metrics to metrics_history every %s as %q", cfg.MetricsHistoryInterval, hostname)
+	}
+
+	if paymentQueue != nil {
+		workers.Go("payment_queue", paymentQueue.Run)
+		log.Printf("Async processing: %d worker(s) submitting to the downstream gateway, queue of %d", cfg.AsyncWorkers, cfg.AsyncQueueSize)
+	}
+
+	if signals != nil {
+		workers.Go("fraud_export", signals.Run)
+		log.Printf("Exporting fraud signals (%s) for merchants with fraud_export enabled", cfg.FraudExportFormat)
+	}
+	if audit != nil {
+		workers.Go("siem_export", audit.Run)
+		log.Printf("Streaming audit events to the SIEM (%s)", cfg.SIEMExportFormat)
+	}
+
+	if cfg.ReconcileProviderURL != "" {
+		if pgRepo == nil {
+			log.Fatal("RECONCILE_PROVIDER_URL requires STORAGE_BACKEND=postgres")
+		}
+		reconciler := service.NewReconciler(pgRepo,
+			provider.NewHTTPProvider(cfg.ReconcileProviderURL, cfg.ReconcileProviderToken),
+			idempotencySvc, cfg.ReconcileInterval, cfg.ReconcileAfter)
+		workers.Go("reconciler", singleton(reconciler.Run))
+		log.Printf("Reconciling payments processing for over %s every %s", cfg.ReconcileAfter, cfg.ReconcileInterval)
+	}
+
+	// Router. Patterns name the method, so the mux answers 405 with an
+	// Allow header for the others; GET patterns also match HEAD. Patterns are
+	// recorded so the OpenAPI document can be checked against them. Every
+	// route takes only JSON bodies, up to MAX_BODY_BYTES.
+	mux := http.NewServeMux()
+	var patterns []string
+	handle := func(pattern string, h http.Handler) {
+		patterns = append(patterns, pattern)
+		mux.Handle(pattern, handler.RequireJSON(cfg.MaxBodyBytes, h))
+	}
+	handleFunc := func(pattern string, h http.HandlerFunc) {
+		handle(pattern, h)
+	}
+
+	// Health
+	handleFunc("GET /health", healthHandler.Health)
+	handleFunc("GET /health/ready", readinessHandler.Ready)
+	handleFunc("GET /livez", readinessHandler.Live)
+	handleFunc("GET /readyz", readinessHandler.Ready)
+
+	// Payments. A key named "batch" can still be read with GET.
+	handle("POST /v1/payments", signed(paymentHandler.ProcessPayment))
+	handleFunc("GET /v1/payments", paymentHandler.FindPayment)
+	handle("POST /v1/payments/batch", signed(paymentHandler.ProcessBatch))
+	handleFunc("GET /v1/payments/{key}", paymentHandler.GetPayment)
+	handleFunc("GET /v1/payments/{key}/attempts", paymentHandler.GetAttempts)
+	handle("PATCH /v1/payments/{key}/complete", signedKey(paymentHandler.CompletePayment))
+	handleFunc("GET /v1/payments/{key}/wait", paymentHandler.WaitForCompletion)
+	handle("POST /v1/idempotency-keys", signed(paymentHandler.ReserveKey))
+
+	// Merchants
+	// Replays name their merchant in the body, signed like its payments.
+	handle("POST /v1/webhooks/replay", signed(webhookHandler.Replay))
+	handleFunc("GET /v1/merchants/{id}/duplicates", reportingHandler.GetDuplicates)
+	handleFunc("GET /v1/merchants/{id}/duplicates/trends", reportingHandler.GetTrends)
+	handleFunc("GET /v1/merchants/{id}/digest", reportingHandler.GetDigest)
+	handleFunc("GET /v1/merchants/{id}/stats", reportingHandler.GetStats)
+	handleFunc("GET /v1/merchants/{id}/anomaly", anomalyHandler.Get)
+	handleFunc("GET /v1/merchants/{id}/policy", policyHandler.UpdatePolicy)
+	// Policies hold signing secrets and limits, so only admins change them.
+	handle("PUT /v1/merchants/{id}/policy", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(policyHandler.UpdatePolicy)))
+	handle("DELETE /v1/merchants/{id}/policy", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(policyHandler.DeletePolicy)))
+	// Bulk policy management spans merchants, so it is admin-only.
+	handle("GET /v1/merchants/policies", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(policyHandler.ListPolicies)))
+	handle("PUT /v1/merchants/policies", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(policyHandler.UpsertPolicies)))
+
+	// Cross-merchant stats are admin-only, like the dashboard.
+	handle("GET /v1/stats", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(reportingHandler.GetStatsTable)))
+	handle("GET /v1/admin/keys", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.SearchKeys)))
+	handle("POST /v1/admin/keys/{key}/expire", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.ExpireKey)))
+	handle("POST /v1/admin/keys/{key}/force-fail", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.ForceFailKey)))
+	handle("POST /v1/admin/keys/{key}/reset", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.ResetKey)))
+	handle("POST /v1/admin/payments/{key}/restore", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.RestoreKey)))
+	handle("POST /v1/admin/seed", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(seedHandler.Seed)))
+	handle("GET /v1/admin/dead-letters", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(paymentHandler.DeadLetters)))
+	handle("GET /v1/admin/webhooks/dead-letters", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(webhookHandler.DeadLetters)))
+	handle("POST /v1/admin/webhooks/dead-letters/{id}/redeliver", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(webhookHandler.Redeliver)))
+	handle("GET /v1/admin/config", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(configHandler.GetConfig)))
 
 	// Metrics
-	mux.HandleFunc("/v1/metrics", healthHandler.Metrics)
-	mux.HandleFunc("/v1/metrics/", func(w http.ResponseWriter, r *http.Request) {
-		healthHandler.Metrics(w, r)
-	})
+	handleFunc("GET /v1/metrics", healthHandler.Metrics)
+	handleFunc("GET /v1/metrics/history", healthHandler.MetricsHistory)
+	handleFunc("GET /v1/metrics/ws", healthHandler.MetricsStream)
+	handle("POST /v1/metrics/reset", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(healthHandler.ResetMetrics)))
+
+	// Admin
+	handle("GET /admin/dashboard", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(dashboardHandler.Page)))
+	handle("GET /admin/dashboard/data", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(dashboardHandler.Data)))
+	handle("GET /admin/export/features", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(featureHandler.Export)))
+	handle("GET /admin/diagnostics", handler.AdminAuth(cfg.AdminToken, http.HandlerFunc(diagnosticsHandler.Bundle)))
+
+	// API documentation, checked against the routes above.
+	openAPIHandler, err := handler.NewOpenAPIHandler(append(patterns, "GET /v1/openapi.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux.HandleFunc("GET /v1/openapi.json", openAPIHandler.Spec)
+	mux.HandleFunc("GET /docs", openAPIHandler.Docs)
 
 	// Apply middleware
-	var h http.Handler = mux
+	h := handler.RequestLogger(logging.DefaultLevel(), mux)
+	h = handler.RecordOutcomes(metrics, h)
 	h = handler.RequestID(h)
 	h = handler.Logging(h)
 	h = handler.Recovery(h)
@@ -99,60 +571,256 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSCertFile == "" && (cfg.TLSClientCAFile != "" || cfg.HTTPRedirectPort != "") {
+		log.Fatal("TLS_CLIENT_CA_FILE and HTTP_REDIRECT_PORT require TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if cfg.TLSClientCAFile != "" {
+		tlsConfig, err := clientCertConfig(cfg.TLSClientCAFile, cfg.TLSClientAuth)
+		if err != nil {
+			log.Fatalf("Client certificates: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+		log.Printf("Verifying client certificates against %s (%s)", cfg.TLSClientCAFile, cfg.TLSClientAuth)
+	}
+	h2s := &http2.Server{IdleTimeout: srv.IdleTimeout}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		log.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+	if cfg.HTTP2Cleartext {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+		log.Println("Accepting cleartext HTTP/2 (h2c)")
+	}
 
-	// Graceful shutdown
+	// Plain HTTP on the redirect port only sends clients to HTTPS.
+	var redirect *http.Server
+	if cfg.HTTPRedirectPort != "" {
+		redirect = &http.Server{
+			Addr:         ":" + cfg.HTTPRedirectPort,
+			Handler:      handler.RedirectToHTTPS(cfg.Port),
+			ReadTimeout:  srv.ReadTimeout,
+			WriteTimeout: srv.WriteTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+		}
+	}
+
+	// Graceful shutdown: fail readiness so load balancers stop routing here,
+	// keep serving through the pre-stop delay, drain in-flight requests, then
+	// stop the background workers and wait for them.
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
-		log.Println("Shutting down...")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		log.Printf("Shutting down: readiness off, draining in %s", cfg.ShutdownDelay)
+		sdnotify.Notify(sdnotify.Stopping)
+		readinessHandler.SetDraining()
+		time.Sleep(cfg.ShutdownDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 		defer cancel()
-		srv.Shutdown(ctx)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: requests still in flight: %v", err)
+		}
+		if redirect != nil {
+			redirect.Shutdown(ctx)
+		}
+		stopBackground()
+		if !workers.Wait(cfg.ShutdownTimeout) {
+			log.Printf("Shutdown: background workers still running after %s", cfg.ShutdownTimeout)
+		}
 	}()
 
+	if cfg.ListenSocket != "" {
+		ln, err := listenUnix(cfg.ListenSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", cfg.ListenSocket, err)
+		}
+		go func() {
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatalf("Server error on %s: %v", cfg.ListenSocket, err)
+			}
+		}()
+		log.Printf("Idempotency Shield listening on unix:%s", cfg.ListenSocket)
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", srv.Addr, err)
+	}
+	if redirect != nil {
+		redirectLn, err := net.Listen("tcp", redirect.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", redirect.Addr, err)
+		}
+		go func() {
+			if err := redirect.Serve(redirectLn); err != http.ErrServerClosed {
+				log.Fatalf("Redirect server error: %v", err)
+			}
+		}()
+		log.Printf("Redirecting HTTP on :%s to HTTPS", cfg.HTTPRedirectPort)
+	}
+
+	// Everything is up: database, migrations, workers and listeners.
+	if ok, err := sdnotify.Notify(sdnotify.Ready); err != nil {
+		log.Printf("sd_notify: %v", err)
+	} else if ok {
+		if interval := sdnotify.WatchdogInterval(); interval > 0 {
+			go sdnotify.RunWatchdog(bgCtx, interval, readinessHandler.Check)
+			log.Printf("Pinging the systemd watchdog every %s while ready", interval)
+		}
+	}
+
 	log.Printf("Idempotency Shield running on :%s", cfg.Port)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	if cfg.TLSCertFile != "" {
+		err = srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-stopped
 	log.Println("Server stopped")
 }
 
-func withMetrics(m *monitor.Metrics, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		sw := &metricsWriter{ResponseWriter: w, status: 200}
-		next(sw, r)
+// redisPoolSize is how many idle Redis connections are kept for reuse.
+const redisPoolSize = 32
 
-		switch sw.status {
-		case 201:
-			m.RecordNew()
-		case 200:
-			m.RecordCached()
-		case 409:
-			m.RecordDuplicate()
-		case 422:
-			m.RecordMismatch()
-		}
+// anomalySampleInterval is how often anomaly episodes are sampled for the
+// support bundle.
+const anomalySampleInterval = 10 * time.Second
+
+// workerGroup runs background jobs on a shared context, lets shutdown wait
+// for them to return and reports their status for diagnostics.
+type workerGroup struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	statuses []*handler.WorkerStatus
+}
+
+// Go runs job, named name, until the group's context is cancelled.
+func (g *workerGroup) Go(name string, job func(context.Context)) {
+	status := &handler.WorkerStatus{Name: name, State: "running", StartedAt: time.Now().UTC()}
+	g.mu.Lock()
+	g.statuses = append(g.statuses, status)
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			stopped := time.Now().UTC()
+			status.State, status.StoppedAt = "stopped", &stopped
+		}()
+		job(g.ctx)
+	}()
+}
+
+// Statuses returns a copy of every worker's status.
+func (g *workerGroup) Statuses() []handler.WorkerStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]handler.WorkerStatus, len(g.statuses))
+	for i, s := range g.statuses {
+		out[i] = *s
 	}
+	return out
 }
 
-type metricsWriter struct {
-	http.ResponseWriter
-	status int
+// Wait reports whether every job returned within timeout.
+func (g *workerGroup) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
-func (w *metricsWriter) WriteHeader(status int) {
-	w.status = status
-	w.ResponseWriter.WriteHeader(status)
+// listenUnix listens on a Unix socket at path, replacing a stale socket left
+// by a previous run. The socket is group-writable so a gateway sidecar in the
+// same group can connect; it is removed when the listener closes.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
-func seedData(db *sql.DB) {
-	log.Println("Seeding sample data...")
-	seedSQL := seed.GenerateSQL()
-	_, err := db.Exec(seedSQL)
+// clientCertConfig verifies client certificates against the CAs in caFile.
+// auth "require" rejects clients without one; "optional" lets them through
+// but still rejects certificates that do not verify.
+func clientCertConfig(caFile, auth string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
 	if err != nil {
-		log.Printf("Seed data (may already exist): %v", err)
-	} else {
-		log.Println("Seed data loaded successfully")
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	cfg := &tls.Config{ClientCAs: pool}
+	switch auth {
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH must be require or optional, got %q", auth)
+	}
+	return cfg, nil
+}
+
+// newRateProvider builds the FX rate source for report normalization. Remote
+// sources are cached and fall back to the static rates until the first fetch
+// succeeds.
+func newRateProvider(cfg config.Config) (fx.RateProvider, error) {
+	spec := cfg.FXStaticRates
+	if spec == "" {
+		spec = fx.DefaultStaticRates
+	}
+	static, err := fx.NewStaticProvider("USD", spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.FXProvider {
+	case "static":
+		return static, nil
+	case "ecb":
+		return fx.NewCachedProvider(fx.NewECBProvider(), static, cfg.FXCacheTTL), nil
+	case "openexchange":
+		if cfg.OpenExchangeAppID == "" {
+			return nil, fmt.Errorf("FX_PROVIDER=openexchange requires OPENEXCHANGE_APP_ID")
+		}
+		return fx.NewCachedProvider(fx.NewOpenExchangeProvider(cfg.OpenExchangeAppID), static, cfg.FXCacheTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown FX_PROVIDER %q (want static, ecb, or openexchange)", cfg.FXProvider)
 	}
 }
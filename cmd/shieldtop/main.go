@@ -0,0 +1,147 @@
+// shieldtop is a terminal monitor for a running Idempotency Shield. It polls the
+// metrics and admin dashboard endpoints and redraws a live summary.
+//
+//	go run ./cmd/shieldtop -addr http://localhost:8080 -token $ADMIN_TOKEN
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+const (
+	clearScreen = "\033[H\033[2J"
+	bold        = "\033[1m"
+	red         = "\033[31m"
+	reset       = "\033[0m"
+)
+
+type dashboardData struct {
+	TopMerchants   []domain.MerchantActivity `json:"top_merchants"`
+	SuspiciousKeys []domain.SuspiciousKey    `json:"suspicious_keys"`
+}
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "shield base URL")
+	token := flag.String("token", os.Getenv("ADMIN_TOKEN"), "admin token for per-merchant data")
+	interval := flag.Duration("interval", 2*time.Second, "refresh interval")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	base := strings.TrimRight(*addr, "/")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		var snap monitor.MetricsSnapshot
+		metricsErr := getJSON(client, base+"/v1/metrics", "", &snap)
+
+		var data dashboardData
+		var dataErr error
+		if *token != "" {
+			dataErr = getJSON(client, base+"/admin/dashboard/data", *token, &data)
+		}
+
+		render(os.Stdout, base, snap, metricsErr, data, dataErr, *token != "")
+
+		select {
+		case <-sigCh:
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getJSON(client *http.Client, url, token string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func render(w io.Writer, base string, snap monitor.MetricsSnapshot, metricsErr error, data dashboardData, dataErr error, hasToken bool) {
+	fmt.Fprint(w, clearScreen)
+	fmt.Fprintf(w, "%sshieldtop%s  %s  %s\n\n", bold, reset, base, time.Now().Format("15:04:05"))
+
+	if metricsErr != nil {
+		fmt.Fprintf(w, "%smetrics unavailable: %v%s\n", red, metricsErr, reset)
+		return
+	}
+
+	anomaly := "no"
+	if snap.AnomalyDetected {
+		anomaly = red + "YES" + reset
+	}
+	window := "5m" // servers from before the window was configurable
+	if snap.WindowSeconds > 0 {
+		window = monitor.WindowLabel(time.Duration(snap.WindowSeconds) * time.Second)
+	}
+	fmt.Fprintf(w, "%-21s%6.1f%%   threshold %.0f%%   anomaly: %s\n",
+		"Duplicate rate ("+window+"):", snap.WindowDupRate, snap.AnomalyThreshold, anomaly)
+	fmt.Fprintf(w, "%-21s%6d   duplicates %d\n", "Requests ("+window+"):", snap.WindowRequests, snap.WindowDuplicates)
+	if len(snap.Windows) > 0 {
+		fmt.Fprintf(w, "%-21s", "Rate by window:")
+		for _, d := range monitor.RateWindows {
+			label := monitor.WindowLabel(d)
+			fmt.Fprintf(w, "%s %.1f%%   ", label, snap.Windows[label].DuplicateRate)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Latency (5m):        p50 %.1fms   p95 %.1fms   p99 %.1fms\n",
+		snap.LatencyP50Ms, snap.LatencyP95Ms, snap.LatencyP99Ms)
+	fmt.Fprintf(w, "Totals:              new %d   blocked %d   cached %d   mismatches %d\n",
+		snap.NewPayments, snap.DuplicateBlocked, snap.CachedResponses, snap.ParamMismatches)
+	fmt.Fprintf(w, "Storage circuit:     %s   slow queries %d\n\n", snap.CircuitState, snap.SlowQueries)
+
+	switch {
+	case !hasToken:
+		fmt.Fprintln(w, "(set -token or ADMIN_TOKEN for per-merchant data)")
+		return
+	case dataErr != nil:
+		fmt.Fprintf(w, "%smerchant data unavailable: %v%s\n", red, dataErr, reset)
+		return
+	}
+
+	fmt.Fprintf(w, "%s%-24s %10s %10s %10s%s\n", bold, "MERCHANT (24h)", "REQUESTS", "UNIQUE", "DUP RATE", reset)
+	for _, m := range data.TopMerchants {
+		fmt.Fprintf(w, "%-24s %10d %10d %9.1f%%\n", m.MerchantID, m.TotalRequests, m.UniquePayments, m.DuplicateRate)
+	}
+
+	if len(data.SuspiciousKeys) > 0 {
+		fmt.Fprintf(w, "\n%s%-28s %-18s %8s %s%s\n", bold, "SUSPICIOUS KEY", "MERCHANT", "ATTEMPTS", "LAST SEEN", reset)
+		for _, k := range data.SuspiciousKeys {
+			line := fmt.Sprintf("%-28s %-18s %8d %s", k.IdempotencyKey, k.MerchantID, k.AttemptCount, k.LastSeenAt.Format("15:04:05"))
+			if k.HighPriority {
+				line = red + line + fmt.Sprintf("  amount %.1fσ", k.AmountZScore) + reset
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
@@ -1,32 +1,384 @@
 package config
 
 import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Deployment tiers for DEPLOY_ENV.
+const (
+	DeployDev     = "dev"
+	DeployStaging = "staging"
+	DeployProd    = "prod"
+)
+
 type Config struct {
-	Port         string
-	DatabaseDSN  string
-	KeyExpiryTTL time.Duration
+	Port               string
+	DatabaseDSN        string
+	KeyExpiryTTL       time.Duration
+	SlowQueryThreshold time.Duration
+	BreakerFailures    int
+	BreakerCooldown    time.Duration
+	ReadReplicaDSNs    []string
+	HedgeDelay         time.Duration
+	// QueryTimeout bounds each Postgres call and LockTimeout the wait for a
+	// key's advisory lock within it; zero disables either.
+	QueryTimeout time.Duration
+	LockTimeout  time.Duration
+	// MaintenanceInterval schedules the DB maintenance job; zero disables it.
+	MaintenanceInterval time.Duration
+	// AdminToken guards the /admin endpoints; empty disables them.
+	AdminToken string
+	// FXProvider selects the rate source: static, ecb, or openexchange.
+	FXProvider        string
+	FXStaticRates     string
+	FXCacheTTL        time.Duration
+	OpenExchangeAppID string
+	ReportCurrency    string
+	// IdempotencyMode is "legacy" (key in the body) or "ietf" (Idempotency-Key
+	// header draft semantics).
+	IdempotencyMode string
+	// ReconcileProviderURL enables the reconciliation worker; empty disables it.
+	ReconcileProviderURL   string
+	ReconcileProviderToken string
+	ReconcileInterval      time.Duration
+	ReconcileAfter         time.Duration
+	// MismatchDetail controls values in 422 mismatch diffs: masked, hashed,
+	// plain, or none.
+	MismatchDetail string
+	// Environment scopes keys, reports and metrics: production or sandbox.
+	Environment string
+	// DeployEnv is the deployment tier: dev, staging or prod. Sample data
+	// is never seeded in prod.
+	DeployEnv string
+	// SeedOnStart loads the sample data when the server starts.
+	SeedOnStart bool
+	// FraudExportURL enables forwarding fraud signals; empty disables it.
+	FraudExportURL    string
+	FraudExportToken  string
+	FraudExportFormat string
+	// MetricsWindow is the sliding window of the duplicate rate.
+	MetricsWindow time.Duration
+	// MetricsDailyRotation resets the counters at UTC midnight, keeping the
+	// previous day.
+	MetricsDailyRotation bool
+	// MetricsHistoryInterval flushes metrics to metrics_history; zero
+	// disables flushing.
+	MetricsHistoryInterval time.Duration
+	// LogLevel is the minimum level logged: debug, info, warn or error.
+	// Requests can override it with X-Log-Level.
+	LogLevel string
+	// LogFormat is text (human-readable lines) or json (one slog record
+	// per line, for log pipelines).
+	LogFormat string
+	// OTLPMetricsEndpoint receives metrics over OTLP/HTTP; empty disables
+	// the exporter. OTLPHeaders is in OTEL_EXPORTER_OTLP_HEADERS format.
+	OTLPMetricsEndpoint string
+	OTLPHeaders         string
+	OTLPExportInterval  time.Duration
+	// ListenSocket is a Unix socket path served in addition to Port;
+	// empty serves TCP only.
+	ListenSocket string
+	// TLSCertFile and TLSKeyFile serve HTTPS, with HTTP/2 negotiated by ALPN.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile verifies client certificates (mTLS) against its CAs;
+	// TLSClientAuth is "require", or "optional" to verify only the
+	// certificates clients present.
+	TLSClientCAFile string
+	TLSClientAuth   string
+	// HTTPRedirectPort serves plain HTTP redirecting to HTTPS on Port;
+	// empty disables it.
+	HTTPRedirectPort string
+	// HTTP2Cleartext accepts HTTP/2 without TLS (h2c, prior knowledge or
+	// Upgrade), for load balancers that speak h2c to trusted backends.
+	HTTP2Cleartext bool
+	// MaxBodyBytes caps request bodies, answered with 413 beyond it; zero
+	// leaves them unbounded.
+	MaxBodyBytes int64
+	// ShutdownDelay keeps serving, with readiness failing, after SIGTERM so
+	// load balancers stop routing here before connections are drained.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds draining in-flight requests, then workers.
+	ShutdownTimeout time.Duration
+	// ReadinessTimeout bounds each readiness check. ReadinessMaxExpired
+	// fails readiness while more expired keys wait for the sweeper; zero
+	// disables the backlog check.
+	ReadinessTimeout    time.Duration
+	ReadinessMaxExpired int
+	// RequireMerchantPolicy rejects payments for merchants without a stored
+	// policy instead of applying defaults.
+	RequireMerchantPolicy bool
+	// ProcessingMode is "sync" (the merchant's worker calls the gateway) or
+	// "async" (payments are queued and submitted to DownstreamURL).
+	ProcessingMode  string
+	DownstreamURL   string
+	DownstreamToken string
+	AsyncWorkers    int
+	AsyncQueueSize  int
+	// AsyncMaxAttempts is how many times a queued payment is submitted
+	// while the gateway errors, AsyncRetryBackoff apart and doubling,
+	// before it is dead-lettered.
+	AsyncMaxAttempts  int
+	AsyncRetryBackoff time.Duration
+	// SIEMExportURL enables streaming audit events to a SIEM; empty disables
+	// it. SIEMExportFormat is json, splunk-hec or syslog.
+	SIEMExportURL    string
+	SIEMExportToken  string
+	SIEMExportFormat string
+	// StorageBackend is postgres, redis, sqlite or memory. The others keep
+	// keys and policies only; features that need Postgres tables are
+	// disabled with them. MemoryMaxKeys bounds the memory backend and
+	// SQLitePath is the sqlite backend's database file.
+	StorageBackend string
+	RedisURL       string
+	MemoryMaxKeys  int
+	SQLitePath     string
+	// SweepInterval schedules deleting expired keys, SweepBatchSize at a
+	// time; zero disables the sweeper.
+	SweepInterval  time.Duration
+	SweepBatchSize int
+	// LeaderElection runs the sweeper, maintenance, digests and reconciler
+	// only on the replica holding a Postgres advisory lock, campaigning
+	// every LeaderElectionInterval.
+	LeaderElection         bool
+	LeaderElectionInterval time.Duration
+	// RateLimitRPS limits each merchant's POST /v1/payments per second,
+	// with bursts of RateLimitBurst (RateLimitRPS rounded up when zero).
+	// Zero leaves merchants unlimited unless their policy sets a limit.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// StormThreshold is how many attempts one idempotency key may make
+	// within StormWindow before further ones are answered 429 with a
+	// growing Retry-After. A merchant's policy may set its own; zero leaves
+	// merchants without one unthrottled.
+	StormThreshold int
+	StormWindow    time.Duration
+	// ProcessingTimeout lets a duplicate take over a key processing for
+	// longer, as if its attempt had failed; zero never does.
+	ProcessingTimeout time.Duration
+	// RequestHashMode is "fields" to compare duplicates by merchant,
+	// customer, amount and currency, or "body" to also compare the rest of
+	// the body as canonical JSON, less HashExcludedFields.
+	RequestHashMode    string
+	HashExcludedFields []string
+	// AnomalyThreshold is the duplicate rate, in percent, over
+	// AnomalyWindow above which a merchant with at least
+	// AnomalyMinRequests requests is anomalous.
+	// AnomalyThresholds overrides it per merchant ("m1=10,m2=35").
+	AnomalyThreshold   float64
+	AnomalyThresholds  map[string]float64
+	AnomalyMinRequests int
+	AnomalyWindow      time.Duration
+	// AnomalyWebhookURL and AnomalySlackURL receive merchant anomaly
+	// alerts besides the log; either may be empty.
+	AnomalyWebhookURL string
+	AnomalySlackURL   string
+	// MaxKeyExpiryTTL bounds the TTL a payment may ask for instead of
+	// KeyExpiryTTL with expiry_hours or Idempotency-Expiry.
+	MaxKeyExpiryTTL time.Duration
+	// KeyReservationTTL is how long POST /v1/idempotency-keys holds a key
+	// for its merchant before the payment must be made.
+	KeyReservationTTL time.Duration
+	// AdminRestoreWindow is how long an admin expire, force-fail or reset
+	// can be undone with POST /v1/admin/payments/{key}/restore.
+	AdminRestoreWindow time.Duration
+	// ArchiveExpired has the sweeper move expired keys and their attempts
+	// to the archive tables, kept for ArchiveRetention, instead of
+	// deleting them.
+	ArchiveExpired   bool
+	ArchiveRetention time.Duration
+	// WebhookEventRetention is how long merchant webhooks are kept for
+	// replays before the sweeper purges them.
+	WebhookEventRetention time.Duration
+	// RequestSigning makes payment requests of merchants with a signing
+	// secret carry an X-Signature whose timestamp is within
+	// SignatureTolerance of the server's clock.
+	RequestSigning     bool
+	SignatureTolerance time.Duration
+	// AmountLimits bounds payment amounts per currency, in minor units, as
+	// {min, max} ("BRL=100:50000000,USD=:1000000"); zero leaves a side open.
+	AmountLimits map[string][2]int64
+	// ConfigFile is read over the environment at start, and read again on
+	// SIGHUP and, every ConfigReloadInterval, when it has changed; zero
+	// reloads on SIGHUP only. A reload applies the fields in Reloadable.
+	ConfigFile           string
+	ConfigReloadInterval time.Duration
 }
 
+// Load reads the configuration from the environment.
 func Load() Config {
-	return Config{
-		Port:         envOrDefault("PORT", "8080"),
-		DatabaseDSN:  envOrDefault("DATABASE_DSN", "postgres://postgres@localhost:5432/idempotency?sslmode=disable"),
-		KeyExpiryTTL: parseDurationHours(envOrDefault("KEY_EXPIRY_HOURS", "24")),
+	return load(os.Getenv)
+}
+
+// LoadFile reads the configuration from the environment overlaid with the
+// file at path, whose values win. The file holds one KEY=VALUE per line,
+// named like the environment variables; blank lines and lines starting
+// with # are skipped, and a value may be quoted.
+func LoadFile(path string) (Config, error) {
+	values, err := readEnvFile(path)
+	if err != nil {
+		return Config{}, err
 	}
+	return load(func(key string) string {
+		if v, ok := values[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	}), nil
 }
 
-func envOrDefault(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
+// readEnvFile parses the KEY=VALUE lines of the file at path.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// envFunc looks up a setting by its environment variable name, returning
+// "" when it is unset.
+type envFunc func(key string) string
+
+func (env envFunc) orDefault(key, fallback string) string {
+	if v := env(key); v != "" {
 		return v
 	}
 	return fallback
 }
 
+func load(env envFunc) Config {
+	return Config{
+		Port:                   env.orDefault("PORT", "8080"),
+		DatabaseDSN:            env.orDefault("DATABASE_DSN", "postgres://postgres@localhost:5432/idempotency?sslmode=disable"),
+		KeyExpiryTTL:           parseDurationHours(env.orDefault("KEY_EXPIRY_HOURS", "24")),
+		MaxKeyExpiryTTL:        time.Duration(parsePositiveInt(env.orDefault("MAX_KEY_EXPIRY_HOURS", "168"), 168)) * time.Hour,
+		KeyReservationTTL:      time.Duration(parsePositiveInt(env.orDefault("KEY_RESERVATION_TTL_MINUTES", "30"), 30)) * time.Minute,
+		AdminRestoreWindow:     time.Duration(parsePositiveInt(env.orDefault("ADMIN_RESTORE_WINDOW_HOURS", "24"), 24)) * time.Hour,
+		ArchiveExpired:         env.orDefault("ARCHIVE_EXPIRED_KEYS", "false") == "true",
+		ArchiveRetention:       time.Duration(parsePositiveInt(env.orDefault("ARCHIVE_RETENTION_DAYS", "90"), 90)) * 24 * time.Hour,
+		WebhookEventRetention:  time.Duration(parsePositiveInt(env.orDefault("WEBHOOK_EVENT_RETENTION_DAYS", "30"), 30)) * 24 * time.Hour,
+		RequestSigning:         env.orDefault("REQUEST_SIGNING", "false") == "true",
+		SignatureTolerance:     time.Duration(parsePositiveInt(env.orDefault("SIGNATURE_TOLERANCE_SECONDS", "300"), 300)) * time.Second,
+		AmountLimits:           parseAmountLimits(env("AMOUNT_LIMITS")),
+		SlowQueryThreshold:     parseDurationMillis(env.orDefault("SLOW_QUERY_MS", "200"), 200),
+		BreakerFailures:        parsePositiveInt(env.orDefault("BREAKER_FAILURES", "5"), 5),
+		BreakerCooldown:        time.Duration(parsePositiveInt(env.orDefault("BREAKER_COOLDOWN_SECONDS", "10"), 10)) * time.Second,
+		ReadReplicaDSNs:        parseList(env("READ_REPLICA_DSNS")),
+		HedgeDelay:             parseDurationMillis(env.orDefault("HEDGE_DELAY_MS", "50"), 50),
+		QueryTimeout:           parseDurationMillis(env.orDefault("QUERY_TIMEOUT_MS", "5000"), 5000),
+		LockTimeout:            parseDurationMillis(env.orDefault("LOCK_TIMEOUT_MS", "2000"), 2000),
+		MaintenanceInterval:    parseDurationMinutes(env.orDefault("MAINTENANCE_INTERVAL_MINUTES", "0")),
+		AdminToken:             env("ADMIN_TOKEN"),
+		FXProvider:             strings.ToLower(env.orDefault("FX_PROVIDER", "static")),
+		FXStaticRates:          env("FX_STATIC_RATES"),
+		FXCacheTTL:             time.Duration(parsePositiveInt(env.orDefault("FX_CACHE_MINUTES", "60"), 60)) * time.Minute,
+		OpenExchangeAppID:      env("OPENEXCHANGE_APP_ID"),
+		ReportCurrency:         strings.ToUpper(env.orDefault("REPORT_CURRENCY", "USD")),
+		IdempotencyMode:        strings.ToLower(env.orDefault("IDEMPOTENCY_MODE", "legacy")),
+		ReconcileProviderURL:   env("RECONCILE_PROVIDER_URL"),
+		ReconcileProviderToken: env("RECONCILE_PROVIDER_TOKEN"),
+		ReconcileInterval:      time.Duration(parsePositiveInt(env.orDefault("RECONCILE_INTERVAL_SECONDS", "60"), 60)) * time.Second,
+		ReconcileAfter:         time.Duration(parsePositiveInt(env.orDefault("RECONCILE_AFTER_MINUTES", "10"), 10)) * time.Minute,
+		MismatchDetail:         strings.ToLower(env.orDefault("MISMATCH_DETAIL", "masked")),
+		Environment:            strings.ToLower(env.orDefault("SHIELD_ENVIRONMENT", "production")),
+		DeployEnv:              strings.ToLower(env.orDefault("DEPLOY_ENV", DeployDev)),
+		SeedOnStart:            env.orDefault("SEED_ON_START", "false") == "true",
+		FraudExportURL:         env("FRAUD_EXPORT_URL"),
+		FraudExportToken:       env("FRAUD_EXPORT_TOKEN"),
+		FraudExportFormat:      strings.ToLower(env.orDefault("FRAUD_EXPORT_FORMAT", "json")),
+		MetricsWindow:          time.Duration(parsePositiveInt(env.orDefault("METRICS_WINDOW_MINUTES", "5"), 5)) * time.Minute,
+		MetricsDailyRotation:   env.orDefault("METRICS_ROTATION", "daily") == "daily",
+		MetricsHistoryInterval: parseDurationMinutes(env.orDefault("METRICS_HISTORY_INTERVAL_MINUTES", "1")),
+		LogLevel:               strings.ToLower(env.orDefault("LOG_LEVEL", "info")),
+		LogFormat:              strings.ToLower(env.orDefault("LOG_FORMAT", "text")),
+		OTLPMetricsEndpoint:    env("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"),
+		OTLPHeaders:            env("OTEL_EXPORTER_OTLP_HEADERS"),
+		ListenSocket:           env("LISTEN_SOCKET"),
+		TLSCertFile:            env("TLS_CERT_FILE"),
+		TLSKeyFile:             env("TLS_KEY_FILE"),
+		TLSClientCAFile:        env("TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:          strings.ToLower(env.orDefault("TLS_CLIENT_AUTH", "require")),
+		HTTPRedirectPort:       env("HTTP_REDIRECT_PORT"),
+		HTTP2Cleartext:         env.orDefault("HTTP2_CLEARTEXT", "false") == "true",
+		MaxBodyBytes:           int64(parseNonNegativeInt(env.orDefault("MAX_BODY_BYTES", "4194304"), 4194304)),
+		ShutdownDelay:          parseDurationSeconds(env.orDefault("SHUTDOWN_DELAY_SECONDS", "0"), 0),
+		ShutdownTimeout:        parseDurationSeconds(env.orDefault("SHUTDOWN_TIMEOUT_SECONDS", "5"), 5),
+		ReadinessTimeout:       parseDurationMillis(env.orDefault("READINESS_TIMEOUT_MS", "1000"), 1000),
+		ReadinessMaxExpired:    parseNonNegativeInt(env.orDefault("READINESS_MAX_EXPIRED_KEYS", "100000"), 100000),
+		RequireMerchantPolicy:  env.orDefault("REQUIRE_MERCHANT_POLICY", "false") == "true",
+		ProcessingMode:         env.orDefault("PROCESSING_MODE", "sync"),
+		DownstreamURL:          env("DOWNSTREAM_URL"),
+		DownstreamToken:        env("DOWNSTREAM_TOKEN"),
+		AsyncWorkers:           parsePositiveInt(env.orDefault("ASYNC_WORKERS", "8"), 8),
+		AsyncQueueSize:         parsePositiveInt(env.orDefault("ASYNC_QUEUE_SIZE", "1000"), 1000),
+		AsyncMaxAttempts:       parsePositiveInt(env.orDefault("ASYNC_MAX_ATTEMPTS", "3"), 3),
+		AsyncRetryBackoff:      parseDurationMillis(env.orDefault("ASYNC_RETRY_BACKOFF_MS", "500"), 500),
+		SIEMExportURL:          env("SIEM_EXPORT_URL"),
+		SIEMExportToken:        env("SIEM_EXPORT_TOKEN"),
+		SIEMExportFormat:       strings.ToLower(env.orDefault("SIEM_EXPORT_FORMAT", "json")),
+		StorageBackend:         strings.ToLower(env.orDefault("STORAGE_BACKEND", "postgres")),
+		RedisURL:               env.orDefault("REDIS_URL", "redis://localhost:6379/0"),
+		MemoryMaxKeys:          parsePositiveInt(env.orDefault("MEMORY_MAX_KEYS", "100000"), 100000),
+		SQLitePath:             env.orDefault("SQLITE_PATH", "idempotency-shield.db"),
+		SweepInterval:          parseDurationMinutes(env.orDefault("SWEEP_INTERVAL_MINUTES", "5")),
+		SweepBatchSize:         parsePositiveInt(env.orDefault("SWEEP_BATCH_SIZE", "1000"), 1000),
+		LeaderElection:         env.orDefault("LEADER_ELECTION", "false") == "true",
+		LeaderElectionInterval: time.Duration(parsePositiveInt(env.orDefault("LEADER_ELECTION_INTERVAL_SECONDS", "15"), 15)) * time.Second,
+		RateLimitRPS:           parseNonNegativeFloat(env("RATE_LIMIT_RPS")),
+		RateLimitBurst:         parsePositiveInt(env("RATE_LIMIT_BURST"), 0),
+		StormThreshold:         parseNonNegativeInt(env.orDefault("STORM_THRESHOLD", "20"), 20),
+		StormWindow:            time.Duration(parsePositiveInt(env.orDefault("STORM_WINDOW_SECONDS", "10"), 10)) * time.Second,
+		ProcessingTimeout:      parseDurationMinutes(env.orDefault("PROCESSING_TIMEOUT_MINUTES", "0")),
+		RequestHashMode:        strings.ToLower(env.orDefault("REQUEST_HASH_MODE", "fields")),
+		HashExcludedFields:     parseList(env("HASH_EXCLUDED_FIELDS")),
+		AnomalyThreshold:       parseNonNegativeFloat(env.orDefault("MERCHANT_ANOMALY_THRESHOLD", "20")),
+		AnomalyThresholds:      parseFloatMap(env("MERCHANT_ANOMALY_THRESHOLDS")),
+		AnomalyMinRequests:     parsePositiveInt(env.orDefault("MERCHANT_ANOMALY_MIN_REQUESTS", "20"), 20),
+		AnomalyWindow:          time.Duration(parsePositiveInt(env.orDefault("MERCHANT_ANOMALY_WINDOW_MINUTES", "5"), 5)) * time.Minute,
+		AnomalyWebhookURL:      env("ANOMALY_WEBHOOK_URL"),
+		AnomalySlackURL:        env("ANOMALY_SLACK_URL"),
+		OTLPExportInterval:     time.Duration(parsePositiveInt(env.orDefault("OTEL_METRIC_EXPORT_INTERVAL", "60000"), 60000)) * time.Millisecond,
+		ConfigFile:             env("CONFIG_FILE"),
+		ConfigReloadInterval:   parseDurationSeconds(env.orDefault("CONFIG_RELOAD_INTERVAL_SECONDS", "0"), 0),
+	}
+}
+
+func envOrDefault(key, fallback string) string {
+	return envFunc(os.Getenv).orDefault(key, fallback)
+}
+
 func parseDurationHours(s string) time.Duration {
 	h, err := strconv.Atoi(s)
 	if err != nil {
@@ -34,3 +386,168 @@ func parseDurationHours(s string) time.Duration {
 	}
 	return time.Duration(h) * time.Hour
 }
+
+func parseDurationMillis(s string, fallback int) time.Duration {
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		ms = fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func parseDurationSeconds(s string, fallback int) time.Duration {
+	secs, err := strconv.Atoi(s)
+	if err != nil || secs < 0 {
+		secs = fallback
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func parsePositiveInt(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// parseNonNegativeFloat returns zero for empty, malformed or negative values.
+func parseNonNegativeInt(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
+
+func parseNonNegativeFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+func parseDurationMinutes(s string) time.Duration {
+	m, err := strconv.Atoi(s)
+	if err != nil || m < 0 {
+		m = 0
+	}
+	return time.Duration(m) * time.Minute
+}
+
+// parseList splits a comma-separated value, dropping empty entries.
+func parseList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parseFloatMap parses "key=value" pairs separated by commas, skipping
+// pairs whose value is not a non-negative number.
+func parseFloatMap(s string) map[string]float64 {
+	out := make(map[string]float64)
+	for _, part := range parseList(s) {
+		k, v, ok := strings.Cut(part, "=")
+		k = strings.TrimSpace(k)
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if !ok || k == "" || err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+			continue
+		}
+		out[k] = f
+	}
+	return out
+}
+
+// parseAmountLimits parses "CUR=min:max" pairs, either side of which may be
+// empty. Malformed pairs, negative bounds and a min above the max are
+// skipped.
+func parseAmountLimits(s string) map[string][2]int64 {
+	out := make(map[string][2]int64)
+	for _, part := range parseList(s) {
+		k, v, ok := strings.Cut(part, "=")
+		k = strings.ToUpper(strings.TrimSpace(k))
+		lo, hi, ok2 := strings.Cut(v, ":")
+		if !ok || !ok2 || k == "" {
+			continue
+		}
+		lower, err1 := parseBound(lo)
+		upper, err2 := parseBound(hi)
+		if err1 != nil || err2 != nil || (upper > 0 && lower > upper) {
+			continue
+		}
+		out[k] = [2]int64{lower, upper}
+	}
+	return out
+}
+
+// parseBound parses an optional non-negative amount; empty is zero.
+func parseBound(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative bound %d", n)
+	}
+	return n, err
+}
+
+// secretFields are shown only as set or unset by Masked.
+var secretFields = map[string]bool{
+	"AdminToken":             true,
+	"OpenExchangeAppID":      true,
+	"ReconcileProviderToken": true,
+	"FraudExportToken":       true,
+	"DownstreamToken":        true,
+	"SIEMExportToken":        true,
+	"OTLPHeaders":            true,
+	"AnomalySlackURL":        true,
+}
+
+// dsnPassword matches the password of a key=value connection string.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// Masked returns the effective configuration by field name, formatted for
+// support bundles. Secrets and the passwords in DSNs and URLs are masked.
+func (c Config) Masked() map[string]string {
+	out := make(map[string]string)
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := fmt.Sprint(v.Field(i).Interface())
+		if list, ok := v.Field(i).Interface().([]string); ok {
+			masked := make([]string, len(list))
+			for j, s := range list {
+				masked[j] = maskCredentials(s)
+			}
+			value = strings.Join(masked, ",")
+		}
+		switch {
+		case secretFields[name] && value != "":
+			value = "****"
+		case !secretFields[name]:
+			value = maskCredentials(value)
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// maskCredentials hides the password in a URL or key=value DSN.
+func maskCredentials(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if pw, ok := u.User.Password(); ok && pw != "" {
+			if masked := strings.Replace(s, ":"+pw+"@", ":****@", 1); masked != s {
+				return masked
+			}
+			return u.Redacted() // the password was percent-encoded
+		}
+	}
+	return dsnPassword.ReplaceAllString(s, "${1}****")
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,6 +15,69 @@ func TestLoad_Defaults(t *testing.T) {
 	os.Unsetenv("PORT")
 	os.Unsetenv("DATABASE_DSN")
 	os.Unsetenv("KEY_EXPIRY_HOURS")
+	os.Unsetenv("SLOW_QUERY_MS")
+	os.Unsetenv("BREAKER_FAILURES")
+	os.Unsetenv("BREAKER_COOLDOWN_SECONDS")
+	os.Unsetenv("FX_PROVIDER")
+	os.Unsetenv("FX_CACHE_MINUTES")
+	os.Unsetenv("REPORT_CURRENCY")
+	os.Unsetenv("IDEMPOTENCY_MODE")
+	os.Unsetenv("RECONCILE_PROVIDER_URL")
+	os.Unsetenv("RECONCILE_INTERVAL_SECONDS")
+	os.Unsetenv("RECONCILE_AFTER_MINUTES")
+	os.Unsetenv("MISMATCH_DETAIL")
+	os.Unsetenv("SHIELD_ENVIRONMENT")
+	os.Unsetenv("FRAUD_EXPORT_URL")
+	os.Unsetenv("FRAUD_EXPORT_FORMAT")
+	os.Unsetenv("METRICS_WINDOW_MINUTES")
+	os.Unsetenv("METRICS_ROTATION")
+	os.Unsetenv("METRICS_HISTORY_INTERVAL_MINUTES")
+	os.Unsetenv("LOG_LEVEL")
+	os.Unsetenv("LOG_FORMAT")
+	os.Unsetenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+	os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+	os.Unsetenv("OTEL_METRIC_EXPORT_INTERVAL")
+	os.Unsetenv("LISTEN_SOCKET")
+	os.Unsetenv("TLS_CERT_FILE")
+	os.Unsetenv("TLS_KEY_FILE")
+	os.Unsetenv("HTTP2_CLEARTEXT")
+	os.Unsetenv("READINESS_TIMEOUT_MS")
+	os.Unsetenv("DEPLOY_ENV")
+	os.Unsetenv("SEED_ON_START")
+	os.Unsetenv("LEADER_ELECTION")
+	os.Unsetenv("LEADER_ELECTION_INTERVAL_SECONDS")
+	os.Unsetenv("KEY_RESERVATION_TTL_MINUTES")
+	os.Unsetenv("ADMIN_RESTORE_WINDOW_HOURS")
+	os.Unsetenv("TLS_CLIENT_CA_FILE")
+	os.Unsetenv("TLS_CLIENT_AUTH")
+	os.Unsetenv("HTTP_REDIRECT_PORT")
+	os.Unsetenv("QUERY_TIMEOUT_MS")
+	os.Unsetenv("LOCK_TIMEOUT_MS")
+	os.Unsetenv("MAX_BODY_BYTES")
+	os.Unsetenv("READINESS_MAX_EXPIRED_KEYS")
+	os.Unsetenv("REQUIRE_MERCHANT_POLICY")
+	os.Unsetenv("PROCESSING_MODE")
+	os.Unsetenv("DOWNSTREAM_URL")
+	os.Unsetenv("ASYNC_WORKERS")
+	os.Unsetenv("ASYNC_QUEUE_SIZE")
+	os.Unsetenv("SIEM_EXPORT_URL")
+	os.Unsetenv("SIEM_EXPORT_FORMAT")
+	os.Unsetenv("STORAGE_BACKEND")
+	os.Unsetenv("REDIS_URL")
+	os.Unsetenv("MEMORY_MAX_KEYS")
+	os.Unsetenv("SWEEP_INTERVAL_MINUTES")
+	os.Unsetenv("SWEEP_BATCH_SIZE")
+	os.Unsetenv("RATE_LIMIT_RPS")
+	os.Unsetenv("RATE_LIMIT_BURST")
+	os.Unsetenv("STORM_THRESHOLD")
+	os.Unsetenv("STORM_WINDOW_SECONDS")
+	os.Unsetenv("CONFIG_FILE")
+	os.Unsetenv("CONFIG_RELOAD_INTERVAL_SECONDS")
+	os.Unsetenv("PROCESSING_TIMEOUT_MINUTES")
+	os.Unsetenv("REQUEST_HASH_MODE")
+	os.Unsetenv("HASH_EXCLUDED_FIELDS")
+	os.Unsetenv("SHUTDOWN_DELAY_SECONDS")
+	os.Unsetenv("SHUTDOWN_TIMEOUT_SECONDS")
 
 	cfg := Load()
 
@@ -23,6 +90,133 @@ func TestLoad_Defaults(t *testing.T) {
 	if cfg.KeyExpiryTTL != 24*time.Hour {
 		t.Errorf("expected 24h TTL, got %v", cfg.KeyExpiryTTL)
 	}
+	if cfg.MaxKeyExpiryTTL != 168*time.Hour {
+		t.Errorf("expected a 168h maximum TTL, got %v", cfg.MaxKeyExpiryTTL)
+	}
+	if cfg.KeyReservationTTL != 30*time.Minute {
+		t.Errorf("expected 30m key reservations, got %v", cfg.KeyReservationTTL)
+	}
+	if cfg.AdminRestoreWindow != 24*time.Hour {
+		t.Errorf("expected admin actions restorable for 24h, got %v", cfg.AdminRestoreWindow)
+	}
+	if cfg.QueryTimeout != 5*time.Second || cfg.LockTimeout != 2*time.Second {
+		t.Errorf("expected 5s query and 2s lock timeouts, got %v %v", cfg.QueryTimeout, cfg.LockTimeout)
+	}
+	if cfg.MaxBodyBytes != 4<<20 {
+		t.Errorf("expected a 4 MiB body limit, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.ArchiveExpired || cfg.ArchiveRetention != 90*24*time.Hour {
+		t.Errorf("expected expired keys deleted and a 90 day archive retention, got %v %v", cfg.ArchiveExpired, cfg.ArchiveRetention)
+	}
+	if cfg.WebhookEventRetention != 30*24*time.Hour {
+		t.Errorf("expected webhook events kept 30 days, got %v", cfg.WebhookEventRetention)
+	}
+	if cfg.RequestSigning || cfg.SignatureTolerance != 5*time.Minute {
+		t.Errorf("expected request signing off with a 5 minute tolerance, got %v %v", cfg.RequestSigning, cfg.SignatureTolerance)
+	}
+	if len(cfg.AmountLimits) != 0 {
+		t.Errorf("expected no amount limits by default, got %v", cfg.AmountLimits)
+	}
+	if cfg.SlowQueryThreshold != 200*time.Millisecond {
+		t.Errorf("expected 200ms slow query threshold, got %v", cfg.SlowQueryThreshold)
+	}
+	if cfg.BreakerFailures != 5 {
+		t.Errorf("expected 5 breaker failures, got %d", cfg.BreakerFailures)
+	}
+	if cfg.BreakerCooldown != 10*time.Second {
+		t.Errorf("expected 10s breaker cooldown, got %v", cfg.BreakerCooldown)
+	}
+	if cfg.FXProvider != "static" || cfg.ReportCurrency != "USD" || cfg.FXCacheTTL != time.Hour {
+		t.Errorf("unexpected FX defaults: %s %s %v", cfg.FXProvider, cfg.ReportCurrency, cfg.FXCacheTTL)
+	}
+	if cfg.IdempotencyMode != "legacy" {
+		t.Errorf("expected legacy idempotency mode, got %s", cfg.IdempotencyMode)
+	}
+	if cfg.ReconcileProviderURL != "" || cfg.ReconcileInterval != time.Minute || cfg.ReconcileAfter != 10*time.Minute {
+		t.Errorf("unexpected reconcile defaults: %q %v %v", cfg.ReconcileProviderURL, cfg.ReconcileInterval, cfg.ReconcileAfter)
+	}
+	if cfg.MismatchDetail != "masked" {
+		t.Errorf("expected masked mismatch detail, got %s", cfg.MismatchDetail)
+	}
+	if cfg.Environment != "production" {
+		t.Errorf("expected production environment, got %s", cfg.Environment)
+	}
+	if cfg.FraudExportURL != "" || cfg.FraudExportFormat != "json" {
+		t.Errorf("unexpected fraud export defaults: %q %s", cfg.FraudExportURL, cfg.FraudExportFormat)
+	}
+	if cfg.MetricsWindow != 5*time.Minute {
+		t.Errorf("expected 5m metrics window, got %v", cfg.MetricsWindow)
+	}
+	if !cfg.MetricsDailyRotation {
+		t.Error("expected daily metrics rotation by default")
+	}
+	if cfg.MetricsHistoryInterval != time.Minute {
+		t.Errorf("expected 1m metrics history interval, got %v", cfg.MetricsHistoryInterval)
+	}
+	if cfg.LogLevel != "info" || cfg.LogFormat != "text" {
+		t.Errorf("expected info text logs, got %s %s", cfg.LogLevel, cfg.LogFormat)
+	}
+	if cfg.OTLPMetricsEndpoint != "" || cfg.OTLPExportInterval != time.Minute {
+		t.Errorf("unexpected OTLP defaults: %q %v", cfg.OTLPMetricsEndpoint, cfg.OTLPExportInterval)
+	}
+	if cfg.ListenSocket != "" {
+		t.Errorf("expected no Unix socket by default, got %q", cfg.ListenSocket)
+	}
+	if cfg.RequireMerchantPolicy {
+		t.Error("expected merchant policies to be optional by default")
+	}
+	if cfg.ProcessingMode != "sync" || cfg.DownstreamURL != "" || cfg.AsyncWorkers != 8 || cfg.AsyncQueueSize != 1000 {
+		t.Errorf("unexpected async defaults: %s %q %d %d", cfg.ProcessingMode, cfg.DownstreamURL, cfg.AsyncWorkers, cfg.AsyncQueueSize)
+	}
+	if cfg.AsyncMaxAttempts != 3 || cfg.AsyncRetryBackoff != 500*time.Millisecond {
+		t.Errorf("unexpected async retry defaults: %d %s", cfg.AsyncMaxAttempts, cfg.AsyncRetryBackoff)
+	}
+	if cfg.SIEMExportURL != "" || cfg.SIEMExportFormat != "json" {
+		t.Errorf("expected SIEM export off with json format, got %q %q", cfg.SIEMExportURL, cfg.SIEMExportFormat)
+	}
+	if cfg.StorageBackend != "postgres" || cfg.RedisURL != "redis://localhost:6379/0" || cfg.MemoryMaxKeys != 100000 || cfg.SQLitePath != "idempotency-shield.db" {
+		t.Errorf("expected the postgres backend by default, got %q %q %d %q", cfg.StorageBackend, cfg.RedisURL, cfg.MemoryMaxKeys, cfg.SQLitePath)
+	}
+	if cfg.SweepInterval != 5*time.Minute || cfg.SweepBatchSize != 1000 {
+		t.Errorf("expected a sweep of 1000 keys every 5m, got %d every %s", cfg.SweepBatchSize, cfg.SweepInterval)
+	}
+	if cfg.LeaderElection || cfg.LeaderElectionInterval != 15*time.Second {
+		t.Errorf("expected leader election off with a 15s interval, got %v %s", cfg.LeaderElection, cfg.LeaderElectionInterval)
+	}
+	if cfg.RateLimitRPS != 0 || cfg.RateLimitBurst != 0 {
+		t.Errorf("expected no default rate limit, got %v/%d", cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	if cfg.StormThreshold != 20 || cfg.StormWindow != 10*time.Second {
+		t.Errorf("expected storms past 20 attempts in 10s throttled, got %d in %s", cfg.StormThreshold, cfg.StormWindow)
+	}
+	if cfg.ConfigFile != "" || cfg.ConfigReloadInterval != 0 {
+		t.Errorf("expected no config file, got %q every %s", cfg.ConfigFile, cfg.ConfigReloadInterval)
+	}
+	if cfg.ProcessingTimeout != 0 {
+		t.Errorf("expected no processing timeout, got %s", cfg.ProcessingTimeout)
+	}
+	if cfg.RequestHashMode != "fields" || cfg.HashExcludedFields != nil {
+		t.Errorf("expected field hashing by default, got %s %v", cfg.RequestHashMode, cfg.HashExcludedFields)
+	}
+	if cfg.AnomalyThreshold != 20 || cfg.AnomalyMinRequests != 20 || cfg.AnomalyWindow != 5*time.Minute || len(cfg.AnomalyThresholds) != 0 {
+		t.Errorf("unexpected merchant anomaly defaults: %v%% of %d over %s, overrides %v",
+			cfg.AnomalyThreshold, cfg.AnomalyMinRequests, cfg.AnomalyWindow, cfg.AnomalyThresholds)
+	}
+	if cfg.TLSCertFile != "" || cfg.HTTP2Cleartext || cfg.TLSClientCAFile != "" || cfg.HTTPRedirectPort != "" {
+		t.Error("expected plain HTTP/1.1 by default")
+	}
+	if cfg.TLSClientAuth != "require" {
+		t.Errorf("expected client certificates required once a CA is set, got %q", cfg.TLSClientAuth)
+	}
+	if cfg.ShutdownDelay != 0 || cfg.ShutdownTimeout != 5*time.Second {
+		t.Errorf("unexpected shutdown defaults: %v %v", cfg.ShutdownDelay, cfg.ShutdownTimeout)
+	}
+	if cfg.DeployEnv != DeployDev || cfg.SeedOnStart {
+		t.Errorf("unexpected deploy defaults: %q seed=%v", cfg.DeployEnv, cfg.SeedOnStart)
+	}
+	if cfg.ReadinessTimeout != time.Second || cfg.ReadinessMaxExpired != 100000 {
+		t.Errorf("unexpected readiness defaults: %v %d", cfg.ReadinessTimeout, cfg.ReadinessMaxExpired)
+	}
 }
 
 func TestLoad_CustomEnv(t *testing.T) {
@@ -48,6 +242,80 @@ func TestLoad_CustomEnv(t *testing.T) {
 	}
 }
 
+func TestLoadFile(t *testing.T) {
+	os.Setenv("PORT", "9090")
+	os.Setenv("KEY_EXPIRY_HOURS", "48")
+	defer func() {
+		os.Unsetenv("PORT")
+		os.Unsetenv("KEY_EXPIRY_HOURS")
+	}()
+	path := filepath.Join(t.TempDir(), "shield.env")
+	os.WriteFile(path, []byte("# tunables\nKEY_EXPIRY_HOURS=12\n\nLOG_LEVEL = \"debug\"\nRATE_LIMIT_RPS='2.5'\n"), 0o600)
+
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KeyExpiryTTL != 12*time.Hour || cfg.LogLevel != "debug" || cfg.RateLimitRPS != 2.5 {
+		t.Errorf("expected the file's values, got %s %q %v", cfg.KeyExpiryTTL, cfg.LogLevel, cfg.RateLimitRPS)
+	}
+	if cfg.Port != "9090" {
+		t.Errorf("expected the environment for keys the file lacks, got port %s", cfg.Port)
+	}
+
+	os.WriteFile(path, []byte("KEY_EXPIRY_HOURS\n"), 0o600)
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("expected the malformed line reported, got %v", err)
+	}
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Error("expected a missing file to fail")
+	}
+}
+
+func TestWatcher_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shield.env")
+	os.WriteFile(path, []byte("KEY_EXPIRY_HOURS=24\n"), 0o600)
+	active, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []Config
+	var refuse bool
+	w := NewWatcher(path, 0, active, func(next Config) error {
+		if refuse {
+			return errors.New("refused")
+		}
+		applied = append(applied, next)
+		return nil
+	})
+
+	os.WriteFile(path, []byte("KEY_EXPIRY_HOURS=6\nMERCHANT_ANOMALY_THRESHOLDS=m1=5\nPORT=9999\n"), 0o600)
+	changed, err := w.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"KeyExpiryTTL", "AnomalyThresholds"}) || len(applied) != 1 {
+		t.Fatalf("expected the tunables applied once, got %v after %d calls", changed, len(applied))
+	}
+	got, _, _ := w.Status()
+	if got.KeyExpiryTTL != 6*time.Hour || got.AnomalyThresholds["m1"] != 5 {
+		t.Errorf("expected the new tunables active, got %s %v", got.KeyExpiryTTL, got.AnomalyThresholds)
+	}
+	if got.Port != active.Port {
+		t.Errorf("expected PORT to wait for a restart, got %s", got.Port)
+	}
+
+	refuse = true
+	os.WriteFile(path, []byte("KEY_EXPIRY_HOURS=1\n"), 0o600)
+	if _, err := w.Reload(); err == nil {
+		t.Fatal("expected the refused reload to fail")
+	}
+	got, _, lastErr := w.Status()
+	if got.KeyExpiryTTL != 6*time.Hour || lastErr == nil {
+		t.Errorf("expected the previous configuration kept and the error reported, got %s %v", got.KeyExpiryTTL, lastErr)
+	}
+}
+
 func TestParseDurationHours_Invalid(t *testing.T) {
 	d := parseDurationHours("not-a-number")
 	if d != 24*time.Hour {
@@ -55,6 +323,64 @@ func TestParseDurationHours_Invalid(t *testing.T) {
 	}
 }
 
+func TestParseDurationMillis(t *testing.T) {
+	if d := parseDurationMillis("50", 200); d != 50*time.Millisecond {
+		t.Errorf("expected 50ms, got %v", d)
+	}
+	if d := parseDurationMillis("bogus", 200); d != 200*time.Millisecond {
+		t.Errorf("expected 200ms fallback, got %v", d)
+	}
+	if d := parseDurationMillis("-5", 200); d != 200*time.Millisecond {
+		t.Errorf("expected 200ms fallback for negative, got %v", d)
+	}
+}
+
+func TestParsePositiveInt(t *testing.T) {
+	if n := parsePositiveInt("7", 5); n != 7 {
+		t.Errorf("expected 7, got %d", n)
+	}
+	if n := parsePositiveInt("0", 5); n != 5 {
+		t.Errorf("expected 5 fallback for zero, got %d", n)
+	}
+	if n := parsePositiveInt("x", 5); n != 5 {
+		t.Errorf("expected 5 fallback, got %d", n)
+	}
+}
+
+func TestParseDurationMinutes(t *testing.T) {
+	if d := parseDurationMinutes("30"); d != 30*time.Minute {
+		t.Errorf("expected 30m, got %v", d)
+	}
+	if d := parseDurationMinutes("nope"); d != 0 {
+		t.Errorf("expected disabled (0), got %v", d)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	got := parseList(" a, ,b ,c")
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("expected [a b c], got %v", got)
+	}
+	if got := parseList(""); len(got) != 0 {
+		t.Errorf("expected empty list, got %v", got)
+	}
+}
+
+func TestParseFloatMap(t *testing.T) {
+	got := parseFloatMap(" m1=10, m2 = 35.5,bad,m3=-1,=4,m4=x")
+	if len(got) != 2 || got["m1"] != 10 || got["m2"] != 35.5 {
+		t.Errorf("expected map[m1:10 m2:35.5], got %v", got)
+	}
+}
+
+func TestParseAmountLimits(t *testing.T) {
+	got := parseAmountLimits("brl=100:50000000, USD=:1000000,JPY=5:,bad,EUR=10,MXN=9:1,CLP=-1:")
+	want := map[string][2]int64{"BRL": {100, 50000000}, "USD": {0, 1000000}, "JPY": {5, 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
 func TestEnvOrDefault(t *testing.T) {
 	os.Unsetenv("TEST_KEY_NONEXISTENT")
 	v := envOrDefault("TEST_KEY_NONEXISTENT", "fallback")
@@ -69,3 +395,26 @@ func TestEnvOrDefault(t *testing.T) {
 		t.Errorf("expected custom, got %s", v)
 	}
 }
+
+func TestMasked(t *testing.T) {
+	cfg := Config{
+		DatabaseDSN:          "postgres://shield:hunter2@db:5432/idempotency?sslmode=disable",
+		ReadReplicaDSNs:      []string{"host=replica user=shield password=hunter2 dbname=idempotency"},
+		AdminToken:           "s3cret",
+		ReconcileProviderURL: "https://provider.example/payments/{payment_id}",
+		KeyExpiryTTL:         24 * time.Hour,
+	}
+	m := cfg.Masked()
+	for field, want := range map[string]string{
+		"DatabaseDSN":          "postgres://shield:****@db:5432/idempotency?sslmode=disable",
+		"ReadReplicaDSNs":      "host=replica user=shield password=**** dbname=idempotency",
+		"AdminToken":           "****",
+		"FraudExportToken":     "",
+		"ReconcileProviderURL": "https://provider.example/payments/{payment_id}",
+		"KeyExpiryTTL":         "24h0m0s",
+	} {
+		if m[field] != want {
+			t.Errorf("%s = %q, want %q", field, m[field], want)
+		}
+	}
+}
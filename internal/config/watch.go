@@ -0,0 +1,165 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloadable lists the fields a Watcher applies while the server runs.
+// Changes to any other field are reported and wait for a restart.
+var Reloadable = []string{
+	"KeyExpiryTTL",
+	"RateLimitRPS",
+	"RateLimitBurst",
+	"AnomalyThreshold",
+	"AnomalyThresholds",
+	"LogLevel",
+}
+
+// Watcher reloads the configuration on SIGHUP and, when it has a file and
+// an interval, whenever the file's modification time changes. It hands the
+// active configuration with the new values of the Reloadable fields to
+// apply; if apply fails, the previous configuration stays active.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	apply    func(Config) error
+
+	mu       sync.Mutex
+	active   Config
+	loadedAt time.Time
+	lastErr  error
+	modTime  time.Time
+}
+
+// NewWatcher creates a Watcher over active, the configuration the server
+// started with, reading it again from the environment and the file at path,
+// if any.
+func NewWatcher(path string, interval time.Duration, active Config, apply func(Config) error) *Watcher {
+	w := &Watcher{path: path, interval: interval, apply: apply, active: active, loadedAt: time.Now().UTC()}
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			w.modTime = info.ModTime()
+		}
+	}
+	return w
+}
+
+// Run reloads on SIGHUP, and polls the file every interval, until ctx is
+// done.
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if w.path != "" && w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("Config: SIGHUP received, reloading")
+			w.Reload()
+		case <-poll:
+			if w.fileChanged() {
+				log.Printf("Config: %s changed, reloading", w.path)
+				w.Reload()
+			}
+		}
+	}
+}
+
+// fileChanged reports whether the file's modification time moved since it
+// was last seen.
+func (w *Watcher) fileChanged() bool {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if info.ModTime().Equal(w.modTime) {
+		return false
+	}
+	w.modTime = info.ModTime()
+	return true
+}
+
+// Reload reads the configuration again and applies the Reloadable fields
+// that changed, returning the names of those applied.
+func (w *Watcher) Reload() ([]string, error) {
+	next := Load()
+	var err error
+	if w.path != "" {
+		next, err = LoadFile(w.path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.lastErr = err
+		log.Printf("Config: reload failed, keeping the active configuration: %v", err)
+		return nil, err
+	}
+
+	merged := w.active
+	applied, restart := mergeReloadable(&merged, next)
+	if len(restart) > 0 {
+		log.Printf("Config: %s changed; restart to apply", strings.Join(restart, ", "))
+	}
+	if len(applied) > 0 {
+		if err := w.apply(merged); err != nil {
+			w.lastErr = err
+			log.Printf("Config: reload failed, keeping the active configuration: %v", err)
+			return nil, err
+		}
+		w.active = merged
+		log.Printf("Config: applied %s", strings.Join(applied, ", "))
+	}
+	w.loadedAt = time.Now().UTC()
+	w.lastErr = nil
+	return applied, nil
+}
+
+// mergeReloadable copies into active the Reloadable fields that differ in
+// next, returning their names and those of the other fields that differ.
+func mergeReloadable(active *Config, next Config) (applied, restart []string) {
+	reloadable := make(map[string]bool, len(Reloadable))
+	for _, name := range Reloadable {
+		reloadable[name] = true
+	}
+	a, n := reflect.ValueOf(active).Elem(), reflect.ValueOf(next)
+	for i := 0; i < n.NumField(); i++ {
+		if reflect.DeepEqual(a.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		name := n.Type().Field(i).Name
+		if reloadable[name] {
+			a.Field(i).Set(n.Field(i))
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return applied, restart
+}
+
+// Status returns the active configuration, when it was last (re)loaded,
+// and the error of the last reload if it failed.
+func (w *Watcher) Status() (active Config, loadedAt time.Time, lastErr error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active, w.loadedAt, w.lastErr
+}
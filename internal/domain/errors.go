@@ -1,6 +1,10 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	// ErrDuplicateProcessing is returned when a key is already being processed.
@@ -15,6 +19,9 @@ var (
 	// ErrKeyNotFound is returned when an idempotency key does not exist.
 	ErrKeyNotFound = errors.New("idempotency key not found")
 
+	// ErrPaymentNotFound is returned when no key was issued a payment ID.
+	ErrPaymentNotFound = errors.New("payment not found")
+
 	// ErrKeyExpired is returned when a key is past its expiration window.
 	ErrKeyExpired = errors.New("idempotency key has expired")
 
@@ -23,4 +30,171 @@ var (
 
 	// ErrMerchantNotFound is returned when a merchant policy is not found.
 	ErrMerchantNotFound = errors.New("merchant not found")
+
+	// ErrMerchantNotOnboarded is returned for payments from a merchant without
+	// a policy when policies are required.
+	ErrMerchantNotOnboarded = errors.New("merchant has no policy; onboard it with PUT /v1/merchants/{id}/policy")
+
+	// ErrDigestNotFound is returned when no digest is stored for a merchant and day.
+	ErrDigestNotFound = errors.New("digest not found")
+
+	// ErrDigestNotReady is returned when a digest is requested for a day that has not ended.
+	ErrDigestNotReady = errors.New("digest is only available for days that have ended (UTC)")
+
+	// ErrKeyReserved is returned when a key is reserved for another merchant.
+	ErrKeyReserved = errors.New("idempotency key is reserved for another merchant")
+
+	// ErrKeyInUse is returned when reserving a key a payment already uses.
+	ErrKeyInUse = errors.New("idempotency key is already used by a payment")
+
+	// ErrNothingToRestore is returned when restoring a key no admin action
+	// changed, or whose restore window has passed.
+	ErrNothingToRestore = errors.New("no admin action on this key can be restored")
+
+	// ErrKeyReused is returned when restoring a key a payment has used since
+	// the admin action; restoring it would overwrite that payment.
+	ErrKeyReused = errors.New("idempotency key was used again after the admin action")
+
+	// ErrDeadLetterNotFound is returned when no webhook dead letter has the
+	// requested ID.
+	ErrDeadLetterNotFound = errors.New("webhook dead letter not found")
+
+	// ErrWebhookDelivery is returned when a webhook endpoint refused or
+	// could not be reached.
+	ErrWebhookDelivery = errors.New("webhook delivery failed")
+
+	// ErrReplayTooLarge is returned when a webhook replay would resend more
+	// than MaxWebhookReplay events.
+	ErrReplayTooLarge = errors.New("webhook replay covers too many events")
+
+	// ErrPaymentIDConflict is returned when a generated payment ID is already
+	// taken; the caller should generate another.
+	ErrPaymentIDConflict = errors.New("payment ID already in use")
+
+	// ErrConcurrentUpdate is returned when a record changed between being
+	// read and being written; the request should be retried.
+	ErrConcurrentUpdate = errors.New("payment was updated concurrently; retry the request")
+
+	// ErrInvalidStoredResponse is returned when a completion's response_status
+	// or response_headers cannot be replayed.
+	ErrInvalidStoredResponse = fmt.Errorf("response_status must be between 200 and 599, and response_headers at most %d headers the shield does not set itself", MaxStoredHeaders)
+
+	// ErrInvalidSignature is returned when a request of a merchant with a
+	// signing secret is unsigned or its signature does not match the body.
+	ErrInvalidSignature = errors.New("X-Signature is missing or does not match the request body")
+
+	// ErrSignatureExpired is returned when a signed request's timestamp is
+	// missing or outside the accepted window, as a replayed request's is.
+	ErrSignatureExpired = errors.New("X-Signature-Timestamp is missing or outside the accepted window")
+
+	// ErrUnavailable is returned when storage is temporarily unavailable.
+	ErrUnavailable = errors.New("service temporarily unavailable")
+
+	// ErrQueueFull is returned when the async processing queue has no room.
+	// It matches ErrUnavailable: the client should back off and retry.
+	ErrQueueFull = fmt.Errorf("%w: processing queue is full", ErrUnavailable)
+
+	// ErrStoreFull is returned when the in-memory store holds as many live
+	// keys as it may. Like ErrQueueFull it matches ErrUnavailable.
+	ErrStoreFull = fmt.Errorf("%w: key store is full", ErrUnavailable)
+
+	// ErrTimeout is returned when storage does not answer within the query
+	// timeout. The call may still have taken effect, so clients retry with
+	// the same key.
+	ErrTimeout = errors.New("storage did not answer in time")
+
+	// ErrLockTimeout is returned when another request for the same key held
+	// its lock longer than the lock wait budget. It matches ErrTimeout.
+	ErrLockTimeout = fmt.Errorf("%w: another request for this key held it too long", ErrTimeout)
 )
+
+// ResponseSchemaError is returned when a completion's response body does not
+// satisfy the merchant's registered response schema.
+type ResponseSchemaError struct {
+	Problems []string
+}
+
+func (e *ResponseSchemaError) Error() string {
+	return "response_body does not match the merchant's response schema: " + strings.Join(e.Problems, "; ")
+}
+
+// FieldDiff is one parameter that differs between the stored payment and a
+// retried request. Values are masked or hashed by the service per config and
+// omitted entirely when they must not be disclosed.
+type FieldDiff struct {
+	Field     string `json:"field"`
+	Stored    string `json:"stored,omitempty"`
+	Submitted string `json:"submitted,omitempty"`
+}
+
+// MismatchError is ErrParamsMismatch annotated with the fields that differ.
+type MismatchError struct {
+	Fields []FieldDiff
+}
+
+func (e *MismatchError) Error() string {
+	names := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		names[i] = f.Field
+	}
+	return ErrParamsMismatch.Error() + ": " + strings.Join(names, ", ")
+}
+
+// Is makes errors.Is(err, ErrParamsMismatch) hold for a MismatchError.
+func (e *MismatchError) Is(target error) bool {
+	return target == ErrParamsMismatch
+}
+
+// ValidationError is returned when a request field fails validation.
+// Rule is "required", "non_negative", "positive", "currency", "charset",
+// "object", "min" with Min, or "max", "max_length" or "max_size" with Max.
+type ValidationError struct {
+	Field string
+	Rule  string
+	Min   int
+	Max   int
+}
+
+func (e *ValidationError) Error() string {
+	switch e.Rule {
+	case "non_negative":
+		return fmt.Sprintf("%s must be non-negative", e.Field)
+	case "positive":
+		return fmt.Sprintf("%s must be positive", e.Field)
+	case "currency":
+		return fmt.Sprintf("%s must be an ISO 4217 currency code", e.Field)
+	case "charset":
+		return fmt.Sprintf("%s must be printable ASCII", e.Field)
+	case "min":
+		return fmt.Sprintf("%s must be at least %d", e.Field, e.Min)
+	case "max":
+		return fmt.Sprintf("%s must be at most %d", e.Field, e.Max)
+	case "max_length":
+		return fmt.Sprintf("%s must be at most %d characters", e.Field, e.Max)
+	case "max_size":
+		return fmt.Sprintf("%s must be at most %d bytes", e.Field, e.Max)
+	case "object":
+		return fmt.Sprintf("%s must be a JSON object", e.Field)
+	}
+	return fmt.Sprintf("%s is required", e.Field)
+}
+
+// ValidationErrors is every rule a request failed, in field order. It
+// unwraps to its errors, so errors.As finds the first ValidationError.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, v := range e {
+		errs[i] = v
+	}
+	return errs
+}
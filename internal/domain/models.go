@@ -1,9 +1,14 @@
 package domain
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 )
 
@@ -15,6 +20,13 @@ const (
 	StatusFailed     Status = "failed"
 )
 
+// Environments a deployment can scope its keys to. Keys are unique per
+// environment, so a sandbox test never collides with a production key.
+const (
+	EnvironmentProduction = "production"
+	EnvironmentSandbox    = "sandbox"
+)
+
 // PaymentRequest is the incoming request to validate idempotency.
 type PaymentRequest struct {
 	IdempotencyKey string `json:"idempotency_key"`
@@ -22,15 +34,93 @@ type PaymentRequest struct {
 	CustomerID     string `json:"customer_id"`
 	Amount         int64  `json:"amount"`
 	Currency       string `json:"currency"`
+	// ExpiryHours, when positive, keeps the key this long instead of the
+	// deployment's TTL, up to the merchant's or deployment's maximum. It is
+	// not part of Hash or the body hash.
+	ExpiryHours int `json:"expiry_hours,omitempty"`
+	// Metadata is an optional JSON object of the caller's own, such as an
+	// order ID or sales channel, stored with the key. It is part of Hash
+	// only when HashMetadata is set, from the merchant's policy.
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+	HashMetadata bool            `json:"-"`
+	// Source is filled in by the HTTP layer, never from the body, and is not
+	// part of Hash.
+	Source AttemptSource `json:"-"`
+	// Body is the raw JSON the request was decoded from, kept by the HTTP
+	// layer for body hashing. BodyHash is the CanonicalBodyHash of the body
+	// fields Hash does not cover, set by the service when body hashing is
+	// enabled.
+	Body     json.RawMessage `json:"-"`
+	BodyHash string          `json:"-"`
+}
+
+// AttemptSource identifies where a single payment attempt came from.
+type AttemptSource struct {
+	IP        string
+	UserAgent string
+	RequestID string
 }
 
-// Hash returns a SHA-256 hex digest of the canonical payment parameters.
+// Hash returns a SHA-256 hex digest of the canonical payment parameters,
+// and of the canonical metadata when HashMetadata is set.
 func (p PaymentRequest) Hash() string {
 	canonical := fmt.Sprintf("%s|%s|%d|%s", p.MerchantID, p.CustomerID, p.Amount, p.Currency)
+	if p.HashMetadata {
+		canonical += "|" + string(CanonicalMetadata(p.Metadata))
+	}
 	h := sha256.Sum256([]byte(canonical))
 	return fmt.Sprintf("%x", h)
 }
 
+// MaxMetadataBytes bounds a request's metadata object.
+const MaxMetadataBytes = 4096
+
+// CanonicalMetadata returns metadata as canonical JSON, keys sorted and
+// whitespace dropped, so equal objects compare equal however they were
+// written. Absent metadata and metadata that does not decode are returned
+// as they are.
+func CanonicalMetadata(metadata json.RawMessage) []byte {
+	if len(metadata) == 0 {
+		return nil
+	}
+	v, err := decodeJSON(metadata)
+	if err != nil {
+		return metadata
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return metadata
+	}
+	return canonical
+}
+
+// CanonicalBodyHash returns a SHA-256 hex digest of body as canonical JSON:
+// object keys sorted at every level, whitespace dropped and numbers kept as
+// written. idempotency_key, expiry_hours and the top-level fields in
+// excluded are left out, so retries may differ in them.
+func CanonicalBodyHash(body []byte, excluded []string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", fmt.Errorf("canonical body: %w", err)
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		delete(obj, "idempotency_key")
+		delete(obj, "expiry_hours")
+		for _, field := range excluded {
+			delete(obj, field)
+		}
+	}
+	// encoding/json writes map keys in sorted order.
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("canonical body: %w", err)
+	}
+	h := sha256.Sum256(canonical)
+	return fmt.Sprintf("%x", h), nil
+}
+
 // IdempotencyRecord is a stored idempotency key row.
 type IdempotencyRecord struct {
 	ID             int64            `json:"id"`
@@ -41,13 +131,31 @@ type IdempotencyRecord struct {
 	Currency       string           `json:"currency"`
 	Status         Status           `json:"status"`
 	RequestHash    string           `json:"request_hash"`
+	// BodyHash is the request's BodyHash, empty when the record was stored
+	// without body hashing.
+	BodyHash string `json:"body_hash,omitempty"`
+	// Metadata is the metadata object the key was created with.
+	Metadata       json.RawMessage  `json:"metadata,omitempty"`
 	ResponseBody   *json.RawMessage `json:"response_body,omitempty"`
+	// ResponseStatus and ResponseHeaders complete the stored response when
+	// the completion sent them; zero means only the body was stored.
+	ResponseStatus  int               `json:"response_status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
 	PaymentID      string           `json:"payment_id"`
 	AttemptCount   int              `json:"attempt_count"`
+	// Version increases with every status change; writes that depend on the
+	// status a record was read with compare it first.
+	Version        int64            `json:"version"`
 	FirstSeenAt    time.Time        `json:"first_seen_at"`
 	LastSeenAt     time.Time        `json:"last_seen_at"`
+	// ProcessingSince is when the record last entered processing, on insert
+	// or on a reset; duplicates do not move it.
+	ProcessingSince time.Time `json:"processing_since"`
 	CompletedAt    *time.Time       `json:"completed_at,omitempty"`
 	ExpiresAt      time.Time        `json:"expires_at"`
+	// DistinctSources is the number of distinct source IPs seen for the key;
+	// only duplicate reports fill it in.
+	DistinctSources int `json:"distinct_sources,omitempty"`
 }
 
 // IsExpired reports whether the record has passed its expiration time.
@@ -57,27 +165,215 @@ func (r IdempotencyRecord) IsExpired() bool {
 
 // PaymentResponse is returned from the POST /v1/payments endpoint.
 type PaymentResponse struct {
-	PaymentID      string           `json:"payment_id"`
-	IdempotencyKey string           `json:"idempotency_key"`
-	Status         Status           `json:"status"`
-	Message        string           `json:"message"`
-	AttemptCount   int              `json:"attempt_count"`
-	ResponseBody   *json.RawMessage `json:"response_body,omitempty"`
+	PaymentID         string           `json:"payment_id"`
+	IdempotencyKey    string           `json:"idempotency_key"`
+	Status            Status           `json:"status"`
+	Code              string           `json:"code"`
+	Message           string           `json:"message"`
+	Duplicate         bool             `json:"duplicate,omitempty"`
+	Retryable         bool             `json:"retryable,omitempty"`
+	RetryAfterSeconds int              `json:"retry_after_seconds,omitempty"`
+	AttemptCount      int              `json:"attempt_count"`
+	ResponseBody      *json.RawMessage `json:"response_body,omitempty"`
+	// EstimatedCompletionAt is when a key still processing is expected to
+	// complete, from the merchant's recent completion latency.
+	EstimatedCompletionAt *time.Time `json:"estimated_completion_at,omitempty"`
+	// Metadata is the key's stored metadata; only lookups fill it in.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// Replay, when set, is written instead of this response: the exact
+	// response a succeeded payment completed with.
+	Replay *StoredResponse `json:"-"`
+}
+
+// ReserveKeyRequest is the body for POST /v1/idempotency-keys. Without an
+// idempotency key the server generates one.
+type ReserveKeyRequest struct {
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	MerchantID     string `json:"merchant_id"`
+}
+
+// KeyReservation is an idempotency key held for a merchant's payment until
+// ExpiresAt. The merchant's first payment with the key claims it.
+type KeyReservation struct {
+	IdempotencyKey string    `json:"idempotency_key"`
+	MerchantID     string    `json:"merchant_id"`
+	ReservedAt     time.Time `json:"reserved_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
 }
 
 // CompleteRequest is the body for PATCH /v1/payments/{key}/complete.
+// ResponseStatus and ResponseHeaders are optional; with a status, succeeded
+// duplicates replay the stored response instead of a PaymentResponse.
 type CompleteRequest struct {
-	Status       Status           `json:"status"`
-	ResponseBody *json.RawMessage `json:"response_body,omitempty"`
+	Status          Status            `json:"status"`
+	ResponseBody    *json.RawMessage  `json:"response_body,omitempty"`
+	ResponseStatus  int               `json:"response_status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+}
+
+// MaxBatchSize bounds the payments in one POST /v1/payments/batch.
+const MaxBatchSize = 500
+
+// MaxStoredHeaders bounds the headers a completion may store for replay.
+const MaxStoredHeaders = 32
+
+// StoredResponse is the HTTP response a payment completed with. A zero
+// Status means only the body was stored.
+type StoredResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    *json.RawMessage
+}
+
+// Response returns the response stored on a completed record.
+func (r IdempotencyRecord) Response() StoredResponse {
+	return StoredResponse{Status: r.ResponseStatus, Headers: r.ResponseHeaders, Body: r.ResponseBody}
+}
+
+// Equal reports whether r and other replay the same response. Bodies are
+// compared as JSON values, since the store may reformat them (JSONB drops
+// whitespace and reorders keys).
+func (r StoredResponse) Equal(other StoredResponse) bool {
+	if r.Status != other.Status || len(r.Headers) != len(other.Headers) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if v, ok := other.Headers[name]; !ok || v != value {
+			return false
+		}
+	}
+	if r.Body == nil || other.Body == nil {
+		return r.Body == nil && other.Body == nil
+	}
+	a, errA := decodeJSON(*r.Body)
+	b, errB := decodeJSON(*other.Body)
+	return errA == nil && errB == nil && reflect.DeepEqual(a, b)
+}
+
+// decodeJSON decodes data keeping numbers as written.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
 }
 
 // MerchantPolicy holds per-merchant idempotency configuration.
 type MerchantPolicy struct {
-	MerchantID  string    `json:"merchant_id"`
-	RetryPolicy string    `json:"retry_policy"`
-	ExpiryHours int       `json:"expiry_hours"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	MerchantID  string `json:"merchant_id"`
+	RetryPolicy string `json:"retry_policy"`
+	ExpiryHours int    `json:"expiry_hours"`
+	// ResponseSchema is an optional JSON Schema that succeeded responses'
+	// bodies must satisfy before they are stored.
+	ResponseSchema *json.RawMessage `json:"response_schema,omitempty"`
+	// DuplicateStatusCode is returned for a duplicate of a payment still
+	// processing: 409 (default) or 200 for clients that treat non-2xx as fatal.
+	DuplicateStatusCode int `json:"duplicate_status_code"`
+	// TolerantFields may differ on a retried request without a params
+	// mismatch; only TolerableFields are accepted.
+	TolerantFields []string  `json:"tolerant_fields"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// BaseCurrency is the ISO 4217 code reports consolidate amounts into;
+	// empty uses the deployment's reporting currency.
+	BaseCurrency string `json:"base_currency,omitempty"`
+	// FraudExport forwards the merchant's fraud signals to the configured
+	// fraud system.
+	FraudExport bool `json:"fraud_export"`
+	// PaymentIDFormat is a template for new payment IDs such as kubo_<ulid>;
+	// empty uses the default pay_<ulid>. See ValidPaymentIDFormat.
+	PaymentIDFormat string `json:"payment_id_format,omitempty"`
+	// DuplicateAlertThreshold, when positive, posts a DuplicateAlert to
+	// DuplicateAlertURL for each day whose digest counts more duplicates.
+	DuplicateAlertThreshold int    `json:"duplicate_alert_threshold,omitempty"`
+	DuplicateAlertURL       string `json:"duplicate_alert_url,omitempty"`
+	// RateLimitRPS, when positive, replaces the deployment's limit on the
+	// merchant's payment requests per second. RateLimitBurst defaults to
+	// RateLimitRPS rounded up.
+	RateLimitRPS   float64 `json:"rate_limit_rps,omitempty"`
+	RateLimitBurst int     `json:"rate_limit_burst,omitempty"`
+	// MaxExpiryHours, when positive, caps the expiry_hours the merchant's
+	// payments may ask for below the deployment's maximum.
+	MaxExpiryHours int `json:"max_expiry_hours,omitempty"`
+	// SigningSecret, when set, is the HMAC key the merchant's payment
+	// requests must be signed with. It is never returned by the API.
+	SigningSecret string `json:"signing_secret,omitempty"`
+	// HashMetadata makes a request's metadata part of its hash, so a retry
+	// with different metadata is a params mismatch.
+	HashMetadata bool `json:"hash_metadata"`
+	// StormThreshold, when positive, replaces the deployment's count of
+	// attempts one key may take within the storm window before more are
+	// throttled with 429.
+	StormThreshold int `json:"storm_threshold,omitempty"`
+	// MismatchBehavior is what a retry whose parameters differ from its
+	// key's does: one of the Mismatch constants, empty for MismatchReject.
+	MismatchBehavior string `json:"mismatch_behavior,omitempty"`
+}
+
+// Placeholders of a PaymentIDFormat; each format has exactly one.
+const (
+	PaymentIDULID  = "<ulid>"
+	PaymentIDUUID  = "<uuid>"
+	PaymentIDNanos = "<nanos>"
+)
+
+// maxPaymentIDLiteral bounds the fixed text around the placeholder.
+const maxPaymentIDLiteral = 32
+
+// ValidPaymentIDFormat reports whether format is one placeholder surrounded
+// by at most 32 letters, digits, '_' or '-' in total.
+func ValidPaymentIDFormat(format string) bool {
+	var placeholder string
+	for _, p := range []string{PaymentIDULID, PaymentIDUUID, PaymentIDNanos} {
+		if strings.Count(format, p) > 0 {
+			if placeholder != "" || strings.Count(format, p) > 1 {
+				return false
+			}
+			placeholder = p
+		}
+	}
+	if placeholder == "" {
+		return false
+	}
+	literal := strings.Replace(format, placeholder, "", 1)
+	if len(literal) > maxPaymentIDLiteral {
+		return false
+	}
+	for _, c := range literal {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// What a retry whose parameters differ from its key's does. A key reused by
+// another merchant is always rejected.
+const (
+	// MismatchReject answers them 422 params_mismatch, the default.
+	MismatchReject = "reject"
+	// MismatchAcceptLatest replaces the key's parameters with the retry's,
+	// restarting a failed payment as a new one under them. A succeeded
+	// payment is never restarted; it answers from its record.
+	MismatchAcceptLatest = "accept_latest"
+	// MismatchAcceptIfNotCompleted replaces them while the payment is still
+	// processing and rejects them once it has completed.
+	MismatchAcceptIfNotCompleted = "accept_if_not_completed"
+)
+
+// TolerableFields are the request fields a merchant policy may list in
+// TolerantFields. Amount and merchant are never tolerated.
+var TolerableFields = []string{"customer_id", "currency"}
+
+// IsTolerable reports whether field may be listed in TolerantFields.
+func IsTolerable(field string) bool {
+	for _, f := range TolerableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
 }
 
 // DuplicateReport is a summary for a merchant's duplicate activity.
@@ -89,19 +385,318 @@ type DuplicateReport struct {
 	DuplicateRate     float64             `json:"duplicate_rate"`
 	SuspiciousKeys    []SuspiciousKey     `json:"suspicious_keys"`
 	TimeRange         TimeRange           `json:"time_range"`
-	AmountAtRisk      int64               `json:"amount_at_risk"`
+	// AmountAtRisk totals the amounts at risk in ReportingCurrency, minor
+	// units. It is omitted when the duplicates are in several currencies
+	// that cannot all be converted; CurrencyBreakdown has them per currency.
+	AmountAtRisk      *int64              `json:"amount_at_risk,omitempty"`
+	ReportingCurrency string              `json:"reporting_currency,omitempty"`
 	CurrencyBreakdown map[string]int64    `json:"currency_breakdown"`
+	// Normalized is the amount at risk converted to the reporting currency,
+	// omitted when no FX rates are available.
+	Normalized *NormalizedAmount `json:"normalized_amount_at_risk,omitempty"`
+	// Page is set when the duplicates were paginated; SuspiciousKeys then
+	// covers only the duplicates on this page. The other totals always cover
+	// the whole range.
+	Page *PageInfo `json:"page,omitempty"`
+}
+
+// Page selects part of a listing. A zero Limit means no limit.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// PageInfo describes the part of a listing a response holds. NextOffset is
+// omitted on the last page.
+type PageInfo struct {
+	Limit      int  `json:"limit"`
+	Offset     int  `json:"offset"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// NewPageInfo describes a page of n items out of total.
+func NewPageInfo(page Page, n, total int) *PageInfo {
+	info := &PageInfo{Limit: page.Limit, Offset: page.Offset, Total: total}
+	if next := page.Offset + n; n > 0 && next < total {
+		info.NextOffset = &next
+	}
+	return info
+}
+
+// PolicyList is a page of merchant policies, signing secrets removed.
+type PolicyList struct {
+	Policies []MerchantPolicy `json:"policies"`
+	Page     PageInfo         `json:"page"`
+}
+
+// MaxPolicyBatch bounds the policies in one PUT /v1/merchants/policies.
+const MaxPolicyBatch = 1000
+
+// RecordFilter selects records for a key search. Zero fields match every
+// record. Amounts are inclusive; From and To bound first_seen_at.
+type RecordFilter struct {
+	MerchantID string
+	CustomerID string
+	Status     Status
+	MinAmount  *int64
+	MaxAmount  *int64
+	From       time.Time
+	To         time.Time
+	KeyPrefix  string
+}
+
+// Matches reports whether rec passes the filter.
+func (f RecordFilter) Matches(rec IdempotencyRecord) bool {
+	switch {
+	case f.MerchantID != "" && rec.MerchantID != f.MerchantID,
+		f.CustomerID != "" && rec.CustomerID != f.CustomerID,
+		f.Status != "" && rec.Status != f.Status,
+		f.MinAmount != nil && rec.Amount < *f.MinAmount,
+		f.MaxAmount != nil && rec.Amount > *f.MaxAmount,
+		!f.From.IsZero() && rec.FirstSeenAt.Before(f.From),
+		!f.To.IsZero() && rec.FirstSeenAt.After(f.To),
+		!strings.HasPrefix(rec.IdempotencyKey, f.KeyPrefix):
+		return false
+	}
+	return true
+}
+
+// RecordSearch is one page of a key search, newest first.
+type RecordSearch struct {
+	Keys []IdempotencyRecord `json:"keys"`
+	Page PageInfo            `json:"page"`
+}
+
+// AmountStats describes the distribution of a merchant's payment amounts in
+// one currency.
+type AmountStats struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+}
+
+// MerchantDigest summarizes one UTC day of activity for a merchant. Counts
+// cover keys first seen that day, as of when the digest was generated.
+type MerchantDigest struct {
+	MerchantID        string            `json:"merchant_id"`
+	Date              string            `json:"date"`
+	TotalRequests     int               `json:"total_requests"`
+	DuplicatesBlocked int               `json:"duplicates_blocked"`
+	AmountProtected   map[string]int64  `json:"amount_protected"`
+	Normalized        *NormalizedAmount `json:"normalized_amount_protected,omitempty"`
+	NewSuspiciousKeys []string          `json:"new_suspicious_keys"`
+	GeneratedAt       time.Time         `json:"generated_at"`
+}
+
+// DuplicateAlertEvent is the event of a DuplicateAlert.
+const DuplicateAlertEvent = "duplicate_threshold_exceeded"
+
+// NewEventID returns a random webhook event ID.
+func NewEventID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return "evt_" + hex.EncodeToString(b[:])
+}
+
+// DuplicateAlertEventID is the event ID of the DuplicateAlert for a
+// merchant's day. It is derived rather than random, so the alert of a
+// digest regenerated after a restart keeps its ID.
+func DuplicateAlertEventID(merchantID, date string) string {
+	sum := sha256.Sum256([]byte(DuplicateAlertEvent + "\x00" + merchantID + "\x00" + date))
+	return "evt_" + hex.EncodeToString(sum[:16])
+}
+
+// DuplicateAlert is posted to a merchant's webhook when a day's digest
+// counts more duplicates than the merchant's threshold. EventID stays the
+// same across retries, redeliveries and replays; receivers dedupe on it.
+type DuplicateAlert struct {
+	EventID           string `json:"event_id"`
+	Event             string `json:"event"`
+	MerchantID        string `json:"merchant_id"`
+	Date              string `json:"date"`
+	DuplicatesBlocked int    `json:"duplicates_blocked"`
+	Threshold         int    `json:"threshold"`
+	TotalRequests     int    `json:"total_requests"`
+}
+
+// Events of an AnomalyAlert.
+const (
+	AnomalyDetectedEvent = "merchant_anomaly_detected"
+	AnomalyResolvedEvent = "merchant_anomaly_resolved"
+)
+
+// AnomalyAlert is sent to the alert sinks when a merchant's duplicate rate
+// over the detection window crosses its threshold, and again when it falls
+// back below. EventID is assigned when the alert is raised.
+type AnomalyAlert struct {
+	EventID          string    `json:"event_id"`
+	Event            string    `json:"event"`
+	MerchantID       string    `json:"merchant_id"`
+	DuplicateRate    float64   `json:"duplicate_rate"`
+	Threshold        float64   `json:"threshold"`
+	WindowRequests   int       `json:"window_requests"`
+	WindowDuplicates int       `json:"window_duplicates"`
+	WindowSeconds    int       `json:"window_seconds"`
+	At               time.Time `json:"at"`
+}
+
+// NormalizedAmount is an amount converted to a single reporting currency.
+type NormalizedAmount struct {
+	Currency       string    `json:"currency"`
+	Amount         int64     `json:"amount"`
+	RatesSource    string    `json:"rates_source"`
+	RatesUpdatedAt time.Time `json:"rates_updated_at"`
+	// Unconverted lists currencies with no known rate, excluded from Amount.
+	Unconverted []string `json:"unconverted_currencies,omitempty"`
+	// Percentages is each converted currency's share of Amount, in percent.
+	Percentages map[string]float64 `json:"currency_percentages,omitempty"`
+}
+
+// KeyActivity is a key's record with what was recorded about its attempts.
+type KeyActivity struct {
+	Record IdempotencyRecord
+	// AttemptTimes are the recorded attempts, oldest first. Keys created
+	// before attempts were recorded may have fewer than AttemptCount.
+	AttemptTimes       []time.Time
+	DistinctSources    int
+	DistinctUserAgents int
+}
+
+// KeyFeatures is one row of the feature dataset exported for model
+// training. Keys and customers are hashed.
+type KeyFeatures struct {
+	KeyHash             string    `json:"key_hash"`
+	MerchantID          string    `json:"merchant_id"`
+	CustomerHash        string    `json:"customer_hash"`
+	Amount              int64     `json:"amount"`
+	Currency            string    `json:"currency"`
+	Outcome             Status    `json:"outcome"`
+	AttemptCount        int       `json:"attempt_count"`
+	FirstSeenAt         time.Time `json:"first_seen_at"`
+	LastSeenAt          time.Time `json:"last_seen_at"`
+	SpanSeconds         float64   `json:"span_seconds"`
+	AttemptsPerMinute   float64   `json:"attempts_per_minute"`
+	InterAttemptSeconds []float64 `json:"inter_attempt_seconds"`
+	MeanIntervalSeconds float64   `json:"mean_interval_seconds"`
+	MinIntervalSeconds  float64   `json:"min_interval_seconds"`
+	DistinctSources     int       `json:"distinct_sources"`
+	DistinctUserAgents  int       `json:"distinct_user_agents"`
+}
+
+// MetricsSample is one instance's metrics as of RecordedAt. Counters are
+// cumulative since PeriodStart.
+type MetricsSample struct {
+	Instance            string    `json:"instance"`
+	RecordedAt          time.Time `json:"recorded_at"`
+	PeriodStart         time.Time `json:"period_start"`
+	TotalRequests       int64     `json:"total_requests"`
+	NewPayments         int64     `json:"new_payments"`
+	DuplicateBlocked    int64     `json:"duplicate_blocked"`
+	RetryAllowed        int64     `json:"retry_allowed"`
+	CachedResponses     int64     `json:"cached_responses"`
+	ParamMismatches     int64     `json:"param_mismatches"`
+	SlowQueries         int64     `json:"slow_queries"`
+	WindowDuplicateRate float64   `json:"window_duplicate_rate"`
+	LatencyP95Ms        float64   `json:"latency_p95_ms"`
+}
+
+// Kinds of FraudSignal.
+const (
+	// SignalSuspiciousKey: a key crossed the suspicious retry count.
+	SignalSuspiciousKey = "suspicious_key"
+	// SignalVelocity: a key was retried many times within a short window.
+	SignalVelocity = "velocity"
+	// SignalCrossKeyDuplicate: a new key carries the same parameters as other
+	// recent keys of the merchant, i.e. the same charge under another key.
+	SignalCrossKeyDuplicate = "cross_key_duplicate"
+)
+
+// FraudSignal is a high-severity pattern forwarded to an external fraud
+// system.
+type FraudSignal struct {
+	Kind           string    `json:"kind"`
+	Environment    string    `json:"environment"`
+	MerchantID     string    `json:"merchant_id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	PaymentID      string    `json:"payment_id"`
+	CustomerID     string    `json:"customer_id"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	AttemptCount   int       `json:"attempt_count"`
+	DetectedAt     time.Time `json:"detected_at"`
+	// RelatedKeys is how many other keys share the parameters, for
+	// cross-key duplicates.
+	RelatedKeys int `json:"related_keys,omitempty"`
+}
+
+// Kinds of AuditEvent.
+const (
+	AuditPaymentAttempt   = "payment_attempt"
+	AuditPaymentCompleted = "payment_completed"
+	AuditPolicyUpdated    = "policy_updated"
+	AuditPolicyDeleted    = "policy_deleted"
+	AuditKeyExpired       = "key_expired"
+	AuditKeyForceFailed   = "key_force_failed"
+	AuditKeyReset         = "key_reset"
+	AuditKeyRestored      = "key_restored"
+	AuditKeyThrottled     = "key_throttled"
+)
+
+// AuditEvent is one entry of the shield's activity trail, streamed to the
+// SIEM. Keys are hashed as in the logs.
+type AuditEvent struct {
+	Kind         string    `json:"kind"`
+	Time         time.Time `json:"time"`
+	Environment  string    `json:"environment"`
+	MerchantID   string    `json:"merchant_id"`
+	KeyHash      string    `json:"key_hash,omitempty"`
+	PaymentID    string    `json:"payment_id,omitempty"`
+	Status       Status    `json:"status,omitempty"`
+	AttemptCount int       `json:"attempt_count,omitempty"`
+	SourceIP     string    `json:"source_ip,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
 }
 
 // SuspiciousKey is a key with an abnormally high retry count.
 type SuspiciousKey struct {
 	IdempotencyKey string    `json:"idempotency_key"`
+	MerchantID     string    `json:"merchant_id,omitempty"`
 	AttemptCount   int       `json:"attempt_count"`
 	Amount         int64     `json:"amount"`
 	Currency       string    `json:"currency"`
 	Status         Status    `json:"status"`
 	FirstSeenAt    time.Time `json:"first_seen_at"`
 	LastSeenAt     time.Time `json:"last_seen_at"`
+	// HighPriority marks keys whose amount is an outlier for the merchant.
+	HighPriority bool    `json:"high_priority"`
+	AmountZScore float64 `json:"amount_zscore,omitempty"`
+	// DistinctSources counts the source IPs behind the attempts: many sources
+	// suggest replay or abuse, a single one a stuck client.
+	DistinctSources int `json:"distinct_sources"`
+	// Metadata is the metadata the key was created with.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// DuplicateRow is one duplicate key in a duplicate report export. Suspicious
+// and HighPriority flag it as the report's suspicious keys would.
+type DuplicateRow struct {
+	IdempotencyKey  string    `json:"idempotency_key"`
+	PaymentID       string    `json:"payment_id"`
+	AttemptCount    int       `json:"attempt_count"`
+	Amount          int64     `json:"amount"`
+	Currency        string    `json:"currency"`
+	AmountAtRisk    int64     `json:"amount_at_risk"`
+	Status          Status    `json:"status"`
+	FirstSeenAt     time.Time `json:"first_seen_at"`
+	LastSeenAt      time.Time `json:"last_seen_at"`
+	DistinctSources int       `json:"distinct_sources"`
+	Suspicious      bool      `json:"suspicious"`
+	HighPriority    bool      `json:"high_priority"`
+	AmountZScore    float64   `json:"amount_zscore,omitempty"`
+	// Metadata is the metadata the key was created with.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
 }
 
 // TimeRange specifies the window of a report.
@@ -109,3 +704,183 @@ type TimeRange struct {
 	From time.Time `json:"from"`
 	To   time.Time `json:"to"`
 }
+
+// MerchantActivity is a merchant's request volume and duplicate rate over a window.
+type MerchantActivity struct {
+	MerchantID     string  `json:"merchant_id"`
+	TotalRequests  int     `json:"total_requests"`
+	UniquePayments int     `json:"unique_payments"`
+	DuplicateRate  float64 `json:"duplicate_rate"`
+}
+
+// MerchantStats is a merchant's request totals, duplicate rate and key
+// outcomes over a time range, without the per-key detail of a
+// DuplicateReport.
+type MerchantStats struct {
+	MerchantID     string    `json:"merchant_id"`
+	TotalRequests  int       `json:"total_requests"`
+	UniquePayments int       `json:"unique_payments"`
+	DuplicateCount int       `json:"duplicate_count"`
+	DuplicateRate  float64   `json:"duplicate_rate"`
+	TimeRange      TimeRange `json:"time_range"`
+	MerchantOutcomes
+}
+
+// MerchantOutcomes is how a merchant's keys first seen in a time range
+// ended: how many were retried, how many are in each status, and how long
+// the completed ones took from when they last entered processing.
+type MerchantOutcomes struct {
+	RetriedKeys int `json:"retried_keys"`
+	Succeeded   int `json:"succeeded"`
+	Failed      int `json:"failed"`
+	Processing  int `json:"processing"`
+	// AvgCompletionMs is nil when no key completed.
+	AvgCompletionMs *float64 `json:"avg_completion_ms"`
+}
+
+// DuplicateTrends is a merchant's MerchantStats split into buckets of
+// BucketSeconds, oldest first, with empty buckets included so the series
+// can be charted as is.
+type DuplicateTrends struct {
+	MerchantID    string        `json:"merchant_id"`
+	BucketSeconds int           `json:"bucket_seconds"`
+	Buckets       []TrendBucket `json:"buckets"`
+	TimeRange     TimeRange     `json:"time_range"`
+}
+
+// TrendBucket counts the keys first seen within [Start, Start+bucket), with
+// all of their attempts.
+type TrendBucket struct {
+	Start          time.Time `json:"start"`
+	TotalRequests  int       `json:"total_requests"`
+	UniquePayments int       `json:"unique_payments"`
+	DuplicateCount int       `json:"duplicate_count"`
+	DuplicateRate  float64   `json:"duplicate_rate"`
+}
+
+// StatsTable is every merchant's activity over a time range, ordered by SortBy.
+type StatsTable struct {
+	Merchants []MerchantActivity `json:"merchants"`
+	SortBy    string             `json:"sort_by"`
+	TimeRange TimeRange          `json:"time_range"`
+}
+
+// Overview summarizes activity across all merchants for operational dashboards.
+type Overview struct {
+	TopMerchants   []MerchantActivity `json:"top_merchants"`
+	SuspiciousKeys []SuspiciousKey    `json:"suspicious_keys"`
+	TimeRange      TimeRange          `json:"time_range"`
+}
+
+// DeadLetter is a queued payment the async workers gave up on: the gateway
+// failed every attempt, or answered but the completion could not be stored.
+// The payment stays processing for the merchant's /complete call or the
+// reconciler.
+type DeadLetter struct {
+	PaymentID      string    `json:"payment_id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	MerchantID     string    `json:"merchant_id"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Attempts       int       `json:"attempts"`
+	GatewayStatus  Status    `json:"gateway_status,omitempty"`
+	Error          string    `json:"error"`
+	FailedAt       time.Time `json:"failed_at"`
+}
+
+// WebhookDeadLetter is a webhook delivery that failed every attempt, kept
+// with its payload until an admin redelivers it. Endpoint is shown with any
+// credentials it carries redacted.
+type WebhookDeadLetter struct {
+	ID            int64           `json:"id"`
+	EventID       string          `json:"event_id,omitempty"`
+	MerchantID    string          `json:"merchant_id,omitempty"`
+	Event         string          `json:"event"`
+	Endpoint      string          `json:"endpoint"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error"`
+	FailedAt      time.Time       `json:"failed_at"`
+	RedeliveredAt *time.Time      `json:"redelivered_at,omitempty"`
+}
+
+// WebhookDeadLetterList is a page of webhook dead letters, newest first.
+type WebhookDeadLetterList struct {
+	DeadLetters []WebhookDeadLetter `json:"dead_letters"`
+	Page        PageInfo            `json:"page"`
+}
+
+// MaxWebhookReplay bounds the events one replay request may resend.
+const MaxWebhookReplay = 1000
+
+// WebhookEvent is a merchant webhook kept in the outbox after delivery, so
+// the merchant can have it replayed.
+type WebhookEvent struct {
+	ID         int64
+	EventID    string
+	MerchantID string
+	Event      string
+	Endpoint   string
+	Payload    json.RawMessage
+	CreatedAt  time.Time
+}
+
+// WebhookReplayRequest is the body of POST /v1/webhooks/replay: the
+// merchant's events created in [From, To], of one kind when Event is set,
+// are delivered again to the endpoints they were first sent to.
+type WebhookReplayRequest struct {
+	MerchantID string    `json:"merchant_id"`
+	Event      string    `json:"event,omitempty"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+}
+
+// WebhookReplay answers a replay request; Events is how many events are
+// being delivered again.
+type WebhookReplay struct {
+	MerchantID string    `json:"merchant_id"`
+	Event      string    `json:"event,omitempty"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Events     int       `json:"events"`
+}
+
+// Attempt outcomes, as the storage layer sees them when recording the
+// attempt. A mismatch may still be let through by the merchant's
+// tolerant_fields.
+const (
+	AttemptNew       = "new"
+	AttemptDuplicate = "duplicate"
+	AttemptMismatch  = "mismatch"
+)
+
+// MaxAttemptHistory bounds the attempts kept, or returned, per key; the
+// most recent ones win.
+const MaxAttemptHistory = 100
+
+// Attempt is one request InsertOrGet saw for an idempotency key. Attempts
+// recorded before their hash and outcome were stored have neither.
+type Attempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	RequestHash string    `json:"request_hash,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Outcome     string    `json:"outcome,omitempty"`
+}
+
+// AttemptOutcome returns the outcome of req against rec, the record
+// InsertOrGet returned for it: new when it created the key, otherwise
+// duplicate or, when its request or body hash differs, mismatch. Records
+// without a body hash compare the request hash only.
+func AttemptOutcome(rec *IdempotencyRecord, req PaymentRequest, created bool) string {
+	switch {
+	case created:
+		return AttemptNew
+	case rec.RequestHash != req.Hash():
+		return AttemptMismatch
+	case rec.BodyHash != "" && req.BodyHash != "" && rec.BodyHash != req.BodyHash:
+		return AttemptMismatch
+	}
+	return AttemptDuplicate
+}
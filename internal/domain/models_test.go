@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -82,3 +84,110 @@ func TestIdempotencyRecord_IsExpired(t *testing.T) {
 		t.Error("zero time should be expired")
 	}
 }
+
+func TestValidPaymentIDFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{"pay_<nanos>", true},
+		{"kubo_<ulid>", true},
+		{"<uuid>", true},
+		{"br-<ulid>-live", true},
+		{"pay_", false},
+		{"<ulid><uuid>", false},
+		{"<ulid>_<ulid>", false},
+		{"pay <ulid>", false},
+		{"pay/<ulid>", false},
+		{strings.Repeat("a", 33) + "<ulid>", false},
+	}
+	for _, tt := range tests {
+		if got := ValidPaymentIDFormat(tt.format); got != tt.want {
+			t.Errorf("ValidPaymentIDFormat(%q) = %v, want %v", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestRecordFilter_Matches(t *testing.T) {
+	now := time.Now()
+	rec := IdempotencyRecord{IdempotencyKey: "pos-42-001", MerchantID: "m1", CustomerID: "c1", Status: StatusFailed, Amount: 500, FirstSeenAt: now}
+	low, high := int64(500), int64(499)
+	cases := []struct {
+		filter RecordFilter
+		want   bool
+	}{
+		{RecordFilter{}, true},
+		{RecordFilter{MerchantID: "m1", CustomerID: "c1", Status: StatusFailed, KeyPrefix: "pos-42-", MinAmount: &low}, true},
+		{RecordFilter{MerchantID: "m2"}, false},
+		{RecordFilter{Status: StatusSucceeded}, false},
+		{RecordFilter{MaxAmount: &high}, false},
+		{RecordFilter{KeyPrefix: "pos-43"}, false},
+		{RecordFilter{From: now.Add(time.Second)}, false},
+		{RecordFilter{To: now.Add(-time.Second)}, false},
+	}
+	for i, c := range cases {
+		if got := c.filter.Matches(rec); got != c.want {
+			t.Errorf("case %d: expected %v, got %v", i, c.want, got)
+		}
+	}
+}
+
+func TestCanonicalBodyHash(t *testing.T) {
+	base, err := CanonicalBodyHash([]byte(`{"amount":100,"metadata":{"order":"A1","channel":"pos"},"idempotency_key":"k1"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reordered, _ := CanonicalBodyHash([]byte(`{ "metadata": {"channel": "pos", "order": "A1"}, "amount": 100, "expiry_hours": 72 }`), nil)
+	if reordered != base {
+		t.Error("key order, whitespace, idempotency_key and expiry_hours should not change the hash")
+	}
+	changed, _ := CanonicalBodyHash([]byte(`{"amount":100,"metadata":{"order":"A2","channel":"pos"}}`), nil)
+	if changed == base {
+		t.Error("a nested change should change the hash")
+	}
+	excluded, _ := CanonicalBodyHash([]byte(`{"amount":100,"metadata":{"order":"A2"}}`), []string{"metadata"})
+	if want, _ := CanonicalBodyHash([]byte(`{"amount":100}`), nil); excluded != want {
+		t.Error("excluded fields should not change the hash")
+	}
+	if _, err := CanonicalBodyHash([]byte(`{"amount":`), nil); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestStoredResponse_Equal(t *testing.T) {
+	body := func(s string) *json.RawMessage {
+		raw := json.RawMessage(s)
+		return &raw
+	}
+	base := StoredResponse{Status: 201, Headers: map[string]string{"Location": "/p/1"}, Body: body(`{"id":"p1","idempotency_key":"k1"}`)}
+	same := StoredResponse{Status: 201, Headers: map[string]string{"Location": "/p/1"}, Body: body(`{ "idempotency_key": "k1", "id": "p1" }`)}
+	if !base.Equal(same) {
+		t.Error("a reformatted body should be equal")
+	}
+	for name, other := range map[string]StoredResponse{
+		"status":  {Status: 200, Headers: base.Headers, Body: base.Body},
+		"headers": {Status: 201, Body: base.Body},
+		"body":    {Status: 201, Headers: base.Headers, Body: body(`{"id":"p1","idempotency_key":"k2"}`)},
+		"no body": {Status: 201, Headers: base.Headers},
+	} {
+		if base.Equal(other) {
+			t.Errorf("expected a different %s to be unequal", name)
+		}
+	}
+	if !(StoredResponse{}).Equal(StoredResponse{Headers: map[string]string{}}) {
+		t.Error("empty responses should be equal")
+	}
+}
+
+func TestEventIDs(t *testing.T) {
+	id := DuplicateAlertEventID("merchant-1", "2026-03-10")
+	if id != DuplicateAlertEventID("merchant-1", "2026-03-10") || !strings.HasPrefix(id, "evt_") {
+		t.Errorf("expected a stable evt_ ID, got %s", id)
+	}
+	if id == DuplicateAlertEventID("merchant-1", "2026-03-11") || id == DuplicateAlertEventID("merchant-2", "2026-03-10") {
+		t.Error("expected each merchant's day to have its own ID")
+	}
+	if a, b := NewEventID(), NewEventID(); a == b || len(a) != len(id) {
+		t.Errorf("expected distinct random IDs shaped like %s, got %s %s", id, a, b)
+	}
+}
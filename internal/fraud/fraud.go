@@ -0,0 +1,155 @@
+// Package fraud forwards fraud signals to an external fraud system.
+package fraud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// Body formats understood by HTTPExporter.
+const (
+	// FormatJSON posts {"signals": [...]}.
+	FormatJSON = "json"
+	// FormatKafkaREST posts records to a Kafka REST Proxy (v2) topic URL,
+	// keyed by merchant so a merchant's signals stay in one partition.
+	FormatKafkaREST = "kafka-rest"
+)
+
+const (
+	httpTimeout = 10 * time.Second
+	queueSize   = 1000
+	maxBatch    = 100
+)
+
+// Exporter delivers a batch of signals.
+type Exporter interface {
+	Export(ctx context.Context, signals []domain.FraudSignal) error
+}
+
+// HTTPExporter posts signal batches to a URL.
+type HTTPExporter struct {
+	URL    string
+	Token  string
+	Format string
+	Client *http.Client
+}
+
+// NewHTTPExporter creates an HTTPExporter. An empty token sends no
+// Authorization header.
+func NewHTTPExporter(url, token, format string) *HTTPExporter {
+	return &HTTPExporter{URL: url, Token: token, Format: format, Client: &http.Client{Timeout: httpTimeout}}
+}
+
+type kafkaRecord struct {
+	Key   string             `json:"key"`
+	Value domain.FraudSignal `json:"value"`
+}
+
+// Export posts signals; any non-2xx response is an error.
+func (e *HTTPExporter) Export(ctx context.Context, signals []domain.FraudSignal) error {
+	var payload interface{}
+	contentType := "application/json"
+	switch e.Format {
+	case FormatKafkaREST:
+		records := make([]kafkaRecord, len(signals))
+		for i, s := range signals {
+			records[i] = kafkaRecord{Key: s.MerchantID, Value: s}
+		}
+		payload = map[string]interface{}{"records": records}
+		contentType = "application/vnd.kafka.json.v2+json"
+	default:
+		payload = map[string]interface{}{"signals": signals}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.Token)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		// The URL may carry credentials; keep only the underlying cause.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("fraud export: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("fraud export: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Dispatcher queues signals and exports them in batches in the background,
+// so a slow fraud system never delays payments. Signals arriving while the
+// queue is full are dropped and counted in the log.
+type Dispatcher struct {
+	exporter Exporter
+	env      string
+	queue    chan domain.FraudSignal
+	dropped  int64
+}
+
+// NewDispatcher creates a Dispatcher stamping every signal with env.
+func NewDispatcher(exporter Exporter, env string) *Dispatcher {
+	return &Dispatcher{exporter: exporter, env: env, queue: make(chan domain.FraudSignal, queueSize)}
+}
+
+// Emit queues a signal without blocking.
+func (d *Dispatcher) Emit(sig domain.FraudSignal) {
+	sig.Environment = d.env
+	select {
+	case d.queue <- sig:
+	default:
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
+
+// Run exports queued signals until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		var sig domain.FraudSignal
+		select {
+		case <-ctx.Done():
+			return
+		case sig = <-d.queue:
+		}
+		batch := []domain.FraudSignal{sig}
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case sig = <-d.queue:
+				batch = append(batch, sig)
+			default:
+				break drain
+			}
+		}
+		if err := d.exporter.Export(ctx, batch); err != nil {
+			log.Printf("fraud export: dropped %d signal(s): %v", len(batch), err)
+		}
+		if n := atomic.SwapInt64(&d.dropped, 0); n > 0 {
+			log.Printf("fraud export: queue full, dropped %d signal(s)", n)
+		}
+	}
+}
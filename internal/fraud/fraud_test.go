@@ -0,0 +1,96 @@
+package fraud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestHTTPExporter_Formats(t *testing.T) {
+	var got struct {
+		contentType string
+		body        map[string][]json.RawMessage
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		got.contentType = r.Header.Get("Content-Type")
+		got.body = nil
+		json.NewDecoder(r.Body).Decode(&got.body)
+	}))
+	defer srv.Close()
+	signals := []domain.FraudSignal{{Kind: domain.SignalVelocity, MerchantID: "merchant-1"}}
+
+	if err := NewHTTPExporter(srv.URL, "secret", FormatJSON).Export(context.Background(), signals); err != nil {
+		t.Fatalf("json export: %v", err)
+	}
+	if got.contentType != "application/json" || len(got.body["signals"]) != 1 {
+		t.Errorf("unexpected json export: %s %v", got.contentType, got.body)
+	}
+
+	if err := NewHTTPExporter(srv.URL, "secret", FormatKafkaREST).Export(context.Background(), signals); err != nil {
+		t.Fatalf("kafka-rest export: %v", err)
+	}
+	if got.contentType != "application/vnd.kafka.json.v2+json" || len(got.body["records"]) != 1 {
+		t.Fatalf("unexpected kafka-rest export: %s %v", got.contentType, got.body)
+	}
+	var rec kafkaRecord
+	json.Unmarshal(got.body["records"][0], &rec)
+	if rec.Key != "merchant-1" || rec.Value.Kind != domain.SignalVelocity {
+		t.Errorf("expected record keyed by merchant, got %+v", rec)
+	}
+
+	if err := NewHTTPExporter(srv.URL, "wrong", FormatJSON).Export(context.Background(), signals); err == nil {
+		t.Error("expected an error for a non-2xx response")
+	}
+}
+
+type recordingExporter struct {
+	mu      sync.Mutex
+	signals []domain.FraudSignal
+}
+
+func (e *recordingExporter) Export(_ context.Context, signals []domain.FraudSignal) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.signals = append(e.signals, signals...)
+	return nil
+}
+
+func (e *recordingExporter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.signals)
+}
+
+func TestDispatcher_StampsEnvironmentAndExports(t *testing.T) {
+	exp := &recordingExporter{}
+	d := NewDispatcher(exp, domain.EnvironmentSandbox)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Emit(domain.FraudSignal{Kind: domain.SignalSuspiciousKey})
+	d.Emit(domain.FraudSignal{Kind: domain.SignalVelocity})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for exp.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if exp.count() != 2 {
+		t.Fatalf("expected 2 exported signals, got %d", exp.count())
+	}
+	for _, s := range exp.signals {
+		if s.Environment != domain.EnvironmentSandbox {
+			t.Errorf("expected sandbox environment, got %q", s.Environment)
+		}
+	}
+}
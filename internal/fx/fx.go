@@ -0,0 +1,129 @@
+// Package fx provides foreign-exchange rates for normalizing amounts in
+// reports. Providers fetch rates from a source; CachedProvider keeps the last
+// good result and falls back to static rates when the source is unreachable.
+package fx
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rates holds units of each currency per one unit of Base.
+type Rates struct {
+	Base      string
+	Values    map[string]float64
+	UpdatedAt time.Time
+	Source    string
+}
+
+// Convert converts an amount in minor units between two currencies using
+// cross rates through Base. It reports false if either currency is unknown.
+func (r Rates) Convert(amount int64, from, to string) (int64, bool) {
+	fromRate, ok := r.rate(from)
+	if !ok {
+		return 0, false
+	}
+	toRate, ok := r.rate(to)
+	if !ok {
+		return 0, false
+	}
+	return int64(math.Round(float64(amount) / fromRate * toRate)), true
+}
+
+func (r Rates) rate(currency string) (float64, bool) {
+	if strings.EqualFold(currency, r.Base) {
+		return 1, true
+	}
+	v, ok := r.Values[strings.ToUpper(currency)]
+	return v, ok && v > 0
+}
+
+// RateProvider fetches the current exchange rates.
+type RateProvider interface {
+	Rates(ctx context.Context) (Rates, error)
+}
+
+// StaticProvider serves fixed rates, typically from configuration.
+type StaticProvider struct {
+	rates Rates
+}
+
+// DefaultStaticRates are rough USD rates for the currencies our merchants
+// settle in, used when nothing better is configured.
+const DefaultStaticRates = "BRL=5.0,MXN=17.0,COP=3900,CLP=900,ARS=850,PEN=3.7,EUR=0.92"
+
+// NewStaticProvider creates a StaticProvider from "CUR=rate" pairs per one
+// unit of base, e.g. "BRL=5.0,MXN=17.0".
+func NewStaticProvider(base, spec string) (*StaticProvider, error) {
+	values := make(map[string]float64)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cur, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("fx: invalid rate %q, want CUR=rate", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("fx: invalid rate %q", pair)
+		}
+		values[strings.ToUpper(strings.TrimSpace(cur))] = rate
+	}
+	return &StaticProvider{rates: Rates{Base: strings.ToUpper(base), Values: values, Source: "static"}}, nil
+}
+
+// Rates implements RateProvider.
+func (p *StaticProvider) Rates(_ context.Context) (Rates, error) {
+	return p.rates, nil
+}
+
+// CachedProvider caches rates from a source for ttl. When a refresh fails it
+// keeps serving the last good rates, or the fallback if there are none yet.
+type CachedProvider struct {
+	source   RateProvider
+	fallback RateProvider
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	cached    Rates
+	fetchedAt time.Time
+	now       func() time.Time
+}
+
+// NewCachedProvider wraps source with a cache. fallback may be nil.
+func NewCachedProvider(source, fallback RateProvider, ttl time.Duration) *CachedProvider {
+	return &CachedProvider{source: source, fallback: fallback, ttl: ttl, now: time.Now}
+}
+
+// Rates implements RateProvider.
+func (p *CachedProvider) Rates(ctx context.Context) (Rates, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.fetchedAt.IsZero() && p.now().Sub(p.fetchedAt) < p.ttl {
+		return p.cached, nil
+	}
+
+	rates, err := p.source.Rates(ctx)
+	if err == nil {
+		p.cached, p.fetchedAt = rates, p.now()
+		return rates, nil
+	}
+	if !p.fetchedAt.IsZero() {
+		log.Printf("fx: refresh failed, serving rates from %s: %v", p.cached.UpdatedAt.Format(time.RFC3339), err)
+		return p.cached, nil
+	}
+	if p.fallback != nil {
+		log.Printf("fx: refresh failed, using fallback rates: %v", err)
+		return p.fallback.Rates(ctx)
+	}
+	return Rates{}, err
+}
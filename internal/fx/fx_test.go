@@ -0,0 +1,127 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRates_Convert(t *testing.T) {
+	r := Rates{Base: "EUR", Values: map[string]float64{"USD": 1.1, "BRL": 5.5}}
+
+	if got, ok := r.Convert(1000, "EUR", "USD"); !ok || got != 1100 {
+		t.Errorf("EUR->USD: got %d ok=%v", got, ok)
+	}
+	if got, ok := r.Convert(5500, "brl", "USD"); !ok || got != 1100 {
+		t.Errorf("BRL->USD cross rate: got %d ok=%v", got, ok)
+	}
+	if _, ok := r.Convert(100, "XYZ", "USD"); ok {
+		t.Error("unknown currency should not convert")
+	}
+}
+
+func TestNewStaticProvider(t *testing.T) {
+	p, err := NewStaticProvider("usd", " brl=5.0, MXN=17 ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, _ := p.Rates(context.Background())
+	if r.Base != "USD" || r.Values["BRL"] != 5.0 || r.Values["MXN"] != 17 {
+		t.Errorf("unexpected rates: %+v", r)
+	}
+
+	for _, bad := range []string{"BRL", "BRL=abc", "BRL=-1"} {
+		if _, err := NewStaticProvider("USD", bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+type fakeProvider struct {
+	rates Rates
+	err   error
+	calls int
+}
+
+func (f *fakeProvider) Rates(_ context.Context) (Rates, error) {
+	f.calls++
+	return f.rates, f.err
+}
+
+func TestCachedProvider(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := &fakeProvider{rates: Rates{Base: "EUR", Source: "ecb"}}
+	fallback := &fakeProvider{rates: Rates{Base: "USD", Source: "static"}}
+	p := NewCachedProvider(source, fallback, time.Hour)
+	p.now = func() time.Time { return now }
+
+	// Source down before the first fetch: fallback rates.
+	source.err = errors.New("down")
+	if r, err := p.Rates(context.Background()); err != nil || r.Source != "static" {
+		t.Fatalf("expected fallback, got %+v err=%v", r, err)
+	}
+
+	// Source up: cached for the TTL.
+	source.err = nil
+	p.Rates(context.Background())
+	p.Rates(context.Background())
+	if source.calls != 2 {
+		t.Errorf("expected cached result, source called %d times", source.calls)
+	}
+
+	// Expired and source down again: stale cache beats the fallback.
+	now = now.Add(2 * time.Hour)
+	source.err = errors.New("down")
+	if r, err := p.Rates(context.Background()); err != nil || r.Source != "ecb" {
+		t.Errorf("expected stale ecb rates, got %+v err=%v", r, err)
+	}
+}
+
+func TestECBProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<Cube><Cube time="2026-10-15"><Cube currency="USD" rate="1.08"/><Cube currency="BRL" rate="5.91"/></Cube></Cube>
+</gesmes:Envelope>`))
+	}))
+	defer srv.Close()
+
+	p := NewECBProvider()
+	p.URL = srv.URL
+	r, err := p.Rates(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Base != "EUR" || r.Values["BRL"] != 5.91 || r.UpdatedAt.Format("2006-01-02") != "2026-10-15" {
+		t.Errorf("unexpected rates: %+v", r)
+	}
+}
+
+func TestOpenExchangeProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("app_id") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"timestamp": 1760000000, "base": "USD", "rates": {"BRL": 5.4, "MXN": 18.2}}`))
+	}))
+	defer srv.Close()
+
+	p := NewOpenExchangeProvider("secret")
+	p.URL = srv.URL
+	r, err := p.Rates(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Base != "USD" || r.Values["MXN"] != 18.2 || r.UpdatedAt.Unix() != 1760000000 {
+		t.Errorf("unexpected rates: %+v", r)
+	}
+
+	p.AppID = "wrong"
+	if _, err := p.Rates(context.Background()); err == nil {
+		t.Error("expected error for rejected app ID")
+	}
+}
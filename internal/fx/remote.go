@@ -0,0 +1,119 @@
+package fx
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ecbDailyURL       = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+	openExchangeURL   = "https://openexchangerates.org/api/latest.json"
+	remoteHTTPTimeout = 10 * time.Second
+)
+
+// ECBProvider fetches the European Central Bank daily reference rates (EUR base).
+type ECBProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewECBProvider creates an ECBProvider for the public daily feed.
+func NewECBProvider() *ECBProvider {
+	return &ECBProvider{URL: ecbDailyURL, Client: &http.Client{Timeout: remoteHTTPTimeout}}
+}
+
+type ecbEnvelope struct {
+	Cube struct {
+		Cube struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+// Rates implements RateProvider.
+func (p *ECBProvider) Rates(ctx context.Context) (Rates, error) {
+	var env ecbEnvelope
+	if err := fetch(ctx, p.Client, p.URL, func(r *http.Response) error {
+		return xml.NewDecoder(r.Body).Decode(&env)
+	}); err != nil {
+		return Rates{}, fmt.Errorf("ecb: %w", err)
+	}
+
+	values := make(map[string]float64, len(env.Cube.Cube.Rates))
+	for _, r := range env.Cube.Cube.Rates {
+		values[r.Currency] = r.Rate
+	}
+	if len(values) == 0 {
+		return Rates{}, fmt.Errorf("ecb: no rates in response")
+	}
+	updated, _ := time.Parse("2006-01-02", env.Cube.Cube.Time)
+	return Rates{Base: "EUR", Values: values, UpdatedAt: updated, Source: "ecb"}, nil
+}
+
+// OpenExchangeProvider fetches rates from Open Exchange Rates (USD base).
+type OpenExchangeProvider struct {
+	URL    string
+	AppID  string
+	Client *http.Client
+}
+
+// NewOpenExchangeProvider creates an OpenExchangeProvider for the given app ID.
+func NewOpenExchangeProvider(appID string) *OpenExchangeProvider {
+	return &OpenExchangeProvider{URL: openExchangeURL, AppID: appID, Client: &http.Client{Timeout: remoteHTTPTimeout}}
+}
+
+// Rates implements RateProvider.
+func (p *OpenExchangeProvider) Rates(ctx context.Context) (Rates, error) {
+	var body struct {
+		Timestamp int64              `json:"timestamp"`
+		Base      string             `json:"base"`
+		Rates     map[string]float64 `json:"rates"`
+	}
+	url := p.URL + "?app_id=" + p.AppID
+	if err := fetch(ctx, p.Client, url, func(r *http.Response) error {
+		return json.NewDecoder(r.Body).Decode(&body)
+	}); err != nil {
+		return Rates{}, fmt.Errorf("openexchangerates: %w", err)
+	}
+	if len(body.Rates) == 0 {
+		return Rates{}, fmt.Errorf("openexchangerates: no rates in response")
+	}
+	return Rates{
+		Base:      strings.ToUpper(body.Base),
+		Values:    body.Rates,
+		UpdatedAt: time.Unix(body.Timestamp, 0).UTC(),
+		Source:    "openexchangerates",
+	}, nil
+}
+
+func fetch(ctx context.Context, client *http.Client, url string, decode func(*http.Response) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// Drop the URL from the error: it may carry an app ID.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return decode(resp)
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+// AnomalyHandler serves each merchant's live duplicate rate anomaly state.
+type AnomalyHandler struct {
+	anomalies *monitor.MerchantAnomalies
+}
+
+// NewAnomalyHandler creates a new AnomalyHandler.
+func NewAnomalyHandler(anomalies *monitor.MerchantAnomalies) *AnomalyHandler {
+	return &AnomalyHandler{anomalies: anomalies}
+}
+
+// Get handles GET /v1/merchants/{id}/anomaly
+// The rate covers this instance's sliding window, not the stored history.
+func (h *AnomalyHandler) Get(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.anomalies.Report(merchantID))
+}
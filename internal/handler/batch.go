@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+)
+
+// batchItemRoute is the route batch payments are counted under, one outcome
+// per payment, so they take part in the duplicate rate.
+const batchItemRoute = "POST /v1/payments/batch items"
+
+// OutcomeRecorder counts request outcomes by route, and payment outcomes
+// by merchant.
+type OutcomeRecorder interface {
+	RecordOutcome(route, outcome string)
+	RecordMerchantOutcome(merchantID, outcome string)
+}
+
+// WithOutcomes counts every payment of a batch in rec.
+func (h *PaymentHandler) WithOutcomes(rec OutcomeRecorder) *PaymentHandler {
+	h.outcomes = rec
+	return h
+}
+
+// batchItem is the result of one payment of a batch: the payment response
+// on success, otherwise the error body POST /v1/payments would have sent.
+type batchItem struct {
+	Index             int                     `json:"index"`
+	Status            int                     `json:"status"`
+	Payment           *domain.PaymentResponse `json:"payment,omitempty"`
+	Code              string                  `json:"code,omitempty"`
+	Error             string                  `json:"error,omitempty"`
+	MismatchedFields  []domain.FieldDiff      `json:"mismatched_fields,omitempty"`
+	Violations        []violation             `json:"violations,omitempty"`
+	Retryable         bool                    `json:"retryable,omitempty"`
+	RetryAfterSeconds int                     `json:"retry_after_seconds,omitempty"`
+}
+
+// ProcessBatch handles POST /v1/payments/batch. The body is an array of up
+// to domain.MaxBatchSize payment requests, each carrying its own
+// idempotency_key in either mode. Every payment goes through the state
+// machine as if sent alone; the response is 200 with one result per payment,
+// in request order.
+func (h *PaymentHandler) ProcessBatch(w http.ResponseWriter, r *http.Request) {
+	fail := writeMessage
+	if h.ietf {
+		fail = writeProblem
+	}
+	if r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		decodeFailure(w, r, err, fail)
+		return
+	}
+	if len(raws) == 0 || len(raws) > domain.MaxBatchSize {
+		fail(w, r, http.StatusUnprocessableEntity, i18n.ErrInvalidBatch, domain.MaxBatchSize)
+		return
+	}
+	reqs := make([]domain.PaymentRequest, len(raws))
+	for i, raw := range raws {
+		req, err := h.paymentFromJSON(raw)
+		if err != nil {
+			decodeFailure(w, r, err, fail)
+			return
+		}
+		reqs[i] = req
+	}
+
+	items := make([]batchItem, len(reqs))
+	var allowed []int
+	var pending []domain.PaymentRequest
+	source := attemptSource(r)
+	for i := range reqs {
+		reqs[i].Source = source
+		items[i].Index = i
+		if h.limiter != nil && reqs[i].MerchantID != "" {
+			if ok, wait := h.limiter.Allow(r.Context(), reqs[i].MerchantID); !ok {
+				items[i] = h.batchError(r, i, http.StatusTooManyRequests, i18n.ErrRateLimited)
+				items[i].RetryAfterSeconds = int(math.Ceil(wait.Seconds()))
+				h.recordItem(reqs[i].MerchantID, "rate_limited")
+				continue
+			}
+		}
+		if h.storms != nil && reqs[i].IdempotencyKey != "" {
+			if ok, wait := h.storms.Allow(r.Context(), reqs[i]); !ok {
+				items[i] = h.batchError(r, i, http.StatusTooManyRequests, i18n.ErrKeyThrottled)
+				items[i].RetryAfterSeconds = int(math.Ceil(wait.Seconds()))
+				h.recordItem(reqs[i].MerchantID, "key_throttled")
+				continue
+			}
+		}
+		allowed = append(allowed, i)
+		pending = append(pending, reqs[i])
+	}
+
+	for j, res := range h.svc.ProcessBatch(r.Context(), pending) {
+		i := allowed[j]
+		items[i] = h.batchResult(r, i, reqs[i], res)
+	}
+	writeJSON(w, http.StatusOK, batchResponse{Results: items})
+}
+
+// batchResponse is the body of POST /v1/payments/batch.
+type batchResponse struct {
+	Results []batchItem `json:"results"`
+}
+
+// batchResult turns the service's result for payment i into its item,
+// queueing accepted payments in async mode as ProcessPayment does.
+func (h *PaymentHandler) batchResult(r *http.Request, i int, req domain.PaymentRequest, res service.BatchResult) batchItem {
+	code, err := res.Code, res.Err
+	if err == nil {
+		code, err = h.enqueue(r, req, code, res.Response)
+	}
+	if err != nil {
+		if code == http.StatusInternalServerError {
+			logging.From(r.Context()).Errorf("process batch payment %d: %v", i, err)
+		}
+		if errors.Is(err, domain.ErrUnavailable) {
+			code = http.StatusServiceUnavailable
+		}
+		if errors.Is(err, domain.ErrTimeout) {
+			code = http.StatusGatewayTimeout
+		}
+		item := batchItem{Index: i, Status: code, Code: string(i18n.ErrInternal), Error: err.Error()}
+		if msg, args, ok := i18n.ForError(err); ok {
+			item = h.batchError(r, i, code, msg, args...)
+		}
+		item.Violations = violations(r, err)
+		var mismatch *domain.MismatchError
+		if errors.As(err, &mismatch) {
+			item.MismatchedFields = mismatch.Fields
+			h.recordItem(req.MerchantID, monitor.OutcomeMismatch)
+		} else {
+			h.recordItem(req.MerchantID, statusOutcome(code))
+		}
+		item.Retryable = retryable(code, i18n.Code(item.Code))
+		if item.Retryable {
+			item.RetryAfterSeconds = processingRetryAfter
+		}
+		return item
+	}
+
+	resp := res.Response
+	h.recordItem(req.MerchantID, paymentOutcome(resp))
+	resp.Message = i18n.Message(language(r), i18n.Code(resp.Code))
+	return batchItem{Index: i, Status: code, Payment: resp}
+}
+
+// batchError returns the item for payment i failing with code.
+func (h *PaymentHandler) batchError(r *http.Request, i, status int, code i18n.Code, args ...interface{}) batchItem {
+	return batchItem{
+		Index:     i,
+		Status:    status,
+		Code:      string(code),
+		Error:     i18n.Message(language(r), code, args...),
+		Retryable: retryable(status, code),
+	}
+}
+
+func (h *PaymentHandler) recordItem(merchantID, outcome string) {
+	if h.outcomes != nil {
+		h.outcomes.RecordOutcome(batchItemRoute, outcome)
+		if merchantID != "" {
+			h.outcomes.RecordMerchantOutcome(merchantID, outcome)
+		}
+	}
+}
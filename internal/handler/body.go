@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// RequireJSON answers 415 to a request whose body is not application/json
+// and 413 to one declaring more than maxBytes, and caps the body it lets
+// through with http.MaxBytesReader so handlers see a body sent without a
+// length stop there too. Requests without a body pass untouched; maxBytes
+// of 0 leaves bodies unbounded.
+func RequireJSON(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			setOutcome(r, "unsupported_media_type")
+			writeMessage(w, r, http.StatusUnsupportedMediaType, i18n.ErrUnsupportedMediaType)
+			return
+		}
+		if maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				setOutcome(r, "body_too_large")
+				writeMessage(w, r, http.StatusRequestEntityTooLarge, i18n.ErrBodyTooLarge, maxBytes)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeFailure writes the error for a body that did not decode: 413 when
+// it ran past RequireJSON's limit, 400 naming the field when a strict
+// decode met one the request type lacks, and 400 invalid_json otherwise.
+func decodeFailure(w http.ResponseWriter, r *http.Request, err error, fail func(http.ResponseWriter, *http.Request, int, i18n.Code, ...interface{})) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		setOutcome(r, "body_too_large")
+		fail(w, r, http.StatusRequestEntityTooLarge, i18n.ErrBodyTooLarge, tooLarge.Limit)
+		return
+	}
+	if field, ok := unknownField(err); ok {
+		fail(w, r, http.StatusBadRequest, i18n.ErrUnknownField, field)
+		return
+	}
+	fail(w, r, http.StatusBadRequest, i18n.ErrInvalidJSON)
+}
+
+// unknownFieldPrefix starts the error encoding/json reports for a field
+// the target lacks; it has no error type of its own.
+const unknownFieldPrefix = "json: unknown field "
+
+// unknownField returns the field a DisallowUnknownFields decode rejected.
+func unknownField(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(err.Error(), unknownFieldPrefix)
+	if !ok {
+		return "", false
+	}
+	if name, err := strconv.Unquote(rest); err == nil {
+		return name, true
+	}
+	return rest, true
+}
+
+// decodeStrict decodes raw into v, rejecting fields v does not have.
+func decodeStrict(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
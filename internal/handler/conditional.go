@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// recordETag is a strong validator over every field a payment view exposes.
+// The message text is derived from status and language (covered by Vary),
+// so it is not hashed.
+func recordETag(rec *domain.IdempotencyRecord) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00", rec.IdempotencyKey, rec.PaymentID, rec.Status, rec.AttemptCount)
+	if rec.ResponseBody != nil {
+		h.Write(*rec.ResponseBody)
+	}
+	return strconv.Quote(fmt.Sprintf("%x", h.Sum(nil)[:12]))
+}
+
+// recordModified is when the record last changed: its latest attempt or its
+// completion, whichever is later.
+func recordModified(rec *domain.IdempotencyRecord) time.Time {
+	t := rec.LastSeenAt
+	if rec.CompletedAt != nil && rec.CompletedAt.After(t) {
+		t = *rec.CompletedAt
+	}
+	return t
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since only
+// when no entity tags were sent (RFC 9110 §13.2.2).
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			// HTTP dates have second precision.
+			return !modified.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
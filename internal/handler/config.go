@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// ActiveConfig is the body of GET /v1/admin/config.
+type ActiveConfig struct {
+	// Source is the configuration file read over the environment, or
+	// "environment" without one.
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+	// Reloadable names the fields a reload applies without a restart.
+	Reloadable []string `json:"reloadable"`
+	// LastReloadError is why the last reload was refused, if it was.
+	LastReloadError string `json:"last_reload_error,omitempty"`
+	// Config is the active configuration by field name, secrets masked.
+	Config map[string]string `json:"config"`
+}
+
+// ConfigHandler reports the configuration the server is running with,
+// including what hot reloads changed since it started.
+type ConfigHandler struct {
+	active func() ActiveConfig
+}
+
+// NewConfigHandler creates a ConfigHandler reporting what active returns.
+func NewConfigHandler(active func() ActiveConfig) *ConfigHandler {
+	return &ConfigHandler{active: active}
+}
+
+// GetConfig handles GET /v1/admin/config
+func (h *ConfigHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.active())
+}
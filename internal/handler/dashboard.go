@@ -0,0 +1,63 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+)
+
+//go:embed static/dashboard.html
+var dashboardHTML []byte
+
+// dashboardTopN bounds the merchants and suspicious keys shown on the dashboard.
+const dashboardTopN = 10
+
+// DashboardHandler serves the embedded operational dashboard and its data.
+type DashboardHandler struct {
+	svc     *service.ReportingService
+	metrics *monitor.Metrics
+}
+
+// NewDashboardHandler creates a new DashboardHandler.
+func NewDashboardHandler(svc *service.ReportingService, metrics *monitor.Metrics) *DashboardHandler {
+	return &DashboardHandler{svc: svc, metrics: metrics}
+}
+
+// dashboardData is the payload polled by the dashboard page.
+type dashboardData struct {
+	Metrics monitor.MetricsSnapshot `json:"metrics"`
+	*domain.Overview
+}
+
+// Page handles GET /admin/dashboard
+func (h *DashboardHandler) Page(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardHTML)
+}
+
+// Data handles GET /admin/dashboard/data with the last 24h of activity.
+func (h *DashboardHandler) Data(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	overview, err := h.svc.GetOverview(r.Context(), now.Add(-24*time.Hour), now, dashboardTopN)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dashboardData{Metrics: h.metrics.Snapshot(), Overview: overview})
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+// PoolStater reports connection pool statistics; *sql.DB implements it.
+type PoolStater interface {
+	Stats() sql.DBStats
+}
+
+// WorkerStatus describes one background worker. StoppedAt is nil while it
+// runs.
+type WorkerStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	StartedAt time.Time  `json:"started_at"`
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+}
+
+// DiagnosticsHandler serves the support bundle: everything support asks for
+// during an incident, in one response.
+type DiagnosticsHandler struct {
+	db        PoolStater
+	metrics   *monitor.Metrics
+	config    func() map[string]string
+	workers   func() []WorkerStatus
+	anomalies *monitor.AnomalyLog
+	readiness *ReadinessHandler
+	started   time.Time
+}
+
+// NewDiagnosticsHandler creates a DiagnosticsHandler. config is the
+// effective configuration with secrets already masked.
+func NewDiagnosticsHandler(db PoolStater, metrics *monitor.Metrics, config map[string]string) *DiagnosticsHandler {
+	return &DiagnosticsHandler{
+		db:      db,
+		metrics: metrics,
+		config:  func() map[string]string { return config },
+		started: time.Now(),
+	}
+}
+
+// WithConfig reports what config returns instead, for configuration that
+// changes while the server runs.
+func (h *DiagnosticsHandler) WithConfig(config func() map[string]string) *DiagnosticsHandler {
+	h.config = config
+	return h
+}
+
+// WithWorkers reports the background workers listed by workers.
+func (h *DiagnosticsHandler) WithWorkers(workers func() []WorkerStatus) *DiagnosticsHandler {
+	h.workers = workers
+	return h
+}
+
+// WithAnomalies reports the recent anomaly episodes from log.
+func (h *DiagnosticsHandler) WithAnomalies(log *monitor.AnomalyLog) *DiagnosticsHandler {
+	h.anomalies = log
+	return h
+}
+
+// WithReadiness reports what /health/ready would answer.
+func (h *DiagnosticsHandler) WithReadiness(readiness *ReadinessHandler) *DiagnosticsHandler {
+	h.readiness = readiness
+	return h
+}
+
+// dbPoolStats is sql.DBStats with JSON names and readable durations.
+type dbPoolStats struct {
+	MaxOpen           int    `json:"max_open"`
+	Open              int    `json:"open"`
+	InUse             int    `json:"in_use"`
+	Idle              int    `json:"idle"`
+	WaitCount         int64  `json:"wait_count"`
+	WaitDuration      string `json:"wait_duration"`
+	MaxIdleClosed     int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64  `json:"max_lifetime_closed"`
+}
+
+// errorCounts are the error outcomes counted since the metrics period began.
+type errorCounts struct {
+	Since       time.Time                   `json:"since"`
+	ServerError int64                       `json:"server_error"`
+	ClientError int64                       `json:"client_error"`
+	ByRoute     map[string]map[string]int64 `json:"by_route"`
+}
+
+// Bundle handles GET /admin/diagnostics.
+func (h *DiagnosticsHandler) Bundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	snap := h.metrics.Snapshot()
+	hostname, _ := os.Hostname()
+	bundle := map[string]interface{}{
+		"generated_at":   time.Now().UTC(),
+		"hostname":       hostname,
+		"go_version":     runtime.Version(),
+		"goroutines":     runtime.NumGoroutine(),
+		"uptime_seconds": int64(time.Since(h.started).Seconds()),
+		"config":         h.config(),
+		"circuit_state":  snap.CircuitState,
+		"errors":         errorsFrom(snap),
+	}
+	if h.db != nil {
+		s := h.db.Stats()
+		bundle["db_pool"] = dbPoolStats{
+			MaxOpen:           s.MaxOpenConnections,
+			Open:              s.OpenConnections,
+			InUse:             s.InUse,
+			Idle:              s.Idle,
+			WaitCount:         s.WaitCount,
+			WaitDuration:      s.WaitDuration.String(),
+			MaxIdleClosed:     s.MaxIdleClosed,
+			MaxIdleTimeClosed: s.MaxIdleTimeClosed,
+			MaxLifetimeClosed: s.MaxLifetimeClosed,
+		}
+	}
+	if h.workers != nil {
+		workers := h.workers()
+		sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+		bundle["workers"] = workers
+	}
+	if h.anomalies != nil {
+		bundle["anomaly_episodes"] = h.anomalies.Recent()
+	}
+	if h.readiness != nil {
+		bundle["readiness"] = h.readiness.readiness(r.Context())
+	}
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// errorsFrom collects the error outcomes of every route in snap.
+func errorsFrom(snap monitor.MetricsSnapshot) errorCounts {
+	counts := errorCounts{Since: snap.PeriodStart, ByRoute: make(map[string]map[string]int64)}
+	for route, outcomes := range snap.Routes {
+		for _, outcome := range []string{"server_error", "client_error"} {
+			n := outcomes[outcome]
+			if n == 0 {
+				continue
+			}
+			if counts.ByRoute[route] == nil {
+				counts.ByRoute[route] = make(map[string]int64)
+			}
+			counts.ByRoute[route][outcome] = n
+			if outcome == "server_error" {
+				counts.ServerError += n
+			} else {
+				counts.ClientError += n
+			}
+		}
+	}
+	return counts
+}
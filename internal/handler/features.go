@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+)
+
+// exportWriteTimeout replaces the server's write timeout for feature exports,
+// which stream for as long as the range takes to read.
+const exportWriteTimeout = 10 * time.Minute
+
+var featureColumns = []string{
+	"key_hash", "merchant_id", "customer_hash", "amount", "currency", "outcome", "attempt_count",
+	"first_seen_at", "last_seen_at", "span_seconds", "attempts_per_minute", "inter_attempt_seconds",
+	"mean_interval_seconds", "min_interval_seconds", "distinct_sources", "distinct_user_agents",
+}
+
+// FeatureHandler exports the per-key feature dataset.
+type FeatureHandler struct {
+	svc *service.FeatureService
+}
+
+// NewFeatureHandler creates a new FeatureHandler.
+func NewFeatureHandler(svc *service.FeatureService) *FeatureHandler {
+	return &FeatureHandler{svc: svc}
+}
+
+// Export handles GET /admin/export/features?from=&to=&merchant_id=&format=jsonl|csv
+// The range defaults to the last 24h and all merchants.
+func (h *FeatureHandler) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if h.svc == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to, ok := parseTimeRange(r, 24*time.Hour)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+
+	format := q.Get("format")
+	var contentType string
+	var begin, end func() error
+	var write func(domain.KeyFeatures) error
+	switch format {
+	case "", "jsonl":
+		format, contentType = "jsonl", "application/x-ndjson"
+		enc := json.NewEncoder(w)
+		begin = func() error { return nil }
+		write = func(f domain.KeyFeatures) error { return enc.Encode(f) }
+		end = func() error { return nil }
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+		cw := csv.NewWriter(w)
+		begin = func() error { return cw.Write(featureColumns) }
+		write = func(f domain.KeyFeatures) error { return cw.Write(featureRow(f)) }
+		end = func() error { cw.Flush(); return cw.Error() }
+	default:
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrUnsupportedFormat)
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+	// Headers are written with the first row, so a query that fails up front
+	// still gets a proper error response.
+	started := false
+	startBody := func() error {
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="features-%s-%s.%s"`,
+			from.UTC().Format("20060102"), to.UTC().Format("20060102"), format))
+		w.WriteHeader(http.StatusOK)
+		return begin()
+	}
+
+	err := h.svc.Export(r.Context(), from, to, q.Get("merchant_id"), func(f domain.KeyFeatures) error {
+		if !started {
+			if err := startBody(); err != nil {
+				return err
+			}
+		}
+		return write(f)
+	})
+	if err == nil && !started {
+		err = startBody()
+	}
+	if err == nil {
+		err = end()
+	}
+	if err != nil {
+		if !started {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// The status is already sent; the truncated body is all the client sees.
+		logging.From(r.Context()).Warnf("feature export aborted: %v", err)
+	}
+}
+
+func featureRow(f domain.KeyFeatures) []string {
+	gaps := make([]string, len(f.InterAttemptSeconds))
+	for i, g := range f.InterAttemptSeconds {
+		gaps[i] = formatSeconds(g)
+	}
+	return []string{
+		f.KeyHash, f.MerchantID, f.CustomerHash, strconv.FormatInt(f.Amount, 10), f.Currency, string(f.Outcome),
+		strconv.Itoa(f.AttemptCount), f.FirstSeenAt.Format(time.RFC3339Nano), f.LastSeenAt.Format(time.RFC3339Nano),
+		formatSeconds(f.SpanSeconds), formatSeconds(f.AttemptsPerMinute), strings.Join(gaps, ";"),
+		formatSeconds(f.MeanIntervalSeconds), formatSeconds(f.MinIntervalSeconds),
+		strconv.Itoa(f.DistinctSources), strconv.Itoa(f.DistinctUserAgents),
+	}
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
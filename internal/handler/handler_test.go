@@ -1,17 +1,26 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 	"github.com/kubo-market/idempotency-shield/internal/monitor"
 	"github.com/kubo-market/idempotency-shield/internal/service"
 	"github.com/kubo-market/idempotency-shield/internal/storage"
@@ -25,6 +34,7 @@ type mockRepo struct {
 	nextID  int64
 
 	policies map[string]*domain.MerchantPolicy
+	attempts map[string][]domain.Attempt
 }
 
 func newMockRepo() *mockRepo {
@@ -32,6 +42,7 @@ func newMockRepo() *mockRepo {
 		records:  make(map[string]*domain.IdempotencyRecord),
 		nextID:   1,
 		policies: make(map[string]*domain.MerchantPolicy),
+		attempts: make(map[string][]domain.Attempt),
 	}
 }
 
@@ -42,6 +53,7 @@ func (m *mockRepo) InsertOrGet(_ context.Context, req domain.PaymentRequest, pay
 	if rec, ok := m.records[req.IdempotencyKey]; ok {
 		rec.AttemptCount++
 		rec.LastSeenAt = time.Now()
+		m.addAttempt(req, domain.AttemptOutcome(rec, req, false))
 		cp := *rec
 		return &cp, false, nil
 	}
@@ -56,18 +68,28 @@ func (m *mockRepo) InsertOrGet(_ context.Context, req domain.PaymentRequest, pay
 		Currency:       req.Currency,
 		Status:         domain.StatusProcessing,
 		RequestHash:    req.Hash(),
+		BodyHash:       req.BodyHash,
+		Metadata:       req.Metadata,
 		PaymentID:      paymentID,
 		AttemptCount:   1,
+		Version:        1,
 		FirstSeenAt:    now,
 		LastSeenAt:     now,
 		ExpiresAt:      expiresAt,
 	}
 	m.nextID++
 	m.records[req.IdempotencyKey] = rec
+	m.addAttempt(req, domain.AttemptNew)
 	cp := *rec
 	return &cp, true, nil
 }
 
+func (m *mockRepo) addAttempt(req domain.PaymentRequest, outcome string) {
+	m.attempts[req.IdempotencyKey] = append(m.attempts[req.IdempotencyKey], domain.Attempt{
+		AttemptedAt: time.Now(), RequestHash: req.Hash(), SourceIP: req.Source.IP, Outcome: outcome,
+	})
+}
+
 func (m *mockRepo) GetByKey(_ context.Context, key string) (*domain.IdempotencyRecord, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -78,7 +100,23 @@ func (m *mockRepo) GetByKey(_ context.Context, key string) (*domain.IdempotencyR
 	return nil, domain.ErrKeyNotFound
 }
 
-func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Status, responseBody *json.RawMessage) error {
+func (m *mockRepo) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	return m.GetByKey(ctx, key)
+}
+
+func (m *mockRepo) GetByPaymentID(_ context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range m.records {
+		if rec.PaymentID == paymentID {
+			cp := *rec
+			return &cp, nil
+		}
+	}
+	return nil, domain.ErrPaymentNotFound
+}
+
+func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	rec, ok := m.records[key]
@@ -89,19 +127,21 @@ func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Sta
 		return domain.ErrAlreadyCompleted
 	}
 	rec.Status = status
-	rec.ResponseBody = responseBody
+	rec.ResponseBody, rec.ResponseStatus, rec.ResponseHeaders = resp.Body, resp.Status, resp.Headers
 	now := time.Now()
 	rec.CompletedAt = &now
+	rec.Version++
 	return nil
 }
 
-func (m *mockRepo) ResetToProcessing(_ context.Context, key string, newPaymentID string, expiresAt time.Time) error {
+func (m *mockRepo) ResetToProcessing(_ context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	rec, ok := m.records[key]
-	if !ok {
-		return domain.ErrKeyNotFound
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
 	}
+	rec.Version++
 	rec.Status = domain.StatusProcessing
 	rec.PaymentID = newPaymentID
 	rec.CompletedAt = nil
@@ -109,8 +149,60 @@ func (m *mockRepo) ResetToProcessing(_ context.Context, key string, newPaymentID
 	return nil
 }
 
-func (m *mockRepo) DeleteExpired(_ context.Context) (int64, error) { return 0, nil }
-func (m *mockRepo) GetDuplicates(_ context.Context, merchantID string, _, _ time.Time) ([]domain.IdempotencyRecord, error) {
+func (m *mockRepo) UpdateParams(_ context.Context, key string, version int64, req domain.PaymentRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	rec.Version++
+	rec.CustomerID, rec.Amount, rec.Currency = req.CustomerID, req.Amount, req.Currency
+	rec.RequestHash, rec.BodyHash, rec.Metadata = req.Hash(), req.BodyHash, req.Metadata
+	return nil
+}
+
+func (m *mockRepo) ExpireKey(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok {
+		return domain.ErrKeyNotFound
+	}
+	if now := time.Now(); rec.ExpiresAt.After(now) {
+		rec.ExpiresAt = now
+	}
+	rec.Version++
+	return nil
+}
+
+func (m *mockRepo) ResetKey(_ context.Context, key string, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	now := time.Now()
+	rec.Status = domain.StatusFailed
+	if rec.ExpiresAt.After(now) {
+		rec.ExpiresAt = now
+	}
+	rec.Version++
+	return nil
+}
+
+func (m *mockRepo) DeleteExpired(_ context.Context, _ int) (int64, error) { return 0, nil }
+func (m *mockRepo) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	records, _, _ := m.GetDuplicates(ctx, merchantID, from, to, domain.Page{})
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (m *mockRepo) GetDuplicates(_ context.Context, merchantID string, _, _ time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	var result []domain.IdempotencyRecord
@@ -119,7 +211,27 @@ func (m *mockRepo) GetDuplicates(_ context.Context, merchantID string, _, _ time
 			result = append(result, *rec)
 		}
 	}
-	return result, nil
+	sort.Slice(result, func(i, j int) bool { return result[i].IdempotencyKey < result[j].IdempotencyKey })
+	total := len(result)
+	if page.Offset >= total {
+		return nil, total, nil
+	}
+	result = result[page.Offset:]
+	if page.Limit > 0 && len(result) > page.Limit {
+		result = result[:page.Limit]
+	}
+	return result, total, nil
+}
+func (m *mockRepo) GetAmountAtRisk(_ context.Context, merchantID string, _, _ time.Time) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	atRisk := make(map[string]int64)
+	for _, rec := range m.records {
+		if rec.MerchantID == merchantID && rec.AttemptCount > 1 {
+			atRisk[rec.Currency] += rec.Amount * int64(rec.AttemptCount-1)
+		}
+	}
+	return atRisk, nil
 }
 func (m *mockRepo) GetMerchantStats(_ context.Context, merchantID string, _, _ time.Time) (int, int, error) {
 	m.mu.Lock()
@@ -133,6 +245,50 @@ func (m *mockRepo) GetMerchantStats(_ context.Context, merchantID string, _, _ t
 	}
 	return total, unique, nil
 }
+func (m *mockRepo) GetMerchantOutcomes(_ context.Context, merchantID string, _, _ time.Time) (domain.MerchantOutcomes, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var o domain.MerchantOutcomes
+	for _, rec := range m.records {
+		if rec.MerchantID != merchantID {
+			continue
+		}
+		if rec.AttemptCount > 1 {
+			o.RetriedKeys++
+		}
+		switch rec.Status {
+		case domain.StatusSucceeded:
+			o.Succeeded++
+		case domain.StatusFailed:
+			o.Failed++
+		case domain.StatusProcessing:
+			o.Processing++
+		}
+	}
+	return o, nil
+}
+func (m *mockRepo) GetDuplicateTrends(_ context.Context, merchantID string, _, _ time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[time.Time]*domain.TrendBucket)
+	var buckets []domain.TrendBucket
+	for _, rec := range m.records {
+		if rec.MerchantID != merchantID {
+			continue
+		}
+		start := time.Unix(0, rec.FirstSeenAt.UnixNano()/int64(bucket)*int64(bucket)).UTC()
+		if counts[start] == nil {
+			counts[start] = &domain.TrendBucket{Start: start}
+		}
+		counts[start].TotalRequests += rec.AttemptCount
+		counts[start].UniquePayments++
+	}
+	for _, b := range counts {
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+	return buckets, nil
+}
 func (m *mockRepo) GetPolicy(_ context.Context, merchantID string) (*domain.MerchantPolicy, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -150,9 +306,74 @@ func (m *mockRepo) UpsertPolicy(_ context.Context, policy domain.MerchantPolicy)
 	m.policies[policy.MerchantID] = &policy
 	return nil
 }
+func (m *mockRepo) ListPolicies(_ context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var policies []domain.MerchantPolicy
+	for _, p := range m.policies {
+		policies = append(policies, *p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].MerchantID < policies[j].MerchantID })
+	total := len(policies)
+	if page.Offset >= total {
+		return nil, total, nil
+	}
+	policies = policies[page.Offset:]
+	if page.Limit > 0 && len(policies) > page.Limit {
+		policies = policies[:page.Limit]
+	}
+	return policies, total, nil
+}
+func (m *mockRepo) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	for _, p := range policies {
+		m.UpsertPolicy(ctx, p)
+	}
+	return nil
+}
+func (m *mockRepo) DeletePolicy(_ context.Context, merchantID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.policies[merchantID]; !ok {
+		return domain.ErrMerchantNotFound
+	}
+	delete(m.policies, merchantID)
+	return nil
+}
 func (m *mockRepo) GetAllMerchantStats(_ context.Context, _, _ time.Time) (map[string][2]int, error) {
 	return nil, nil
 }
+func (m *mockRepo) GetAmountStats(_ context.Context, _ string, _, _ time.Time) (map[string]domain.AmountStats, error) {
+	return nil, nil
+}
+func (m *mockRepo) SearchRecords(_ context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []domain.IdempotencyRecord
+	for _, rec := range m.records {
+		if filter.Matches(*rec) {
+			records = append(records, *rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID > records[j].ID })
+	total := len(records)
+	if page.Offset >= total {
+		return nil, total, nil
+	}
+	records = records[page.Offset:]
+	if page.Limit > 0 && len(records) > page.Limit {
+		records = records[:page.Limit]
+	}
+	return records, total, nil
+}
+
+func (m *mockRepo) GetAttempts(_ context.Context, key string) ([]domain.Attempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.records[key]; !ok {
+		return nil, domain.ErrKeyNotFound
+	}
+	return append([]domain.Attempt{}, m.attempts[key]...), nil
+}
 
 // ensure mockRepo implements storage.Repository
 var _ storage.Repository = (*mockRepo)(nil)
@@ -177,6 +398,13 @@ func patchJSON(handler http.HandlerFunc, path string, body interface{}) *httptes
 	return w
 }
 
+// route serves handler at pattern, as main does, so it reads its path values.
+func route(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	return mux.ServeHTTP
+}
+
 func getRequest(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
 	req := httptest.NewRequest(http.MethodGet, path, nil)
 	w := httptest.NewRecorder()
@@ -229,6 +457,39 @@ func TestProcessPayment_Duplicate_409(t *testing.T) {
 	if w.Code != 409 {
 		t.Errorf("expected 409, got %d", w.Code)
 	}
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Retryable || resp.RetryAfterSeconds != 1 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected retryable 409 with a 1s backoff, got %+v", resp)
+	}
+}
+
+type fixedLatency time.Duration
+
+func (f fixedLatency) CompletionLatency(context.Context, string, time.Time) (time.Duration, int, error) {
+	return time.Duration(f), 100, nil
+}
+
+func TestProcessPayment_Duplicate_409_EstimatedCompletion(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour).WithCompletionEstimates(fixedLatency(20 * time.Second))
+	h := NewPaymentHandler(svc)
+
+	payload := domain.PaymentRequest{IdempotencyKey: "slow-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	postJSON(h.ProcessPayment, "/v1/payments", payload)
+	repo.mu.Lock()
+	repo.records["slow-key"].ProcessingSince = time.Now()
+	repo.mu.Unlock()
+	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 409 || resp.EstimatedCompletionAt == nil {
+		t.Fatalf("expected 409 with an estimated completion, got %d %s", w.Code, w.Body.String())
+	}
+	if header := w.Header().Get("Retry-After"); !resp.Retryable || resp.RetryAfterSeconds < 19 || header != strconv.Itoa(resp.RetryAfterSeconds) {
+		t.Errorf("expected a matching Retry-After of about 20s, got header %q body %+v", header, resp)
+	}
 }
 
 func TestProcessPayment_InvalidJSON_400(t *testing.T) {
@@ -271,6 +532,64 @@ func TestProcessPayment_MethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestFindPayment_ByPaymentID(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	w := postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "trace-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL",
+	})
+	var created domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = getRequest(h.FindPayment, "/v1/payments?payment_id="+created.PaymentID)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var found domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &found)
+	if found.IdempotencyKey != "trace-key" || w.Header().Get("ETag") == "" {
+		t.Errorf("expected trace-key with an ETag, got %+v", found)
+	}
+
+	if w := getRequest(h.FindPayment, "/v1/payments?payment_id=pay_unknown"); w.Code != 404 || !strings.Contains(w.Body.String(), "payment_not_found") {
+		t.Errorf("expected 404 payment_not_found, got %d %s", w.Code, w.Body.String())
+	}
+	if w := getRequest(h.FindPayment, "/v1/payments"); w.Code != 400 {
+		t.Errorf("expected 400 without payment_id, got %d", w.Code)
+	}
+}
+
+func TestProcessPayment_RequiredPolicy_403(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour).WithRequiredPolicy()
+	h := NewPaymentHandler(svc)
+
+	payload := domain.PaymentRequest{
+		IdempotencyKey: "onboard-key",
+		MerchantID:     "merchant-new",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	}
+	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w.Code != 403 {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "merchant_not_onboarded") {
+		t.Errorf("expected merchant_not_onboarded, got %s", w.Body.String())
+	}
+	if _, err := repo.GetByKey(context.Background(), "onboard-key"); err == nil {
+		t.Error("expected the rejected key not to be stored")
+	}
+
+	repo.UpsertPolicy(context.Background(), domain.MerchantPolicy{MerchantID: "merchant-new", RetryPolicy: "standard", ExpiryHours: 24})
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 201 {
+		t.Errorf("expected 201 once onboarded, got %d", w.Code)
+	}
+}
+
 func TestProcessPayment_ParamsMismatch_422(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
@@ -295,15 +614,30 @@ func TestProcessPayment_ParamsMismatch_422(t *testing.T) {
 	if w.Code != 422 {
 		t.Errorf("expected 422 for mismatch, got %d", w.Code)
 	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["retryable"] != false {
+		t.Errorf("expected retryable false for mismatch, got %v", body["retryable"])
+	}
+	if _, ok := body["retry_after_seconds"]; ok {
+		t.Error("expected no retry_after_seconds for mismatch")
+	}
+	fields, _ := body["mismatched_fields"].([]interface{})
+	if len(fields) != 1 {
+		t.Fatalf("expected one mismatched field, got %v", body["mismatched_fields"])
+	}
+	if f := fields[0].(map[string]interface{}); f["field"] != "amount" || f["stored"] != "10000" || f["submitted"] != "99999" {
+		t.Errorf("unexpected amount diff: %v", f)
+	}
 }
 
-func TestProcessPayment_SucceededCached_200(t *testing.T) {
+func TestProcessPayment_Duplicate_LocalizedMessage(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
 	h := NewPaymentHandler(svc)
 
 	payload := domain.PaymentRequest{
-		IdempotencyKey: "cached-key",
+		IdempotencyKey: "dup-key-pt",
 		MerchantID:     "merchant-1",
 		CustomerID:     "customer-1",
 		Amount:         10000,
@@ -311,113 +645,592 @@ func TestProcessPayment_SucceededCached_200(t *testing.T) {
 	}
 	postJSON(h.ProcessPayment, "/v1/payments", payload)
 
-	// Mark succeeded
-	body := json.RawMessage(`{"tx":"123"}`)
-	svc.MarkComplete(context.Background(), "cached-key", domain.CompleteRequest{
-		Status:       domain.StatusSucceeded,
-		ResponseBody: &body,
-	})
+	b, _ := json.Marshal(payload)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewReader(b))
+	req.Header.Set("Accept-Language", "pt-BR,pt;q=0.9,en;q=0.8")
+	w := httptest.NewRecorder()
+	h.ProcessPayment(w, req)
 
-	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
-	if w.Code != 200 {
-		t.Errorf("expected 200 cached, got %d", w.Code)
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Code != "already_processing" {
+		t.Errorf("expected already_processing code, got %s", resp.Code)
+	}
+	if resp.Message != "o pagamento já está sendo processado" {
+		t.Errorf("expected Portuguese message, got %q", resp.Message)
 	}
 }
 
-// --- CompletePayment tests ---
+func TestRequireJSON(t *testing.T) {
+	var served bool
+	h := RequireJSON(64, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+		_, err := io.ReadAll(r.Body)
+		if err != nil {
+			decodeFailure(w, r, err, writeMessage)
+		}
+	}))
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		served = false
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
 
-func TestCompletePayment_200(t *testing.T) {
-	repo := newMockRepo()
-	svc := service.NewIdempotencyService(repo, 24*time.Hour)
-	h := NewPaymentHandler(svc)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(`idempotency_key=k1`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := send(req); w.Code != http.StatusUnsupportedMediaType || served || !strings.Contains(w.Body.String(), "unsupported_media_type") {
+		t.Errorf("expected 415 unsupported_media_type, got %d %s", w.Code, w.Body.String())
+	}
 
-	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
-		IdempotencyKey: "complete-key",
-		MerchantID:     "merchant-1",
-		CustomerID:     "customer-1",
-		Amount:         10000,
-		Currency:       "BRL",
-	})
+	big := strings.Repeat(" ", 100) + "{}"
+	req = httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(big))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if w := send(req); w.Code != http.StatusRequestEntityTooLarge || served || !strings.Contains(w.Body.String(), "body_too_large") {
+		t.Errorf("expected 413 before the handler, got %d %s", w.Code, w.Body.String())
+	}
 
-	w := patchJSON(h.CompletePayment, "/v1/payments/complete-key/complete", domain.CompleteRequest{
-		Status: domain.StatusSucceeded,
-	})
+	req = httptest.NewRequest(http.MethodPost, "/v1/payments", io.NopCloser(strings.NewReader(big)))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	if w := send(req); w.Code != http.StatusRequestEntityTooLarge || !served {
+		t.Errorf("expected an unsized body cut off at the limit with 413, got %d", w.Code)
+	}
 
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+	if w := send(httptest.NewRequest(http.MethodPost, "/v1/admin/keys/k1/reset", nil)); w.Code != http.StatusOK || !served {
+		t.Errorf("expected a request without a body to pass, got %d", w.Code)
 	}
 }
 
-func TestCompletePayment_NotFound_404(t *testing.T) {
+func TestProcessPayment_UnknownField_400(t *testing.T) {
+	body := `{"idempotency_key":"k1","merchant_id":"m1","customer_id":"c1","amount":100,"currency":"BRL","amout":100}`
+	send := func(h *PaymentHandler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ProcessPayment(w, req)
+		return w
+	}
+
+	w := send(NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour)))
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusBadRequest || resp["code"] != "unknown_field" || resp["error"] != "unknown field amout" {
+		t.Errorf("expected 400 unknown_field naming amout, got %d %v", w.Code, resp)
+	}
+
+	loose := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour)).WithUnknownFields()
+	if w := send(loose); w.Code != http.StatusCreated {
+		t.Errorf("expected extra fields accepted with WithUnknownFields, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCompletePayment_UnknownField_400(t *testing.T) {
+	h := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour))
+	req := httptest.NewRequest(http.MethodPatch, "/v1/payments/k1/complete", strings.NewReader(`{"status":"succeeded","reponse_body":{}}`))
+	req.SetPathValue("key", "k1")
+	w := httptest.NewRecorder()
+	h.CompletePayment(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown_field") {
+		t.Errorf("expected 400 unknown_field, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProcessPayment_Violations_422(t *testing.T) {
+	h := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments",
+		strings.NewReader(`{"idempotency_key":"k1","customer_id":"c1","amount":0,"currency":"ABC"}`))
+	req.Header.Set("Accept-Language", "pt-BR")
+	w := httptest.NewRecorder()
+	h.ProcessPayment(w, req)
+
+	var body struct {
+		Code       string      `json:"code"`
+		Violations []violation `json:"violations"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 422 || body.Code != "field_required" {
+		t.Fatalf("expected 422 field_required, got %d %s", w.Code, w.Body.String())
+	}
+	want := []violation{
+		{Field: "merchant_id", Code: "field_required", Error: "merchant_id é obrigatório"},
+		{Field: "amount", Code: "field_positive", Error: "amount deve ser positivo"},
+		{Field: "currency", Code: "unsupported_currency", Error: "currency deve ser um código de moeda ISO 4217"},
+	}
+	if fmt.Sprint(body.Violations) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, body.Violations)
+	}
+}
+
+func TestProcessPayment_MissingFields_LocalizedError(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
 	h := NewPaymentHandler(svc)
 
-	w := patchJSON(h.CompletePayment, "/v1/payments/nonexistent/complete", domain.CompleteRequest{
-		Status: domain.StatusSucceeded,
-	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(`{}`))
+	req.Header.Set("Accept-Language", "es-MX")
+	w := httptest.NewRecorder()
+	h.ProcessPayment(w, req)
 
-	if w.Code != 404 {
-		t.Errorf("expected 404, got %d", w.Code)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["code"] != "field_required" {
+		t.Errorf("expected field_required code, got %s", body["code"])
+	}
+	if body["error"] != "idempotency_key es obligatorio" {
+		t.Errorf("expected Spanish message, got %q", body["error"])
+	}
+	if w.Header().Get("Content-Language") != "es-MX" {
+		t.Errorf("expected Content-Language es-MX, got %s", w.Header().Get("Content-Language"))
 	}
 }
 
-func TestCompletePayment_InvalidStatus_422(t *testing.T) {
+func TestProcessPayment_SucceededCached_200(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
 	h := NewPaymentHandler(svc)
 
-	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
-		IdempotencyKey: "invalid-status-key",
+	payload := domain.PaymentRequest{
+		IdempotencyKey: "cached-key",
 		MerchantID:     "merchant-1",
 		CustomerID:     "customer-1",
 		Amount:         10000,
 		Currency:       "BRL",
-	})
+	}
+	postJSON(h.ProcessPayment, "/v1/payments", payload)
 
-	w := patchJSON(h.CompletePayment, "/v1/payments/invalid-status-key/complete", domain.CompleteRequest{
-		Status: "invalid",
+	// Mark succeeded
+	body := json.RawMessage(`{"tx":"123"}`)
+	svc.MarkComplete(context.Background(), "cached-key", domain.CompleteRequest{
+		Status:       domain.StatusSucceeded,
+		ResponseBody: &body,
 	})
 
-	if w.Code != 422 {
-		t.Errorf("expected 422, got %d", w.Code)
+	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w.Code != 200 {
+		t.Errorf("expected 200 cached, got %d", w.Code)
 	}
 }
 
-func TestCompletePayment_AlreadyCompleted_409(t *testing.T) {
+func TestProcessPayment_ReplaysStoredResponse(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
 	h := NewPaymentHandler(svc)
 
-	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
-		IdempotencyKey: "already-done",
-		MerchantID:     "merchant-1",
-		CustomerID:     "customer-1",
-		Amount:         10000,
-		Currency:       "BRL",
+	payload := domain.PaymentRequest{IdempotencyKey: "replay-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	postJSON(h.ProcessPayment, "/v1/payments", payload)
+	w := patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/replay-key/complete", map[string]interface{}{
+		"status":           "succeeded",
+		"response_body":    map[string]string{"charge": "ch_1"},
+		"response_status":  201,
+		"response_headers": map[string]string{"Location": "/charges/ch_1", "Content-Type": "application/vnd.psp+json"},
 	})
+	if w.Code != 200 {
+		t.Fatalf("complete: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
 
-	// First complete
-	patchJSON(h.CompletePayment, "/v1/payments/already-done/complete", domain.CompleteRequest{
-		Status: domain.StatusSucceeded,
-	})
+	w = postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w.Code != 201 || w.Header().Get("Location") != "/charges/ch_1" || w.Header().Get(ReplayedHeader) != "true" ||
+		w.Header().Get("Content-Type") != "application/vnd.psp+json" || w.Body.String() != `{"charge":"ch_1"}` {
+		t.Errorf("expected the stored response replayed, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	w = patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/replay-key/complete", map[string]interface{}{
+		"status": "succeeded", "response_status": 201, "response_headers": map[string]string{"Content-Length": "3"},
+	})
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "invalid_stored_response") {
+		t.Errorf("expected 422 invalid_stored_response, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProcessPayment_RateLimited_429(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc).WithRateLimiter(service.NewRateLimiter(repo, 1, 1))
+
+	payload := domain.PaymentRequest{IdempotencyKey: "limit-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 201 {
+		t.Fatalf("expected the first request allowed, got %d", w.Code)
+	}
+	payload.IdempotencyKey = "limit-2"
+	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" || !strings.Contains(w.Body.String(), "rate_limited") {
+		t.Errorf("expected 429 rate_limited with Retry-After 1, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	if _, err := repo.GetByKey(context.Background(), "limit-2"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected a limited request not to store its key, got %v", err)
+	}
+
+	payload.MerchantID = "merchant-2"
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 201 {
+		t.Errorf("expected other merchants unaffected, got %d", w.Code)
+	}
+}
+
+func TestProcessPayment_DuplicateStorm_429(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc).WithStormGuard(service.NewStormGuard(repo, 2, time.Minute))
+
+	payload := domain.PaymentRequest{IdempotencyKey: "storm-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 409 {
+		t.Fatalf("expected duplicates within the threshold answered 409, got %d", w.Code)
+	}
+	for _, want := range []string{"1", "2"} {
+		w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+		if w.Code != 429 || w.Header().Get("Retry-After") != want || !strings.Contains(w.Body.String(), "key_throttled") {
+			t.Errorf("expected 429 key_throttled with Retry-After %s, got %d %v %s", want, w.Code, w.Header(), w.Body.String())
+		}
+	}
+	if record, _ := repo.GetByKey(context.Background(), "storm-1"); record.AttemptCount != 2 {
+		t.Errorf("expected throttled attempts kept from storage, got %d attempts", record.AttemptCount)
+	}
+
+	payload.IdempotencyKey = "storm-2"
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 201 {
+		t.Errorf("expected other keys unaffected, got %d", w.Code)
+	}
+}
+
+func TestProcessBatch_PerItemResults(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	payment := domain.PaymentRequest{IdempotencyKey: "batch-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	changed := payment
+	changed.Amount = 1
+	invalid := domain.PaymentRequest{IdempotencyKey: "batch-2", MerchantID: "merchant-1"}
+	w := postJSON(h.ProcessBatch, "/v1/payments/batch", []domain.PaymentRequest{payment, payment, changed, invalid})
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Results []struct {
+			Index   int                     `json:"index"`
+			Status  int                     `json:"status"`
+			Code    string                  `json:"code"`
+			Payment *domain.PaymentResponse `json:"payment"`
+		} `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	want := []int{201, 409, 422, 422}
+	if len(body.Results) != len(want) {
+		t.Fatalf("expected %d results, got %s", len(want), w.Body.String())
+	}
+	for i, res := range body.Results {
+		if res.Index != i || res.Status != want[i] {
+			t.Errorf("item %d: expected %d, got %+v", i, want[i], res)
+		}
+	}
+	if body.Results[0].Payment == nil || body.Results[0].Payment.PaymentID == "" || body.Results[2].Code != "params_mismatch" {
+		t.Errorf("unexpected results: %s", w.Body.String())
+	}
+
+	tooMany := make([]domain.PaymentRequest, domain.MaxBatchSize+1)
+	for _, reqs := range [][]domain.PaymentRequest{{}, tooMany} {
+		if w := postJSON(h.ProcessBatch, "/v1/payments/batch", reqs); w.Code != 422 || !strings.Contains(w.Body.String(), "invalid_batch") {
+			t.Errorf("%d payments: expected 422 invalid_batch, got %d", len(reqs), w.Code)
+		}
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	for i, amount := range []int64{100, 5000, 9000} {
+		postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{IdempotencyKey: fmt.Sprintf("pos-%d", i), MerchantID: "merchant-1", CustomerID: "customer-1", Amount: amount, Currency: "BRL"})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/admin/keys?merchant_id=merchant-1&key_prefix=pos-&min_amount=1000&limit=1", nil)
+	w := httptest.NewRecorder()
+	h.SearchKeys(w, req)
+	var result domain.RecordSearch
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != 200 || len(result.Keys) != 1 || result.Keys[0].IdempotencyKey != "pos-2" || result.Page.Total != 2 ||
+		result.Page.NextOffset == nil || *result.Page.NextOffset != 1 {
+		t.Errorf("unexpected search result: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, query := range []string{"status=done", "min_amount=-1", "min_amount=10&max_amount=5", "from=yesterday", "limit=501"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/admin/keys?"+query, nil)
+		w := httptest.NewRecorder()
+		h.SearchKeys(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+// --- CompletePayment tests ---
+
+func TestCompletePayment_200(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
 
-	// Second complete → conflict
-	w := patchJSON(h.CompletePayment, "/v1/payments/already-done/complete", domain.CompleteRequest{
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "complete-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	w := patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/complete-key/complete", domain.CompleteRequest{
+		Status: domain.StatusSucceeded,
+	})
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestCompletePayment_NotFound_404(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	w := patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/nonexistent/complete", domain.CompleteRequest{
+		Status: domain.StatusSucceeded,
+	})
+
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestCompletePayment_InvalidStatus_422(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "invalid-status-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	w := patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/invalid-status-key/complete", domain.CompleteRequest{
+		Status: "invalid",
+	})
+
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+}
+
+func TestCompletePayment_AlreadyCompleted_409(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "already-done",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	// First complete
+	patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/already-done/complete", domain.CompleteRequest{
 		Status: domain.StatusSucceeded,
 	})
 
+	// Conflicting complete → conflict
+	w := patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/already-done/complete", domain.CompleteRequest{
+		Status: domain.StatusFailed,
+	})
+
 	if w.Code != 409 {
 		t.Errorf("expected 409 for already completed, got %d", w.Code)
 	}
 }
 
+func TestCompletePayment_RepeatedCompletion_200(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	complete := route("/v1/payments/{key}/complete", h.CompletePayment)
+
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "complete-twice",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	body := json.RawMessage(`{"transaction_id": "tx_1", "amount": 100}`)
+	w := patchJSON(complete, "/v1/payments/complete-twice/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &body})
+	if w.Code != 200 || w.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("expected a fresh 200, got %d %v", w.Code, w.Header())
+	}
+
+	// The same completion, reformatted as a store would: 200, replayed
+	same := json.RawMessage(`{"amount":100,"transaction_id":"tx_1"}`)
+	w = patchJSON(complete, "/v1/payments/complete-twice/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &same})
+	if w.Code != 200 || w.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("expected a replayed 200 for the same completion, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	// Same status, different body: conflict
+	other := json.RawMessage(`{"transaction_id":"tx_2","amount":100}`)
+	w = patchJSON(complete, "/v1/payments/complete-twice/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &other})
+	if w.Code != 409 {
+		t.Errorf("expected 409 for a different response body, got %d", w.Code)
+	}
+
+	// Same body, different replay status: conflict
+	w = patchJSON(complete, "/v1/payments/complete-twice/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &same, ResponseStatus: 201})
+	if w.Code != 409 {
+		t.Errorf("expected 409 for a different response status, got %d", w.Code)
+	}
+}
+
+func TestWaitForCompletion_AlreadyCompleted_200(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "wait-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+	patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/wait-key/complete", domain.CompleteRequest{Status: domain.StatusFailed})
+
+	w := getRequest(route("/v1/payments/{key}/wait", h.WaitForCompletion), "/v1/payments/wait-key/wait?timeout=1s")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Status != domain.StatusFailed || resp.Code != "payment_failed" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestWaitForCompletion_NotFound_404(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+
+	w := getRequest(route("/v1/payments/{key}/wait", h.WaitForCompletion), "/v1/payments/missing/wait?timeout=1s")
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestWaitForCompletion_InvalidTimeout_400(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+
+	for _, v := range []string{"soon", "-1s", "5m"} {
+		w := getRequest(route("/v1/payments/{key}/wait", h.WaitForCompletion), "/v1/payments/k/wait?timeout="+v)
+		if w.Code != 400 {
+			t.Errorf("timeout=%s: expected 400, got %d", v, w.Code)
+		}
+	}
+}
+
+func TestGetPayment_ETagAndConditional(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "etag-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	w := getRequest(route("/v1/payments/{key}", h.GetPayment), "/v1/payments/etag-key")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expected ETag and Last-Modified, got %q %q", etag, lastModified)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments/etag-key", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag)
+	w = httptest.NewRecorder()
+	route("/v1/payments/{key}", h.GetPayment)(w, req)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected empty 304, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/payments/etag-key", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	w = httptest.NewRecorder()
+	route("/v1/payments/{key}", h.GetPayment)(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for If-Modified-Since, got %d", w.Code)
+	}
+
+	// Completing the payment changes the representation.
+	body := json.RawMessage(`{"transaction_id":"tx_1"}`)
+	patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/etag-key/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &body})
+	req = httptest.NewRequest(http.MethodGet, "/v1/payments/etag-key", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	route("/v1/payments/{key}", h.GetPayment)(w, req)
+	if w.Code != 200 || w.Header().Get("ETag") == etag {
+		t.Errorf("expected 200 with a new ETag after completion, got %d %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestPayment_Metadata(t *testing.T) {
+	h := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour))
+	payment := map[string]interface{}{
+		"idempotency_key": "meta-key", "merchant_id": "merchant-1", "customer_id": "customer-1", "amount": 10000, "currency": "BRL",
+		"metadata": map[string]string{"order_id": "ord-1", "channel": "app"},
+	}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payment); w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	w := getRequest(route("/v1/payments/{key}", h.GetPayment), "/v1/payments/meta-key")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"metadata":{"channel":"app","order_id":"ord-1"}`) {
+		t.Errorf("expected the metadata returned with the key, got %d: %s", w.Code, w.Body.String())
+	}
+
+	payment["idempotency_key"] = "meta-list"
+	payment["metadata"] = []string{"ord-1"}
+	w = postJSON(h.ProcessPayment, "/v1/payments", payment)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "field_object") {
+		t.Errorf("expected 422 field_object for metadata that is not an object, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetPayment_NotFound_404(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+
+	w := getRequest(route("/v1/payments/{key}", h.GetPayment), "/v1/payments/missing")
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
 func TestCompletePayment_MethodNotAllowed(t *testing.T) {
 	repo := newMockRepo()
 	svc := service.NewIdempotencyService(repo, 24*time.Hour)
 	h := NewPaymentHandler(svc)
 
-	w := getRequest(h.CompletePayment, "/v1/payments/key/complete")
+	w := getRequest(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/key/complete")
 	if w.Code != 405 {
 		t.Errorf("expected 405, got %d", w.Code)
 	}
@@ -430,7 +1243,7 @@ func TestCompletePayment_InvalidJSON_400(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodPatch, "/v1/payments/key/complete", bytes.NewReader([]byte("bad")))
 	w := httptest.NewRecorder()
-	h.CompletePayment(w, req)
+	route("/v1/payments/{key}/complete", h.CompletePayment)(w, req)
 
 	if w.Code != 400 {
 		t.Errorf("expected 400, got %d", w.Code)
@@ -458,7 +1271,7 @@ func TestGetDuplicates_200(t *testing.T) {
 	reportingSvc := service.NewReportingService(repo)
 	h := NewReportingHandler(reportingSvc)
 
-	w := getRequest(h.GetDuplicates, "/v1/merchants/merchant-1/duplicates")
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates")
 
 	if w.Code != 200 {
 		t.Errorf("expected 200, got %d", w.Code)
@@ -471,6 +1284,33 @@ func TestGetDuplicates_200(t *testing.T) {
 	}
 }
 
+func TestGetDuplicates_Paginated(t *testing.T) {
+	repo := newMockRepo()
+	now := time.Now()
+	for _, key := range []string{"dup-a", "dup-b", "dup-c"} {
+		repo.records[key] = &domain.IdempotencyRecord{IdempotencyKey: key, MerchantID: "merchant-1", AttemptCount: 5,
+			Amount: 100, Currency: "USD", FirstSeenAt: now, LastSeenAt: now}
+	}
+	h := NewReportingHandler(service.NewReportingService(repo))
+
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?limit=2&offset=1")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report domain.DuplicateReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.SuspiciousKeys) != 2 || report.SuspiciousKeys[0].IdempotencyKey != "dup-b" || report.Page == nil ||
+		report.Page.Total != 3 || report.Page.NextOffset != nil || report.AmountAtRisk == nil || *report.AmountAtRisk != 1200 {
+		t.Errorf("unexpected page: %+v %+v", report.SuspiciousKeys, report.Page)
+	}
+
+	for _, q := range []string{"limit=0", "limit=1001", "limit=x", "offset=5", "limit=10&offset=-1"} {
+		if w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?"+q); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+		}
+	}
+}
+
 func TestGetDuplicates_WithTimeRange(t *testing.T) {
 	repo := newMockRepo()
 	reportingSvc := service.NewReportingService(repo)
@@ -478,7 +1318,7 @@ func TestGetDuplicates_WithTimeRange(t *testing.T) {
 
 	from := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
 	to := time.Now().Format(time.RFC3339)
-	w := getRequest(h.GetDuplicates, "/v1/merchants/merchant-1/duplicates?from="+from+"&to="+to)
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?from="+from+"&to="+to)
 
 	if w.Code != 200 {
 		t.Errorf("expected 200, got %d", w.Code)
@@ -490,7 +1330,7 @@ func TestGetDuplicates_MethodNotAllowed(t *testing.T) {
 	reportingSvc := service.NewReportingService(repo)
 	h := NewReportingHandler(reportingSvc)
 
-	w := postJSON(h.GetDuplicates, "/v1/merchants/merchant-1/duplicates", nil)
+	w := postJSON(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates", nil)
 	if w.Code != 405 {
 		t.Errorf("expected 405, got %d", w.Code)
 	}
@@ -507,276 +1347,2009 @@ func TestGetDuplicates_ShortPath_400(t *testing.T) {
 	}
 }
 
-// --- Policy handler tests ---
-
-func TestUpdatePolicy_PUT_200(t *testing.T) {
+func TestGetDuplicates_PDF(t *testing.T) {
 	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+	reportingSvc := service.NewReportingService(repo)
+	h := NewReportingHandler(reportingSvc)
 
-	body, _ := json.Marshal(map[string]interface{}{
-		"retry_policy": "standard",
-		"expiry_hours": 24,
-	})
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?format=pdf")
 
 	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("expected application/pdf, got %s", ct)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "duplicates-merchant-1-") {
+		t.Errorf("unexpected Content-Disposition: %s", w.Header().Get("Content-Disposition"))
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")) {
+		t.Error("expected body to be a PDF document")
 	}
 }
 
-func TestUpdatePolicy_GET_200(t *testing.T) {
+func TestGetDuplicates_Export(t *testing.T) {
 	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+	now := time.Now()
+	for _, key := range []string{"dup-a", "dup-b"} {
+		repo.records[key] = &domain.IdempotencyRecord{IdempotencyKey: key, MerchantID: "merchant-1", AttemptCount: 5,
+			Amount: 100, Currency: "USD", FirstSeenAt: now, LastSeenAt: now}
+	}
+	h := NewReportingHandler(service.NewReportingService(repo))
 
-	// First create
-	body, _ := json.Marshal(map[string]interface{}{
-		"retry_policy": "lenient",
-		"expiry_hours": 48,
-	})
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
-
-	// Then get
-	req2 := httptest.NewRequest(http.MethodGet, "/v1/merchants/merchant-1/policy", nil)
-	w2 := httptest.NewRecorder()
-	h.UpdatePolicy(w2, req2)
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?format=csv&limit=1")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if w.Code != 200 || err != nil || len(rows) != 3 || rows[0][0] != "idempotency_key" || rows[1][0] != "dup-a" || rows[1][5] != "400" {
+		t.Fatalf("unexpected CSV export: %d %v %v", w.Code, rows, err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("expected text/csv, got %s", ct)
+	}
 
-	if w2.Code != 200 {
-		t.Errorf("expected 200, got %d", w2.Code)
+	req := httptest.NewRequest(http.MethodGet, "/v1/merchants/merchant-1/duplicates", nil)
+	req.Header.Set("Accept", "application/x-ndjson; q=0.9, */*")
+	w = httptest.NewRecorder()
+	route("/v1/merchants/{id}/duplicates", h.GetDuplicates)(w, req)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var row domain.DuplicateRow
+	json.Unmarshal([]byte(lines[1]), &row)
+	if w.Header().Get("Content-Type") != "application/x-ndjson" || len(lines) != 2 || row.IdempotencyKey != "dup-b" || !row.Suspicious {
+		t.Errorf("unexpected NDJSON export: %s", w.Body.String())
 	}
 }
 
-func TestUpdatePolicy_GET_NotFound_404(t *testing.T) {
+func TestGetDuplicates_UnknownFormat_400(t *testing.T) {
 	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+	reportingSvc := service.NewReportingService(repo)
+	h := NewReportingHandler(reportingSvc)
 
-	req := httptest.NewRequest(http.MethodGet, "/v1/merchants/nonexistent/policy", nil)
-	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	w := getRequest(route("/v1/merchants/{id}/duplicates", h.GetDuplicates), "/v1/merchants/merchant-1/duplicates?format=xlsx")
+	if w.Code != 400 {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
 
-	if w.Code != 404 {
-		t.Errorf("expected 404, got %d", w.Code)
+func TestGetDigest_200(t *testing.T) {
+	repo := newMockRepo()
+	h := NewReportingHandler(service.NewReportingService(repo))
+
+	w := getRequest(route("/v1/merchants/{id}/digest", h.GetDigest), "/v1/merchants/merchant-1/digest?date=2026-01-15")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var digest domain.MerchantDigest
+	json.Unmarshal(w.Body.Bytes(), &digest)
+	if digest.MerchantID != "merchant-1" || digest.Date != "2026-01-15" {
+		t.Errorf("unexpected digest: %+v", digest)
 	}
 }
 
-func TestUpdatePolicy_InvalidRetryPolicy_422(t *testing.T) {
+func TestGetDigest_InvalidDate_400(t *testing.T) {
 	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+	h := NewReportingHandler(service.NewReportingService(repo))
 
-	body, _ := json.Marshal(map[string]interface{}{
-		"retry_policy": "invalid",
-		"expiry_hours": 24,
-	})
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	w := getRequest(route("/v1/merchants/{id}/digest", h.GetDigest), "/v1/merchants/merchant-1/digest?date=15-01-2026")
+	if w.Code != 400 {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestGetDigest_Today_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewReportingHandler(service.NewReportingService(repo))
 
+	today := time.Now().UTC().Format("2006-01-02")
+	w := getRequest(route("/v1/merchants/{id}/digest", h.GetDigest), "/v1/merchants/merchant-1/digest?date="+today)
 	if w.Code != 422 {
 		t.Errorf("expected 422, got %d", w.Code)
 	}
 }
 
-func TestUpdatePolicy_InvalidExpiryHours_422(t *testing.T) {
-	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+func TestAttemptSource(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set("User-Agent", "pos-terminal/2.1\x00"+strings.Repeat("x", 600))
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	ctx, fields := logging.NewContext(req.Context())
+	fields.RequestID = "req_1"
+
+	src := attemptSource(req.WithContext(ctx))
+	if src.IP != "203.0.113.7" {
+		t.Errorf("expected peer IP, got %q", src.IP)
+	}
+	if src.RequestID != "req_1" {
+		t.Errorf("expected request ID req_1, got %q", src.RequestID)
+	}
+	if !strings.HasPrefix(src.UserAgent, "pos-terminal/2.1x") || len(src.UserAgent) > maxUserAgentLen {
+		t.Errorf("unexpected user agent %q", src.UserAgent)
+	}
+}
 
-	body, _ := json.Marshal(map[string]interface{}{
-		"retry_policy": "standard",
-		"expiry_hours": 99,
-	})
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+// --- IETF Idempotency-Key mode tests ---
+
+func postIETF(h *PaymentHandler, key string, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
 	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	h.ProcessPayment(w, req)
+	return w
+}
 
-	if w.Code != 422 {
-		t.Errorf("expected 422, got %d", w.Code)
+func problemOf(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("expected application/problem+json, got %q", ct)
 	}
+	var p map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &p)
+	return p
 }
 
-func TestUpdatePolicy_InvalidJSON_400(t *testing.T) {
+func TestProcessPayment_IETF(t *testing.T) {
 	repo := newMockRepo()
-	h := NewPolicyHandler(repo)
+	h := NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour)).WithIETFMode()
+	payment := domain.PaymentRequest{MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
 
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader([]byte("bad")))
-	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	w := postIETF(h, "", payment)
+	if w.Code != 400 {
+		t.Fatalf("missing header: expected 400, got %d", w.Code)
+	}
+	if p := problemOf(t, w); p["type"] != "/problems/idempotency-key-missing" {
+		t.Errorf("unexpected problem: %v", p)
+	}
+
+	w = postIETF(h, `"ietf-key"`, payment)
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.IdempotencyKey != "ietf-key" {
+		t.Errorf("expected key from header, got %q", resp.IdempotencyKey)
+	}
+
+	w = postIETF(h, `"ietf-key"`, payment)
+	if w.Code != 409 {
+		t.Fatalf("concurrent: expected 409, got %d", w.Code)
+	}
+	if p := problemOf(t, w); p["type"] != "/problems/idempotency-key-in-use" || p["code"] != "already_processing" {
+		t.Errorf("unexpected problem: %v", p)
+	}
 
+	changed := payment
+	changed.Amount = 20000
+	w = postIETF(h, `"ietf-key"`, changed)
+	if w.Code != 422 {
+		t.Fatalf("mismatch: expected 422, got %d", w.Code)
+	}
+	if p := problemOf(t, w); p["type"] != "/problems/idempotency-key-reused" || p["status"] != float64(422) {
+		t.Errorf("unexpected problem: %v", p)
+	}
+
+	conflicting := payment
+	conflicting.IdempotencyKey = "other-key"
+	w = postIETF(h, `"ietf-key"`, conflicting)
 	if w.Code != 400 {
-		t.Errorf("expected 400, got %d", w.Code)
+		t.Fatalf("body/header conflict: expected 400, got %d", w.Code)
+	}
+	if p := problemOf(t, w); p["code"] != "idempotency_key_conflict" {
+		t.Errorf("unexpected problem: %v", p)
 	}
 }
 
-func TestUpdatePolicy_MethodNotAllowed(t *testing.T) {
+// --- Policy handler tests ---
+
+func TestUpdatePolicy_PUT_200(t *testing.T) {
 	repo := newMockRepo()
 	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodDelete, "/v1/merchants/merchant-1/policy", nil)
+	body, _ := json.Marshal(map[string]interface{}{
+		"retry_policy": "standard",
+		"expiry_hours": 24,
+	})
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 405 {
-		t.Errorf("expected 405, got %d", w.Code)
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
 	}
 }
 
-func TestUpdatePolicy_ShortPath_400(t *testing.T) {
+func TestUpdatePolicy_InvalidResponseSchema_422(t *testing.T) {
 	repo := newMockRepo()
 	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodPut, "/v1/merchants", bytes.NewReader([]byte("{}")))
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "response_schema": {"$ref": "#/x"}}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	h.UpdatePolicy(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 400 {
-		t.Errorf("expected 400 for short path, got %d", w.Code)
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
 	}
 }
 
-// --- mock pinger for health tests ---
-
-type mockPinger struct{ err error }
+func TestCompletePayment_ResponseSchemaMismatch_422(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	ph := NewPolicyHandler(repo)
 
-func (p *mockPinger) Ping() error { return p.err }
+	policy := []byte(`{"retry_policy": "standard", "expiry_hours": 24,
+		"response_schema": {"type": "object", "required": ["transaction_id"]}}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(policy))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", ph.UpdatePolicy)(w, req)
+	if w.Code != 200 {
+		t.Fatalf("policy update: expected 200, got %d", w.Code)
+	}
 
-// --- Health handler tests ---
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "schema-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
 
-func TestHealth_Healthy(t *testing.T) {
-	m := monitor.NewMetrics()
-	h := NewHealthHandler(&mockPinger{err: nil}, m)
+	bad := json.RawMessage(`{"error": "gateway timeout"}`)
+	w = patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/schema-key/complete", domain.CompleteRequest{Status: domain.StatusSucceeded, ResponseBody: &bad})
+	if w.Code != 422 {
+		t.Fatalf("expected 422, got %d: %s", w.Code, w.Body.String())
+	}
+	var errBody map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &errBody)
+	if errBody["code"] != "response_schema_mismatch" || !strings.Contains(fmt.Sprint(errBody["error"]), "transaction_id") {
+		t.Errorf("unexpected error body: %v", errBody)
+	}
 
-	w := getRequest(h.Health, "/health")
+	// Failed completions carry gateway errors and are not schema-checked.
+	w = patchJSON(route("/v1/payments/{key}/complete", h.CompletePayment), "/v1/payments/schema-key/complete", domain.CompleteRequest{Status: domain.StatusFailed, ResponseBody: &bad})
 	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+		t.Errorf("expected 200 for failed completion, got %d", w.Code)
 	}
 }
 
-func TestHealth_Unhealthy(t *testing.T) {
-	m := monitor.NewMetrics()
-	h := NewHealthHandler(&mockPinger{err: fmt.Errorf("connection refused")}, m)
+func TestProcessPayment_DuplicateMappedTo200(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	ph := NewPolicyHandler(repo)
 
-	w := getRequest(h.Health, "/health")
-	if w.Code != 503 {
-		t.Errorf("expected 503, got %d", w.Code)
+	policy := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "duplicate_status_code": 200}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(policy))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", ph.UpdatePolicy)(w, req)
+	if w.Code != 200 {
+		t.Fatalf("policy update: expected 200, got %d", w.Code)
 	}
-}
 
-func TestMetrics_200(t *testing.T) {
-	m := monitor.NewMetrics()
-	h := NewHealthHandler(&mockPinger{}, m)
+	payment := domain.PaymentRequest{
+		IdempotencyKey: "mapped-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	}
+	postJSON(h.ProcessPayment, "/v1/payments", payment)
+	w = postJSON(h.ProcessPayment, "/v1/payments", payment)
 
-	w := getRequest(h.Metrics, "/v1/metrics")
 	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+		t.Fatalf("expected 200, got %d", w.Code)
 	}
-
-	var snap monitor.MetricsSnapshot
-	json.Unmarshal(w.Body.Bytes(), &snap)
-	if snap.TotalRequests != 0 {
-		t.Errorf("expected 0, got %d", snap.TotalRequests)
+	if w.Header().Get(DuplicateHeader) != "true" {
+		t.Errorf("expected %s header", DuplicateHeader)
+	}
+	var resp domain.PaymentResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Duplicate || resp.Status != domain.StatusProcessing {
+		t.Errorf("expected processing duplicate, got %+v", resp)
 	}
 }
 
-func TestMetrics_MethodNotAllowed(t *testing.T) {
-	m := monitor.NewMetrics()
-	h := NewHealthHandler(&mockPinger{}, m)
+func TestUpdatePolicy_InvalidDuplicateStatusCode_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", nil)
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "duplicate_status_code": 202}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	h.Metrics(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 405 {
-		t.Errorf("expected 405, got %d", w.Code)
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
 	}
 }
 
-func TestHealth_MethodNotAllowed(t *testing.T) {
-	m := monitor.NewMetrics()
-	h := NewHealthHandler(&mockPinger{}, m)
+func TestUpdatePolicy_InvalidRateLimit_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodPost, "/health", nil)
-	w := httptest.NewRecorder()
-	h.Health(w, req)
+	for _, body := range []string{
+		`{"retry_policy": "standard", "expiry_hours": 24, "rate_limit_rps": -1}`,
+		`{"retry_policy": "standard", "expiry_hours": 24, "rate_limit_burst": 10}`,
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 405 {
-		t.Errorf("expected 405, got %d", w.Code)
+		if w.Code != 422 || !strings.Contains(w.Body.String(), "invalid_rate_limit") {
+			t.Errorf("%s: expected 422 invalid_rate_limit, got %d: %s", body, w.Code, w.Body.String())
+		}
 	}
 }
 
-// --- Middleware tests ---
-
-func TestLoggingMiddleware(t *testing.T) {
-	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	})
-	handler := Logging(inner)
+func TestUpdatePolicy_InvalidMismatchBehavior_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "mismatch_behavior": "accept_first"}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "invalid_mismatch_behavior") {
+		t.Errorf("expected 422 invalid_mismatch_behavior, got %d: %s", w.Code, w.Body.String())
 	}
 }
 
-func TestRecoveryMiddleware(t *testing.T) {
-	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		panic("test panic")
-	})
-	handler := Recovery(inner)
+func TestUpdatePolicy_InvalidTolerantField_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "tolerant_fields": ["customer_id", "amount"]}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Code != 500 {
-		t.Errorf("expected 500, got %d", w.Code)
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid_tolerant_field") {
+		t.Errorf("expected invalid_tolerant_field, got %s", w.Body.String())
 	}
 }
 
-func TestRequestIDMiddleware_Generated(t *testing.T) {
-	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	})
-	handler := RequestID(inner)
+func TestUpdatePolicy_InvalidBaseCurrency_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "base_currency": "dollars"}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Header().Get("X-Request-ID") == "" {
-		t.Error("expected X-Request-ID header to be set")
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid_base_currency") {
+		t.Errorf("expected invalid_base_currency, got %s", w.Body.String())
 	}
 }
 
-func TestRequestIDMiddleware_Passthrough(t *testing.T) {
-	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	})
-	handler := RequestID(inner)
+func TestUpdatePolicy_InvalidPaymentIDFormat_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
 
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
-	req.Header.Set("X-Request-ID", "custom-id-123")
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "payment_id_format": "kubo_{id}"}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
 
-	if w.Header().Get("X-Request-ID") != "custom-id-123" {
-		t.Errorf("expected custom-id-123, got %s", w.Header().Get("X-Request-ID"))
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid_payment_id_format") {
+		t.Errorf("expected invalid_payment_id_format, got %s", w.Body.String())
 	}
 }
 
-func TestWriteJSON(t *testing.T) {
+func TestUpdatePolicy_InvalidDuplicateAlert_422(t *testing.T) {
+	h := NewPolicyHandler(newMockRepo())
+
+	for _, alert := range []string{
+		`"duplicate_alert_threshold": 10`,
+		`"duplicate_alert_url": "https://merchant.example/hooks"`,
+		`"duplicate_alert_threshold": -1, "duplicate_alert_url": "https://merchant.example/hooks"`,
+		`"duplicate_alert_threshold": 10, "duplicate_alert_url": "merchant.example/hooks"`,
+	} {
+		body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, ` + alert + `}`)
+		req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+		if w.Code != 422 || !strings.Contains(w.Body.String(), "invalid_duplicate_alert") {
+			t.Errorf("%s: expected 422 invalid_duplicate_alert, got %d %s", alert, w.Code, w.Body.String())
+		}
+	}
+
+	body := []byte(`{"retry_policy": "standard", "expiry_hours": 24, "duplicate_alert_threshold": 10, "duplicate_alert_url": "https://merchant.example/hooks"}`)
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
 	w := httptest.NewRecorder()
-	writeJSON(w, 201, map[string]string{"key": "value"})
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+	if w.Code != 200 {
+		t.Errorf("expected 200 for a complete duplicate alert, got %d %s", w.Code, w.Body.String())
+	}
+}
 
-	if w.Code != 201 {
-		t.Errorf("expected 201, got %d", w.Code)
+func TestUpdatePolicy_GET_200(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	// First create
+	body, _ := json.Marshal(map[string]interface{}{
+		"retry_policy": "lenient",
+		"expiry_hours": 48,
+	})
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	// Then get
+	req2 := httptest.NewRequest(http.MethodGet, "/v1/merchants/merchant-1/policy", nil)
+	w2 := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w2, req2)
+
+	if w2.Code != 200 {
+		t.Errorf("expected 200, got %d", w2.Code)
 	}
-	if w.Header().Get("Content-Type") != "application/json" {
-		t.Errorf("expected application/json, got %s", w.Header().Get("Content-Type"))
+}
+
+func TestUpdatePolicy_SigningSecretWriteOnly(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+	put := func(body map[string]interface{}) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+		if w.Code != 200 {
+			t.Fatalf("PUT: expected 200, got %d", w.Code)
+		}
+	}
+
+	put(map[string]interface{}{"retry_policy": "standard", "expiry_hours": 24, "signing_secret": "s3cret"})
+	w := getRequest(route("/v1/merchants/{id}/policy", h.UpdatePolicy), "/v1/merchants/merchant-1/policy")
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("expected the signing secret hidden, got %s", w.Body.String())
+	}
+
+	put(map[string]interface{}{"retry_policy": "lenient", "expiry_hours": 48})
+	if got := repo.policies["merchant-1"].SigningSecret; got != "s3cret" {
+		t.Errorf("expected an update without signing_secret to keep it, got %q", got)
+	}
+	put(map[string]interface{}{"retry_policy": "lenient", "expiry_hours": 48, "signing_secret": ""})
+	if got := repo.policies["merchant-1"].SigningSecret; got != "" {
+		t.Errorf("expected an empty signing_secret to remove it, got %q", got)
+	}
+}
+
+func TestBulkPolicies(t *testing.T) {
+	repo := newMockRepo()
+	repo.policies["merchant-2"] = &domain.MerchantPolicy{MerchantID: "merchant-2", RetryPolicy: "standard", ExpiryHours: 24, SigningSecret: "s3cret"}
+	h := NewPolicyHandler(repo)
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/v1/merchants/policies", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.UpsertPolicies(w, req)
+		return w
+	}
+
+	w := put(`[{"merchant_id":"merchant-1","retry_policy":"lenient","expiry_hours":48},
+		{"merchant_id":"merchant-2","retry_policy":"strict_no_retry","expiry_hours":72},
+		{"merchant_id":"merchant-3","retry_policy":"standard","expiry_hours":24,"base_currency":"usd"}]`)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if p := repo.policies["merchant-2"]; p.RetryPolicy != "strict_no_retry" || p.SigningSecret != "s3cret" {
+		t.Errorf("expected merchant-2 replaced with its secret kept, got %+v", p)
+	}
+	if p := repo.policies["merchant-3"]; p.BaseCurrency != "USD" || p.DuplicateStatusCode != 409 {
+		t.Errorf("expected defaults filled in as for one policy, got %+v", p)
+	}
+
+	// One invalid policy rejects them all, listing every problem by index
+	w = put(`[{"merchant_id":"merchant-4","retry_policy":"standard","expiry_hours":24},
+		{"merchant_id":"merchant-1","retry_policy":"sometimes","expiry_hours":24},
+		{"retry_policy":"standard","expiry_hours":24},
+		{"merchant_id":"merchant-4","retry_policy":"standard","expiry_hours":24}]`)
+	var body errorBody
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 422 || body.Code != "invalid_retry_policy" || len(body.Violations) != 3 {
+		t.Fatalf("expected 422 with 3 violations, got %d: %s", w.Code, w.Body.String())
+	}
+	if body.Violations[0].Field != "[1]" || body.Violations[1].Code != "missing_merchant_id" || body.Violations[2].Code != "duplicate_merchant_id" {
+		t.Errorf("unexpected violations: %+v", body.Violations)
+	}
+	if _, ok := repo.policies["merchant-4"]; ok {
+		t.Error("expected no policy written when one is invalid")
+	}
+	if w := put(`[]`); w.Code != 422 {
+		t.Errorf("expected 422 for an empty update, got %d", w.Code)
+	}
+
+	w = getRequest(h.ListPolicies, "/v1/merchants/policies?limit=2")
+	var list domain.PolicyList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != 200 || list.Page.Total != 3 || len(list.Policies) != 2 || list.Page.NextOffset == nil || *list.Page.NextOffset != 2 {
+		t.Fatalf("expected the first 2 of 3 policies, got %d: %s", w.Code, w.Body.String())
+	}
+	if list.Policies[0].MerchantID != "merchant-1" || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("expected policies by merchant_id without secrets, got %s", w.Body.String())
+	}
+	if w := getRequest(h.ListPolicies, "/v1/merchants/policies?limit=5000"); w.Code != 400 {
+		t.Errorf("expected 400 for a limit over the maximum, got %d", w.Code)
+	}
+}
+
+func TestDeletePolicy(t *testing.T) {
+	repo := newMockRepo()
+	repo.policies["merchant-1"] = &domain.MerchantPolicy{MerchantID: "merchant-1", RetryPolicy: "standard", ExpiryHours: 24}
+	h := route("/v1/merchants/{id}/policy", NewPolicyHandler(repo).DeletePolicy)
+	del := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/merchants/merchant-1/policy", nil)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	if w := del(); w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := repo.policies["merchant-1"]; ok {
+		t.Error("expected the policy deleted")
+	}
+	if w := del(); w.Code != 404 || !strings.Contains(w.Body.String(), "policy_not_found") {
+		t.Errorf("expected 404 policy_not_found, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+	repo := newMockRepo()
+	repo.policies["merchant-1"] = &domain.MerchantPolicy{MerchantID: "merchant-1", SigningSecret: "s3cret"}
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := RequireSignature(service.NewSignatureVerifier(repo, 5*time.Minute), http.HandlerFunc(NewPaymentHandler(svc).ProcessPayment))
+	body := []byte(`{"idempotency_key":"k1","merchant_id":"merchant-1","customer_id":"c1","amount":100,"currency":"BRL"}`)
+	send := func(body []byte, ts, sig string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewReader(body))
+		req.Header.Set(SignatureTimestampHeader, ts)
+		req.Header.Set(SignatureHeader, sig)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	now := fmt.Sprint(time.Now().Unix())
+
+	if w := send(body, now, service.Sign("s3cret", now, body)); w.Code != 201 {
+		t.Errorf("signed: expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	tampered := bytes.Replace(body, []byte(`"amount":100`), []byte(`"amount":900`), 1)
+	if w := send(tampered, now, service.Sign("s3cret", now, body)); w.Code != 401 || !strings.Contains(w.Body.String(), "invalid_signature") {
+		t.Errorf("tampered: expected 401 invalid_signature, got %d: %s", w.Code, w.Body.String())
+	}
+	old := fmt.Sprint(time.Now().Add(-time.Hour).Unix())
+	if w := send(body, old, service.Sign("s3cret", old, body)); w.Code != 401 || !strings.Contains(w.Body.String(), "signature_expired") {
+		t.Errorf("replayed: expected 401 signature_expired, got %d: %s", w.Code, w.Body.String())
+	}
+	batch := []byte(`[{"idempotency_key":"k2","merchant_id":"other"},{"idempotency_key":"k3","merchant_id":"merchant-1"}]`)
+	if got := bodyMerchants(batch); len(got) != 2 || got[1] != "merchant-1" {
+		t.Errorf("expected both batch merchants checked, got %v", got)
+	}
+}
+
+func TestRequireKeySignature(t *testing.T) {
+	repo := newMockRepo()
+	repo.policies["merchant-1"] = &domain.MerchantPolicy{MerchantID: "merchant-1", SigningSecret: "s3cret"}
+	repo.records["k1"] = &domain.IdempotencyRecord{IdempotencyKey: "k1", MerchantID: "merchant-1", Status: domain.StatusProcessing, ExpiresAt: time.Now().Add(time.Hour)}
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	owner := func(ctx context.Context, key string) (string, error) {
+		rec, err := repo.GetByKeyPrimary(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		return rec.MerchantID, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("PATCH /v1/payments/{key}/complete",
+		RequireKeySignature(service.NewSignatureVerifier(repo, 5*time.Minute), owner, http.HandlerFunc(NewPaymentHandler(svc).CompletePayment)))
+	send := func(key string, body []byte, sig string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/v1/payments/"+key+"/complete", bytes.NewReader(body))
+		now := fmt.Sprint(time.Now().Unix())
+		req.Header.Set(SignatureTimestampHeader, now)
+		req.Header.Set(SignatureHeader, service.Sign(sig, now, body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	body := []byte(`{"status":"succeeded"}`)
+
+	if w := send("k1", body, "wrong"); w.Code != 401 || !strings.Contains(w.Body.String(), "invalid_signature") {
+		t.Errorf("wrong secret: expected 401 invalid_signature, got %d: %s", w.Code, w.Body.String())
+	}
+	if repo.records["k1"].Status != domain.StatusProcessing {
+		t.Error("expected an unsigned completion to leave the key processing")
+	}
+	if w := send("k1", body, "s3cret"); w.Code != 200 {
+		t.Errorf("signed: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("missing", body, "s3cret"); w.Code != 404 {
+		t.Errorf("unknown key: expected 404 from the handler, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdatePolicy_GET_NotFound_404(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/merchants/nonexistent/policy", nil)
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestUpdatePolicy_InvalidRetryPolicy_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"retry_policy": "invalid",
+		"expiry_hours": 24,
+	})
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+}
+
+func TestUpdatePolicy_InvalidExpiryHours_422(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"retry_policy": "standard",
+		"expiry_hours": 99,
+	})
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	if w.Code != 422 {
+		t.Errorf("expected 422, got %d", w.Code)
+	}
+}
+
+func TestUpdatePolicy_InvalidJSON_400(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants/merchant-1/policy", bytes.NewReader([]byte("bad")))
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	if w.Code != 400 {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestUpdatePolicy_MethodNotAllowed(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/merchants/merchant-1/policy", nil)
+	w := httptest.NewRecorder()
+	route("/v1/merchants/{id}/policy", h.UpdatePolicy)(w, req)
+
+	if w.Code != 405 {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestUpdatePolicy_ShortPath_400(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPolicyHandler(repo)
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/merchants", bytes.NewReader([]byte("{}")))
+	w := httptest.NewRecorder()
+	h.UpdatePolicy(w, req)
+
+	if w.Code != 400 {
+		t.Errorf("expected 400 for short path, got %d", w.Code)
+	}
+}
+
+// --- mock pinger for health tests ---
+
+type mockPinger struct{ err error }
+
+func (p *mockPinger) Ping() error { return p.err }
+
+type mockSchema struct {
+	applied  int
+	expected int
+	err      error
+}
+
+func (s *mockSchema) AppliedVersion(_ context.Context) (int, error) { return s.applied, s.err }
+func (s *mockSchema) ExpectedVersion() int                          { return s.expected }
+
+// --- Health handler tests ---
+
+func TestHealth_Healthy(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{err: nil}, m)
+
+	w := getRequest(h.Health, "/health")
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestHealth_Unhealthy(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{err: fmt.Errorf("connection refused")}, m)
+
+	w := getRequest(h.Health, "/health")
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestHealth_ReportsCircuitState(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{}, m)
+
+	var body map[string]string
+	json.Unmarshal(getRequest(h.Health, "/health").Body.Bytes(), &body)
+	if body["circuit_breaker"] != "closed" {
+		t.Errorf("expected a closed circuit, got %v", body)
+	}
+	m.RecordCircuitState("open")
+	json.Unmarshal(getRequest(h.Health, "/health").Body.Bytes(), &body)
+	if body["circuit_breaker"] != "open" {
+		t.Errorf("expected an open circuit, got %v", body)
+	}
+}
+
+func TestReady_SchemaMatches_200(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{}, &mockSchema{applied: 3, expected: 3})
+
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestReady_SchemaMismatch_503(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{}, &mockSchema{applied: 2, expected: 3})
+
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["reason"] != "schema version mismatch" {
+		t.Errorf("unexpected reason: %v", body["reason"])
+	}
+}
+
+func TestReady_SchemaError_503(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{}, &mockSchema{err: fmt.Errorf("relation does not exist")})
+
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestReady_NoSchema_200(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{}, nil)
+
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != 200 {
+		t.Errorf("expected 200 without a schema to check, got %d", w.Code)
+	}
+	h = NewReadinessHandler(&mockPinger{err: fmt.Errorf("connection refused")}, nil)
+	if w := getRequest(h.Ready, "/health/ready"); w.Code != 503 {
+		t.Errorf("expected 503 when the store is down, got %d", w.Code)
+	}
+}
+
+func TestReady_DBDown_503(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{err: fmt.Errorf("connection refused")}, &mockSchema{applied: 1, expected: 1})
+
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+}
+
+type slowPinger struct{ delay time.Duration }
+
+func (p *slowPinger) Ping() error {
+	time.Sleep(p.delay)
+	return nil
+}
+
+type mockExpired struct{ n int64 }
+
+func (m *mockExpired) CountExpired(ctx context.Context, limit int) (int64, error) {
+	return min(m.n, int64(limit)), nil
+}
+
+func TestLivez_IgnoresDependencies(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{err: fmt.Errorf("connection refused")}, &mockSchema{err: fmt.Errorf("down")})
+	h.SetDraining()
+
+	w := getRequest(h.Live, "/livez")
+	if w.Code != 200 {
+		t.Fatalf("expected 200 while the database is down, got %d", w.Code)
+	}
+	var body liveness
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Status != "alive" {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestReadyz_ReportsEachCheck(t *testing.T) {
+	backlog := &mockExpired{n: 5}
+	h := NewReadinessHandler(&mockPinger{}, &mockSchema{applied: 3, expected: 3}).WithSweepBacklog(backlog, 10)
+
+	w := getRequest(h.Ready, "/readyz")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body readinessReport
+	json.Unmarshal(w.Body.Bytes(), &body)
+	for _, name := range []string{"database", "schema", "sweeper_backlog"} {
+		if c, ok := body.Checks[name]; !ok || c.Status != "ok" {
+			t.Errorf("expected check %s ok, got %+v", name, body.Checks)
+		}
+	}
+	if c := body.Checks["schema"]; c.AppliedVersion != 3 {
+		t.Errorf("expected applied version 3, got %+v", c)
+	}
+	if c := body.Checks["sweeper_backlog"]; c.ExpiredKeys == nil || *c.ExpiredKeys != 5 {
+		t.Errorf("expected 5 expired keys, got %+v", c)
+	}
+
+	backlog.n = 50
+	w = getRequest(h.Ready, "/readyz")
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 503 || body.Reason != "expired key backlog" || body.Checks["sweeper_backlog"].Status != "fail" {
+		t.Errorf("expected a failed backlog check, got %d %s", w.Code, w.Body.String())
+	}
+	if body.Checks["database"].Status != "ok" {
+		t.Errorf("expected the database check to still run, got %+v", body.Checks)
+	}
+}
+
+func TestReadyz_PingTimeout(t *testing.T) {
+	h := NewReadinessHandler(&slowPinger{delay: time.Second}, nil).WithCheckTimeout(20 * time.Millisecond)
+
+	start := time.Now()
+	w := getRequest(h.Ready, "/readyz")
+	if w.Code != 503 {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the check to give up after its timeout, took %s", elapsed)
+	}
+	var body readinessReport
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Reason != "database disconnected" || body.Checks["database"].Error == "" {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestMetrics_200(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{}, m)
+
+	w := getRequest(h.Metrics, "/v1/metrics")
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	var snap monitor.MetricsSnapshot
+	json.Unmarshal(w.Body.Bytes(), &snap)
+	if snap.TotalRequests != 0 {
+		t.Errorf("expected 0, got %d", snap.TotalRequests)
+	}
+}
+
+func TestMetrics_MethodNotAllowed(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{}, m)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", nil)
+	w := httptest.NewRecorder()
+	h.Metrics(w, req)
+
+	if w.Code != 405 {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestHealth_MethodNotAllowed(t *testing.T) {
+	m := monitor.NewMetrics()
+	h := NewHealthHandler(&mockPinger{}, m)
+
+	req := httptest.NewRequest(http.MethodPost, "/health", nil)
+	w := httptest.NewRecorder()
+	h.Health(w, req)
+
+	if w.Code != 405 {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+// --- Middleware tests ---
+
+func TestLoggingMiddleware(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	handler := Logging(inner)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	})
+	handler := Recovery(inner)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 500 {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+}
+
+func TestRequestIDMiddleware_Generated(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	handler := RequestID(inner)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("expected X-Request-ID header to be set")
+	}
+}
+
+func TestRequestIDMiddleware_Passthrough(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	handler := RequestID(inner)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("X-Request-ID", "custom-id-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Request-ID") != "custom-id-123" {
+		t.Errorf("expected custom-id-123, got %s", w.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, 201, map[string]string{"key": "value"})
+
+	if w.Code != 201 {
+		t.Errorf("expected 201, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected application/json, got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestMiddlewareChain_PropagatesRequestID(t *testing.T) {
+	var got string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = logging.FromContext(r.Context()).RequestID
+		w.WriteHeader(200)
+	})
+	handler := Recovery(Logging(RequestID(inner)))
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("X-Request-ID", "chain-id-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if got != "chain-id-1" {
+		t.Errorf("expected chain-id-1 in context, got %q", got)
+	}
+}
+
+// --- Storage outage tests ---
+
+// unavailableRepo fails every payment call as an open circuit would.
+type unavailableRepo struct {
+	*mockRepo
+}
+
+func (u *unavailableRepo) InsertOrGet(_ context.Context, _ domain.PaymentRequest, _ string, _ time.Time) (*domain.IdempotencyRecord, bool, error) {
+	return nil, false, &storage.CircuitOpenError{RetryAfter: 7 * time.Second}
+}
+
+func TestProcessPayment_CircuitOpen_503(t *testing.T) {
+	svc := service.NewIdempotencyService(&unavailableRepo{newMockRepo()}, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	w := postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "outage-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "7" {
+		t.Errorf("expected Retry-After 7, got %q", got)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["retryable"] != true || body["retry_after_seconds"] != float64(7) {
+		t.Errorf("expected retryable after 7s, got %v", body)
+	}
+}
+
+// timeoutRepo fails inserts as a key whose lock another request holds would.
+type timeoutRepo struct {
+	*mockRepo
+}
+
+func (u *timeoutRepo) InsertOrGet(_ context.Context, _ domain.PaymentRequest, _ string, _ time.Time) (*domain.IdempotencyRecord, bool, error) {
+	return nil, false, fmt.Errorf("advisory lock: %w", domain.ErrLockTimeout)
+}
+
+func TestProcessPayment_LockTimeout_504(t *testing.T) {
+	svc := service.NewIdempotencyService(&timeoutRepo{newMockRepo()}, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+
+	w := postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "stuck-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", w.Code)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["code"] != "lock_timeout" || body["retryable"] != true {
+		t.Errorf("expected retryable lock_timeout, got %v", body)
+	}
+}
+
+func TestForceFailKey_UnsticksRetry(t *testing.T) {
+	svc := service.NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	payment := domain.PaymentRequest{
+		IdempotencyKey: "stuck-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	}
+	postJSON(h.ProcessPayment, "/v1/payments", payment)
+
+	forceFail := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/keys/"+key+"/force-fail", nil)
+		req.SetPathValue("key", key)
+		w := httptest.NewRecorder()
+		h.ForceFailKey(w, req)
+		return w
+	}
+
+	w := forceFail("stuck-key")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"failed"`) {
+		t.Fatalf("expected 200 failed, got %d %s", w.Code, w.Body.String())
+	}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payment); w.Code != http.StatusCreated {
+		t.Errorf("expected the retry accepted, got %d", w.Code)
+	}
+	if w := forceFail("missing-key"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", w.Code)
+	}
+
+	svc.MarkComplete(context.Background(), "stuck-key", domain.CompleteRequest{Status: domain.StatusSucceeded})
+	if w := forceFail("stuck-key"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a completed key, got %d", w.Code)
+	}
+}
+
+// restoreStore answers every restore with err.
+type restoreStore struct{ err error }
+
+func (s restoreStore) SaveRestorePoint(context.Context, string, string, domain.IdempotencyRecord, time.Time) error {
+	return nil
+}
+
+func (s restoreStore) RestoreKey(context.Context, string) error { return s.err }
+
+func TestRestoreKey(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	h := NewPaymentHandler(svc)
+	postJSON(h.ProcessPayment, "/v1/payments", domain.PaymentRequest{
+		IdempotencyKey: "restore-key",
+		MerchantID:     "merchant-1",
+		CustomerID:     "customer-1",
+		Amount:         10000,
+		Currency:       "BRL",
+	})
+
+	restore := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/payments/"+key+"/restore", nil)
+		req.SetPathValue("key", key)
+		w := httptest.NewRecorder()
+		h.RestoreKey(w, req)
+		return w
+	}
+
+	if w := restore("restore-key"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without restores, got %d", w.Code)
+	}
+	svc.WithRestores(restoreStore{}, time.Hour)
+	if w := restore("restore-key"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"restored"`) {
+		t.Errorf("expected 200 restored, got %d %s", w.Code, w.Body.String())
+	}
+	if w := restore("missing-key"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", w.Code)
+	}
+	for err, want := range map[error]struct {
+		status int
+		code   string
+	}{
+		domain.ErrNothingToRestore: {http.StatusNotFound, "nothing_to_restore"},
+		domain.ErrKeyReused:        {http.StatusConflict, "key_reused"},
+	} {
+		svc.WithRestores(restoreStore{err: err}, time.Hour)
+		if w := restore("restore-key"); w.Code != want.status || !strings.Contains(w.Body.String(), want.code) {
+			t.Errorf("%v: expected %d %s, got %d %s", err, want.status, want.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// --- Metrics WebSocket tests ---
+
+func TestMetricsStream_SendsSnapshots(t *testing.T) {
+	m := monitor.NewMetrics()
+	m.RecordNew()
+	h := NewHealthHandler(&mockPinger{}, m)
+	h.streamInterval = 10 * time.Millisecond
+
+	srv := httptest.NewServer(Logging(http.HandlerFunc(h.MetricsStream)))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprintf(conn, "GET /v1/metrics/ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	// Accept value for the RFC 6455 sample key.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept header %q", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(br, head); err != nil {
+			t.Fatalf("frame %d header: %v", i, err)
+		}
+		if head[0] != 0x81 {
+			t.Fatalf("expected final text frame, got %#x", head[0])
+		}
+		n := int(head[1] & 0x7F)
+		if n == 126 {
+			ext := make([]byte, 2)
+			io.ReadFull(br, ext)
+			n = int(ext[0])<<8 | int(ext[1])
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("frame %d payload: %v", i, err)
+		}
+		var snap monitor.MetricsSnapshot
+		if err := json.Unmarshal(payload, &snap); err != nil {
+			t.Fatalf("frame %d: invalid JSON: %v", i, err)
+		}
+		if snap.NewPayments != 1 {
+			t.Errorf("frame %d: expected 1 new payment, got %d", i, snap.NewPayments)
+		}
+	}
+}
+
+func TestMetricsStream_RequiresUpgrade(t *testing.T) {
+	h := NewHealthHandler(&mockPinger{}, monitor.NewMetrics())
+
+	w := getRequest(h.MetricsStream, "/v1/metrics/ws")
+	if w.Code != 400 {
+		t.Errorf("expected 400 without upgrade headers, got %d", w.Code)
+	}
+}
+
+// --- Admin auth and dashboard tests ---
+
+type mockSeeder struct {
+	calls int
+	err   error
+}
+
+func (m *mockSeeder) Seed(ctx context.Context) error {
+	m.calls++
+	return m.err
+}
+
+func TestSeed(t *testing.T) {
+	seeder := &mockSeeder{}
+	w := postJSON(NewSeedHandler(seeder, true).Seed, "/v1/admin/seed", nil)
+	if w.Code != 200 || seeder.calls != 1 {
+		t.Errorf("expected 200 and one seed, got %d after %d: %s", w.Code, seeder.calls, w.Body.String())
+	}
+
+	w = postJSON(NewSeedHandler(seeder, false).Seed, "/v1/admin/seed", nil)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "seed_disabled") || seeder.calls != 1 {
+		t.Errorf("expected 403 seed_disabled without seeding in prod, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := postJSON(NewSeedHandler(nil, true).Seed, "/v1/admin/seed", nil); w.Code != 503 {
+		t.Errorf("expected 503 without Postgres, got %d", w.Code)
+	}
+
+	seeder.err = fmt.Errorf("relation does not exist")
+	if w := postJSON(NewSeedHandler(seeder, true).Seed, "/v1/admin/seed", nil); w.Code != 500 {
+		t.Errorf("expected 500 when seeding fails, got %d", w.Code)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) })
+
+	cases := []struct {
+		name  string
+		token string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"disabled", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer x") }, 403},
+		{"missing", "secret", func(r *http.Request) {}, 401},
+		{"wrong bearer", "secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, 401},
+		{"bearer", "secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, 200},
+		{"basic", "secret", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/dashboard", nil)
+			tc.setup(req)
+			w := httptest.NewRecorder()
+			AdminAuth(tc.token, ok).ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestDashboard_Page(t *testing.T) {
+	h := NewDashboardHandler(service.NewReportingService(newMockRepo()), monitor.NewMetrics())
+
+	w := getRequest(h.Page, "/admin/dashboard")
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("expected html, got %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "/admin/dashboard/data") {
+		t.Error("page should poll the data endpoint")
+	}
+}
+
+func TestDashboard_Data(t *testing.T) {
+	m := monitor.NewMetrics()
+	m.RecordDuplicate()
+	h := NewDashboardHandler(service.NewReportingService(newMockRepo()), m)
+
+	w := getRequest(h.Data, "/admin/dashboard/data")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		Metrics      monitor.MetricsSnapshot   `json:"metrics"`
+		TopMerchants []domain.MerchantActivity `json:"top_merchants"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if body.Metrics.DuplicateBlocked != 1 {
+		t.Errorf("expected 1 duplicate blocked, got %d", body.Metrics.DuplicateBlocked)
+	}
+}
+
+type featureStore []domain.KeyActivity
+
+func (s featureStore) StreamKeyActivity(_ context.Context, _, _ time.Time, _ string, fn func(domain.KeyActivity) error) error {
+	for _, a := range s {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFeatureExport_CSVAndJSONL(t *testing.T) {
+	now := time.Now()
+	store := featureStore{{
+		Record:       domain.IdempotencyRecord{IdempotencyKey: "k1", MerchantID: "merchant-1", Amount: 100, Currency: "MXN", Status: domain.StatusFailed, AttemptCount: 2, FirstSeenAt: now, LastSeenAt: now.Add(2 * time.Second)},
+		AttemptTimes: []time.Time{now, now.Add(2 * time.Second)},
+	}}
+	h := NewFeatureHandler(service.NewFeatureService(store))
+
+	w := getRequest(h.Export, "/admin/export/features?format=csv")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected csv, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "key_hash,merchant_id,") || !strings.Contains(lines[1], ",failed,2,") {
+		t.Errorf("unexpected csv: %q", w.Body.String())
+	}
+
+	w = getRequest(h.Export, "/admin/export/features")
+	var row domain.KeyFeatures
+	if err := json.Unmarshal(w.Body.Bytes(), &row); err != nil {
+		t.Fatalf("expected one JSON line: %v", err)
+	}
+	if row.MerchantID != "merchant-1" || len(row.InterAttemptSeconds) != 1 || row.InterAttemptSeconds[0] != 2 {
+		t.Errorf("unexpected row: %+v", row)
+	}
+}
+
+func TestFeatureExport_InvalidRange_400(t *testing.T) {
+	h := NewFeatureHandler(service.NewFeatureService(featureStore{}))
+	w := getRequest(h.Export, "/admin/export/features?from=2026-03-02T00:00:00Z&to=2026-03-01T00:00:00Z")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_time_range") {
+		t.Errorf("expected 400 invalid_time_range, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResetMetrics(t *testing.T) {
+	m := monitor.NewMetrics()
+	m.RecordNew()
+	h := NewHealthHandler(nil, m)
+
+	w := getRequest(h.ResetMetrics, "/v1/metrics/reset")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics/reset", nil)
+	w = httptest.NewRecorder()
+	h.ResetMetrics(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"previous_period"`) {
+		t.Errorf("expected 200 with previous_period, got %d %s", w.Code, w.Body.String())
+	}
+	if m.Snapshot().TotalRequests != 0 {
+		t.Error("expected counters reset")
+	}
+}
+
+func TestMetricsHistory_InvalidRange_400(t *testing.T) {
+	h := NewHealthHandler(nil, monitor.NewMetrics()).
+		WithHistory(service.NewMetricsHistory(nil, nil, "api-1", time.Minute))
+	w := getRequest(h.MetricsHistory, "/v1/metrics/history?from=yesterday")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_time_range") {
+		t.Errorf("expected 400 invalid_time_range, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMetricsHistory_Disabled_503(t *testing.T) {
+	h := NewHealthHandler(nil, monitor.NewMetrics())
+	w := getRequest(h.MetricsHistory, "/v1/metrics/history")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without history, got %d", w.Code)
+	}
+}
+
+func TestRequestLogger_PopulatesFields(t *testing.T) {
+	var got logging.Fields
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/merchants/", func(w http.ResponseWriter, r *http.Request) {
+		got = *logging.FromContext(r.Context())
+	})
+	h := RequestLogger(logging.LevelWarn, mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/merchants/m1/policy", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Route != "GET /v1/merchants/" || got.MerchantID != "m1" || got.Level != logging.LevelWarn {
+		t.Errorf("unexpected fields %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/merchants/m1/policy", nil)
+	req.Header.Set(LogLevelHeader, "debug")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Level != logging.LevelDebug {
+		t.Errorf("expected X-Log-Level to override the level, got %v", got.Level)
+	}
+
+	var level logging.LevelVar
+	h = RequestLogger(&level, mux)
+	level.Set(logging.LevelError)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/merchants/m1/policy", nil))
+	if got.Level != logging.LevelError {
+		t.Errorf("expected a changed level applied from the next request, got %v", got.Level)
+	}
+}
+
+func TestRecordOutcomes_ClassifiesPaymentsAndOtherRoutes(t *testing.T) {
+	m := monitor.NewMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/payments", NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour)).ProcessPayment)
+	mux.HandleFunc("/v1/merchants/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	h := RecordOutcomes(m, RequestLogger(logging.LevelInfo, mux))
+
+	body := `{"idempotency_key":"k1","merchant_id":"m1","amount":10,"currency":"USD","customer_id":"c1"}`
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body)))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/merchants/m1/policy", nil))
+
+	snap := m.Snapshot()
+	if snap.NewPayments != 1 || snap.DuplicateBlocked != 1 {
+		t.Errorf("expected 1 new and 1 duplicate, got %d %d", snap.NewPayments, snap.DuplicateBlocked)
+	}
+	if snap.Routes["GET /v1/merchants/"]["client_error"] != 1 {
+		t.Errorf("expected the merchant route counted, got %v", snap.Routes)
+	}
+}
+
+func TestRequestLogger_RouteErrors(t *testing.T) {
+	var got string
+	mux := http.NewServeMux()
+	policy := func(w http.ResponseWriter, r *http.Request) { got = r.PathValue("id") }
+	mux.HandleFunc("GET /v1/merchants/{id}/policy", policy)
+	mux.HandleFunc("PUT /v1/merchants/{id}/policy", policy)
+	mux.HandleFunc("PATCH /v1/payments/{key}/complete", func(w http.ResponseWriter, r *http.Request) {})
+	h := RequestLogger(logging.LevelInfo, mux)
+
+	w := getRequest(h.ServeHTTP, "/v1/merchants/m1/policy")
+	if w.Code != 200 || got != "m1" {
+		t.Errorf("expected policy served for m1, got %d %q", w.Code, got)
+	}
+	for _, path := range []string{"/v1/merchants/m1/unknown", "/v1/merchants/m1/policy/extra", "/v1/merchants/m1", "/v1/payments/a/b/complete"} {
+		w = getRequest(h.ServeHTTP, path)
+		if w.Code != 404 || !strings.Contains(w.Body.String(), "resource_not_found") {
+			t.Errorf("%s: expected 404 resource_not_found, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/merchants/m1/policy", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 405 || !strings.Contains(w.Body.String(), "method_not_allowed") || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON 405, got %d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "GET") || !strings.Contains(allow, "PUT") {
+		t.Errorf("expected Allow: GET, PUT, got %q", allow)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	repo := newMockRepo()
+	repo.records["s1"] = &domain.IdempotencyRecord{IdempotencyKey: "s1", MerchantID: "merchant-1", Status: domain.StatusSucceeded, AttemptCount: 3}
+	repo.records["s2"] = &domain.IdempotencyRecord{IdempotencyKey: "s2", MerchantID: "merchant-1", Status: domain.StatusFailed, AttemptCount: 1}
+	h := NewReportingHandler(service.NewReportingService(repo))
+	w := getRequest(route("/v1/merchants/{id}/stats", h.GetStats), "/v1/merchants/merchant-1/stats")
+	var stats domain.MerchantStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if w.Code != 200 || stats.MerchantID != "merchant-1" {
+		t.Errorf("expected 200 for merchant-1, got %d %s", w.Code, w.Body.String())
+	}
+	if stats.TotalRequests != 4 || stats.RetriedKeys != 1 || stats.Succeeded != 1 || stats.Failed != 1 || stats.AvgCompletionMs != nil {
+		t.Errorf("unexpected stats %s", w.Body.String())
+	}
+
+	w = getRequest(route("/v1/merchants/{id}/stats", h.GetStats), "/v1/merchants/merchant-1/stats?from=yesterday")
+	if w.Code != 400 {
+		t.Errorf("expected 400 for an invalid range, got %d", w.Code)
+	}
+}
+
+func TestGetTrends(t *testing.T) {
+	repo := newMockRepo()
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	repo.records["t1"] = &domain.IdempotencyRecord{IdempotencyKey: "t1", MerchantID: "merchant-1", AttemptCount: 4, FirstSeenAt: start.Add(5 * time.Minute)}
+	repo.records["t2"] = &domain.IdempotencyRecord{IdempotencyKey: "t2", MerchantID: "merchant-1", AttemptCount: 1, FirstSeenAt: start.Add(10 * time.Minute)}
+	repo.records["t3"] = &domain.IdempotencyRecord{IdempotencyKey: "t3", MerchantID: "merchant-1", AttemptCount: 1, FirstSeenAt: start.Add(2 * time.Hour)}
+	h := route("/v1/merchants/{id}/duplicates/trends", NewReportingHandler(service.NewReportingService(repo)).GetTrends)
+
+	w := getRequest(h, "/v1/merchants/merchant-1/duplicates/trends?from=2026-03-10T12:00:00Z&to=2026-03-10T14:30:00Z")
+	var trends domain.DuplicateTrends
+	json.Unmarshal(w.Body.Bytes(), &trends)
+	if w.Code != 200 || trends.BucketSeconds != 3600 || len(trends.Buckets) != 3 {
+		t.Fatalf("expected 3 hourly buckets, got %d %s", w.Code, w.Body.String())
+	}
+	if b := trends.Buckets[0]; !b.Start.Equal(start) || b.TotalRequests != 5 || b.DuplicateCount != 3 || b.DuplicateRate != 60 {
+		t.Errorf("first bucket: %+v", b)
+	}
+	if b := trends.Buckets[1]; b.TotalRequests != 0 || b.DuplicateRate != 0 {
+		t.Errorf("expected an empty second bucket, got %+v", b)
+	}
+	if b := trends.Buckets[2]; b.TotalRequests != 1 || b.UniquePayments != 1 {
+		t.Errorf("third bucket: %+v", b)
+	}
+
+	w = getRequest(h, "/v1/merchants/merchant-1/duplicates/trends?from=2026-03-10T12:00:00Z&to=2026-03-10T14:30:00Z&bucket=15m")
+	json.Unmarshal(w.Body.Bytes(), &trends)
+	if w.Code != 200 || len(trends.Buckets) != 11 || trends.Buckets[0].TotalRequests != 5 {
+		t.Errorf("expected 11 quarter-hour buckets, got %d %s", w.Code, w.Body.String())
+	}
+
+	for _, q := range []string{"bucket=hourly", "bucket=90s", "bucket=0", "bucket=1m&from=2026-01-01T00:00:00Z", "from=yesterday"} {
+		if w := getRequest(h, "/v1/merchants/merchant-1/duplicates/trends?"+q); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+		}
+	}
+}
+
+func TestGetStatsTable_InvalidParams_400(t *testing.T) {
+	h := NewReportingHandler(service.NewReportingService(newMockRepo()))
+	for _, path := range []string{"/v1/stats?sort=amount", "/v1/stats?top=0", "/v1/stats?top=ten"} {
+		if w := getRequest(h.GetStatsTable, path); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", path, w.Code)
+		}
+	}
+	if w := getRequest(h.GetStatsTable, "/v1/stats?sort=unique&top=5"); w.Code != 200 {
+		t.Errorf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReady_FailsWhileDraining(t *testing.T) {
+	h := NewReadinessHandler(&mockPinger{}, &mockSchema{applied: 3, expected: 3})
+	if w := getRequest(h.Ready, "/health/ready"); w.Code != 200 {
+		t.Fatalf("expected ready, got %d", w.Code)
+	}
+	h.SetDraining()
+	w := getRequest(h.Ready, "/health/ready")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "shutting down") {
+		t.Errorf("expected 503 shutting down, got %d %s", w.Code, w.Body.String())
+	}
+	if err := h.Check(context.Background()); err == nil {
+		t.Error("expected Check to fail while draining")
+	}
+}
+
+type mockPool struct{ stats sql.DBStats }
+
+func (p mockPool) Stats() sql.DBStats { return p.stats }
+
+func TestDiagnosticsBundle(t *testing.T) {
+	m := monitor.NewMetrics()
+	m.RecordOutcome("POST /v1/payments", "server_error")
+	m.RecordOutcome("GET /v1/payments/{key}", "client_error")
+	m.RecordOutcome("GET /v1/payments/{key}", "ok")
+	workers := func() []WorkerStatus {
+		return []WorkerStatus{{Name: "reconciler", State: "running"}, {Name: "digests", State: "running"}}
+	}
+	h := NewDiagnosticsHandler(mockPool{sql.DBStats{MaxOpenConnections: 25, InUse: 3}}, m, map[string]string{"AdminToken": "****"}).
+		WithWorkers(workers).
+		WithAnomalies(monitor.NewAnomalyLog(m, time.Second)).
+		WithReadiness(NewReadinessHandler(&mockPinger{}, &mockSchema{applied: 3, expected: 3}))
+
+	w := getRequest(h.Bundle, "/admin/diagnostics")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		Config   map[string]string        `json:"config"`
+		DBPool   dbPoolStats              `json:"db_pool"`
+		Workers  []WorkerStatus           `json:"workers"`
+		Errors   errorCounts              `json:"errors"`
+		Ready    map[string]any           `json:"readiness"`
+		Episodes []monitor.AnomalyEpisode `json:"anomaly_episodes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Config["AdminToken"] != "****" || body.DBPool.MaxOpen != 25 || body.DBPool.InUse != 3 {
+		t.Errorf("unexpected config or pool: %+v %+v", body.Config, body.DBPool)
+	}
+	if len(body.Workers) != 2 || body.Workers[0].Name != "digests" {
+		t.Errorf("expected workers sorted by name, got %+v", body.Workers)
+	}
+	if body.Errors.ServerError != 1 || body.Errors.ClientError != 1 || len(body.Errors.ByRoute) != 2 {
+		t.Errorf("unexpected error counts: %+v", body.Errors)
+	}
+	if body.Ready["status"] != "ready" || body.Episodes == nil {
+		t.Errorf("expected readiness and an empty episode list, got %v %v", body.Ready, body.Episodes)
+	}
+}
+
+type pendingGateway struct{}
+
+func (pendingGateway) Submit(_ context.Context, _ domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	return domain.StatusProcessing, nil, nil
+}
+
+func TestProcessPayment_AsyncQueue(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour)
+	m := monitor.NewMetrics()
+	h := NewPaymentHandler(svc).WithQueue(service.NewPaymentQueue(svc, pendingGateway{}, 1, 1, m))
+
+	payload := domain.PaymentRequest{IdempotencyKey: "async-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 202 {
+		t.Fatalf("expected 202 once queued, got %d", w.Code)
+	}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 409 {
+		t.Errorf("expected a duplicate to get 409 without queueing, got %d", w.Code)
+	}
+
+	payload.IdempotencyKey = "async-2"
+	w := postJSON(h.ProcessPayment, "/v1/payments", payload)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After on a full queue, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"queue_full"`) {
+		t.Errorf("expected queue_full, got %s", w.Body.String())
+	}
+	if q := m.Snapshot().Queue; q == nil || q.Depth != 1 || q.Capacity != 1 || q.Rejected != 1 {
+		t.Errorf("unexpected queue metrics: %+v", q)
+	}
+}
+
+func TestDeadLetters_SyncModeIsEmpty(t *testing.T) {
+	h := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour))
+	w := getRequest(h.DeadLetters, "/v1/admin/dead-letters")
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"dead_letters":[]}` {
+		t.Errorf("expected an empty list, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetConfig_ReportsReloads(t *testing.T) {
+	active := ActiveConfig{Source: "/etc/shield.env", Reloadable: []string{"LogLevel"}, Config: map[string]string{"LogLevel": "info"}}
+	h := NewConfigHandler(func() ActiveConfig { return active })
+
+	active.Config = map[string]string{"LogLevel": "debug"}
+	w := getRequest(h.GetConfig, "/v1/admin/config")
+	var body ActiveConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || body.Source != "/etc/shield.env" || body.Config["LogLevel"] != "debug" {
+		t.Errorf("expected the reloaded configuration, got %d %+v", w.Code, body)
+	}
+	if strings.Contains(w.Body.String(), "last_reload_error") {
+		t.Errorf("expected no reload error, got %s", w.Body.String())
+	}
+}
+
+func TestGetAnomaly_TracksMerchantOutcomes(t *testing.T) {
+	anomalies := monitor.NewMerchantAnomalies(5*time.Minute, 20, 2)
+	m := monitor.NewMetrics().WithMerchantAnomalies(anomalies)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/payments", NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour)).ProcessPayment)
+	h := RecordOutcomes(m, RequestLogger(logging.LevelInfo, mux))
+
+	body := `{"idempotency_key":"k1","merchant_id":"m1","amount":10,"currency":"USD","customer_id":"c1"}`
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body)))
+	}
+
+	router := route("/v1/merchants/{id}/anomaly", NewAnomalyHandler(anomalies).Get)
+	w := getRequest(router, "/v1/merchants/m1/anomaly")
+	var report monitor.MerchantAnomaly
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != 200 || report.MerchantID != "m1" || report.WindowRequests != 3 || report.WindowDuplicates != 2 || !report.AnomalyDetected {
+		t.Errorf("expected m1 anomalous with 2 of 3 duplicates, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = getRequest(router, "/v1/merchants/m2/anomaly")
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != 200 || report.MerchantID != "m2" || report.WindowRequests != 0 {
+		t.Errorf("expected no requests for m2, got %d %s", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/merchants/m1/anomaly", nil)
+	rec := httptest.NewRecorder()
+	router(rec, req)
+	if rec.Code != 405 {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestProcessPayment_ExpiryHeader(t *testing.T) {
+	repo := newMockRepo()
+	svc := service.NewIdempotencyService(repo, 24*time.Hour).WithMaxExpiry(72 * time.Hour)
+	h := NewPaymentHandler(svc)
+	send := func(key, expiry, extra string) *httptest.ResponseRecorder {
+		body := `{"idempotency_key":"` + key + `","merchant_id":"m1","amount":10,"currency":"USD","customer_id":"c1"` + extra + `}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body))
+		if expiry != "" {
+			req.Header.Set(ExpiryHeader, expiry)
+		}
+		w := httptest.NewRecorder()
+		h.ProcessPayment(w, req)
+		return w
+	}
+
+	if w := send("exp-1", "72", ""); w.Code != 201 {
+		t.Fatalf("expected 201, got %d %s", w.Code, w.Body.String())
+	}
+	if got := time.Until(repo.records["exp-1"].ExpiresAt).Round(time.Hour); got != 72*time.Hour {
+		t.Errorf("expected a 72h TTL, got %s", got)
+	}
+	if w := send("exp-2", "", `,"expiry_hours":96`); w.Code != 422 || !strings.Contains(w.Body.String(), "field_max") {
+		t.Errorf("expected 422 field_max, got %d %s", w.Code, w.Body.String())
+	}
+	for _, tc := range []struct{ header, extra string }{{"0", ""}, {"a day", ""}, {"48", `,"expiry_hours":72`}} {
+		if w := send("exp-3", tc.header, tc.extra); w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_expiry_header") {
+			t.Errorf("%q %s: expected 400 invalid_expiry_header, got %d %s", tc.header, tc.extra, w.Code, w.Body.String())
+		}
+	}
+}
+
+// --- OpenAPI tests ---
+
+func TestOpenAPI_SpecAndDocs(t *testing.T) {
+	var patterns []string
+	for _, op := range APIOperations {
+		patterns = append(patterns, op.Pattern())
+	}
+	h, err := NewOpenAPIHandler(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := getRequest(h.Spec, "/v1/openapi.json")
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &doc) != nil {
+		t.Fatalf("expected a JSON document, got %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := doc.Paths["/v1/payments/{key}/complete"]["patch"]; !ok {
+		t.Errorf("missing PATCH /v1/payments/{key}/complete in %v", doc.Paths)
+	}
+	req := doc.Components.Schemas["PaymentRequest"].Properties
+	if _, ok := req["idempotency_key"]; !ok {
+		t.Errorf("PaymentRequest lacks idempotency_key: %v", req)
+	}
+	if _, ok := req["Body"]; ok {
+		t.Error("PaymentRequest documents its Body, which is json:\"-\"")
+	}
+
+	w = getRequest(h.Docs, "/docs")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/v1/openapi.json") {
+		t.Errorf("expected the docs page, got %d", w.Code)
+	}
+
+	if _, err := NewOpenAPIHandler(append(patterns, "GET /v1/undocumented")); err == nil {
+		t.Error("expected an undocumented route to be refused")
+	}
+}
+
+// --- Attempt history tests ---
+
+func TestGetAttempts(t *testing.T) {
+	repo := newMockRepo()
+	h := NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+	get := route("GET /v1/payments/{key}/attempts", h.GetAttempts)
+
+	if w := getRequest(get, "/v1/payments/unknown/attempts"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+
+	req := domain.PaymentRequest{IdempotencyKey: "att-1", MerchantID: "m1", CustomerID: "c1", Amount: 100, Currency: "USD"}
+	postJSON(h.ProcessPayment, "/v1/payments", req)
+	postJSON(h.ProcessPayment, "/v1/payments", req)
+	req.Amount = 200
+	postJSON(h.ProcessPayment, "/v1/payments", req)
+
+	w := getRequest(get, "/v1/payments/att-1/attempts")
+	var body struct {
+		IdempotencyKey string           `json:"idempotency_key"`
+		Attempts       []domain.Attempt `json:"attempts"`
+	}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+		t.Fatalf("expected 200 with attempts, got %d %s", w.Code, w.Body.String())
+	}
+	if body.IdempotencyKey != "att-1" || len(body.Attempts) != 3 ||
+		body.Attempts[0].Outcome != domain.AttemptNew || body.Attempts[1].Outcome != domain.AttemptDuplicate ||
+		body.Attempts[2].Outcome != domain.AttemptMismatch || body.Attempts[2].RequestHash == body.Attempts[0].RequestHash {
+		t.Errorf("unexpected history: %+v", body)
+	}
+}
+
+type memoryReservations map[string]string
+
+func (m memoryReservations) ReserveKey(_ context.Context, key, merchantID string, expiresAt time.Time) (*domain.KeyReservation, error) {
+	if owner, ok := m[key]; ok && owner != merchantID {
+		return nil, domain.ErrKeyReserved
+	}
+	m[key] = merchantID
+	return &domain.KeyReservation{IdempotencyKey: key, MerchantID: merchantID, ReservedAt: time.Now(), ExpiresAt: expiresAt}, nil
+}
+
+func (m memoryReservations) CheckReservation(_ context.Context, key, merchantID string) (bool, error) {
+	owner, ok := m[key]
+	if ok && owner != merchantID {
+		return false, domain.ErrKeyReserved
+	}
+	return ok, nil
+}
+
+func (m memoryReservations) ClaimReservation(_ context.Context, key, merchantID string) error {
+	if m[key] == merchantID {
+		delete(m, key)
+	}
+	return nil
+}
+
+func TestReserveKey_201ThenPayment(t *testing.T) {
+	svc := service.NewIdempotencyService(newMockRepo(), 24*time.Hour).WithReservations(memoryReservations{}, 30*time.Minute)
+	h := NewPaymentHandler(svc)
+
+	w := postJSON(h.ReserveKey, "/v1/idempotency-keys", domain.ReserveKeyRequest{MerchantID: "merchant-1"})
+	var res domain.KeyReservation
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != 201 || res.IdempotencyKey == "" || res.MerchantID != "merchant-1" {
+		t.Fatalf("expected 201 with a generated key, got %d %s", w.Code, w.Body.String())
+	}
+
+	payload := domain.PaymentRequest{IdempotencyKey: res.IdempotencyKey, MerchantID: "merchant-2", CustomerID: "customer-1", Amount: 10000, Currency: "BRL"}
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 409 || !strings.Contains(w.Body.String(), "key_reserved") {
+		t.Errorf("expected 409 key_reserved for another merchant, got %d %s", w.Code, w.Body.String())
+	}
+	payload.MerchantID = "merchant-1"
+	if w := postJSON(h.ProcessPayment, "/v1/payments", payload); w.Code != 201 {
+		t.Errorf("expected the reserved key's payment to succeed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReserveKey_503WithoutStore(t *testing.T) {
+	h := NewPaymentHandler(service.NewIdempotencyService(newMockRepo(), 24*time.Hour))
+	if w := postJSON(h.ReserveKey, "/v1/idempotency-keys", domain.ReserveKeyRequest{MerchantID: "merchant-1"}); w.Code != 503 {
+		t.Errorf("expected 503 without reservations, got %d", w.Code)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	h := NewWebhookHandler(nil)
+	if w := getRequest(h.DeadLetters, "/v1/admin/webhooks/dead-letters"); w.Code != 503 {
+		t.Errorf("expected 503 without Postgres, got %d", w.Code)
+	}
+
+	h = NewWebhookHandler(service.NewWebhookService(webhookDeadLetters{}, nil))
+	w := getRequest(h.DeadLetters, "/v1/admin/webhooks/dead-letters")
+	var list domain.WebhookDeadLetterList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != 200 || list.DeadLetters == nil || list.Page.Limit != defaultDeadLettersLimit {
+		t.Errorf("expected an empty page of %d, got %d %s", defaultDeadLettersLimit, w.Code, w.Body.String())
+	}
+
+	for id, want := range map[string]int{"abc": 400, "0": 400, "7": 404} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/webhooks/dead-letters/"+id+"/redeliver", nil)
+		req.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		h.Redeliver(w, req)
+		if w.Code != want {
+			t.Errorf("redeliver %s: expected %d, got %d %s", id, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+// webhookDeadLetters is an empty service.WebhookStore.
+type webhookDeadLetters struct{}
+
+func (webhookDeadLetters) ListWebhookDeadLetters(context.Context, domain.Page) ([]domain.WebhookDeadLetter, int, error) {
+	return nil, 0, nil
+}
+
+func (webhookDeadLetters) GetWebhookDeadLetter(context.Context, int64) (*domain.WebhookDeadLetter, error) {
+	return nil, domain.ErrDeadLetterNotFound
+}
+
+func (webhookDeadLetters) RecordWebhookRedelivery(context.Context, int64, error) error {
+	return domain.ErrDeadLetterNotFound
+}
+
+func (webhookDeadLetters) ListWebhookEvents(context.Context, string, string, time.Time, time.Time, int) ([]domain.WebhookEvent, error) {
+	return nil, nil
+}
+
+func TestWebhookReplay(t *testing.T) {
+	h := NewWebhookHandler(service.NewWebhookService(webhookDeadLetters{}, nil))
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		body domain.WebhookReplayRequest
+		want int
+	}{
+		{domain.WebhookReplayRequest{From: from, To: from.Add(time.Hour)}, 400},
+		{domain.WebhookReplayRequest{MerchantID: "merchant-1", From: from, To: from}, 400},
+		{domain.WebhookReplayRequest{MerchantID: "merchant-1", To: from}, 400},
+		{domain.WebhookReplayRequest{MerchantID: "merchant-1", From: from, To: from.Add(time.Hour)}, 202},
+	}
+	for _, c := range cases {
+		if w := postJSON(h.Replay, "/v1/webhooks/replay", c.body); w.Code != c.want {
+			t.Errorf("%+v: expected %d, got %d %s", c.body, c.want, w.Code, w.Body.String())
+		}
+	}
+	if w := postJSON(NewWebhookHandler(nil).Replay, "/v1/webhooks/replay", cases[3].body); w.Code != 503 {
+		t.Errorf("expected 503 without Postgres, got %d", w.Code)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	h := RedirectToHTTPS("8443")
+	req := httptest.NewRequest(http.MethodPost, "http://shield.internal:8080/v1/payments?lang=es", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "https://shield.internal:8443/v1/payments?lang=es" {
+		t.Errorf("expected a 308 to the HTTPS port, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://[::1]/healthz", nil)
+	w = httptest.NewRecorder()
+	RedirectToHTTPS("443").ServeHTTP(w, req)
+	if w.Header().Get("Location") != "https://[::1]/healthz" {
+		t.Errorf("unexpected location %q", w.Header().Get("Location"))
 	}
 }
@@ -1,9 +1,19 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 	"github.com/kubo-market/idempotency-shield/internal/monitor"
+	"github.com/kubo-market/idempotency-shield/internal/service"
 )
 
 // Pinger checks database connectivity.
@@ -11,43 +21,391 @@ type Pinger interface {
 	Ping() error
 }
 
+// metricsStreamInterval is how often snapshots are pushed to WebSocket clients.
+const metricsStreamInterval = 2 * time.Second
+
 // HealthHandler handles health check and metrics endpoints.
 type HealthHandler struct {
-	db      Pinger
-	metrics *monitor.Metrics
+	db             Pinger
+	metrics        *monitor.Metrics
+	streamInterval time.Duration
+	history        *service.MetricsHistory
 }
 
 // NewHealthHandler creates a new HealthHandler.
 func NewHealthHandler(db Pinger, metrics *monitor.Metrics) *HealthHandler {
-	return &HealthHandler{db: db, metrics: metrics}
+	return &HealthHandler{db: db, metrics: metrics, streamInterval: metricsStreamInterval}
+}
+
+// WithHistory serves stored metrics samples from history.
+func (h *HealthHandler) WithHistory(history *service.MetricsHistory) *HealthHandler {
+	h.history = history
+	return h
 }
 
 // Health handles GET /health
+// The circuit breaker state is reported alongside the ping, so a storage
+// outage the breaker is failing fast on shows up before the pool recovers.
 func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 
+	circuit := h.metrics.CircuitState()
 	if err := h.db.Ping(); err != nil {
-		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
-			"status":   "unhealthy",
-			"database": "disconnected",
+		writeJSON(w, http.StatusServiceUnavailable, healthStatus{
+			Status:         "unhealthy",
+			Database:       "disconnected",
+			CircuitBreaker: circuit,
 		})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]string{
-		"status":   "healthy",
-		"database": "connected",
+	writeJSON(w, http.StatusOK, healthStatus{
+		Status:         "healthy",
+		Database:       "connected",
+		CircuitBreaker: circuit,
 	})
 }
 
+// healthStatus is the body of GET /health.
+type healthStatus struct {
+	Status         string `json:"status"`
+	Database       string `json:"database"`
+	CircuitBreaker string `json:"circuit_breaker"`
+}
+
 // Metrics handles GET /v1/metrics
 func (h *HealthHandler) Metrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 	writeJSON(w, http.StatusOK, h.metrics.Snapshot())
 }
+
+// ResetMetrics handles POST /v1/metrics/reset, zeroing the counters after a
+// load test or drill. The ending period stays available as previous_period.
+func (h *HealthHandler) ResetMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	prev := h.metrics.Reset()
+	writeJSON(w, http.StatusOK, metricsReset{Status: "reset", Previous: prev})
+}
+
+// metricsReset is the body of POST /v1/metrics/reset.
+type metricsReset struct {
+	Status   string                  `json:"status"`
+	Previous monitor.MetricsSnapshot `json:"previous_period"`
+}
+
+// MetricsHistory handles GET /v1/metrics/history?from=&to=&instance=
+// with the stored metrics samples, defaulting to the last 24h.
+func (h *HealthHandler) MetricsHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if h.history == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	from, to, ok := parseTimeRange(r, 24*time.Hour)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+	samples, err := h.history.Query(r.Context(), from, to, r.URL.Query().Get("instance"))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, metricsHistory{From: from.UTC(), To: to.UTC(), Samples: samples})
+}
+
+// metricsHistory is the body of GET /v1/metrics/history.
+type metricsHistory struct {
+	From    time.Time              `json:"from"`
+	To      time.Time              `json:"to"`
+	Samples []domain.MetricsSample `json:"samples"`
+}
+
+// MetricsStream handles GET /v1/metrics/ws, pushing a metrics snapshot over a
+// WebSocket every few seconds until the client disconnects.
+func (h *HealthHandler) MetricsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if errors.Is(err, errNotWebSocket) {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrWebSocketRequired)
+		return
+	}
+	if err != nil {
+		logging.From(r.Context()).Warnf("metrics stream: upgrade: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	// Reader: answer pings and notice when the client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			case wsOpClose:
+				ws.writeFrame(wsOpClose, nil)
+				return
+			}
+		}
+	}()
+
+	send := func() error {
+		b, err := json.Marshal(h.metrics.Snapshot())
+		if err != nil {
+			return err
+		}
+		return ws.writeFrame(wsOpText, b)
+	}
+
+	ticker := time.NewTicker(h.streamInterval)
+	defer ticker.Stop()
+	for {
+		if err := send(); err != nil {
+			return
+		}
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SchemaChecker reports the applied and expected database schema versions.
+type SchemaChecker interface {
+	AppliedVersion(ctx context.Context) (int, error)
+	ExpectedVersion() int
+}
+
+// ContextPinger is a Pinger that can be cancelled, such as *sql.DB.
+type ContextPinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// ExpiredCounter counts expired keys still waiting for the sweeper, up to
+// limit.
+type ExpiredCounter interface {
+	CountExpired(ctx context.Context, limit int) (int64, error)
+}
+
+// defaultReadinessTimeout bounds each readiness check unless
+// WithCheckTimeout says otherwise.
+const defaultReadinessTimeout = 2 * time.Second
+
+// ReadinessHandler decides whether this instance may receive traffic, and
+// answers liveness, which depends on the process alone.
+type ReadinessHandler struct {
+	db         Pinger
+	schema     SchemaChecker
+	timeout    time.Duration
+	expired    ExpiredCounter
+	maxExpired int64
+	started    time.Time
+	draining   atomic.Bool
+}
+
+// NewReadinessHandler creates a new ReadinessHandler.
+func NewReadinessHandler(db Pinger, schema SchemaChecker) *ReadinessHandler {
+	return &ReadinessHandler{db: db, schema: schema, timeout: defaultReadinessTimeout, started: time.Now()}
+}
+
+// WithCheckTimeout fails a readiness check that takes longer than timeout.
+func (h *ReadinessHandler) WithCheckTimeout(timeout time.Duration) *ReadinessHandler {
+	h.timeout = timeout
+	return h
+}
+
+// WithSweepBacklog fails readiness while more than max expired keys wait
+// for the sweeper, a sign it is stuck or cannot keep up.
+func (h *ReadinessHandler) WithSweepBacklog(counter ExpiredCounter, max int64) *ReadinessHandler {
+	h.expired = counter
+	h.maxExpired = max
+	return h
+}
+
+// Live handles GET /livez. It checks nothing outside the process, so a
+// database blip fails readiness without getting the instance restarted.
+func (h *ReadinessHandler) Live(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, liveness{Status: "alive", UptimeSeconds: int64(time.Since(h.started).Seconds())})
+}
+
+// liveness is the body of GET /livez.
+type liveness struct {
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// Ready handles GET /readyz and GET /health/ready. It refuses readiness
+// while draining, when the database does not answer a ping in time, when
+// its schema version differs from the one this binary expects, or when the
+// sweeper's backlog is over its limit. A nil schema (the Redis backend)
+// skips the version check; the backlog is only checked when configured.
+func (h *ReadinessHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	report := h.readiness(r.Context())
+	status := http.StatusOK
+	if report.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// Check returns an error naming why the instance is not ready, or nil.
+func (h *ReadinessHandler) Check(ctx context.Context) error {
+	if report := h.readiness(ctx); report.Status != "ready" {
+		return fmt.Errorf("not ready: %s", report.Reason)
+	}
+	return nil
+}
+
+// SetDraining makes readiness fail from now on, so load balancers stop
+// sending traffic while in-flight requests finish.
+func (h *ReadinessHandler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// readinessReport is the body of GET /readyz: the overall status, the
+// first failure's reason and every check that ran.
+type readinessReport struct {
+	Status string                    `json:"status"`
+	Reason string                    `json:"reason,omitempty"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// readinessCheck is one dependency's result.
+type readinessCheck struct {
+	Status          string  `json:"status"`
+	LatencyMs       float64 `json:"latency_ms"`
+	Error           string  `json:"error,omitempty"`
+	ExpectedVersion int     `json:"expected_version,omitempty"`
+	AppliedVersion  int     `json:"applied_version,omitempty"`
+	ExpiredKeys     *int64  `json:"expired_keys,omitempty"`
+	MaxExpiredKeys  int64   `json:"max_expired_keys,omitempty"`
+}
+
+// readiness runs every check, each under the check timeout. Draining skips
+// them: the answer is no regardless.
+func (h *ReadinessHandler) readiness(ctx context.Context) readinessReport {
+	report := readinessReport{Status: "ready", Checks: make(map[string]readinessCheck)}
+	if h.draining.Load() {
+		report.Status, report.Reason = "not_ready", "shutting down"
+		return report
+	}
+	fail := func(reason string) {
+		if report.Status == "ready" {
+			report.Status, report.Reason = "not_ready", reason
+		}
+	}
+
+	db := h.run(ctx, func(ctx context.Context, c *readinessCheck) error { return ping(ctx, h.db) })
+	report.Checks["database"] = db
+	if db.Status != "ok" {
+		fail("database disconnected")
+	}
+
+	if h.schema != nil {
+		unavailable := false
+		schema := h.run(ctx, func(ctx context.Context, c *readinessCheck) error {
+			c.ExpectedVersion = h.schema.ExpectedVersion()
+			applied, err := h.schema.AppliedVersion(ctx)
+			if err != nil {
+				unavailable = true
+				return err
+			}
+			c.AppliedVersion = applied
+			if applied != c.ExpectedVersion {
+				return fmt.Errorf("schema version %d, expected %d", applied, c.ExpectedVersion)
+			}
+			return nil
+		})
+		report.Checks["schema"] = schema
+		switch {
+		case schema.Status == "ok":
+		case unavailable:
+			fail("schema version unavailable")
+		default:
+			fail("schema version mismatch")
+		}
+	}
+
+	if h.expired != nil {
+		backlog := h.run(ctx, func(ctx context.Context, c *readinessCheck) error {
+			c.MaxExpiredKeys = h.maxExpired
+			n, err := h.expired.CountExpired(ctx, int(h.maxExpired)+1)
+			if err != nil {
+				return err
+			}
+			c.ExpiredKeys = &n
+			if n > h.maxExpired {
+				return fmt.Errorf("more than %d expired keys waiting for the sweeper", h.maxExpired)
+			}
+			return nil
+		})
+		report.Checks["sweeper_backlog"] = backlog
+		if backlog.Status != "ok" {
+			fail("expired key backlog")
+		}
+	}
+	return report
+}
+
+// run times fn under the check timeout and records its outcome.
+func (h *ReadinessHandler) run(ctx context.Context, fn func(ctx context.Context, c *readinessCheck) error) readinessCheck {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	var c readinessCheck
+	start := time.Now()
+	err := fn(ctx, &c)
+	c.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	c.Status = "ok"
+	if err != nil {
+		c.Status, c.Error = "fail", err.Error()
+	}
+	return c
+}
+
+// ping pings p within ctx. Pingers without a context are pinged in the
+// background, so a hung connection still fails the check on time.
+func ping(ctx context.Context, p Pinger) error {
+	if cp, ok := p.(ContextPinger); ok {
+		return cp.PingContext(ctx)
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Ping() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
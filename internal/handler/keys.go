@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// maxKeysLimit bounds one page of a key search.
+const maxKeysLimit = 500
+
+// SearchKeys handles GET /v1/admin/keys?merchant_id=&customer_id=&status=
+// &min_amount=&max_amount=&from=&to=&key_prefix=&limit=&offset=
+// Every filter is optional; from and to bound first_seen_at.
+func (h *PaymentHandler) SearchKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	filter, bad := parseRecordFilter(r)
+	if bad != "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidKeyFilter, bad)
+		return
+	}
+	page, ok := parsePage(r, maxKeysLimit)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidPage, maxKeysLimit)
+		return
+	}
+
+	result, err := h.svc.SearchRecords(r.Context(), filter, page)
+	if err != nil {
+		logging.From(r.Context()).Errorf("search keys: %v", err)
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// keyActionResult is the body of a successful admin key action.
+type keyActionResult struct {
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// ExpireKey handles POST /v1/admin/keys/{key}/expire: the key's next payment
+// is accepted as new, as after its TTL.
+func (h *PaymentHandler) ExpireKey(w http.ResponseWriter, r *http.Request) {
+	h.keyAction(w, r, "expired", h.svc.ExpireKey)
+}
+
+// ForceFailKey handles POST /v1/admin/keys/{key}/force-fail: a key stuck in
+// processing fails, so a retry with the same parameters goes through.
+func (h *PaymentHandler) ForceFailKey(w http.ResponseWriter, r *http.Request) {
+	h.keyAction(w, r, "failed", h.svc.ForceFailKey)
+}
+
+// ResetKey handles POST /v1/admin/keys/{key}/reset: the key fails and
+// expires in place, keeping its attempts, so its next payment is accepted as
+// new.
+func (h *PaymentHandler) ResetKey(w http.ResponseWriter, r *http.Request) {
+	h.keyAction(w, r, "reset", h.svc.ResetKey)
+}
+
+// RestoreKey handles POST /v1/admin/payments/{key}/restore: the key's last
+// expire, force-fail or reset is undone within the restore window. A key a
+// payment used since answers 409, and one with nothing left to restore 404.
+func (h *PaymentHandler) RestoreKey(w http.ResponseWriter, r *http.Request) {
+	if !h.svc.RestoresEnabled() {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	h.keyAction(w, r, "restored", h.svc.RestoreKey)
+}
+
+// keyAction runs an admin action on the path's key and answers status.
+func (h *PaymentHandler) keyAction(w http.ResponseWriter, r *http.Request, status string, action func(context.Context, string, domain.AttemptSource) error) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	key := r.PathValue("key")
+	if key == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingIdempotencyKey)
+		return
+	}
+
+	if err := action(r.Context(), key, attemptSource(r)); err != nil {
+		if errors.Is(err, domain.ErrKeyNotFound) || errors.Is(err, domain.ErrNothingToRestore) {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, domain.ErrAlreadyCompleted) || errors.Is(err, domain.ErrConcurrentUpdate) || errors.Is(err, domain.ErrKeyReused) {
+			writeError(w, r, http.StatusConflict, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("admin key action %s: %v", status, err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keyActionResult{Status: status, IdempotencyKey: key})
+}
+
+// parseRecordFilter reads a key search's filters. On failure it returns the
+// name of the first invalid parameter.
+func parseRecordFilter(r *http.Request) (domain.RecordFilter, string) {
+	q := r.URL.Query()
+	filter := domain.RecordFilter{
+		MerchantID: q.Get("merchant_id"),
+		CustomerID: q.Get("customer_id"),
+		Status:     domain.Status(q.Get("status")),
+		KeyPrefix:  q.Get("key_prefix"),
+	}
+	switch filter.Status {
+	case "", domain.StatusProcessing, domain.StatusSucceeded, domain.StatusFailed:
+	default:
+		return filter, "status"
+	}
+
+	amounts := []struct {
+		name string
+		dst  **int64
+	}{{"min_amount", &filter.MinAmount}, {"max_amount", &filter.MaxAmount}}
+	for _, a := range amounts {
+		if v := q.Get(a.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return filter, a.name
+			}
+			*a.dst = &n
+		}
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MinAmount > *filter.MaxAmount {
+		return filter, "min_amount"
+	}
+
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}}
+	for _, t := range times {
+		if v := q.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, t.name
+			}
+			*t.dst = parsed
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, "from"
+	}
+	return filter, ""
+}
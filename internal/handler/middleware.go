@@ -1,36 +1,135 @@
 package handler
 
 import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 )
 
 // Logging wraps an http.Handler with request logging.
+// Correlation fields set by inner layers (merchant, key, payment) are included,
+// and JSON records also carry the method, path, status and latency_ms.
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		ctx, _ := logging.NewContext(r.Context())
 		sw := &statusWriter{ResponseWriter: w, status: 200}
-		next.ServeHTTP(sw, r)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, sw.status, time.Since(start).Round(time.Microsecond))
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		latency := time.Since(start)
+		logging.From(ctx).With(
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+		).Infof("%s %s %d %s", r.Method, r.URL.Path, sw.status, latency.Round(time.Microsecond))
+	})
+}
+
+// LogLevelHeader lets a caller raise or lower the log level of one request.
+const LogLevelHeader = "X-Log-Level"
+
+// RequestLogger serves mux with a request-scoped logger in the context,
+// pre-populated with the matched route and, when the URL names one, the
+// merchant. Handlers and services reach it through logging.From. Lines below
+// level are dropped unless the request's X-Log-Level asks for them; level is
+// read per request, so changing it applies from the next one.
+func RequestLogger(level logging.Leveler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, fields := logging.NewContext(r.Context())
+		fields.Level = level.Level()
+		if l, ok := logging.ParseLevel(r.Header.Get(LogLevelHeader)); ok {
+			fields.Level = l
+		}
+		// The pattern, unlike the path, never contains an idempotency key.
+		// Its method, if any, is replaced by the request's so HEAD is
+		// counted apart from GET.
+		_, pattern := mux.Handler(r)
+		if pattern != "" {
+			if _, path, ok := strings.Cut(pattern, " "); ok {
+				pattern = path
+			}
+			fields.Route = r.Method + " " + pattern
+		} else {
+			w = &routeErrorWriter{ResponseWriter: w, r: r}
+		}
+		if fields.MerchantID == "" {
+			fields.MerchantID = requestMerchant(r)
+		}
+		mux.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// merchantsPrefix is the path every merchant resource lives under.
+const merchantsPrefix = "/v1/merchants/"
+
+// requestMerchant returns the merchant named by /v1/merchants/{id}/... or
+// the merchant_id query parameter, if any. It runs before routing, so the
+// path values handlers read are not set yet.
+func requestMerchant(r *http.Request) string {
+	if rest, ok := strings.CutPrefix(r.URL.Path, merchantsPrefix); ok {
+		if id, _, _ := strings.Cut(rest, "/"); id != "" {
+			return id
+		}
+	}
+	return r.URL.Query().Get("merchant_id")
+}
+
+// routeErrorWriter replaces the plain-text 404 and 405 the mux writes for
+// unrouted requests with the JSON errors of the handlers. The mux's Allow
+// header is kept.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (w *routeErrorWriter) WriteHeader(status int) {
+	var code i18n.Code
+	switch status {
+	case http.StatusNotFound:
+		code = i18n.ErrResourceNotFound
+	case http.StatusMethodNotAllowed:
+		code = i18n.ErrMethodNotAllowed
+	default:
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+	w.Header().Del("X-Content-Type-Options")
+	writeMessage(w.ResponseWriter, w.r, status, code)
+}
+
+func (w *routeErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
 // Recovery recovers from panics and returns 500.
 func Recovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := logging.NewContext(r.Context())
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("PANIC: %v", err)
-				http.Error(w, fmt.Sprintf(`{"error":"internal server error"}"`), http.StatusInternalServerError)
+				logging.From(ctx).Errorf("PANIC: %v", err)
+				writeMessage(w, r, http.StatusInternalServerError, i18n.ErrInternal)
 			}
 		}()
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// RequestID adds a request ID header.
+// RequestID adds a request ID header and records it in the log context.
 func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqID := r.Header.Get("X-Request-ID")
@@ -38,6 +137,34 @@ func RequestID(next http.Handler) http.Handler {
 			reqID = fmt.Sprintf("req_%d", time.Now().UnixNano())
 		}
 		w.Header().Set("X-Request-ID", reqID)
+		ctx, fields := logging.NewContext(r.Context())
+		fields.RequestID = reqID
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AdminAuth restricts a handler to callers presenting the admin token, either as
+// "Authorization: Bearer <token>" or as the Basic auth password (so browsers can
+// log in to the dashboard). An empty token disables the admin endpoints.
+func AdminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeMessage(w, r, http.StatusForbidden, i18n.ErrAdminDisabled)
+			return
+		}
+
+		var presented string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			presented = strings.TrimPrefix(auth, "Bearer ")
+		} else if _, pass, ok := r.BasicAuth(); ok {
+			presented = pass
+		}
+
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="idempotency-shield admin"`)
+			writeMessage(w, r, http.StatusUnauthorized, i18n.ErrUnauthorized)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -51,3 +178,18 @@ func (w *statusWriter) WriteHeader(status int) {
 	w.status = status
 	w.ResponseWriter.WriteHeader(status)
 }
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets WebSocket handlers take over the connection through the middleware.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+	"github.com/kubo-market/idempotency-shield/internal/openapi"
+)
+
+//go:embed static/docs.html
+var docsHTML []byte
+
+// errorBody documents the JSON error body writeMessage and writeError
+// build; the fields after code appear only when they apply. In IETF mode
+// POST /v1/payments answers RFC 9457 problem details instead.
+type errorBody struct {
+	Error             string             `json:"error"`
+	Code              string             `json:"code"`
+	Retryable         bool               `json:"retryable,omitempty"`
+	RetryAfterSeconds int                `json:"retry_after_seconds,omitempty"`
+	MismatchedFields  []domain.FieldDiff `json:"mismatched_fields,omitempty"`
+	Violations        []violation        `json:"violations,omitempty"`
+}
+
+// Query parameters shared by several operations.
+var (
+	fromParam   = openapi.Param{Name: "from", Description: "RFC 3339 start of the range; defaults to 24h before to"}
+	toParam     = openapi.Param{Name: "to", Description: "RFC 3339 end of the range; defaults to now"}
+	limitParam  = openapi.Param{Name: "limit", Description: "Page size"}
+	offsetParam = openapi.Param{Name: "offset", Description: "Results to skip; needs limit"}
+)
+
+// okBody documents a 200 with body.
+func okBody(body any) openapi.Response {
+	return openapi.Response{Status: http.StatusOK, Body: body}
+}
+
+// errorResponses documents statuses answered with an errorBody.
+func errorResponses(statuses ...int) []openapi.Response {
+	out := make([]openapi.Response, len(statuses))
+	for i, s := range statuses {
+		out[i] = openapi.Response{Status: s, Body: errorBody{}}
+	}
+	return out
+}
+
+// withErrors appends error responses for errs to success.
+func withErrors(success []openapi.Response, errs ...int) []openapi.Response {
+	return append(success, errorResponses(errs...)...)
+}
+
+// APIOperations documents every health and /v1 route main registers.
+// NewOpenAPIHandler refuses to start when the two disagree, so a route
+// added without an entry here fails at boot rather than drifting silently.
+var APIOperations = []openapi.Operation{
+	{Method: "GET", Path: "/health", Tag: "health", Summary: "Liveness, database connectivity and circuit breaker state",
+		Responses: []openapi.Response{okBody(healthStatus{}), {Status: http.StatusServiceUnavailable, Body: healthStatus{}}}},
+	{Method: "GET", Path: "/health/ready", Tag: "health", Summary: "Readiness: database reachable, schema current, not draining",
+		Responses: []openapi.Response{okBody(readinessReport{}), {Status: http.StatusServiceUnavailable, Body: readinessReport{}}}},
+	{Method: "GET", Path: "/livez", Tag: "health", Summary: "Liveness of the process alone; never checks dependencies",
+		Responses: []openapi.Response{okBody(liveness{})}},
+	{Method: "GET", Path: "/readyz", Tag: "health", Summary: "Readiness with per-check status and latency: database, schema, sweeper backlog",
+		Responses: []openapi.Response{okBody(readinessReport{}), {Status: http.StatusServiceUnavailable, Body: readinessReport{}}}},
+
+	{Method: "POST", Path: "/v1/payments", Tag: "payments", Summary: "Validate a payment's idempotency key",
+		Request: domain.PaymentRequest{},
+		Responses: withErrors([]openapi.Response{
+			{Status: http.StatusCreated, Description: "New payment, or a retry of a failed one", Body: domain.PaymentResponse{}},
+			{Status: http.StatusOK, Description: "Duplicate answered under the merchant's duplicate_status_code policy", Body: domain.PaymentResponse{}},
+			{Status: http.StatusAccepted, Description: "Queued for the gateway in async mode", Body: domain.PaymentResponse{}},
+			{Status: http.StatusConflict, Description: "Duplicate of a payment processing or succeeded", Body: domain.PaymentResponse{}},
+		}, 400, 401, 413, 415, 422, 429, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/payments", Tag: "payments", Summary: "Find a payment by payment ID",
+		Query:     []openapi.Param{{Name: "payment_id", Description: "Payment ID to look up (required)"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.PaymentResponse{}), {Status: http.StatusNotModified}}, 400, 404, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/payments/batch", Tag: "payments", Summary: "Validate up to 500 payments, one result each",
+		Request:   []domain.PaymentRequest{},
+		Responses: withErrors([]openapi.Response{okBody(batchResponse{})}, 400, 401, 413, 415, 422)},
+	{Method: "GET", Path: "/v1/payments/{key}", Tag: "payments", Summary: "Get a payment by idempotency key",
+		Responses: withErrors([]openapi.Response{okBody(domain.PaymentResponse{}), {Status: http.StatusNotModified}}, 404, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/payments/{key}/attempts", Tag: "payments", Summary: "Latest 100 attempts for a key, oldest first",
+		Responses: withErrors([]openapi.Response{okBody(attemptHistory{})}, 404, 500, 503, 504)},
+	{Method: "PATCH", Path: "/v1/payments/{key}/complete", Tag: "payments", Summary: "Record a payment's final status; repeating it answers 200 again",
+		Request:   domain.CompleteRequest{},
+		Responses: withErrors([]openapi.Response{okBody(completeResponse{})}, 400, 401, 404, 409, 413, 415, 422, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/payments/{key}/wait", Tag: "payments", Summary: "Long-poll until a payment leaves processing",
+		Query:     []openapi.Param{{Name: "timeout", Description: "Go duration up to 60s; defaults to 30s"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.PaymentResponse{})}, 400, 404, 500, 503, 504)},
+
+	{Method: "POST", Path: "/v1/idempotency-keys", Tag: "payments", Summary: "Reserve a key, or a generated one, for a merchant's coming payment",
+		Request:   domain.ReserveKeyRequest{},
+		Responses: withErrors([]openapi.Response{{Status: http.StatusCreated, Body: domain.KeyReservation{}}}, 400, 401, 403, 409, 413, 415, 422, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/webhooks/replay", Tag: "merchants", Summary: "Deliver a merchant's webhooks of a time range again",
+		Request:   domain.WebhookReplayRequest{},
+		Responses: withErrors([]openapi.Response{{Status: http.StatusAccepted, Body: domain.WebhookReplay{}}}, 400, 401, 413, 415, 422, 500, 503, 504)},
+
+	{Method: "GET", Path: "/v1/merchants/{id}/duplicates", Tag: "merchants", Summary: "Duplicate attempts in a time range",
+		Query: []openapi.Param{fromParam, toParam, limitParam, offsetParam,
+			{Name: "format", Description: "json (default), csv, ndjson or pdf; also negotiated with Accept"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.DuplicateReport{})}, 400, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/merchants/{id}/duplicates/trends", Tag: "merchants", Summary: "Duplicate counts per time bucket",
+		Query:     []openapi.Param{fromParam, toParam, {Name: "bucket", Description: "Go duration; defaults to 1h"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.DuplicateTrends{})}, 400, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/merchants/{id}/digest", Tag: "merchants", Summary: "Daily duplicate digest",
+		Query:     []openapi.Param{{Name: "date", Description: "YYYY-MM-DD; defaults to yesterday (UTC)"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.MerchantDigest{})}, 400, 422, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/merchants/{id}/stats", Tag: "merchants", Summary: "Request and duplicate counts in a time range",
+		Query:     []openapi.Param{fromParam, toParam},
+		Responses: withErrors([]openapi.Response{okBody(domain.MerchantStats{})}, 400, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/merchants/{id}/anomaly", Tag: "merchants", Summary: "Live duplicate rate anomaly state",
+		Responses: withErrors([]openapi.Response{okBody(monitor.MerchantAnomaly{})}, 400)},
+	{Method: "GET", Path: "/v1/merchants/{id}/policy", Tag: "merchants", Summary: "Get a merchant's policy; signing_secret is never returned",
+		Responses: withErrors([]openapi.Response{okBody(domain.MerchantPolicy{})}, 404, 500, 503, 504)},
+	{Method: "PUT", Path: "/v1/merchants/{id}/policy", Tag: "merchants", Summary: "Create or replace a merchant's policy",
+		Request: domain.MerchantPolicy{}, Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(policyResult{})}, 400, 401, 413, 415, 422, 500, 503, 504)},
+	{Method: "DELETE", Path: "/v1/merchants/{id}/policy", Tag: "merchants", Summary: "Delete a merchant's policy", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(policyResult{})}, 401, 404, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/merchants/policies", Tag: "merchants", Summary: "Every merchant's policy by merchant_id; signing_secret is never returned", Auth: true,
+		Query:     []openapi.Param{{Name: "limit", Description: "Page size, up to 1000; defaults to 100"}, offsetParam},
+		Responses: withErrors([]openapi.Response{okBody(domain.PolicyList{})}, 400, 401, 500, 503, 504)},
+	{Method: "PUT", Path: "/v1/merchants/policies", Tag: "merchants", Summary: "Create or replace up to 1000 policies at once, all or none", Auth: true,
+		Request:   []domain.MerchantPolicy{},
+		Responses: withErrors([]openapi.Response{okBody(policiesUpdated{})}, 400, 401, 413, 415, 422, 500, 503, 504)},
+
+	{Method: "GET", Path: "/v1/stats", Tag: "admin", Summary: "Every merchant's activity in a time range", Auth: true,
+		Query: []openapi.Param{fromParam, toParam,
+			{Name: "sort", Description: "requests (default), unique, duplicate_rate or merchant_id"},
+			{Name: "top", Description: "Only the first N merchants"}},
+		Responses: withErrors([]openapi.Response{okBody(domain.StatsTable{})}, 400, 401, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/admin/keys", Tag: "admin", Summary: "Search stored idempotency keys", Auth: true,
+		Query: []openapi.Param{
+			{Name: "merchant_id"}, {Name: "customer_id"},
+			{Name: "status", Description: "processing, succeeded or failed"},
+			{Name: "min_amount"}, {Name: "max_amount"},
+			{Name: "from", Description: "RFC 3339 lower bound of first_seen_at"},
+			{Name: "to", Description: "RFC 3339 upper bound of first_seen_at"},
+			{Name: "key_prefix"}, limitParam, offsetParam},
+		Responses: withErrors([]openapi.Response{okBody(domain.RecordSearch{})}, 400, 401, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/keys/{key}/expire", Tag: "admin", Summary: "Expire a key now so its next payment is accepted as new", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(keyActionResult{})}, 401, 404, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/keys/{key}/force-fail", Tag: "admin", Summary: "Fail a key stuck in processing so a retry goes through", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(keyActionResult{})}, 401, 404, 409, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/keys/{key}/reset", Tag: "admin", Summary: "Fail and expire a key, keeping its attempts, so it can be used again", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(keyActionResult{})}, 401, 404, 409, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/payments/{key}/restore", Tag: "admin", Summary: "Undo a key's last expire, force-fail or reset within the restore window", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(keyActionResult{})}, 401, 404, 409, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/seed", Tag: "admin", Summary: "Load the sample data; refused when DEPLOY_ENV is prod", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(seedResult{})}, 401, 403, 500, 503)},
+	{Method: "GET", Path: "/v1/admin/dead-letters", Tag: "admin", Summary: "Queued payments the async workers gave up on", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(deadLettersResponse{})}, 401)},
+	{Method: "GET", Path: "/v1/admin/webhooks/dead-letters", Tag: "admin", Summary: "Webhook deliveries that failed every attempt, newest first", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(domain.WebhookDeadLetterList{})}, 400, 401, 500, 503, 504)},
+	{Method: "POST", Path: "/v1/admin/webhooks/dead-letters/{id}/redeliver", Tag: "admin", Summary: "Post a dead-lettered webhook to its endpoint again", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(domain.WebhookDeadLetter{})}, 400, 401, 404, 500, 502, 503, 504)},
+	{Method: "GET", Path: "/v1/admin/config", Tag: "admin", Summary: "Active configuration, after any hot reloads, with secrets masked", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(ActiveConfig{})}, 401)},
+
+	{Method: "GET", Path: "/v1/metrics", Tag: "metrics", Summary: "Counters, rates and latencies",
+		Responses: []openapi.Response{okBody(monitor.MetricsSnapshot{})}},
+	{Method: "GET", Path: "/v1/metrics/history", Tag: "metrics", Summary: "Stored metrics samples",
+		Query:     []openapi.Param{fromParam, toParam, {Name: "instance", Description: "Only this instance's samples"}},
+		Responses: withErrors([]openapi.Response{okBody(metricsHistory{})}, 400, 500, 503, 504)},
+	{Method: "GET", Path: "/v1/metrics/ws", Tag: "metrics", Summary: "WebSocket pushing a MetricsSnapshot every few seconds",
+		Responses: withErrors([]openapi.Response{{Status: http.StatusSwitchingProtocols}}, 400)},
+	{Method: "POST", Path: "/v1/metrics/reset", Tag: "metrics", Summary: "Zero the counters", Auth: true,
+		Responses: withErrors([]openapi.Response{okBody(metricsReset{})}, 401)},
+
+	{Method: "GET", Path: "/v1/openapi.json", Tag: "meta", Summary: "This document",
+		Responses: []openapi.Response{okBody(json.RawMessage{})}},
+}
+
+// APIPrefixes are the route prefixes APIOperations must cover completely.
+var APIPrefixes = []string{"/health", "/livez", "/readyz", "/v1/"}
+
+// OpenAPIHandler serves the OpenAPI document of APIOperations and a Swagger
+// UI page reading it.
+type OpenAPIHandler struct {
+	spec []byte
+}
+
+// NewOpenAPIHandler builds the document, failing when APIOperations and the
+// patterns the mux serves disagree.
+func NewOpenAPIHandler(served []string) (*OpenAPIHandler, error) {
+	if err := openapi.Check(APIOperations, served, APIPrefixes...); err != nil {
+		return nil, err
+	}
+	spec, err := json.Marshal(openapi.Build("Idempotency Shield API", "v1", APIOperations))
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	return &OpenAPIHandler{spec: spec}, nil
+}
+
+// Spec handles GET /v1/openapi.json
+func (h *OpenAPIHandler) Spec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.spec)
+}
+
+// Docs handles GET /docs with Swagger UI for the document.
+func (h *OpenAPIHandler) Docs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsHTML)
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+type outcomeKey struct{}
+
+// paymentRoute is the route whose latency percentiles the metrics report.
+const paymentRoute = "POST /v1/payments"
+
+// countedMethods bounds the routes recorded; other methods are not counted.
+var countedMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+}
+
+// RecordOutcomes counts and times every routed request in m by route and
+// outcome.
+// Handlers name the outcome with setOutcome; otherwise it is the status
+// class (ok, client_error, server_error). It must wrap RequestLogger, which
+// resolves the route.
+func RecordOutcomes(m *monitor.Metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, fields := logging.NewContext(r.Context())
+		var outcome string
+		ctx = context.WithValue(ctx, outcomeKey{}, &outcome)
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if fields.Route == "" || !countedMethods[r.Method] {
+			return
+		}
+		if outcome == "" {
+			outcome = statusOutcome(sw.status)
+		}
+		elapsed := time.Since(start)
+		m.RecordRouteLatency(fields.Route, elapsed)
+		if fields.Route == paymentRoute {
+			m.RecordLatency(elapsed)
+			if fields.MerchantID != "" {
+				m.RecordMerchantOutcome(fields.MerchantID, outcome)
+			}
+		}
+		m.RecordOutcome(fields.Route, outcome)
+	})
+}
+
+// setOutcome names how r ended for RecordOutcomes.
+func setOutcome(r *http.Request, outcome string) {
+	if p, ok := r.Context().Value(outcomeKey{}).(*string); ok {
+		*p = outcome
+	}
+}
+
+func statusOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	}
+	return "ok"
+}
+
+// paymentOutcome classifies a ProcessPayment response.
+func paymentOutcome(resp *domain.PaymentResponse) string {
+	switch i18n.Code(resp.Code) {
+	case i18n.MsgAlreadyProcessing:
+		return monitor.OutcomeDuplicate
+	case i18n.MsgAlreadySucceeded:
+		return monitor.OutcomeCached
+	case i18n.MsgRetryingFailed, i18n.MsgReclaimedStale, i18n.MsgParamsUpdated:
+		return monitor.OutcomeRetry
+	}
+	return monitor.OutcomeNew
+}
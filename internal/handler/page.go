@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// parsePage reads the limit and offset query parameters. Both are optional,
+// but offset needs a limit, and limit may not exceed max. It reports false
+// for anything else.
+func parsePage(r *http.Request, max int) (domain.Page, bool) {
+	q := r.URL.Query()
+	var page domain.Page
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if page.Limit, err = strconv.Atoi(v); err != nil || page.Limit < 1 || page.Limit > max {
+			return page, false
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if page.Offset, err = strconv.Atoi(v); err != nil || page.Offset < 0 || page.Limit == 0 {
+			return page, false
+		}
+	}
+	return page, true
+}
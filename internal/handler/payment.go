@@ -3,16 +3,31 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
 	"github.com/kubo-market/idempotency-shield/internal/service"
+	"github.com/kubo-market/idempotency-shield/internal/storage"
 )
 
 // PaymentHandler handles payment idempotency validation endpoints.
 type PaymentHandler struct {
-	svc *service.IdempotencyService
+	svc      *service.IdempotencyService
+	ietf     bool
+	queue    *service.PaymentQueue
+	limiter  *service.RateLimiter
+	storms   *service.StormGuard
+	outcomes OutcomeRecorder
+	// looseFields accepts payment fields PaymentRequest lacks.
+	looseFields bool
 }
 
 // NewPaymentHandler creates a new PaymentHandler.
@@ -20,71 +35,565 @@ func NewPaymentHandler(svc *service.IdempotencyService) *PaymentHandler {
 	return &PaymentHandler{svc: svc}
 }
 
+// WithIETFMode makes POST /v1/payments follow the IETF Idempotency-Key draft:
+// the key comes from the Idempotency-Key header, a missing key is a 400, and
+// errors are RFC 9457 problem details.
+func (h *PaymentHandler) WithIETFMode() *PaymentHandler {
+	h.ietf = true
+	return h
+}
+
+// WithUnknownFields accepts payments carrying fields PaymentRequest does not
+// have, which body hashing compares; without it they are a 400
+// unknown_field.
+func (h *PaymentHandler) WithUnknownFields() *PaymentHandler {
+	h.looseFields = true
+	return h
+}
+
+// WithQueue answers new and retried payments with 202 once they are queued
+// for downstream processing, instead of 201.
+func (h *PaymentHandler) WithQueue(queue *service.PaymentQueue) *PaymentHandler {
+	h.queue = queue
+	return h
+}
+
+// WithRateLimiter answers a merchant's payments beyond its rate limit with
+// 429 and a Retry-After hint, before they reach storage.
+func (h *PaymentHandler) WithRateLimiter(limiter *service.RateLimiter) *PaymentHandler {
+	h.limiter = limiter
+	return h
+}
+
+// rateLimited reports whether req is over its merchant's rate limit and, if
+// so, sets the outcome and Retry-After for the 429 the caller writes.
+func (h *PaymentHandler) rateLimited(w http.ResponseWriter, r *http.Request, req domain.PaymentRequest) bool {
+	if h.limiter == nil || req.MerchantID == "" {
+		return false
+	}
+	ok, wait := h.limiter.Allow(r.Context(), req.MerchantID)
+	if ok {
+		return false
+	}
+	setOutcome(r, "rate_limited")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return true
+}
+
+// WithStormGuard answers a key resent in a tight loop with 429 and a
+// growing Retry-After, before it reaches storage.
+func (h *PaymentHandler) WithStormGuard(guard *service.StormGuard) *PaymentHandler {
+	h.storms = guard
+	return h
+}
+
+// throttled reports whether req's key is storming and, if so, sets the
+// outcome and Retry-After for the 429 the caller writes.
+func (h *PaymentHandler) throttled(w http.ResponseWriter, r *http.Request, req domain.PaymentRequest) bool {
+	if h.storms == nil || req.IdempotencyKey == "" {
+		return false
+	}
+	ok, wait := h.storms.Allow(r.Context(), req)
+	if ok {
+		return false
+	}
+	setOutcome(r, "key_throttled")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return true
+}
+
 // ProcessPayment handles POST /v1/payments
 func (h *PaymentHandler) ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 
-	var req domain.PaymentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+	if h.ietf {
+		h.processPaymentIETF(w, r)
+		return
+	}
+
+	req, err := h.decodePayment(r)
+	if err != nil {
+		decodeFailure(w, r, err, writeMessage)
+		return
+	}
+	if !applyExpiryHeader(r, &req) {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidExpiryHeader)
+		return
+	}
+	if h.rateLimited(w, r, req) {
+		writeMessage(w, r, http.StatusTooManyRequests, i18n.ErrRateLimited)
 		return
 	}
 
+	req.Source = attemptSource(r)
+	if h.throttled(w, r, req) {
+		writeMessage(w, r, http.StatusTooManyRequests, i18n.ErrKeyThrottled)
+		return
+	}
 	resp, code, err := h.svc.ProcessPayment(r.Context(), req)
+	if err == nil {
+		code, err = h.enqueue(r, req, code, resp)
+	}
 	if err != nil {
+		if code == http.StatusInternalServerError {
+			logging.From(r.Context()).Errorf("process payment: %v", err)
+		}
 		if errors.Is(err, domain.ErrParamsMismatch) {
-			writeJSON(w, code, map[string]string{"error": err.Error()})
-			return
+			setOutcome(r, monitor.OutcomeMismatch)
 		}
-		writeJSON(w, code, map[string]string{"error": err.Error()})
+		writeError(w, r, code, err)
+		return
+	}
+	h.writePayment(w, r, code, resp)
+}
+
+// processPaymentIETF is ProcessPayment in IETF Idempotency-Key mode.
+func (h *PaymentHandler) processPaymentIETF(w http.ResponseWriter, r *http.Request) {
+	key, ok := headerKey(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, i18n.ErrIdempotencyKeyHeader)
 		return
 	}
 
+	req, err := h.decodePayment(r)
+	if err != nil {
+		decodeFailure(w, r, err, writeProblem)
+		return
+	}
+	if req.IdempotencyKey != "" && req.IdempotencyKey != key {
+		writeProblem(w, r, http.StatusBadRequest, i18n.ErrIdempotencyKeyConflict)
+		return
+	}
+	req.IdempotencyKey = key
+	if !applyExpiryHeader(r, &req) {
+		writeProblem(w, r, http.StatusBadRequest, i18n.ErrInvalidExpiryHeader)
+		return
+	}
+	if h.rateLimited(w, r, req) {
+		writeProblem(w, r, http.StatusTooManyRequests, i18n.ErrRateLimited)
+		return
+	}
+
+	req.Source = attemptSource(r)
+	if h.throttled(w, r, req) {
+		writeProblem(w, r, http.StatusTooManyRequests, i18n.ErrKeyThrottled)
+		return
+	}
+	resp, code, err := h.svc.ProcessPayment(r.Context(), req)
+	if err == nil {
+		code, err = h.enqueue(r, req, code, resp)
+	}
+	if err != nil {
+		if code == http.StatusInternalServerError {
+			logging.From(r.Context()).Errorf("process payment: %v", err)
+		}
+		if errors.Is(err, domain.ErrParamsMismatch) {
+			setOutcome(r, monitor.OutcomeMismatch)
+		}
+		writeProblemError(w, r, code, err)
+		return
+	}
+	if code == http.StatusConflict {
+		setOutcome(r, paymentOutcome(resp))
+		writeProblem(w, r, code, i18n.Code(resp.Code))
+		return
+	}
+	h.writePayment(w, r, code, resp)
+}
+
+// enqueue hands a payment the verdict accepted (201) to the queue and
+// answers 202 instead. Other verdicts, replays stored with 201 among them,
+// and sync mode, pass through.
+func (h *PaymentHandler) enqueue(r *http.Request, req domain.PaymentRequest, code int, resp *domain.PaymentResponse) (int, error) {
+	if h.queue == nil || code != http.StatusCreated || resp.Replay != nil {
+		return code, nil
+	}
+	err := h.queue.Enqueue(r.Context(), domain.IdempotencyRecord{
+		IdempotencyKey: resp.IdempotencyKey,
+		PaymentID:      resp.PaymentID,
+		MerchantID:     req.MerchantID,
+		CustomerID:     req.CustomerID,
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+	})
+	if err != nil {
+		setOutcome(r, "queue_full")
+		return http.StatusServiceUnavailable, err
+	}
+	return http.StatusAccepted, nil
+}
+
+// DeadLetters handles GET /v1/admin/dead-letters: the queued payments the
+// async workers gave up on, oldest first. Sync mode has none.
+func (h *PaymentHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	dead := []domain.DeadLetter{}
+	if h.queue != nil {
+		dead = h.queue.DeadLetters()
+	}
+	writeJSON(w, http.StatusOK, deadLettersResponse{DeadLetters: dead})
+}
+
+// deadLettersResponse is the body of GET /v1/admin/dead-letters.
+type deadLettersResponse struct {
+	DeadLetters []domain.DeadLetter `json:"dead_letters"`
+}
+
+// maxUserAgentLen bounds the user-agent stored per attempt.
+const maxUserAgentLen = 512
+
+// ExpiryHeader asks for the key to be kept this many hours, like
+// expiry_hours in the body.
+const ExpiryHeader = "Idempotency-Expiry"
+
+// applyExpiryHeader sets req.ExpiryHours from ExpiryHeader, if sent. It
+// reports false when the header is not a positive number of hours or
+// contradicts the body.
+func applyExpiryHeader(r *http.Request, req *domain.PaymentRequest) bool {
+	v := r.Header.Get(ExpiryHeader)
+	if v == "" {
+		return true
+	}
+	hours, err := strconv.Atoi(v)
+	if err != nil || hours <= 0 || (req.ExpiryHours != 0 && req.ExpiryHours != hours) {
+		return false
+	}
+	req.ExpiryHours = hours
+	return true
+}
+
+// decodePayment decodes the payment request in r's body.
+func (h *PaymentHandler) decodePayment(r *http.Request) (domain.PaymentRequest, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return domain.PaymentRequest{}, err
+	}
+	return h.paymentFromJSON(raw)
+}
+
+// paymentFromJSON decodes raw, keeping it as the request's Body for body
+// hashing. Unknown fields are an error unless WithUnknownFields was set.
+func (h *PaymentHandler) paymentFromJSON(raw json.RawMessage) (domain.PaymentRequest, error) {
+	var req domain.PaymentRequest
+	decode := decodeStrict
+	if h.looseFields {
+		decode = json.Unmarshal
+	}
+	if err := decode(raw, &req); err != nil {
+		return domain.PaymentRequest{}, err
+	}
+	req.Body = raw
+	return req, nil
+}
+
+// attemptSource describes the client behind r. The IP is the connection's
+// peer address; forwarding headers are client-controlled and not trusted.
+func attemptSource(r *http.Request) domain.AttemptSource {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLen {
+		ua = ua[:maxUserAgentLen]
+	}
+	// Postgres rejects NUL bytes and invalid UTF-8 in text columns.
+	ua = strings.ToValidUTF8(strings.ReplaceAll(ua, "\x00", ""), "")
+	src := domain.AttemptSource{IP: ip, UserAgent: ua}
+	if f := logging.FromContext(r.Context()); f != nil {
+		src.RequestID = f.RequestID
+	}
+	return src
+}
+
+// writePayment writes a successful ProcessPayment result.
+func (h *PaymentHandler) writePayment(w http.ResponseWriter, r *http.Request, code int, resp *domain.PaymentResponse) {
+	setOutcome(r, paymentOutcome(resp))
+	if resp.Replay != nil {
+		writeReplay(w, code, resp.Replay)
+		return
+	}
+	resp.Message = i18n.Message(language(r), i18n.Code(resp.Code))
+	if resp.Duplicate {
+		w.Header().Set(DuplicateHeader, "true")
+	}
+	if code == http.StatusConflict {
+		if resp.RetryAfterSeconds > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(resp.RetryAfterSeconds))
+		}
+		resp.Retryable, resp.RetryAfterSeconds = retryHint(w, code, i18n.Code(resp.Code))
+	}
 	writeJSON(w, code, resp)
 }
 
 // CompletePayment handles PATCH /v1/payments/{key}/complete
 func (h *PaymentHandler) CompletePayment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPatch {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 
-	// Extract key from path: /v1/payments/{key}/complete
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) < 4 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing idempotency key"})
+	key := r.PathValue("key")
+	if key == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingIdempotencyKey)
 		return
 	}
-	key := parts[2]
 
 	var req domain.CompleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		decodeFailure(w, r, err, writeMessage)
 		return
 	}
 
-	if err := h.svc.MarkComplete(r.Context(), key, req); err != nil {
-		if errors.Is(err, domain.ErrInvalidStatus) {
-			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	replayed, err := h.svc.Complete(r.Context(), key, req)
+	if err != nil {
+		var schemaErr *domain.ResponseSchemaError
+		if errors.Is(err, domain.ErrInvalidStatus) || errors.Is(err, domain.ErrInvalidStoredResponse) || errors.As(err, &schemaErr) {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
 			return
 		}
 		if errors.Is(err, domain.ErrKeyNotFound) {
-			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			writeError(w, r, http.StatusNotFound, err)
 			return
 		}
 		if errors.Is(err, domain.ErrAlreadyCompleted) {
-			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			writeError(w, r, http.StatusConflict, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("complete payment: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	setOutcome(r, string(req.Status))
+	if replayed {
+		w.Header().Set(ReplayedHeader, "true")
+	}
+	writeJSON(w, http.StatusOK, completeResponse{Status: "completed", IdempotencyKey: key})
+}
+
+// completeResponse is the body of a successful completion.
+type completeResponse struct {
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// writeReplay writes the response a succeeded payment completed with: its
+// status, headers and body as stored, marked with ReplayedHeader. Bodies
+// are JSON unless the stored headers say otherwise.
+func writeReplay(w http.ResponseWriter, code int, resp *domain.StoredResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(code)
+	if resp.Body != nil {
+		w.Write(*resp.Body)
+	}
+}
+
+// DuplicateHeader marks duplicates answered with 200 under a merchant's
+// duplicate_status_code policy, so clients and metrics can still tell them apart.
+const DuplicateHeader = "Idempotency-Duplicate"
+
+// ReplayedHeader marks a succeeded duplicate answered with the stored
+// response of the original payment rather than a PaymentResponse, and a
+// completion that repeated the one the payment already had.
+const ReplayedHeader = "Idempotency-Replayed"
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 60 * time.Second
+)
+
+// WaitForCompletion handles GET /v1/payments/{key}/wait?timeout=30s
+// It long-polls until the payment leaves processing or the timeout elapses,
+// then returns the current state; clients check the status field.
+func (h *PaymentHandler) WaitForCompletion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("key")
+	if key == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingIdempotencyKey)
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxWaitTimeout {
+			writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeout, maxWaitTimeout)
 			return
 		}
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		timeout = d
+	}
+
+	// The server's WriteTimeout is shorter than a long poll.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 5*time.Second)); err != nil {
+		logging.From(r.Context()).Warnf("wait for completion: extend write deadline: %v", err)
+	}
+
+	rec, err := h.svc.WaitForCompletion(r.Context(), key, timeout)
+	if err != nil {
+		if errors.Is(err, domain.ErrKeyNotFound) {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("wait for completion: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, paymentView(r, rec))
+}
+
+// GetPayment handles GET /v1/payments/{key}
+// Responses carry ETag and Last-Modified; a matching If-None-Match (or, when
+// absent, an If-Modified-Since not older than the record) yields 304.
+func (h *PaymentHandler) GetPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("key")
+	if key == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingIdempotencyKey)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]string{"status": "completed", "idempotency_key": key})
+	rec, err := h.svc.GetPayment(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, domain.ErrKeyNotFound) {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("get payment: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeRecord(w, r, rec)
+}
+
+// GetAttempts handles GET /v1/payments/{key}/attempts: when each request
+// for the key arrived, from where, with which request hash and how it was
+// treated, oldest first.
+func (h *PaymentHandler) GetAttempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("key")
+	if key == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingIdempotencyKey)
+		return
+	}
+
+	attempts, err := h.svc.GetAttempts(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, domain.ErrKeyNotFound) {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("get attempts: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, attemptHistory{IdempotencyKey: key, Attempts: attempts})
+}
+
+// attemptHistory is the body of GET /v1/payments/{key}/attempts.
+type attemptHistory struct {
+	IdempotencyKey string           `json:"idempotency_key"`
+	Attempts       []domain.Attempt `json:"attempts"`
+}
+
+// FindPayment handles GET /v1/payments?payment_id=, for downstream systems
+// that only know the payment ID. The response is that of GET
+// /v1/payments/{key}, which names the key.
+func (h *PaymentHandler) FindPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	paymentID := r.URL.Query().Get("payment_id")
+	if paymentID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingPaymentID)
+		return
+	}
+
+	rec, err := h.svc.GetPaymentByID(r.Context(), paymentID)
+	if err != nil {
+		if errors.Is(err, domain.ErrPaymentNotFound) {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("find payment: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeRecord(w, r, rec)
+}
+
+// writeRecord writes a stored record with its validators, or 304 when the
+// client's copy is current.
+func writeRecord(w http.ResponseWriter, r *http.Request, rec *domain.IdempotencyRecord) {
+	etag := recordETag(rec)
+	modified := recordModified(rec)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept-Language")
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, paymentView(r, rec))
+}
+
+// paymentView renders a stored record with a status message in the client's language.
+func paymentView(r *http.Request, rec *domain.IdempotencyRecord) domain.PaymentResponse {
+	code := i18n.MsgAlreadyProcessing
+	switch rec.Status {
+	case domain.StatusSucceeded:
+		code = i18n.MsgAlreadySucceeded
+	case domain.StatusFailed:
+		code = i18n.MsgPaymentFailed
+	}
+	return domain.PaymentResponse{
+		PaymentID:      rec.PaymentID,
+		IdempotencyKey: rec.IdempotencyKey,
+		Status:         rec.Status,
+		Code:           string(code),
+		Message:        i18n.Message(language(r), code),
+		AttemptCount:   rec.AttemptCount,
+		ResponseBody:   rec.ResponseBody,
+		Metadata:       rec.Metadata,
+	}
 }
 
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -92,3 +601,96 @@ func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
+
+// language returns the catalog language negotiated from Accept-Language.
+func language(r *http.Request) string {
+	return i18n.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// writeMessage writes a localized error body carrying both the message code
+// and its text in the client's language.
+func writeMessage(w http.ResponseWriter, r *http.Request, status int, code i18n.Code, args ...interface{}) {
+	writeJSON(w, status, messageBody(w, r, status, code, args...))
+}
+
+func messageBody(w http.ResponseWriter, r *http.Request, status int, code i18n.Code, args ...interface{}) map[string]interface{} {
+	body := map[string]interface{}{
+		"error": i18n.Message(language(r), code, args...),
+		"code":  string(code),
+	}
+	addRetryHint(w, body, status, code)
+	w.Header().Set("Content-Language", language(r))
+	return body
+}
+
+// writeError writes err as a localized JSON error body. Storage outages are
+// reported as 503 with a Retry-After hint, and storage timeouts as 504,
+// regardless of the given status. Errors without a message code keep their
+// raw text.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if errors.Is(err, domain.ErrUnavailable) {
+		status = http.StatusServiceUnavailable
+		setRetryAfter(w, err)
+	}
+	if errors.Is(err, domain.ErrTimeout) {
+		status = http.StatusGatewayTimeout
+	}
+	if code, args, ok := i18n.ForError(err); ok {
+		body := messageBody(w, r, status, code, args...)
+		addErrorDetails(r, body, err)
+		writeJSON(w, status, body)
+		return
+	}
+	body := map[string]interface{}{"error": err.Error(), "code": string(i18n.ErrInternal)}
+	addRetryHint(w, body, status, i18n.ErrInternal)
+	writeJSON(w, status, body)
+}
+
+// addErrorDetails adds the structured details some errors carry to a body.
+func addErrorDetails(r *http.Request, body map[string]interface{}, err error) {
+	var mismatch *domain.MismatchError
+	if errors.As(err, &mismatch) && len(mismatch.Fields) > 0 {
+		body["mismatched_fields"] = mismatch.Fields
+	}
+	if v := violations(r, err); v != nil {
+		body["violations"] = v
+	}
+}
+
+// violation is one rule a request failed, in an error body.
+type violation struct {
+	Field string `json:"field"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// violations lists, in the request's language, every rule a validation
+// error reports; nil for other errors. The body's own code and error are
+// the first violation's.
+func violations(r *http.Request, err error) []violation {
+	var errs domain.ValidationErrors
+	if !errors.As(err, &errs) {
+		var one *domain.ValidationError
+		if !errors.As(err, &one) {
+			return nil
+		}
+		errs = domain.ValidationErrors{one}
+	}
+	list := make([]violation, len(errs))
+	for i, v := range errs {
+		code, args, _ := i18n.ForError(v)
+		list[i] = violation{Field: v.Field, Code: string(code), Error: i18n.Message(language(r), code, args...)}
+	}
+	return list
+}
+
+// setRetryAfter sets a Retry-After hint for a storage outage, using the
+// circuit breaker's remaining cooldown when it is open.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	retry := time.Second
+	var open *storage.CircuitOpenError
+	if errors.As(err, &open) && open.RetryAfter > retry {
+		retry = open.RetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+}
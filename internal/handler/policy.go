@@ -3,16 +3,23 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/jsonschema"
+	"github.com/kubo-market/idempotency-shield/internal/service"
 	"github.com/kubo-market/idempotency-shield/internal/storage"
 )
 
 // PolicyHandler handles merchant policy endpoints.
 type PolicyHandler struct {
-	repo storage.Repository
+	repo  storage.Repository
+	audit service.AuditSink
 }
 
 // NewPolicyHandler creates a new PolicyHandler.
@@ -20,58 +27,336 @@ func NewPolicyHandler(repo storage.Repository) *PolicyHandler {
 	return &PolicyHandler{repo: repo}
 }
 
+// WithAudit records every policy update to sink.
+func (h *PolicyHandler) WithAudit(sink service.AuditSink) *PolicyHandler {
+	h.audit = sink
+	return h
+}
+
 // UpdatePolicy handles PUT /v1/merchants/{id}/policy
 func (h *PolicyHandler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut && r.Method != http.MethodGet {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 
-	// Extract merchant ID from path: /v1/merchants/{id}/policy
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) < 4 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing merchant_id"})
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
 		return
 	}
-	merchantID := parts[2]
 
 	if r.Method == http.MethodGet {
 		policy, err := h.repo.GetPolicy(r.Context(), merchantID)
 		if err != nil {
 			if errors.Is(err, domain.ErrMerchantNotFound) {
-				writeJSON(w, http.StatusNotFound, map[string]string{"error": "merchant policy not found"})
+				writeMessage(w, r, http.StatusNotFound, i18n.ErrPolicyNotFound)
 				return
 			}
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		writeJSON(w, http.StatusOK, policy)
+		redacted := *policy
+		redacted.SigningSecret = ""
+		writeJSON(w, http.StatusOK, redacted)
 		return
 	}
 
-	var policy domain.MerchantPolicy
-	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		decodeFailure(w, r, err, writeMessage)
+		return
+	}
+	policy, keepSecret, err := decodePolicy(raw)
+	if err != nil {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidJSON)
 		return
 	}
 	policy.MerchantID = merchantID
 
-	// Validate
+	if keepSecret {
+		current, err := h.repo.GetPolicy(r.Context(), merchantID)
+		if err != nil && !errors.Is(err, domain.ErrMerchantNotFound) {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if current != nil {
+			policy.SigningSecret = current.SigningSecret
+		}
+	}
+
+	if code, args := validatePolicy(&policy); code != "" {
+		writeMessage(w, r, http.StatusUnprocessableEntity, code, args...)
+		return
+	}
+
+	if err := h.repo.UpsertPolicy(r.Context(), policy); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	h.record(r, domain.AuditPolicyUpdated, merchantID)
+
+	setOutcome(r, "updated")
+	writeJSON(w, http.StatusOK, policyResult{Status: "updated", MerchantID: merchantID})
+}
+
+// DeletePolicy handles DELETE /v1/merchants/{id}/policy. The merchant falls
+// back to the default policy, or is refused under REQUIRE_MERCHANT_POLICY.
+func (h *PolicyHandler) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+	if err := h.repo.DeletePolicy(r.Context(), merchantID); err != nil {
+		if errors.Is(err, domain.ErrMerchantNotFound) {
+			writeMessage(w, r, http.StatusNotFound, i18n.ErrPolicyNotFound)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	h.record(r, domain.AuditPolicyDeleted, merchantID)
+
+	setOutcome(r, "deleted")
+	writeJSON(w, http.StatusOK, policyResult{Status: "deleted", MerchantID: merchantID})
+}
+
+const (
+	// defaultPoliciesLimit is the page size of a policy listing that sets
+	// no limit; maxPoliciesLimit bounds it.
+	defaultPoliciesLimit = 100
+	maxPoliciesLimit     = 1000
+)
+
+// ListPolicies handles GET /v1/merchants/policies?limit=&offset=
+// Policies are ordered by merchant_id; signing secrets are never returned.
+func (h *PolicyHandler) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	page, ok := parsePage(r, maxPoliciesLimit)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidPage, maxPoliciesLimit)
+		return
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultPoliciesLimit
+	}
+	policies, total, err := h.repo.ListPolicies(r.Context(), page)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if policies == nil {
+		policies = []domain.MerchantPolicy{}
+	}
+	for i := range policies {
+		policies[i].SigningSecret = ""
+	}
+	writeJSON(w, http.StatusOK, domain.PolicyList{Policies: policies, Page: *domain.NewPageInfo(page, len(policies), total)})
+}
+
+// UpsertPolicies handles PUT /v1/merchants/policies with a JSON array of up
+// to domain.MaxPolicyBatch policies, each naming its merchant_id. Every
+// policy is validated as PUT /v1/merchants/{id}/policy validates one; if
+// any fails, none is written and the 422 lists each failure by index.
+func (h *PolicyHandler) UpsertPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		decodeFailure(w, r, err, writeMessage)
+		return
+	}
+	if len(raws) == 0 || len(raws) > domain.MaxPolicyBatch {
+		writeMessage(w, r, http.StatusUnprocessableEntity, i18n.ErrInvalidPolicyBatch, domain.MaxPolicyBatch)
+		return
+	}
+
+	policies := make([]domain.MerchantPolicy, len(raws))
+	keepSecret := make([]bool, len(raws))
+	seen := make(map[string]bool, len(raws))
+	var problems []violation
+	for i, raw := range raws {
+		policy, keep, err := decodePolicy(raw)
+		if err != nil {
+			writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidJSON)
+			return
+		}
+		code, args := validatePolicy(&policy)
+		switch {
+		case policy.MerchantID == "":
+			code, args = i18n.ErrMissingMerchantID, nil
+		case seen[policy.MerchantID]:
+			code, args = i18n.ErrDuplicateMerchantID, []interface{}{policy.MerchantID}
+		}
+		if code != "" {
+			problems = append(problems, violation{
+				Field: fmt.Sprintf("[%d]", i), Code: string(code), Error: i18n.Message(language(r), code, args...),
+			})
+		}
+		seen[policy.MerchantID] = true
+		policies[i], keepSecret[i] = policy, keep
+	}
+	if problems != nil {
+		body := messageBody(w, r, http.StatusUnprocessableEntity, i18n.Code(problems[0].Code))
+		body["error"] = problems[0].Error
+		body["violations"] = problems
+		writeJSON(w, http.StatusUnprocessableEntity, body)
+		return
+	}
+
+	// As with one policy, leaving signing_secret out keeps the stored one.
+	secrets := make(map[string]string)
+	current, _, err := h.repo.ListPolicies(r.Context(), domain.Page{})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, p := range current {
+		secrets[p.MerchantID] = p.SigningSecret
+	}
+	ids := make([]string, len(policies))
+	for i := range policies {
+		if keepSecret[i] {
+			policies[i].SigningSecret = secrets[policies[i].MerchantID]
+		}
+		ids[i] = policies[i].MerchantID
+	}
+
+	if err := h.repo.UpsertPolicies(r.Context(), policies); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, id := range ids {
+		h.record(r, domain.AuditPolicyUpdated, id)
+	}
+
+	setOutcome(r, "updated")
+	writeJSON(w, http.StatusOK, policiesUpdated{Status: "updated", MerchantIDs: ids})
+}
+
+// decodePolicy decodes one policy body. keepSecret reports that it leaves
+// signing_secret out: GET never returns the secret, so such an update keeps
+// the stored one, while "" removes it.
+func decodePolicy(raw json.RawMessage) (policy domain.MerchantPolicy, keepSecret bool, err error) {
+	var secret struct {
+		SigningSecret *string `json:"signing_secret"`
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return policy, false, err
+	}
+	if err := json.Unmarshal(raw, &secret); err != nil {
+		return policy, false, err
+	}
+	return policy, secret.SigningSecret == nil, nil
+}
+
+// validatePolicy checks policy, filling in defaults. It returns the code and
+// arguments of the first problem, or "" when policy is valid.
+func validatePolicy(policy *domain.MerchantPolicy) (i18n.Code, []interface{}) {
 	validPolicies := map[string]bool{"strict_no_retry": true, "standard": true, "lenient": true}
 	if !validPolicies[policy.RetryPolicy] {
-		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "retry_policy must be strict_no_retry, standard, or lenient"})
-		return
+		return i18n.ErrInvalidRetryPolicy, nil
 	}
 	validHours := map[int]bool{24: true, 48: true, 72: true}
 	if !validHours[policy.ExpiryHours] {
-		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "expiry_hours must be 24, 48, or 72"})
-		return
+		return i18n.ErrInvalidExpiryHours, nil
+	}
+	if policy.DuplicateStatusCode == 0 {
+		policy.DuplicateStatusCode = http.StatusConflict
+	}
+	if policy.DuplicateStatusCode != http.StatusConflict && policy.DuplicateStatusCode != http.StatusOK {
+		return i18n.ErrInvalidDuplicateStatus, nil
 	}
 
-	if err := h.repo.UpsertPolicy(r.Context(), policy); err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	for _, f := range policy.TolerantFields {
+		if !domain.IsTolerable(f) {
+			return i18n.ErrInvalidTolerantField, []interface{}{f, strings.Join(domain.TolerableFields, ", ")}
+		}
+	}
+
+	policy.BaseCurrency = strings.ToUpper(policy.BaseCurrency)
+	if policy.BaseCurrency != "" && !domain.IsCurrency(policy.BaseCurrency) {
+		return i18n.ErrInvalidBaseCurrency, []interface{}{policy.BaseCurrency}
+	}
+
+	if policy.PaymentIDFormat != "" && !domain.ValidPaymentIDFormat(policy.PaymentIDFormat) {
+		return i18n.ErrInvalidPaymentIDFormat, []interface{}{policy.PaymentIDFormat}
+	}
+
+	if !validDuplicateAlert(*policy) {
+		return i18n.ErrInvalidDuplicateAlert, nil
+	}
+
+	if policy.RateLimitRPS < 0 || policy.RateLimitBurst < 0 ||
+		(policy.RateLimitBurst > 0 && policy.RateLimitRPS == 0) {
+		return i18n.ErrInvalidRateLimit, nil
+	}
+
+	if policy.MaxExpiryHours < 0 {
+		return i18n.ErrInvalidMaxExpiryHours, nil
+	}
+
+	if policy.StormThreshold < 0 {
+		return i18n.ErrInvalidStormThreshold, nil
+	}
+
+	validBehaviors := map[string]bool{"": true, domain.MismatchReject: true, domain.MismatchAcceptLatest: true, domain.MismatchAcceptIfNotCompleted: true}
+	if !validBehaviors[policy.MismatchBehavior] {
+		return i18n.ErrInvalidMismatch, []interface{}{policy.MismatchBehavior}
+	}
+
+	if policy.ResponseSchema != nil {
+		if _, err := jsonschema.Compile(*policy.ResponseSchema); err != nil {
+			return i18n.ErrInvalidResponseSchema, []interface{}{err.Error()}
+		}
+	}
+	return "", nil
+}
+
+// record sends an audit event of kind for merchantID, if auditing is on.
+func (h *PolicyHandler) record(r *http.Request, kind, merchantID string) {
+	if h.audit == nil {
 		return
 	}
+	src := attemptSource(r)
+	h.audit.Record(domain.AuditEvent{
+		Kind:       kind,
+		Time:       time.Now().UTC(),
+		MerchantID: merchantID,
+		SourceIP:   src.IP,
+		UserAgent:  src.UserAgent,
+		RequestID:  src.RequestID,
+	})
+}
+
+// policyResult is the body of a successful policy update or deletion.
+type policyResult struct {
+	Status     string `json:"status"`
+	MerchantID string `json:"merchant_id"`
+}
 
-	writeJSON(w, http.StatusOK, map[string]string{"status": "updated", "merchant_id": merchantID})
+// policiesUpdated is the body of a successful bulk update.
+type policiesUpdated struct {
+	Status      string   `json:"status"`
+	MerchantIDs []string `json:"merchant_ids"`
+}
+
+// validDuplicateAlert reports whether policy sets both a positive duplicate
+// alert threshold and an absolute http(s) URL to post to, or neither.
+func validDuplicateAlert(policy domain.MerchantPolicy) bool {
+	if policy.DuplicateAlertThreshold == 0 && policy.DuplicateAlertURL == "" {
+		return true
+	}
+	u, err := url.Parse(policy.DuplicateAlertURL)
+	return policy.DuplicateAlertThreshold > 0 && err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
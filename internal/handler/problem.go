@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// IdempotencyKeyHeader is the request header defined by the IETF
+// Idempotency-Key draft (draft-ietf-httpapi-idempotency-key-header).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// problemType is an RFC 9457 problem type with its fixed English title.
+type problemType struct {
+	URI   string
+	Title string
+}
+
+// Problem types for the failure modes the Idempotency-Key draft names.
+var (
+	problemKeyMissing = problemType{"/problems/idempotency-key-missing", "Idempotency-Key is missing"}
+	problemKeyInUse   = problemType{"/problems/idempotency-key-in-use", "A request with this Idempotency-Key is still being processed"}
+	problemKeyReused  = problemType{"/problems/idempotency-key-reused", "Idempotency-Key is already used for a different request payload"}
+	problemBlank      = problemType{"about:blank", ""}
+)
+
+// problemTypes maps message codes to the draft's problem types; other codes
+// are reported as about:blank.
+var problemTypes = map[i18n.Code]problemType{
+	i18n.ErrIdempotencyKeyHeader: problemKeyMissing,
+	i18n.MsgAlreadyProcessing:    problemKeyInUse,
+	i18n.ErrDuplicateProcessing:  problemKeyInUse,
+	i18n.ErrParamsMismatch:       problemKeyReused,
+}
+
+// writeProblemError is writeError for problem responses.
+func writeProblemError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if errors.Is(err, domain.ErrUnavailable) {
+		status = http.StatusServiceUnavailable
+		setRetryAfter(w, err)
+	}
+	if errors.Is(err, domain.ErrTimeout) {
+		status = http.StatusGatewayTimeout
+	}
+	code, args, ok := i18n.ForError(err)
+	if !ok {
+		code, args = i18n.ErrInternal, nil
+	}
+	body := problemBody(w, r, status, code, args...)
+	addErrorDetails(r, body, err)
+	writeProblemBody(w, status, body)
+}
+
+// headerKey returns the Idempotency-Key header value. The draft defines it as
+// a structured-field string, so surrounding quotes are stripped; bare tokens
+// are accepted too.
+func headerKey(r *http.Request) (string, bool) {
+	v := strings.TrimSpace(r.Header.Get(IdempotencyKeyHeader))
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return v, v != ""
+}
+
+// writeProblem writes an application/problem+json body. The title is fixed
+// per type; the detail is localized and the message code is kept as an
+// extension member so clients can branch on it as in legacy mode.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code i18n.Code, args ...interface{}) {
+	writeProblemBody(w, status, problemBody(w, r, status, code, args...))
+}
+
+func problemBody(w http.ResponseWriter, r *http.Request, status int, code i18n.Code, args ...interface{}) map[string]interface{} {
+	pt, ok := problemTypes[code]
+	if !ok {
+		pt = problemBlank
+	}
+	title := pt.Title
+	if title == "" {
+		title = http.StatusText(status)
+	}
+	body := map[string]interface{}{
+		"type":   pt.URI,
+		"title":  title,
+		"status": status,
+		"detail": i18n.Message(language(r), code, args...),
+		"code":   string(code),
+	}
+	addRetryHint(w, body, status, code)
+	w.Header().Set("Content-Language", language(r))
+	return body
+}
+
+func writeProblemBody(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
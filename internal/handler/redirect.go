@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectToHTTPS answers every request with a permanent redirect to the
+// same host, path and query over HTTPS on port. The 308 keeps the method and
+// body, so clients retry a POST as a POST.
+func RedirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case port != "443":
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
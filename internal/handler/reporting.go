@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
 	"github.com/kubo-market/idempotency-shield/internal/service"
 )
 
@@ -18,20 +22,23 @@ func NewReportingHandler(svc *service.ReportingService) *ReportingHandler {
 	return &ReportingHandler{svc: svc}
 }
 
-// GetDuplicates handles GET /v1/merchants/{id}/duplicates
+// maxDuplicatesLimit bounds one page of the duplicates report.
+const maxDuplicatesLimit = 1000
+
+// GetDuplicates handles GET /v1/merchants/{id}/duplicates?from=&to=&limit=&offset=
+// Without limit every duplicate is analyzed in one response. CSV and NDJSON,
+// asked for with ?format= or Accept, stream every duplicate and ignore paging.
 func (h *ReportingHandler) GetDuplicates(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
 		return
 	}
 
-	// Extract merchant ID from path: /v1/merchants/{id}/duplicates
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) < 4 {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing merchant_id"})
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
 		return
 	}
-	merchantID := parts[2]
 
 	// Parse time range from query params, default to last 24h
 	now := time.Now()
@@ -49,11 +56,190 @@ func (h *ReportingHandler) GetDuplicates(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	report, err := h.svc.GetDuplicateReport(r.Context(), merchantID, from, to)
+	w.Header().Add("Vary", "Accept")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = acceptedFormat(r)
+	}
+	switch format {
+	case "", "json", "pdf":
+	case formatCSV, formatNDJSON:
+		h.exportDuplicates(w, r, merchantID, from, to, format)
+		return
+	default:
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrUnsupportedFormat)
+		return
+	}
+
+	page, ok := parsePage(r, maxDuplicatesLimit)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidPage, maxDuplicatesLimit)
+		return
+	}
+
+	report, err := h.svc.GetDuplicateReport(r.Context(), merchantID, from, to, page)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="duplicates-%s-%s.pdf"`, merchantID, to.UTC().Format("20060102")))
+		w.WriteHeader(http.StatusOK)
+		w.Write(renderDuplicateReportPDF(report))
 		return
 	}
 
 	writeJSON(w, http.StatusOK, report)
 }
+
+// GetStats handles GET /v1/merchants/{id}/stats?from=&to=
+// The range defaults to the last 24h.
+func (h *ReportingHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+
+	from, to, ok := parseTimeRange(r, 24*time.Hour)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+
+	stats, err := h.svc.GetMerchantStats(r.Context(), merchantID, from, to)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// GetTrends handles GET /v1/merchants/{id}/duplicates/trends?from=&to=&bucket=
+// The range defaults to the last 24h and the bucket to 1h.
+func (h *ReportingHandler) GetTrends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+
+	from, to, ok := parseTimeRange(r, 24*time.Hour)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+
+	bucket := time.Hour
+	if v := r.URL.Query().Get("bucket"); v != "" {
+		var err error
+		if bucket, err = time.ParseDuration(v); err != nil {
+			bucket = 0
+		}
+	}
+	if !service.ValidTrendBucket(from, to, bucket) {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidBucket, service.MaxTrendBuckets)
+		return
+	}
+
+	trends, err := h.svc.GetDuplicateTrends(r.Context(), merchantID, from, to, bucket)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, trends)
+}
+
+// GetStatsTable handles GET /v1/stats?from=&to=&sort=&top=
+// Every merchant's activity, ordered by sort (requests, unique,
+// duplicate_rate or merchant_id; default requests), optionally only the top N.
+func (h *ReportingHandler) GetStatsTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	from, to, ok := parseTimeRange(r, 24*time.Hour)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+
+	q := r.URL.Query()
+	sortBy := service.StatsSortRequests
+	if v := q.Get("sort"); v != "" {
+		if !service.ValidStatsSort(v) {
+			writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidSort, "requests, unique, duplicate_rate, merchant_id")
+			return
+		}
+		sortBy = v
+	}
+	var top int
+	if v := q.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTop)
+			return
+		}
+		top = n
+	}
+
+	table, err := h.svc.GetStatsTable(r.Context(), from, to, sortBy, top)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, table)
+}
+
+// GetDigest handles GET /v1/merchants/{id}/digest?date=YYYY-MM-DD
+// The date defaults to yesterday (UTC).
+func (h *ReportingHandler) GetDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+
+	merchantID := r.PathValue("id")
+	if merchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+
+	day := time.Now().UTC().Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("date"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidDate)
+			return
+		}
+		day = t
+	}
+
+	digest, err := h.svc.GetDigest(r.Context(), merchantID, day)
+	if err != nil {
+		if errors.Is(err, domain.ErrDigestNotReady) {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, digest)
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// Export formats of the duplicates report.
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+var duplicateColumns = []string{
+	"idempotency_key", "payment_id", "attempt_count", "amount", "currency", "amount_at_risk", "status",
+	"first_seen_at", "last_seen_at", "distinct_sources", "suspicious", "high_priority", "amount_zscore",
+	"metadata",
+}
+
+// acceptedFormat returns the export format asked for in the Accept header,
+// or "" when the client accepts neither CSV nor NDJSON.
+func acceptedFormat(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return formatCSV
+		case "application/x-ndjson":
+			return formatNDJSON
+		}
+	}
+	return ""
+}
+
+// exportDuplicates streams every duplicate of the range as CSV or NDJSON,
+// one row per key as the repository reads it.
+func (h *ReportingHandler) exportDuplicates(w http.ResponseWriter, r *http.Request, merchantID string, from, to time.Time, format string) {
+	var contentType string
+	var begin, end func() error
+	var write func(domain.DuplicateRow) error
+	if format == formatCSV {
+		contentType = "text/csv; charset=utf-8"
+		cw := csv.NewWriter(w)
+		begin = func() error { return cw.Write(duplicateColumns) }
+		write = func(d domain.DuplicateRow) error { return cw.Write(duplicateRecord(d)) }
+		end = func() error { cw.Flush(); return cw.Error() }
+	} else {
+		contentType = "application/x-ndjson"
+		enc := json.NewEncoder(w)
+		begin = func() error { return nil }
+		write = func(d domain.DuplicateRow) error { return enc.Encode(d) }
+		end = func() error { return nil }
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+	// As with feature exports, headers wait for the first row so a query
+	// that fails up front still gets an error status.
+	started := false
+	startBody := func() error {
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="duplicates-%s-%s.%s"`,
+			merchantID, to.UTC().Format("20060102"), format))
+		w.WriteHeader(http.StatusOK)
+		return begin()
+	}
+
+	err := h.svc.ExportDuplicates(r.Context(), merchantID, from, to, func(d domain.DuplicateRow) error {
+		if !started {
+			if err := startBody(); err != nil {
+				return err
+			}
+		}
+		return write(d)
+	})
+	if err == nil && !started {
+		err = startBody()
+	}
+	if err == nil {
+		err = end()
+	}
+	if err != nil {
+		if !started {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		logging.From(r.Context()).Warnf("duplicates export aborted: %v", err)
+	}
+}
+
+func duplicateRecord(d domain.DuplicateRow) []string {
+	zscore := ""
+	if d.HighPriority {
+		zscore = strconv.FormatFloat(d.AmountZScore, 'f', 2, 64)
+	}
+	return []string{
+		d.IdempotencyKey, d.PaymentID, strconv.Itoa(d.AttemptCount), strconv.FormatInt(d.Amount, 10), d.Currency,
+		strconv.FormatInt(d.AmountAtRisk, 10), string(d.Status),
+		d.FirstSeenAt.Format(time.RFC3339Nano), d.LastSeenAt.Format(time.RFC3339Nano),
+		strconv.Itoa(d.DistinctSources), strconv.FormatBool(d.Suspicious), strconv.FormatBool(d.HighPriority), zscore,
+		string(d.Metadata),
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/pdf"
+)
+
+const (
+	pdfMargin     = 50.0
+	pdfLineHeight = 16.0
+	pdfBarWidth   = 180.0
+)
+
+// pdfWriter tracks the vertical cursor and starts new pages as needed.
+type pdfWriter struct {
+	doc *pdf.Document
+	y   float64
+}
+
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{doc: pdf.New()}
+	w.newPage()
+	return w
+}
+
+func (w *pdfWriter) newPage() {
+	w.doc.AddPage()
+	w.y = pdf.PageHeight - pdfMargin
+}
+
+// need starts a new page if fewer than h points remain.
+func (w *pdfWriter) need(h float64) {
+	if w.y-h < pdfMargin {
+		w.newPage()
+	}
+}
+
+func (w *pdfWriter) heading(s string) {
+	w.need(3 * pdfLineHeight)
+	w.y -= pdfLineHeight
+	w.doc.Text(pdfMargin, w.y, 13, true, s)
+	w.y -= 4
+	w.doc.Line(pdfMargin, w.y, pdf.PageWidth-pdfMargin, w.y)
+	w.y -= pdfLineHeight
+}
+
+// row writes cells at the given x offsets from the left margin.
+func (w *pdfWriter) row(cols []float64, bold bool, cells ...string) {
+	w.need(pdfLineHeight)
+	for i, c := range cells {
+		w.doc.Text(pdfMargin+cols[i], w.y, 9, bold, c)
+	}
+	w.y -= pdfLineHeight
+}
+
+func formatCents(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, currency)
+}
+
+// renderDuplicateReportPDF lays out a duplicate report for account managers to
+// forward to merchants: summary, currency breakdown, and suspicious keys with
+// a bar per key sized by attempt count.
+func renderDuplicateReportPDF(r *domain.DuplicateReport) []byte {
+	w := newPDFWriter()
+
+	w.doc.Text(pdfMargin, w.y, 18, true, "Duplicate Activity Report")
+	w.y -= 2 * pdfLineHeight
+	w.doc.Text(pdfMargin, w.y, 11, false, "Merchant: "+r.MerchantID)
+	w.y -= pdfLineHeight
+	w.doc.Text(pdfMargin, w.y, 11, false, fmt.Sprintf("Period: %s to %s",
+		r.TimeRange.From.UTC().Format("2006-01-02 15:04 MST"), r.TimeRange.To.UTC().Format("2006-01-02 15:04 MST")))
+	w.y -= pdfLineHeight
+
+	w.heading("Summary")
+	summary := [][2]string{
+		{"Total requests", strconv.Itoa(r.TotalRequests)},
+		{"Unique payments", strconv.Itoa(r.UniquePayments)},
+		{"Duplicate requests", strconv.Itoa(r.DuplicateCount)},
+		{"Duplicate rate", fmt.Sprintf("%.1f%%", r.DuplicateRate)},
+		{"Suspicious keys", strconv.Itoa(len(r.SuspiciousKeys))},
+	}
+	if n := r.Normalized; n != nil {
+		summary = append(summary, [2]string{"Amount at risk (normalized)",
+			fmt.Sprintf("%s (%s rates, %s)", formatCents(n.Amount, n.Currency), n.RatesSource, n.RatesUpdatedAt.UTC().Format("2006-01-02"))})
+	}
+	for _, kv := range summary {
+		w.row([]float64{0, 180}, false, kv[0], kv[1])
+	}
+
+	w.heading("Amount at risk by currency")
+	currencies := make([]string, 0, len(r.CurrencyBreakdown))
+	for c := range r.CurrencyBreakdown {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+	if len(currencies) == 0 {
+		w.row([]float64{0}, false, "No duplicate charges were at risk in this period.")
+	}
+	for _, c := range currencies {
+		share := ""
+		if r.Normalized != nil {
+			if pct, ok := r.Normalized.Percentages[c]; ok {
+				share = fmt.Sprintf("%.1f%%", pct)
+			}
+		}
+		w.row([]float64{0, 180, 300}, false, c, formatCents(r.CurrencyBreakdown[c], c), share)
+	}
+
+	w.heading("Suspicious keys")
+	if len(r.SuspiciousKeys) == 0 {
+		w.row([]float64{0}, false, "No keys exceeded the retry threshold.")
+		return w.doc.Bytes()
+	}
+	cols := []float64{0, 150, 200, 290, 360, 440}
+	w.row(cols, true, "Idempotency key", "Attempts", "Amount", "Status", "Last seen", "")
+	maxAttempts := 0
+	for _, k := range r.SuspiciousKeys {
+		if k.AttemptCount > maxAttempts {
+			maxAttempts = k.AttemptCount
+		}
+	}
+	for _, k := range r.SuspiciousKeys {
+		key := k.IdempotencyKey
+		if len(key) > 24 {
+			key = key[:21] + "..."
+		}
+		if k.HighPriority {
+			key = "! " + key
+		}
+		w.need(pdfLineHeight)
+		barWidth := pdfBarWidth / 2 * float64(k.AttemptCount) / float64(maxAttempts)
+		w.doc.Rect(pdfMargin+cols[5], w.y-1, barWidth, 8, 0.6)
+		w.row(cols, false, key, strconv.Itoa(k.AttemptCount), formatCents(k.Amount, k.Currency),
+			string(k.Status), k.LastSeenAt.UTC().Format("01-02 15:04"), "")
+	}
+	for _, k := range r.SuspiciousKeys {
+		if k.HighPriority {
+			w.y -= pdfLineHeight / 2
+			w.row([]float64{0}, false, "! High priority: amount is an outlier for this merchant (more than 3 standard deviations above its 30-day mean).")
+			break
+		}
+	}
+	return w.doc.Bytes()
+}
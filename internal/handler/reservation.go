@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// ReserveKey handles POST /v1/idempotency-keys: it reserves the body's
+// idempotency_key, or a generated one, for the merchant's coming payment.
+func (h *PaymentHandler) ReserveKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if !h.svc.ReservationsEnabled() {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+
+	var req domain.ReserveKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeFailure(w, r, err, writeMessage)
+		return
+	}
+	res, code, err := h.svc.ReserveKey(r.Context(), req)
+	if err != nil {
+		if code == http.StatusInternalServerError {
+			logging.From(r.Context()).Errorf("reserve key: %v", err)
+		}
+		writeError(w, r, code, err)
+		return
+	}
+	writeJSON(w, code, res)
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// processingRetryAfter is the backoff, in seconds, suggested to clients
+// whose key is still being processed.
+const processingRetryAfter = 1
+
+// retryHint reports whether a failed request may be resent unchanged and,
+// if so, after how many seconds. Server errors, keys still processing and
+// writes that lost a race are retryable; every other client error needs a
+// changed request. Retry-After is set when not already present, so the
+// header and body always agree.
+func retryHint(w http.ResponseWriter, status int, code i18n.Code) (bool, int) {
+	if !retryable(status, code) {
+		return false, 0
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && secs > 0 {
+		return true, secs
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(processingRetryAfter))
+	return true, processingRetryAfter
+}
+
+// retryable reports whether the same request may succeed if retried later.
+func retryable(status int, code i18n.Code) bool {
+	return status >= 500 || status == http.StatusTooManyRequests ||
+		(status == http.StatusConflict && (code == i18n.MsgAlreadyProcessing ||
+			code == i18n.ErrDuplicateProcessing || code == i18n.ErrConcurrentUpdate))
+}
+
+// addRetryHint adds retryable (and, when true, retry_after_seconds) to an
+// error body.
+func addRetryHint(w http.ResponseWriter, body map[string]interface{}, status int, code i18n.Code) {
+	retryable, after := retryHint(w, status, code)
+	body["retryable"] = retryable
+	if retryable {
+		body["retry_after_seconds"] = after
+	}
+}
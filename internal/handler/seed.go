@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// Seeder loads the sample data.
+type Seeder interface {
+	Seed(ctx context.Context) error
+}
+
+// SeedHandler loads the sample data on demand, for dev and staging.
+type SeedHandler struct {
+	seeder  Seeder
+	enabled bool
+}
+
+// NewSeedHandler creates a new SeedHandler. A nil seeder (backends other
+// than Postgres) answers 503; a disabled one, in prod, answers 403.
+func NewSeedHandler(seeder Seeder, enabled bool) *SeedHandler {
+	return &SeedHandler{seeder: seeder, enabled: enabled}
+}
+
+// seedResult is the body of POST /v1/admin/seed.
+type seedResult struct {
+	Status string `json:"status"`
+}
+
+// Seed handles POST /v1/admin/seed
+func (h *SeedHandler) Seed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if !h.enabled {
+		writeMessage(w, r, http.StatusForbidden, i18n.ErrSeedDisabled)
+		return
+	}
+	if h.seeder == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	if err := h.seeder.Seed(r.Context()); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, seedResult{Status: "seeded"})
+}
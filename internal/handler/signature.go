@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+)
+
+// Request signing headers: the hex HMAC-SHA256 of the timestamp, a dot and
+// the body, and the Unix time the request was signed at.
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// RequireSignature verifies the signature of payment requests whose
+// merchants have a signing secret before they reach next, answering 401 to
+// unsigned, tampered or stale ones. The body may be one payment or a batch;
+// every merchant it names is checked.
+func RequireSignature(verifier *service.SignatureVerifier, next http.Handler) http.Handler {
+	return requireSignature(verifier, func(_ *http.Request, body []byte) ([]string, error) {
+		return bodyMerchants(body), nil
+	}, next)
+}
+
+// KeyOwner returns the merchant an idempotency key belongs to, or
+// domain.ErrKeyNotFound.
+type KeyOwner func(ctx context.Context, key string) (string, error)
+
+// RequireKeySignature verifies requests on the payment named by the {key}
+// path value, such as completions, whose bodies do not name a merchant:
+// they must be signed under the secret of the merchant owning the key. An
+// unknown key passes through, for the handler to answer 404.
+func RequireKeySignature(verifier *service.SignatureVerifier, owner KeyOwner, next http.Handler) http.Handler {
+	return requireSignature(verifier, func(r *http.Request, _ []byte) ([]string, error) {
+		merchantID, err := owner(r.Context(), r.PathValue("key"))
+		if errors.Is(err, domain.ErrKeyNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []string{merchantID}, nil
+	}, next)
+}
+
+// requireSignature verifies the request for the merchants it names.
+func requireSignature(verifier *service.SignatureVerifier, merchants func(*http.Request, []byte) ([]string, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			decodeFailure(w, r, err, writeMessage)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ids, err := merchants(r, body)
+		if err == nil {
+			err = verifier.Verify(r.Context(), ids,
+				r.Header.Get(SignatureTimestampHeader), r.Header.Get(SignatureHeader), body)
+		}
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r)
+		case errors.Is(err, domain.ErrInvalidSignature):
+			setOutcome(r, "invalid_signature")
+			writeMessage(w, r, http.StatusUnauthorized, i18n.ErrInvalidSignature)
+		case errors.Is(err, domain.ErrSignatureExpired):
+			setOutcome(r, "invalid_signature")
+			writeMessage(w, r, http.StatusUnauthorized, i18n.ErrSignatureExpired, int(verifier.Tolerance().Seconds()))
+		default:
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+	})
+}
+
+// bodyMerchants returns the distinct merchant_ids of a payment or batch
+// body, decoded as the handlers decode it. A body that does not decode
+// names none; the handler rejects it.
+func bodyMerchants(body []byte) []string {
+	type payment struct {
+		MerchantID string `json:"merchant_id"`
+	}
+	var payments []payment
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if json.NewDecoder(bytes.NewReader(trimmed)).Decode(&payments) != nil {
+			return nil
+		}
+	} else {
+		var one payment
+		if json.NewDecoder(bytes.NewReader(trimmed)).Decode(&one) != nil {
+			return nil
+		}
+		payments = append(payments, one)
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, p := range payments {
+		if p.MerchantID != "" && !seen[p.MerchantID] {
+			seen[p.MerchantID] = true
+			ids = append(ids, p.MerchantID)
+		}
+	}
+	return ids
+}
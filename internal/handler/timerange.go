@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// parseTimeRange reads the RFC 3339 from and to query parameters, defaulting
+// to the span before now. It reports false for unparsable values or a range
+// that does not move forward.
+func parseTimeRange(r *http.Request, span time.Duration) (time.Time, time.Time, bool) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-span)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, false
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, false
+		}
+	}
+	return from, to, from.Before(to)
+}
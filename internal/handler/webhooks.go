@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+)
+
+const (
+	// defaultDeadLettersLimit is the page size of a dead-letter listing that
+	// sets no limit; maxDeadLettersLimit bounds it.
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 500
+)
+
+// WebhookHandler serves the webhook dead-letter admin endpoints and
+// merchants' webhook replays.
+type WebhookHandler struct {
+	svc *service.WebhookService
+}
+
+// NewWebhookHandler creates a new WebhookHandler. With a nil svc, as without
+// Postgres, every endpoint answers 503.
+func NewWebhookHandler(svc *service.WebhookService) *WebhookHandler {
+	return &WebhookHandler{svc: svc}
+}
+
+// DeadLetters handles GET /v1/admin/webhooks/dead-letters?limit=&offset=
+// Dead letters are listed newest first.
+func (h *WebhookHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if h.svc == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	page, ok := parsePage(r, maxDeadLettersLimit)
+	if !ok {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidPage, maxDeadLettersLimit)
+		return
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultDeadLettersLimit
+	}
+	dead, total, err := h.svc.DeadLetters(r.Context(), page)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if dead == nil {
+		dead = []domain.WebhookDeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, domain.WebhookDeadLetterList{DeadLetters: dead, Page: *domain.NewPageInfo(page, len(dead), total)})
+}
+
+// Redeliver handles POST /v1/admin/webhooks/dead-letters/{id}/redeliver: the
+// payload is posted to its endpoint once more. A delivery the endpoint
+// refuses answers 502 and stays listed with the attempt counted.
+func (h *WebhookHandler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if h.svc == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidDeadLetterID)
+		return
+	}
+
+	dl, err := h.svc.Redeliver(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrDeadLetterNotFound):
+			writeError(w, r, http.StatusNotFound, err)
+		case errors.Is(err, domain.ErrWebhookDelivery):
+			writeError(w, r, http.StatusBadGateway, err)
+		default:
+			if !errors.Is(err, domain.ErrUnavailable) {
+				logging.From(r.Context()).Errorf("redeliver webhook %d: %v", id, err)
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+// Replay handles POST /v1/webhooks/replay: the merchant's webhooks created
+// in the body's range are delivered again, in the background, to the
+// endpoints they were first sent to. It answers 202 with their count.
+func (h *WebhookHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, r, http.StatusMethodNotAllowed, i18n.ErrMethodNotAllowed)
+		return
+	}
+	if h.svc == nil {
+		writeMessage(w, r, http.StatusServiceUnavailable, i18n.ErrUnavailable)
+		return
+	}
+	var req domain.WebhookReplayRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		decodeFailure(w, r, err, writeMessage)
+		return
+	}
+	if req.MerchantID == "" {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrMissingMerchantID)
+		return
+	}
+	if req.From.IsZero() || !req.From.Before(req.To) {
+		writeMessage(w, r, http.StatusBadRequest, i18n.ErrInvalidTimeRange)
+		return
+	}
+
+	replay, err := h.svc.Replay(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, domain.ErrReplayTooLarge) {
+			writeMessage(w, r, http.StatusUnprocessableEntity, i18n.ErrReplayTooLarge, domain.MaxWebhookReplay)
+			return
+		}
+		if !errors.Is(err, domain.ErrUnavailable) {
+			logging.From(r.Context()).Errorf("replay webhooks: %v", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, replay)
+}
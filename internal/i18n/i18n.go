@@ -0,0 +1,546 @@
+// Package i18n resolves message codes to human-readable text in the languages
+// our merchant dashboards display to end users. Clients should branch on the
+// code; the text is for display only and may change between releases.
+package i18n
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// Code identifies a response message independent of its language.
+type Code string
+
+// DefaultLanguage is used when the client sends no supported Accept-Language.
+const DefaultLanguage = "en"
+
+// Payment outcome messages.
+const (
+	MsgPaymentAccepted   Code = "payment_accepted"
+	MsgExpiredKeyReused  Code = "expired_key_reused"
+	MsgAlreadyProcessing Code = "already_processing"
+	MsgAlreadySucceeded  Code = "already_succeeded"
+	MsgRetryingFailed    Code = "retrying_failed"
+	MsgReclaimedStale    Code = "reclaimed_stale_processing"
+	MsgPaymentFailed     Code = "payment_failed"
+	MsgParamsUpdated     Code = "params_updated"
+)
+
+// Error messages.
+const (
+	ErrMethodNotAllowed       Code = "method_not_allowed"
+	ErrInvalidJSON            Code = "invalid_json"
+	ErrMissingMerchantID      Code = "missing_merchant_id"
+	ErrMissingIdempotencyKey  Code = "missing_idempotency_key"
+	ErrUnsupportedFormat      Code = "unsupported_format"
+	ErrPolicyNotFound         Code = "policy_not_found"
+	ErrInvalidRetryPolicy     Code = "invalid_retry_policy"
+	ErrInvalidExpiryHours     Code = "invalid_expiry_hours"
+	ErrWebSocketRequired      Code = "websocket_required"
+	ErrAdminDisabled          Code = "admin_disabled"
+	ErrSeedDisabled           Code = "seed_disabled"
+	ErrUnauthorized           Code = "unauthorized"
+	ErrInternal               Code = "internal_error"
+	ErrFieldRequired          Code = "field_required"
+	ErrFieldNonNegative       Code = "field_non_negative"
+	ErrFieldMax               Code = "field_max"
+	ErrFieldPositive          Code = "field_positive"
+	ErrFieldMin               Code = "field_min"
+	ErrFieldTooLong           Code = "field_too_long"
+	ErrFieldCharset           Code = "field_charset"
+	ErrFieldTooLarge          Code = "field_too_large"
+	ErrFieldObject            Code = "field_object"
+	ErrUnsupportedCurrency    Code = "unsupported_currency"
+	ErrInvalidExpiryHeader    Code = "invalid_expiry_header"
+	ErrInvalidMaxExpiryHours  Code = "invalid_max_expiry_hours"
+	ErrInvalidBucket          Code = "invalid_bucket"
+	ErrInvalidSignature       Code = "invalid_signature"
+	ErrSignatureExpired       Code = "signature_expired"
+	ErrDuplicateProcessing    Code = "duplicate_processing"
+	ErrParamsMismatch         Code = "params_mismatch"
+	ErrAlreadyCompleted       Code = "already_completed"
+	ErrKeyNotFound            Code = "key_not_found"
+	ErrKeyExpired             Code = "key_expired"
+	ErrInvalidStatus          Code = "invalid_status"
+	ErrMerchantNotFound       Code = "merchant_not_found"
+	ErrUnavailable            Code = "service_unavailable"
+	ErrInvalidDate            Code = "invalid_date"
+	ErrDigestNotFound         Code = "digest_not_found"
+	ErrDigestNotReady         Code = "digest_not_ready"
+	ErrInvalidTimeout         Code = "invalid_timeout"
+	ErrInvalidResponseSchema  Code = "invalid_response_schema"
+	ErrResponseSchema         Code = "response_schema_mismatch"
+	ErrInvalidDuplicateStatus Code = "invalid_duplicate_status_code"
+	ErrIdempotencyKeyHeader   Code = "idempotency_key_header_missing"
+	ErrIdempotencyKeyConflict Code = "idempotency_key_conflict"
+	ErrInvalidTolerantField   Code = "invalid_tolerant_field"
+	ErrInvalidBaseCurrency    Code = "invalid_base_currency"
+	ErrInvalidTimeRange       Code = "invalid_time_range"
+	ErrResourceNotFound       Code = "resource_not_found"
+	ErrInvalidSort            Code = "invalid_sort"
+	ErrInvalidTop             Code = "invalid_top"
+	ErrInvalidPage            Code = "invalid_page"
+	ErrInvalidPaymentIDFormat Code = "invalid_payment_id_format"
+	ErrInvalidDuplicateAlert  Code = "invalid_duplicate_alert"
+	ErrMerchantNotOnboarded   Code = "merchant_not_onboarded"
+	ErrQueueFull              Code = "queue_full"
+	ErrPaymentNotFound        Code = "payment_not_found"
+	ErrConcurrentUpdate       Code = "concurrent_update"
+	ErrMissingPaymentID       Code = "missing_payment_id"
+	ErrStoreFull              Code = "store_full"
+	ErrInvalidStoredResponse  Code = "invalid_stored_response"
+	ErrRateLimited            Code = "rate_limited"
+	ErrInvalidRateLimit       Code = "invalid_rate_limit"
+	ErrInvalidBatch           Code = "invalid_batch"
+	ErrInvalidPolicyBatch     Code = "invalid_policy_batch"
+	ErrDuplicateMerchantID    Code = "duplicate_merchant_id"
+	ErrInvalidKeyFilter       Code = "invalid_key_filter"
+	ErrKeyReserved            Code = "key_reserved"
+	ErrKeyInUse               Code = "key_in_use"
+	ErrTimeout                Code = "timeout"
+	ErrLockTimeout            Code = "lock_timeout"
+	ErrUnsupportedMediaType   Code = "unsupported_media_type"
+	ErrBodyTooLarge           Code = "body_too_large"
+	ErrUnknownField           Code = "unknown_field"
+	ErrKeyThrottled           Code = "key_throttled"
+	ErrInvalidStormThreshold  Code = "invalid_storm_threshold"
+	ErrInvalidMismatch        Code = "invalid_mismatch_behavior"
+	ErrDeadLetterNotFound     Code = "dead_letter_not_found"
+	ErrWebhookDelivery        Code = "webhook_delivery_failed"
+	ErrInvalidDeadLetterID    Code = "invalid_dead_letter_id"
+	ErrReplayTooLarge         Code = "replay_too_large"
+	ErrNothingToRestore       Code = "nothing_to_restore"
+	ErrKeyReused              Code = "key_reused"
+)
+
+var catalog = map[string]map[Code]string{
+	"en": {
+		MsgPaymentAccepted:   "payment accepted for processing",
+		MsgExpiredKeyReused:  "expired key reused, payment accepted for processing",
+		MsgAlreadyProcessing: "payment is already being processed",
+		MsgAlreadySucceeded:  "payment already succeeded",
+		MsgRetryingFailed:    "previous attempt failed, retrying",
+		MsgReclaimedStale:    "previous attempt timed out in processing, retrying",
+		MsgPaymentFailed:     "payment failed",
+		MsgParamsUpdated:     "payment parameters replaced with this request's",
+
+		ErrMethodNotAllowed:       "method not allowed",
+		ErrInvalidJSON:            "invalid JSON body",
+		ErrMissingMerchantID:      "missing merchant_id",
+		ErrMissingIdempotencyKey:  "missing idempotency key",
+		ErrUnsupportedFormat:      "format must be json or pdf",
+		ErrPolicyNotFound:         "merchant policy not found",
+		ErrInvalidRetryPolicy:     "retry_policy must be strict_no_retry, standard, or lenient",
+		ErrInvalidExpiryHours:     "expiry_hours must be 24, 48, or 72",
+		ErrWebSocketRequired:      "websocket upgrade required",
+		ErrAdminDisabled:          "admin API disabled: ADMIN_TOKEN not set",
+		ErrSeedDisabled:           "sample data cannot be seeded when DEPLOY_ENV is prod",
+		ErrUnauthorized:           "unauthorized",
+		ErrInternal:               "internal server error",
+		ErrFieldRequired:          "%s is required",
+		ErrFieldNonNegative:       "%s must be non-negative",
+		ErrFieldMax:               "%s must be at most %d",
+		ErrFieldPositive:          "%s must be positive",
+		ErrFieldMin:               "%s must be at least %d",
+		ErrFieldTooLong:           "%s must be at most %d characters",
+		ErrFieldCharset:           "%s must be printable ASCII",
+		ErrFieldTooLarge:          "%s must be at most %d bytes",
+		ErrFieldObject:            "%s must be a JSON object",
+		ErrUnsupportedCurrency:    "%s must be an ISO 4217 currency code",
+		ErrInvalidExpiryHeader:    "Idempotency-Expiry must be a positive number of hours, matching expiry_hours when both are sent",
+		ErrInvalidMaxExpiryHours:  "max_expiry_hours must be a positive number of hours",
+		ErrInvalidBucket:          "bucket must be a whole number of minutes (e.g. 15m, 1h) splitting the time range into at most %d buckets",
+		ErrInvalidSignature:       "X-Signature is missing or does not match the request body",
+		ErrSignatureExpired:       "X-Signature-Timestamp is missing or more than %d seconds from the server time",
+		ErrDuplicateProcessing:    "payment is already being processed",
+		ErrParamsMismatch:         "request parameters do not match original payment",
+		ErrAlreadyCompleted:       "payment already completed",
+		ErrKeyNotFound:            "idempotency key not found",
+		ErrKeyExpired:             "idempotency key has expired",
+		ErrInvalidStatus:          "invalid status: must be 'succeeded' or 'failed'",
+		ErrMerchantNotFound:       "merchant not found",
+		ErrUnavailable:            "service temporarily unavailable",
+		ErrInvalidDate:            "date must be in YYYY-MM-DD format",
+		ErrDigestNotFound:         "digest not found",
+		ErrDigestNotReady:         "digest is only available for days that have ended (UTC)",
+		ErrInvalidTimeout:         "timeout must be a positive duration up to %s, e.g. 30s",
+		ErrInvalidResponseSchema:  "response_schema is not a supported JSON Schema: %s",
+		ErrResponseSchema:         "response_body does not match the merchant's response schema: %s",
+		ErrInvalidDuplicateStatus: "duplicate_status_code must be 409 or 200",
+		ErrIdempotencyKeyHeader:   "the Idempotency-Key header is required",
+		ErrIdempotencyKeyConflict: "idempotency_key in the body does not match the Idempotency-Key header",
+		ErrInvalidTolerantField:   "%s cannot be a tolerant field (allowed: %s)",
+		ErrInvalidBaseCurrency:    "base_currency %q is not a three-letter ISO 4217 code",
+		ErrInvalidTimeRange:       "from and to must be RFC 3339 timestamps with from before to",
+		ErrResourceNotFound:       "resource not found",
+		ErrInvalidSort:            "sort must be one of: %s",
+		ErrInvalidTop:             "top must be a positive integer",
+		ErrInvalidPage:            "limit must be between 1 and %d and offset must be a non-negative integer",
+		ErrInvalidPaymentIDFormat: "payment_id_format %q must contain exactly one of <ulid>, <uuid> or <nanos> and at most 32 letters, digits, _ or -",
+		ErrInvalidDuplicateAlert:  "duplicate_alert_threshold must be positive and duplicate_alert_url an absolute http(s) URL; set both or neither",
+		ErrMerchantNotOnboarded:   "merchant has no policy; onboard it with PUT /v1/merchants/{id}/policy",
+		ErrQueueFull:              "the processing queue is full; retry later",
+		ErrPaymentNotFound:        "payment not found",
+		ErrConcurrentUpdate:       "payment was updated concurrently; retry the request",
+		ErrMissingPaymentID:       "payment_id is required",
+		ErrStoreFull:              "the key store is full; retry later",
+		ErrInvalidStoredResponse:  "response_status must be between 200 and 599, and response_headers at most %d valid headers other than hop-by-hop, Content-Length, Date, Content-Language, Retry-After and Idempotency-* headers",
+		ErrRateLimited:            "too many payment requests for this merchant; retry later",
+		ErrInvalidRateLimit:       "rate_limit_rps must be positive and rate_limit_burst a positive integer, set only with rate_limit_rps",
+		ErrInvalidBatch:           "a batch must have between 1 and %d payments",
+		ErrInvalidPolicyBatch:     "a bulk update must have between 1 and %d policies",
+		ErrDuplicateMerchantID:    "merchant_id %s appears more than once",
+		ErrInvalidKeyFilter:       "invalid %s: status must be processing, succeeded or failed, amounts non-negative integers with min_amount at most max_amount, and from and to RFC 3339 timestamps with from before to",
+		ErrKeyReserved:            "idempotency key is reserved for another merchant",
+		ErrKeyInUse:               "idempotency key is already used by a payment",
+		ErrTimeout:                "storage did not answer in time; retry with the same key",
+		ErrLockTimeout:            "another request for this key held it too long; retry with the same key",
+		ErrUnsupportedMediaType:   "request body must be application/json",
+		ErrBodyTooLarge:           "request body exceeds %d bytes",
+		ErrUnknownField:           "unknown field %s",
+		ErrKeyThrottled:           "too many attempts for this idempotency key; back off for Retry-After seconds",
+		ErrInvalidStormThreshold:  "storm_threshold must be a positive number of attempts",
+		ErrInvalidMismatch:        "mismatch_behavior %q must be reject, accept_latest or accept_if_not_completed",
+		ErrDeadLetterNotFound:     "webhook dead letter not found",
+		ErrWebhookDelivery:        "the webhook endpoint did not accept the delivery; it stays a dead letter",
+		ErrInvalidDeadLetterID:    "dead letter id must be a positive integer",
+		ErrReplayTooLarge:         "the range holds more than %d webhooks; replay a shorter range",
+		ErrNothingToRestore:       "no admin action on this key can be restored; the restore window may have passed",
+		ErrKeyReused:              "a payment has used this key since the admin action; restoring it would overwrite that payment",
+	},
+	"pt-BR": {
+		MsgPaymentAccepted:   "pagamento aceito para processamento",
+		MsgExpiredKeyReused:  "chave expirada reutilizada, pagamento aceito para processamento",
+		MsgAlreadyProcessing: "o pagamento já está sendo processado",
+		MsgAlreadySucceeded:  "o pagamento já foi concluído com sucesso",
+		MsgRetryingFailed:    "a tentativa anterior falhou, tentando novamente",
+		MsgReclaimedStale:    "a tentativa anterior excedeu o tempo de processamento, tentando novamente",
+		MsgPaymentFailed:     "o pagamento falhou",
+		MsgParamsUpdated:     "parâmetros do pagamento substituídos pelos desta requisição",
+
+		ErrMethodNotAllowed:       "método não permitido",
+		ErrInvalidJSON:            "corpo JSON inválido",
+		ErrMissingMerchantID:      "merchant_id ausente",
+		ErrMissingIdempotencyKey:  "chave de idempotência ausente",
+		ErrUnsupportedFormat:      "format deve ser json ou pdf",
+		ErrPolicyNotFound:         "política do lojista não encontrada",
+		ErrInvalidRetryPolicy:     "retry_policy deve ser strict_no_retry, standard ou lenient",
+		ErrInvalidExpiryHours:     "expiry_hours deve ser 24, 48 ou 72",
+		ErrWebSocketRequired:      "é necessário upgrade para websocket",
+		ErrAdminDisabled:          "API administrativa desativada: ADMIN_TOKEN não definido",
+		ErrSeedDisabled:           "dados de exemplo não podem ser carregados quando DEPLOY_ENV é prod",
+		ErrUnauthorized:           "não autorizado",
+		ErrInternal:               "erro interno do servidor",
+		ErrFieldRequired:          "%s é obrigatório",
+		ErrFieldNonNegative:       "%s não pode ser negativo",
+		ErrFieldMax:               "%s deve ser no máximo %d",
+		ErrFieldPositive:          "%s deve ser positivo",
+		ErrFieldMin:               "%s deve ser no mínimo %d",
+		ErrFieldTooLong:           "%s deve ter no máximo %d caracteres",
+		ErrFieldCharset:           "%s deve conter apenas ASCII imprimível",
+		ErrFieldTooLarge:          "%s deve ter no máximo %d bytes",
+		ErrFieldObject:            "%s deve ser um objeto JSON",
+		ErrUnsupportedCurrency:    "%s deve ser um código de moeda ISO 4217",
+		ErrInvalidExpiryHeader:    "Idempotency-Expiry deve ser um número positivo de horas, igual a expiry_hours quando ambos são enviados",
+		ErrInvalidMaxExpiryHours:  "max_expiry_hours deve ser um número positivo de horas",
+		ErrInvalidBucket:          "bucket deve ser um número inteiro de minutos (ex. 15m, 1h) que divida o período em no máximo %d intervalos",
+		ErrInvalidSignature:       "X-Signature ausente ou não corresponde ao corpo da requisição",
+		ErrSignatureExpired:       "X-Signature-Timestamp ausente ou a mais de %d segundos do horário do servidor",
+		ErrDuplicateProcessing:    "o pagamento já está sendo processado",
+		ErrParamsMismatch:         "os parâmetros da requisição não correspondem ao pagamento original",
+		ErrAlreadyCompleted:       "o pagamento já foi finalizado",
+		ErrKeyNotFound:            "chave de idempotência não encontrada",
+		ErrKeyExpired:             "a chave de idempotência expirou",
+		ErrInvalidStatus:          "status inválido: deve ser 'succeeded' ou 'failed'",
+		ErrMerchantNotFound:       "lojista não encontrado",
+		ErrUnavailable:            "serviço temporariamente indisponível",
+		ErrInvalidDate:            "date deve estar no formato AAAA-MM-DD",
+		ErrDigestNotFound:         "resumo não encontrado",
+		ErrDigestNotReady:         "o resumo só está disponível para dias já encerrados (UTC)",
+		ErrInvalidTimeout:         "timeout deve ser uma duração positiva de até %s, por exemplo 30s",
+		ErrInvalidResponseSchema:  "response_schema não é um JSON Schema suportado: %s",
+		ErrResponseSchema:         "response_body não corresponde ao schema de resposta do lojista: %s",
+		ErrInvalidDuplicateStatus: "duplicate_status_code deve ser 409 ou 200",
+		ErrIdempotencyKeyHeader:   "o cabeçalho Idempotency-Key é obrigatório",
+		ErrIdempotencyKeyConflict: "idempotency_key no corpo não corresponde ao cabeçalho Idempotency-Key",
+		ErrInvalidTolerantField:   "%s não pode ser um campo tolerado (permitidos: %s)",
+		ErrInvalidBaseCurrency:    "base_currency %q não é um código ISO 4217 de três letras",
+		ErrInvalidTimeRange:       "from e to devem ser datas RFC 3339, com from antes de to",
+		ErrResourceNotFound:       "recurso não encontrado",
+		ErrInvalidSort:            "sort deve ser um de: %s",
+		ErrInvalidTop:             "top deve ser um inteiro positivo",
+		ErrInvalidPage:            "limit deve estar entre 1 e %d e offset deve ser um inteiro não negativo",
+		ErrInvalidPaymentIDFormat: "payment_id_format %q deve conter exatamente um de <ulid>, <uuid> ou <nanos> e no máximo 32 letras, dígitos, _ ou -",
+		ErrInvalidDuplicateAlert:  "duplicate_alert_threshold deve ser positivo e duplicate_alert_url uma URL http(s) absoluta; defina ambos ou nenhum",
+		ErrMerchantNotOnboarded:   "o lojista não tem política; cadastre-a com PUT /v1/merchants/{id}/policy",
+		ErrQueueFull:              "a fila de processamento está cheia; tente novamente mais tarde",
+		ErrPaymentNotFound:        "pagamento não encontrado",
+		ErrConcurrentUpdate:       "o pagamento foi atualizado simultaneamente; repita a requisição",
+		ErrMissingPaymentID:       "payment_id é obrigatório",
+		ErrStoreFull:              "o armazenamento de chaves está cheio; tente novamente mais tarde",
+		ErrInvalidStoredResponse:  "response_status deve estar entre 200 e 599, e response_headers ter no máximo %d cabeçalhos válidos que não sejam hop-by-hop, Content-Length, Date, Content-Language, Retry-After ou Idempotency-*",
+		ErrRateLimited:            "muitas requisições de pagamento para este lojista; tente novamente mais tarde",
+		ErrInvalidRateLimit:       "rate_limit_rps deve ser positivo e rate_limit_burst um inteiro positivo, definido apenas com rate_limit_rps",
+		ErrInvalidBatch:           "um lote deve ter entre 1 e %d pagamentos",
+		ErrInvalidPolicyBatch:     "uma atualização em massa deve ter entre 1 e %d políticas",
+		ErrDuplicateMerchantID:    "merchant_id %s aparece mais de uma vez",
+		ErrInvalidKeyFilter:       "%s inválido: status deve ser processing, succeeded ou failed, os valores inteiros não negativos com min_amount até max_amount, e from e to timestamps RFC 3339 com from antes de to",
+		ErrKeyReserved:            "a chave de idempotência está reservada para outro lojista",
+		ErrKeyInUse:               "a chave de idempotência já é usada por um pagamento",
+		ErrTimeout:                "o armazenamento não respondeu a tempo; tente novamente com a mesma chave",
+		ErrLockTimeout:            "outra requisição com esta chave a reteve por tempo demais; tente novamente com a mesma chave",
+		ErrUnsupportedMediaType:   "o corpo da requisição deve ser application/json",
+		ErrBodyTooLarge:           "o corpo da requisição excede %d bytes",
+		ErrUnknownField:           "campo desconhecido %s",
+		ErrKeyThrottled:           "tentativas demais para esta chave de idempotência; aguarde os segundos de Retry-After",
+		ErrInvalidStormThreshold:  "storm_threshold deve ser um número positivo de tentativas",
+		ErrInvalidMismatch:        "mismatch_behavior %q deve ser reject, accept_latest ou accept_if_not_completed",
+		ErrDeadLetterNotFound:     "webhook não entregue não encontrado",
+		ErrWebhookDelivery:        "o endpoint do webhook não aceitou a entrega; ela continua como não entregue",
+		ErrInvalidDeadLetterID:    "o id do webhook não entregue deve ser um inteiro positivo",
+		ErrReplayTooLarge:         "o intervalo tem mais de %d webhooks; reenvie um intervalo menor",
+		ErrNothingToRestore:       "nenhuma ação administrativa nesta chave pode ser desfeita; o prazo pode ter passado",
+		ErrKeyReused:              "um pagamento usou esta chave depois da ação administrativa; restaurá-la sobrescreveria esse pagamento",
+	},
+	"es-MX": {
+		MsgPaymentAccepted:   "pago aceptado para procesamiento",
+		MsgExpiredKeyReused:  "clave expirada reutilizada, pago aceptado para procesamiento",
+		MsgAlreadyProcessing: "el pago ya se está procesando",
+		MsgAlreadySucceeded:  "el pago ya fue exitoso",
+		MsgRetryingFailed:    "el intento anterior falló, reintentando",
+		MsgReclaimedStale:    "el intento anterior excedió el tiempo de procesamiento, reintentando",
+		MsgPaymentFailed:     "el pago falló",
+		MsgParamsUpdated:     "parámetros del pago reemplazados por los de esta solicitud",
+
+		ErrMethodNotAllowed:       "método no permitido",
+		ErrInvalidJSON:            "cuerpo JSON inválido",
+		ErrMissingMerchantID:      "falta merchant_id",
+		ErrMissingIdempotencyKey:  "falta la clave de idempotencia",
+		ErrUnsupportedFormat:      "format debe ser json o pdf",
+		ErrPolicyNotFound:         "política del comercio no encontrada",
+		ErrInvalidRetryPolicy:     "retry_policy debe ser strict_no_retry, standard o lenient",
+		ErrInvalidExpiryHours:     "expiry_hours debe ser 24, 48 o 72",
+		ErrWebSocketRequired:      "se requiere actualizar a websocket",
+		ErrAdminDisabled:          "API de administración deshabilitada: ADMIN_TOKEN no configurado",
+		ErrSeedDisabled:           "no se pueden cargar datos de ejemplo cuando DEPLOY_ENV es prod",
+		ErrUnauthorized:           "no autorizado",
+		ErrInternal:               "error interno del servidor",
+		ErrFieldRequired:          "%s es obligatorio",
+		ErrFieldNonNegative:       "%s no puede ser negativo",
+		ErrFieldMax:               "%s debe ser como máximo %d",
+		ErrFieldPositive:          "%s debe ser positivo",
+		ErrFieldMin:               "%s debe ser como mínimo %d",
+		ErrFieldTooLong:           "%s debe tener como máximo %d caracteres",
+		ErrFieldCharset:           "%s debe contener solo ASCII imprimible",
+		ErrFieldTooLarge:          "%s debe tener como máximo %d bytes",
+		ErrFieldObject:            "%s debe ser un objeto JSON",
+		ErrUnsupportedCurrency:    "%s debe ser un código de moneda ISO 4217",
+		ErrInvalidExpiryHeader:    "Idempotency-Expiry debe ser un número positivo de horas, igual a expiry_hours cuando se envían ambos",
+		ErrInvalidMaxExpiryHours:  "max_expiry_hours debe ser un número positivo de horas",
+		ErrInvalidBucket:          "bucket debe ser un número entero de minutos (p. ej. 15m, 1h) que divida el período en como máximo %d intervalos",
+		ErrInvalidSignature:       "X-Signature falta o no coincide con el cuerpo de la solicitud",
+		ErrSignatureExpired:       "X-Signature-Timestamp falta o está a más de %d segundos de la hora del servidor",
+		ErrDuplicateProcessing:    "el pago ya se está procesando",
+		ErrParamsMismatch:         "los parámetros de la solicitud no coinciden con el pago original",
+		ErrAlreadyCompleted:       "el pago ya fue completado",
+		ErrKeyNotFound:            "clave de idempotencia no encontrada",
+		ErrKeyExpired:             "la clave de idempotencia expiró",
+		ErrInvalidStatus:          "estado inválido: debe ser 'succeeded' o 'failed'",
+		ErrMerchantNotFound:       "comercio no encontrado",
+		ErrUnavailable:            "servicio temporalmente no disponible",
+		ErrInvalidDate:            "date debe tener el formato AAAA-MM-DD",
+		ErrDigestNotFound:         "resumen no encontrado",
+		ErrDigestNotReady:         "el resumen solo está disponible para días ya concluidos (UTC)",
+		ErrInvalidTimeout:         "timeout debe ser una duración positiva de hasta %s, por ejemplo 30s",
+		ErrInvalidResponseSchema:  "response_schema no es un JSON Schema compatible: %s",
+		ErrResponseSchema:         "response_body no coincide con el schema de respuesta del comercio: %s",
+		ErrInvalidDuplicateStatus: "duplicate_status_code debe ser 409 o 200",
+		ErrIdempotencyKeyHeader:   "el encabezado Idempotency-Key es obligatorio",
+		ErrIdempotencyKeyConflict: "idempotency_key en el cuerpo no coincide con el encabezado Idempotency-Key",
+		ErrInvalidTolerantField:   "%s no puede ser un campo tolerado (permitidos: %s)",
+		ErrInvalidBaseCurrency:    "base_currency %q no es un código ISO 4217 de tres letras",
+		ErrInvalidTimeRange:       "from y to deben ser fechas RFC 3339, con from antes de to",
+		ErrResourceNotFound:       "recurso no encontrado",
+		ErrInvalidSort:            "sort debe ser uno de: %s",
+		ErrInvalidTop:             "top debe ser un entero positivo",
+		ErrInvalidPage:            "limit debe estar entre 1 y %d y offset debe ser un entero no negativo",
+		ErrInvalidPaymentIDFormat: "payment_id_format %q debe contener exactamente uno de <ulid>, <uuid> o <nanos> y como máximo 32 letras, dígitos, _ o -",
+		ErrInvalidDuplicateAlert:  "duplicate_alert_threshold debe ser positivo y duplicate_alert_url una URL http(s) absoluta; define ambos o ninguno",
+		ErrMerchantNotOnboarded:   "el comercio no tiene política; regístrela con PUT /v1/merchants/{id}/policy",
+		ErrQueueFull:              "la cola de procesamiento está llena; reintente más tarde",
+		ErrPaymentNotFound:        "pago no encontrado",
+		ErrConcurrentUpdate:       "el pago fue actualizado simultáneamente; reintenta la solicitud",
+		ErrMissingPaymentID:       "payment_id es obligatorio",
+		ErrStoreFull:              "el almacén de claves está lleno; reintente más tarde",
+		ErrInvalidStoredResponse:  "response_status debe estar entre 200 y 599, y response_headers tener como máximo %d encabezados válidos que no sean hop-by-hop, Content-Length, Date, Content-Language, Retry-After ni Idempotency-*",
+		ErrRateLimited:            "demasiadas solicitudes de pago para este comercio; reintente más tarde",
+		ErrInvalidRateLimit:       "rate_limit_rps debe ser positivo y rate_limit_burst un entero positivo, definido solo con rate_limit_rps",
+		ErrInvalidBatch:           "un lote debe tener entre 1 y %d pagos",
+		ErrInvalidPolicyBatch:     "una actualización masiva debe tener entre 1 y %d políticas",
+		ErrDuplicateMerchantID:    "merchant_id %s aparece más de una vez",
+		ErrInvalidKeyFilter:       "%s inválido: status debe ser processing, succeeded o failed, los montos enteros no negativos con min_amount hasta max_amount, y from y to marcas de tiempo RFC 3339 con from antes de to",
+		ErrKeyReserved:            "la clave de idempotencia está reservada para otro comercio",
+		ErrKeyInUse:               "la clave de idempotencia ya la usa un pago",
+		ErrTimeout:                "el almacenamiento no respondió a tiempo; reintente con la misma clave",
+		ErrLockTimeout:            "otra solicitud con esta clave la retuvo demasiado tiempo; reintente con la misma clave",
+		ErrUnsupportedMediaType:   "el cuerpo de la solicitud debe ser application/json",
+		ErrBodyTooLarge:           "el cuerpo de la solicitud supera %d bytes",
+		ErrUnknownField:           "campo desconocido %s",
+		ErrKeyThrottled:           "demasiados intentos para esta clave de idempotencia; espere los segundos de Retry-After",
+		ErrInvalidStormThreshold:  "storm_threshold debe ser un número positivo de intentos",
+		ErrInvalidMismatch:        "mismatch_behavior %q debe ser reject, accept_latest o accept_if_not_completed",
+		ErrDeadLetterNotFound:     "webhook no entregado no encontrado",
+		ErrWebhookDelivery:        "el endpoint del webhook no aceptó la entrega; sigue como no entregado",
+		ErrInvalidDeadLetterID:    "el id del webhook no entregado debe ser un entero positivo",
+		ErrReplayTooLarge:         "el rango tiene más de %d webhooks; reenvíe un rango más corto",
+		ErrNothingToRestore:       "ninguna acción administrativa en esta clave se puede deshacer; el plazo puede haber pasado",
+		ErrKeyReused:              "un pago usó esta clave después de la acción administrativa; restaurarla sobrescribiría ese pago",
+	},
+}
+
+// Message returns the text for code in lang, falling back to English and
+// then to the code itself. Args fill placeholders such as the field name.
+func Message(lang string, code Code, args ...interface{}) string {
+	text, ok := catalog[lang][code]
+	if !ok {
+		text, ok = catalog[DefaultLanguage][code]
+	}
+	if !ok {
+		return string(code)
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// Negotiate picks the best supported language from an Accept-Language header.
+// A bare primary tag ("pt", "es") matches the regional catalog we ship.
+func Negotiate(header string) string {
+	type candidate struct {
+		tag string
+		q   float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{tag, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if lang, ok := match(c.tag); ok {
+			return lang
+		}
+	}
+	return DefaultLanguage
+}
+
+func match(tag string) (string, bool) {
+	primary, _, _ := strings.Cut(tag, "-")
+	for lang := range catalog {
+		if strings.EqualFold(lang, tag) {
+			return lang, true
+		}
+	}
+	for lang := range catalog {
+		p, _, _ := strings.Cut(lang, "-")
+		if strings.EqualFold(p, primary) {
+			return lang, true
+		}
+	}
+	return "", false
+}
+
+// ForError maps a domain error to its message code and placeholder args.
+// Errors without a code report ok=false so callers can keep the raw text.
+func ForError(err error) (code Code, args []interface{}, ok bool) {
+	var serr *domain.ResponseSchemaError
+	if errors.As(err, &serr) {
+		return ErrResponseSchema, []interface{}{strings.Join(serr.Problems, "; ")}, true
+	}
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		switch verr.Rule {
+		case "non_negative":
+			return ErrFieldNonNegative, []interface{}{verr.Field}, true
+		case "positive":
+			return ErrFieldPositive, []interface{}{verr.Field}, true
+		case "min":
+			return ErrFieldMin, []interface{}{verr.Field, verr.Min}, true
+		case "max":
+			return ErrFieldMax, []interface{}{verr.Field, verr.Max}, true
+		case "max_length":
+			return ErrFieldTooLong, []interface{}{verr.Field, verr.Max}, true
+		case "charset":
+			return ErrFieldCharset, []interface{}{verr.Field}, true
+		case "max_size":
+			return ErrFieldTooLarge, []interface{}{verr.Field, verr.Max}, true
+		case "object":
+			return ErrFieldObject, []interface{}{verr.Field}, true
+		case "currency":
+			return ErrUnsupportedCurrency, []interface{}{verr.Field}, true
+		}
+		return ErrFieldRequired, []interface{}{verr.Field}, true
+	}
+	// ErrQueueFull and ErrStoreFull also match ErrUnavailable; report the
+	// specific code.
+	if errors.Is(err, domain.ErrQueueFull) {
+		return ErrQueueFull, nil, true
+	}
+	if errors.Is(err, domain.ErrStoreFull) {
+		return ErrStoreFull, nil, true
+	}
+	// ErrLockTimeout also matches ErrTimeout.
+	if errors.Is(err, domain.ErrLockTimeout) {
+		return ErrLockTimeout, nil, true
+	}
+	if errors.Is(err, domain.ErrInvalidStoredResponse) {
+		return ErrInvalidStoredResponse, []interface{}{domain.MaxStoredHeaders}, true
+	}
+	for target, code := range errorCodes {
+		if errors.Is(err, target) {
+			return code, nil, true
+		}
+	}
+	return "", nil, false
+}
+
+var errorCodes = map[error]Code{
+	domain.ErrDuplicateProcessing:  ErrDuplicateProcessing,
+	domain.ErrParamsMismatch:       ErrParamsMismatch,
+	domain.ErrAlreadyCompleted:     ErrAlreadyCompleted,
+	domain.ErrKeyNotFound:          ErrKeyNotFound,
+	domain.ErrPaymentNotFound:      ErrPaymentNotFound,
+	domain.ErrConcurrentUpdate:     ErrConcurrentUpdate,
+	domain.ErrKeyExpired:           ErrKeyExpired,
+	domain.ErrInvalidStatus:        ErrInvalidStatus,
+	domain.ErrMerchantNotFound:     ErrMerchantNotFound,
+	domain.ErrMerchantNotOnboarded: ErrMerchantNotOnboarded,
+	domain.ErrUnavailable:          ErrUnavailable,
+	domain.ErrDigestNotFound:       ErrDigestNotFound,
+	domain.ErrDigestNotReady:       ErrDigestNotReady,
+	domain.ErrKeyReserved:          ErrKeyReserved,
+	domain.ErrKeyInUse:             ErrKeyInUse,
+	domain.ErrTimeout:              ErrTimeout,
+	domain.ErrDeadLetterNotFound:   ErrDeadLetterNotFound,
+	domain.ErrWebhookDelivery:      ErrWebhookDelivery,
+	domain.ErrNothingToRestore:     ErrNothingToRestore,
+	domain.ErrKeyReused:            ErrKeyReused,
+}
@@ -0,0 +1,75 @@
+package i18n
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                        "en",
+		"pt-BR":                   "pt-BR",
+		"pt":                      "pt-BR",
+		"es-AR,es;q=0.9":          "es-MX",
+		"fr-FR,es-MX;q=0.5":       "es-MX",
+		"en-US,pt-BR;q=0.9":       "en",
+		"pt-BR;q=0.2,es-MX;q=0.8": "es-MX",
+		"de,fr;q=0.5":             "en",
+		"pt-BR;q=0,es-MX;q=0.1":   "es-MX",
+	}
+	for header, want := range cases {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestMessage_Fallbacks(t *testing.T) {
+	if got := Message("pt-BR", MsgAlreadySucceeded); got != "o pagamento já foi concluído com sucesso" {
+		t.Errorf("unexpected pt-BR message: %q", got)
+	}
+	if got := Message("fr", MsgAlreadySucceeded); got != "payment already succeeded" {
+		t.Errorf("expected English fallback, got %q", got)
+	}
+	if got := Message("en", Code("no_such_code")); got != "no_such_code" {
+		t.Errorf("expected code fallback, got %q", got)
+	}
+	if got := Message("es-MX", ErrFieldRequired, "currency"); got != "currency es obligatorio" {
+		t.Errorf("unexpected formatted message: %q", got)
+	}
+}
+
+func TestCatalogsComplete(t *testing.T) {
+	for lang, messages := range catalog {
+		for code := range catalog[DefaultLanguage] {
+			if _, ok := messages[code]; !ok {
+				t.Errorf("%s catalog missing %s", lang, code)
+			}
+		}
+	}
+}
+
+func TestForError(t *testing.T) {
+	code, _, ok := ForError(fmt.Errorf("insert: %w", domain.ErrUnavailable))
+	if !ok || code != ErrUnavailable {
+		t.Errorf("expected %s, got %s (ok=%v)", ErrUnavailable, code, ok)
+	}
+
+	code, args, ok := ForError(&domain.ValidationError{Field: "amount", Rule: "non_negative"})
+	if !ok || code != ErrFieldNonNegative || len(args) != 1 || args[0] != "amount" {
+		t.Errorf("unexpected validation mapping: %s %v", code, args)
+	}
+
+	if code, _, _ := ForError(fmt.Errorf("advisory lock: %w", domain.ErrLockTimeout)); code != ErrLockTimeout {
+		t.Errorf("expected %s, got %s", ErrLockTimeout, code)
+	}
+	if code, _, _ := ForError(fmt.Errorf("get by key: %w", domain.ErrTimeout)); code != ErrTimeout {
+		t.Errorf("expected %s, got %s", ErrTimeout, code)
+	}
+
+	if _, _, ok := ForError(fmt.Errorf("boom")); ok {
+		t.Error("unknown errors should not have a code")
+	}
+}
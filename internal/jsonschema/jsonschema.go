@@ -0,0 +1,379 @@
+// Package jsonschema validates JSON documents against the subset of JSON
+// Schema merchants use to describe gateway responses: type, enum, const,
+// properties, required, additionalProperties, items, string/number/array
+// bounds, pattern, and allOf/anyOf/oneOf. References ($ref) are rejected at
+// compile time rather than silently ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	always *bool // boolean schema: true accepts everything, false nothing
+
+	types       []string
+	enum        []interface{}
+	constVal    interface{}
+	hasConst    bool
+	properties  map[string]*Schema
+	required    []string
+	additional  *Schema
+	items       *Schema
+	minLength   *int
+	maxLength   *int
+	pattern     *regexp.Regexp
+	minimum     *float64
+	maximum     *float64
+	exclMinimum *float64
+	exclMaximum *float64
+	minItems    *int
+	maxItems    *int
+	allOf       []*Schema
+	anyOf       []*Schema
+	oneOf       []*Schema
+}
+
+var validTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// Compile parses a JSON Schema document.
+func Compile(raw []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	return compile(doc, "#")
+}
+
+func compile(doc interface{}, path string) (*Schema, error) {
+	if b, ok := doc.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or boolean", path)
+	}
+	if _, ok := m["$ref"]; ok {
+		return nil, fmt.Errorf("%s: $ref is not supported", path)
+	}
+
+	s := &Schema{}
+	var err error
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: entries must be strings", path)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s/type: must be a string or array", path)
+	}
+	for _, t := range s.types {
+		if !validTypes[t] {
+			return nil, fmt.Errorf("%s/type: unknown type %q", path, t)
+		}
+	}
+
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return nil, fmt.Errorf("%s/enum: must be an array", path)
+		}
+	}
+	if v, ok := m["const"]; ok {
+		s.constVal, s.hasConst = v, true
+	}
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be an object", path)
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = compile(sub, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["required"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be an array", path)
+		}
+		for _, r := range list {
+			name, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: entries must be strings", path)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if v, ok := m["additionalProperties"]; ok {
+		if s.additional, err = compile(v, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := m["items"]; ok {
+		if s.items, err = compile(v, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.minLength, err = intKeyword(m, "minLength", path); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = intKeyword(m, "maxLength", path); err != nil {
+		return nil, err
+	}
+	if s.minItems, err = intKeyword(m, "minItems", path); err != nil {
+		return nil, err
+	}
+	if s.maxItems, err = intKeyword(m, "maxItems", path); err != nil {
+		return nil, err
+	}
+	if s.minimum, err = numberKeyword(m, "minimum", path); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = numberKeyword(m, "maximum", path); err != nil {
+		return nil, err
+	}
+	if s.exclMinimum, err = numberKeyword(m, "exclusiveMinimum", path); err != nil {
+		return nil, err
+	}
+	if s.exclMaximum, err = numberKeyword(m, "exclusiveMaximum", path); err != nil {
+		return nil, err
+	}
+
+	if v, ok := m["pattern"]; ok {
+		p, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be a string", path)
+		}
+		if s.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %w", path, err)
+		}
+	}
+
+	for _, kw := range []struct {
+		name string
+		dst  *[]*Schema
+	}{{"allOf", &s.allOf}, {"anyOf", &s.anyOf}, {"oneOf", &s.oneOf}} {
+		v, ok := m[kw.name]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%s/%s: must be a non-empty array", path, kw.name)
+		}
+		for i, sub := range list {
+			c, err := compile(sub, fmt.Sprintf("%s/%s/%d", path, kw.name, i))
+			if err != nil {
+				return nil, err
+			}
+			*kw.dst = append(*kw.dst, c)
+		}
+	}
+	return s, nil
+}
+
+func intKeyword(m map[string]interface{}, name, path string) (*int, error) {
+	v, ok := m[name]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, fmt.Errorf("%s/%s: must be a non-negative integer", path, name)
+	}
+	n := int(f)
+	return &n, nil
+}
+
+func numberKeyword(m map[string]interface{}, name, path string) (*float64, error) {
+	v, ok := m[name]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: must be a number", path, name)
+	}
+	return &f, nil
+}
+
+// ValidateJSON decodes raw and validates it, returning one message per
+// violation. A nil result means the document is valid.
+func (s *Schema) ValidateJSON(raw []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return []string{"document is not valid JSON"}
+	}
+	return s.Validate(v)
+}
+
+// Validate checks a decoded JSON value (as produced by encoding/json into an
+// interface{}) and returns one message per violation.
+func (s *Schema) Validate(v interface{}) []string {
+	var problems []string
+	s.validate(v, "$", &problems)
+	return problems
+}
+
+func (s *Schema) validate(v interface{}, path string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("no value is allowed here")
+		}
+		return
+	}
+
+	if len(s.types) > 0 && !matchesAnyType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		return
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		fail("value is not one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constVal, v) {
+		fail("value does not match the required constant")
+	}
+
+	switch val := v.(type) {
+	case string:
+		n := len([]rune(val))
+		if s.minLength != nil && n < *s.minLength {
+			fail("shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("does not match pattern %s", s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && val > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclMinimum != nil && val <= *s.exclMinimum {
+			fail("must be > %v", *s.exclMinimum)
+		}
+		if s.exclMaximum != nil && val >= *s.exclMaximum {
+			fail("must be < %v", *s.exclMaximum)
+		}
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range val {
+				s.items.validate(item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if sub, ok := s.properties[name]; ok {
+				sub.validate(val[name], path+"."+name, problems)
+			} else if s.additional != nil {
+				s.additional.validate(val[name], path+"."+name, problems)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, problems)
+	}
+	if len(s.anyOf) > 0 && countMatches(s.anyOf, v) == 0 {
+		fail("does not match any of the allowed schemas")
+	}
+	if len(s.oneOf) > 0 && countMatches(s.oneOf, v) != 1 {
+		fail("must match exactly one of the allowed schemas")
+	}
+}
+
+func countMatches(schemas []*Schema, v interface{}) int {
+	n := 0
+	for _, sub := range schemas {
+		if len(sub.Validate(v)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func matchesAnyType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
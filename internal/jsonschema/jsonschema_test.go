@@ -0,0 +1,81 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+const gatewaySchema = `{
+	"type": "object",
+	"required": ["transaction_id", "amount"],
+	"properties": {
+		"transaction_id": {"type": "string", "pattern": "^tx_", "minLength": 4},
+		"amount": {"type": "integer", "minimum": 0},
+		"status": {"enum": ["approved", "captured"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	},
+	"additionalProperties": false
+}`
+
+func TestValidate_Valid(t *testing.T) {
+	s, err := Compile([]byte(gatewaySchema))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	doc := `{"transaction_id": "tx_123", "amount": 5000, "status": "approved", "tags": ["a"]}`
+	if problems := s.ValidateJSON([]byte(doc)); len(problems) != 0 {
+		t.Errorf("expected valid, got %v", problems)
+	}
+}
+
+func TestValidate_Violations(t *testing.T) {
+	s, _ := Compile([]byte(gatewaySchema))
+	cases := map[string]string{
+		`{"amount": 1}`: `missing required property "transaction_id"`,
+		`{"transaction_id": "abc_1", "amount": 1}`:               "does not match pattern",
+		`{"transaction_id": "tx_1", "amount": 1.5}`:              "expected integer, got number",
+		`{"transaction_id": "tx_1", "amount": -1}`:               "must be >= 0",
+		`{"transaction_id": "tx_1", "amount": 1, "status": "x"}`: "not one of the allowed values",
+		`{"transaction_id": "tx_1", "amount": 1, "extra": true}`: "$.extra: no value is allowed here",
+		`{"transaction_id": "tx_1", "amount": 1, "tags": [1]}`:   "$.tags[0]: expected string",
+		`[]`:       "expected object, got array",
+		`not json`: "not valid JSON",
+	}
+	for doc, want := range cases {
+		problems := s.ValidateJSON([]byte(doc))
+		if !strings.Contains(strings.Join(problems, "|"), want) {
+			t.Errorf("%s: expected %q in %v", doc, want, problems)
+		}
+	}
+}
+
+func TestValidate_Combinators(t *testing.T) {
+	s, err := Compile([]byte(`{"oneOf": [{"type": "string"}, {"type": "integer"}], "anyOf": [{"const": "ok"}, {"minimum": 10}]}`))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if p := s.Validate("ok"); len(p) != 0 {
+		t.Errorf("expected valid, got %v", p)
+	}
+	if p := s.Validate(3.0); len(p) == 0 {
+		t.Error("expected anyOf violation for 3")
+	}
+	if p := s.Validate(true); len(p) == 0 {
+		t.Error("expected oneOf violation for boolean")
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for _, raw := range []string{
+		`{"$ref": "#/definitions/x"}`,
+		`{"type": "money"}`,
+		`{"pattern": "("}`,
+		`{"minLength": -1}`,
+		`"string"`,
+		`{`,
+	} {
+		if _, err := Compile([]byte(raw)); err == nil {
+			t.Errorf("expected compile error for %s", raw)
+		}
+	}
+}
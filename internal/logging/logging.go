@@ -0,0 +1,269 @@
+// Package logging carries per-request correlation fields through a context so
+// log lines and errors from every layer can be tied back to one request.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+type ctxKey struct{}
+
+// Level is a log severity. The zero value is LevelInfo.
+type Level int
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Level returns l itself, so a fixed Level is a Leveler.
+func (l Level) Level() Level { return l }
+
+// Leveler reports a minimum level that may change while the server runs.
+type Leveler interface {
+	Level() Level
+}
+
+// LevelVar is a Level that can be changed while it is read. The zero value
+// is LevelInfo.
+type LevelVar struct {
+	v atomic.Int64
+}
+
+// Level returns the current level.
+func (v *LevelVar) Level() Level { return Level(v.v.Load()) }
+
+// Set changes the level.
+func (v *LevelVar) Set(l Level) { v.v.Store(int64(l)) }
+
+// ParseLevel parses debug, info, warn or error, case-insensitively.
+func ParseLevel(s string) (Level, bool) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Output formats accepted by Setup.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	// structured writes JSON records when set; nil writes text lines
+	// through the standard log package.
+	structured *slog.Logger
+	// defaultLevel is the minimum level logged outside a request.
+	defaultLevel LevelVar
+)
+
+// Setup sets the output format and the level logged outside requests. JSON
+// output also routes the standard log package through the same handler, so
+// plain log.Printf lines become JSON records at info level. Call it once,
+// before logging starts.
+func Setup(format string, level Level, w io.Writer) error {
+	switch format {
+	case FormatText:
+		structured = nil
+	case FormatJSON:
+		// Levels are checked by Logger.Enabled, so that X-Log-Level can
+		// lower them per request.
+		structured = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		slog.SetDefault(structured)
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+	defaultLevel.Set(level)
+	return nil
+}
+
+// DefaultLevel is the level logged outside requests, set by Setup. Changing
+// it takes effect on the next line logged.
+func DefaultLevel() *LevelVar {
+	return &defaultLevel
+}
+
+// slogLevels maps levels to their slog equivalents.
+var slogLevels = map[Level]slog.Level{
+	LevelDebug: slog.LevelDebug,
+	LevelInfo:  slog.LevelInfo,
+	LevelWarn:  slog.LevelWarn,
+	LevelError: slog.LevelError,
+}
+
+// Fields are the correlation identifiers attached to a request, plus the
+// minimum level logged for it.
+// The idempotency key is never stored in clear, only its hash.
+type Fields struct {
+	RequestID  string
+	Route      string
+	MerchantID string
+	KeyHash    string
+	PaymentID  string
+	Level      Level
+}
+
+// String renders the non-empty fields as space-separated key=value pairs.
+func (f *Fields) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	add := func(k, v string) {
+		if v != "" {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	add("request_id", f.RequestID)
+	add("route", f.Route)
+	add("merchant_id", f.MerchantID)
+	add("key_hash", f.KeyHash)
+	add("payment_id", f.PaymentID)
+	return strings.Join(parts, " ")
+}
+
+// attrs returns the non-empty fields as structured attributes.
+func (f *Fields) attrs() []slog.Attr {
+	if f == nil {
+		return nil
+	}
+	var attrs []slog.Attr
+	add := func(k, v string) {
+		if v != "" {
+			attrs = append(attrs, slog.String(k, v))
+		}
+	}
+	add("request_id", f.RequestID)
+	add("route", f.Route)
+	add("merchant_id", f.MerchantID)
+	add("key_hash", f.KeyHash)
+	add("payment_id", f.PaymentID)
+	return attrs
+}
+
+// NewContext returns a context carrying mutable Fields, reusing the ones
+// already present so that outer middleware sees what inner layers fill in.
+func NewContext(ctx context.Context) (context.Context, *Fields) {
+	if f, ok := ctx.Value(ctxKey{}).(*Fields); ok {
+		return ctx, f
+	}
+	f := &Fields{}
+	return context.WithValue(ctx, ctxKey{}, f), f
+}
+
+// CopyContext returns ctx carrying a copy of its Fields, so concurrent work
+// for one request can fill in its own merchant, key and payment.
+func CopyContext(ctx context.Context) context.Context {
+	f := &Fields{}
+	if parent := FromContext(ctx); parent != nil {
+		*f = *parent
+	}
+	return context.WithValue(ctx, ctxKey{}, f)
+}
+
+// FromContext returns the Fields carried by ctx, or nil if there are none.
+func FromContext(ctx context.Context) *Fields {
+	f, _ := ctx.Value(ctxKey{}).(*Fields)
+	return f
+}
+
+// HashKey returns a short, stable digest of an idempotency key for logging.
+func HashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%x", h[:6])
+}
+
+// Logger writes leveled log lines annotated with a request's fields.
+type Logger struct {
+	fields *Fields
+	attrs  []slog.Attr
+}
+
+// From returns the logger for the request carried by ctx. Outside a request
+// it logs at info level without fields.
+func From(ctx context.Context) Logger {
+	return Logger{fields: FromContext(ctx)}
+}
+
+// With returns a logger that adds attrs to JSON records. Text lines omit
+// them, so the message must still say what a reader needs.
+func (lg Logger) With(attrs ...slog.Attr) Logger {
+	lg.attrs = append(append([]slog.Attr(nil), lg.attrs...), attrs...)
+	return lg
+}
+
+// Enabled reports whether the logger writes lines at level l.
+func (lg Logger) Enabled(l Level) bool {
+	if lg.fields == nil {
+		return l >= defaultLevel.Level()
+	}
+	return l >= lg.fields.Level
+}
+
+func (lg Logger) logf(l Level, format string, args ...interface{}) {
+	if !lg.Enabled(l) {
+		return
+	}
+	if structured != nil {
+		attrs := append(lg.fields.attrs(), lg.attrs...)
+		structured.LogAttrs(context.Background(), slogLevels[l], fmt.Sprintf(format, args...), attrs...)
+		return
+	}
+	msg := strings.ToUpper(l.String()) + " " + fmt.Sprintf(format, args...)
+	if s := lg.fields.String(); s != "" {
+		msg += " [" + s + "]"
+	}
+	log.Print(msg)
+}
+
+// Debugf logs detail useful when tracing a single request.
+func (lg Logger) Debugf(format string, args ...interface{}) { lg.logf(LevelDebug, format, args...) }
+
+// Infof logs normal operation.
+func (lg Logger) Infof(format string, args ...interface{}) { lg.logf(LevelInfo, format, args...) }
+
+// Warnf logs a degraded but handled condition.
+func (lg Logger) Warnf(format string, args ...interface{}) { lg.logf(LevelWarn, format, args...) }
+
+// Errorf logs a failure the caller could not handle.
+func (lg Logger) Errorf(format string, args ...interface{}) { lg.logf(LevelError, format, args...) }
+
+// Printf logs a message at info level followed by the correlation fields of ctx.
+func Printf(ctx context.Context, format string, args ...interface{}) {
+	From(ctx).Infof(format, args...)
+}
+
+// Wrap annotates err with the operation name and the correlation fields of ctx.
+// It returns nil if err is nil.
+func Wrap(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if s := FromContext(ctx).String(); s != "" {
+		return fmt.Errorf("%s [%s]: %w", op, s, err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,167 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewContext_ReusesFields(t *testing.T) {
+	ctx, f1 := NewContext(context.Background())
+	f1.RequestID = "req-1"
+
+	ctx2, f2 := NewContext(ctx)
+	if f1 != f2 {
+		t.Fatal("expected NewContext to reuse existing fields")
+	}
+	if FromContext(ctx2).RequestID != "req-1" {
+		t.Errorf("expected req-1, got %s", FromContext(ctx2).RequestID)
+	}
+}
+
+func TestFromContext_Empty(t *testing.T) {
+	if f := FromContext(context.Background()); f != nil {
+		t.Errorf("expected nil fields, got %+v", f)
+	}
+	if s := FromContext(context.Background()).String(); s != "" {
+		t.Errorf("expected empty string, got %q", s)
+	}
+}
+
+func TestFields_String(t *testing.T) {
+	f := &Fields{RequestID: "req-1", MerchantID: "m1", PaymentID: "pay_1"}
+	want := "request_id=req-1 merchant_id=m1 payment_id=pay_1"
+	if f.String() != want {
+		t.Errorf("expected %q, got %q", want, f.String())
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	h1 := HashKey("secret-key")
+	h2 := HashKey("secret-key")
+	if h1 != h2 {
+		t.Errorf("hash not deterministic: %s vs %s", h1, h2)
+	}
+	if strings.Contains(h1, "secret") {
+		t.Error("hash must not contain the raw key")
+	}
+	if HashKey("other-key") == h1 {
+		t.Error("different keys should hash differently")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	base := errors.New("boom")
+
+	if Wrap(context.Background(), "op", nil) != nil {
+		t.Error("expected nil for nil error")
+	}
+
+	err := Wrap(context.Background(), "upsert", base)
+	if err.Error() != "upsert: boom" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, f := NewContext(context.Background())
+	f.MerchantID = "m1"
+	err = Wrap(ctx, "upsert", base)
+	if err.Error() != "upsert [merchant_id=m1]: boom" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !errors.Is(err, base) {
+		t.Error("wrapped error should unwrap to base")
+	}
+}
+
+func TestPrintf_IncludesFields(t *testing.T) {
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(orig)
+
+	ctx, f := NewContext(context.Background())
+	f.RequestID = "req-42"
+	Printf(ctx, "hello %d", 1)
+
+	if !strings.Contains(buf.String(), "hello 1 [request_id=req-42]") {
+		t.Errorf("unexpected log output: %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, ok := ParseLevel("WARN"); !ok || l != LevelWarn {
+		t.Errorf("expected warn, got %v %v", l, ok)
+	}
+	if _, ok := ParseLevel("verbose"); ok {
+		t.Error("expected verbose to be rejected")
+	}
+}
+
+func TestLogger_RespectsRequestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(orig)
+
+	ctx, f := NewContext(context.Background())
+	f.Route = "GET /v1/payments/"
+	From(ctx).Debugf("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("expected debug dropped at info level, got %q", buf.String())
+	}
+
+	f.Level = LevelDebug
+	From(ctx).Debugf("shown")
+	if !strings.Contains(buf.String(), "DEBUG shown [route=GET /v1/payments/]") {
+		t.Errorf("unexpected log output: %q", buf.String())
+	}
+
+	buf.Reset()
+	From(context.Background()).Debugf("no request")
+	From(context.Background()).Warnf("careful")
+	if buf.String() == "" || strings.Contains(buf.String(), "no request") {
+		t.Errorf("expected only the warning outside a request, got %q", buf.String())
+	}
+}
+
+func TestSetup_JSON(t *testing.T) {
+	origLog, origSlog := log.Writer(), slog.Default()
+	defer func() {
+		Setup(FormatText, LevelInfo, nil)
+		slog.SetDefault(origSlog)
+		log.SetOutput(origLog)
+	}()
+
+	var buf bytes.Buffer
+	if err := Setup(FormatJSON, LevelWarn, &buf); err != nil {
+		t.Fatal(err)
+	}
+	ctx, f := NewContext(context.Background())
+	f.RequestID, f.MerchantID, f.KeyHash = "req-1", "m1", HashKey("k1")
+	From(ctx).With(slog.Int("status", 201)).Infof("created %s", "pay_1")
+	From(context.Background()).Infof("below the default level")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", buf.String(), err)
+	}
+	if rec["level"] != "INFO" || rec["msg"] != "created pay_1" || rec["request_id"] != "req-1" ||
+		rec["merchant_id"] != "m1" || rec["key_hash"] != HashKey("k1") || rec["status"] != float64(201) {
+		t.Errorf("unexpected record: %v", rec)
+	}
+
+	buf.Reset()
+	log.Printf("plain %d", 1)
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil || rec["msg"] != "plain 1" {
+		t.Errorf("expected log.Printf as a JSON record, got %q", buf.String())
+	}
+
+	if err := Setup("xml", LevelInfo, &buf); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -1,9 +1,12 @@
 package monitor
 
+import "time"
+
 // AnomalyDetector checks if duplicate rates exceed thresholds.
 type AnomalyDetector struct {
 	metrics   *Metrics
 	threshold float64 // percentage
+	window    time.Duration
 }
 
 // NewAnomalyDetector creates a detector with the given threshold.
@@ -11,20 +14,40 @@ func NewAnomalyDetector(metrics *Metrics, threshold float64) *AnomalyDetector {
 	return &AnomalyDetector{metrics: metrics, threshold: threshold}
 }
 
+// WithWindow makes the detector judge the duplicate rate over its own window
+// instead of the metrics window.
+func (d *AnomalyDetector) WithWindow(window time.Duration) *AnomalyDetector {
+	d.window = clampWindow(window)
+	d.metrics.mu.Lock()
+	d.metrics.retain(d.window)
+	d.metrics.mu.Unlock()
+	return d
+}
+
+// windowRate returns the requests, duplicates and duplicate rate the
+// detector judges.
+func (d *AnomalyDetector) windowRate() (int, int, float64) {
+	if d.window == 0 {
+		snap := d.metrics.Snapshot()
+		return snap.WindowRequests, snap.WindowDuplicates, snap.WindowDupRate
+	}
+	return d.metrics.duplicateRate(d.window)
+}
+
 // IsAnomalous returns true if the current sliding-window duplicate rate exceeds the threshold.
 func (d *AnomalyDetector) IsAnomalous() bool {
-	snap := d.metrics.Snapshot()
-	return snap.WindowDupRate > d.threshold
+	_, _, rate := d.windowRate()
+	return rate > d.threshold
 }
 
 // Report returns the current anomaly state.
 func (d *AnomalyDetector) Report() map[string]interface{} {
-	snap := d.metrics.Snapshot()
+	reqs, dups, rate := d.windowRate()
 	return map[string]interface{}{
-		"anomaly_detected":    snap.WindowDupRate > d.threshold,
-		"current_rate":        snap.WindowDupRate,
+		"anomaly_detected":    rate > d.threshold,
+		"current_rate":        rate,
 		"threshold":           d.threshold,
-		"window_requests":     snap.WindowRequests,
-		"window_duplicates":   snap.WindowDuplicates,
+		"window_requests":     reqs,
+		"window_duplicates":   dups,
 	}
 }
@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"testing"
+	"time"
 )
 
 func TestAnomalyDetector_NotAnomalous(t *testing.T) {
@@ -67,3 +68,23 @@ func TestAnomalyDetector_EmptyMetrics(t *testing.T) {
 		t.Error("empty report should not detect anomaly")
 	}
 }
+
+func TestAnomalyDetector_OwnWindow(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMetrics()
+	m.now = func() time.Time { return now }
+	d := NewAnomalyDetector(m, 20.0).WithWindow(time.Hour)
+
+	for i := 0; i < 5; i++ {
+		m.RecordDuplicate()
+	}
+	now = now.Add(10 * time.Minute)
+	m.RecordNew()
+
+	if m.Snapshot().WindowDupRate != 0 {
+		t.Error("the 5m metrics window should only see the new payment")
+	}
+	if !d.IsAnomalous() {
+		t.Error("the detector's 1h window should still see the duplicates")
+	}
+}
@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxAnomalyEpisodes is how many episodes an AnomalyLog keeps.
+const maxAnomalyEpisodes = 10
+
+// AnomalyEpisode is a stretch of time the duplicate rate stayed anomalous.
+// End is nil while the episode is ongoing.
+type AnomalyEpisode struct {
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	PeakRate float64    `json:"peak_duplicate_rate"`
+}
+
+// AnomalyLog samples the metrics' anomaly flag and remembers the most
+// recent episodes, so an incident can be reconstructed after the rate has
+// recovered.
+type AnomalyLog struct {
+	mu       sync.Mutex
+	metrics  *Metrics
+	interval time.Duration
+	episodes []AnomalyEpisode
+	open     bool
+	now      func() time.Time
+}
+
+// NewAnomalyLog creates an AnomalyLog sampling metrics every interval.
+func NewAnomalyLog(metrics *Metrics, interval time.Duration) *AnomalyLog {
+	return &AnomalyLog{metrics: metrics, interval: interval, now: time.Now}
+}
+
+// Run samples on every tick until ctx is done.
+func (l *AnomalyLog) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Sample()
+		}
+	}
+}
+
+// Sample opens, extends or closes the current episode.
+func (l *AnomalyLog) Sample() {
+	snap := l.metrics.Snapshot()
+	now := l.now().UTC()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case snap.AnomalyDetected && !l.open:
+		l.episodes = append(l.episodes, AnomalyEpisode{Start: now, PeakRate: snap.WindowDupRate})
+		if len(l.episodes) > maxAnomalyEpisodes {
+			l.episodes = l.episodes[1:]
+		}
+		l.open = true
+	case snap.AnomalyDetected:
+		if cur := &l.episodes[len(l.episodes)-1]; snap.WindowDupRate > cur.PeakRate {
+			cur.PeakRate = snap.WindowDupRate
+		}
+	case l.open:
+		l.episodes[len(l.episodes)-1].End = &now
+		l.open = false
+	}
+}
+
+// Recent returns the remembered episodes, newest first.
+func (l *AnomalyLog) Recent() []AnomalyEpisode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]AnomalyEpisode, len(l.episodes))
+	for i, e := range l.episodes {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
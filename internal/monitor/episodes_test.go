@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalyLog_RecordsEpisodes(t *testing.T) {
+	m := NewMetrics()
+	l := NewAnomalyLog(m, time.Second)
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return clock }
+
+	m.RecordNew()
+	l.Sample()
+	if got := l.Recent(); len(got) != 0 {
+		t.Fatalf("expected no episodes at 0%%, got %+v", got)
+	}
+
+	m.RecordDuplicate() // 50%
+	l.Sample()
+	clock = clock.Add(time.Minute)
+	m.RecordDuplicate() // 67%
+	l.Sample()
+	got := l.Recent()
+	if len(got) != 1 || got[0].End != nil || got[0].PeakRate < 66 {
+		t.Fatalf("expected one ongoing episode peaking near 67%%, got %+v", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		m.RecordNew()
+	}
+	clock = clock.Add(time.Minute)
+	l.Sample()
+	got = l.Recent()
+	if len(got) != 1 || got[0].End == nil || !got[0].End.Equal(clock) {
+		t.Fatalf("expected the episode to end at %s, got %+v", clock, got)
+	}
+	if !got[0].Start.Equal(clock.Add(-2 * time.Minute)) {
+		t.Errorf("expected the episode to start at the first anomalous sample, got %s", got[0].Start)
+	}
+}
+
+func TestAnomalyLog_KeepsMostRecent(t *testing.T) {
+	m := NewMetrics()
+	l := NewAnomalyLog(m, time.Second)
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return clock }
+
+	for i := 0; i < maxAnomalyEpisodes+2; i++ {
+		clock = clock.Add(time.Minute)
+		m.Reset()
+		m.RecordDuplicate()
+		l.Sample()
+		m.Reset()
+		m.RecordNew()
+		l.Sample()
+	}
+	got := l.Recent()
+	if len(got) != maxAnomalyEpisodes {
+		t.Fatalf("expected %d episodes, got %d", maxAnomalyEpisodes, len(got))
+	}
+	if !got[0].Start.Equal(clock) {
+		t.Errorf("expected newest first, got %s want %s", got[0].Start, clock)
+	}
+}
@@ -0,0 +1,41 @@
+package monitor
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// histogram counts latencies into the LatencyBoundsMs buckets, plus an
+// overflow bucket, without a lock. Call init before use.
+type histogram struct {
+	counts []atomic.Int64
+	sumNs  atomic.Int64
+}
+
+func (h *histogram) init() {
+	h.counts = make([]atomic.Int64, len(LatencyBoundsMs)+1)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	h.counts[sort.SearchFloat64s(LatencyBoundsMs, ms)].Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+// addCounts adds h's bucket counts to counts.
+func (h *histogram) addCounts(counts []int64) {
+	for i := range h.counts {
+		counts[i] += h.counts[i].Load()
+	}
+}
+
+func (h *histogram) snapshot() LatencyHistogram {
+	out := LatencyHistogram{BoundsMs: LatencyBoundsMs, Counts: make([]int64, len(h.counts))}
+	h.addCounts(out.Counts)
+	for _, n := range out.Counts {
+		out.Count += n
+	}
+	out.SumMs = float64(h.sumNs.Load()) / float64(time.Millisecond)
+	return out
+}
@@ -0,0 +1,251 @@
+package monitor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+const (
+	// merchantBuckets is how many buckets a merchant's window is split into,
+	// so a merchant costs the same memory whatever the window.
+	merchantBuckets = 60
+	// merchantCheckInterval is how often thresholds are checked for alerts.
+	merchantCheckInterval = 10 * time.Second
+)
+
+// AlertSink delivers merchant anomaly alerts.
+type AlertSink interface {
+	SendAnomalyAlert(ctx context.Context, alert domain.AnomalyAlert) error
+}
+
+// LogSink writes anomaly alerts to the log.
+type LogSink struct{}
+
+// SendAnomalyAlert logs alert.
+func (LogSink) SendAnomalyAlert(_ context.Context, alert domain.AnomalyAlert) error {
+	log.Printf("%s: merchant %s duplicate rate %.1f%% (threshold %.1f%%, %d of %d requests in %ds)",
+		alert.Event, alert.MerchantID, alert.DuplicateRate, alert.Threshold,
+		alert.WindowDuplicates, alert.WindowRequests, alert.WindowSeconds)
+	return nil
+}
+
+// MerchantAnomaly is one merchant's duplicate rate over the detection window.
+// Since is when the current anomaly was first seen.
+type MerchantAnomaly struct {
+	MerchantID       string     `json:"merchant_id"`
+	AnomalyDetected  bool       `json:"anomaly_detected"`
+	DuplicateRate    float64    `json:"duplicate_rate"`
+	Threshold        float64    `json:"threshold"`
+	MinRequests      int        `json:"min_requests"`
+	WindowRequests   int        `json:"window_requests"`
+	WindowDuplicates int        `json:"window_duplicates"`
+	WindowSeconds    int        `json:"window_seconds"`
+	Since            *time.Time `json:"since,omitempty"`
+}
+
+// rateBucket counts the requests of one bucket.
+type rateBucket struct {
+	sec  int64
+	reqs int
+	dups int
+}
+
+// merchantWindow is a ring of buckets of one merchant; rateBucket.sec holds
+// the bucket number rather than a second.
+type merchantWindow struct {
+	buckets  [merchantBuckets]rateBucket
+	alerting bool
+	since    time.Time
+}
+
+// MerchantAnomalies tracks each merchant's duplicate rate over a sliding
+// window, like the deployment-wide window of Metrics, and alerts the sinks
+// when a merchant crosses its threshold and when it recovers. Merchants with
+// fewer than minRequests requests in the window are never anomalous.
+type MerchantAnomalies struct {
+	mu          sync.Mutex
+	window      time.Duration
+	width       time.Duration
+	threshold   float64
+	thresholds  map[string]float64
+	minRequests int
+	merchants   map[string]*merchantWindow
+	sinks       []AlertSink
+	now         func() time.Time
+}
+
+// NewMerchantAnomalies creates a tracker flagging merchants whose duplicate
+// rate over window exceeds threshold percent.
+func NewMerchantAnomalies(window time.Duration, threshold float64, minRequests int) *MerchantAnomalies {
+	window = clampWindow(window)
+	// Whole seconds, rounded up so the window fits in the ring.
+	width := (window/merchantBuckets + time.Second - 1).Truncate(time.Second)
+	return &MerchantAnomalies{
+		window:      window,
+		width:       width,
+		threshold:   threshold,
+		minRequests: minRequests,
+		merchants:   make(map[string]*merchantWindow),
+		now:         time.Now,
+	}
+}
+
+// WithThresholds overrides the threshold of the merchants in thresholds.
+func (a *MerchantAnomalies) WithThresholds(thresholds map[string]float64) *MerchantAnomalies {
+	a.thresholds = thresholds
+	return a
+}
+
+// SetThresholds replaces the default threshold and the per-merchant
+// overrides while the tracker runs. Merchants are checked against the new
+// ones from their next report.
+func (a *MerchantAnomalies) SetThresholds(threshold float64, thresholds map[string]float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.threshold = threshold
+	a.thresholds = thresholds
+}
+
+// WithSinks adds sinks alerts are sent to.
+func (a *MerchantAnomalies) WithSinks(sinks ...AlertSink) *MerchantAnomalies {
+	a.sinks = append(a.sinks, sinks...)
+	return a
+}
+
+// RecordOutcome counts a payment outcome for merchantID. Outcomes other than
+// the payment ones are ignored.
+func (a *MerchantAnomalies) RecordOutcome(merchantID, outcome string) {
+	var dup bool
+	switch outcome {
+	case OutcomeNew, OutcomeRetry:
+	case OutcomeDuplicate, OutcomeCached, OutcomeMismatch:
+		dup = true
+	default:
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w, ok := a.merchants[merchantID]
+	if !ok {
+		w = &merchantWindow{}
+		a.merchants[merchantID] = w
+	}
+	n := a.bucket(a.now())
+	b := &w.buckets[n%merchantBuckets]
+	if b.sec != n {
+		*b = rateBucket{sec: n}
+	}
+	b.reqs++
+	if dup {
+		b.dups++
+	}
+}
+
+// Report returns merchantID's current state.
+func (a *MerchantAnomalies) Report(merchantID string) MerchantAnomaly {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := a.report(merchantID, a.now())
+	if w, ok := a.merchants[merchantID]; ok && w.alerting {
+		since := w.since
+		report.Since = &since
+	}
+	return report
+}
+
+// Run checks thresholds every merchantCheckInterval until ctx is done.
+func (a *MerchantAnomalies) Run(ctx context.Context) {
+	ticker := time.NewTicker(merchantCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Check(ctx)
+		}
+	}
+}
+
+// Check alerts for every merchant that crossed its threshold, or fell back
+// below it, since the last check, and forgets merchants with no requests
+// left in the window.
+func (a *MerchantAnomalies) Check(ctx context.Context) {
+	now := a.now()
+	var alerts []domain.AnomalyAlert
+
+	a.mu.Lock()
+	for id, w := range a.merchants {
+		r := a.report(id, now)
+		switch {
+		case r.AnomalyDetected && !w.alerting:
+			w.alerting, w.since = true, now.UTC()
+			alerts = append(alerts, anomalyAlert(domain.AnomalyDetectedEvent, r, now))
+		case !r.AnomalyDetected && w.alerting:
+			w.alerting = false
+			alerts = append(alerts, anomalyAlert(domain.AnomalyResolvedEvent, r, now))
+		}
+		if r.WindowRequests == 0 && !w.alerting {
+			delete(a.merchants, id)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, alert := range alerts {
+		for _, sink := range a.sinks {
+			if err := sink.SendAnomalyAlert(ctx, alert); err != nil {
+				log.Printf("anomaly alert for merchant %s failed: %v", alert.MerchantID, err)
+			}
+		}
+	}
+}
+
+// report computes merchantID's state at now. Callers hold the lock.
+func (a *MerchantAnomalies) report(merchantID string, now time.Time) MerchantAnomaly {
+	threshold := a.threshold
+	if t, ok := a.thresholds[merchantID]; ok {
+		threshold = t
+	}
+	r := MerchantAnomaly{
+		MerchantID:    merchantID,
+		Threshold:     threshold,
+		MinRequests:   a.minRequests,
+		WindowSeconds: int(a.window / time.Second),
+	}
+	if w, ok := a.merchants[merchantID]; ok {
+		last := a.bucket(now)
+		first := last - int64(a.window/a.width)
+		for _, b := range w.buckets {
+			if b.sec > first && b.sec <= last {
+				r.WindowRequests += b.reqs
+				r.WindowDuplicates += b.dups
+			}
+		}
+	}
+	r.DuplicateRate = rate(r.WindowRequests, r.WindowDuplicates)
+	r.AnomalyDetected = r.WindowRequests >= a.minRequests && r.DuplicateRate > threshold
+	return r
+}
+
+func (a *MerchantAnomalies) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(a.width)
+}
+
+func anomalyAlert(event string, r MerchantAnomaly, now time.Time) domain.AnomalyAlert {
+	return domain.AnomalyAlert{
+		EventID:          domain.NewEventID(),
+		Event:            event,
+		MerchantID:       r.MerchantID,
+		DuplicateRate:    r.DuplicateRate,
+		Threshold:        r.Threshold,
+		WindowRequests:   r.WindowRequests,
+		WindowDuplicates: r.WindowDuplicates,
+		WindowSeconds:    r.WindowSeconds,
+		At:               now.UTC(),
+	}
+}
@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type recordingSink struct {
+	alerts []domain.AnomalyAlert
+}
+
+func (s *recordingSink) SendAnomalyAlert(_ context.Context, alert domain.AnomalyAlert) error {
+	s.alerts = append(s.alerts, alert)
+	return nil
+}
+
+func record(a *MerchantAnomalies, merchantID string, outcome string, n int) {
+	for i := 0; i < n; i++ {
+		a.RecordOutcome(merchantID, outcome)
+	}
+}
+
+func TestMerchantAnomalies_PerMerchant(t *testing.T) {
+	a := NewMerchantAnomalies(5*time.Minute, 20, 10).WithThresholds(map[string]float64{"lenient": 50})
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	record(a, "noisy", OutcomeNew, 6)
+	record(a, "noisy", OutcomeDuplicate, 4)
+	record(a, "lenient", OutcomeNew, 6)
+	record(a, "lenient", OutcomeMismatch, 4)
+	record(a, "quiet", OutcomeDuplicate, 5)
+	record(a, "quiet", "rate_limited", 20)
+
+	noisy := a.Report("noisy")
+	if !noisy.AnomalyDetected || noisy.DuplicateRate != 40 || noisy.WindowRequests != 10 {
+		t.Errorf("noisy: %+v", noisy)
+	}
+	if lenient := a.Report("lenient"); lenient.AnomalyDetected || lenient.Threshold != 50 {
+		t.Errorf("lenient should be under its own threshold: %+v", lenient)
+	}
+	if quiet := a.Report("quiet"); quiet.AnomalyDetected || quiet.WindowRequests != 5 {
+		t.Errorf("quiet is under the minimum requests: %+v", quiet)
+	}
+	if unknown := a.Report("unknown"); unknown.AnomalyDetected || unknown.WindowRequests != 0 || unknown.Threshold != 20 {
+		t.Errorf("unknown: %+v", unknown)
+	}
+
+	now = now.Add(6 * time.Minute)
+	if noisy := a.Report("noisy"); noisy.WindowRequests != 0 {
+		t.Errorf("expected the window to slide past noisy's requests, got %+v", noisy)
+	}
+}
+
+func TestMerchantAnomalies_SetThresholds(t *testing.T) {
+	a := NewMerchantAnomalies(5*time.Minute, 20, 10).WithThresholds(map[string]float64{"lenient": 50})
+	record(a, "noisy", OutcomeNew, 7)
+	record(a, "noisy", OutcomeDuplicate, 3)
+	record(a, "lenient", OutcomeNew, 7)
+	record(a, "lenient", OutcomeDuplicate, 3)
+
+	a.SetThresholds(40, nil)
+	if noisy := a.Report("noisy"); noisy.AnomalyDetected || noisy.Threshold != 40 {
+		t.Errorf("expected the new default applied, got %+v", noisy)
+	}
+	if lenient := a.Report("lenient"); lenient.Threshold != 40 {
+		t.Errorf("expected the old override dropped, got %+v", lenient)
+	}
+}
+
+func TestMerchantAnomalies_Check(t *testing.T) {
+	sink := &recordingSink{}
+	a := NewMerchantAnomalies(5*time.Minute, 20, 10).WithSinks(sink)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	record(a, "m1", OutcomeNew, 5)
+	record(a, "m1", OutcomeCached, 5)
+	a.Check(ctx)
+	a.Check(ctx)
+	if len(sink.alerts) != 1 || sink.alerts[0].Event != domain.AnomalyDetectedEvent || sink.alerts[0].MerchantID != "m1" {
+		t.Fatalf("expected one detected alert, got %+v", sink.alerts)
+	}
+	if r := a.Report("m1"); r.Since == nil || !r.Since.Equal(now) {
+		t.Errorf("expected the anomaly to start now, got %+v", r)
+	}
+
+	now = now.Add(6 * time.Minute)
+	record(a, "m1", OutcomeNew, 10)
+	a.Check(ctx)
+	if len(sink.alerts) != 2 || sink.alerts[1].Event != domain.AnomalyResolvedEvent || sink.alerts[1].DuplicateRate != 0 {
+		t.Fatalf("expected a resolved alert, got %+v", sink.alerts)
+	}
+	if r := a.Report("m1"); r.Since != nil {
+		t.Errorf("expected no anomaly, got %+v", r)
+	}
+
+	now = now.Add(6 * time.Minute)
+	a.Check(ctx)
+	if len(a.merchants) != 0 {
+		t.Errorf("expected idle merchants to be forgotten, got %d", len(a.merchants))
+	}
+}
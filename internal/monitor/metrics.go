@@ -1,145 +1,700 @@
 package monitor
 
 import (
+	"context"
+	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Metrics tracks in-memory counters for the idempotency service.
+// Metrics tracks in-memory counters for the idempotency service. The
+// counters every request touches, its route, outcome, duplicate-rate window
+// and latency, are atomic, so recording takes no lock; mu guards the state
+// that changes rarely. A snapshot taken while requests are recorded may be
+// off by the requests in flight.
 type Metrics struct {
+	// current holds the counters of the period since the last reset.
+	current atomic.Pointer[period]
+
 	mu sync.RWMutex
 
-	TotalRequests    int64 `json:"total_requests"`
-	NewPayments      int64 `json:"new_payments"`
-	DuplicateBlocked int64 `json:"duplicate_blocked"`
-	RetryAllowed     int64 `json:"retry_allowed"`
-	CachedResponses  int64 `json:"cached_responses"`
-	ParamMismatches  int64 `json:"param_mismatches"`
+	slowQueries     int64
+	slowQueriesByOp map[string]int64
+
+	toleratedMismatches int64
+	toleratedByField    map[string]int64
+
+	circuitState string
+	circuitOpens int64
+
+	// queue is the async processing queue; capacity zero means sync mode.
+	queue QueueStats
+
+	// leader is this instance's leader election state; nil when leader
+	// election is off.
+	leader *LeaderStats
+
+	environment string
+
+	// merchants tracks per-merchant duplicate rates when set.
+	merchants *MerchantAnomalies
+
+	// window is the duplicate-rate window of the window_*_5m fields.
+	window time.Duration
+
+	// previous is the final snapshot of the period before.
+	previous *MetricsSnapshot
+
+	now func() time.Time
+}
+
+// period is what Reset starts over: the hot counters, swapped out whole so
+// recording never waits for a reset.
+type period struct {
+	start time.Time
+
+	totalRequests    atomic.Int64
+	newPayments      atomic.Int64
+	duplicateBlocked atomic.Int64
+	retryAllowed     atomic.Int64
+	cachedResponses  atomic.Int64
+	paramMismatches  atomic.Int64
+	expiredDeleted   atomic.Int64
+	reclaimed        atomic.Int64
+	throttled        atomic.Int64
+
+	// routes maps each route to its *routeStats.
+	routes sync.Map
+
+	// latency is the cumulative payment latency histogram; latencies is a
+	// ring of per-second histograms over latencyWindow for percentiles.
+	latency   histogram
+	latencies *ring[histogram]
+
+	// rates is a ring of per-second duplicate-rate buckets long enough for
+	// the longest window anyone reads. retain replaces it when it grows.
+	rates atomic.Pointer[ring[rateCounts]]
+}
+
+// routeStats counts one route's requests by outcome, in a map of
+// *atomic.Int64, and times them.
+type routeStats struct {
+	outcomes sync.Map
+	latency  histogram
+}
+
+// rateCounts counts the payment requests of one second.
+type rateCounts struct {
+	reqs atomic.Int64
+	dups atomic.Int64
+}
+
+const (
+	// DefaultWindow is the duplicate-rate window unless configured.
+	DefaultWindow = 5 * time.Minute
+	// MaxWindow bounds rate windows, and so the bucket ring.
+	MaxWindow = 24 * time.Hour
+	// latencyWindow is the window of the latency percentiles.
+	latencyWindow = 5 * time.Minute
+)
+
+// Outcomes of POST /v1/payments, each also counted in its own field.
+// Other routes report their own outcome names or the status class.
+const (
+	OutcomeNew       = "new"
+	OutcomeDuplicate = "duplicate"
+	OutcomeRetry     = "retry"
+	OutcomeCached    = "cached"
+	OutcomeMismatch  = "mismatch"
+)
+
+// LatencyBoundsMs are the upper bounds, in milliseconds, of the latency
+// histogram buckets.
+var LatencyBoundsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
 
-	// Sliding window for duplicate rate
-	window []windowEntry
+// LatencyHistogram counts payment latencies since the period started.
+// Counts[i] are latencies up to BoundsMs[i]; the last count is the rest.
+type LatencyHistogram struct {
+	BoundsMs []float64 `json:"bounds_ms"`
+	Counts   []int64   `json:"counts"`
+	Count    int64     `json:"count"`
+	SumMs    float64   `json:"sum_ms"`
 }
 
-type windowEntry struct {
-	ts          time.Time
-	isDuplicate bool
+// QueueStats describes the async processing queue. Depth and Capacity are
+// current; Enqueued, Rejected, Processed and DeadLettered count since the
+// period started.
+type QueueStats struct {
+	Depth        int   `json:"depth"`
+	Capacity     int   `json:"capacity"`
+	Enqueued     int64 `json:"enqueued"`
+	Rejected     int64 `json:"rejected"`
+	Processed    int64 `json:"processed"`
+	DeadLettered int64 `json:"dead_lettered"`
 }
 
-const windowDuration = 5 * time.Minute
+// LeaderStats describes this instance's part in leader election. Since is
+// when it last gained or lost leadership; Acquisitions counts the times it
+// became leader since it started.
+type LeaderStats struct {
+	IsLeader     bool      `json:"is_leader"`
+	Since        time.Time `json:"since"`
+	Acquisitions int64     `json:"acquisitions"`
+}
+
+// RateWindows are the duplicate-rate windows every snapshot reports, so
+// alerts can require a short spike and sustained elevation together.
+var RateWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// WindowRate is the duplicate activity over one window.
+type WindowRate struct {
+	Requests      int     `json:"requests"`
+	Duplicates    int     `json:"duplicates"`
+	DuplicateRate float64 `json:"duplicate_rate"`
+}
 
 // MetricsSnapshot is a point-in-time view of metrics.
 type MetricsSnapshot struct {
-	TotalRequests     int64   `json:"total_requests"`
-	NewPayments       int64   `json:"new_payments"`
-	DuplicateBlocked  int64   `json:"duplicate_blocked"`
-	RetryAllowed      int64   `json:"retry_allowed"`
-	CachedResponses   int64   `json:"cached_responses"`
-	ParamMismatches   int64   `json:"param_mismatches"`
-	WindowRequests    int     `json:"window_requests_5m"`
-	WindowDuplicates  int     `json:"window_duplicates_5m"`
-	WindowDupRate     float64 `json:"window_duplicate_rate_5m"`
-	AnomalyDetected   bool    `json:"anomaly_detected"`
-	AnomalyThreshold  float64 `json:"anomaly_threshold"`
+	TotalRequests    int64            `json:"total_requests"`
+	NewPayments      int64            `json:"new_payments"`
+	DuplicateBlocked int64            `json:"duplicate_blocked"`
+	RetryAllowed     int64            `json:"retry_allowed"`
+	CachedResponses  int64            `json:"cached_responses"`
+	ParamMismatches  int64            `json:"param_mismatches"`
+	SlowQueries      int64            `json:"slow_queries"`
+	SlowQueriesByOp  map[string]int64 `json:"slow_queries_by_op"`
+	CircuitState     string           `json:"circuit_state"`
+	CircuitOpens     int64            `json:"circuit_opens"`
+	Queue            *QueueStats      `json:"queue,omitempty"`
+	Leader           *LeaderStats     `json:"leader,omitempty"`
+	WindowRequests   int              `json:"window_requests_5m"`
+	WindowDuplicates int              `json:"window_duplicates_5m"`
+	WindowDupRate    float64          `json:"window_duplicate_rate_5m"`
+	LatencyP50Ms     float64          `json:"latency_p50_ms_5m"`
+	LatencyP95Ms     float64          `json:"latency_p95_ms_5m"`
+	LatencyP99Ms     float64          `json:"latency_p99_ms_5m"`
+	LatencyHistogram LatencyHistogram `json:"latency_histogram"`
+	AnomalyDetected  bool             `json:"anomaly_detected"`
+	AnomalyThreshold float64          `json:"anomaly_threshold"`
+
+	// ToleratedMismatches counts retries whose differences a merchant's
+	// tolerant_fields let through.
+	ToleratedMismatches int64            `json:"tolerated_mismatches"`
+	ToleratedByField    map[string]int64 `json:"tolerated_mismatches_by_field"`
+
+	// ExpiredKeysDeleted counts keys the expiry sweeper removed.
+	ExpiredKeysDeleted int64 `json:"expired_keys_deleted"`
+	// ReclaimedKeys counts keys stuck in processing that a duplicate took
+	// over after the processing timeout.
+	ReclaimedKeys int64 `json:"reclaimed_keys"`
+	// ThrottledKeys counts duplicate storms: keys answered 429 for taking
+	// too many attempts within the storm window.
+	ThrottledKeys int64 `json:"throttled_keys"`
+
+	// Routes counts requests per route ("POST /v1/payments") and outcome.
+	Routes map[string]map[string]int64 `json:"routes"`
+	// RouteLatency is each route's latency histogram since the period
+	// started.
+	RouteLatency map[string]LatencyHistogram `json:"route_latency"`
+
+	// Environment labels the counters when several deployments report to the
+	// same place.
+	Environment string `json:"environment"`
+	// WindowSeconds is the duplicate-rate window actually covered by the
+	// window_*_5m fields, which keep their names for existing clients.
+	WindowSeconds int `json:"window_seconds"`
+	// Windows holds the duplicate rate over each of RateWindows, keyed
+	// "1m", "5m", "1h".
+	Windows map[string]WindowRate `json:"windows"`
+
+	// PeriodStart is when the counters started counting; Previous is the
+	// period before the last reset or daily rotation.
+	PeriodStart time.Time        `json:"period_start"`
+	Previous    *MetricsSnapshot `json:"previous_period,omitempty"`
 }
 
 // NewMetrics creates a new Metrics instance.
 func NewMetrics() *Metrics {
-	return &Metrics{}
+	m := &Metrics{slowQueriesByOp: make(map[string]int64), toleratedByField: make(map[string]int64), circuitState: "closed", environment: "production", now: time.Now}
+	m.window = DefaultWindow
+	m.current.Store(m.newPeriod(0))
+	for _, d := range RateWindows {
+		m.retain(d)
+	}
+	return m
 }
 
-// RecordNew records a new payment request.
-func (m *Metrics) RecordNew() {
+// newPeriod starts a period whose rate ring has slots seconds.
+func (m *Metrics) newPeriod(slots int) *period {
+	p := &period{start: m.now().UTC(), latencies: newRing(int(latencyWindow/time.Second), (*histogram).init)}
+	p.latency.init()
+	p.rates.Store(newRing[rateCounts](max(slots, 1), nil))
+	return p
+}
+
+// Reset zeroes the counters, rate windows and latencies, keeping the final
+// snapshot of the ending period as Previous, which it returns. Circuit state,
+// queue depth and configuration are kept.
+func (m *Metrics) Reset() MetricsSnapshot {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.TotalRequests++
-	m.NewPayments++
-	m.addWindow(false)
+	ended := m.current.Swap(m.newPeriod(m.current.Load().rates.Load().len()))
+	prev := m.snapshot(ended)
+	prev.Previous = nil
+
+	m.slowQueries = 0
+	m.slowQueriesByOp = make(map[string]int64)
+	m.toleratedMismatches = 0
+	m.toleratedByField = make(map[string]int64)
+	m.circuitOpens = 0
+	m.queue.Enqueued, m.queue.Rejected, m.queue.Processed, m.queue.DeadLettered = 0, 0, 0, 0
+	m.previous = &prev
+	return prev
 }
 
-// RecordDuplicate records a blocked duplicate.
-func (m *Metrics) RecordDuplicate() {
+// RunDailyRotation resets the metrics at every UTC midnight until ctx is
+// done, so each period covers one day.
+func (m *Metrics) RunDailyRotation(ctx context.Context) {
+	for {
+		now := m.now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		prev := m.Reset()
+		log.Printf("metrics rotated: %d requests, %d duplicates blocked since %s",
+			prev.TotalRequests, prev.DuplicateBlocked, prev.PeriodStart.Format(time.RFC3339))
+	}
+}
+
+// WithWindow sets the duplicate-rate window, capped at MaxWindow. Low-traffic
+// deployments need longer windows for a meaningful rate.
+func (m *Metrics) WithWindow(d time.Duration) *Metrics {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.TotalRequests++
-	m.DuplicateBlocked++
-	m.addWindow(true)
+	m.window = clampWindow(d)
+	m.retain(m.window)
+	return m
+}
+
+func clampWindow(d time.Duration) time.Duration {
+	switch {
+	case d < time.Second:
+		return time.Second
+	case d > MaxWindow:
+		return MaxWindow
+	}
+	return d.Truncate(time.Second)
+}
+
+// retain grows the rate ring to cover d, keeping the counts already
+// recorded. Callers hold the write lock.
+func (m *Metrics) retain(d time.Duration) {
+	p := m.current.Load()
+	n := int(clampWindow(d) / time.Second)
+	if rates := p.rates.Load(); n > rates.len() {
+		p.rates.Store(rates.grow(n))
+	}
+}
+
+// windowCounts sums the requests and duplicates of p's last d.
+func (m *Metrics) windowCounts(p *period, now time.Time, d time.Duration) (reqs, dups int) {
+	rates := p.rates.Load()
+	last := now.Unix()
+	for sec := last - int64(clampWindow(d)/time.Second) + 1; sec <= last; sec++ {
+		if b := rates.get(sec); b != nil {
+			reqs += int(b.reqs.Load())
+			dups += int(b.dups.Load())
+		}
+	}
+	return reqs, dups
+}
+
+// duplicateRate returns the requests, duplicates and duplicate percentage of
+// the last d.
+func (m *Metrics) duplicateRate(d time.Duration) (int, int, float64) {
+	reqs, dups := m.windowCounts(m.current.Load(), m.now(), d)
+	return reqs, dups, rate(reqs, dups)
+}
+
+// windowLabel names a window the way snapshot keys do: 1m, 5m, 1h.
+func WindowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	}
+	return strconv.Itoa(int(d/time.Second)) + "s"
+}
+
+func rate(reqs, dups int) float64 {
+	if reqs == 0 {
+		return 0
+	}
+	return float64(dups) / float64(reqs) * 100
+}
+
+// WithEnvironment labels the metrics with the deployment's environment.
+func (m *Metrics) WithEnvironment(env string) *Metrics {
+	m.mu.Lock()
+	m.environment = env
+	m.mu.Unlock()
+	return m
+}
+
+// RecordNew records a new payment request.
+func (m *Metrics) RecordNew() {
+	p := m.current.Load()
+	p.newPayments.Add(1)
+	m.countRequest(p, false)
+}
+
+// RecordDuplicate records a blocked duplicate.
+func (m *Metrics) RecordDuplicate() {
+	p := m.current.Load()
+	p.duplicateBlocked.Add(1)
+	m.countRequest(p, true)
 }
 
 // RecordRetry records a retry after failure.
 func (m *Metrics) RecordRetry() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.TotalRequests++
-	m.RetryAllowed++
-	m.addWindow(false)
+	p := m.current.Load()
+	p.retryAllowed.Add(1)
+	m.countRequest(p, false)
 }
 
 // RecordCached records a cached response return.
 func (m *Metrics) RecordCached() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.TotalRequests++
-	m.CachedResponses++
-	m.addWindow(true)
+	p := m.current.Load()
+	p.cachedResponses.Add(1)
+	m.countRequest(p, true)
 }
 
 // RecordMismatch records a parameter mismatch.
 func (m *Metrics) RecordMismatch() {
+	p := m.current.Load()
+	p.paramMismatches.Add(1)
+	m.countRequest(p, true)
+}
+
+// RecordOutcome records how a request to route ended. Payment outcomes also
+// update their counters and the duplicate-rate window.
+func (m *Metrics) RecordOutcome(route, outcome string) {
+	m.current.Load().route(route).count(outcome)
+
+	switch outcome {
+	case OutcomeNew:
+		m.RecordNew()
+	case OutcomeDuplicate:
+		m.RecordDuplicate()
+	case OutcomeRetry:
+		m.RecordRetry()
+	case OutcomeCached:
+		m.RecordCached()
+	case OutcomeMismatch:
+		m.RecordMismatch()
+	}
+}
+
+// RecordRouteLatency records how long a request to route took to serve.
+func (m *Metrics) RecordRouteLatency(route string, d time.Duration) {
+	m.current.Load().route(route).latency.observe(d)
+}
+
+// route returns the stats of route, adding them on its first request.
+func (p *period) route(name string) *routeStats {
+	if r, ok := p.routes.Load(name); ok {
+		return r.(*routeStats)
+	}
+	fresh := &routeStats{}
+	fresh.latency.init()
+	r, _ := p.routes.LoadOrStore(name, fresh)
+	return r.(*routeStats)
+}
+
+func (r *routeStats) count(outcome string) {
+	n, ok := r.outcomes.Load(outcome)
+	if !ok {
+		n, _ = r.outcomes.LoadOrStore(outcome, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+// WithMerchantAnomalies also counts payment outcomes per merchant in a.
+func (m *Metrics) WithMerchantAnomalies(a *MerchantAnomalies) *Metrics {
+	m.mu.Lock()
+	m.merchants = a
+	m.mu.Unlock()
+	return m
+}
+
+// RecordMerchantOutcome counts a payment outcome for merchantID; callers
+// count it for its route with RecordOutcome as well.
+func (m *Metrics) RecordMerchantOutcome(merchantID, outcome string) {
+	m.mu.RLock()
+	merchants := m.merchants
+	m.mu.RUnlock()
+	if merchants != nil {
+		merchants.RecordOutcome(merchantID, outcome)
+	}
+}
+
+// RecordToleratedMismatch records a retry that differed only in tolerated fields.
+func (m *Metrics) RecordToleratedMismatch(fields []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toleratedMismatches++
+	for _, f := range fields {
+		m.toleratedByField[f]++
+	}
+}
+
+// RecordSlowQuery records a repository call that exceeded the slow query threshold.
+func (m *Metrics) RecordSlowQuery(op string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.TotalRequests++
-	m.ParamMismatches++
-	m.addWindow(true)
+	m.slowQueries++
+	m.slowQueriesByOp[op]++
+}
+
+// RecordExpiredDeleted records keys removed by the expiry sweeper.
+func (m *Metrics) RecordExpiredDeleted(n int64) {
+	m.current.Load().expiredDeleted.Add(n)
 }
 
-func (m *Metrics) addWindow(isDuplicate bool) {
-	now := time.Now()
-	m.window = append(m.window, windowEntry{ts: now, isDuplicate: isDuplicate})
-	m.pruneWindow(now)
+// RecordReclaimed records a key taken over after the processing timeout.
+func (m *Metrics) RecordReclaimed() {
+	m.current.Load().reclaimed.Add(1)
 }
 
-func (m *Metrics) pruneWindow(now time.Time) {
-	cutoff := now.Add(-windowDuration)
-	i := 0
-	for i < len(m.window) && m.window[i].ts.Before(cutoff) {
-		i++
+// RecordThrottled records the start of a key's duplicate storm.
+func (m *Metrics) RecordThrottled() {
+	m.current.Load().throttled.Add(1)
+}
+
+// RecordCircuitState records a storage circuit breaker state transition.
+func (m *Metrics) RecordCircuitState(state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.circuitState = state
+	if state == "open" {
+		m.circuitOpens++
+	}
+}
+
+// CircuitState returns the storage circuit breaker state last recorded.
+func (m *Metrics) CircuitState() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.circuitState
+}
+
+// RecordLeadership records this instance gaining or losing leadership of
+// the background jobs.
+func (m *Metrics) RecordLeadership(leader bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leader == nil {
+		m.leader = &LeaderStats{}
+	}
+	m.leader.IsLeader = leader
+	m.leader.Since = m.now().UTC()
+	if leader {
+		m.leader.Acquisitions++
+	}
+}
+
+// RecordQueued records a payment entering the async queue and the depth
+// after it did.
+func (m *Metrics) RecordQueued(depth, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue.Depth, m.queue.Capacity = depth, capacity
+	m.queue.Enqueued++
+}
+
+// RecordQueueRejected records a payment turned away by a full queue.
+func (m *Metrics) RecordQueueRejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue.Rejected++
+}
+
+// RecordDequeued records a queued payment handed to the gateway and the
+// depth after it left.
+func (m *Metrics) RecordDequeued(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue.Depth = depth
+	m.queue.Processed++
+}
+
+// RecordDeadLettered records a queued payment the workers gave up on.
+func (m *Metrics) RecordDeadLettered() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue.DeadLettered++
+}
+
+// RecordLatency records how long a payment request took to serve.
+func (m *Metrics) RecordLatency(d time.Duration) {
+	p := m.current.Load()
+	p.latency.observe(d)
+	if h := p.latencies.at(m.now().Unix()); h != nil {
+		h.observe(d)
+	}
+}
+
+// countRequest counts a payment request in p's total and rate window.
+func (m *Metrics) countRequest(p *period, isDuplicate bool) {
+	p.totalRequests.Add(1)
+	b := p.rates.Load().at(m.now().Unix())
+	if b == nil {
+		return
+	}
+	b.reqs.Add(1)
+	if isDuplicate {
+		b.dups.Add(1)
 	}
-	m.window = m.window[i:]
 }
 
 // Snapshot returns a point-in-time copy of all metrics.
 func (m *Metrics) Snapshot() MetricsSnapshot {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.snapshot(m.current.Load())
+}
 
-	now := time.Now()
-	cutoff := now.Add(-windowDuration)
-	var windowReqs, windowDups int
-	for _, e := range m.window {
-		if e.ts.After(cutoff) {
-			windowReqs++
-			if e.isDuplicate {
-				windowDups++
-			}
+// snapshot builds a Snapshot of p; callers hold the lock.
+func (m *Metrics) snapshot(p *period) MetricsSnapshot {
+	now := m.now()
+	windowReqs, windowDups := m.windowCounts(p, now, m.window)
+	dupRate := rate(windowReqs, windowDups)
+	windows := make(map[string]WindowRate, len(RateWindows))
+	for _, d := range RateWindows {
+		reqs, dups := m.windowCounts(p, now, d)
+		windows[WindowLabel(d)] = WindowRate{Requests: reqs, Duplicates: dups, DuplicateRate: rate(reqs, dups)}
+	}
+
+	recent := make([]int64, len(LatencyBoundsMs)+1)
+	for sec, last := now.Add(-latencyWindow).Unix()+1, now.Unix(); sec <= last; sec++ {
+		if h := p.latencies.get(sec); h != nil {
+			h.addCounts(recent)
 		}
 	}
 
-	var dupRate float64
-	if windowReqs > 0 {
-		dupRate = float64(windowDups) / float64(windowReqs) * 100
+	slowByOp := make(map[string]int64, len(m.slowQueriesByOp))
+	for op, n := range m.slowQueriesByOp {
+		slowByOp[op] = n
+	}
+	toleratedByField := make(map[string]int64, len(m.toleratedByField))
+	for f, n := range m.toleratedByField {
+		toleratedByField[f] = n
+	}
+	routes := make(map[string]map[string]int64)
+	routeLatency := make(map[string]LatencyHistogram)
+	p.routes.Range(func(route, stats any) bool {
+		r := stats.(*routeStats)
+		outcomes := make(map[string]int64)
+		r.outcomes.Range(func(o, n any) bool {
+			outcomes[o.(string)] = n.(*atomic.Int64).Load()
+			return true
+		})
+		if len(outcomes) > 0 {
+			routes[route.(string)] = outcomes
+		}
+		if h := r.latency.snapshot(); h.Count > 0 {
+			routeLatency[route.(string)] = h
+		}
+		return true
+	})
+
+	var queue *QueueStats
+	if m.queue.Capacity > 0 {
+		q := m.queue
+		queue = &q
+	}
+	var leader *LeaderStats
+	if m.leader != nil {
+		l := *m.leader
+		leader = &l
 	}
 
 	return MetricsSnapshot{
-		TotalRequests:    m.TotalRequests,
-		NewPayments:      m.NewPayments,
-		DuplicateBlocked: m.DuplicateBlocked,
-		RetryAllowed:     m.RetryAllowed,
-		CachedResponses:  m.CachedResponses,
-		ParamMismatches:  m.ParamMismatches,
+		TotalRequests:    p.totalRequests.Load(),
+		NewPayments:      p.newPayments.Load(),
+		DuplicateBlocked: p.duplicateBlocked.Load(),
+		RetryAllowed:     p.retryAllowed.Load(),
+		CachedResponses:  p.cachedResponses.Load(),
+		ParamMismatches:  p.paramMismatches.Load(),
+		SlowQueries:      m.slowQueries,
+		SlowQueriesByOp:  slowByOp,
+		CircuitState:     m.circuitState,
+		CircuitOpens:     m.circuitOpens,
+		Queue:            queue,
+		Leader:           leader,
 		WindowRequests:   windowReqs,
 		WindowDuplicates: windowDups,
 		WindowDupRate:    dupRate,
+		LatencyP50Ms:     percentileMs(recent, 50),
+		LatencyP95Ms:     percentileMs(recent, 95),
+		LatencyP99Ms:     percentileMs(recent, 99),
+		LatencyHistogram: p.latency.snapshot(),
 		AnomalyDetected:  dupRate > 20.0,
 		AnomalyThreshold: 20.0,
+
+		ToleratedMismatches: m.toleratedMismatches,
+		ToleratedByField:    toleratedByField,
+
+		ExpiredKeysDeleted: p.expiredDeleted.Load(),
+		ReclaimedKeys:      p.reclaimed.Load(),
+		ThrottledKeys:      p.throttled.Load(),
+
+		Routes:       routes,
+		RouteLatency: routeLatency,
+
+		Environment:   m.environment,
+		WindowSeconds: int(m.window / time.Second),
+		Windows:       windows,
+
+		PeriodStart: p.start,
+		Previous:    m.previous,
+	}
+}
+
+// percentileMs estimates the nearest-rank percentile of the latencies
+// counted over LatencyBoundsMs, interpolating linearly within the bucket it
+// falls in. Latencies past the last bound report that bound.
+func percentileMs(counts []int64, p int) float64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := max((int64(p)*total+99)/100, 1)
+	var below int64
+	for i, n := range counts {
+		if below+n < rank {
+			below += n
+			continue
+		}
+		if i == len(LatencyBoundsMs) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = LatencyBoundsMs[i-1]
+		}
+		return lower + (LatencyBoundsMs[i]-lower)*float64(rank-below)/float64(n)
 	}
+	return LatencyBoundsMs[len(LatencyBoundsMs)-1]
 }
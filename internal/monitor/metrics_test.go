@@ -3,6 +3,7 @@ package monitor
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMetrics_RecordNew(t *testing.T) {
@@ -152,3 +153,264 @@ func TestMetrics_ConcurrentAccess(t *testing.T) {
 		t.Errorf("expected 25 duplicate, got %d", snap.DuplicateBlocked)
 	}
 }
+
+func TestMetrics_RecordSlowQuery(t *testing.T) {
+	m := NewMetrics()
+	m.RecordSlowQuery("insert_or_get")
+	m.RecordSlowQuery("insert_or_get")
+	m.RecordSlowQuery("get_by_key")
+
+	snap := m.Snapshot()
+	if snap.SlowQueries != 3 {
+		t.Errorf("expected 3 slow queries, got %d", snap.SlowQueries)
+	}
+	if snap.SlowQueriesByOp["insert_or_get"] != 2 {
+		t.Errorf("expected 2 insert_or_get, got %d", snap.SlowQueriesByOp["insert_or_get"])
+	}
+	if snap.TotalRequests != 0 {
+		t.Errorf("slow queries should not count as requests, got %d", snap.TotalRequests)
+	}
+}
+
+func TestMetrics_RecordExpiredDeleted(t *testing.T) {
+	m := NewMetrics()
+	m.RecordExpiredDeleted(500)
+	m.RecordExpiredDeleted(12)
+	m.RecordReclaimed()
+
+	if snap := m.Snapshot(); snap.ExpiredKeysDeleted != 512 {
+		t.Errorf("expected 512 expired keys deleted, got %d", snap.ExpiredKeysDeleted)
+	}
+	if snap := m.Snapshot(); snap.ReclaimedKeys != 1 {
+		t.Errorf("expected 1 reclaimed key, got %d", snap.ReclaimedKeys)
+	}
+	m.Reset()
+	if snap := m.Snapshot(); snap.ExpiredKeysDeleted != 0 || snap.ReclaimedKeys != 0 {
+		t.Errorf("expected the count reset, got %d", snap.ExpiredKeysDeleted)
+	}
+}
+
+func TestMetrics_RecordCircuitState(t *testing.T) {
+	m := NewMetrics()
+	if s := m.Snapshot().CircuitState; s != "closed" {
+		t.Errorf("expected closed initially, got %s", s)
+	}
+
+	m.RecordCircuitState("open")
+	m.RecordCircuitState("half_open")
+	m.RecordCircuitState("open")
+
+	snap := m.Snapshot()
+	if snap.CircuitState != "open" {
+		t.Errorf("expected open, got %s", snap.CircuitState)
+	}
+	if snap.CircuitOpens != 2 {
+		t.Errorf("expected 2 opens, got %d", snap.CircuitOpens)
+	}
+}
+
+func TestMetrics_RecordLeadership(t *testing.T) {
+	m := NewMetrics()
+	if m.Snapshot().Leader != nil {
+		t.Fatal("expected no leader section before any leadership is recorded")
+	}
+
+	m.RecordLeadership(true)
+	m.RecordLeadership(false)
+	m.RecordLeadership(true)
+	m.Reset()
+
+	l := m.Snapshot().Leader
+	if l == nil || !l.IsLeader || l.Acquisitions != 2 || l.Since.IsZero() {
+		t.Errorf("unexpected leader stats: %+v", l)
+	}
+}
+
+func TestMetrics_LatencyPercentiles(t *testing.T) {
+	m := NewMetrics()
+	for i := 1; i <= 100; i++ {
+		m.RecordLatency(time.Duration(i) * time.Millisecond)
+	}
+
+	snap := m.Snapshot()
+	if snap.LatencyP50Ms != 50 {
+		t.Errorf("expected p50 50ms, got %v", snap.LatencyP50Ms)
+	}
+	if snap.LatencyP95Ms != 95 {
+		t.Errorf("expected p95 95ms, got %v", snap.LatencyP95Ms)
+	}
+	if snap.LatencyP99Ms != 99 {
+		t.Errorf("expected p99 99ms, got %v", snap.LatencyP99Ms)
+	}
+}
+
+func TestMetrics_LatencyWindowDropsOldSeconds(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMetrics()
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 1000; i++ {
+		m.RecordLatency(2 * time.Second)
+	}
+	now = now.Add(latencyWindow)
+	m.RecordLatency(20 * time.Millisecond)
+
+	snap := m.Snapshot()
+	if snap.LatencyP99Ms > 25 {
+		t.Errorf("expected latencies older than the window ignored, got p99 %vms", snap.LatencyP99Ms)
+	}
+	if snap.LatencyHistogram.Count != 1001 {
+		t.Errorf("expected the cumulative histogram to keep every latency, got %d", snap.LatencyHistogram.Count)
+	}
+}
+
+func TestMetrics_RouteLatency(t *testing.T) {
+	m := NewMetrics()
+	m.RecordRouteLatency("GET /v1/payments/{key}", 3*time.Millisecond)
+	m.RecordRouteLatency("GET /v1/payments/{key}", 40*time.Millisecond)
+	m.RecordRouteLatency("POST /v1/payments", 8*time.Second)
+
+	snap := m.Snapshot()
+	h := snap.RouteLatency["GET /v1/payments/{key}"]
+	if h.Count != 2 || h.Counts[0] != 1 || h.Counts[3] != 1 || h.SumMs != 43 {
+		t.Errorf("unexpected GET histogram %+v", h)
+	}
+	if h := snap.RouteLatency["POST /v1/payments"]; h.Counts[len(LatencyBoundsMs)] != 1 {
+		t.Errorf("expected the slow request in the overflow bucket, got %+v", h)
+	}
+	if len(snap.Routes) != 0 {
+		t.Errorf("expected no outcomes for routes only timed, got %v", snap.Routes)
+	}
+
+	m.Reset()
+	if snap := m.Snapshot(); len(snap.RouteLatency) != 0 || snap.Previous.RouteLatency["POST /v1/payments"].Count != 1 {
+		t.Errorf("expected route latencies to move to the previous period, got %+v", snap)
+	}
+}
+
+func TestMetrics_LatencyEmpty(t *testing.T) {
+	if p := NewMetrics().Snapshot().LatencyP95Ms; p != 0 {
+		t.Errorf("expected 0 with no samples, got %v", p)
+	}
+}
+
+func TestMetrics_ConfigurableWindow(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMetrics().WithWindow(time.Hour)
+	m.now = func() time.Time { return now }
+
+	m.RecordDuplicate()
+	now = now.Add(30 * time.Minute)
+	m.RecordNew()
+
+	snap := m.Snapshot()
+	if snap.WindowSeconds != 3600 || snap.WindowRequests != 2 || snap.WindowDuplicates != 1 {
+		t.Errorf("expected both requests in a 1h window, got %d/%d over %ds", snap.WindowDuplicates, snap.WindowRequests, snap.WindowSeconds)
+	}
+
+	now = now.Add(31 * time.Minute)
+	if snap := m.Snapshot(); snap.WindowRequests != 1 || snap.WindowDuplicates != 0 {
+		t.Errorf("expected the first request to leave the window, got %d/%d", snap.WindowDuplicates, snap.WindowRequests)
+	}
+}
+
+func TestMetrics_RateWindows(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMetrics()
+	m.now = func() time.Time { return now }
+
+	m.RecordNew()
+	m.RecordNew()
+	now = now.Add(10 * time.Minute)
+	m.RecordNew()
+	now = now.Add(2 * time.Minute)
+	m.RecordDuplicate()
+
+	w := m.Snapshot().Windows
+	if w["1m"].Requests != 1 || w["1m"].DuplicateRate != 100 {
+		t.Errorf("unexpected 1m window: %+v", w["1m"])
+	}
+	if w["5m"].Requests != 2 || w["5m"].DuplicateRate != 50 {
+		t.Errorf("unexpected 5m window: %+v", w["5m"])
+	}
+	if w["1h"].Requests != 4 || w["1h"].DuplicateRate != 25 {
+		t.Errorf("unexpected 1h window: %+v", w["1h"])
+	}
+}
+
+func TestMetrics_ResetKeepsPreviousPeriod(t *testing.T) {
+	m := NewMetrics()
+	m.RecordNew()
+	m.RecordDuplicate()
+	m.RecordSlowQuery("InsertOrGet")
+
+	prev := m.Reset()
+	if prev.TotalRequests != 2 || prev.DuplicateBlocked != 1 {
+		t.Errorf("expected the ended period in the result, got %+v", prev)
+	}
+
+	snap := m.Snapshot()
+	if snap.TotalRequests != 0 || snap.WindowRequests != 0 || len(snap.SlowQueriesByOp) != 0 {
+		t.Errorf("expected zeroed counters, got %+v", snap)
+	}
+	if snap.Previous == nil || snap.Previous.TotalRequests != 2 {
+		t.Fatalf("expected previous period with 2 requests, got %+v", snap.Previous)
+	}
+
+	m.Reset()
+	if p := m.Snapshot().Previous; p.TotalRequests != 0 || p.Previous != nil {
+		t.Errorf("expected only the latest period retained, got %+v", p)
+	}
+}
+
+func TestMetrics_RecordOutcome(t *testing.T) {
+	m := NewMetrics()
+	m.RecordOutcome("POST /v1/payments", OutcomeRetry)
+	m.RecordOutcome("POST /v1/payments", OutcomeDuplicate)
+	m.RecordOutcome("PATCH /v1/payments/", "succeeded")
+
+	snap := m.Snapshot()
+	if snap.RetryAllowed != 1 || snap.DuplicateBlocked != 1 || snap.TotalRequests != 2 {
+		t.Errorf("expected payment outcomes counted, got %+v", snap)
+	}
+	if snap.Routes["POST /v1/payments"][OutcomeRetry] != 1 || snap.Routes["PATCH /v1/payments/"]["succeeded"] != 1 {
+		t.Errorf("unexpected routes %v", snap.Routes)
+	}
+}
+
+// The benchmarks below record from every CPU at once, as the request
+// middleware does under load.
+
+func BenchmarkMetrics_RecordOutcome(b *testing.B) {
+	m := NewMetrics()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.RecordOutcome("POST /v1/payments", OutcomeNew)
+		}
+	})
+}
+
+func BenchmarkMetrics_RecordLatency(b *testing.B) {
+	m := NewMetrics()
+	b.RunParallel(func(pb *testing.PB) {
+		d := time.Duration(0)
+		for pb.Next() {
+			d = (d + 7*time.Millisecond) % (3 * time.Second)
+			m.RecordLatency(d)
+		}
+	})
+}
+
+// BenchmarkMetrics_Snapshot reads the metrics after 100k payments in the
+// latency window, as the /metrics endpoint and the OTLP exporter do.
+func BenchmarkMetrics_Snapshot(b *testing.B) {
+	m := NewMetrics()
+	for i := 0; i < 100000; i++ {
+		m.RecordOutcome("POST /v1/payments", OutcomeNew)
+		m.RecordLatency(time.Duration(i%3000) * time.Millisecond)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Snapshot()
+	}
+}
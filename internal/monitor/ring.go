@@ -0,0 +1,68 @@
+package monitor
+
+import "sync/atomic"
+
+// ring is a sliding window of per-second buckets that is safe to record
+// into without a lock. Each slot holds the bucket of the last second that
+// mapped to it; the first write of a new second swaps in a fresh bucket.
+type ring[T any] struct {
+	slots []atomic.Pointer[slot[T]]
+	// init prepares a fresh bucket; nil when the zero value will do.
+	init func(*T)
+}
+
+type slot[T any] struct {
+	sec int64
+	val T
+}
+
+func newRing[T any](n int, init func(*T)) *ring[T] {
+	return &ring[T]{slots: make([]atomic.Pointer[slot[T]], n), init: init}
+}
+
+func (r *ring[T]) len() int {
+	return len(r.slots)
+}
+
+// at returns the bucket of sec, starting it if its slot holds an older
+// second. It returns nil for a second the ring has already moved past.
+func (r *ring[T]) at(sec int64) *T {
+	p := &r.slots[sec%int64(len(r.slots))]
+	for {
+		s := p.Load()
+		if s != nil && s.sec == sec {
+			return &s.val
+		}
+		if s != nil && s.sec > sec {
+			return nil
+		}
+		fresh := &slot[T]{sec: sec}
+		if r.init != nil {
+			r.init(&fresh.val)
+		}
+		if p.CompareAndSwap(s, fresh) {
+			return &fresh.val
+		}
+	}
+}
+
+// get returns the bucket of sec, or nil if nothing was recorded in it or it
+// has been overwritten.
+func (r *ring[T]) get(sec int64) *T {
+	if s := r.slots[sec%int64(len(r.slots))].Load(); s != nil && s.sec == sec {
+		return &s.val
+	}
+	return nil
+}
+
+// grow returns a ring of n slots holding r's buckets. Buckets started in r
+// after grow has copied them are lost, so rings grow while configuring.
+func (r *ring[T]) grow(n int) *ring[T] {
+	grown := newRing(n, r.init)
+	for i := range r.slots {
+		if s := r.slots[i].Load(); s != nil {
+			grown.slots[s.sec%int64(n)].Store(s)
+		}
+	}
+	return grown
+}
@@ -0,0 +1,283 @@
+// Package openapi builds an OpenAPI 3 document from a list of operations and
+// the Go types of their request and response bodies. Schemas are derived
+// from the types' JSON encoding by reflection, so the document changes with
+// the structs the handlers actually encode and decode.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of the documents Build returns.
+const Version = "3.0.3"
+
+// Operation is one documented endpoint. Path uses ServeMux wildcards
+// ("/v1/payments/{key}"), which are also OpenAPI path templates.
+type Operation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Query   []Param
+	// Request, when non-nil, is a value of the JSON request body's type.
+	Request any
+	// Auth marks operations that need the admin bearer token.
+	Auth      bool
+	Responses []Response
+}
+
+// Param is a query parameter. All query parameters are optional strings.
+type Param struct {
+	Name        string
+	Description string
+}
+
+// Response is one documented status of an operation. Body, when non-nil, is
+// a value of the JSON response body's type.
+type Response struct {
+	Status      int
+	Description string
+	Body        any
+}
+
+// Pattern returns the operation's ServeMux pattern.
+func (op Operation) Pattern() string {
+	return op.Method + " " + op.Path
+}
+
+// Build returns the OpenAPI document for ops. Named struct types become
+// components, referenced wherever they are used.
+func Build(title, version string, ops []Operation) map[string]any {
+	g := &generator{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	paths := map[string]map[string]any{}
+	usesAuth := false
+	for _, op := range ops {
+		item := paths[op.Path]
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = g.operation(op)
+		usesAuth = usesAuth || op.Auth
+	}
+	components := map[string]any{"schemas": g.schemas}
+	if usesAuth {
+		components["securitySchemes"] = map[string]any{
+			"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+		}
+	}
+	return map[string]any{
+		"openapi":    Version,
+		"info":       map[string]any{"title": title, "version": version},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+type generator struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+func (g *generator) operation(op Operation) map[string]any {
+	out := map[string]any{"summary": op.Summary, "operationId": operationID(op)}
+	if op.Tag != "" {
+		out["tags"] = []string{op.Tag}
+	}
+	var params []any
+	for _, name := range pathParams(op.Path) {
+		params = append(params, map[string]any{
+			"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, p := range op.Query {
+		params = append(params, map[string]any{
+			"name": p.Name, "in": "query", "description": p.Description, "schema": map[string]any{"type": "string"},
+		})
+	}
+	if params != nil {
+		out["parameters"] = params
+	}
+	if op.Request != nil {
+		out["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.Request))}},
+		}
+	}
+	responses := map[string]any{}
+	for _, r := range op.Responses {
+		desc := r.Description
+		if desc == "" {
+			desc = http.StatusText(r.Status)
+		}
+		resp := map[string]any{"description": desc}
+		if r.Body != nil {
+			resp["content"] = map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(r.Body))}}
+		}
+		responses[fmt.Sprint(r.Status)] = resp
+	}
+	out["responses"] = responses
+	if op.Auth {
+		out["security"] = []any{map[string]any{"adminToken": []string{}}}
+	}
+	return out
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of t's JSON encoding, registering named structs
+// as components.
+func (g *generator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]any{"description": "Any JSON value"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + g.component(t)}
+	}
+	return map[string]any{}
+}
+
+// component registers the named struct t and returns its component name:
+// the type's name, qualified by its package when two packages share it.
+func (g *generator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := g.schemas[name]; taken {
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+	}
+	g.names[t] = name
+	g.schemas[name] = map[string]any{} // placeholder for recursive types
+	g.schemas[name] = g.object(t)
+	return name
+}
+
+// object is the schema of struct t's fields as encoding/json sees them.
+func (g *generator) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	g.fields(t, props)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+func (g *generator) fields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(opts, "string") {
+			props[name] = map[string]any{"type": "string"}
+			continue
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
+
+// pathParams returns the wildcard names in path, in order.
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			names = append(names, strings.TrimSuffix(strings.Trim(seg, "{}"), "..."))
+		}
+	}
+	return names
+}
+
+// operationID derives a stable ID such as getV1PaymentsKeyWait.
+func operationID(op Operation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, seg := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '-' || r == '.' }) {
+		b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return b.String()
+}
+
+// Check compares the documented operations with the patterns a mux serves
+// and returns an error naming any served pattern under one of prefixes that
+// is not documented, and any documented operation that is not served.
+func Check(ops []Operation, served []string, prefixes ...string) error {
+	documented := map[string]bool{}
+	for _, op := range ops {
+		documented[op.Pattern()] = true
+	}
+	var problems []string
+	routed := map[string]bool{}
+	for _, p := range served {
+		routed[p] = true
+		_, path, _ := strings.Cut(p, " ")
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) && !documented[p] {
+				problems = append(problems, "undocumented route "+p)
+				break
+			}
+		}
+	}
+	for p := range documented {
+		if !routed[p] {
+			problems = append(problems, "documented route not served: "+p)
+		}
+	}
+	if problems == nil {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("openapi: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,66 @@
+package openapi
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type inner struct {
+	At time.Time `json:"at"`
+}
+
+type node struct {
+	Name     string            `json:"name"`
+	Count    int64             `json:"count,omitempty"`
+	Hidden   string            `json:"-"`
+	Tags     map[string]string `json:"tags"`
+	Children []node            `json:"children"`
+	Raw      json.RawMessage   `json:"raw"`
+	*inner
+}
+
+func TestBuild_Schemas(t *testing.T) {
+	doc := Build("t", "v1", []Operation{{
+		Method: "POST", Path: "/v1/nodes/{id}", Request: node{},
+		Responses: []Response{{Status: 200, Body: []node{}}},
+	}})
+	schemas := doc["components"].(map[string]any)["schemas"].(map[string]any)
+	props := schemas["node"].(map[string]any)["properties"].(map[string]any)
+	for _, name := range []string{"name", "count", "tags", "children", "raw", "at"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("missing property %q in %v", name, props)
+		}
+	}
+	if _, ok := props["Hidden"]; ok {
+		t.Error("json:\"-\" field documented")
+	}
+	if got := props["at"].(map[string]any)["format"]; got != "date-time" {
+		t.Errorf("time format = %v", got)
+	}
+	if got := props["children"].(map[string]any)["items"].(map[string]any)["$ref"]; got != "#/components/schemas/node" {
+		t.Errorf("recursive ref = %v", got)
+	}
+
+	op := doc["paths"].(map[string]map[string]any)["/v1/nodes/{id}"]["post"].(map[string]any)
+	params := op["parameters"].([]any)
+	if len(params) != 1 || params[0].(map[string]any)["name"] != "id" {
+		t.Errorf("parameters = %v", params)
+	}
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ops := []Operation{{Method: "GET", Path: "/v1/a"}, {Method: "GET", Path: "/v1/b"}}
+	if err := Check(ops, []string{"GET /v1/a", "GET /v1/b", "GET /admin/x"}, "/v1/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := Check(ops, []string{"GET /v1/a", "POST /v1/c"}, "/v1/")
+	if err == nil || !strings.Contains(err.Error(), "undocumented route POST /v1/c") ||
+		!strings.Contains(err.Error(), "not served: GET /v1/b") {
+		t.Fatalf("expected drift error, got %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+// Package otlp pushes the shield's metrics to an OpenTelemetry collector
+// over OTLP/HTTP, using the protocol's JSON encoding so no SDK is needed.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+const (
+	serviceName = "idempotency-shield"
+	httpTimeout = 10 * time.Second
+	// temporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+	temporalityCumulative = 2
+)
+
+// Exporter periodically posts a metrics snapshot to an OTLP/HTTP metrics
+// endpoint, e.g. http://collector:4318/v1/metrics. Counters are cumulative
+// sums starting at the snapshot's period_start, so resets and rotations look
+// like restarts to the collector.
+type Exporter struct {
+	URL      string
+	Headers  map[string]string
+	Client   *http.Client
+	metrics  *monitor.Metrics
+	instance string
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewExporter creates an Exporter for metrics reported as instance.
+// headers are sent with every request, typically for collector auth.
+func NewExporter(endpoint string, headers map[string]string, metrics *monitor.Metrics, instance string, interval time.Duration) *Exporter {
+	return &Exporter{
+		URL:      endpoint,
+		Headers:  headers,
+		Client:   &http.Client{Timeout: httpTimeout},
+		metrics:  metrics,
+		instance: instance,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// ParseHeaders parses the OTEL_EXPORTER_OTLP_HEADERS format:
+// comma-separated key=value pairs with URL-encoded values.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("otlp: malformed header %q", pair)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("otlp: header %q: %w", k, err)
+		}
+		headers[strings.TrimSpace(k)] = v
+	}
+	return headers, nil
+}
+
+// Run exports on every tick until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := e.Export(ctx); err != nil {
+			log.Printf("otlp export: %v", err)
+		}
+	}
+}
+
+// Export posts the current snapshot; any non-2xx response is an error.
+func (e *Exporter) Export(ctx context.Context) error {
+	body, err := json.Marshal(e.request(e.metrics.Snapshot()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below are the subset of the OTLP JSON encoding the exporter
+// writes. 64-bit integers are strings, as the encoding requires.
+
+type exportRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type metric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Sum         *sum       `json:"sum,omitempty"`
+	Gauge       *gauge     `json:"gauge,omitempty"`
+	Histogram   *histogram `json:"histogram,omitempty"`
+}
+
+type sum struct {
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+	DataPoints             []numberDataPoint `json:"dataPoints"`
+}
+
+type gauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type histogram struct {
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+	DataPoints             []histogramDataPoint `json:"dataPoints"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsInt             string     `json:"asInt,omitempty"`
+	AsDouble          *float64   `json:"asDouble,omitempty"`
+}
+
+type histogramDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	Count             string     `json:"count"`
+	Sum               float64    `json:"sum"`
+	BucketCounts      []string   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func attr(k, v string) keyValue {
+	return keyValue{Key: k, Value: anyValue{StringValue: v}}
+}
+
+// request converts a snapshot into an OTLP export request.
+func (e *Exporter) request(snap monitor.MetricsSnapshot) exportRequest {
+	start := nanos(snap.PeriodStart)
+	now := nanos(e.now())
+
+	counter := func(name, desc string, points ...numberDataPoint) metric {
+		for i := range points {
+			points[i].StartTimeUnixNano = start
+			points[i].TimeUnixNano = now
+		}
+		return metric{Name: name, Description: desc, Unit: "1", Sum: &sum{
+			AggregationTemporality: temporalityCumulative,
+			IsMonotonic:            true,
+			DataPoints:             points,
+		}}
+	}
+	count := func(n int64, attrs ...keyValue) numberDataPoint {
+		return numberDataPoint{Attributes: attrs, AsInt: strconv.FormatInt(n, 10)}
+	}
+
+	payments := []numberDataPoint{
+		count(snap.NewPayments, attr("outcome", monitor.OutcomeNew)),
+		count(snap.DuplicateBlocked, attr("outcome", monitor.OutcomeDuplicate)),
+		count(snap.RetryAllowed, attr("outcome", monitor.OutcomeRetry)),
+		count(snap.CachedResponses, attr("outcome", monitor.OutcomeCached)),
+		count(snap.ParamMismatches, attr("outcome", monitor.OutcomeMismatch)),
+	}
+	var requests []numberDataPoint
+	for _, route := range sortedKeys(snap.Routes) {
+		outcomes := snap.Routes[route]
+		for _, outcome := range sortedKeys(outcomes) {
+			requests = append(requests, count(outcomes[outcome], attr("http.route", route), attr("outcome", outcome)))
+		}
+	}
+	var slow []numberDataPoint
+	for _, op := range sortedKeys(snap.SlowQueriesByOp) {
+		slow = append(slow, count(snap.SlowQueriesByOp[op], attr("op", op)))
+	}
+	var tolerated []numberDataPoint
+	for _, field := range sortedKeys(snap.ToleratedByField) {
+		tolerated = append(tolerated, count(snap.ToleratedByField[field], attr("field", field)))
+	}
+
+	var rates []numberDataPoint
+	for _, label := range sortedKeys(snap.Windows) {
+		rate := snap.Windows[label].DuplicateRate
+		rates = append(rates, numberDataPoint{Attributes: []keyValue{attr("window", label)}, TimeUnixNano: now, AsDouble: &rate})
+	}
+
+	histogramPoint := func(h monitor.LatencyHistogram, attrs ...keyValue) histogramDataPoint {
+		buckets := make([]string, len(h.Counts))
+		for i, n := range h.Counts {
+			buckets[i] = strconv.FormatInt(n, 10)
+		}
+		return histogramDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             strconv.FormatInt(h.Count, 10),
+			Sum:               h.SumMs,
+			BucketCounts:      buckets,
+			ExplicitBounds:    h.BoundsMs,
+		}
+	}
+	var durations []histogramDataPoint
+	for _, route := range sortedKeys(snap.RouteLatency) {
+		durations = append(durations, histogramPoint(snap.RouteLatency[route], attr("http.route", route)))
+	}
+
+	metrics := []metric{
+		counter("shield.payments", "Payment requests by idempotency outcome.", payments...),
+		counter("shield.requests", "Requests by route and outcome.", requests...),
+		counter("shield.slow_queries", "Repository calls over the slow query threshold.", slow...),
+		counter("shield.tolerated_mismatches", "Retries whose differences were tolerated, by field.", tolerated...),
+		counter("shield.circuit_opens", "Storage circuit breaker openings.", count(snap.CircuitOpens)),
+		counter("shield.expired_keys_deleted", "Expired keys removed by the sweeper.", count(snap.ExpiredKeysDeleted)),
+		counter("shield.reclaimed_keys", "Keys stuck in processing taken over after the processing timeout.", count(snap.ReclaimedKeys)),
+		counter("shield.throttled_keys", "Keys throttled with 429 for a duplicate storm.", count(snap.ThrottledKeys)),
+		{Name: "shield.duplicate_rate", Description: "Percentage of payment requests that were duplicates.", Unit: "%", Gauge: &gauge{DataPoints: rates}},
+		{Name: "shield.payment.duration", Description: "Time to serve POST /v1/payments.", Unit: "ms", Histogram: &histogram{
+			AggregationTemporality: temporalityCumulative,
+			DataPoints:             []histogramDataPoint{histogramPoint(snap.LatencyHistogram)},
+		}},
+	}
+	if durations != nil {
+		metrics = append(metrics, metric{Name: "shield.http.server.duration", Description: "Time to serve requests, by route.", Unit: "ms", Histogram: &histogram{
+			AggregationTemporality: temporalityCumulative,
+			DataPoints:             durations,
+		}})
+	}
+
+	if q := snap.Queue; q != nil {
+		depth := float64(q.Depth)
+		metrics = append(metrics,
+			metric{Name: "shield.queue.depth", Description: "Payments waiting in the async processing queue.", Unit: "1",
+				Gauge: &gauge{DataPoints: []numberDataPoint{{TimeUnixNano: now, AsDouble: &depth}}}},
+			counter("shield.queue.rejected", "Payments turned away by a full async queue.", count(q.Rejected)),
+		)
+	}
+
+	if l := snap.Leader; l != nil {
+		leader := 0.0
+		if l.IsLeader {
+			leader = 1
+		}
+		metrics = append(metrics,
+			metric{Name: "shield.leader", Description: "Whether this instance runs the background jobs (1) or not (0).", Unit: "1",
+				Gauge: &gauge{DataPoints: []numberDataPoint{{TimeUnixNano: now, AsDouble: &leader}}}},
+		)
+	}
+
+	// Counters nothing has incremented yet, e.g. slow queries, are left out.
+	kept := metrics[:0]
+	for _, m := range metrics {
+		if m.Sum == nil || len(m.Sum.DataPoints) > 0 {
+			kept = append(kept, m)
+		}
+	}
+
+	return exportRequest{ResourceMetrics: []resourceMetrics{{
+		Resource: resource{Attributes: []keyValue{
+			attr("service.name", serviceName),
+			attr("service.instance.id", e.instance),
+			attr("deployment.environment", snap.Environment),
+		}},
+		ScopeMetrics: []scopeMetrics{{Scope: scope{Name: serviceName}, Metrics: kept}},
+	}}}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := ParseHeaders("api-key=s3cr%3Dt, x-tenant = shield")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if headers["api-key"] != "s3cr=t" || headers["x-tenant"] != "shield" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if _, err := ParseHeaders("no-equals"); err == nil {
+		t.Error("expected an error for a header without =")
+	}
+}
+
+func TestExport_PostsOTLPJSON(t *testing.T) {
+	var got exportRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("api-key")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	metrics := monitor.NewMetrics()
+	metrics.RecordOutcome("POST /v1/payments", monitor.OutcomeNew)
+	metrics.RecordOutcome("POST /v1/payments", monitor.OutcomeDuplicate)
+	metrics.RecordLatency(30 * time.Millisecond)
+	metrics.RecordRouteLatency("GET /v1/payments/{key}", 4*time.Millisecond)
+
+	e := NewExporter(srv.URL, map[string]string{"api-key": "k"}, metrics, "api-1", time.Minute)
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if auth != "k" {
+		t.Errorf("expected the configured header, got %q", auth)
+	}
+
+	byName := map[string]metric{}
+	for _, m := range got.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+	if _, ok := byName["shield.slow_queries"]; ok {
+		t.Error("expected counters without data points left out")
+	}
+	payments := byName["shield.payments"].Sum
+	if payments == nil || payments.DataPoints[0].AsInt != "1" || payments.DataPoints[1].AsInt != "1" {
+		t.Errorf("unexpected payments sum %+v", payments)
+	}
+	hist := byName["shield.payment.duration"].Histogram
+	if hist == nil || hist.DataPoints[0].Count != "1" || hist.DataPoints[0].BucketCounts[3] != "1" {
+		t.Errorf("expected the 30ms latency in the 50ms bucket, got %+v", hist)
+	}
+	routes := byName["shield.http.server.duration"].Histogram
+	if routes == nil || len(routes.DataPoints) != 1 || routes.DataPoints[0].Attributes[0].Value.StringValue != "GET /v1/payments/{key}" {
+		t.Errorf("expected one route duration point, got %+v", routes)
+	}
+}
+
+func TestExport_CollectorErrorIsReturned(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	e := NewExporter(srv.URL, nil, monitor.NewMetrics(), "api-1", time.Minute)
+	if err := e.Export(context.Background()); err == nil {
+		t.Error("expected an error for a 503 from the collector")
+	}
+}
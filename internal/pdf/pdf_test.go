@@ -0,0 +1,69 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestBytes_Structure(t *testing.T) {
+	d := New()
+	d.Text(50, 800, 12, true, "Hello")
+	d.AddPage()
+	d.Line(0, 0, 100, 100)
+	d.Rect(10, 10, 20, 20, 0.5)
+	out := d.Bytes()
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) {
+		t.Error("missing PDF header")
+	}
+	if !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Error("missing EOF marker")
+	}
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Error("expected two pages")
+	}
+}
+
+func TestBytes_XrefOffsetsPointAtObjects(t *testing.T) {
+	d := New()
+	d.Text(50, 800, 12, false, "Offsets")
+	out := d.Bytes()
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if m == nil {
+		t.Fatal("missing startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at xref table", xref)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 objects, got %d", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		want := []byte(fmt.Sprintf("%d 0 obj", i+1))
+		if !bytes.HasPrefix(out[off:], want) {
+			t.Errorf("object %d: offset %d does not point at %q", i+1, off, want)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	cases := map[string]string{
+		"plain":     "plain",
+		"a(b)c\\":   `a\(b\)c\\`,
+		"São Paulo": `S\343o Paulo`,
+		"emoji 🙂":   "emoji ?",
+	}
+	for in, want := range cases {
+		if got := escape(in); got != want {
+			t.Errorf("escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
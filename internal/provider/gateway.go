@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// HTTPGateway submits payments downstream with POST, for the asynchronous
+// processing mode. The body is the payment as JSON; the response is read like
+// a status lookup, so "succeeded" and "failed" complete the payment and
+// anything else leaves it processing for the merchant or the reconciler.
+type HTTPGateway struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// NewHTTPGateway creates an HTTPGateway. An empty token sends no
+// Authorization header.
+func NewHTTPGateway(url, token string) *HTTPGateway {
+	return &HTTPGateway{URL: url, Token: token, Client: &http.Client{Timeout: httpTimeout}}
+}
+
+// gatewayPayment is the body POSTed for each payment.
+type gatewayPayment struct {
+	PaymentID      string `json:"payment_id"`
+	IdempotencyKey string `json:"idempotency_key"`
+	MerchantID     string `json:"merchant_id"`
+	CustomerID     string `json:"customer_id"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+}
+
+// Submit posts rec and returns the gateway's status and raw response. Any
+// non-2xx response is an error.
+func (g *HTTPGateway) Submit(ctx context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	body, err := json.Marshal(gatewayPayment{
+		PaymentID:      rec.PaymentID,
+		IdempotencyKey: rec.IdempotencyKey,
+		MerchantID:     rec.MerchantID,
+		CustomerID:     rec.CustomerID,
+		Amount:         rec.Amount,
+		Currency:       rec.Currency,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Idempotency-Key", rec.PaymentID)
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("gateway: %w", stripURL(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", nil, fmt.Errorf("gateway: unexpected status %s", resp.Status)
+	}
+	return decodeStatus(resp.Body)
+}
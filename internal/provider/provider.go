@@ -0,0 +1,112 @@
+// Package provider queries a payment provider for the final status of a
+// payment, so payments left in processing can be reconciled.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+const (
+	httpTimeout = 10 * time.Second
+	// maxBodyBytes bounds the provider response stored as response_body.
+	maxBodyBytes = 1 << 20
+)
+
+// ErrUnknownPayment is returned when the provider has no record of the payment.
+var ErrUnknownPayment = errors.New("payment unknown to provider")
+
+// HTTPProvider looks payments up with GET on a URL template. The template's
+// {payment_id} and {idempotency_key} placeholders are replaced with the
+// path-escaped values of the record. The response must be a JSON object with a
+// "status" member; "succeeded" and "failed" are final, anything else means
+// the provider is still working on it.
+type HTTPProvider struct {
+	URLTemplate string
+	Token       string
+	Client      *http.Client
+}
+
+// NewHTTPProvider creates an HTTPProvider. An empty token sends no
+// Authorization header.
+func NewHTTPProvider(urlTemplate, token string) *HTTPProvider {
+	return &HTTPProvider{URLTemplate: urlTemplate, Token: token, Client: &http.Client{Timeout: httpTimeout}}
+}
+
+// PaymentStatus returns the provider's status for rec and its raw response.
+// Non-final statuses are reported as domain.StatusProcessing.
+func (p *HTTPProvider) PaymentStatus(ctx context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	url := strings.NewReplacer(
+		"{payment_id}", neturl.PathEscape(rec.PaymentID),
+		"{idempotency_key}", neturl.PathEscape(rec.IdempotencyKey),
+	).Replace(p.URLTemplate)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("provider: %w", stripURL(err))
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", nil, ErrUnknownPayment
+	case resp.StatusCode != http.StatusOK:
+		return "", nil, fmt.Errorf("provider: unexpected status %s", resp.Status)
+	}
+	return decodeStatus(resp.Body)
+}
+
+// stripURL drops the request URL, which may carry credentials, from a
+// client error and keeps only the underlying cause.
+func stripURL(err error) error {
+	var uerr *neturl.Error
+	if errors.As(err, &uerr) {
+		return uerr.Err
+	}
+	return err
+}
+
+// decodeStatus reads a provider response: a JSON object with a "status"
+// member. Non-final statuses are reported as domain.StatusProcessing.
+func decodeStatus(r io.Reader) (domain.Status, *json.RawMessage, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxBodyBytes+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("provider: read body: %w", err)
+	}
+	if len(raw) > maxBodyBytes {
+		return "", nil, fmt.Errorf("provider: response larger than %d bytes", maxBodyBytes)
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return "", nil, fmt.Errorf("provider: decode body: %w", err)
+	}
+
+	msg := json.RawMessage(raw)
+	switch domain.Status(strings.ToLower(body.Status)) {
+	case domain.StatusSucceeded:
+		return domain.StatusSucceeded, &msg, nil
+	case domain.StatusFailed:
+		return domain.StatusFailed, &msg, nil
+	default:
+		return domain.StatusProcessing, &msg, nil
+	}
+}
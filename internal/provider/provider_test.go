@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestHTTPProvider_PaymentStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/payments/pay_ok":
+			w.Write([]byte(`{"status": "SUCCEEDED", "transaction_id": "tx_1"}`))
+		case "/payments/pay_pending":
+			w.Write([]byte(`{"status": "authorizing"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	p := NewHTTPProvider(srv.URL+"/payments/{payment_id}", "secret")
+
+	status, body, err := p.PaymentStatus(context.Background(), domain.IdempotencyRecord{PaymentID: "pay_ok"})
+	if err != nil || status != domain.StatusSucceeded {
+		t.Fatalf("expected succeeded, got %s, %v", status, err)
+	}
+	if body == nil || string(*body) != `{"status": "SUCCEEDED", "transaction_id": "tx_1"}` {
+		t.Errorf("expected raw provider body, got %v", body)
+	}
+
+	if status, _, err := p.PaymentStatus(context.Background(), domain.IdempotencyRecord{PaymentID: "pay_pending"}); err != nil || status != domain.StatusProcessing {
+		t.Errorf("expected processing for a non-final status, got %s, %v", status, err)
+	}
+
+	if _, _, err := p.PaymentStatus(context.Background(), domain.IdempotencyRecord{PaymentID: "pay_missing"}); !errors.Is(err, ErrUnknownPayment) {
+		t.Errorf("expected ErrUnknownPayment, got %v", err)
+	}
+}
+
+func TestHTTPGateway_Submit(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Idempotency-Key") != "pay_1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		if got["amount"] == float64(666) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "succeeded", "transaction_id": "tx_1"}`))
+	}))
+	defer srv.Close()
+	g := NewHTTPGateway(srv.URL, "")
+
+	rec := domain.IdempotencyRecord{PaymentID: "pay_1", IdempotencyKey: "key-1", MerchantID: "m1", CustomerID: "c1", Amount: 5000, Currency: "BRL"}
+	status, body, err := g.Submit(context.Background(), rec)
+	if err != nil || status != domain.StatusSucceeded || body == nil {
+		t.Fatalf("expected succeeded with a body, got %s, %v", status, err)
+	}
+	if got["idempotency_key"] != "key-1" || got["currency"] != "BRL" {
+		t.Errorf("unexpected payment body: %v", got)
+	}
+
+	rec.Amount = 666
+	if _, _, err := g.Submit(context.Background(), rec); err == nil {
+		t.Error("expected an error for a 502 from the gateway")
+	}
+}
@@ -0,0 +1,80 @@
+// Package sdnotify implements the systemd service notification protocol, so
+// Type=notify units learn when the shield is ready and that it is still
+// healthy.
+package sdnotify
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state to the socket in NOTIFY_SOCKET. It reports false, with
+// no error, when the process is not run by systemd with notify support.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often to ping the systemd watchdog, half of
+// WatchdogSec, or 0 when the watchdog is off or meant for another process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// RunWatchdog pings the watchdog every interval while check passes, until
+// ctx is done. A failing check skips the ping, so systemd restarts a service
+// that stays unhealthy for longer than WatchdogSec.
+func RunWatchdog(ctx context.Context, interval time.Duration, check func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		err := check(checkCtx)
+		cancel()
+		if err != nil {
+			log.Printf("watchdog: unhealthy, skipping ping: %v", err)
+			continue
+		}
+		if _, err := Notify(Watchdog); err != nil {
+			log.Printf("watchdog: %v", err)
+		}
+	}
+}
@@ -49,7 +49,7 @@ ON CONFLICT (merchant_id) DO NOTHING;
 		b.WriteString(completedAt + ", ")
 		b.WriteString(ts + " + INTERVAL '24 hours', ")
 		b.WriteString(responseBody)
-		b.WriteString(") ON CONFLICT (idempotency_key) DO NOTHING;\n")
+		b.WriteString(") ON CONFLICT (environment, idempotency_key) DO NOTHING;\n")
 	}
 
 	currencies := []struct{ merchant, currency string }{
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// RestoreStore keeps what admin key actions changed on their keys' rows, so
+// they can be undone.
+type RestoreStore interface {
+	// SaveRestorePoint keeps prior, the record as the action found it, on
+	// key's row until until, or returns domain.ErrConcurrentUpdate when the
+	// row moved on past the action.
+	SaveRestorePoint(ctx context.Context, key, action string, prior domain.IdempotencyRecord, until time.Time) error
+	// RestoreKey undoes key's last admin action, or returns
+	// domain.ErrNothingToRestore or domain.ErrKeyReused.
+	RestoreKey(ctx context.Context, key string) error
+}
+
+// WithRestores keeps a restore point for every admin key action, so
+// RestoreKey can undo it for window.
+func (s *IdempotencyService) WithRestores(store RestoreStore, window time.Duration) *IdempotencyService {
+	s.restores = store
+	s.restoreWindow = window
+	return s
+}
+
+// RestoresEnabled reports whether admin key actions can be undone.
+func (s *IdempotencyService) RestoresEnabled() bool {
+	return s.restores != nil
+}
+
+// ExpireKey expires key now, so its next payment is accepted as new the way
+// it would be once the key's TTL ran out. src is who asked, for the audit
+// trail.
+func (s *IdempotencyService) ExpireKey(ctx context.Context, key string, src domain.AttemptSource) error {
+	return s.keyAction(ctx, key, src, domain.AuditKeyExpired, func(ctx context.Context, _ *domain.IdempotencyRecord) error {
+		return s.repo.ExpireKey(ctx, key)
+	})
+}
+
+// ForceFailKey fails key while it is processing, as a failed completion
+// would: waiters wake and a retry with the same parameters is accepted. A key
+// that already completed returns domain.ErrAlreadyCompleted.
+func (s *IdempotencyService) ForceFailKey(ctx context.Context, key string, src domain.AttemptSource) error {
+	return s.keyAction(ctx, key, src, domain.AuditKeyForceFailed, func(ctx context.Context, _ *domain.IdempotencyRecord) error {
+		if err := s.repo.MarkComplete(ctx, key, domain.StatusFailed, domain.StoredResponse{}); err != nil {
+			return err
+		}
+		s.hub.Publish(key)
+		return nil
+	})
+}
+
+// ResetKey fails key and expires it in place, so its next payment is
+// accepted as new while the key and its attempts stay traceable until the
+// sweeper deletes or archives them. A key that changed since keyAction read
+// it returns domain.ErrConcurrentUpdate. Waiters wake to find it failed.
+func (s *IdempotencyService) ResetKey(ctx context.Context, key string, src domain.AttemptSource) error {
+	return s.keyAction(ctx, key, src, domain.AuditKeyReset, func(ctx context.Context, rec *domain.IdempotencyRecord) error {
+		if err := s.repo.ResetKey(ctx, key, rec.Version); err != nil {
+			return err
+		}
+		s.hub.Publish(key)
+		return nil
+	})
+}
+
+// RestoreKey undoes key's last admin action within the restore window: the
+// key gets back the status, completion and expiry it had before. A key a
+// payment used since returns domain.ErrKeyReused rather than overwriting
+// that payment, and one with no action left to undo
+// domain.ErrNothingToRestore.
+func (s *IdempotencyService) RestoreKey(ctx context.Context, key string, src domain.AttemptSource) error {
+	return s.keyAction(ctx, key, src, domain.AuditKeyRestored, func(ctx context.Context, _ *domain.IdempotencyRecord) error {
+		return s.restores.RestoreKey(ctx, key)
+	})
+}
+
+// keyAction runs an admin action on key's record and, when it succeeds, logs
+// it and records it to the audit sink with the record as it was before. The
+// action is handed the record it read, so it can compare and swap on its
+// version; a key that does not exist returns domain.ErrKeyNotFound. Every
+// action but a restore keeps that record as the key's restore point.
+func (s *IdempotencyService) keyAction(ctx context.Context, key string, src domain.AttemptSource, kind string, action func(context.Context, *domain.IdempotencyRecord) error) error {
+	ctx, fields := logging.NewContext(ctx)
+	fields.KeyHash = logging.HashKey(key)
+	rec, err := s.repo.GetByKeyPrimary(ctx, key)
+	if err != nil {
+		return err
+	}
+	fields.MerchantID = rec.MerchantID
+	if err := action(ctx, rec); err != nil {
+		return err
+	}
+	logging.From(ctx).Infof("admin action %s on key in status %s", kind, rec.Status)
+	if s.restores != nil && kind != domain.AuditKeyRestored {
+		// The action stands without a restore point; it only cannot be undone.
+		if err := s.restores.SaveRestorePoint(ctx, key, kind, *rec, time.Now().Add(s.restoreWindow)); err != nil {
+			logging.From(ctx).Warnf("admin action %s: no restore point kept: %v", kind, err)
+		}
+	}
+
+	if s.audit != nil {
+		s.audit.Record(domain.AuditEvent{
+			Kind:         kind,
+			Time:         time.Now().UTC(),
+			MerchantID:   rec.MerchantID,
+			KeyHash:      fields.KeyHash,
+			PaymentID:    rec.PaymentID,
+			Status:       rec.Status,
+			AttemptCount: rec.AttemptCount,
+			SourceIP:     src.IP,
+			UserAgent:    src.UserAgent,
+			RequestID:    src.RequestID,
+		})
+	}
+	return nil
+}
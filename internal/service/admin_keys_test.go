@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+)
+
+// auditLog is an AuditSink that keeps what it is given.
+type auditLog struct {
+	mu     sync.Mutex
+	events []domain.AuditEvent
+}
+
+func (a *auditLog) Record(ev domain.AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, ev)
+}
+
+func (a *auditLog) kinds(kind string) []domain.AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []domain.AuditEvent
+	for _, ev := range a.events {
+		if ev.Kind == kind {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func adminKeyRequest(key string) domain.PaymentRequest {
+	return domain.PaymentRequest{IdempotencyKey: key, MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+}
+
+var supportDesk = domain.AttemptSource{IP: "10.9.9.9", UserAgent: "curl", RequestID: "req-support"}
+
+func TestForceFailKey_UnsticksProcessingKey(t *testing.T) {
+	audit := &auditLog{}
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithAudit(audit)
+	ctx := context.Background()
+	req := adminKeyRequest("stuck-1")
+	svc.ProcessPayment(ctx, req)
+
+	if err := svc.ForceFailKey(ctx, "stuck-1", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := svc.ProcessPayment(ctx, req); code != 201 {
+		t.Errorf("expected the retry accepted after a forced failure, got %d", code)
+	}
+	events := audit.kinds(domain.AuditKeyForceFailed)
+	if len(events) != 1 {
+		t.Fatalf("expected one audit event, got %+v", audit.events)
+	}
+	if ev := events[0]; ev.MerchantID != "merchant-1" || ev.Status != domain.StatusProcessing || ev.SourceIP != "10.9.9.9" || ev.RequestID != "req-support" || ev.KeyHash == "" {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+
+	svc.MarkComplete(ctx, "stuck-1", domain.CompleteRequest{Status: domain.StatusSucceeded})
+	if err := svc.ForceFailKey(ctx, "stuck-1", supportDesk); err != domain.ErrAlreadyCompleted {
+		t.Errorf("expected ErrAlreadyCompleted, got %v", err)
+	}
+	if n := len(audit.kinds(domain.AuditKeyForceFailed)); n != 1 {
+		t.Errorf("a refused action should not be audited, got %d events", n)
+	}
+}
+
+func TestExpireKey_NextPaymentStartsAfresh(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	ctx := context.Background()
+	req := adminKeyRequest("stuck-2")
+	svc.ProcessPayment(ctx, req)
+
+	if err := svc.ExpireKey(ctx, "stuck-2", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	resp, code, err := svc.ProcessPayment(ctx, req)
+	if err != nil || code != 201 || resp.Code != string(i18n.MsgExpiredKeyReused) {
+		t.Errorf("expected the expired key reused, got %d %+v %v", code, resp, err)
+	}
+}
+
+func TestResetKey_FailsKeyInPlace(t *testing.T) {
+	audit := &auditLog{}
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithAudit(audit)
+	ctx := context.Background()
+	req := adminKeyRequest("stuck-3")
+	svc.ProcessPayment(ctx, req)
+
+	if err := svc.ResetKey(ctx, "stuck-3", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := svc.GetPayment(ctx, "stuck-3")
+	if err != nil || resp.Status != domain.StatusFailed {
+		t.Errorf("expected the key kept and failed, got %+v %v", resp, err)
+	}
+	if events := audit.kinds(domain.AuditKeyReset); len(events) != 1 || events[0].MerchantID != "merchant-1" {
+		t.Errorf("expected the reset attributed to its merchant, got %+v", events)
+	}
+	reused, code, err := svc.ProcessPayment(ctx, req)
+	if err != nil || code != 201 || reused.Code != string(i18n.MsgExpiredKeyReused) {
+		t.Errorf("expected the reset key reused, got %d %+v %v", code, reused, err)
+	}
+	if err := svc.ResetKey(ctx, "missing", supportDesk); err != domain.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+// movingRepo moves a key's version on between keyAction's read and its
+// action, as a concurrent payment would.
+type movingRepo struct{ *mockRepo }
+
+func (r movingRepo) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	rec, err := r.mockRepo.GetByKeyPrimary(ctx, key)
+	if err == nil {
+		r.mu.Lock()
+		r.records[key].Version++
+		r.mu.Unlock()
+	}
+	return rec, err
+}
+
+func TestResetKey_RefusesKeyChangedSinceRead(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(movingRepo{repo}, 24*time.Hour)
+	ctx := context.Background()
+	svc.ProcessPayment(ctx, adminKeyRequest("stuck-4"))
+
+	if err := svc.ResetKey(ctx, "stuck-4", supportDesk); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate, got %v", err)
+	}
+	if rec := repo.records["stuck-4"]; rec.Status != domain.StatusProcessing {
+		t.Errorf("expected the key left processing, got %s", rec.Status)
+	}
+}
+
+// restorePoints is a RestoreStore over a mockRepo's records.
+type restorePoints struct {
+	repo   *mockRepo
+	points map[string]domain.IdempotencyRecord
+}
+
+func (p *restorePoints) SaveRestorePoint(_ context.Context, key, _ string, prior domain.IdempotencyRecord, _ time.Time) error {
+	p.repo.mu.Lock()
+	defer p.repo.mu.Unlock()
+	if rec, ok := p.repo.records[key]; !ok || rec.Version != prior.Version+1 {
+		return domain.ErrConcurrentUpdate
+	}
+	p.points[key] = prior
+	return nil
+}
+
+func (p *restorePoints) RestoreKey(_ context.Context, key string) error {
+	p.repo.mu.Lock()
+	defer p.repo.mu.Unlock()
+	prior, ok := p.points[key]
+	if !ok {
+		return domain.ErrNothingToRestore
+	}
+	rec := p.repo.records[key]
+	if rec.Version != prior.Version+1 {
+		return domain.ErrKeyReused
+	}
+	rec.Status, rec.CompletedAt, rec.ExpiresAt = prior.Status, prior.CompletedAt, prior.ExpiresAt
+	rec.Version++
+	delete(p.points, key)
+	return nil
+}
+
+func TestRestoreKey_UndoesAdminAction(t *testing.T) {
+	audit := &auditLog{}
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithAudit(audit).
+		WithRestores(&restorePoints{repo: repo, points: map[string]domain.IdempotencyRecord{}}, 24*time.Hour)
+	ctx := context.Background()
+	req := adminKeyRequest("stuck-5")
+	svc.ProcessPayment(ctx, req)
+
+	if err := svc.ResetKey(ctx, "stuck-5", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RestoreKey(ctx, "stuck-5", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	if rec := repo.records["stuck-5"]; rec.Status != domain.StatusProcessing || !rec.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected the key processing and unexpired again, got %s %v", rec.Status, rec.ExpiresAt)
+	}
+	events := audit.kinds(domain.AuditKeyRestored)
+	if len(events) != 1 || events[0].Status != domain.StatusFailed || events[0].RequestID != "req-support" {
+		t.Errorf("expected the restore audited with the status it undid, got %+v", events)
+	}
+	if err := svc.RestoreKey(ctx, "stuck-5", supportDesk); err != domain.ErrNothingToRestore {
+		t.Errorf("expected ErrNothingToRestore once restored, got %v", err)
+	}
+
+	// A payment reusing the expired key is not overwritten.
+	if err := svc.ExpireKey(ctx, "stuck-5", supportDesk); err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := svc.ProcessPayment(ctx, req); code != 201 {
+		t.Fatalf("expected the expired key reused, got %d", code)
+	}
+	if err := svc.RestoreKey(ctx, "stuck-5", supportDesk); err != domain.ErrKeyReused {
+		t.Errorf("expected ErrKeyReused, got %v", err)
+	}
+	if n := len(audit.kinds(domain.AuditKeyRestored)); n != 1 {
+		t.Errorf("a refused restore should not be audited, got %d events", n)
+	}
+}
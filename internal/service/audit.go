@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// AuditSink receives audit events. Record must not block the request.
+type AuditSink interface {
+	Record(domain.AuditEvent)
+}
+
+// WithAudit records every payment attempt and completion to sink.
+func (s *IdempotencyService) WithAudit(sink AuditSink) *IdempotencyService {
+	s.audit = sink
+	return s
+}
+
+// auditAttempt records one attempt at a key, new or duplicate, with the
+// status the key had when it arrived.
+func (s *IdempotencyService) auditAttempt(req domain.PaymentRequest, rec *domain.IdempotencyRecord) {
+	if s.audit == nil {
+		return
+	}
+	s.audit.Record(domain.AuditEvent{
+		Kind:         domain.AuditPaymentAttempt,
+		Time:         time.Now().UTC(),
+		MerchantID:   rec.MerchantID,
+		KeyHash:      logging.HashKey(rec.IdempotencyKey),
+		PaymentID:    rec.PaymentID,
+		Status:       rec.Status,
+		AttemptCount: rec.AttemptCount,
+		SourceIP:     req.Source.IP,
+		UserAgent:    req.Source.UserAgent,
+		RequestID:    req.Source.RequestID,
+	})
+}
+
+// auditCompletion records a completion of rec, the record Complete read
+// before it, for the merchant and payment ID the request does not carry.
+func (s *IdempotencyService) auditCompletion(ctx context.Context, rec *domain.IdempotencyRecord, status domain.Status) {
+	if s.audit == nil {
+		return
+	}
+	ev := domain.AuditEvent{
+		Kind:         domain.AuditPaymentCompleted,
+		Time:         time.Now().UTC(),
+		MerchantID:   rec.MerchantID,
+		KeyHash:      logging.HashKey(rec.IdempotencyKey),
+		PaymentID:    rec.PaymentID,
+		Status:       status,
+		AttemptCount: rec.AttemptCount,
+	}
+	if f := logging.FromContext(ctx); f != nil {
+		ev.RequestID = f.RequestID
+	}
+	s.audit.Record(ev)
+}
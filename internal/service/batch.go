@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// batchWorkers bounds the payments of one batch processed at once. Each
+// holds a database connection for its InsertOrGet, so this also bounds a
+// batch's share of the pool.
+const batchWorkers = 8
+
+// BatchResult is the ProcessPayment result for one payment of a batch.
+type BatchResult struct {
+	Response *domain.PaymentResponse
+	Code     int
+	Err      error
+}
+
+// ProcessBatch runs every request through ProcessPayment, batchWorkers at a
+// time, and returns the results in request order. Requests sharing an
+// idempotency key are processed in order by one worker, so a batch that
+// repeats a key gets the same answers as sending its payments one by one.
+func (s *IdempotencyService) ProcessBatch(ctx context.Context, reqs []domain.PaymentRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+
+	var groups [][]int
+	byKey := make(map[string]int)
+	for i, req := range reqs {
+		g, ok := byKey[req.IdempotencyKey]
+		if !ok || req.IdempotencyKey == "" {
+			g = len(groups)
+			byKey[req.IdempotencyKey] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	next := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < batchWorkers && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range next {
+				for _, i := range group {
+					resp, code, err := s.ProcessPayment(logging.CopyContext(ctx), reqs[i])
+					results[i] = BatchResult{Response: resp, Code: code, Err: err}
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		next <- group
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
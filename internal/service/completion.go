@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// waitPollInterval bounds how stale a waiter can be when the key is completed
+// by another instance, whose notifications this process never sees.
+const waitPollInterval = time.Second
+
+// CompletionHub notifies in-process waiters when an idempotency key leaves
+// the processing state.
+type CompletionHub struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// NewCompletionHub creates an empty CompletionHub.
+func NewCompletionHub() *CompletionHub {
+	return &CompletionHub{waiters: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that is closed when key is published, and a
+// function that must be called to release the subscription.
+func (h *CompletionHub) Subscribe(key string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	h.mu.Lock()
+	if h.waiters[key] == nil {
+		h.waiters[key] = make(map[chan struct{}]struct{})
+	}
+	h.waiters[key][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.waiters[key][ch]; ok {
+			delete(h.waiters[key], ch)
+			if len(h.waiters[key]) == 0 {
+				delete(h.waiters, key)
+			}
+		}
+	}
+}
+
+// Publish wakes every waiter subscribed to key.
+func (h *CompletionHub) Publish(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.waiters[key] {
+		close(ch)
+	}
+	delete(h.waiters, key)
+}
+
+// WaitForCompletion blocks until key is no longer processing, the timeout
+// elapses, or ctx is done, and returns the latest record either way. It
+// reads from the primary, so a completion it is woken for is already there.
+func (s *IdempotencyService) WaitForCompletion(ctx context.Context, key string, timeout time.Duration) (*domain.IdempotencyRecord, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.KeyHash = logging.HashKey(key)
+
+	// Subscribe before reading so a completion between the read and the
+	// wait is not missed.
+	done, release := s.hub.Subscribe(key)
+	defer release()
+
+	rec, err := s.repo.GetByKeyPrimary(ctx, key)
+	if err != nil || rec.Status != domain.StatusProcessing {
+		return rec, err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(waitPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-done:
+			return s.repo.GetByKeyPrimary(ctx, key)
+		case <-deadline.C:
+			return rec, nil
+		case <-ctx.Done():
+			return rec, nil
+		case <-poll.C:
+			if rec, err = s.repo.GetByKeyPrimary(ctx, key); err != nil || rec.Status != domain.StatusProcessing {
+				return rec, err
+			}
+		}
+	}
+}
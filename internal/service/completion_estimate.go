@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+const (
+	// completionLatencyWindow is how far back a merchant's completions are
+	// looked at to estimate how long processing takes.
+	completionLatencyWindow = 7 * 24 * time.Hour
+	// completionLatencyTTL is how long a merchant's estimate is reused
+	// before it is read again.
+	completionLatencyTTL = 5 * time.Minute
+	// minCompletionSamples is the fewest completions an estimate is based on.
+	minCompletionSamples = 10
+	// maxProcessingRetryAfter caps the backoff suggested from an estimate.
+	maxProcessingRetryAfter = time.Minute
+)
+
+// CompletionLatencyStore reports how long a merchant's payments usually
+// take to complete.
+type CompletionLatencyStore interface {
+	CompletionLatency(ctx context.Context, merchantID string, since time.Time) (time.Duration, int, error)
+}
+
+type cachedLatency struct {
+	latency  time.Duration // zero when there are too few completions
+	loadedAt time.Time
+}
+
+// completionEstimates caches per-merchant completion latencies.
+type completionEstimates struct {
+	store   CompletionLatencyStore
+	mu      sync.Mutex
+	entries map[string]cachedLatency
+	now     func() time.Time
+}
+
+// WithCompletionEstimates has duplicates of a key still processing carry
+// an estimated completion time, derived from the merchant's recent
+// completion latency, and a Retry-After to match.
+func (s *IdempotencyService) WithCompletionEstimates(store CompletionLatencyStore) *IdempotencyService {
+	s.estimates = &completionEstimates{store: store, entries: make(map[string]cachedLatency), now: time.Now}
+	return s
+}
+
+// estimateCompletion sets resp's estimated completion time and retry hint
+// for rec, which is still processing. Keys past the estimate, and merchants
+// without enough history, get no estimate and the default hint.
+func (s *IdempotencyService) estimateCompletion(ctx context.Context, rec *domain.IdempotencyRecord, resp *domain.PaymentResponse) {
+	if s.estimates == nil {
+		return
+	}
+	latency := s.estimates.latency(ctx, rec.MerchantID)
+	if latency <= 0 {
+		return
+	}
+	now := s.estimates.now()
+	at := rec.ProcessingSince.Add(latency)
+	if !at.After(now) {
+		return
+	}
+	at = at.UTC()
+	resp.EstimatedCompletionAt = &at
+	resp.RetryAfterSeconds = int(math.Ceil(min(at.Sub(now), maxProcessingRetryAfter).Seconds()))
+}
+
+// latency returns the merchant's cached completion latency, reading it
+// again once stale. Lookup failures are logged and cached like a merchant
+// without history, so an outage doesn't add a query to every duplicate.
+func (c *completionEstimates) latency(ctx context.Context, merchantID string) time.Duration {
+	c.mu.Lock()
+	entry, ok := c.entries[merchantID]
+	c.mu.Unlock()
+	now := c.now()
+	if ok && now.Sub(entry.loadedAt) < completionLatencyTTL {
+		return entry.latency
+	}
+
+	entry = cachedLatency{loadedAt: now}
+	latency, n, err := c.store.CompletionLatency(ctx, merchantID, now.Add(-completionLatencyWindow))
+	switch {
+	case err != nil:
+		logging.From(ctx).Warnf("completion latency: %v", err)
+	case n >= minCompletionSamples:
+		entry.latency = latency
+	}
+
+	c.mu.Lock()
+	c.entries[merchantID] = entry
+	c.mu.Unlock()
+	return entry.latency
+}
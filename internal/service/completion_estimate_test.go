@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type fakeLatencyStore struct {
+	latency time.Duration
+	samples int
+	err     error
+	calls   int
+}
+
+func (f *fakeLatencyStore) CompletionLatency(context.Context, string, time.Time) (time.Duration, int, error) {
+	f.calls++
+	return f.latency, f.samples, f.err
+}
+
+func TestProcessPayment_EstimatesCompletionOfProcessingKey(t *testing.T) {
+	repo := newMockRepo()
+	store := &fakeLatencyStore{latency: 30 * time.Second, samples: 50}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithCompletionEstimates(store)
+	req := domain.PaymentRequest{IdempotencyKey: "slow-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	svc.ProcessPayment(context.Background(), req)
+
+	repo.mu.Lock()
+	since := time.Now().Add(-10 * time.Second)
+	repo.records["slow-key"].ProcessingSince = since
+	repo.mu.Unlock()
+
+	resp, code, _ := svc.ProcessPayment(context.Background(), req)
+	if code != 409 || resp.EstimatedCompletionAt == nil {
+		t.Fatalf("expected a 409 with an estimate, got %d %+v", code, resp)
+	}
+	if want := since.Add(30 * time.Second); !resp.EstimatedCompletionAt.Equal(want) {
+		t.Errorf("expected completion at %s, got %s", want, resp.EstimatedCompletionAt)
+	}
+	if resp.RetryAfterSeconds < 19 || resp.RetryAfterSeconds > 20 {
+		t.Errorf("expected about 20s to wait, got %d", resp.RetryAfterSeconds)
+	}
+
+	svc.ProcessPayment(context.Background(), req)
+	if store.calls != 1 {
+		t.Errorf("expected the merchant's latency read once, got %d reads", store.calls)
+	}
+}
+
+func TestProcessPayment_NoEstimateWithoutHistory(t *testing.T) {
+	for name, store := range map[string]*fakeLatencyStore{
+		"too few completions": {latency: 30 * time.Second, samples: minCompletionSamples - 1},
+		"lookup failure":      {err: errors.New("db down")},
+		"already overdue":     {latency: time.Millisecond, samples: 50},
+	} {
+		t.Run(name, func(t *testing.T) {
+			svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithCompletionEstimates(store)
+			req := domain.PaymentRequest{IdempotencyKey: "key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+			svc.ProcessPayment(context.Background(), req)
+			time.Sleep(2 * time.Millisecond)
+
+			resp, code, _ := svc.ProcessPayment(context.Background(), req)
+			if code != 409 || resp.EstimatedCompletionAt != nil || resp.RetryAfterSeconds != 0 {
+				t.Errorf("expected a 409 without an estimate, got %d %+v", code, resp)
+			}
+		})
+	}
+}
+
+func TestEstimateCompletion_CapsRetryAfter(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).
+		WithCompletionEstimates(&fakeLatencyStore{latency: time.Hour, samples: 50})
+	rec := &domain.IdempotencyRecord{MerchantID: "merchant-1", ProcessingSince: time.Now()}
+	var resp domain.PaymentResponse
+	svc.estimateCompletion(context.Background(), rec, &resp)
+	if resp.RetryAfterSeconds != int(maxProcessingRetryAfter/time.Second) {
+		t.Errorf("expected the backoff capped at %s, got %ds", maxProcessingRetryAfter, resp.RetryAfterSeconds)
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// digestDelay is how long after midnight UTC the daily digests are generated,
+// giving in-flight requests of the previous day time to settle.
+const digestDelay = 5 * time.Minute
+
+// DigestStore persists merchant digests.
+type DigestStore interface {
+	SaveDigest(ctx context.Context, d domain.MerchantDigest) error
+	GetDigest(ctx context.Context, merchantID string, day time.Time) (*domain.MerchantDigest, error)
+}
+
+// DuplicateAlertSender delivers a merchant's duplicate alert to its webhook.
+type DuplicateAlertSender interface {
+	SendDuplicateAlert(ctx context.Context, url string, alert domain.DuplicateAlert) error
+}
+
+// WithDigests enables storing and serving daily merchant digests.
+func (s *ReportingService) WithDigests(store DigestStore) *ReportingService {
+	s.digests = store
+	return s
+}
+
+// WithDuplicateAlerts sends merchants' duplicate alerts while the daily
+// digests are generated. These are the merchants' own alerts, unrelated to
+// the deployment-wide anomaly detection.
+func (s *ReportingService) WithDuplicateAlerts(sender DuplicateAlertSender) *ReportingService {
+	s.alerts = sender
+	return s
+}
+
+// GetDigest returns the digest for a merchant and UTC day, generating and
+// storing it on first request. Days that have not ended yet are rejected.
+func (s *ReportingService) GetDigest(ctx context.Context, merchantID string, day time.Time) (*domain.MerchantDigest, error) {
+	day = truncateDay(day)
+	if !day.Before(truncateDay(s.now())) {
+		return nil, domain.ErrDigestNotReady
+	}
+
+	if s.digests != nil {
+		d, err := s.digests.GetDigest(ctx, merchantID, day)
+		if !errors.Is(err, domain.ErrDigestNotFound) {
+			return d, err
+		}
+	}
+	return s.GenerateDigest(ctx, merchantID, day)
+}
+
+// GenerateDigest computes a merchant's digest for a UTC day and stores it
+// when a DigestStore is configured.
+func (s *ReportingService) GenerateDigest(ctx context.Context, merchantID string, day time.Time) (*domain.MerchantDigest, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = merchantID
+
+	day = truncateDay(day)
+	from, to := day, day.Add(24*time.Hour-time.Nanosecond)
+
+	total, unique, err := s.repo.GetMerchantStats(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	duplicates, _, err := s.repo.GetDuplicates(ctx, merchantID, from, to, domain.Page{})
+	if err != nil {
+		return nil, err
+	}
+
+	d := domain.MerchantDigest{
+		MerchantID:        merchantID,
+		Date:              day.Format("2006-01-02"),
+		TotalRequests:     total,
+		DuplicatesBlocked: total - unique,
+		AmountProtected:   make(map[string]int64),
+		NewSuspiciousKeys: []string{},
+		GeneratedAt:       s.now().UTC(),
+	}
+	for _, dup := range duplicates {
+		d.AmountProtected[dup.Currency] += dup.Amount * int64(dup.AttemptCount-1)
+	}
+	for _, k := range suspiciousKeys(duplicates, s.amountDistribution(ctx, merchantID, to)) {
+		d.NewSuspiciousKeys = append(d.NewSuspiciousKeys, k.IdempotencyKey)
+	}
+	sort.Strings(d.NewSuspiciousKeys)
+	d.Normalized = s.normalize(ctx, merchantID, d.AmountProtected)
+
+	if s.digests != nil {
+		if err := s.digests.SaveDigest(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+// GenerateDigests stores the digest of every merchant active on a UTC day
+// and sends the duplicate alerts the digests trigger.
+func (s *ReportingService) GenerateDigests(ctx context.Context, day time.Time) (int, error) {
+	day = truncateDay(day)
+	stats, err := s.repo.GetAllMerchantStats(ctx, day, day.Add(24*time.Hour-time.Nanosecond))
+	if err != nil {
+		return 0, err
+	}
+	merchants := make([]string, 0, len(stats))
+	for id := range stats {
+		merchants = append(merchants, id)
+	}
+	sort.Strings(merchants)
+
+	for i, id := range merchants {
+		d, err := s.GenerateDigest(ctx, id, day)
+		if err != nil {
+			return i, err
+		}
+		s.alertDuplicates(ctx, d)
+	}
+	return len(merchants), nil
+}
+
+// alertDuplicates posts a DuplicateAlert when d counts more duplicates than
+// its merchant's threshold. The sender retries and dead-letters failed
+// deliveries; failures are logged and never stop the digest run.
+func (s *ReportingService) alertDuplicates(ctx context.Context, d *domain.MerchantDigest) {
+	if s.alerts == nil {
+		return
+	}
+	policy, err := s.repo.GetPolicy(ctx, d.MerchantID)
+	if err != nil {
+		if !errors.Is(err, domain.ErrMerchantNotFound) {
+			log.Printf("digest: %s: duplicate alert policy lookup failed: %v", d.MerchantID, err)
+		}
+		return
+	}
+	if policy.DuplicateAlertThreshold <= 0 || policy.DuplicateAlertURL == "" || d.DuplicatesBlocked <= policy.DuplicateAlertThreshold {
+		return
+	}
+	alert := domain.DuplicateAlert{
+		EventID:           domain.DuplicateAlertEventID(d.MerchantID, d.Date),
+		Event:             domain.DuplicateAlertEvent,
+		MerchantID:        d.MerchantID,
+		Date:              d.Date,
+		DuplicatesBlocked: d.DuplicatesBlocked,
+		Threshold:         policy.DuplicateAlertThreshold,
+		TotalRequests:     d.TotalRequests,
+	}
+	if err := s.alerts.SendDuplicateAlert(ctx, policy.DuplicateAlertURL, alert); err != nil {
+		log.Printf("digest: %s: duplicate alert: %v", d.MerchantID, err)
+		return
+	}
+	log.Printf("digest: %s: sent duplicate alert (%d > %d)", d.MerchantID, d.DuplicatesBlocked, policy.DuplicateAlertThreshold)
+}
+
+// RunDigests generates the previous day's digests at startup and shortly
+// after every UTC midnight until ctx is done.
+func (s *ReportingService) RunDigests(ctx context.Context) {
+	for {
+		yesterday := truncateDay(s.now()).Add(-24 * time.Hour)
+		n, err := s.GenerateDigests(ctx, yesterday)
+		if err != nil {
+			log.Printf("digest: %s: %v", yesterday.Format("2006-01-02"), err)
+		} else {
+			log.Printf("digest: generated %d merchant digest(s) for %s", n, yesterday.Format("2006-01-02"))
+		}
+
+		next := truncateDay(s.now()).Add(24*time.Hour + digestDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
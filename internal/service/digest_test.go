@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type memDigestStore struct {
+	saved map[string]domain.MerchantDigest
+}
+
+func (m *memDigestStore) SaveDigest(_ context.Context, d domain.MerchantDigest) error {
+	m.saved[d.MerchantID+"/"+d.Date] = d
+	return nil
+}
+
+func (m *memDigestStore) GetDigest(_ context.Context, merchantID string, day time.Time) (*domain.MerchantDigest, error) {
+	d, ok := m.saved[merchantID+"/"+day.Format("2006-01-02")]
+	if !ok {
+		return nil, domain.ErrDigestNotFound
+	}
+	return &d, nil
+}
+
+func TestGenerateDigest(t *testing.T) {
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	repo := &reportMockRepo{
+		total:  30,
+		unique: 20,
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "k-small", MerchantID: "m1", AttemptCount: 2, Amount: 500, Currency: "BRL"},
+			{IdempotencyKey: "k-storm", MerchantID: "m1", AttemptCount: 6, Amount: 1000, Currency: "BRL"},
+			{IdempotencyKey: "k-mx", MerchantID: "m1", AttemptCount: 3, Amount: 2000, Currency: "MXN"},
+		},
+	}
+	store := &memDigestStore{saved: map[string]domain.MerchantDigest{}}
+	svc := NewReportingService(repo).WithDigests(store)
+
+	d, err := svc.GenerateDigest(context.Background(), "m1", day.Add(15*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.Date != "2026-03-10" || d.TotalRequests != 30 || d.DuplicatesBlocked != 10 {
+		t.Errorf("unexpected digest: %+v", d)
+	}
+	// BRL: 500*1 + 1000*5 = 5500; MXN: 2000*2 = 4000
+	if d.AmountProtected["BRL"] != 5500 || d.AmountProtected["MXN"] != 4000 {
+		t.Errorf("unexpected amounts: %v", d.AmountProtected)
+	}
+	if len(d.NewSuspiciousKeys) != 1 || d.NewSuspiciousKeys[0] != "k-storm" {
+		t.Errorf("expected k-storm suspicious, got %v", d.NewSuspiciousKeys)
+	}
+	if _, ok := store.saved["m1/2026-03-10"]; !ok {
+		t.Error("expected digest to be stored")
+	}
+}
+
+func TestGetDigest_ServesStored(t *testing.T) {
+	store := &memDigestStore{saved: map[string]domain.MerchantDigest{
+		"m1/2026-03-10": {MerchantID: "m1", Date: "2026-03-10", TotalRequests: 99},
+	}}
+	svc := NewReportingService(&reportMockRepo{}).WithDigests(store)
+
+	d, err := svc.GetDigest(context.Background(), "m1", time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.TotalRequests != 99 {
+		t.Errorf("expected stored digest, got %+v", d)
+	}
+}
+
+func TestGetDigest_TodayNotReady(t *testing.T) {
+	svc := NewReportingService(&reportMockRepo{})
+	svc.now = func() time.Time { return time.Date(2026, 3, 10, 23, 0, 0, 0, time.UTC) }
+
+	_, err := svc.GetDigest(context.Background(), "m1", time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC))
+	if !errors.Is(err, domain.ErrDigestNotReady) {
+		t.Errorf("expected ErrDigestNotReady, got %v", err)
+	}
+}
+
+func TestGenerateDigests_AllActiveMerchants(t *testing.T) {
+	repo := &reportMockRepo{allStats: map[string][2]int{"m1": {5, 5}, "m2": {3, 2}}}
+	store := &memDigestStore{saved: map[string]domain.MerchantDigest{}}
+	svc := NewReportingService(repo).WithDigests(store)
+
+	n, err := svc.GenerateDigests(context.Background(), time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 || len(store.saved) != 2 {
+		t.Errorf("expected 2 digests, got n=%d stored=%d", n, len(store.saved))
+	}
+}
+
+type recordingAlertSender struct {
+	urls   []string
+	alerts []domain.DuplicateAlert
+}
+
+func (r *recordingAlertSender) SendDuplicateAlert(_ context.Context, url string, alert domain.DuplicateAlert) error {
+	r.urls = append(r.urls, url)
+	r.alerts = append(r.alerts, alert)
+	return nil
+}
+
+func TestGenerateDigests_DuplicateAlerts(t *testing.T) {
+	repo := &reportMockRepo{
+		total:    30,
+		unique:   18,
+		allStats: map[string][2]int{"m1": {30, 18}},
+		policy:   &domain.MerchantPolicy{MerchantID: "m1", DuplicateAlertThreshold: 10, DuplicateAlertURL: "https://merchant.example/hooks"},
+	}
+	sender := &recordingAlertSender{}
+	svc := NewReportingService(repo).WithDuplicateAlerts(sender)
+
+	if _, err := svc.GenerateDigests(context.Background(), time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := domain.DuplicateAlert{EventID: domain.DuplicateAlertEventID("m1", "2026-03-10"), Event: domain.DuplicateAlertEvent, MerchantID: "m1", Date: "2026-03-10", DuplicatesBlocked: 12, Threshold: 10, TotalRequests: 30}
+	if len(sender.alerts) != 1 || sender.alerts[0] != want || sender.urls[0] != "https://merchant.example/hooks" {
+		t.Fatalf("expected one alert %+v, got %+v to %v", want, sender.alerts, sender.urls)
+	}
+
+	// Reaching the threshold is not exceeding it.
+	repo.policy.DuplicateAlertThreshold = 12
+	sender = &recordingAlertSender{}
+	svc = NewReportingService(repo).WithDuplicateAlerts(sender)
+	svc.GenerateDigests(context.Background(), time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC))
+	if len(sender.alerts) != 0 {
+		t.Errorf("expected no alert at the threshold, got %+v", sender.alerts)
+	}
+}
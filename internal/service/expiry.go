@@ -0,0 +1,44 @@
+package service
+
+import (
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// WithMaxExpiry lets payments keep their key for up to max with
+// expiry_hours. Without it, they may only ask for the default TTL or less.
+func (s *IdempotencyService) WithMaxExpiry(max time.Duration) *IdempotencyService {
+	s.maxExpiryTTL = max
+	return s
+}
+
+// SetExpiryTTL replaces the default TTL for keys stored from now on; keys
+// already stored keep the expiry they were given.
+func (s *IdempotencyService) SetExpiryTTL(ttl time.Duration) {
+	s.expiryTTL.Store(int64(ttl))
+}
+
+// keyTTL returns how long req's key is kept: the expiry_hours it asked for,
+// or the default TTL. Asking for more than the merchant's MaxExpiryHours or
+// the deployment's maximum, whichever is lower, is a validation error.
+func (s *IdempotencyService) keyTTL(req domain.PaymentRequest, policy *domain.MerchantPolicy) (time.Duration, error) {
+	defaultTTL := time.Duration(s.expiryTTL.Load())
+	if req.ExpiryHours == 0 {
+		return defaultTTL, nil
+	}
+	limit := s.maxExpiryTTL
+	if limit == 0 {
+		limit = defaultTTL
+	}
+	if policy != nil && policy.MaxExpiryHours > 0 {
+		if l := time.Duration(policy.MaxExpiryHours) * time.Hour; l < limit {
+			limit = l
+		}
+	}
+	ttl := time.Duration(req.ExpiryHours) * time.Hour
+	if ttl > limit {
+		return 0, &domain.ValidationError{Field: "expiry_hours", Rule: "max", Max: int(limit / time.Hour)}
+	}
+	return ttl, nil
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func expiryPayment(key string, hours int) domain.PaymentRequest {
+	return domain.PaymentRequest{IdempotencyKey: key, MerchantID: "merchant-1", CustomerID: "customer-1",
+		Amount: 5000, Currency: "BRL", ExpiryHours: hours}
+}
+
+func TestProcessPayment_ExpiryHours(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithMaxExpiry(168 * time.Hour)
+	expiresIn := func(key string) time.Duration {
+		return time.Until(repo.records[key].ExpiresAt).Round(time.Hour)
+	}
+
+	svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-default", 0))
+	if got := expiresIn("key-ttl-default"); got != 24*time.Hour {
+		t.Errorf("expected the default 24h TTL, got %s", got)
+	}
+	if _, code, _ := svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-long", 168)); code != 201 {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if got := expiresIn("key-ttl-long"); got != 168*time.Hour {
+		t.Errorf("expected a 168h TTL, got %s", got)
+	}
+
+	var verr *domain.ValidationError
+	_, code, err := svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-over", 169))
+	if code != 422 || !errors.As(err, &verr) || verr.Rule != "max" || verr.Max != 168 {
+		t.Errorf("expected 422 over the deployment maximum, got %d %v", code, err)
+	}
+	if _, code, _ := svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-negative", -1)); code != 422 {
+		t.Errorf("expected 422 for negative expiry_hours, got %d", code)
+	}
+
+	// Without a maximum, only the default TTL or less may be asked for.
+	plain := NewIdempotencyService(repo, 24*time.Hour)
+	if _, code, _ := plain.ProcessPayment(context.Background(), expiryPayment("key-ttl-plain", 48)); code != 422 {
+		t.Errorf("expected 422 without a maximum, got %d", code)
+	}
+}
+
+func TestProcessPayment_ExpiryHoursMerchantMaximum(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{MaxExpiryHours: 48}}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithMaxExpiry(168 * time.Hour)
+
+	if _, code, _ := svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-48", 48)); code != 201 {
+		t.Errorf("expected 201 within the merchant's maximum, got %d", code)
+	}
+	var verr *domain.ValidationError
+	_, code, err := svc.ProcessPayment(context.Background(), expiryPayment("key-ttl-72", 72))
+	if code != 422 || !errors.As(err, &verr) || verr.Max != 48 {
+		t.Errorf("expected 422 over the merchant's maximum, got %d %v", code, err)
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// FeatureStore streams keys with their recorded attempts.
+type FeatureStore interface {
+	StreamKeyActivity(ctx context.Context, from, to time.Time, merchantID string, fn func(domain.KeyActivity) error) error
+}
+
+// FeatureService derives per-key features for model training.
+type FeatureService struct {
+	store FeatureStore
+}
+
+// NewFeatureService creates a new FeatureService.
+func NewFeatureService(store FeatureStore) *FeatureService {
+	return &FeatureService{store: store}
+}
+
+// Export calls fn with the features of every key first seen in [from, to];
+// an empty merchantID exports all merchants.
+func (s *FeatureService) Export(ctx context.Context, from, to time.Time, merchantID string, fn func(domain.KeyFeatures) error) error {
+	return s.store.StreamKeyActivity(ctx, from, to, merchantID, func(a domain.KeyActivity) error {
+		return fn(keyFeatures(a))
+	})
+}
+
+func keyFeatures(a domain.KeyActivity) domain.KeyFeatures {
+	rec := a.Record
+	f := domain.KeyFeatures{
+		KeyHash:             logging.HashKey(rec.IdempotencyKey),
+		MerchantID:          rec.MerchantID,
+		CustomerHash:        logging.HashKey(rec.CustomerID),
+		Amount:              rec.Amount,
+		Currency:            rec.Currency,
+		Outcome:             rec.Status,
+		AttemptCount:        rec.AttemptCount,
+		FirstSeenAt:         rec.FirstSeenAt.UTC(),
+		LastSeenAt:          rec.LastSeenAt.UTC(),
+		SpanSeconds:         rec.LastSeenAt.Sub(rec.FirstSeenAt).Seconds(),
+		InterAttemptSeconds: []float64{},
+		DistinctSources:     a.DistinctSources,
+		DistinctUserAgents:  a.DistinctUserAgents,
+	}
+	if f.SpanSeconds > 0 {
+		f.AttemptsPerMinute = float64(rec.AttemptCount-1) / (f.SpanSeconds / 60)
+	}
+
+	var total float64
+	f.MinIntervalSeconds = math.Inf(1)
+	for i := 1; i < len(a.AttemptTimes); i++ {
+		gap := a.AttemptTimes[i].Sub(a.AttemptTimes[i-1]).Seconds()
+		f.InterAttemptSeconds = append(f.InterAttemptSeconds, gap)
+		total += gap
+		f.MinIntervalSeconds = math.Min(f.MinIntervalSeconds, gap)
+	}
+	if n := len(f.InterAttemptSeconds); n > 0 {
+		f.MeanIntervalSeconds = total / float64(n)
+	} else {
+		f.MinIntervalSeconds = 0
+	}
+	return f
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+type activityStore []domain.KeyActivity
+
+func (s activityStore) StreamKeyActivity(_ context.Context, _, _ time.Time, _ string, fn func(domain.KeyActivity) error) error {
+	for _, a := range s {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFeatureExport(t *testing.T) {
+	first := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := activityStore{
+		{
+			Record: domain.IdempotencyRecord{
+				IdempotencyKey: "key-1", MerchantID: "merchant-1", CustomerID: "customer-1",
+				Amount: 5000, Currency: "BRL", Status: domain.StatusSucceeded, AttemptCount: 4,
+				FirstSeenAt: first, LastSeenAt: first.Add(3 * time.Minute),
+			},
+			AttemptTimes:    []time.Time{first, first.Add(30 * time.Second), first.Add(90 * time.Second), first.Add(3 * time.Minute)},
+			DistinctSources: 2,
+		},
+		{
+			Record: domain.IdempotencyRecord{IdempotencyKey: "key-2", AttemptCount: 1, FirstSeenAt: first, LastSeenAt: first},
+		},
+	}
+
+	var got []domain.KeyFeatures
+	err := NewFeatureService(store).Export(context.Background(), first, first.Add(time.Hour), "", func(f domain.KeyFeatures) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected 2 rows, got %d: %v", len(got), err)
+	}
+
+	f := got[0]
+	if f.KeyHash != logging.HashKey("key-1") || f.CustomerHash != logging.HashKey("customer-1") {
+		t.Errorf("expected hashed key and customer, got %s %s", f.KeyHash, f.CustomerHash)
+	}
+	if want := []float64{30, 60, 90}; !reflect.DeepEqual(f.InterAttemptSeconds, want) {
+		t.Errorf("expected intervals %v, got %v", want, f.InterAttemptSeconds)
+	}
+	if f.MeanIntervalSeconds != 60 || f.MinIntervalSeconds != 30 || f.SpanSeconds != 180 || f.AttemptsPerMinute != 1 {
+		t.Errorf("unexpected cadence: %+v", f)
+	}
+	if f.Outcome != domain.StatusSucceeded || f.DistinctSources != 2 {
+		t.Errorf("unexpected outcome or sources: %+v", f)
+	}
+
+	if single := got[1]; len(single.InterAttemptSeconds) != 0 || single.MinIntervalSeconds != 0 || single.AttemptsPerMinute != 0 {
+		t.Errorf("expected no intervals for a single attempt, got %+v", single)
+	}
+}
@@ -2,44 +2,122 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 	"github.com/kubo-market/idempotency-shield/internal/storage"
 )
 
 // IdempotencyService implements the core idempotency validation logic.
 type IdempotencyService struct {
-	repo      storage.Repository
-	expiryTTL time.Duration
+	repo storage.Repository
+	// expiryTTL is the default key TTL in nanoseconds; SetExpiryTTL may
+	// change it while requests are served.
+	expiryTTL      atomic.Int64
+	hub            *CompletionHub
+	schemas        *responseSchemas
+	mismatchDetail string
+	mismatches     MismatchRecorder
+	signals        SignalSink
+	signalStore    SignalStore
+	requirePolicy  bool
+	audit          AuditSink
+	// processingTimeout lets duplicates take over keys processing longer;
+	// zero never does.
+	processingTimeout time.Duration
+	reclaims          ReclaimRecorder
+	// bodyHash compares duplicates by their whole body, less hashExcluded.
+	bodyHash     bool
+	hashExcluded []string
+	// maxExpiryTTL bounds the TTL payments may ask for; zero allows only
+	// expiryTTL or less.
+	maxExpiryTTL time.Duration
+	// amountLimits bounds amounts per currency.
+	amountLimits map[string]AmountLimit
+	// estimates, when set, estimates when keys still processing complete.
+	estimates *completionEstimates
+	// reservations, when set, holds keys reserved for reservationTTL ahead
+	// of their payments.
+	reservations   ReservationStore
+	reservationTTL time.Duration
+	// restores, when set, keeps what admin key actions changed so they can
+	// be undone within restoreWindow.
+	restores      RestoreStore
+	restoreWindow time.Duration
 }
 
 // NewIdempotencyService creates a new IdempotencyService.
 func NewIdempotencyService(repo storage.Repository, expiryTTL time.Duration) *IdempotencyService {
-	return &IdempotencyService{repo: repo, expiryTTL: expiryTTL}
+	s := &IdempotencyService{repo: repo, hub: NewCompletionHub(), schemas: newResponseSchemas(), mismatchDetail: MismatchDetailMasked}
+	s.expiryTTL.Store(int64(expiryTTL))
+	return s
 }
 
 // ProcessPayment validates an incoming payment request against the idempotency state machine:
 //
 //	New key → INSERT status='processing' → 201
 //	Duplicate + processing → return 409
-//	Duplicate + succeeded → return 200 cached result
+//	Duplicate + succeeded → return 200 cached result, or the stored response
 //	Duplicate + failed + params match → reset to 'processing' → 201
 //	Duplicate + failed + params differ → return 422 mismatch
 //	Expired key → treat as new → 201
+//
+// A merchant's mismatch_behavior may let differing params win instead of the
+// 422: see acceptsMismatch.
+//
+// Resets only apply if the record is still the version this request read, so
+// a duplicate racing a completion or another reset gets 409
+// ErrConcurrentUpdate rather than acting on a stale status.
 func (s *IdempotencyService) ProcessPayment(ctx context.Context, req domain.PaymentRequest) (*domain.PaymentResponse, int, error) {
-	if err := validateRequest(req); err != nil {
+	if err := s.validateRequest(&req); err != nil {
 		return nil, 422, err
 	}
+	if err := s.hashBody(&req); err != nil {
+		return nil, 400, err
+	}
 
-	paymentID := generatePaymentID()
-	expiresAt := time.Now().Add(s.expiryTTL)
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = req.MerchantID
+	fields.KeyHash = logging.HashKey(req.IdempotencyKey)
 
-	rec, isNew, err := s.repo.InsertOrGet(ctx, req, paymentID, expiresAt)
+	policy, code, err := s.merchantPolicy(ctx, req.MerchantID)
+	if err != nil {
+		return nil, code, err
+	}
+	req.HashMetadata = policy != nil && policy.HashMetadata
+	ttl, err := s.keyTTL(req, policy)
+	if err != nil {
+		return nil, 422, err
+	}
+	reserved, code, err := s.checkReservation(ctx, req)
 	if err != nil {
-		return nil, 500, fmt.Errorf("insert or get: %w", err)
+		return nil, code, err
 	}
+	idFormat := paymentIDFormat(policy)
+	expiresAt := time.Now().Add(ttl)
+
+	var rec *domain.IdempotencyRecord
+	var isNew bool
+	_, err = withPaymentID(ctx, idFormat, func(paymentID string) error {
+		var err error
+		rec, isNew, err = s.repo.InsertOrGet(ctx, req, paymentID, expiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, repoErrorCode(err), fmt.Errorf("insert or get: %w", err)
+	}
+	if reserved {
+		s.claimReservation(ctx, req)
+	}
+	fields.PaymentID = rec.PaymentID
+	logging.From(ctx).Debugf("insert or get: new=%t status=%s attempts=%d", isNew, rec.Status, rec.AttemptCount)
+	s.detectSignals(ctx, rec, isNew)
+	s.auditAttempt(req, rec)
 
 	// New key - first time seeing this idempotency key
 	if isNew {
@@ -47,7 +125,8 @@ func (s *IdempotencyService) ProcessPayment(ctx context.Context, req domain.Paym
 			PaymentID:      rec.PaymentID,
 			IdempotencyKey: rec.IdempotencyKey,
 			Status:         domain.StatusProcessing,
-			Message:        "payment accepted for processing",
+			Code:           string(i18n.MsgPaymentAccepted),
+			Message:        i18n.Message(i18n.DefaultLanguage, i18n.MsgPaymentAccepted),
 			AttemptCount:   1,
 		}, 201, nil
 	}
@@ -56,95 +135,243 @@ func (s *IdempotencyService) ProcessPayment(ctx context.Context, req domain.Paym
 	if rec.IsExpired() {
 		// Expired: delete and treat as new
 		// The InsertOrGet already bumped attempt_count, but we reset
-		if err := s.repo.ResetToProcessing(ctx, rec.IdempotencyKey, paymentID, expiresAt); err != nil {
-			return nil, 500, fmt.Errorf("reset expired: %w", err)
+		paymentID, err := withPaymentID(ctx, idFormat, func(paymentID string) error {
+			return s.repo.ResetToProcessing(ctx, rec.IdempotencyKey, rec.Version, paymentID, expiresAt)
+		})
+		if err != nil {
+			return nil, repoErrorCode(err), fmt.Errorf("reset expired: %w", err)
 		}
+		fields.PaymentID = paymentID
 		return &domain.PaymentResponse{
 			PaymentID:      paymentID,
 			IdempotencyKey: rec.IdempotencyKey,
 			Status:         domain.StatusProcessing,
-			Message:        "expired key reused, payment accepted for processing",
+			Code:           string(i18n.MsgExpiredKeyReused),
+			Message:        i18n.Message(i18n.DefaultLanguage, i18n.MsgExpiredKeyReused),
 			AttemptCount:   rec.AttemptCount,
 		}, 201, nil
 	}
 
-	// Check parameter mismatch
-	requestHash := req.Hash()
-
 	switch rec.Status {
 	case domain.StatusProcessing:
 		// Duplicate while still processing
-		if rec.RequestHash != requestHash {
-			return nil, 422, domain.ErrParamsMismatch
+		updated := false
+		if err := s.checkParams(ctx, policy, rec, req); err != nil {
+			if !acceptsMismatch(policy, rec, req) {
+				return nil, 422, err
+			}
+			if err := s.replaceParams(ctx, rec, req); err != nil {
+				return nil, repoErrorCode(err), err
+			}
+			updated = true
 		}
-		return &domain.PaymentResponse{
+		if s.isStale(rec) {
+			return s.reclaim(ctx, rec, idFormat, expiresAt)
+		}
+		resp := &domain.PaymentResponse{
 			PaymentID:      rec.PaymentID,
 			IdempotencyKey: rec.IdempotencyKey,
 			Status:         domain.StatusProcessing,
-			Message:        "payment is already being processed",
+			Code:           string(i18n.MsgAlreadyProcessing),
+			Message:        i18n.Message(i18n.DefaultLanguage, i18n.MsgAlreadyProcessing),
 			AttemptCount:   rec.AttemptCount,
-		}, 409, nil
+		}
+		s.estimateCompletion(ctx, rec, resp)
+		if updated {
+			resp.Code = string(i18n.MsgParamsUpdated)
+			resp.Message = i18n.Message(i18n.DefaultLanguage, i18n.MsgParamsUpdated)
+			return resp, 200, nil
+		}
+		if duplicateStatusCode(policy) == 200 {
+			resp.Duplicate = true
+			return resp, 200, nil
+		}
+		return resp, 409, nil
 
 	case domain.StatusSucceeded:
-		// Already succeeded - return cached response
-		return &domain.PaymentResponse{
+		// Already succeeded - return cached response, replayed exactly when
+		// the completion stored its status
+		resp := &domain.PaymentResponse{
 			PaymentID:      rec.PaymentID,
 			IdempotencyKey: rec.IdempotencyKey,
 			Status:         domain.StatusSucceeded,
-			Message:        "payment already succeeded",
+			Code:           string(i18n.MsgAlreadySucceeded),
+			Message:        i18n.Message(i18n.DefaultLanguage, i18n.MsgAlreadySucceeded),
 			AttemptCount:   rec.AttemptCount,
 			ResponseBody:   rec.ResponseBody,
-		}, 200, nil
+		}
+		if rec.ResponseStatus != 0 {
+			stored := rec.Response()
+			resp.Replay = &stored
+			return resp, rec.ResponseStatus, nil
+		}
+		return resp, 200, nil
 
 	case domain.StatusFailed:
-		// Failed - allow retry only if params match
-		if rec.RequestHash != requestHash {
-			return nil, 422, domain.ErrParamsMismatch
-		}
-		// Reset to processing for retry
-		if err := s.repo.ResetToProcessing(ctx, rec.IdempotencyKey, paymentID, expiresAt); err != nil {
-			return nil, 500, fmt.Errorf("reset to processing: %w", err)
+		// Failed - allow retry only if params match, unless the policy accepts
+		// differing ones
+		msg := i18n.MsgRetryingFailed
+		if err := s.checkParams(ctx, policy, rec, req); err != nil {
+			if !acceptsMismatch(policy, rec, req) {
+				return nil, 422, err
+			}
+			if err := s.replaceParams(ctx, rec, req); err != nil {
+				return nil, repoErrorCode(err), err
+			}
+			msg = i18n.MsgParamsUpdated
 		}
-		return &domain.PaymentResponse{
-			PaymentID:      paymentID,
-			IdempotencyKey: rec.IdempotencyKey,
-			Status:         domain.StatusProcessing,
-			Message:        "previous attempt failed, retrying",
-			AttemptCount:   rec.AttemptCount,
-		}, 201, nil
+		return s.retry(ctx, rec, idFormat, expiresAt, msg)
 
 	default:
 		return nil, 500, fmt.Errorf("unknown status: %s", rec.Status)
 	}
 }
 
+// retry resets a completed record to processing under a new payment ID, for
+// a retry of a failed payment or one whose params replaced the record's.
+func (s *IdempotencyService) retry(ctx context.Context, rec *domain.IdempotencyRecord, idFormat string, expiresAt time.Time, msg i18n.Code) (*domain.PaymentResponse, int, error) {
+	paymentID, err := withPaymentID(ctx, idFormat, func(paymentID string) error {
+		return s.repo.ResetToProcessing(ctx, rec.IdempotencyKey, rec.Version, paymentID, expiresAt)
+	})
+	if err != nil {
+		return nil, repoErrorCode(err), fmt.Errorf("reset to processing: %w", err)
+	}
+	logging.FromContext(ctx).PaymentID = paymentID
+	return &domain.PaymentResponse{
+		PaymentID:      paymentID,
+		IdempotencyKey: rec.IdempotencyKey,
+		Status:         domain.StatusProcessing,
+		Code:           string(msg),
+		Message:        i18n.Message(i18n.DefaultLanguage, msg),
+		AttemptCount:   rec.AttemptCount,
+	}, 201, nil
+}
+
 // MarkComplete finalizes a payment with either succeeded or failed status.
 func (s *IdempotencyService) MarkComplete(ctx context.Context, key string, req domain.CompleteRequest) error {
-	if req.Status != domain.StatusSucceeded && req.Status != domain.StatusFailed {
-		return domain.ErrInvalidStatus
-	}
-	return s.repo.MarkComplete(ctx, key, req.Status, req.ResponseBody)
+	_, err := s.Complete(ctx, key, req)
+	return err
 }
 
-func validateRequest(req domain.PaymentRequest) error {
-	if req.IdempotencyKey == "" {
-		return fmt.Errorf("idempotency_key is required")
+// Complete is MarkComplete reporting whether req repeated the completion
+// the payment already has: the same status and response. A repeat changes
+// nothing and is not an error, so clients may retry completions freely;
+// only a conflicting one returns domain.ErrAlreadyCompleted.
+func (s *IdempotencyService) Complete(ctx context.Context, key string, req domain.CompleteRequest) (bool, error) {
+	if req.Status != domain.StatusSucceeded && req.Status != domain.StatusFailed {
+		return false, domain.ErrInvalidStatus
 	}
-	if req.MerchantID == "" {
-		return fmt.Errorf("merchant_id is required")
+	resp, err := storedResponse(req)
+	if err != nil {
+		return false, err
 	}
-	if req.CustomerID == "" {
-		return fmt.Errorf("customer_id is required")
+	ctx, fields := logging.NewContext(ctx)
+	fields.KeyHash = logging.HashKey(key)
+	// The record is read once, for the merchant's response schema and the
+	// audit trail, and only when either needs it.
+	var rec *domain.IdempotencyRecord
+	if req.Status == domain.StatusSucceeded || s.audit != nil {
+		if rec, err = s.repo.GetByKeyPrimary(ctx, key); err != nil {
+			return false, err
+		}
+		fields.MerchantID = rec.MerchantID
 	}
-	if req.Amount < 0 {
-		return fmt.Errorf("amount must be non-negative")
+	if err := s.validateResponse(ctx, rec, req); err != nil {
+		return false, err
 	}
-	if req.Currency == "" {
-		return fmt.Errorf("currency is required")
+	err = s.repo.MarkComplete(ctx, key, req.Status, resp)
+	if errors.Is(err, domain.ErrAlreadyCompleted) {
+		rec, getErr := s.repo.GetByKeyPrimary(ctx, key)
+		if getErr != nil {
+			return false, getErr
+		}
+		if rec.Status == req.Status && rec.Response().Equal(resp) {
+			return true, nil
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
 	}
-	return nil
+	s.hub.Publish(key)
+	s.auditCompletion(ctx, rec, req.Status)
+	return false, nil
 }
 
-func generatePaymentID() string {
-	return fmt.Sprintf("pay_%d", time.Now().UnixNano())
+// GetPayment returns the current record for an idempotency key.
+func (s *IdempotencyService) GetPayment(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.KeyHash = logging.HashKey(key)
+	return s.repo.GetByKey(ctx, key)
+}
+
+// GetAttempts returns the latest attempts recorded for an idempotency key,
+// oldest first.
+func (s *IdempotencyService) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.KeyHash = logging.HashKey(key)
+	return s.repo.GetAttempts(ctx, key)
+}
+
+// GetPaymentByID returns the record that was issued paymentID, so systems
+// that only know the payment ID can trace it back to its key.
+func (s *IdempotencyService) GetPaymentByID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.PaymentID = paymentID
+	rec, err := s.repo.GetByPaymentID(ctx, paymentID)
+	if err == nil {
+		fields.KeyHash = logging.HashKey(rec.IdempotencyKey)
+	}
+	return rec, err
+}
+
+// duplicateStatusCode returns the status code policy, the one ProcessPayment
+// loaded, sets for a duplicate of a payment still processing. Without a
+// policy, as when its lookup failed, it is the default 409.
+func duplicateStatusCode(policy *domain.MerchantPolicy) int {
+	if policy != nil && policy.DuplicateStatusCode == 200 {
+		return 200
+	}
+	return 409
+}
+
+// WithRequiredPolicy rejects payments from merchants that have no stored
+// policy, so every merchant has to be onboarded explicitly.
+func (s *IdempotencyService) WithRequiredPolicy() *IdempotencyService {
+	s.requirePolicy = true
+	return s
+}
+
+// merchantPolicy returns the merchant's policy, or nil to use the defaults.
+// A failed lookup falls back to the defaults too, unless policies are
+// required: then the payment is rejected, 403 for a merchant without one.
+func (s *IdempotencyService) merchantPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, int, error) {
+	policy, err := s.repo.GetPolicy(ctx, merchantID)
+	switch {
+	case err == nil:
+		return policy, 0, nil
+	case errors.Is(err, domain.ErrMerchantNotFound):
+		if s.requirePolicy {
+			logging.From(ctx).Infof("rejected payment from merchant without a policy")
+			return nil, 403, domain.ErrMerchantNotOnboarded
+		}
+		return nil, 0, nil
+	case s.requirePolicy:
+		return nil, repoErrorCode(err), fmt.Errorf("policy lookup: %w", err)
+	}
+	logging.From(ctx).Warnf("policy lookup failed, using defaults: %v", err)
+	return nil, 0, nil
+}
+
+// repoErrorCode maps a repository failure to an HTTP status code.
+func repoErrorCode(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrUnavailable):
+		return 503
+	case errors.Is(err, domain.ErrTimeout):
+		return 504
+	case errors.Is(err, domain.ErrConcurrentUpdate):
+		return 409
+	}
+	return 500
 }
@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
 )
 
 // mockRepo is an in-memory repository for unit tests.
@@ -36,19 +38,23 @@ func (m *mockRepo) InsertOrGet(_ context.Context, req domain.PaymentRequest, pay
 
 	now := time.Now()
 	rec := &domain.IdempotencyRecord{
-		ID:             m.nextID,
-		IdempotencyKey: req.IdempotencyKey,
-		MerchantID:     req.MerchantID,
-		CustomerID:     req.CustomerID,
-		Amount:         req.Amount,
-		Currency:       req.Currency,
-		Status:         domain.StatusProcessing,
-		RequestHash:    req.Hash(),
-		PaymentID:      paymentID,
-		AttemptCount:   1,
-		FirstSeenAt:    now,
-		LastSeenAt:     now,
-		ExpiresAt:      expiresAt,
+		ID:              m.nextID,
+		IdempotencyKey:  req.IdempotencyKey,
+		MerchantID:      req.MerchantID,
+		CustomerID:      req.CustomerID,
+		Amount:          req.Amount,
+		Currency:        req.Currency,
+		Status:          domain.StatusProcessing,
+		RequestHash:     req.Hash(),
+		BodyHash:        req.BodyHash,
+		Metadata:        req.Metadata,
+		PaymentID:       paymentID,
+		AttemptCount:    1,
+		Version:         1,
+		FirstSeenAt:     now,
+		LastSeenAt:      now,
+		ExpiresAt:       expiresAt,
+		ProcessingSince: now,
 	}
 	m.nextID++
 	m.records[req.IdempotencyKey] = rec
@@ -61,12 +67,29 @@ func (m *mockRepo) GetByKey(_ context.Context, key string) (*domain.IdempotencyR
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if rec, ok := m.records[key]; ok {
-		return rec, nil
+		cp := *rec // like a DB read, callers get a snapshot
+		return &cp, nil
 	}
 	return nil, domain.ErrKeyNotFound
 }
 
-func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Status, responseBody *json.RawMessage) error {
+func (m *mockRepo) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	return m.GetByKey(ctx, key)
+}
+
+func (m *mockRepo) GetByPaymentID(_ context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range m.records {
+		if rec.PaymentID == paymentID {
+			cp := *rec
+			return &cp, nil
+		}
+	}
+	return nil, domain.ErrPaymentNotFound
+}
+
+func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	rec, ok := m.records[key]
@@ -77,40 +100,118 @@ func (m *mockRepo) MarkComplete(_ context.Context, key string, status domain.Sta
 		return domain.ErrAlreadyCompleted
 	}
 	rec.Status = status
-	rec.ResponseBody = responseBody
+	rec.ResponseBody, rec.ResponseStatus, rec.ResponseHeaders = resp.Body, resp.Status, resp.Headers
 	now := time.Now()
 	rec.CompletedAt = &now
+	rec.Version++
 	return nil
 }
 
-func (m *mockRepo) ResetToProcessing(_ context.Context, key string, newPaymentID string, expiresAt time.Time) error {
+func (m *mockRepo) ResetToProcessing(_ context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	rec, ok := m.records[key]
-	if !ok {
-		return domain.ErrKeyNotFound
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
 	}
+	rec.Version++
 	rec.Status = domain.StatusProcessing
 	rec.PaymentID = newPaymentID
 	rec.CompletedAt = nil
 	rec.ExpiresAt = expiresAt
+	rec.ProcessingSince = time.Now()
+	return nil
+}
+
+func (m *mockRepo) UpdateParams(_ context.Context, key string, version int64, req domain.PaymentRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	rec.Version++
+	rec.CustomerID, rec.Amount, rec.Currency = req.CustomerID, req.Amount, req.Currency
+	rec.RequestHash, rec.BodyHash, rec.Metadata = req.Hash(), req.BodyHash, req.Metadata
+	return nil
+}
+
+func (m *mockRepo) ExpireKey(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok {
+		return domain.ErrKeyNotFound
+	}
+	if now := time.Now(); rec.ExpiresAt.After(now) {
+		rec.ExpiresAt = now
+	}
+	rec.Version++
 	return nil
 }
 
-func (m *mockRepo) DeleteExpired(_ context.Context) (int64, error)                    { return 0, nil }
-func (m *mockRepo) GetDuplicates(_ context.Context, _ string, _, _ time.Time) ([]domain.IdempotencyRecord, error) {
+func (m *mockRepo) ResetKey(_ context.Context, key string, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok || rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	now := time.Now()
+	rec.Status = domain.StatusFailed
+	if rec.ExpiresAt.After(now) {
+		rec.ExpiresAt = now
+	}
+	rec.Version++
+	return nil
+}
+
+func (m *mockRepo) DeleteExpired(_ context.Context, _ int) (int64, error) { return 0, nil }
+func (m *mockRepo) GetDuplicates(_ context.Context, _ string, _, _ time.Time, _ domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	return nil, 0, nil
+}
+func (m *mockRepo) StreamDuplicates(_ context.Context, _ string, _, _ time.Time, _ func(domain.IdempotencyRecord) error) error {
+	return nil
+}
+func (m *mockRepo) GetAmountAtRisk(_ context.Context, _ string, _, _ time.Time) (map[string]int64, error) {
 	return nil, nil
 }
 func (m *mockRepo) GetMerchantStats(_ context.Context, _ string, _, _ time.Time) (int, int, error) {
 	return 0, 0, nil
 }
+func (m *mockRepo) GetMerchantOutcomes(_ context.Context, _ string, _, _ time.Time) (domain.MerchantOutcomes, error) {
+	return domain.MerchantOutcomes{}, nil
+}
+func (m *mockRepo) GetDuplicateTrends(_ context.Context, _ string, _, _ time.Time, _ time.Duration) ([]domain.TrendBucket, error) {
+	return nil, nil
+}
 func (m *mockRepo) GetPolicy(_ context.Context, _ string) (*domain.MerchantPolicy, error) {
 	return nil, domain.ErrMerchantNotFound
 }
 func (m *mockRepo) UpsertPolicy(_ context.Context, _ domain.MerchantPolicy) error { return nil }
+func (m *mockRepo) ListPolicies(_ context.Context, _ domain.Page) ([]domain.MerchantPolicy, int, error) {
+	return nil, 0, nil
+}
+func (m *mockRepo) UpsertPolicies(_ context.Context, _ []domain.MerchantPolicy) error { return nil }
+func (m *mockRepo) DeletePolicy(_ context.Context, _ string) error                    { return nil }
 func (m *mockRepo) GetAllMerchantStats(_ context.Context, _, _ time.Time) (map[string][2]int, error) {
 	return nil, nil
 }
+func (m *mockRepo) GetAmountStats(_ context.Context, _ string, _, _ time.Time) (map[string]domain.AmountStats, error) {
+	return nil, nil
+}
+func (m *mockRepo) SearchRecords(_ context.Context, _ domain.RecordFilter, _ domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	return nil, 0, nil
+}
+
+func (m *mockRepo) GetAttempts(_ context.Context, key string) ([]domain.Attempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.records[key]; !ok {
+		return nil, domain.ErrKeyNotFound
+	}
+	return []domain.Attempt{}, nil
+}
 
 func TestProcessPayment_NewKey(t *testing.T) {
 	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
@@ -257,6 +358,31 @@ func TestProcessPayment_ParamsMismatch(t *testing.T) {
 	}
 }
 
+func TestProcessPayment_BodyHash(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithBodyHash([]string{"trace_id"})
+	payment := func(key, body string) domain.PaymentRequest {
+		return domain.PaymentRequest{IdempotencyKey: key, MerchantID: "merchant-1", CustomerID: "customer-1",
+			Amount: 5000, Currency: "BRL", Body: json.RawMessage(body)}
+	}
+
+	svc.ProcessPayment(context.Background(), payment("key-body-1", `{"amount":5000,"metadata":{"order":"A1"},"trace_id":"t1"}`))
+	if _, code, _ := svc.ProcessPayment(context.Background(), payment("key-body-1", `{"trace_id":"t2","metadata":{"order":"A1"},"amount":5000}`)); code != 409 {
+		t.Errorf("expected 409 for the same body in another order, got %d", code)
+	}
+	_, code, err := svc.ProcessPayment(context.Background(), payment("key-body-1", `{"amount":5000,"metadata":{"order":"A2"}}`))
+	var mismatch *domain.MismatchError
+	if code != 422 || !errors.As(err, &mismatch) || len(mismatch.Fields) != 1 || mismatch.Fields[0].Field != "body" {
+		t.Errorf("expected 422 with a body mismatch, got %d %v", code, err)
+	}
+
+	// Records stored without a body hash are compared by the field hash.
+	NewIdempotencyService(repo, 24*time.Hour).ProcessPayment(context.Background(), payment("key-body-2", `{"metadata":{"order":"A1"}}`))
+	if _, code, _ := svc.ProcessPayment(context.Background(), payment("key-body-2", `{"metadata":{"order":"A2"}}`)); code != 409 {
+		t.Errorf("expected 409 against a record without a body hash, got %d", code)
+	}
+}
+
 func TestProcessPayment_ValidationErrors(t *testing.T) {
 	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
 
@@ -293,6 +419,69 @@ func TestMarkComplete_InvalidStatus(t *testing.T) {
 	}
 }
 
+// laggingReplica is a repository whose replica reads have not caught up with
+// any write: GetByKey misses every key, while GetByKeyPrimary sees them.
+type laggingReplica struct {
+	*mockRepo
+}
+
+func (laggingReplica) GetByKey(_ context.Context, _ string) (*domain.IdempotencyRecord, error) {
+	return nil, domain.ErrKeyNotFound
+}
+
+func TestComplete_ReadsPrimaryWhileReplicaLags(t *testing.T) {
+	audit := &auditLog{}
+	svc := NewIdempotencyService(laggingReplica{newMockRepo()}, 24*time.Hour).WithAudit(audit)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "lag-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	if _, code, err := svc.ProcessPayment(ctx, req); code != 201 {
+		t.Fatalf("expected 201, got %d: %v", code, err)
+	}
+	if _, err := svc.GetPayment(ctx, "lag-1"); !errors.Is(err, domain.ErrKeyNotFound) {
+		t.Fatalf("expected the replica to lag, got %v", err)
+	}
+
+	complete := domain.CompleteRequest{Status: domain.StatusSucceeded}
+	if repeat, err := svc.Complete(ctx, "lag-1", complete); err != nil || repeat {
+		t.Fatalf("expected the new key completed at once, got repeat=%v %v", repeat, err)
+	}
+	if repeat, err := svc.Complete(ctx, "lag-1", complete); err != nil || !repeat {
+		t.Errorf("expected the repeat recognised from the primary, got repeat=%v %v", repeat, err)
+	}
+	if rec, err := svc.WaitForCompletion(ctx, "lag-1", time.Second); err != nil || rec.Status != domain.StatusSucceeded {
+		t.Errorf("expected the wait to see the completion, got %+v %v", rec, err)
+	}
+	if events := audit.kinds(domain.AuditPaymentCompleted); len(events) != 1 || events[0].MerchantID != "merchant-1" {
+		t.Errorf("expected the completion audited with its merchant, got %+v", events)
+	}
+}
+
+// primaryReads counts reads from the primary.
+type primaryReads struct {
+	*mockRepo
+	n int
+}
+
+func (r *primaryReads) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	r.n++
+	return r.mockRepo.GetByKeyPrimary(ctx, key)
+}
+
+func TestComplete_ReadsRecordOnce(t *testing.T) {
+	repo := &primaryReads{mockRepo: newMockRepo()}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithAudit(&auditLog{})
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "once-1", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	svc.ProcessPayment(ctx, req)
+
+	if _, err := svc.Complete(ctx, "once-1", domain.CompleteRequest{Status: domain.StatusSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+	if repo.n != 1 {
+		t.Errorf("expected one read for the schema and the audit, got %d", repo.n)
+	}
+}
+
 func TestProcessPayment_ConcurrentSameKey(t *testing.T) {
 	repo := newMockRepo()
 	svc := NewIdempotencyService(repo, 24*time.Hour)
@@ -367,3 +556,198 @@ func TestProcessPayment_ExpiredKey(t *testing.T) {
 		t.Errorf("unexpected message: %s", resp.Message)
 	}
 }
+
+func TestWaitForCompletion_WakesOnMarkComplete(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	ctx := context.Background()
+
+	req := domain.PaymentRequest{IdempotencyKey: "wait-1", MerchantID: "m1", CustomerID: "c1", Amount: 100, Currency: "BRL"}
+	if _, _, err := svc.ProcessPayment(ctx, req); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		svc.MarkComplete(ctx, "wait-1", domain.CompleteRequest{Status: domain.StatusSucceeded})
+	}()
+
+	start := time.Now()
+	rec, err := svc.WaitForCompletion(ctx, "wait-1", 5*time.Second)
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if rec.Status != domain.StatusSucceeded {
+		t.Errorf("expected succeeded, got %s", rec.Status)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("waiter was not woken promptly: %v", time.Since(start))
+	}
+}
+
+func TestWaitForCompletion_Timeout(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	ctx := context.Background()
+
+	req := domain.PaymentRequest{IdempotencyKey: "wait-2", MerchantID: "m1", CustomerID: "c1", Amount: 100, Currency: "BRL"}
+	svc.ProcessPayment(ctx, req)
+
+	rec, err := svc.WaitForCompletion(ctx, "wait-2", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if rec.Status != domain.StatusProcessing {
+		t.Errorf("expected still processing after timeout, got %s", rec.Status)
+	}
+}
+
+func TestCompletionHub_ReleaseUnsubscribes(t *testing.T) {
+	hub := NewCompletionHub()
+	_, release := hub.Subscribe("k")
+	release()
+	release() // idempotent
+	if len(hub.waiters) != 0 {
+		t.Errorf("expected no waiters, got %d", len(hub.waiters))
+	}
+	hub.Publish("k") // no subscribers, must not panic
+}
+
+// failingPolicyRepo fails every policy lookup.
+type failingPolicyRepo struct {
+	*mockRepo
+}
+
+func (f *failingPolicyRepo) GetPolicy(_ context.Context, _ string) (*domain.MerchantPolicy, error) {
+	return nil, domain.ErrUnavailable
+}
+
+func TestProcessPayment_RequiredPolicy(t *testing.T) {
+	req := domain.PaymentRequest{IdempotencyKey: "strict-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithRequiredPolicy()
+	if _, code, err := svc.ProcessPayment(context.Background(), req); code != 403 || !errors.Is(err, domain.ErrMerchantNotOnboarded) {
+		t.Errorf("expected 403 without a policy, got %d: %v", code, err)
+	}
+
+	onboarded := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{MerchantID: "merchant-1"}}
+	svc = NewIdempotencyService(onboarded, 24*time.Hour).WithRequiredPolicy()
+	if _, code, err := svc.ProcessPayment(context.Background(), req); code != 201 || err != nil {
+		t.Errorf("expected 201 with a policy, got %d: %v", code, err)
+	}
+
+	// An unverifiable merchant is rejected in strict mode but accepted otherwise.
+	failing := &failingPolicyRepo{mockRepo: newMockRepo()}
+	if _, code, _ := NewIdempotencyService(failing, 24*time.Hour).WithRequiredPolicy().ProcessPayment(context.Background(), req); code != 503 {
+		t.Errorf("expected 503 when the policy lookup fails, got %d", code)
+	}
+	if _, code, _ := NewIdempotencyService(failing, 24*time.Hour).ProcessPayment(context.Background(), req); code != 201 {
+		t.Errorf("expected defaults when the policy lookup fails, got %d", code)
+	}
+}
+
+// racingRepo lets another request reset the key between a duplicate's read
+// and its own reset.
+type racingRepo struct {
+	*mockRepo
+}
+
+func (r *racingRepo) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	rec, isNew, err := r.mockRepo.InsertOrGet(ctx, req, paymentID, expiresAt)
+	if err == nil && !isNew {
+		r.mockRepo.ResetToProcessing(ctx, req.IdempotencyKey, rec.Version, "pay_winner", expiresAt)
+	}
+	return rec, isNew, err
+}
+
+func TestProcessPayment_RetryLosesResetRace(t *testing.T) {
+	repo := &racingRepo{mockRepo: newMockRepo()}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	req := domain.PaymentRequest{IdempotencyKey: "race-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+
+	svc.ProcessPayment(context.Background(), req)
+	svc.MarkComplete(context.Background(), "race-key", domain.CompleteRequest{Status: domain.StatusFailed})
+
+	_, code, err := svc.ProcessPayment(context.Background(), req)
+	if code != 409 || !errors.Is(err, domain.ErrConcurrentUpdate) {
+		t.Fatalf("expected 409 ErrConcurrentUpdate, got %d: %v", code, err)
+	}
+	if rec := repo.records["race-key"]; rec.PaymentID != "pay_winner" || rec.Version != 3 {
+		t.Errorf("expected only the winning reset to apply, got %s at version %d", rec.PaymentID, rec.Version)
+	}
+}
+
+func TestProcessBatch_OrdersRepeatedKeys(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	var reqs []domain.PaymentRequest
+	for i := 0; i < 20; i++ {
+		reqs = append(reqs, domain.PaymentRequest{IdempotencyKey: fmt.Sprintf("batch-%d", i%10), MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"})
+	}
+	reqs[19].Amount = 1
+
+	results := svc.ProcessBatch(context.Background(), reqs)
+	for i, res := range results[:10] {
+		if res.Err != nil || res.Code != 201 || res.Response.IdempotencyKey != reqs[i].IdempotencyKey {
+			t.Errorf("item %d: expected 201 for the first use of its key, got %d %v", i, res.Code, res.Err)
+		}
+	}
+	for i, res := range results[10:19] {
+		if res.Err != nil || res.Code != 409 {
+			t.Errorf("item %d: expected 409 for a repeated key, got %d %v", i+10, res.Code, res.Err)
+		}
+	}
+	if !errors.Is(results[19].Err, domain.ErrParamsMismatch) || results[19].Code != 422 {
+		t.Errorf("expected a mismatch for the changed amount, got %d %v", results[19].Code, results[19].Err)
+	}
+}
+
+type reclaimCounter struct{ n int }
+
+func (c *reclaimCounter) RecordReclaimed() { c.n++ }
+
+func TestProcessPayment_ReclaimsStaleProcessing(t *testing.T) {
+	repo := newMockRepo()
+	counter := &reclaimCounter{}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithProcessingTimeout(time.Minute, counter)
+	req := domain.PaymentRequest{IdempotencyKey: "stuck-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	first, _, _ := svc.ProcessPayment(context.Background(), req)
+
+	if _, code, _ := svc.ProcessPayment(context.Background(), req); code != 409 {
+		t.Fatalf("expected a fresh processing key to stay locked, got %d", code)
+	}
+
+	repo.mu.Lock()
+	repo.records["stuck-key"].ProcessingSince = time.Now().Add(-2 * time.Minute)
+	repo.mu.Unlock()
+	changed := req
+	changed.Amount = 1
+	if _, code, _ := svc.ProcessPayment(context.Background(), changed); code != 422 {
+		t.Errorf("expected a mismatched duplicate to be rejected, got %d", code)
+	}
+	resp, code, err := svc.ProcessPayment(context.Background(), req)
+	if err != nil || code != 201 || resp.Code != string(i18n.MsgReclaimedStale) || resp.PaymentID == first.PaymentID {
+		t.Fatalf("expected the stale key reclaimed with a new payment ID, got %d %+v %v", code, resp, err)
+	}
+	if counter.n != 1 {
+		t.Errorf("expected one reclaim counted, got %d", counter.n)
+	}
+	if _, code, _ := svc.ProcessPayment(context.Background(), req); code != 409 {
+		t.Errorf("expected the reclaimed key to be processing again, got %d", code)
+	}
+}
+
+func TestProcessPayment_DuplicateStatusFromLoadedPolicy(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{DuplicateStatusCode: 200}}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	req := domain.PaymentRequest{IdempotencyKey: "dup-200-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	svc.ProcessPayment(context.Background(), req)
+
+	repo.reads = 0
+	resp, code, err := svc.ProcessPayment(context.Background(), req)
+	if err != nil || code != 200 || !resp.Duplicate {
+		t.Fatalf("expected the merchant's 200 for a processing duplicate, got %d %+v %v", code, resp, err)
+	}
+	if repo.reads != 1 {
+		t.Errorf("expected the policy read once per payment, got %d", repo.reads)
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// leaderReleaseTimeout bounds giving up leadership at shutdown.
+const leaderReleaseTimeout = 5 * time.Second
+
+// LeaderLock is a lock at most one instance holds at a time, such as a
+// Postgres session advisory lock.
+type LeaderLock interface {
+	// TryAcquire takes the lock if it is free and reports whether this
+	// instance holds it, including when it already did.
+	TryAcquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// LeadershipRecorder is told whenever this instance gains or loses
+// leadership.
+type LeadershipRecorder interface {
+	RecordLeadership(leader bool)
+}
+
+// LeaderElector decides which of several replicas runs the jobs that must
+// run once per deployment, such as the expiry sweeper. Every interval it
+// tries to take the lock, or checks it still holds it; jobs wrapped with
+// Lead run only while it does.
+type LeaderElector struct {
+	lock     LeaderLock
+	interval time.Duration
+	recorder LeadershipRecorder
+
+	mu     sync.Mutex
+	leader bool
+	// changed is closed, and replaced, whenever leader changes.
+	changed chan struct{}
+}
+
+// NewLeaderElector creates a LeaderElector that campaigns for lock every
+// interval.
+func NewLeaderElector(lock LeaderLock, interval time.Duration) *LeaderElector {
+	return &LeaderElector{lock: lock, interval: interval, changed: make(chan struct{})}
+}
+
+// WithRecorder reports leadership changes to recorder.
+func (e *LeaderElector) WithRecorder(recorder LeadershipRecorder) *LeaderElector {
+	e.recorder = recorder
+	return e
+}
+
+// IsLeader reports whether this instance currently holds the lock.
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Run campaigns at once and then on every tick until ctx is done, when it
+// releases the lock if it holds it.
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign takes or confirms the lock. An error counts as not holding it:
+// another instance may take over, and two leaders for one interval are
+// safer than none for good.
+func (e *LeaderElector) campaign(ctx context.Context) {
+	held, err := e.lock.TryAcquire(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("leader election: %v", err)
+	}
+	e.setLeader(held && err == nil)
+}
+
+func (e *LeaderElector) resign() {
+	if !e.IsLeader() {
+		return
+	}
+	e.setLeader(false)
+	ctx, cancel := context.WithTimeout(context.Background(), leaderReleaseTimeout)
+	defer cancel()
+	if err := e.lock.Release(ctx); err != nil {
+		log.Printf("leader election: %v", err)
+	}
+}
+
+func (e *LeaderElector) setLeader(leader bool) {
+	e.mu.Lock()
+	if e.leader == leader {
+		e.mu.Unlock()
+		return
+	}
+	e.leader = leader
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.mu.Unlock()
+
+	if leader {
+		log.Printf("leader election: this instance is now the leader")
+	} else {
+		log.Printf("leader election: this instance is no longer the leader")
+	}
+	if e.recorder != nil {
+		e.recorder.RecordLeadership(leader)
+	}
+}
+
+// awaitLeadership blocks until this instance leads and returns a channel
+// closed when it stops leading, or false once ctx is done.
+func (e *LeaderElector) awaitLeadership(ctx context.Context) (<-chan struct{}, bool) {
+	for ctx.Err() == nil {
+		e.mu.Lock()
+		leader, changed := e.leader, e.changed
+		e.mu.Unlock()
+		if leader {
+			return changed, true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
+	return nil, false
+}
+
+// Lead wraps job so it runs only while this instance leads: it starts when
+// leadership is gained and its context is cancelled when it is lost, to
+// start again on the next term.
+func (e *LeaderElector) Lead(job func(context.Context)) func(context.Context) {
+	return func(ctx context.Context) {
+		for {
+			lost, ok := e.awaitLeadership(ctx)
+			if !ok {
+				return
+			}
+			termCtx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				job(termCtx)
+			}()
+			select {
+			case <-lost:
+			case <-ctx.Done():
+			}
+			cancel()
+			<-done
+		}
+	}
+}
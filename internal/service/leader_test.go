@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaderLock is held while free is false; err fails the next attempt.
+type fakeLeaderLock struct {
+	mu       sync.Mutex
+	free     bool
+	err      error
+	released bool
+}
+
+func (l *fakeLeaderLock) TryAcquire(context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	return l.free, nil
+}
+
+func (l *fakeLeaderLock) Release(context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	return nil
+}
+
+func (l *fakeLeaderLock) set(free bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.free, l.err = free, err
+}
+
+type leadershipLog struct {
+	mu      sync.Mutex
+	changes []bool
+}
+
+func (r *leadershipLog) RecordLeadership(leader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, leader)
+}
+
+func TestLeaderElector_CampaignFollowsLock(t *testing.T) {
+	lock := &fakeLeaderLock{}
+	rec := &leadershipLog{}
+	e := NewLeaderElector(lock, time.Hour).WithRecorder(rec)
+	ctx := context.Background()
+
+	e.campaign(ctx)
+	if e.IsLeader() {
+		t.Fatal("expected no leadership while another instance holds the lock")
+	}
+	lock.set(true, nil)
+	e.campaign(ctx)
+	e.campaign(ctx)
+	if !e.IsLeader() {
+		t.Fatal("expected leadership once the lock is free")
+	}
+	lock.set(true, errors.New("connection reset"))
+	e.campaign(ctx)
+	if e.IsLeader() {
+		t.Fatal("expected a failed check to give up leadership")
+	}
+	if len(rec.changes) != 2 || !rec.changes[0] || rec.changes[1] {
+		t.Errorf("expected one gain and one loss recorded, got %v", rec.changes)
+	}
+}
+
+func TestLeaderElector_LeadRunsJobOnlyWhileLeading(t *testing.T) {
+	lock := &fakeLeaderLock{}
+	e := NewLeaderElector(lock, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{}, 2)
+	stopped := make(chan struct{}, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Lead(func(ctx context.Context) {
+			started <- struct{}{}
+			<-ctx.Done()
+			stopped <- struct{}{}
+		})(ctx)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("expected the job to wait for leadership")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	lock.set(true, nil)
+	e.campaign(ctx)
+	waitFor(t, started, "the job to start on gaining leadership")
+
+	lock.set(false, nil)
+	e.campaign(ctx)
+	waitFor(t, stopped, "the job to stop on losing leadership")
+
+	lock.set(true, nil)
+	e.campaign(ctx)
+	waitFor(t, started, "the job to start again on the next term")
+
+	cancel()
+	waitFor(t, stopped, "the job to stop on shutdown")
+	waitFor(t, done, "Lead to return on shutdown")
+}
+
+func TestLeaderElector_RunReleasesOnShutdown(t *testing.T) {
+	lock := &fakeLeaderLock{free: true}
+	e := NewLeaderElector(lock, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !e.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !e.IsLeader() {
+		t.Fatal("expected leadership after the first campaign")
+	}
+	cancel()
+	<-done
+	if e.IsLeader() || !lock.released {
+		t.Errorf("expected the lock released on shutdown, leader=%v released=%v", e.IsLeader(), lock.released)
+	}
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
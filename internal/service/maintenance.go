@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/storage"
+)
+
+const (
+	// analyzeModifiedRatio triggers ANALYZE once this fraction of rows changed.
+	analyzeModifiedRatio = 0.10
+	// bloatDeadRatio triggers a bloat warning above this dead-tuple fraction.
+	bloatDeadRatio = 0.20
+	// largeCleanupRows is the deletion count that triggers an immediate run.
+	largeCleanupRows = 10000
+)
+
+// TableMaintainer exposes the database housekeeping operations the job needs.
+type TableMaintainer interface {
+	TableStats(ctx context.Context) ([]storage.TableStats, error)
+	Analyze(ctx context.Context, table string) error
+}
+
+// MaintenanceJob keeps planner statistics fresh on the idempotency tables and
+// reports bloat caused by attempt_count updates and expiry deletes.
+type MaintenanceJob struct {
+	db       TableMaintainer
+	interval time.Duration
+	trigger  chan struct{}
+}
+
+// NewMaintenanceJob creates a new MaintenanceJob that runs every interval.
+func NewMaintenanceJob(db TableMaintainer, interval time.Duration) *MaintenanceJob {
+	return &MaintenanceJob{db: db, interval: interval, trigger: make(chan struct{}, 1)}
+}
+
+// Run executes the job on every tick, and after large cleanups, until ctx is done.
+func (j *MaintenanceJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-j.trigger:
+		}
+		if err := j.RunOnce(ctx); err != nil {
+			log.Printf("maintenance: %v", err)
+		}
+	}
+}
+
+// AfterCleanup schedules an immediate run when a cleanup deleted many rows.
+func (j *MaintenanceJob) AfterCleanup(deleted int64) {
+	if deleted < largeCleanupRows {
+		return
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// RunOnce analyzes tables whose statistics are stale and reports bloated ones.
+func (j *MaintenanceJob) RunOnce(ctx context.Context) error {
+	stats, err := j.db.TableStats(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ts := range stats {
+		if ts.ModifiedRatio() >= analyzeModifiedRatio {
+			if err := j.db.Analyze(ctx, ts.Table); err != nil {
+				return err
+			}
+			log.Printf("maintenance: analyzed %s (%d rows modified since last analyze)", ts.Table, ts.ModsSinceAnalyze)
+		}
+		if ratio := ts.DeadRatio(); ratio >= bloatDeadRatio {
+			log.Printf("maintenance: %s is %.0f%% dead tuples (%d dead / %d live); consider VACUUM or an online pg_repack",
+				ts.Table, ratio*100, ts.DeadTuples, ts.LiveTuples)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/storage"
+)
+
+type mockMaintainer struct {
+	stats    []storage.TableStats
+	err      error
+	analyzed []string
+}
+
+func (m *mockMaintainer) TableStats(_ context.Context) ([]storage.TableStats, error) {
+	return m.stats, m.err
+}
+
+func (m *mockMaintainer) Analyze(_ context.Context, table string) error {
+	m.analyzed = append(m.analyzed, table)
+	return nil
+}
+
+func TestMaintenanceJob_AnalyzesStaleTables(t *testing.T) {
+	m := &mockMaintainer{stats: []storage.TableStats{
+		{Table: "idempotency_keys", LiveTuples: 1000, ModsSinceAnalyze: 500},
+		{Table: "merchant_policies", LiveTuples: 1000, ModsSinceAnalyze: 5},
+	}}
+	job := NewMaintenanceJob(m, time.Hour)
+
+	if err := job.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.analyzed) != 1 || m.analyzed[0] != "idempotency_keys" {
+		t.Errorf("expected only idempotency_keys analyzed, got %v", m.analyzed)
+	}
+}
+
+func TestMaintenanceJob_StatsError(t *testing.T) {
+	m := &mockMaintainer{err: errors.New("db down")}
+	job := NewMaintenanceJob(m, time.Hour)
+
+	if err := job.RunOnce(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMaintenanceJob_AfterLargeCleanupTriggersRun(t *testing.T) {
+	m := &mockMaintainer{stats: []storage.TableStats{
+		{Table: "idempotency_keys", LiveTuples: 10, ModsSinceAnalyze: 50000},
+	}}
+	job := NewMaintenanceJob(m, time.Hour)
+
+	job.AfterCleanup(5) // too small to trigger
+	select {
+	case <-job.trigger:
+		t.Fatal("small cleanup should not trigger a run")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		job.Run(ctx)
+		close(done)
+	}()
+	job.AfterCleanup(largeCleanupRows)
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-deadline:
+			cancel()
+			t.Fatal("expected run after large cleanup")
+		case <-time.After(5 * time.Millisecond):
+		}
+		if len(job.trigger) == 0 {
+			break
+		}
+	}
+	cancel()
+	<-done
+	if len(m.analyzed) != 1 {
+		t.Errorf("expected one analyze, got %v", m.analyzed)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+const (
+	// metricsHistoryRetention is how long samples are kept.
+	metricsHistoryRetention = 30 * 24 * time.Hour
+	// MaxMetricsSamples bounds one history query.
+	MaxMetricsSamples = 5000
+)
+
+// MetricsHistoryStore persists metrics samples.
+type MetricsHistoryStore interface {
+	SaveMetricsSample(ctx context.Context, s domain.MetricsSample) error
+	ListMetricsSamples(ctx context.Context, from, to time.Time, instance string, limit int) ([]domain.MetricsSample, error)
+	DeleteMetricsSamples(ctx context.Context, before time.Time) (int64, error)
+}
+
+// MetricsHistory flushes the in-memory metrics to the database on an
+// interval, so they outlive the process, and serves the stored series.
+type MetricsHistory struct {
+	store    MetricsHistoryStore
+	metrics  *monitor.Metrics
+	instance string
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewMetricsHistory creates a MetricsHistory recording metrics as instance.
+func NewMetricsHistory(store MetricsHistoryStore, metrics *monitor.Metrics, instance string, interval time.Duration) *MetricsHistory {
+	return &MetricsHistory{store: store, metrics: metrics, instance: instance, interval: interval, now: time.Now}
+}
+
+// Run flushes on every tick until ctx is done.
+func (h *MetricsHistory) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.Flush(ctx); err != nil {
+			log.Printf("metrics history: %v", err)
+		}
+	}
+}
+
+// Flush stores the current metrics and drops samples past retention.
+func (h *MetricsHistory) Flush(ctx context.Context) error {
+	snap := h.metrics.Snapshot()
+	now := h.now().UTC()
+	err := h.store.SaveMetricsSample(ctx, domain.MetricsSample{
+		Instance:            h.instance,
+		RecordedAt:          now,
+		PeriodStart:         snap.PeriodStart,
+		TotalRequests:       snap.TotalRequests,
+		NewPayments:         snap.NewPayments,
+		DuplicateBlocked:    snap.DuplicateBlocked,
+		RetryAllowed:        snap.RetryAllowed,
+		CachedResponses:     snap.CachedResponses,
+		ParamMismatches:     snap.ParamMismatches,
+		SlowQueries:         snap.SlowQueries,
+		WindowDuplicateRate: snap.WindowDupRate,
+		LatencyP95Ms:        snap.LatencyP95Ms,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = h.store.DeleteMetricsSamples(ctx, now.Add(-metricsHistoryRetention))
+	return err
+}
+
+// Query returns up to MaxMetricsSamples samples recorded in [from, to];
+// an empty instance returns every instance's samples.
+func (h *MetricsHistory) Query(ctx context.Context, from, to time.Time, instance string) ([]domain.MetricsSample, error) {
+	return h.store.ListMetricsSamples(ctx, from, to, instance, MaxMetricsSamples)
+}
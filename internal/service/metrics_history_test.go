@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/monitor"
+)
+
+type historyStore struct {
+	samples []domain.MetricsSample
+	before  time.Time
+	limit   int
+}
+
+func (s *historyStore) SaveMetricsSample(_ context.Context, sample domain.MetricsSample) error {
+	s.samples = append(s.samples, sample)
+	return nil
+}
+
+func (s *historyStore) ListMetricsSamples(_ context.Context, from, to time.Time, instance string, limit int) ([]domain.MetricsSample, error) {
+	s.limit = limit
+	var out []domain.MetricsSample
+	for _, sample := range s.samples {
+		if sample.RecordedAt.Before(from) || sample.RecordedAt.After(to) {
+			continue
+		}
+		if instance != "" && sample.Instance != instance {
+			continue
+		}
+		out = append(out, sample)
+	}
+	return out, nil
+}
+
+func (s *historyStore) DeleteMetricsSamples(_ context.Context, before time.Time) (int64, error) {
+	s.before = before
+	return 0, nil
+}
+
+func TestMetricsHistory_FlushAndQuery(t *testing.T) {
+	store := &historyStore{}
+	metrics := monitor.NewMetrics()
+	metrics.RecordNew()
+	metrics.RecordDuplicate()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := NewMetricsHistory(store, metrics, "api-1", time.Minute)
+	h.now = func() time.Time { return now }
+
+	if err := h.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(store.samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(store.samples))
+	}
+	s := store.samples[0]
+	if s.Instance != "api-1" || s.TotalRequests != 2 || s.DuplicateBlocked != 1 || !s.RecordedAt.Equal(now) {
+		t.Errorf("unexpected sample %+v", s)
+	}
+	if want := now.Add(-metricsHistoryRetention); !store.before.Equal(want) {
+		t.Errorf("expected samples before %v dropped, got %v", want, store.before)
+	}
+
+	got, err := h.Query(context.Background(), now.Add(-time.Hour), now, "api-2")
+	if err != nil || len(got) != 0 {
+		t.Errorf("expected no samples for another instance, got %v %v", got, err)
+	}
+	got, _ = h.Query(context.Background(), now.Add(-time.Hour), now, "")
+	if len(got) != 1 || store.limit != MaxMetricsSamples {
+		t.Errorf("expected 1 sample capped at %d, got %d (limit %d)", MaxMetricsSamples, len(got), store.limit)
+	}
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// How differing values are shown in params-mismatch errors.
+const (
+	// MismatchDetailMasked shows amount and currency as-is and masks the
+	// middle of identifiers.
+	MismatchDetailMasked = "masked"
+	// MismatchDetailHashed shows short SHA-256 digests of every value, which
+	// integrators can compare with digests of their own values.
+	MismatchDetailHashed = "hashed"
+	// MismatchDetailPlain shows values unchanged.
+	MismatchDetailPlain = "plain"
+	// MismatchDetailNone names the fields without any values.
+	MismatchDetailNone = "none"
+)
+
+// WithMismatchDetail sets how differing values appear in params-mismatch
+// errors; the default is MismatchDetailMasked.
+func (s *IdempotencyService) WithMismatchDetail(mode string) *IdempotencyService {
+	s.mismatchDetail = mode
+	return s
+}
+
+// MismatchRecorder counts mismatches a merchant's tolerant_fields let through.
+type MismatchRecorder interface {
+	RecordToleratedMismatch(fields []string)
+}
+
+// WithMismatchRecorder sets where tolerated mismatches are counted.
+func (s *IdempotencyService) WithMismatchRecorder(r MismatchRecorder) *IdempotencyService {
+	s.mismatches = r
+	return s
+}
+
+// hashedFields are the body fields PaymentRequest.Hash covers. The body hash
+// leaves them out, so differences in them are still reported per field and
+// can be tolerated.
+var hashedFields = []string{"merchant_id", "customer_id", "amount", "currency"}
+
+// WithBodyHash also compares duplicates by a canonical hash of the rest of
+// their body, leaving out the excluded top-level fields, so fields the
+// shield does not compare itself, such as metadata, cannot change silently.
+// Both hashes are stored; records stored without a body hash are compared
+// by the field hash alone.
+func (s *IdempotencyService) WithBodyHash(excluded []string) *IdempotencyService {
+	s.bodyHash = true
+	s.hashExcluded = append(append([]string(nil), hashedFields...), excluded...)
+	return s
+}
+
+// hashBody sets req.BodyHash when body hashing is on and the HTTP layer kept
+// the body.
+func (s *IdempotencyService) hashBody(req *domain.PaymentRequest) error {
+	if !s.bodyHash || len(req.Body) == 0 {
+		return nil
+	}
+	hash, err := domain.CanonicalBodyHash(req.Body, s.hashExcluded)
+	if err != nil {
+		return err
+	}
+	req.BodyHash = hash
+	return nil
+}
+
+// paramDiffs lists the fields of req that differ from the stored record, with
+// raw values; metadata, when the merchant hashes it, is named without them.
+// A key reused by another merchant only reports merchant_id: the stored
+// payment belongs to someone else and none of its values may be disclosed.
+func paramDiffs(rec *domain.IdempotencyRecord, req domain.PaymentRequest) []domain.FieldDiff {
+	if rec.MerchantID != req.MerchantID {
+		return []domain.FieldDiff{{Field: "merchant_id"}}
+	}
+	var diffs []domain.FieldDiff
+	add := func(field, stored, submitted string) {
+		if stored != submitted {
+			diffs = append(diffs, domain.FieldDiff{Field: field, Stored: stored, Submitted: submitted})
+		}
+	}
+	add("customer_id", rec.CustomerID, req.CustomerID)
+	add("amount", strconv.FormatInt(rec.Amount, 10), strconv.FormatInt(req.Amount, 10))
+	add("currency", rec.Currency, req.Currency)
+	if req.HashMetadata && !bytes.Equal(domain.CanonicalMetadata(rec.Metadata), domain.CanonicalMetadata(req.Metadata)) {
+		diffs = append(diffs, domain.FieldDiff{Field: "metadata"})
+	}
+	return diffs
+}
+
+// checkParams returns nil when req matches the stored record, or differs only
+// in fields the merchant's policy tolerates; tolerated differences are logged
+// (field names only) and counted. Otherwise it returns the mismatch error; a
+// body hash mismatch is reported as field "body" and never tolerated.
+func (s *IdempotencyService) checkParams(ctx context.Context, policy *domain.MerchantPolicy, rec *domain.IdempotencyRecord, req domain.PaymentRequest) error {
+	bodyDiffers := rec.BodyHash != "" && req.BodyHash != "" && rec.BodyHash != req.BodyHash
+	if !bodyDiffers && rec.RequestHash == req.Hash() {
+		return nil
+	}
+	diffs := paramDiffs(rec, req)
+	if bodyDiffers && (len(diffs) == 0 || diffs[0].Field != "merchant_id") {
+		diffs = append(diffs, domain.FieldDiff{Field: "body"})
+	}
+	if len(diffs) == 0 {
+		return domain.ErrParamsMismatch
+	}
+
+	if fields, ok := tolerated(policy, diffs); ok {
+		logging.From(ctx).Infof("tolerated params mismatch in %s", strings.Join(fields, ", "))
+		if s.mismatches != nil {
+			s.mismatches.RecordToleratedMismatch(fields)
+		}
+		return nil
+	}
+
+	for i := range diffs {
+		if diffs[i].Field == "merchant_id" || diffs[i].Field == "body" || diffs[i].Field == "metadata" {
+			continue
+		}
+		identifier := diffs[i].Field == "customer_id"
+		diffs[i].Stored = s.renderValue(diffs[i].Stored, identifier)
+		diffs[i].Submitted = s.renderValue(diffs[i].Submitted, identifier)
+	}
+	return &domain.MismatchError{Fields: diffs}
+}
+
+// tolerated reports whether every differing field is in policy's
+// tolerant_fields, returning the field names. Without a policy, as when its
+// lookup failed, nothing is tolerated.
+func tolerated(policy *domain.MerchantPolicy, diffs []domain.FieldDiff) ([]string, bool) {
+	if policy == nil {
+		return nil, false
+	}
+	allowed := make(map[string]bool, len(policy.TolerantFields))
+	for _, f := range policy.TolerantFields {
+		if domain.IsTolerable(f) {
+			allowed[f] = true
+		}
+	}
+	fields := make([]string, len(diffs))
+	for i, d := range diffs {
+		if !allowed[d.Field] {
+			return nil, false
+		}
+		fields[i] = d.Field
+	}
+	return fields, true
+}
+
+// acceptsMismatch reports whether the merchant's mismatch_behavior lets a
+// retry with differing params replace rec's: accept_latest unless rec has
+// succeeded, and accept_if_not_completed while rec is processing. A
+// succeeded payment is never reopened, whatever the policy, since that
+// would charge it again; nor is a key reused by another merchant.
+func acceptsMismatch(policy *domain.MerchantPolicy, rec *domain.IdempotencyRecord, req domain.PaymentRequest) bool {
+	if policy == nil || rec.MerchantID != req.MerchantID {
+		return false
+	}
+	switch policy.MismatchBehavior {
+	case domain.MismatchAcceptLatest:
+		return rec.Status != domain.StatusSucceeded
+	case domain.MismatchAcceptIfNotCompleted:
+		return rec.Status == domain.StatusProcessing
+	}
+	return false
+}
+
+// replaceParams stores req's params in place of rec's, and updates rec to
+// match. The update compares versions, so of two differing retries racing
+// for the key only one wins; the other gets ErrConcurrentUpdate.
+func (s *IdempotencyService) replaceParams(ctx context.Context, rec *domain.IdempotencyRecord, req domain.PaymentRequest) error {
+	if err := s.repo.UpdateParams(ctx, rec.IdempotencyKey, rec.Version, req); err != nil {
+		return fmt.Errorf("update params: %w", err)
+	}
+	logging.From(ctx).Infof("replaced params of %s key with the latest request's", rec.Status)
+	rec.Version++
+	rec.CustomerID, rec.Amount, rec.Currency = req.CustomerID, req.Amount, req.Currency
+	rec.RequestHash, rec.BodyHash, rec.Metadata = req.Hash(), req.BodyHash, req.Metadata
+	return nil
+}
+
+func (s *IdempotencyService) renderValue(v string, identifier bool) string {
+	switch s.mismatchDetail {
+	case MismatchDetailPlain:
+		return v
+	case MismatchDetailHashed:
+		return logging.HashKey(v)
+	case MismatchDetailNone:
+		return ""
+	default:
+		if !identifier {
+			return v
+		}
+		return maskValue(v)
+	}
+}
+
+// maskValue keeps the first and last character of values long enough for
+// that to reveal little, and masks shorter ones entirely.
+func maskValue(v string) string {
+	r := []rune(v)
+	if len(r) <= 4 {
+		return strings.Repeat("*", len(r))
+	}
+	return string(r[0]) + strings.Repeat("*", len(r)-2) + string(r[len(r)-1])
+}
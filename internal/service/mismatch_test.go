@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func mismatchFields(t *testing.T, mode string, retry domain.PaymentRequest) []domain.FieldDiff {
+	t.Helper()
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	if mode != "" {
+		svc.WithMismatchDetail(mode)
+	}
+	svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "diff-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL",
+	})
+	_, _, err := svc.ProcessPayment(context.Background(), retry)
+	var mismatch *domain.MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected MismatchError, got %v", err)
+	}
+	return mismatch.Fields
+}
+
+func TestMismatchDiff_Modes(t *testing.T) {
+	retry := domain.PaymentRequest{
+		IdempotencyKey: "diff-key", MerchantID: "merchant-1", CustomerID: "customer-9", Amount: 9999, Currency: "BRL",
+	}
+	cases := map[string][]domain.FieldDiff{
+		"": {
+			{Field: "customer_id", Stored: "c********1", Submitted: "c********9"},
+			{Field: "amount", Stored: "5000", Submitted: "9999"},
+		},
+		MismatchDetailPlain: {
+			{Field: "customer_id", Stored: "customer-1", Submitted: "customer-9"},
+			{Field: "amount", Stored: "5000", Submitted: "9999"},
+		},
+		MismatchDetailNone: {
+			{Field: "customer_id"},
+			{Field: "amount"},
+		},
+	}
+	for mode, want := range cases {
+		if got := mismatchFields(t, mode, retry); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %q: got %+v, want %+v", mode, got, want)
+		}
+	}
+
+	hashed := mismatchFields(t, MismatchDetailHashed, retry)
+	if len(hashed) != 2 || hashed[1].Stored == "5000" || len(hashed[1].Stored) != 12 {
+		t.Errorf("expected hashed values, got %+v", hashed)
+	}
+}
+
+func TestMismatchDiff_OtherMerchantDisclosesNothing(t *testing.T) {
+	got := mismatchFields(t, MismatchDetailPlain, domain.PaymentRequest{
+		IdempotencyKey: "diff-key", MerchantID: "merchant-2", CustomerID: "customer-2", Amount: 1, Currency: "MXN",
+	})
+	if want := []domain.FieldDiff{{Field: "merchant_id"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// policyRepo serves a fixed merchant policy on top of mockRepo, counting
+// how often it is read.
+type policyRepo struct {
+	*mockRepo
+	policy domain.MerchantPolicy
+	reads  int
+}
+
+func (p *policyRepo) GetPolicy(_ context.Context, _ string) (*domain.MerchantPolicy, error) {
+	p.reads++
+	return &p.policy, nil
+}
+
+type toleranceCounter map[string]int
+
+func (c toleranceCounter) RecordToleratedMismatch(fields []string) {
+	for _, f := range fields {
+		c[f]++
+	}
+}
+
+func TestTolerantFields(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{TolerantFields: []string{"customer_id"}}}
+	counter := toleranceCounter{}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithMismatchRecorder(counter)
+	req := domain.PaymentRequest{IdempotencyKey: "tolerant-key", MerchantID: "merchant-1", CustomerID: "Customer-1", Amount: 5000, Currency: "BRL"}
+	svc.ProcessPayment(context.Background(), req)
+
+	retry := req
+	retry.CustomerID = "customer-1"
+	repo.reads = 0
+	if _, code, err := svc.ProcessPayment(context.Background(), retry); code != 409 || err != nil {
+		t.Errorf("expected tolerated duplicate (409), got %d: %v", code, err)
+	}
+	if counter["customer_id"] != 1 {
+		t.Errorf("expected one tolerated customer_id mismatch, got %v", counter)
+	}
+	if repo.reads != 1 {
+		t.Errorf("expected the policy read once per payment, got %d", repo.reads)
+	}
+
+	retry.Amount = 6000
+	_, code, err := svc.ProcessPayment(context.Background(), retry)
+	if code != 422 || !errors.Is(err, domain.ErrParamsMismatch) {
+		t.Errorf("expected 422 when amount also differs, got %d: %v", code, err)
+	}
+	if counter["customer_id"] != 1 {
+		t.Errorf("expected no further tolerated mismatches, got %v", counter)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo()}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	req := domain.PaymentRequest{IdempotencyKey: "meta-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000,
+		Currency: "BRL", Metadata: json.RawMessage(`{"order_id":"A1","channel":"web"}`)}
+	svc.ProcessPayment(context.Background(), req)
+	if rec, _ := svc.GetPayment(context.Background(), "meta-key"); rec == nil || string(rec.Metadata) != string(req.Metadata) {
+		t.Fatalf("expected the metadata stored with the key, got %+v", rec)
+	}
+
+	retry := req
+	retry.Metadata = json.RawMessage(`{"order_id":"A2"}`)
+	if _, code, err := svc.ProcessPayment(context.Background(), retry); code != 409 || err != nil {
+		t.Errorf("expected other metadata to be a plain duplicate (409) by default, got %d: %v", code, err)
+	}
+
+	repo.policy.HashMetadata = true
+	reordered := req
+	reordered.IdempotencyKey = "meta-key-2"
+	svc.ProcessPayment(context.Background(), reordered)
+	reordered.Metadata = json.RawMessage(`{ "channel": "web", "order_id": "A1" }`)
+	if _, code, err := svc.ProcessPayment(context.Background(), reordered); code != 409 || err != nil {
+		t.Errorf("expected reordered metadata to match (409), got %d: %v", code, err)
+	}
+	retry.IdempotencyKey = "meta-key-2"
+	_, code, err := svc.ProcessPayment(context.Background(), retry)
+	var mismatch *domain.MismatchError
+	if code != 422 || !errors.As(err, &mismatch) || !reflect.DeepEqual(mismatch.Fields, []domain.FieldDiff{{Field: "metadata"}}) {
+		t.Errorf("expected 422 naming metadata when the policy hashes it, got %d: %v", code, err)
+	}
+}
+
+func TestMetadata_Validation(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	req := domain.PaymentRequest{IdempotencyKey: "meta-invalid", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	for raw, rule := range map[string]string{
+		`["A1"]`: "object",
+		`"A1"`:   "object",
+		`{"note":"` + strings.Repeat("x", domain.MaxMetadataBytes) + `"}`: "max_size",
+	} {
+		req.Metadata = json.RawMessage(raw)
+		_, code, err := svc.ProcessPayment(context.Background(), req)
+		var verr *domain.ValidationError
+		if code != 422 || !errors.As(err, &verr) || verr.Field != "metadata" || verr.Rule != rule {
+			t.Errorf("%.20s: expected 422 metadata %s, got %d: %v", raw, rule, code, err)
+		}
+	}
+	req.Metadata = json.RawMessage(`null`)
+	if _, code, err := svc.ProcessPayment(context.Background(), req); code != 201 {
+		t.Errorf("expected null metadata to be accepted, got %d: %v", code, err)
+	}
+}
+
+func mismatchBehaviorService(behavior string) (*IdempotencyService, domain.PaymentRequest, domain.PaymentRequest) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{MismatchBehavior: behavior}}
+	req := domain.PaymentRequest{IdempotencyKey: "behavior-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	latest := req
+	latest.Amount = 7500
+	return NewIdempotencyService(repo, 24*time.Hour), req, latest
+}
+
+func TestMismatchBehavior_Reject(t *testing.T) {
+	for _, behavior := range []string{"", domain.MismatchReject} {
+		svc, req, latest := mismatchBehaviorService(behavior)
+		svc.ProcessPayment(context.Background(), req)
+		if _, code, err := svc.ProcessPayment(context.Background(), latest); code != 422 || !errors.Is(err, domain.ErrParamsMismatch) {
+			t.Errorf("%q: expected 422, got %d: %v", behavior, code, err)
+		}
+	}
+}
+
+func TestMismatchBehavior_AcceptLatest(t *testing.T) {
+	svc, req, latest := mismatchBehaviorService(domain.MismatchAcceptLatest)
+	ctx := context.Background()
+	first, _, _ := svc.ProcessPayment(ctx, req)
+
+	resp, code, err := svc.ProcessPayment(ctx, latest)
+	if err != nil || code != 200 || resp.Code != "params_updated" || resp.PaymentID != first.PaymentID {
+		t.Fatalf("expected the processing payment to take the latest params, got %d %+v %v", code, resp, err)
+	}
+	if rec, _ := svc.GetPayment(ctx, req.IdempotencyKey); rec.Amount != 7500 {
+		t.Errorf("expected the stored amount replaced, got %d", rec.Amount)
+	}
+	if _, code, _ := svc.ProcessPayment(ctx, latest); code != 409 {
+		t.Errorf("expected the latest params to be a plain duplicate now, got %d", code)
+	}
+
+	svc.MarkComplete(ctx, req.IdempotencyKey, domain.CompleteRequest{Status: domain.StatusFailed})
+	retried, code, err := svc.ProcessPayment(ctx, req)
+	if err != nil || code != 201 || retried.Code != "params_updated" || retried.PaymentID == first.PaymentID {
+		t.Fatalf("expected a failed payment retried under the latest params, got %d %+v %v", code, retried, err)
+	}
+
+	other := latest
+	other.MerchantID = "merchant-2"
+	if _, code, _ := svc.ProcessPayment(ctx, other); code != 422 {
+		t.Errorf("expected another merchant's params never to win, got %d", code)
+	}
+
+	// A succeeded payment is never charged again, whatever the params.
+	svc.MarkComplete(ctx, req.IdempotencyKey, domain.CompleteRequest{Status: domain.StatusSucceeded})
+	resp, code, err = svc.ProcessPayment(ctx, latest)
+	if err != nil || code != 200 || resp.Status != domain.StatusSucceeded || resp.PaymentID != retried.PaymentID {
+		t.Errorf("expected the succeeded payment answered from its record, got %d %+v %v", code, resp, err)
+	}
+	if rec, _ := svc.GetPayment(ctx, req.IdempotencyKey); rec.Status != domain.StatusSucceeded || rec.Amount != req.Amount || rec.PaymentID != retried.PaymentID {
+		t.Errorf("expected the succeeded record untouched, got %s %d %s", rec.Status, rec.Amount, rec.PaymentID)
+	}
+}
+
+func TestMismatchBehavior_AcceptIfNotCompleted(t *testing.T) {
+	svc, req, latest := mismatchBehaviorService(domain.MismatchAcceptIfNotCompleted)
+	ctx := context.Background()
+	svc.ProcessPayment(ctx, req)
+
+	if resp, code, err := svc.ProcessPayment(ctx, latest); err != nil || code != 200 || resp.Code != "params_updated" {
+		t.Fatalf("expected the processing payment to take the latest params, got %d %+v %v", code, resp, err)
+	}
+
+	svc.MarkComplete(ctx, req.IdempotencyKey, domain.CompleteRequest{Status: domain.StatusFailed})
+	if _, code, err := svc.ProcessPayment(ctx, req); code != 422 || !errors.Is(err, domain.ErrParamsMismatch) {
+		t.Errorf("expected a completed payment to reject other params, got %d: %v", code, err)
+	}
+	if resp, code, _ := svc.ProcessPayment(ctx, latest); code != 201 || resp.Code != "retrying_failed" {
+		t.Errorf("expected the stored params to retry as usual, got %d %+v", code, resp)
+	}
+	svc.MarkComplete(ctx, req.IdempotencyKey, domain.CompleteRequest{Status: domain.StatusSucceeded})
+	if resp, code, _ := svc.ProcessPayment(ctx, req); code != 200 || resp.Code != "already_succeeded" {
+		t.Errorf("expected a succeeded payment answered from its record, got %d %+v", code, resp)
+	}
+}
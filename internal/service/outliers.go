@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+const (
+	// outlierSigma is how many standard deviations above the merchant's mean
+	// an amount must be to count as an outlier.
+	outlierSigma = 3.0
+	// outlierMinSamples is the fewest payments in a currency for which the
+	// distribution is trusted.
+	outlierMinSamples = 30
+	// outlierLookback is the window the merchant's distribution is drawn from.
+	outlierLookback = 30 * 24 * time.Hour
+)
+
+// amountDistribution is a merchant's recent amount statistics per currency.
+type amountDistribution map[string]domain.AmountStats
+
+// amountDistribution loads the merchant's amount distribution for the
+// lookback window ending at to. Failures are logged and disable detection
+// rather than failing the report.
+func (s *ReportingService) amountDistribution(ctx context.Context, merchantID string, to time.Time) amountDistribution {
+	stats, err := s.repo.GetAmountStats(ctx, merchantID, to.Add(-outlierLookback), to)
+	if err != nil {
+		logging.From(ctx).Warnf("amount stats unavailable, outlier detection skipped: %v", err)
+		return nil
+	}
+	return stats
+}
+
+// outlier returns the z-score of amount and whether it exceeds outlierSigma.
+// Only unusually large amounts are flagged.
+func (d amountDistribution) outlier(amount int64, currency string) (float64, bool) {
+	st, ok := d[currency]
+	if !ok || st.Count < outlierMinSamples || st.StdDev == 0 {
+		return 0, false
+	}
+	z := (float64(amount) - st.Mean) / st.StdDev
+	return math.Round(z*100) / 100, z > outlierSigma
+}
+
+// suspiciousKeys selects the duplicates worth surfacing: those retried more
+// than suspiciousThreshold times, plus any whose amount is an outlier.
+func suspiciousKeys(duplicates []domain.IdempotencyRecord, dist amountDistribution) []domain.SuspiciousKey {
+	var keys []domain.SuspiciousKey
+	for _, d := range duplicates {
+		z, outlier := dist.outlier(d.Amount, d.Currency)
+		if d.AttemptCount <= suspiciousThreshold && !outlier {
+			continue
+		}
+		k := domain.SuspiciousKey{
+			IdempotencyKey:  d.IdempotencyKey,
+			MerchantID:      d.MerchantID,
+			AttemptCount:    d.AttemptCount,
+			Amount:          d.Amount,
+			Currency:        d.Currency,
+			Status:          d.Status,
+			FirstSeenAt:     d.FirstSeenAt,
+			LastSeenAt:      d.LastSeenAt,
+			HighPriority:    outlier,
+			DistinctSources: d.DistinctSources,
+			Metadata:        d.Metadata,
+		}
+		if outlier {
+			k.AmountZScore = z
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// duplicateRow flags d with the same rules as suspiciousKeys.
+func duplicateRow(d domain.IdempotencyRecord, dist amountDistribution) domain.DuplicateRow {
+	z, outlier := dist.outlier(d.Amount, d.Currency)
+	row := domain.DuplicateRow{
+		IdempotencyKey:  d.IdempotencyKey,
+		PaymentID:       d.PaymentID,
+		AttemptCount:    d.AttemptCount,
+		Amount:          d.Amount,
+		Currency:        d.Currency,
+		AmountAtRisk:    d.Amount * int64(d.AttemptCount-1),
+		Status:          d.Status,
+		FirstSeenAt:     d.FirstSeenAt.UTC(),
+		LastSeenAt:      d.LastSeenAt.UTC(),
+		DistinctSources: d.DistinctSources,
+		Suspicious:      d.AttemptCount > suspiciousThreshold || outlier,
+		HighPriority:    outlier,
+		Metadata:        d.Metadata,
+	}
+	if outlier {
+		row.AmountZScore = z
+	}
+	return row
+}
+
+// prioritize moves high-priority keys to the front, keeping the existing
+// order within each group.
+func prioritize(keys []domain.SuspiciousKey) {
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].HighPriority && !keys[j].HighPriority })
+}
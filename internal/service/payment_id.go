@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// defaultPaymentIDFormat is used when a merchant has no policy format.
+const defaultPaymentIDFormat = "pay_" + domain.PaymentIDULID
+
+// maxPaymentIDAttempts bounds how often a colliding payment ID is
+// regenerated before the request fails.
+const maxPaymentIDAttempts = 3
+
+// paymentIDFormat returns the policy's format, or the default without one.
+func paymentIDFormat(policy *domain.MerchantPolicy) string {
+	if policy != nil && policy.PaymentIDFormat != "" {
+		return policy.PaymentIDFormat
+	}
+	return defaultPaymentIDFormat
+}
+
+// withPaymentID calls write with a new payment ID in format, generating
+// another whenever the repository reports the ID is already taken. It
+// returns the ID that was written.
+func withPaymentID(ctx context.Context, format string, write func(paymentID string) error) (string, error) {
+	var err error
+	for attempt := 1; attempt <= maxPaymentIDAttempts; attempt++ {
+		paymentID := formatPaymentID(format, time.Now())
+		if err = write(paymentID); !errors.Is(err, domain.ErrPaymentIDConflict) {
+			return paymentID, err
+		}
+		logging.From(ctx).Warnf("payment ID collision (attempt %d), regenerating", attempt)
+	}
+	return "", err
+}
+
+// formatPaymentID fills the placeholder of a valid format.
+func formatPaymentID(format string, now time.Time) string {
+	switch {
+	case strings.Contains(format, domain.PaymentIDULID):
+		return strings.Replace(format, domain.PaymentIDULID, newULID(now), 1)
+	case strings.Contains(format, domain.PaymentIDUUID):
+		return strings.Replace(format, domain.PaymentIDUUID, newUUID(), 1)
+	}
+	return strings.Replace(format, domain.PaymentIDNanos, strconv.FormatInt(now.UnixNano(), 10), 1)
+}
+
+// crockford is the ULID alphabet.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of milliseconds then 80 random bits, as 26
+// Crockford base32 characters, so IDs sort by creation time.
+func newULID(now time.Time) string {
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	var out [26]byte
+	// 128 bits in 26 characters: the first carries the top 3 bits.
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestFormatPaymentID(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		format  string
+		pattern string
+	}{
+		{"pay_<nanos>", `^pay_\d+$`},
+		{"kubo_<ulid>", `^kubo_[0-9A-HJKMNP-TV-Z]{26}$`},
+		{"<uuid>", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"br-<nanos>-x", `^br-\d+-x$`},
+	}
+	for _, tt := range tests {
+		got := formatPaymentID(tt.format, now)
+		if !regexp.MustCompile(tt.pattern).MatchString(got) {
+			t.Errorf("formatPaymentID(%q) = %q, want match for %s", tt.format, got, tt.pattern)
+		}
+	}
+}
+
+func TestNewULID_SortsByTime(t *testing.T) {
+	earlier := newULID(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	later := newULID(time.Date(2026, 3, 1, 0, 0, 0, int(time.Millisecond), time.UTC))
+	if earlier >= later {
+		t.Errorf("expected %s < %s", earlier, later)
+	}
+}
+
+func TestProcessPayment_PolicyPaymentIDFormat(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{PaymentIDFormat: "kubo_<ulid>"}}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	rec, code, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "format-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL",
+	})
+	if err != nil || code != 201 {
+		t.Fatalf("expected 201, got %d: %v", code, err)
+	}
+	if !strings.HasPrefix(rec.PaymentID, "kubo_") || len(rec.PaymentID) != len("kubo_")+26 {
+		t.Errorf("expected kubo_<ulid> payment ID, got %q", rec.PaymentID)
+	}
+}
+
+func TestProcessPayment_DefaultPaymentIDFormat(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	rec, _, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "default-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rec.PaymentID, "pay_") || len(rec.PaymentID) != len("pay_")+26 {
+		t.Errorf("expected default pay_<ulid>, got %q", rec.PaymentID)
+	}
+}
+
+// collidingRepo reports the first conflicts payment IDs as already taken.
+type collidingRepo struct {
+	*mockRepo
+	conflicts int
+	tried     []string
+}
+
+func (c *collidingRepo) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	c.tried = append(c.tried, paymentID)
+	if len(c.tried) <= c.conflicts {
+		return nil, false, domain.ErrPaymentIDConflict
+	}
+	return c.mockRepo.InsertOrGet(ctx, req, paymentID, expiresAt)
+}
+
+func TestProcessPayment_RegeneratesCollidingPaymentID(t *testing.T) {
+	repo := &collidingRepo{mockRepo: newMockRepo(), conflicts: 2}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	rec, code, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "collide-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL",
+	})
+	if err != nil || code != 201 {
+		t.Fatalf("expected 201 after regenerating, got %d: %v", code, err)
+	}
+	if len(repo.tried) != 3 || rec.PaymentID != repo.tried[2] {
+		t.Errorf("expected the third ID to be used, tried %v, got %s", repo.tried, rec.PaymentID)
+	}
+	if repo.tried[0] == repo.tried[1] || repo.tried[1] == repo.tried[2] {
+		t.Errorf("expected a fresh ID on each attempt, got %v", repo.tried)
+	}
+}
+
+func TestProcessPayment_GivesUpOnPersistentCollisions(t *testing.T) {
+	repo := &collidingRepo{mockRepo: newMockRepo(), conflicts: maxPaymentIDAttempts}
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	_, code, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "collide-key", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL",
+	})
+	if code != 500 || !errors.Is(err, domain.ErrPaymentIDConflict) {
+		t.Errorf("expected 500 wrapping ErrPaymentIDConflict, got %d: %v", code, err)
+	}
+	if len(repo.tried) != maxPaymentIDAttempts {
+		t.Errorf("expected %d attempts, got %d", maxPaymentIDAttempts, len(repo.tried))
+	}
+}
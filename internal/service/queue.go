@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// Gateway submits a payment downstream and reports the resulting status.
+// Payments the gateway has not finished are reported as processing.
+type Gateway interface {
+	Submit(ctx context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error)
+}
+
+// QueueObserver is notified as payments enter, are turned away from and
+// leave the queue.
+type QueueObserver interface {
+	RecordQueued(depth, capacity int)
+	RecordQueueRejected()
+	RecordDequeued(depth int)
+	RecordDeadLettered()
+}
+
+// maxDeadLetters bounds the dead letters a queue keeps; older ones are
+// dropped first.
+const maxDeadLetters = 1000
+
+// queueFullBody is stored as the response_body of payments turned away by a
+// full queue.
+var queueFullBody = json.RawMessage(`{"code":"queue_full"}`)
+
+// PaymentQueue decouples the merchant-facing answer from the downstream
+// gateway: accepted payments are queued and a pool of workers submits them,
+// completing each with the gateway's final status. Payments the gateway
+// leaves unfinished, or that are still queued at shutdown, stay processing
+// for the merchant's /complete call or the reconciler. Payments the workers
+// give up on are also kept as dead letters.
+type PaymentQueue struct {
+	svc      *IdempotencyService
+	gateway  Gateway
+	jobs     chan domain.IdempotencyRecord
+	workers  int
+	observer QueueObserver
+	attempts int
+	backoff  time.Duration
+
+	mu   sync.Mutex
+	dead []domain.DeadLetter
+	now  func() time.Time
+}
+
+// NewPaymentQueue creates a queue holding up to size payments, drained by
+// workers goroutines. observer may be nil. Each payment is submitted once.
+func NewPaymentQueue(svc *IdempotencyService, gateway Gateway, workers, size int, observer QueueObserver) *PaymentQueue {
+	return &PaymentQueue{
+		svc: svc, gateway: gateway, jobs: make(chan domain.IdempotencyRecord, size), workers: workers, observer: observer,
+		attempts: 1, now: time.Now,
+	}
+}
+
+// WithRetries submits each payment up to attempts times while the gateway
+// returns an error, waiting backoff before the first retry and doubling it
+// for each one after. The gateway dedupes on the payment ID, so a retry
+// never charges twice.
+func (q *PaymentQueue) WithRetries(attempts int, backoff time.Duration) *PaymentQueue {
+	if attempts > 0 {
+		q.attempts = attempts
+	}
+	q.backoff = backoff
+	return q
+}
+
+// DeadLetters returns the payments the workers gave up on, oldest first.
+func (q *PaymentQueue) DeadLetters() []domain.DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]domain.DeadLetter{}, q.dead...)
+}
+
+// Enqueue queues rec without blocking. When the queue is full, rec is
+// marked failed so the client's retry is allowed through, and
+// domain.ErrQueueFull is returned.
+func (q *PaymentQueue) Enqueue(ctx context.Context, rec domain.IdempotencyRecord) error {
+	select {
+	case q.jobs <- rec:
+		if q.observer != nil {
+			q.observer.RecordQueued(len(q.jobs), cap(q.jobs))
+		}
+		return nil
+	default:
+	}
+
+	if q.observer != nil {
+		q.observer.RecordQueueRejected()
+	}
+	body := queueFullBody
+	if err := q.svc.MarkComplete(ctx, rec.IdempotencyKey, domain.CompleteRequest{Status: domain.StatusFailed, ResponseBody: &body}); err != nil {
+		logging.From(ctx).Errorf("queue full: mark failed: %v", err)
+	}
+	return domain.ErrQueueFull
+}
+
+// Run submits queued payments with the worker pool until ctx is done.
+func (q *PaymentQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case rec := <-q.jobs:
+					if q.observer != nil {
+						q.observer.RecordDequeued(len(q.jobs))
+					}
+					q.process(ctx, rec)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *PaymentQueue) process(ctx context.Context, rec domain.IdempotencyRecord) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = rec.MerchantID
+	fields.KeyHash = logging.HashKey(rec.IdempotencyKey)
+	fields.PaymentID = rec.PaymentID
+
+	status, body, attempts, err := q.submit(ctx, rec)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down: the payment stays processing, like one still queued.
+			return
+		}
+		logging.From(ctx).Warnf("async: gateway submit failed %d times, dead-lettering the payment: %v", attempts, err)
+		q.deadLetter(rec, attempts, "", err)
+		return
+	}
+	if status != domain.StatusSucceeded && status != domain.StatusFailed {
+		return
+	}
+	err = q.svc.MarkComplete(ctx, rec.IdempotencyKey, domain.CompleteRequest{Status: status, ResponseBody: body})
+	switch {
+	case err == nil:
+		logging.From(ctx).Debugf("async: marked %s from gateway status", status)
+	case errors.Is(err, domain.ErrAlreadyCompleted):
+		// The merchant completed it while the gateway was working.
+	default:
+		logging.From(ctx).Errorf("async: complete failed, dead-lettering the payment: %v", err)
+		q.deadLetter(rec, attempts, status, err)
+	}
+}
+
+// submit hands rec to the gateway, retrying errors per WithRetries, and
+// returns the gateway's answer with the number of attempts made.
+func (q *PaymentQueue) submit(ctx context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, int, error) {
+	wait := q.backoff
+	for attempt := 1; ; attempt++ {
+		status, body, err := q.gateway.Submit(ctx, rec)
+		if err == nil || attempt >= q.attempts {
+			return status, body, attempt, err
+		}
+		logging.From(ctx).Debugf("async: gateway submit attempt %d failed, retrying in %s: %v", attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return "", nil, attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// deadLetter keeps rec as a dead letter, dropping the oldest beyond
+// maxDeadLetters.
+func (q *PaymentQueue) deadLetter(rec domain.IdempotencyRecord, attempts int, status domain.Status, err error) {
+	if q.observer != nil {
+		q.observer.RecordDeadLettered()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.dead) >= maxDeadLetters {
+		q.dead = append(q.dead[:0], q.dead[len(q.dead)-maxDeadLetters+1:]...)
+	}
+	q.dead = append(q.dead, domain.DeadLetter{
+		PaymentID:      rec.PaymentID,
+		IdempotencyKey: rec.IdempotencyKey,
+		MerchantID:     rec.MerchantID,
+		Amount:         rec.Amount,
+		Currency:       rec.Currency,
+		Attempts:       attempts,
+		GatewayStatus:  status,
+		Error:          err.Error(),
+		FailedAt:       q.now().UTC(),
+	})
+}
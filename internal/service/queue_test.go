@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type fakeGateway map[string]domain.Status
+
+func (f fakeGateway) Submit(_ context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	status, ok := f[rec.IdempotencyKey]
+	if !ok {
+		return "", nil, errors.New("gateway down")
+	}
+	body := json.RawMessage(`{"status":"` + string(status) + `"}`)
+	return status, &body, nil
+}
+
+type queueCounter struct {
+	queued, rejected, dequeued, dead, depth int
+}
+
+func (c *queueCounter) RecordQueued(depth, _ int) { c.queued++; c.depth = depth }
+func (c *queueCounter) RecordQueueRejected()      { c.rejected++ }
+func (c *queueCounter) RecordDequeued(depth int)  { c.dequeued++; c.depth = depth }
+func (c *queueCounter) RecordDeadLettered()       { c.dead++ }
+
+func acceptPayment(t *testing.T, svc *IdempotencyService, key string) domain.IdempotencyRecord {
+	t.Helper()
+	req := domain.PaymentRequest{IdempotencyKey: key, MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "BRL"}
+	resp, code, err := svc.ProcessPayment(context.Background(), req)
+	if err != nil || code != 201 {
+		t.Fatalf("process %s: %d %v", key, code, err)
+	}
+	return domain.IdempotencyRecord{IdempotencyKey: key, PaymentID: resp.PaymentID, MerchantID: req.MerchantID,
+		CustomerID: req.CustomerID, Amount: req.Amount, Currency: req.Currency}
+}
+
+func TestPaymentQueue_FullQueueFailsPaymentForRetry(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	counter := &queueCounter{}
+	q := NewPaymentQueue(svc, fakeGateway{}, 1, 1, counter)
+
+	if err := q.Enqueue(context.Background(), acceptPayment(t, svc, "first")); err != nil {
+		t.Fatalf("expected room for the first payment, got %v", err)
+	}
+	err := q.Enqueue(context.Background(), acceptPayment(t, svc, "second"))
+	if !errors.Is(err, domain.ErrQueueFull) || !errors.Is(err, domain.ErrUnavailable) {
+		t.Fatalf("expected ErrQueueFull matching ErrUnavailable, got %v", err)
+	}
+	if counter.queued != 1 || counter.rejected != 1 || counter.depth != 1 {
+		t.Errorf("unexpected observer counts: %+v", counter)
+	}
+	if repo.records["second"].Status != domain.StatusFailed {
+		t.Errorf("expected the rejected payment to be failed, got %s", repo.records["second"].Status)
+	}
+
+	// The client's retry is let through as a retry of a failed payment.
+	_, code, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "second", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "BRL",
+	})
+	if code != 201 || err != nil {
+		t.Errorf("expected the retry to be accepted, got %d: %v", code, err)
+	}
+}
+
+func TestPaymentQueue_CompletesWithGatewayStatus(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	counter := &queueCounter{}
+	gateway := fakeGateway{"paid": domain.StatusSucceeded, "declined": domain.StatusFailed, "pending": domain.StatusProcessing}
+	q := NewPaymentQueue(svc, gateway, 1, 10, counter)
+
+	for _, key := range []string{"paid", "declined", "pending", "unreachable"} {
+		if err := q.Enqueue(context.Background(), acceptPayment(t, svc, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(q.jobs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Let the worker finish the last payment it took.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	want := map[string]domain.Status{
+		"paid": domain.StatusSucceeded, "declined": domain.StatusFailed,
+		"pending": domain.StatusProcessing, "unreachable": domain.StatusProcessing,
+	}
+	for key, status := range want {
+		if got := repo.records[key].Status; got != status {
+			t.Errorf("%s: expected %s, got %s", key, status, got)
+		}
+	}
+	if counter.dequeued != 4 || counter.depth != 0 {
+		t.Errorf("expected 4 dequeued and an empty queue, got %+v", counter)
+	}
+}
+
+// flakyGateway fails each payment's first failures submissions, then
+// succeeds it.
+type flakyGateway struct {
+	failures int
+	calls    map[string]int
+}
+
+func (f *flakyGateway) Submit(_ context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	f.calls[rec.IdempotencyKey]++
+	if f.calls[rec.IdempotencyKey] <= f.failures {
+		return "", nil, errors.New("gateway down")
+	}
+	body := json.RawMessage(`{"status":"succeeded"}`)
+	return domain.StatusSucceeded, &body, nil
+}
+
+func TestPaymentQueue_RetriesThenDeadLetters(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	counter := &queueCounter{}
+	gateway := &flakyGateway{failures: 2, calls: map[string]int{}}
+	q := NewPaymentQueue(svc, gateway, 1, 10, counter).WithRetries(3, time.Millisecond)
+
+	q.process(context.Background(), acceptPayment(t, svc, "recovers"))
+	if got := repo.records["recovers"].Status; got != domain.StatusSucceeded || gateway.calls["recovers"] != 3 {
+		t.Errorf("expected success on the third attempt, got %s after %d", got, gateway.calls["recovers"])
+	}
+
+	gateway.failures = 5
+	q.process(context.Background(), acceptPayment(t, svc, "down"))
+	if got := repo.records["down"].Status; got != domain.StatusProcessing || gateway.calls["down"] != 3 {
+		t.Errorf("expected the payment left processing after 3 attempts, got %s after %d", got, gateway.calls["down"])
+	}
+	dead := q.DeadLetters()
+	if len(dead) != 1 || dead[0].IdempotencyKey != "down" || dead[0].Attempts != 3 || dead[0].Error != "gateway down" {
+		t.Errorf("unexpected dead letters: %+v", dead)
+	}
+	if counter.dead != 1 {
+		t.Errorf("expected 1 dead letter recorded, got %d", counter.dead)
+	}
+}
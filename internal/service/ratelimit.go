@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// rateLimitPolicyTTL is how long a merchant's limit is used before its
+// policy is read again, so policy changes take effect within this window.
+const rateLimitPolicyTTL = time.Minute
+
+// PolicyReader reads merchant policies.
+type PolicyReader interface {
+	GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error)
+}
+
+// RateLimiter keeps a token bucket per merchant. Each merchant's rate and
+// burst come from its policy's rate_limit_rps and rate_limit_burst, or the
+// deployment defaults when the policy sets none. A zero rate is unlimited.
+type RateLimiter struct {
+	policies PolicyReader
+
+	mu        sync.Mutex
+	rps       float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	rate     float64 // tokens per second; zero is unlimited
+	burst    float64
+	tokens   float64
+	last     time.Time // last refill
+	loadedAt time.Time // when rate and burst were read
+}
+
+// NewRateLimiter creates a RateLimiter allowing rps requests per second per
+// merchant, with bursts of burst. A zero burst is rps rounded up.
+func NewRateLimiter(policies PolicyReader, rps float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		policies: policies,
+		rps:      rps,
+		burst:    burst,
+		buckets:  make(map[string]*tokenBucket),
+		now:      time.Now,
+	}
+}
+
+// SetDefaults replaces the deployment defaults while the limiter runs.
+// Buckets keep their tokens and reload their limits at their merchant's
+// next request, refilling from then on at the new rate, so a reload never
+// hands every merchant a fresh burst.
+func (l *RateLimiter) SetDefaults(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rps, l.burst = rps, burst
+	for _, b := range l.buckets {
+		b.loadedAt = time.Time{}
+	}
+}
+
+// Allow takes a token from merchantID's bucket. When the bucket is empty it
+// returns false and how long until the next token.
+func (l *RateLimiter) Allow(ctx context.Context, merchantID string) (bool, time.Duration) {
+	l.mu.Lock()
+	l.prune(l.now())
+	b, ok := l.buckets[merchantID]
+	stale := !ok || l.now().Sub(b.loadedAt) >= rateLimitPolicyTTL
+	l.mu.Unlock()
+
+	// Read the policy without holding the lock; a concurrent reload of the
+	// same merchant only repeats the work.
+	var rate, burst float64
+	if stale {
+		rate, burst = l.limits(ctx, merchantID)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok = l.buckets[merchantID]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[merchantID] = b
+	}
+	if stale {
+		if b.rate <= 0 {
+			// An unlimited bucket kept no tokens; it starts full.
+			b.tokens = burst
+		}
+		b.rate, b.burst, b.loadedAt = rate, burst, now
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate <= 0 {
+		return true, 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// limits returns the rate and burst for merchantID. Policy lookups never
+// fail the request; any problem falls back to the defaults.
+func (l *RateLimiter) limits(ctx context.Context, merchantID string) (float64, float64) {
+	l.mu.Lock()
+	rps, burst := l.rps, l.burst
+	l.mu.Unlock()
+	if policy, err := l.policies.GetPolicy(ctx, merchantID); err == nil && policy.RateLimitRPS > 0 {
+		rps, burst = policy.RateLimitRPS, policy.RateLimitBurst
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rps))
+	}
+	return rps, float64(burst)
+}
+
+// prune drops, at most once per rateLimitPolicyTTL, the buckets of
+// merchants idle long enough for the bucket to have refilled and the limit
+// to need reloading, so forgetting them changes nothing. The caller holds mu.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPolicyTTL {
+		return
+	}
+	l.lastPrune = now
+	for id, b := range l.buckets {
+		idle := now.Sub(b.last)
+		if idle < rateLimitPolicyTTL {
+			continue
+		}
+		if b.rate <= 0 || idle.Seconds()*b.rate >= b.burst-b.tokens {
+			delete(l.buckets, id)
+		}
+	}
+}
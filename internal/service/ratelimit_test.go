@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// policyMap is a PolicyReader over an in-memory map.
+type policyMap map[string]*domain.MerchantPolicy
+
+func (p policyMap) GetPolicy(_ context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	if policy, ok := p[merchantID]; ok {
+		return policy, nil
+	}
+	return nil, domain.ErrMerchantNotFound
+}
+
+func newTestLimiter(rps float64, burst int) (*RateLimiter, policyMap, *time.Time) {
+	policies := policyMap{}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(policies, rps, burst)
+	l.now = func() time.Time { return now }
+	return l, policies, &now
+}
+
+func TestRateLimiter_BurstThenRefill(t *testing.T) {
+	l, _, now := newTestLimiter(2, 3)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(ctx, "m1"); !ok {
+			t.Fatalf("request %d: expected the burst allowed", i)
+		}
+	}
+	ok, wait := l.Allow(ctx, "m1")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected a denial with a 500ms wait, got %v %s", ok, wait)
+	}
+	if ok, _ := l.Allow(ctx, "m2"); !ok {
+		t.Error("expected merchants to have separate buckets")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow(ctx, "m1"); !ok {
+		t.Error("expected a token after refilling")
+	}
+	if ok, _ := l.Allow(ctx, "m1"); ok {
+		t.Error("expected the refilled token spent")
+	}
+}
+
+func TestRateLimiter_UnlimitedByDefault(t *testing.T) {
+	l, _, _ := newTestLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow(context.Background(), "m1"); !ok {
+			t.Fatalf("request %d: expected no limit", i)
+		}
+	}
+}
+
+func TestRateLimiter_PolicyOverride(t *testing.T) {
+	l, policies, now := newTestLimiter(0, 0)
+	ctx := context.Background()
+	policies["m1"] = &domain.MerchantPolicy{MerchantID: "m1", RateLimitRPS: 0.5}
+
+	if ok, _ := l.Allow(ctx, "m1"); !ok {
+		t.Fatal("expected the burst of one allowed")
+	}
+	if ok, wait := l.Allow(ctx, "m1"); ok || wait != 2*time.Second {
+		t.Errorf("expected the policy limit with a 2s wait, got %v %s", ok, wait)
+	}
+
+	// Policy changes apply once the cached limit expires.
+	delete(policies, "m1")
+	*now = now.Add(rateLimitPolicyTTL)
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow(ctx, "m1"); !ok {
+			t.Fatalf("request %d: expected the limit removed", i)
+		}
+	}
+}
+
+func TestRateLimiter_SetDefaults(t *testing.T) {
+	l, _, _ := newTestLimiter(0, 0)
+	ctx := context.Background()
+	l.Allow(ctx, "m1")
+
+	// New defaults apply at once, without waiting for the cached limit.
+	l.SetDefaults(1, 1)
+	if ok, _ := l.Allow(ctx, "m1"); !ok {
+		t.Fatal("expected the new burst of one allowed")
+	}
+	if ok, wait := l.Allow(ctx, "m1"); ok || wait != time.Second {
+		t.Errorf("expected the new limit with a 1s wait, got %v %s", ok, wait)
+	}
+}
+
+func TestRateLimiter_SetDefaultsKeepsBuckets(t *testing.T) {
+	l, _, now := newTestLimiter(1, 2)
+	ctx := context.Background()
+	l.Allow(ctx, "m1")
+	l.Allow(ctx, "m1")
+
+	// A reload does not refill a drained bucket; it refills at the new rate.
+	l.SetDefaults(4, 2)
+	if ok, wait := l.Allow(ctx, "m1"); ok || wait != 250*time.Millisecond {
+		t.Fatalf("expected the drained bucket kept with a 250ms wait, got %v %s", ok, wait)
+	}
+	*now = now.Add(250 * time.Millisecond)
+	if ok, _ := l.Allow(ctx, "m1"); !ok {
+		t.Error("expected a token refilled at the new rate")
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// reconcileBatch bounds how many stuck payments one pass looks up.
+const reconcileBatch = 100
+
+// ReconcileStore finds payments stuck in processing.
+type ReconcileStore interface {
+	ListStuckProcessing(ctx context.Context, before time.Time, limit int) ([]domain.IdempotencyRecord, error)
+}
+
+// StatusProvider reports a payment's status at the downstream provider.
+// Payments the provider has not finished are reported as processing.
+type StatusProvider interface {
+	PaymentStatus(ctx context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error)
+}
+
+// Reconciler completes payments left in processing, typically because the
+// merchant's worker died before calling /complete, with the provider's final
+// status.
+type Reconciler struct {
+	store      ReconcileStore
+	provider   StatusProvider
+	svc        *IdempotencyService
+	interval   time.Duration
+	stuckAfter time.Duration
+	now        func() time.Time
+}
+
+// NewReconciler creates a Reconciler that checks, every interval, payments
+// whose last attempt is older than stuckAfter.
+func NewReconciler(store ReconcileStore, provider StatusProvider, svc *IdempotencyService, interval, stuckAfter time.Duration) *Reconciler {
+	return &Reconciler{store: store, provider: provider, svc: svc, interval: interval, stuckAfter: stuckAfter, now: time.Now}
+}
+
+// Run reconciles on every tick until ctx is done.
+func (rc *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := rc.RunOnce(ctx)
+		if err != nil {
+			log.Printf("reconcile: %v", err)
+		}
+		if n > 0 {
+			log.Printf("reconcile: completed %d stuck payment(s)", n)
+		}
+	}
+}
+
+// RunOnce looks up one batch of stuck payments and completes those the
+// provider has finalized. Lookup failures for single payments are logged and
+// skipped; it returns how many payments were completed.
+func (rc *Reconciler) RunOnce(ctx context.Context) (int, error) {
+	stuck, err := rc.store.ListStuckProcessing(ctx, rc.now().Add(-rc.stuckAfter), reconcileBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	completed := 0
+	for _, rec := range stuck {
+		if ctx.Err() != nil {
+			return completed, ctx.Err()
+		}
+		if rc.reconcile(ctx, rec) {
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+func (rc *Reconciler) reconcile(ctx context.Context, rec domain.IdempotencyRecord) bool {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = rec.MerchantID
+	fields.KeyHash = logging.HashKey(rec.IdempotencyKey)
+	fields.PaymentID = rec.PaymentID
+
+	status, body, err := rc.provider.PaymentStatus(ctx, rec)
+	if err != nil {
+		logging.From(ctx).Warnf("reconcile: provider lookup failed: %v", err)
+		return false
+	}
+	if status != domain.StatusSucceeded && status != domain.StatusFailed {
+		return false
+	}
+
+	err = rc.svc.MarkComplete(ctx, rec.IdempotencyKey, domain.CompleteRequest{Status: status, ResponseBody: body})
+	switch {
+	case err == nil:
+		logging.From(ctx).Infof("reconcile: marked %s from provider status", status)
+		return true
+	case errors.Is(err, domain.ErrAlreadyCompleted):
+		// The merchant completed it while we were asking the provider.
+		return false
+	default:
+		logging.From(ctx).Errorf("reconcile: complete failed: %v", err)
+		return false
+	}
+}
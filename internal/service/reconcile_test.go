@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type stuckStore struct {
+	repo   *mockRepo
+	before time.Time
+}
+
+func (s *stuckStore) ListStuckProcessing(_ context.Context, before time.Time, limit int) ([]domain.IdempotencyRecord, error) {
+	s.before = before
+	s.repo.mu.Lock()
+	defer s.repo.mu.Unlock()
+	var out []domain.IdempotencyRecord
+	for _, rec := range s.repo.records {
+		if rec.Status == domain.StatusProcessing && len(out) < limit {
+			out = append(out, *rec)
+		}
+	}
+	return out, nil
+}
+
+type fakeProvider map[string]domain.Status
+
+func (f fakeProvider) PaymentStatus(_ context.Context, rec domain.IdempotencyRecord) (domain.Status, *json.RawMessage, error) {
+	status, ok := f[rec.IdempotencyKey]
+	if !ok {
+		return "", nil, errors.New("provider down")
+	}
+	body := json.RawMessage(`{"status":"` + string(status) + `"}`)
+	return status, &body, nil
+}
+
+func TestReconciler_CompletesFinalizedPayments(t *testing.T) {
+	repo := newMockRepo()
+	svc := NewIdempotencyService(repo, 24*time.Hour)
+	for _, key := range []string{"done", "declined", "pending", "unreachable"} {
+		if _, _, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+			IdempotencyKey: key, MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "BRL",
+		}); err != nil {
+			t.Fatalf("process %s: %v", key, err)
+		}
+	}
+
+	store := &stuckStore{repo: repo}
+	provider := fakeProvider{"done": domain.StatusSucceeded, "declined": domain.StatusFailed, "pending": domain.StatusProcessing}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	rc := NewReconciler(store, provider, svc, time.Minute, 10*time.Minute)
+	rc.now = func() time.Time { return now }
+
+	n, err := rc.RunOnce(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 payments completed, got %d", n)
+	}
+	if !store.before.Equal(now.Add(-10 * time.Minute)) {
+		t.Errorf("expected cutoff 10m ago, got %v", store.before)
+	}
+
+	want := map[string]domain.Status{
+		"done": domain.StatusSucceeded, "declined": domain.StatusFailed,
+		"pending": domain.StatusProcessing, "unreachable": domain.StatusProcessing,
+	}
+	for key, status := range want {
+		rec, _ := repo.GetByKey(context.Background(), key)
+		if rec.Status != status {
+			t.Errorf("%s: expected %s, got %s", key, status, rec.Status)
+		}
+	}
+}
@@ -2,9 +2,15 @@ package service
 
 import (
 	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/fx"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
 	"github.com/kubo-market/idempotency-shield/internal/storage"
 )
 
@@ -13,19 +19,44 @@ const suspiciousThreshold = 3 // attempts > 3 are suspicious
 // ReportingService generates duplicate detection reports.
 type ReportingService struct {
 	repo storage.Repository
+
+	rates          fx.RateProvider
+	reportCurrency string
+	digests        DigestStore
+	alerts         DuplicateAlertSender
+	now            func() time.Time
 }
 
 // NewReportingService creates a new ReportingService.
 func NewReportingService(repo storage.Repository) *ReportingService {
-	return &ReportingService{repo: repo}
+	return &ReportingService{repo: repo, now: time.Now}
+}
+
+// WithFX enables normalizing amounts at risk into reportCurrency.
+func (s *ReportingService) WithFX(rates fx.RateProvider, reportCurrency string) *ReportingService {
+	s.rates = rates
+	s.reportCurrency = strings.ToUpper(reportCurrency)
+	return s
 }
 
-// GetDuplicateReport returns a full duplicate analysis for a merchant.
-func (s *ReportingService) GetDuplicateReport(ctx context.Context, merchantID string, from, to time.Time) (*domain.DuplicateReport, error) {
-	duplicates, err := s.repo.GetDuplicates(ctx, merchantID, from, to)
+// GetDuplicateReport returns a duplicate analysis for a merchant. With a page
+// limit, suspicious keys come from that page of duplicates only; the counts
+// and amounts at risk always cover the whole range.
+func (s *ReportingService) GetDuplicateReport(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) (*domain.DuplicateReport, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = merchantID
+
+	duplicates, totalDuplicates, err := s.repo.GetDuplicates(ctx, merchantID, from, to, page)
+	if err != nil {
+		return nil, err
+	}
+	currencyBreakdown, err := s.repo.GetAmountAtRisk(ctx, merchantID, from, to)
 	if err != nil {
 		return nil, err
 	}
+	if currencyBreakdown == nil {
+		currencyBreakdown = make(map[string]int64)
+	}
 
 	totalRequests, uniquePayments, err := s.repo.GetMerchantStats(ctx, merchantID, from, to)
 	if err != nil {
@@ -33,36 +64,16 @@ func (s *ReportingService) GetDuplicateReport(ctx context.Context, merchantID st
 	}
 
 	duplicateCount := totalRequests - uniquePayments
-	var duplicateRate float64
-	if totalRequests > 0 {
-		duplicateRate = float64(duplicateCount) / float64(totalRequests) * 100
-	}
-
-	var suspicious []domain.SuspiciousKey
-	var amountAtRisk int64
-	currencyBreakdown := make(map[string]int64)
-
-	for _, d := range duplicates {
-		if d.AttemptCount > suspiciousThreshold {
-			suspicious = append(suspicious, domain.SuspiciousKey{
-				IdempotencyKey: d.IdempotencyKey,
-				AttemptCount:   d.AttemptCount,
-				Amount:         d.Amount,
-				Currency:       d.Currency,
-				Status:         d.Status,
-				FirstSeenAt:    d.FirstSeenAt,
-				LastSeenAt:     d.LastSeenAt,
-			})
-		}
+	duplicateRate := duplicateRate(totalRequests, uniquePayments)
 
-		// Amount at risk: duplicates that could have been double-charged
-		extraAttempts := int64(d.AttemptCount - 1)
-		atRisk := d.Amount * extraAttempts
-		amountAtRisk += atRisk
-		currencyBreakdown[d.Currency] += atRisk
-	}
+	suspicious := suspiciousKeys(duplicates, s.amountDistribution(ctx, merchantID, to))
+	prioritize(suspicious)
+
+	// Amount at risk: duplicates that could have been double-charged
+	normalized := s.normalize(ctx, merchantID, currencyBreakdown)
+	amountAtRisk, reportingCurrency := totalAtRisk(currencyBreakdown, normalized)
 
-	return &domain.DuplicateReport{
+	report := &domain.DuplicateReport{
 		MerchantID:        merchantID,
 		TotalRequests:     totalRequests,
 		UniquePayments:    uniquePayments,
@@ -71,6 +82,271 @@ func (s *ReportingService) GetDuplicateReport(ctx context.Context, merchantID st
 		SuspiciousKeys:    suspicious,
 		TimeRange:         domain.TimeRange{From: from, To: to},
 		AmountAtRisk:      amountAtRisk,
+		ReportingCurrency: reportingCurrency,
 		CurrencyBreakdown: currencyBreakdown,
+		Normalized:        normalized,
+	}
+	if page.Limit > 0 {
+		report.Page = domain.NewPageInfo(page, len(duplicates), totalDuplicates)
+	}
+	return report, nil
+}
+
+// ExportDuplicates calls fn with every duplicate key of a merchant in the
+// range, most attempts first, as the repository streams them. Unlike
+// GetDuplicateReport it never holds the duplicates in memory.
+func (s *ReportingService) ExportDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.DuplicateRow) error) error {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = merchantID
+
+	dist := s.amountDistribution(ctx, merchantID, to)
+	return s.repo.StreamDuplicates(ctx, merchantID, from, to, func(d domain.IdempotencyRecord) error {
+		return fn(duplicateRow(d, dist))
+	})
+}
+
+// GetMerchantStats returns a merchant's request totals, duplicate rate and
+// key outcomes, a cheaper alternative to GetDuplicateReport for dashboards.
+func (s *ReportingService) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (*domain.MerchantStats, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = merchantID
+
+	total, unique, err := s.repo.GetMerchantStats(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	outcomes, err := s.repo.GetMerchantOutcomes(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.MerchantStats{
+		MerchantID:       merchantID,
+		TotalRequests:    total,
+		UniquePayments:   unique,
+		DuplicateCount:   total - unique,
+		DuplicateRate:    duplicateRate(total, unique),
+		TimeRange:        domain.TimeRange{From: from, To: to},
+		MerchantOutcomes: outcomes,
+	}, nil
+}
+
+// MaxTrendBuckets bounds how many buckets one trends response holds.
+const MaxTrendBuckets = 1000
+
+// ValidTrendBucket reports whether bucket is a whole number of minutes that
+// splits [from, to] into at most MaxTrendBuckets buckets.
+func ValidTrendBucket(from, to time.Time, bucket time.Duration) bool {
+	if bucket < time.Minute || bucket%time.Minute != 0 {
+		return false
+	}
+	return to.Sub(from)/bucket < MaxTrendBuckets
+}
+
+// GetDuplicateTrends returns a merchant's stats per bucket across [from, to],
+// counting each key in the bucket it was first seen in. Buckets without keys
+// are filled in with zeros.
+func (s *ReportingService) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) (*domain.DuplicateTrends, error) {
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = merchantID
+
+	counts, err := s.repo.GetDuplicateTrends(ctx, merchantID, from, to, bucket)
+	if err != nil {
+		return nil, err
+	}
+	buckets := []domain.TrendBucket{}
+	first := time.Unix(0, from.UnixNano()/int64(bucket)*int64(bucket)).UTC()
+	for start := first; !start.After(to); start = start.Add(bucket) {
+		b := domain.TrendBucket{Start: start}
+		if len(counts) > 0 && counts[0].Start.Equal(start) {
+			b = counts[0]
+			counts = counts[1:]
+		}
+		b.DuplicateCount = b.TotalRequests - b.UniquePayments
+		b.DuplicateRate = duplicateRate(b.TotalRequests, b.UniquePayments)
+		buckets = append(buckets, b)
+	}
+	return &domain.DuplicateTrends{
+		MerchantID:    merchantID,
+		BucketSeconds: int(bucket / time.Second),
+		Buckets:       buckets,
+		TimeRange:     domain.TimeRange{From: from, To: to},
+	}, nil
+}
+
+// duplicateRate is the percentage of requests that repeated a key.
+func duplicateRate(total, unique int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(total-unique) / float64(total) * 100
+}
+
+// normalize converts a per-currency breakdown into the merchant's base
+// currency, or the reporting currency when the merchant has none. FX problems
+// never fail a report; the normalized amount is just omitted.
+func (s *ReportingService) normalize(ctx context.Context, merchantID string, breakdown map[string]int64) *domain.NormalizedAmount {
+	if s.rates == nil {
+		return nil
+	}
+	rates, err := s.rates.Rates(ctx)
+	if err != nil {
+		logging.From(ctx).Warnf("fx rates unavailable: %v", err)
+		return nil
+	}
+
+	target := s.baseCurrency(ctx, merchantID)
+	n := &domain.NormalizedAmount{
+		Currency:       target,
+		RatesSource:    rates.Source,
+		RatesUpdatedAt: rates.UpdatedAt,
+	}
+	converted := make(map[string]int64, len(breakdown))
+	for currency, amount := range breakdown {
+		c, ok := rates.Convert(amount, currency, target)
+		if !ok {
+			n.Unconverted = append(n.Unconverted, currency)
+			continue
+		}
+		converted[currency] = c
+		n.Amount += c
+	}
+	sort.Strings(n.Unconverted)
+	if n.Amount > 0 {
+		n.Percentages = make(map[string]float64, len(converted))
+		for currency, c := range converted {
+			n.Percentages[currency] = math.Round(float64(c)/float64(n.Amount)*10000) / 100
+		}
+	}
+	return n
+}
+
+// totalAtRisk returns the amount at risk in a single currency: the normalized
+// amount when every currency converted, else the breakdown's only currency.
+// Mixed currencies that cannot all be converted have no total, since adding
+// minor units of different currencies means nothing.
+func totalAtRisk(breakdown map[string]int64, normalized *domain.NormalizedAmount) (*int64, string) {
+	if normalized != nil && len(normalized.Unconverted) == 0 {
+		amount := normalized.Amount
+		return &amount, normalized.Currency
+	}
+	var total int64
+	var currency string
+	for c, amount := range breakdown {
+		if currency != "" {
+			return nil, ""
+		}
+		total, currency = amount, c
+	}
+	return &total, currency
+}
+
+// baseCurrency returns the merchant policy's base currency, falling back to
+// the reporting currency when there is none or the policy cannot be read.
+func (s *ReportingService) baseCurrency(ctx context.Context, merchantID string) string {
+	policy, err := s.repo.GetPolicy(ctx, merchantID)
+	if err != nil {
+		if !errors.Is(err, domain.ErrMerchantNotFound) {
+			logging.From(ctx).Warnf("base currency lookup failed, using %s: %v", s.reportCurrency, err)
+		}
+		return s.reportCurrency
+	}
+	if policy.BaseCurrency == "" {
+		return s.reportCurrency
+	}
+	return policy.BaseCurrency
+}
+
+// Orders of GetStatsTable: the first three descending, merchant_id ascending.
+const (
+	StatsSortRequests      = "requests"
+	StatsSortUnique        = "unique"
+	StatsSortDuplicateRate = "duplicate_rate"
+	StatsSortMerchant      = "merchant_id"
+)
+
+// ValidStatsSort reports whether sortBy is one of the StatsSort orders.
+func ValidStatsSort(sortBy string) bool {
+	switch sortBy {
+	case StatsSortRequests, StatsSortUnique, StatsSortDuplicateRate, StatsSortMerchant:
+		return true
+	}
+	return false
+}
+
+// GetStatsTable returns every merchant's activity ordered by sortBy, keeping
+// the first limit rows when limit is positive.
+func (s *ReportingService) GetStatsTable(ctx context.Context, from, to time.Time, sortBy string, limit int) (*domain.StatsTable, error) {
+	merchants, err := s.merchantActivity(ctx, from, to, sortBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.StatsTable{
+		Merchants: merchants,
+		SortBy:    sortBy,
+		TimeRange: domain.TimeRange{From: from, To: to},
+	}, nil
+}
+
+// merchantActivity ranks merchants by sortBy, ties broken by merchant ID,
+// and keeps the first limit when limit is positive.
+func (s *ReportingService) merchantActivity(ctx context.Context, from, to time.Time, sortBy string, limit int) ([]domain.MerchantActivity, error) {
+	stats, err := s.repo.GetAllMerchantStats(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	merchants := make([]domain.MerchantActivity, 0, len(stats))
+	for id, st := range stats {
+		merchants = append(merchants, domain.MerchantActivity{
+			MerchantID:     id,
+			TotalRequests:  st[0],
+			UniquePayments: st[1],
+			DuplicateRate:  duplicateRate(st[0], st[1]),
+		})
+	}
+	sort.Slice(merchants, func(i, j int) bool {
+		a, b := merchants[i], merchants[j]
+		switch {
+		case sortBy == StatsSortUnique && a.UniquePayments != b.UniquePayments:
+			return a.UniquePayments > b.UniquePayments
+		case sortBy == StatsSortDuplicateRate && a.DuplicateRate != b.DuplicateRate:
+			return a.DuplicateRate > b.DuplicateRate
+		case sortBy == StatsSortRequests && a.TotalRequests != b.TotalRequests:
+			return a.TotalRequests > b.TotalRequests
+		}
+		return a.MerchantID < b.MerchantID
+	})
+	if limit > 0 && len(merchants) > limit {
+		merchants = merchants[:limit]
+	}
+	return merchants, nil
+}
+
+// GetOverview ranks merchants by request volume and collects the most recently
+// seen suspicious keys among the top merchants.
+func (s *ReportingService) GetOverview(ctx context.Context, from, to time.Time, limit int) (*domain.Overview, error) {
+	merchants, err := s.merchantActivity(ctx, from, to, StatsSortRequests, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	suspicious := []domain.SuspiciousKey{}
+	for _, m := range merchants {
+		duplicates, _, err := s.repo.GetDuplicates(ctx, m.MerchantID, from, to, domain.Page{})
+		if err != nil {
+			return nil, err
+		}
+		suspicious = append(suspicious, suspiciousKeys(duplicates, s.amountDistribution(ctx, m.MerchantID, to))...)
+	}
+	sort.Slice(suspicious, func(i, j int) bool { return suspicious[i].LastSeenAt.After(suspicious[j].LastSeenAt) })
+	prioritize(suspicious)
+	if len(suspicious) > limit {
+		suspicious = suspicious[:limit]
+	}
+
+	return &domain.Overview{
+		TopMerchants:   merchants,
+		SuspiciousKeys: suspicious,
+		TimeRange:      domain.TimeRange{From: from, To: to},
 	}, nil
 }
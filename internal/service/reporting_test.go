@@ -2,18 +2,23 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/fx"
 )
 
 // reportMockRepo extends mockRepo for reporting tests.
 type reportMockRepo struct {
-	duplicates []domain.IdempotencyRecord
-	total      int
-	unique     int
+	duplicates  []domain.IdempotencyRecord
+	total       int
+	unique      int
+	allStats    map[string][2]int
+	amountStats map[string]domain.AmountStats
+	policy      *domain.MerchantPolicy
+	trends      []domain.TrendBucket
+	outcomes    domain.MerchantOutcomes
 }
 
 func (m *reportMockRepo) InsertOrGet(_ context.Context, _ domain.PaymentRequest, _ string, _ time.Time) (*domain.IdempotencyRecord, bool, error) {
@@ -22,25 +27,97 @@ func (m *reportMockRepo) InsertOrGet(_ context.Context, _ domain.PaymentRequest,
 func (m *reportMockRepo) GetByKey(_ context.Context, _ string) (*domain.IdempotencyRecord, error) {
 	return nil, domain.ErrKeyNotFound
 }
-func (m *reportMockRepo) MarkComplete(_ context.Context, _ string, _ domain.Status, _ *json.RawMessage) error {
+func (m *reportMockRepo) GetByKeyPrimary(_ context.Context, _ string) (*domain.IdempotencyRecord, error) {
+	return nil, domain.ErrKeyNotFound
+}
+func (m *reportMockRepo) GetByPaymentID(_ context.Context, _ string) (*domain.IdempotencyRecord, error) {
+	return nil, domain.ErrPaymentNotFound
+}
+func (m *reportMockRepo) MarkComplete(_ context.Context, _ string, _ domain.Status, _ domain.StoredResponse) error {
+	return nil
+}
+func (m *reportMockRepo) ResetToProcessing(_ context.Context, _ string, _ int64, _ string, _ time.Time) error {
 	return nil
 }
-func (m *reportMockRepo) ResetToProcessing(_ context.Context, _ string, _ string, _ time.Time) error {
+func (m *reportMockRepo) UpdateParams(_ context.Context, _ string, _ int64, _ domain.PaymentRequest) error {
+	return nil
+}
+func (m *reportMockRepo) ExpireKey(_ context.Context, _ string) error           { return nil }
+func (m *reportMockRepo) ResetKey(_ context.Context, _ string, _ int64) error   { return nil }
+func (m *reportMockRepo) DeleteExpired(_ context.Context, _ int) (int64, error) { return 0, nil }
+func (m *reportMockRepo) GetDuplicates(_ context.Context, merchantID string, _, _ time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	out := m.merchantDuplicates(merchantID)
+	total := len(out)
+	if page.Offset >= total {
+		return nil, total, nil
+	}
+	out = out[page.Offset:]
+	if page.Limit > 0 && len(out) > page.Limit {
+		out = out[:page.Limit]
+	}
+	return out, total, nil
+}
+
+func (m *reportMockRepo) StreamDuplicates(_ context.Context, merchantID string, _, _ time.Time, fn func(domain.IdempotencyRecord) error) error {
+	for _, d := range m.merchantDuplicates(merchantID) {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-func (m *reportMockRepo) DeleteExpired(_ context.Context) (int64, error) { return 0, nil }
-func (m *reportMockRepo) GetDuplicates(_ context.Context, _ string, _, _ time.Time) ([]domain.IdempotencyRecord, error) {
-	return m.duplicates, nil
+
+func (m *reportMockRepo) GetAmountAtRisk(_ context.Context, merchantID string, _, _ time.Time) (map[string]int64, error) {
+	atRisk := make(map[string]int64)
+	for _, d := range m.merchantDuplicates(merchantID) {
+		atRisk[d.Currency] += d.Amount * int64(d.AttemptCount-1)
+	}
+	return atRisk, nil
+}
+
+func (m *reportMockRepo) merchantDuplicates(merchantID string) []domain.IdempotencyRecord {
+	var out []domain.IdempotencyRecord
+	for _, d := range m.duplicates {
+		if d.MerchantID == "" || d.MerchantID == merchantID {
+			out = append(out, d)
+		}
+	}
+	return out
 }
 func (m *reportMockRepo) GetMerchantStats(_ context.Context, _ string, _, _ time.Time) (int, int, error) {
 	return m.total, m.unique, nil
 }
+func (m *reportMockRepo) GetMerchantOutcomes(_ context.Context, _ string, _, _ time.Time) (domain.MerchantOutcomes, error) {
+	return m.outcomes, nil
+}
+func (m *reportMockRepo) GetDuplicateTrends(_ context.Context, _ string, _, _ time.Time, _ time.Duration) ([]domain.TrendBucket, error) {
+	return m.trends, nil
+}
 func (m *reportMockRepo) GetPolicy(_ context.Context, _ string) (*domain.MerchantPolicy, error) {
-	return nil, domain.ErrMerchantNotFound
+	if m.policy == nil {
+		return nil, domain.ErrMerchantNotFound
+	}
+	return m.policy, nil
 }
 func (m *reportMockRepo) UpsertPolicy(_ context.Context, _ domain.MerchantPolicy) error { return nil }
+func (m *reportMockRepo) ListPolicies(_ context.Context, _ domain.Page) ([]domain.MerchantPolicy, int, error) {
+	return nil, 0, nil
+}
+func (m *reportMockRepo) UpsertPolicies(_ context.Context, _ []domain.MerchantPolicy) error {
+	return nil
+}
+func (m *reportMockRepo) DeletePolicy(_ context.Context, _ string) error { return nil }
 func (m *reportMockRepo) GetAllMerchantStats(_ context.Context, _, _ time.Time) (map[string][2]int, error) {
-	return nil, nil
+	return m.allStats, nil
+}
+func (m *reportMockRepo) GetAmountStats(_ context.Context, _ string, _, _ time.Time) (map[string]domain.AmountStats, error) {
+	return m.amountStats, nil
+}
+func (m *reportMockRepo) SearchRecords(_ context.Context, _ domain.RecordFilter, _ domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	return nil, 0, nil
+}
+func (m *reportMockRepo) GetAttempts(_ context.Context, _ string) ([]domain.Attempt, error) {
+	return nil, domain.ErrKeyNotFound
 }
 
 func TestDuplicateReport_Basic(t *testing.T) {
@@ -50,12 +127,12 @@ func TestDuplicateReport_Basic(t *testing.T) {
 		unique: 100,
 		duplicates: []domain.IdempotencyRecord{
 			{IdempotencyKey: "key-1", AttemptCount: 2, Amount: 5000, Currency: "BRL", Status: domain.StatusSucceeded, FirstSeenAt: now, LastSeenAt: now},
-			{IdempotencyKey: "key-2", AttemptCount: 8, Amount: 15000, Currency: "BRL", Status: domain.StatusProcessing, FirstSeenAt: now, LastSeenAt: now},
+			{IdempotencyKey: "key-2", AttemptCount: 8, Amount: 15000, Currency: "BRL", Status: domain.StatusProcessing, FirstSeenAt: now, LastSeenAt: now, DistinctSources: 8},
 		},
 	}
 
 	svc := NewReportingService(repo)
-	report, err := svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-24*time.Hour), now)
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-24*time.Hour), now, domain.Page{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -82,11 +159,96 @@ func TestDuplicateReport_Basic(t *testing.T) {
 	if report.SuspiciousKeys[0].IdempotencyKey != "key-2" {
 		t.Errorf("expected key-2 suspicious, got %s", report.SuspiciousKeys[0].IdempotencyKey)
 	}
+	if report.SuspiciousKeys[0].DistinctSources != 8 {
+		t.Errorf("expected 8 distinct sources, got %d", report.SuspiciousKeys[0].DistinctSources)
+	}
 
 	// Amount at risk: key-1 = 5000 * 1 = 5000, key-2 = 15000 * 7 = 105000
 	expectedRisk := int64(5000 + 105000)
-	if report.AmountAtRisk != expectedRisk {
-		t.Errorf("expected amount at risk %d, got %d", expectedRisk, report.AmountAtRisk)
+	if report.AmountAtRisk == nil || *report.AmountAtRisk != expectedRisk || report.ReportingCurrency != "BRL" {
+		t.Errorf("expected amount at risk %d BRL, got %v %s", expectedRisk, report.AmountAtRisk, report.ReportingCurrency)
+	}
+}
+
+func TestDuplicateReport_NormalizedWithFX(t *testing.T) {
+	now := time.Now()
+	repo := &reportMockRepo{
+		total:  10,
+		unique: 7,
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "brl", AttemptCount: 2, Amount: 50000, Currency: "BRL", LastSeenAt: now},
+			{IdempotencyKey: "mxn", AttemptCount: 2, Amount: 170000, Currency: "MXN", LastSeenAt: now},
+			{IdempotencyKey: "xyz", AttemptCount: 2, Amount: 100, Currency: "XYZ", LastSeenAt: now},
+		},
+	}
+	rates, err := fx.NewStaticProvider("USD", "BRL=5,MXN=17")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewReportingService(repo).WithFX(rates, "usd")
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n := report.Normalized
+	if n == nil {
+		t.Fatal("expected normalized amount")
+	}
+	// 50000 BRL cents = 10000 USD cents; 170000 MXN cents = 10000 USD cents
+	if n.Currency != "USD" || n.Amount != 20000 {
+		t.Errorf("expected 20000 USD, got %d %s", n.Amount, n.Currency)
+	}
+	if n.RatesSource != "static" {
+		t.Errorf("expected static source, got %s", n.RatesSource)
+	}
+	if len(n.Unconverted) != 1 || n.Unconverted[0] != "XYZ" {
+		t.Errorf("expected XYZ unconverted, got %v", n.Unconverted)
+	}
+	if n.Percentages["BRL"] != 50 || n.Percentages["MXN"] != 50 {
+		t.Errorf("expected 50/50 split, got %v", n.Percentages)
+	}
+	if _, ok := n.Percentages["XYZ"]; ok {
+		t.Error("unconverted currency should have no percentage")
+	}
+	if report.AmountAtRisk != nil || report.ReportingCurrency != "" {
+		t.Errorf("expected no total with XYZ unconverted, got %v %s", report.AmountAtRisk, report.ReportingCurrency)
+	}
+}
+
+func TestDuplicateReport_NormalizedToMerchantBaseCurrency(t *testing.T) {
+	now := time.Now()
+	repo := &reportMockRepo{
+		total:  4,
+		unique: 2,
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "usd", AttemptCount: 2, Amount: 1000, Currency: "USD", LastSeenAt: now},
+			{IdempotencyKey: "brl", AttemptCount: 2, Amount: 15000, Currency: "BRL", LastSeenAt: now},
+		},
+		policy: &domain.MerchantPolicy{MerchantID: "merchant-1", BaseCurrency: "BRL"},
+	}
+	rates, err := fx.NewStaticProvider("USD", "BRL=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewReportingService(repo).WithFX(rates, "USD")
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n := report.Normalized
+	// 1000 USD cents = 5000 BRL cents, plus 15000 BRL cents
+	if n == nil || n.Currency != "BRL" || n.Amount != 20000 {
+		t.Fatalf("expected 20000 BRL, got %+v", n)
+	}
+	if n.Percentages["USD"] != 25 || n.Percentages["BRL"] != 75 {
+		t.Errorf("expected 25/75 split, got %v", n.Percentages)
+	}
+	if report.AmountAtRisk == nil || *report.AmountAtRisk != 20000 || report.ReportingCurrency != "BRL" {
+		t.Errorf("expected amount at risk 20000 BRL, got %v %s", report.AmountAtRisk, report.ReportingCurrency)
 	}
 }
 
@@ -95,7 +257,7 @@ func TestDuplicateReport_NoDuplicates(t *testing.T) {
 	svc := NewReportingService(repo)
 	now := time.Now()
 
-	report, err := svc.GetDuplicateReport(context.Background(), "merchant-clean", now.Add(-24*time.Hour), now)
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-clean", now.Add(-24*time.Hour), now, domain.Page{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -109,6 +271,9 @@ func TestDuplicateReport_NoDuplicates(t *testing.T) {
 	if len(report.SuspiciousKeys) != 0 {
 		t.Errorf("expected no suspicious keys, got %d", len(report.SuspiciousKeys))
 	}
+	if report.Normalized != nil {
+		t.Error("expected no normalized amount without FX configured")
+	}
 }
 
 func TestDuplicateReport_ZeroTotal(t *testing.T) {
@@ -116,7 +281,7 @@ func TestDuplicateReport_ZeroTotal(t *testing.T) {
 	svc := NewReportingService(repo)
 	now := time.Now()
 
-	report, err := svc.GetDuplicateReport(context.Background(), "merchant-empty", now.Add(-24*time.Hour), now)
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-empty", now.Add(-24*time.Hour), now, domain.Page{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -125,3 +290,155 @@ func TestDuplicateReport_ZeroTotal(t *testing.T) {
 		t.Errorf("expected 0%% rate for zero total, got %.2f%%", report.DuplicateRate)
 	}
 }
+
+func TestOverview_RanksMerchantsAndCollectsSuspicious(t *testing.T) {
+	now := time.Now()
+	repo := &reportMockRepo{
+		allStats: map[string][2]int{
+			"small": {10, 10},
+			"big":   {200, 100},
+			"mid":   {50, 40},
+		},
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "old", MerchantID: "big", AttemptCount: 9, LastSeenAt: now.Add(-time.Hour)},
+			{IdempotencyKey: "new", MerchantID: "mid", AttemptCount: 5, LastSeenAt: now},
+			{IdempotencyKey: "benign", MerchantID: "big", AttemptCount: 2, LastSeenAt: now},
+		},
+	}
+
+	svc := NewReportingService(repo)
+	ov, err := svc.GetOverview(context.Background(), now.Add(-24*time.Hour), now, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ov.TopMerchants) != 2 || ov.TopMerchants[0].MerchantID != "big" || ov.TopMerchants[1].MerchantID != "mid" {
+		t.Fatalf("unexpected ranking: %+v", ov.TopMerchants)
+	}
+	if ov.TopMerchants[0].DuplicateRate != 50 {
+		t.Errorf("expected 50%% duplicate rate, got %v", ov.TopMerchants[0].DuplicateRate)
+	}
+	if len(ov.SuspiciousKeys) != 2 || ov.SuspiciousKeys[0].IdempotencyKey != "new" {
+		t.Errorf("expected [new old] suspicious keys, got %+v", ov.SuspiciousKeys)
+	}
+	if ov.SuspiciousKeys[0].MerchantID != "mid" {
+		t.Errorf("expected merchant id on suspicious key, got %q", ov.SuspiciousKeys[0].MerchantID)
+	}
+}
+
+func TestDuplicateReport_AmountOutliersHighPriority(t *testing.T) {
+	now := time.Now()
+	repo := &reportMockRepo{
+		total:  200,
+		unique: 190,
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "storm-small", AttemptCount: 9, Amount: 500, Currency: "BRL", LastSeenAt: now},
+			{IdempotencyKey: "retry-large", AttemptCount: 2, Amount: 900000, Currency: "BRL", LastSeenAt: now},
+			{IdempotencyKey: "retry-normal", AttemptCount: 2, Amount: 1200, Currency: "BRL", LastSeenAt: now},
+			{IdempotencyKey: "storm-mxn", AttemptCount: 5, Amount: 900000, Currency: "MXN", LastSeenAt: now},
+		},
+		amountStats: map[string]domain.AmountStats{
+			"BRL": {Count: 500, Mean: 1000, StdDev: 2000},
+			"MXN": {Count: 5, Mean: 1000, StdDev: 10}, // too few samples to judge
+		},
+	}
+
+	report, err := NewReportingService(repo).GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(report.SuspiciousKeys) != 3 {
+		t.Fatalf("expected 3 suspicious keys, got %+v", report.SuspiciousKeys)
+	}
+	first := report.SuspiciousKeys[0]
+	if first.IdempotencyKey != "retry-large" || !first.HighPriority {
+		t.Errorf("expected retry-large first and high priority, got %+v", first)
+	}
+	if first.AmountZScore < 3 {
+		t.Errorf("expected z-score above 3, got %v", first.AmountZScore)
+	}
+	for _, k := range report.SuspiciousKeys[1:] {
+		if k.HighPriority {
+			t.Errorf("%s should not be high priority", k.IdempotencyKey)
+		}
+	}
+}
+
+func TestGetMerchantStats(t *testing.T) {
+	now := time.Now()
+	avg := 850.0
+	outcomes := domain.MerchantOutcomes{RetriedKeys: 12, Succeeded: 90, Failed: 8, Processing: 2, AvgCompletionMs: &avg}
+	svc := NewReportingService(&reportMockRepo{total: 120, unique: 100, outcomes: outcomes})
+	stats, err := svc.GetMerchantStats(context.Background(), "merchant-1", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.DuplicateCount != 20 || stats.DuplicateRate < 16.66 || stats.DuplicateRate > 16.67 {
+		t.Errorf("expected 20 duplicates at 16.67%%, got %d at %.2f%%", stats.DuplicateCount, stats.DuplicateRate)
+	}
+	if stats.RetriedKeys != 12 || stats.Succeeded != 90 || stats.Failed != 8 || *stats.AvgCompletionMs != 850 {
+		t.Errorf("expected the outcomes included, got %+v", stats.MerchantOutcomes)
+	}
+}
+
+func TestGetStatsTable_SortAndTop(t *testing.T) {
+	repo := &reportMockRepo{allStats: map[string][2]int{
+		"m-big":   {1000, 990},
+		"m-dupes": {100, 50},
+		"m-small": {10, 10},
+	}}
+	svc := NewReportingService(repo)
+	now := time.Now()
+
+	table, err := svc.GetStatsTable(context.Background(), now.Add(-time.Hour), now, StatsSortDuplicateRate, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(table.Merchants) != 2 || table.Merchants[0].MerchantID != "m-dupes" || table.Merchants[1].MerchantID != "m-big" {
+		t.Errorf("unexpected order %+v", table.Merchants)
+	}
+
+	table, _ = svc.GetStatsTable(context.Background(), now.Add(-time.Hour), now, StatsSortMerchant, 0)
+	if len(table.Merchants) != 3 || table.Merchants[0].MerchantID != "m-big" {
+		t.Errorf("expected all merchants by ID, got %+v", table.Merchants)
+	}
+}
+
+func TestDuplicateReport_PaginatedKeepsTotals(t *testing.T) {
+	now := time.Now()
+	repo := &reportMockRepo{
+		total:  30,
+		unique: 3,
+		duplicates: []domain.IdempotencyRecord{
+			{IdempotencyKey: "key-1", AttemptCount: 10, Amount: 1000, Currency: "BRL", FirstSeenAt: now, LastSeenAt: now},
+			{IdempotencyKey: "key-2", AttemptCount: 9, Amount: 1000, Currency: "BRL", FirstSeenAt: now, LastSeenAt: now},
+			{IdempotencyKey: "key-3", AttemptCount: 8, Amount: 1000, Currency: "USD", FirstSeenAt: now, LastSeenAt: now},
+		},
+	}
+	svc := NewReportingService(repo)
+
+	report, err := svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.SuspiciousKeys) != 2 || report.Page == nil || report.Page.Total != 3 || report.Page.NextOffset == nil || *report.Page.NextOffset != 2 {
+		t.Fatalf("unexpected first page: %+v %+v", report.SuspiciousKeys, report.Page)
+	}
+	if report.CurrencyBreakdown["BRL"] != 9000+8000 || report.CurrencyBreakdown["USD"] != 7000 {
+		t.Errorf("expected amounts at risk over every duplicate, got %v", report.CurrencyBreakdown)
+	}
+	if report.AmountAtRisk != nil {
+		t.Errorf("expected no total across BRL and USD without rates, got %d", *report.AmountAtRisk)
+	}
+
+	report, _ = svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{Limit: 2, Offset: 2})
+	if len(report.SuspiciousKeys) != 1 || report.SuspiciousKeys[0].IdempotencyKey != "key-3" || report.Page.NextOffset != nil {
+		t.Errorf("unexpected last page: %+v %+v", report.SuspiciousKeys, report.Page)
+	}
+
+	report, _ = svc.GetDuplicateReport(context.Background(), "merchant-1", now.Add(-time.Hour), now, domain.Page{})
+	if report.Page != nil || len(report.SuspiciousKeys) != 3 {
+		t.Errorf("expected an unpaginated report without page info, got %+v", report.Page)
+	}
+}
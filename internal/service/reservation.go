@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// ReservationStore holds idempotency keys reserved ahead of their payments.
+type ReservationStore interface {
+	ReserveKey(ctx context.Context, key, merchantID string, expiresAt time.Time) (*domain.KeyReservation, error)
+	// CheckReservation reports whether merchantID holds a reservation of
+	// key, or returns domain.ErrKeyReserved when another merchant holds a
+	// live one.
+	CheckReservation(ctx context.Context, key, merchantID string) (bool, error)
+	// ClaimReservation releases merchantID's reservation of key once its
+	// payment is stored.
+	ClaimReservation(ctx context.Context, key, merchantID string) error
+}
+
+// WithReservations lets clients reserve keys for reservationTTL before the
+// payment, and has payments claim the keys reserved for them.
+func (s *IdempotencyService) WithReservations(store ReservationStore, reservationTTL time.Duration) *IdempotencyService {
+	s.reservations = store
+	s.reservationTTL = reservationTTL
+	return s
+}
+
+// ReservationsEnabled reports whether keys can be reserved.
+func (s *IdempotencyService) ReservationsEnabled() bool {
+	return s.reservations != nil
+}
+
+// ReserveKey reserves req's key, or a generated UUID when it has none, for
+// the merchant. The key is validated like a payment's.
+func (s *IdempotencyService) ReserveKey(ctx context.Context, req domain.ReserveKeyRequest) (*domain.KeyReservation, int, error) {
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = newUUID()
+	}
+	if err := validateReservation(req); err != nil {
+		return nil, 422, err
+	}
+
+	ctx, fields := logging.NewContext(ctx)
+	fields.MerchantID = req.MerchantID
+	fields.KeyHash = logging.HashKey(req.IdempotencyKey)
+	if _, code, err := s.merchantPolicy(ctx, req.MerchantID); err != nil {
+		return nil, code, err
+	}
+
+	res, err := s.reservations.ReserveKey(ctx, req.IdempotencyKey, req.MerchantID, time.Now().Add(s.reservationTTL))
+	switch {
+	case err == nil:
+		return res, 201, nil
+	case errors.Is(err, domain.ErrKeyReserved), errors.Is(err, domain.ErrKeyInUse):
+		return nil, 409, err
+	}
+	return nil, repoErrorCode(err), fmt.Errorf("reserve key: %w", err)
+}
+
+// checkReservation refuses req when another merchant reserved its key, and
+// reports whether req's merchant holds the reservation.
+func (s *IdempotencyService) checkReservation(ctx context.Context, req domain.PaymentRequest) (bool, int, error) {
+	if s.reservations == nil {
+		return false, 0, nil
+	}
+	held, err := s.reservations.CheckReservation(ctx, req.IdempotencyKey, req.MerchantID)
+	switch {
+	case err == nil:
+		return held, 0, nil
+	case errors.Is(err, domain.ErrKeyReserved):
+		return false, 409, err
+	}
+	return false, repoErrorCode(err), fmt.Errorf("check reservation: %w", err)
+}
+
+// claimReservation releases the reservation req's merchant held once the
+// payment is stored, so a failed insert leaves the key reserved. The
+// payment stands if the release fails: the reservation lapses on its own
+// and the sweeper deletes it.
+func (s *IdempotencyService) claimReservation(ctx context.Context, req domain.PaymentRequest) {
+	if err := s.reservations.ClaimReservation(ctx, req.IdempotencyKey, req.MerchantID); err != nil {
+		logging.From(ctx).Warnf("claim reservation: %v", err)
+	}
+}
+
+// validateReservation checks a reservation like validateRequest checks a
+// payment's key and merchant.
+func validateReservation(req domain.ReserveKeyRequest) error {
+	var errs domain.ValidationErrors
+	switch {
+	case len(req.IdempotencyKey) > MaxIdempotencyKeyLength:
+		errs = append(errs, &domain.ValidationError{Field: "idempotency_key", Rule: "max_length", Max: MaxIdempotencyKeyLength})
+	case !printableASCII(req.IdempotencyKey):
+		errs = append(errs, &domain.ValidationError{Field: "idempotency_key", Rule: "charset"})
+	}
+	if req.MerchantID == "" {
+		errs = append(errs, &domain.ValidationError{Field: "merchant_id", Rule: "required"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
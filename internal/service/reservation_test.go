@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// fakeReservations keeps reservations in a map and ignores expiry.
+type fakeReservations struct {
+	mu       sync.Mutex
+	reserved map[string]string
+	claimed  []string
+}
+
+func newFakeReservations() *fakeReservations {
+	return &fakeReservations{reserved: map[string]string{}}
+}
+
+func (f *fakeReservations) ReserveKey(_ context.Context, key, merchantID string, expiresAt time.Time) (*domain.KeyReservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if owner, ok := f.reserved[key]; ok && owner != merchantID {
+		return nil, domain.ErrKeyReserved
+	}
+	f.reserved[key] = merchantID
+	return &domain.KeyReservation{IdempotencyKey: key, MerchantID: merchantID, ReservedAt: time.Now(), ExpiresAt: expiresAt}, nil
+}
+
+func (f *fakeReservations) CheckReservation(_ context.Context, key, merchantID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, ok := f.reserved[key]
+	if ok && owner != merchantID {
+		return false, domain.ErrKeyReserved
+	}
+	return ok, nil
+}
+
+func (f *fakeReservations) ClaimReservation(_ context.Context, key, merchantID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reserved[key] == merchantID {
+		delete(f.reserved, key)
+		f.claimed = append(f.claimed, key)
+	}
+	return nil
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestReserveKey_GeneratesKeyWhenNoneGiven(t *testing.T) {
+	store := newFakeReservations()
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithReservations(store, 30*time.Minute)
+
+	res, code, err := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{MerchantID: "merchant-1"})
+	if err != nil || code != 201 {
+		t.Fatalf("expected 201, got %d %v", code, err)
+	}
+	if !uuidPattern.MatchString(res.IdempotencyKey) {
+		t.Errorf("expected a generated UUID key, got %q", res.IdempotencyKey)
+	}
+	if ttl := time.Until(res.ExpiresAt); ttl < 29*time.Minute || ttl > 30*time.Minute {
+		t.Errorf("expected the reservation to last 30m, got %s", ttl)
+	}
+
+	res, _, err = svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{IdempotencyKey: "order-42", MerchantID: "merchant-1"})
+	if err != nil || res.IdempotencyKey != "order-42" {
+		t.Errorf("expected the given key reserved, got %+v %v", res, err)
+	}
+}
+
+func TestReserveKey_Rejections(t *testing.T) {
+	store := newFakeReservations()
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithReservations(store, 30*time.Minute)
+	svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{IdempotencyKey: "taken", MerchantID: "merchant-1"})
+
+	_, code, err := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{IdempotencyKey: "taken", MerchantID: "merchant-2"})
+	if code != 409 || !errors.Is(err, domain.ErrKeyReserved) {
+		t.Errorf("expected 409 for another merchant's key, got %d %v", code, err)
+	}
+	if _, code, _ := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{IdempotencyKey: "taken"}); code != 422 {
+		t.Errorf("expected 422 without a merchant, got %d", code)
+	}
+	if _, code, _ := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{IdempotencyKey: "bad\nkey", MerchantID: "merchant-1"}); code != 422 {
+		t.Errorf("expected 422 for a non-printable key, got %d", code)
+	}
+}
+
+func TestProcessPayment_ClaimsReservedKey(t *testing.T) {
+	store := newFakeReservations()
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).WithReservations(store, 30*time.Minute)
+	res, _, _ := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{MerchantID: "merchant-1"})
+
+	req := domain.PaymentRequest{IdempotencyKey: res.IdempotencyKey, MerchantID: "merchant-2", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	if _, code, err := svc.ProcessPayment(context.Background(), req); code != 409 || !errors.Is(err, domain.ErrKeyReserved) {
+		t.Errorf("expected 409 for another merchant's reserved key, got %d %v", code, err)
+	}
+
+	req.MerchantID = "merchant-1"
+	if _, code, err := svc.ProcessPayment(context.Background(), req); code != 201 {
+		t.Fatalf("expected the reserving merchant's payment to succeed, got %d %v", code, err)
+	}
+	if len(store.claimed) != 1 || len(store.reserved) != 0 {
+		t.Errorf("expected the reservation claimed, got %+v", store)
+	}
+}
+
+// unavailableInserts fails every InsertOrGet, as a storage outage would.
+type unavailableInserts struct{ *mockRepo }
+
+func (unavailableInserts) InsertOrGet(_ context.Context, _ domain.PaymentRequest, _ string, _ time.Time) (*domain.IdempotencyRecord, bool, error) {
+	return nil, false, domain.ErrUnavailable
+}
+
+func TestProcessPayment_KeepsReservationWhenInsertFails(t *testing.T) {
+	store := newFakeReservations()
+	svc := NewIdempotencyService(unavailableInserts{newMockRepo()}, 24*time.Hour).WithReservations(store, 30*time.Minute)
+	res, _, _ := svc.ReserveKey(context.Background(), domain.ReserveKeyRequest{MerchantID: "merchant-1"})
+
+	req := domain.PaymentRequest{IdempotencyKey: res.IdempotencyKey, MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	if _, _, err := svc.ProcessPayment(context.Background(), req); !errors.Is(err, domain.ErrUnavailable) {
+		t.Fatalf("expected the insert to fail, got %v", err)
+	}
+	if len(store.claimed) != 0 || store.reserved[res.IdempotencyKey] != "merchant-1" {
+		t.Errorf("expected the reservation kept for the retry, got %+v", store)
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/jsonschema"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// responseSchemaTTL is how long a merchant's compiled response schema is
+// reused before the policy is read again, so schema changes take effect
+// within this window on every instance.
+const responseSchemaTTL = time.Minute
+
+type cachedSchema struct {
+	schema   *jsonschema.Schema // nil when the merchant has no schema
+	loadedAt time.Time
+}
+
+// responseSchemas caches compiled per-merchant response schemas.
+type responseSchemas struct {
+	mu      sync.Mutex
+	entries map[string]cachedSchema
+	now     func() time.Time
+}
+
+func newResponseSchemas() *responseSchemas {
+	return &responseSchemas{entries: make(map[string]cachedSchema), now: time.Now}
+}
+
+// validateResponse checks a succeeded completion's body against the response
+// schema of rec's merchant, if one is registered. Complete passes the record
+// it read, so the schema comes from the cache without reading it again.
+func (s *IdempotencyService) validateResponse(ctx context.Context, rec *domain.IdempotencyRecord, req domain.CompleteRequest) error {
+	if req.Status != domain.StatusSucceeded {
+		return nil
+	}
+	if rec.Status != domain.StatusProcessing {
+		return nil // MarkComplete reports ErrAlreadyCompleted
+	}
+	schema, err := s.responseSchema(ctx, rec.MerchantID)
+	if err != nil || schema == nil {
+		return err
+	}
+
+	body := []byte("null")
+	if req.ResponseBody != nil {
+		body = *req.ResponseBody
+	}
+	if problems := schema.ValidateJSON(body); len(problems) > 0 {
+		return &domain.ResponseSchemaError{Problems: problems}
+	}
+	return nil
+}
+
+func (s *IdempotencyService) responseSchema(ctx context.Context, merchantID string) (*jsonschema.Schema, error) {
+	c := s.schemas
+	c.mu.Lock()
+	entry, ok := c.entries[merchantID]
+	c.mu.Unlock()
+	if ok && c.now().Sub(entry.loadedAt) < responseSchemaTTL {
+		return entry.schema, nil
+	}
+
+	entry = cachedSchema{loadedAt: c.now()}
+	policy, err := s.repo.GetPolicy(ctx, merchantID)
+	switch {
+	case errors.Is(err, domain.ErrMerchantNotFound):
+	case err != nil:
+		return nil, err
+	case policy.ResponseSchema != nil:
+		// Schemas are validated when registered; a bad one here means the
+		// row was edited by hand, so don't block completions over it.
+		if entry.schema, err = jsonschema.Compile(*policy.ResponseSchema); err != nil {
+			logging.From(ctx).Warnf("ignoring invalid response schema: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.entries[merchantID] = entry
+	c.mu.Unlock()
+	return entry.schema, nil
+}
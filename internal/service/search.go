@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// defaultSearchLimit is the page size of a key search that sets no limit.
+const defaultSearchLimit = 50
+
+// SearchRecords returns one page of the records matching filter, newest
+// first, for support lookups.
+func (s *IdempotencyService) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) (*domain.RecordSearch, error) {
+	if page.Limit == 0 {
+		page.Limit = defaultSearchLimit
+	}
+	records, total, err := s.repo.SearchRecords(ctx, filter, page)
+	if err != nil {
+		return nil, fmt.Errorf("search records: %w", err)
+	}
+	if records == nil {
+		records = []domain.IdempotencyRecord{}
+	}
+	return &domain.RecordSearch{Keys: records, Page: *domain.NewPageInfo(page, len(records), total)}, nil
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+const (
+	// velocityAttempts within velocityWindow of a key's first attempt is a
+	// velocity hit.
+	velocityAttempts = 5
+	velocityWindow   = time.Minute
+	// crossKeyWindow is how far back keys with the same parameters count as
+	// cross-key duplicates.
+	crossKeyWindow = 10 * time.Minute
+)
+
+// SignalSink receives fraud signals. Emit must not block the request.
+type SignalSink interface {
+	Emit(domain.FraudSignal)
+}
+
+// SignalStore finds other keys carrying the same payment parameters.
+type SignalStore interface {
+	CountSameParams(ctx context.Context, merchantID, requestHash, excludeKey string, since time.Time) (int, error)
+}
+
+// WithSignals enables fraud signal detection for merchants whose policy sets
+// fraud_export. A nil store disables cross-key duplicate detection.
+func (s *IdempotencyService) WithSignals(sink SignalSink, store SignalStore) *IdempotencyService {
+	s.signals = sink
+	s.signalStore = store
+	return s
+}
+
+// detectSignals emits the fraud signals rec triggers. Each threshold fires
+// once per key, on the attempt that crosses it. Lookup failures are logged and
+// never fail the request.
+func (s *IdempotencyService) detectSignals(ctx context.Context, rec *domain.IdempotencyRecord, isNew bool) {
+	if s.signals == nil {
+		return
+	}
+	now := time.Now()
+	var kinds []string
+	if !isNew {
+		if rec.AttemptCount == suspiciousThreshold+1 {
+			kinds = append(kinds, domain.SignalSuspiciousKey)
+		}
+		if rec.AttemptCount == velocityAttempts && now.Sub(rec.FirstSeenAt) <= velocityWindow {
+			kinds = append(kinds, domain.SignalVelocity)
+		}
+		if len(kinds) == 0 {
+			return
+		}
+	} else if s.signalStore == nil {
+		return
+	}
+
+	policy, err := s.repo.GetPolicy(ctx, rec.MerchantID)
+	if err != nil {
+		if !errors.Is(err, domain.ErrMerchantNotFound) {
+			logging.From(ctx).Warnf("fraud export policy lookup failed: %v", err)
+		}
+		return
+	}
+	if !policy.FraudExport {
+		return
+	}
+
+	related := 0
+	if isNew {
+		related, err = s.signalStore.CountSameParams(ctx, rec.MerchantID, rec.RequestHash, rec.IdempotencyKey, now.Add(-crossKeyWindow))
+		if err != nil {
+			logging.From(ctx).Warnf("cross-key duplicate lookup failed: %v", err)
+			return
+		}
+		if related == 0 {
+			return
+		}
+		kinds = append(kinds, domain.SignalCrossKeyDuplicate)
+	}
+
+	for _, kind := range kinds {
+		s.signals.Emit(domain.FraudSignal{
+			Kind:           kind,
+			MerchantID:     rec.MerchantID,
+			IdempotencyKey: rec.IdempotencyKey,
+			PaymentID:      rec.PaymentID,
+			CustomerID:     rec.CustomerID,
+			Amount:         rec.Amount,
+			Currency:       rec.Currency,
+			AttemptCount:   rec.AttemptCount,
+			DetectedAt:     now.UTC(),
+			RelatedKeys:    related,
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type signalRecorder []domain.FraudSignal
+
+func (r *signalRecorder) Emit(s domain.FraudSignal) { *r = append(*r, s) }
+
+func (r signalRecorder) kinds() []string {
+	kinds := make([]string, len(r))
+	for i, s := range r {
+		kinds[i] = s.Kind
+	}
+	return kinds
+}
+
+type sameParamsStore int
+
+func (n sameParamsStore) CountSameParams(_ context.Context, _, _, _ string, _ time.Time) (int, error) {
+	return int(n), nil
+}
+
+func TestSignals_SuspiciousAndVelocityFireOnce(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{FraudExport: true}}
+	sink := &signalRecorder{}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithSignals(sink, nil)
+	req := domain.PaymentRequest{IdempotencyKey: "signal-key", MerchantID: "merchant-1", CustomerID: "c1", Amount: 5000, Currency: "BRL"}
+
+	for i := 0; i < 7; i++ {
+		svc.ProcessPayment(context.Background(), req)
+	}
+	if got := fmt.Sprint(sink.kinds()); got != "[suspicious_key velocity]" {
+		t.Errorf("expected one suspicious_key and one velocity signal, got %s", got)
+	}
+	if (*sink)[0].AttemptCount != suspiciousThreshold+1 {
+		t.Errorf("expected signal on attempt %d, got %d", suspiciousThreshold+1, (*sink)[0].AttemptCount)
+	}
+}
+
+func TestSignals_CrossKeyDuplicate(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo(), policy: domain.MerchantPolicy{FraudExport: true}}
+	sink := &signalRecorder{}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithSignals(sink, sameParamsStore(2))
+	req := domain.PaymentRequest{IdempotencyKey: "cross-key", MerchantID: "merchant-1", CustomerID: "c1", Amount: 5000, Currency: "BRL"}
+
+	svc.ProcessPayment(context.Background(), req)
+	if len(*sink) != 1 || (*sink)[0].Kind != domain.SignalCrossKeyDuplicate || (*sink)[0].RelatedKeys != 2 {
+		t.Errorf("expected a cross-key duplicate with 2 related keys, got %+v", *sink)
+	}
+}
+
+func TestSignals_DisabledForMerchant(t *testing.T) {
+	repo := &policyRepo{mockRepo: newMockRepo()}
+	sink := &signalRecorder{}
+	svc := NewIdempotencyService(repo, 24*time.Hour).WithSignals(sink, sameParamsStore(5))
+	req := domain.PaymentRequest{IdempotencyKey: "quiet-key", MerchantID: "merchant-1", CustomerID: "c1", Amount: 5000, Currency: "BRL"}
+
+	for i := 0; i < 6; i++ {
+		svc.ProcessPayment(context.Background(), req)
+	}
+	if len(*sink) != 0 {
+		t.Errorf("expected no signals without fraud_export, got %v", sink.kinds())
+	}
+}
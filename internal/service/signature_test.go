@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestSignatureVerifier_Verify(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	policies := policyMap{
+		"signed":   {MerchantID: "signed", SigningSecret: "s3cret"},
+		"unsigned": {MerchantID: "unsigned"},
+	}
+	v := NewSignatureVerifier(policies, 5*time.Minute)
+	v.now = func() time.Time { return now }
+	ctx := context.Background()
+	body := []byte(`{"merchant_id":"signed","amount":100}`)
+	ts := strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)
+	sig := Sign("s3cret", ts, body)
+
+	if err := v.Verify(ctx, []string{"signed"}, ts, sig, body); err != nil {
+		t.Errorf("expected a valid signature accepted, got %v", err)
+	}
+	if err := v.Verify(ctx, []string{"unsigned", "unknown"}, "", "", body); err != nil {
+		t.Errorf("expected merchants without a secret to need no signature, got %v", err)
+	}
+	tampered := []byte(`{"merchant_id":"signed","amount":999}`)
+	if err := v.Verify(ctx, []string{"signed"}, ts, sig, tampered); !errors.Is(err, domain.ErrInvalidSignature) {
+		t.Errorf("tampered body: expected ErrInvalidSignature, got %v", err)
+	}
+	if err := v.Verify(ctx, []string{"signed"}, ts, "", body); !errors.Is(err, domain.ErrInvalidSignature) {
+		t.Errorf("missing signature: expected ErrInvalidSignature, got %v", err)
+	}
+	old := strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10)
+	if err := v.Verify(ctx, []string{"signed"}, old, Sign("s3cret", old, body), body); !errors.Is(err, domain.ErrSignatureExpired) {
+		t.Errorf("stale timestamp: expected ErrSignatureExpired, got %v", err)
+	}
+	if err := v.Verify(ctx, []string{"signed"}, "", sig, body); !errors.Is(err, domain.ErrSignatureExpired) {
+		t.Errorf("missing timestamp: expected ErrSignatureExpired, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/i18n"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// ReclaimRecorder counts keys taken over after the processing timeout.
+type ReclaimRecorder interface {
+	RecordReclaimed()
+}
+
+// WithProcessingTimeout lets a duplicate take over a key that has been
+// processing for longer than timeout, as a retry of a failed attempt would:
+// the worker that held it is presumed dead. Reclaims are counted in recorder,
+// which may be nil.
+func (s *IdempotencyService) WithProcessingTimeout(timeout time.Duration, recorder ReclaimRecorder) *IdempotencyService {
+	s.processingTimeout = timeout
+	s.reclaims = recorder
+	return s
+}
+
+// isStale reports whether rec has been processing past the timeout.
+func (s *IdempotencyService) isStale(rec *domain.IdempotencyRecord) bool {
+	return s.processingTimeout > 0 && time.Since(rec.ProcessingSince) > s.processingTimeout
+}
+
+// reclaim resets a stale processing record for the duplicate that found it.
+// The reset compares versions, so of several duplicates racing for the key
+// only one takes it over; the others get ErrConcurrentUpdate.
+func (s *IdempotencyService) reclaim(ctx context.Context, rec *domain.IdempotencyRecord, idFormat string, expiresAt time.Time) (*domain.PaymentResponse, int, error) {
+	paymentID, err := withPaymentID(ctx, idFormat, func(paymentID string) error {
+		return s.repo.ResetToProcessing(ctx, rec.IdempotencyKey, rec.Version, paymentID, expiresAt)
+	})
+	if err != nil {
+		return nil, repoErrorCode(err), fmt.Errorf("reclaim stale processing: %w", err)
+	}
+	logging.From(ctx).Warnf("reclaimed key processing since %s; previous payment ID %s", rec.ProcessingSince.UTC().Format(time.RFC3339), rec.PaymentID)
+	logging.FromContext(ctx).PaymentID = paymentID
+	if s.reclaims != nil {
+		s.reclaims.RecordReclaimed()
+	}
+	return &domain.PaymentResponse{
+		PaymentID:      paymentID,
+		IdempotencyKey: rec.IdempotencyKey,
+		Status:         domain.StatusProcessing,
+		Code:           string(i18n.MsgReclaimedStale),
+		Message:        i18n.Message(i18n.DefaultLanguage, i18n.MsgReclaimedStale),
+		AttemptCount:   rec.AttemptCount,
+	}, 201, nil
+}
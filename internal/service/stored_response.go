@@ -0,0 +1,58 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// reservedHeaders are set by the HTTP server or by the shield when it
+// replays a response, so completions cannot store them.
+var reservedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Content-Language":  true,
+	"Retry-After":       true,
+}
+
+// storedResponse validates the status and headers a completion asks to be
+// replayed with and returns the response to store. Header names are
+// canonicalized so replays and lookups agree on them.
+func storedResponse(req domain.CompleteRequest) (domain.StoredResponse, error) {
+	resp := domain.StoredResponse{Status: req.ResponseStatus, Body: req.ResponseBody}
+	if req.ResponseStatus != 0 && (req.ResponseStatus < 200 || req.ResponseStatus > 599) {
+		return resp, domain.ErrInvalidStoredResponse
+	}
+	if len(req.ResponseHeaders) == 0 {
+		return resp, nil
+	}
+	if len(req.ResponseHeaders) > domain.MaxStoredHeaders {
+		return resp, domain.ErrInvalidStoredResponse
+	}
+	resp.Headers = make(map[string]string, len(req.ResponseHeaders))
+	for name, value := range req.ResponseHeaders {
+		canonical := http.CanonicalHeaderKey(name)
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) ||
+			reservedHeaders[canonical] || isShieldHeader(canonical) {
+			return resp, domain.ErrInvalidStoredResponse
+		}
+		resp.Headers[canonical] = value
+	}
+	return resp, nil
+}
+
+// isShieldHeader reports whether name is one of the Idempotency-* headers
+// the shield answers with.
+func isShieldHeader(name string) bool {
+	return strings.HasPrefix(name, "Idempotency-")
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestProcessPayment_ReplaysStoredResponse(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	req := domain.PaymentRequest{IdempotencyKey: "key-replay", MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+	svc.ProcessPayment(context.Background(), req)
+
+	body := json.RawMessage(`{"id":"ch_1"}`)
+	err := svc.MarkComplete(context.Background(), "key-replay", domain.CompleteRequest{
+		Status:          domain.StatusSucceeded,
+		ResponseBody:    &body,
+		ResponseStatus:  201,
+		ResponseHeaders: map[string]string{"location": "/charges/ch_1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, code, err := svc.ProcessPayment(context.Background(), req)
+	if err != nil || code != 201 || resp.Replay == nil {
+		t.Fatalf("expected a 201 replay, got %d %+v %v", code, resp, err)
+	}
+	if resp.Replay.Headers["Location"] != "/charges/ch_1" || string(*resp.Replay.Body) != `{"id":"ch_1"}` {
+		t.Errorf("unexpected replay: %+v", resp.Replay)
+	}
+}
+
+func TestMarkComplete_InvalidStoredResponse(t *testing.T) {
+	many := make(map[string]string)
+	for i := 0; i <= domain.MaxStoredHeaders; i++ {
+		many[fmt.Sprintf("X-H%d", i)] = "v"
+	}
+	cases := []domain.CompleteRequest{
+		{ResponseStatus: 199},
+		{ResponseStatus: 600},
+		{ResponseStatus: 200, ResponseHeaders: map[string]string{"Content-Length": "10"}},
+		{ResponseStatus: 200, ResponseHeaders: map[string]string{"idempotency-replayed": "false"}},
+		{ResponseStatus: 200, ResponseHeaders: map[string]string{"Bad Name": "v"}},
+		{ResponseStatus: 200, ResponseHeaders: map[string]string{"X-Ok": "line\r\nbreak"}},
+		{ResponseStatus: 200, ResponseHeaders: many},
+	}
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	for _, c := range cases {
+		c.Status = domain.StatusSucceeded
+		if err := svc.MarkComplete(context.Background(), "any-key", c); !errors.Is(err, domain.ErrInvalidStoredResponse) {
+			t.Errorf("%+v: expected ErrInvalidStoredResponse, got %v", c, err)
+		}
+	}
+}
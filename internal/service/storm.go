@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// maxStormBackoff caps the Retry-After a throttled key is told to wait.
+const maxStormBackoff = 5 * time.Minute
+
+// StormRecorder counts keys throttled by a StormGuard.
+type StormRecorder interface {
+	RecordThrottled()
+}
+
+// StormGuard throttles duplicate storms: a client resending one key in a
+// tight loop. A key that takes more attempts than its merchant's
+// storm_threshold (or the deployment default) within the window is answered
+// 429 in the process, before storage, with a Retry-After that doubles on
+// every attempt made during the storm, up to maxStormBackoff. The storm ends
+// once the key has been left alone for a whole window. Each instance counts
+// its own attempts, as RateLimiter does.
+type StormGuard struct {
+	policies  PolicyReader
+	threshold int
+	window    time.Duration
+	audit     AuditSink
+	recorder  StormRecorder
+
+	mu         sync.Mutex
+	keys       map[string]*stormKey
+	thresholds map[string]stormThreshold
+	lastPrune  time.Time
+	now        func() time.Time
+}
+
+type stormKey struct {
+	windowStart time.Time
+	attempts    int
+	strikes     int // attempts throttled since the storm began
+	last        time.Time
+}
+
+type stormThreshold struct {
+	attempts int
+	loadedAt time.Time
+}
+
+// NewStormGuard creates a StormGuard allowing threshold attempts per key
+// within window. A zero threshold throttles only merchants whose policy
+// sets one.
+func NewStormGuard(policies PolicyReader, threshold int, window time.Duration) *StormGuard {
+	return &StormGuard{
+		policies:   policies,
+		threshold:  threshold,
+		window:     window,
+		keys:       make(map[string]*stormKey),
+		thresholds: make(map[string]stormThreshold),
+		now:        time.Now,
+	}
+}
+
+// WithAudit records a key_throttled event to sink when a key's storm begins.
+func (g *StormGuard) WithAudit(sink AuditSink) *StormGuard {
+	g.audit = sink
+	return g
+}
+
+// WithRecorder counts each storm in recorder.
+func (g *StormGuard) WithRecorder(recorder StormRecorder) *StormGuard {
+	g.recorder = recorder
+	return g
+}
+
+// Allow counts an attempt at req's key. When the key is storming it returns
+// false and how long the client should wait.
+func (g *StormGuard) Allow(ctx context.Context, req domain.PaymentRequest) (bool, time.Duration) {
+	threshold := g.thresholdFor(ctx, req.MerchantID)
+	if threshold <= 0 {
+		return true, 0
+	}
+
+	g.mu.Lock()
+	now := g.now()
+	g.prune(now)
+	k, ok := g.keys[req.IdempotencyKey]
+	if !ok {
+		k = &stormKey{}
+		g.keys[req.IdempotencyKey] = k
+	}
+	switch {
+	case now.Sub(k.last) >= g.window:
+		k.windowStart, k.attempts, k.strikes = now, 0, 0
+	case k.strikes == 0 && now.Sub(k.windowStart) >= g.window:
+		// A storm keeps its count until the client backs off for a window.
+		k.windowStart, k.attempts = now, 0
+	}
+	k.last = now
+	k.attempts++
+	if k.attempts <= threshold {
+		g.mu.Unlock()
+		return true, 0
+	}
+	k.strikes++
+	strikes, attempts := k.strikes, k.attempts
+	g.mu.Unlock()
+
+	if strikes == 1 {
+		g.stormBegan(ctx, req, attempts)
+	}
+	return false, stormBackoff(strikes)
+}
+
+// stormBackoff is 1s doubled for every throttled attempt before this one.
+func stormBackoff(strikes int) time.Duration {
+	if strikes > 30 {
+		return maxStormBackoff
+	}
+	if d := time.Second << (strikes - 1); d < maxStormBackoff {
+		return d
+	}
+	return maxStormBackoff
+}
+
+// stormBegan logs, counts and audits the first throttled attempt of a storm.
+func (g *StormGuard) stormBegan(ctx context.Context, req domain.PaymentRequest, attempts int) {
+	keyHash := logging.HashKey(req.IdempotencyKey)
+	logging.From(ctx).Warnf("key %s throttled after %d attempts within %s", keyHash, attempts, g.window)
+	if g.recorder != nil {
+		g.recorder.RecordThrottled()
+	}
+	if g.audit != nil {
+		g.audit.Record(domain.AuditEvent{
+			Kind:         domain.AuditKeyThrottled,
+			Time:         g.now().UTC(),
+			MerchantID:   req.MerchantID,
+			KeyHash:      keyHash,
+			AttemptCount: attempts,
+			SourceIP:     req.Source.IP,
+			UserAgent:    req.Source.UserAgent,
+			RequestID:    req.Source.RequestID,
+		})
+	}
+}
+
+// thresholdFor returns merchantID's threshold, reading its policy at most
+// once per rateLimitPolicyTTL. Policy lookups never fail the request; any
+// problem falls back to the default.
+func (g *StormGuard) thresholdFor(ctx context.Context, merchantID string) int {
+	g.mu.Lock()
+	t, ok := g.thresholds[merchantID]
+	g.mu.Unlock()
+	if ok && g.now().Sub(t.loadedAt) < rateLimitPolicyTTL {
+		return t.attempts
+	}
+
+	attempts := g.threshold
+	if policy, err := g.policies.GetPolicy(ctx, merchantID); err == nil && policy.StormThreshold > 0 {
+		attempts = policy.StormThreshold
+	}
+	g.mu.Lock()
+	g.thresholds[merchantID] = stormThreshold{attempts: attempts, loadedAt: g.now()}
+	g.mu.Unlock()
+	return attempts
+}
+
+// prune drops, at most once per window, keys left alone for a window, which
+// would start afresh anyway, and thresholds due for reloading. The caller
+// holds mu.
+func (g *StormGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < g.window {
+		return
+	}
+	g.lastPrune = now
+	for key, k := range g.keys {
+		if now.Sub(k.last) >= g.window {
+			delete(g.keys, key)
+		}
+	}
+	for id, t := range g.thresholds {
+		if now.Sub(t.loadedAt) >= rateLimitPolicyTTL {
+			delete(g.thresholds, id)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+type stormCounter struct{ n atomic.Int64 }
+
+func (c *stormCounter) RecordThrottled() { c.n.Add(1) }
+
+func newTestStormGuard(threshold int) (*StormGuard, policyMap, *time.Time) {
+	policies := policyMap{}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := NewStormGuard(policies, threshold, 10*time.Second)
+	g.now = func() time.Time { return now }
+	return g, policies, &now
+}
+
+func TestStormGuard_ThrottlesWithGrowingBackoff(t *testing.T) {
+	g, _, now := newTestStormGuard(3)
+	audit, counter := &auditLog{}, &stormCounter{}
+	g.WithAudit(audit).WithRecorder(counter)
+	ctx := context.Background()
+	req := adminKeyRequest("loop-1")
+	req.Source = supportDesk
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := g.Allow(ctx, req); !ok {
+			t.Fatalf("attempt %d: expected attempts up to the threshold allowed", i)
+		}
+		*now = now.Add(time.Second)
+	}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if ok, wait := g.Allow(ctx, req); ok || wait != want {
+			t.Errorf("expected a denial with a %s wait, got %v %s", want, ok, wait)
+		}
+	}
+	if ok, _ := g.Allow(ctx, adminKeyRequest("loop-2")); !ok {
+		t.Error("expected keys to be counted separately")
+	}
+
+	events := audit.kinds(domain.AuditKeyThrottled)
+	if len(events) != 1 || counter.n.Load() != 1 {
+		t.Fatalf("expected the storm recorded once, got %d events and %d counted", len(events), counter.n.Load())
+	}
+	if ev := events[0]; ev.MerchantID != "merchant-1" || ev.AttemptCount != 4 || ev.SourceIP != "10.9.9.9" || ev.KeyHash == "" {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+}
+
+func TestStormGuard_EndsAfterQuietWindow(t *testing.T) {
+	g, _, now := newTestStormGuard(2)
+	ctx := context.Background()
+	req := adminKeyRequest("loop-3")
+
+	for i := 0; i < 3; i++ {
+		g.Allow(ctx, req)
+	}
+	// Hammering past the window keeps the storm going.
+	*now = now.Add(9 * time.Second)
+	g.Allow(ctx, req)
+	*now = now.Add(9 * time.Second)
+	if ok, wait := g.Allow(ctx, req); ok || wait != 4*time.Second {
+		t.Errorf("expected the storm to last while the key is hammered, got %v %s", ok, wait)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if ok, _ := g.Allow(ctx, req); !ok {
+		t.Error("expected the key allowed after a quiet window")
+	}
+}
+
+func TestStormGuard_PolicyThreshold(t *testing.T) {
+	g, policies, _ := newTestStormGuard(0)
+	policies["merchant-1"] = &domain.MerchantPolicy{MerchantID: "merchant-1", StormThreshold: 1}
+	ctx := context.Background()
+
+	g.Allow(ctx, adminKeyRequest("loop-4"))
+	if ok, _ := g.Allow(ctx, adminKeyRequest("loop-4")); ok {
+		t.Error("expected the policy threshold enforced")
+	}
+	other := adminKeyRequest("loop-5")
+	other.MerchantID = "merchant-2"
+	for i := 0; i < 100; i++ {
+		if ok, _ := g.Allow(ctx, other); !ok {
+			t.Fatalf("attempt %d: expected no throttling without a threshold", i)
+		}
+	}
+}
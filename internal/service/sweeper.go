@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ExpiredDeleter removes expired keys a batch at a time.
+type ExpiredDeleter interface {
+	DeleteExpired(ctx context.Context, limit int) (int64, error)
+}
+
+// ExpiredArchiver moves expired keys to an archive a batch at a time, and
+// purges archived keys once they are past retention.
+type ExpiredArchiver interface {
+	ArchiveExpired(ctx context.Context, limit int) (int64, error)
+	PurgeArchive(ctx context.Context, before time.Time, limit int) (int64, error)
+}
+
+// ExpiredReservationDeleter removes lapsed key reservations a batch at a
+// time.
+type ExpiredReservationDeleter interface {
+	DeleteExpiredReservations(ctx context.Context, limit int) (int64, error)
+}
+
+// WebhookEventPurger removes outbox webhook events and delivery records a
+// batch at a time.
+type WebhookEventPurger interface {
+	PurgeWebhookEvents(ctx context.Context, before time.Time, limit int) (int64, error)
+	PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int64, error)
+}
+
+// SweepRecorder counts the keys a sweep removed.
+type SweepRecorder interface {
+	RecordExpiredDeleted(n int64)
+}
+
+// CleanupObserver is told how many keys each sweep removed; MaintenanceJob
+// uses it to analyze tables after large cleanups.
+type CleanupObserver interface {
+	AfterCleanup(deleted int64)
+}
+
+// Sweeper deletes expired keys in the background. Each sweep deletes batches
+// until one comes back short, so a backlog clears in one run without holding
+// a long transaction.
+type Sweeper struct {
+	repo      ExpiredDeleter
+	interval  time.Duration
+	batchSize int
+	recorder  SweepRecorder
+	observer  CleanupObserver
+	archive   ExpiredArchiver
+	retention time.Duration
+	reserved  ExpiredReservationDeleter
+	events    WebhookEventPurger
+	eventsTTL time.Duration
+}
+
+// NewSweeper creates a Sweeper that runs every interval, deleting batchSize
+// keys per statement.
+func NewSweeper(repo ExpiredDeleter, interval time.Duration, batchSize int) *Sweeper {
+	return &Sweeper{repo: repo, interval: interval, batchSize: batchSize}
+}
+
+// WithRecorder counts deleted keys in recorder.
+func (s *Sweeper) WithRecorder(recorder SweepRecorder) *Sweeper {
+	s.recorder = recorder
+	return s
+}
+
+// WithObserver reports each sweep's total to observer.
+func (s *Sweeper) WithObserver(observer CleanupObserver) *Sweeper {
+	s.observer = observer
+	return s
+}
+
+// WithArchive moves expired keys to archiver instead of deleting them, and
+// purges archived keys older than retention after each sweep; zero
+// retention keeps them forever.
+func (s *Sweeper) WithArchive(archiver ExpiredArchiver, retention time.Duration) *Sweeper {
+	s.archive = archiver
+	s.retention = retention
+	return s
+}
+
+// WithReservations also deletes lapsed key reservations on each sweep.
+func (s *Sweeper) WithReservations(deleter ExpiredReservationDeleter) *Sweeper {
+	s.reserved = deleter
+	return s
+}
+
+// WithWebhookEvents also purges outbox webhook events, and delivery records
+// last attempted, longer ago than retention on each sweep.
+func (s *Sweeper) WithWebhookEvents(purger WebhookEventPurger, retention time.Duration) *Sweeper {
+	s.events = purger
+	s.eventsTTL = retention
+	return s
+}
+
+// Run sweeps on every tick until ctx is done. A sweep in progress stops
+// between batches.
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deleted, err := s.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("sweeper: %v (deleted %d before the error)", err, deleted)
+		}
+	}
+}
+
+// RunOnce deletes, or archives, expired keys until none are left, returning
+// the total, then purges the archive past retention, lapsed reservations
+// and webhook events and deliveries past retention.
+func (s *Sweeper) RunOnce(ctx context.Context) (int64, error) {
+	remove := s.repo.DeleteExpired
+	if s.archive != nil {
+		remove = s.archive.ArchiveExpired
+	}
+	total, err := s.batches(ctx, remove, s.recorder)
+	if total > 0 && s.observer != nil {
+		s.observer.AfterCleanup(total)
+	}
+	if err != nil {
+		return total, err
+	}
+
+	if s.archive != nil && s.retention > 0 {
+		before := time.Now().Add(-s.retention)
+		if _, err := s.batches(ctx, func(ctx context.Context, limit int) (int64, error) {
+			return s.archive.PurgeArchive(ctx, before, limit)
+		}, nil); err != nil {
+			return total, err
+		}
+	}
+	if s.reserved != nil {
+		if _, err := s.batches(ctx, s.reserved.DeleteExpiredReservations, nil); err != nil {
+			return total, err
+		}
+	}
+	if s.events != nil && s.eventsTTL > 0 {
+		before := time.Now().Add(-s.eventsTTL)
+		if _, err := s.batches(ctx, func(ctx context.Context, limit int) (int64, error) {
+			return s.events.PurgeWebhookEvents(ctx, before, limit)
+		}, nil); err != nil {
+			return total, err
+		}
+		_, err = s.batches(ctx, func(ctx context.Context, limit int) (int64, error) {
+			return s.events.PurgeWebhookDeliveries(ctx, before, limit)
+		}, nil)
+	}
+	return total, err
+}
+
+// batches calls fn until a batch comes back short, returning the total.
+func (s *Sweeper) batches(ctx context.Context, fn func(ctx context.Context, limit int) (int64, error), recorder SweepRecorder) (int64, error) {
+	var total int64
+	for ctx.Err() == nil {
+		n, err := fn(ctx, s.batchSize)
+		if n > 0 {
+			total += n
+			if recorder != nil {
+				recorder.RecordExpiredDeleted(n)
+			}
+		}
+		if err != nil {
+			return total, err
+		}
+		if n < int64(s.batchSize) {
+			break
+		}
+	}
+	return total, ctx.Err()
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type expiredKeys struct {
+	remaining int64
+	calls     int
+	err       error
+}
+
+func (e *expiredKeys) DeleteExpired(_ context.Context, limit int) (int64, error) {
+	e.calls++
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := e.remaining
+	if n > int64(limit) {
+		n = int64(limit)
+	}
+	e.remaining -= n
+	return n, nil
+}
+
+type sweepCounter struct{ deleted, cleanups int64 }
+
+func (c *sweepCounter) RecordExpiredDeleted(n int64) { c.deleted += n }
+func (c *sweepCounter) AfterCleanup(n int64)         { c.cleanups += n }
+
+func TestSweeper_DeletesInBatchesUntilShort(t *testing.T) {
+	repo := &expiredKeys{remaining: 250}
+	counter := &sweepCounter{}
+	s := NewSweeper(repo, time.Minute, 100).WithRecorder(counter).WithObserver(counter)
+
+	total, err := s.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 250 || repo.calls != 3 {
+		t.Errorf("expected 250 deleted in 3 batches, got %d in %d", total, repo.calls)
+	}
+	if counter.deleted != 250 || counter.cleanups != 250 {
+		t.Errorf("expected the total recorded and observed, got %d %d", counter.deleted, counter.cleanups)
+	}
+}
+
+func TestSweeper_StopsOnErrorAndCancel(t *testing.T) {
+	repo := &expiredKeys{err: errors.New("db down")}
+	if _, err := NewSweeper(repo, time.Minute, 100).RunOnce(context.Background()); err == nil {
+		t.Error("expected the repository error")
+	}
+
+	repo = &expiredKeys{remaining: 1000}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if total, _ := NewSweeper(repo, time.Minute, 100).RunOnce(ctx); total != 0 || repo.calls != 0 {
+		t.Errorf("expected no batches after cancellation, got %d in %d", total, repo.calls)
+	}
+}
+
+type archivedKeys struct {
+	expired  expiredKeys
+	archived int64
+	purged   int64
+	before   time.Time
+}
+
+func (a *archivedKeys) ArchiveExpired(ctx context.Context, limit int) (int64, error) {
+	n, err := a.expired.DeleteExpired(ctx, limit)
+	a.archived += n
+	return n, err
+}
+
+func (a *archivedKeys) PurgeArchive(_ context.Context, before time.Time, limit int) (int64, error) {
+	a.before = before
+	n := a.archived - a.purged
+	if n > int64(limit) {
+		n = int64(limit)
+	}
+	a.purged += n
+	return n, nil
+}
+
+func TestSweeper_ArchivesAndPurgesPastRetention(t *testing.T) {
+	repo := &expiredKeys{remaining: 50}
+	archive := &archivedKeys{expired: expiredKeys{remaining: 150}}
+	counter := &sweepCounter{}
+	s := NewSweeper(repo, time.Minute, 100).WithRecorder(counter).WithArchive(archive, 90*24*time.Hour)
+
+	total, err := s.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 150 || archive.archived != 150 || repo.calls != 0 {
+		t.Errorf("expected 150 archived and nothing deleted, got %d %d %d", total, archive.archived, repo.calls)
+	}
+	if counter.deleted != 150 {
+		t.Errorf("expected archived keys counted, got %d", counter.deleted)
+	}
+	if archive.purged != 150 {
+		t.Errorf("expected the archive purged in batches, got %d", archive.purged)
+	}
+	if age := time.Since(archive.before); age < 90*24*time.Hour || age > 90*24*time.Hour+time.Minute {
+		t.Errorf("expected the purge cutoff 90 days ago, got %s", archive.before)
+	}
+
+	archive = &archivedKeys{expired: expiredKeys{remaining: 10}}
+	if _, err := NewSweeper(repo, time.Minute, 100).WithArchive(archive, 0).RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if archive.archived != 10 || !archive.before.IsZero() {
+		t.Errorf("expected no purge without retention, got %+v", archive)
+	}
+}
+
+type lapsedReservations struct{ expiredKeys }
+
+func (l *lapsedReservations) DeleteExpiredReservations(ctx context.Context, limit int) (int64, error) {
+	return l.DeleteExpired(ctx, limit)
+}
+
+func TestSweeper_DeletesLapsedReservations(t *testing.T) {
+	repo := &expiredKeys{remaining: 50}
+	reservations := &lapsedReservations{expiredKeys{remaining: 120}}
+	counter := &sweepCounter{}
+	total, err := NewSweeper(repo, time.Minute, 100).WithRecorder(counter).WithReservations(reservations).RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 50 || reservations.remaining != 0 || reservations.calls != 2 {
+		t.Errorf("expected 50 keys and the reservations deleted in 2 batches, got %d %+v", total, reservations)
+	}
+	if counter.deleted != 50 {
+		t.Errorf("expected only keys counted as deleted, got %d", counter.deleted)
+	}
+}
+
+type oldWebhookEvents struct {
+	expiredKeys
+	deliveries expiredKeys
+	before     time.Time
+}
+
+func (o *oldWebhookEvents) PurgeWebhookEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	o.before = before
+	return o.DeleteExpired(ctx, limit)
+}
+
+func (o *oldWebhookEvents) PurgeWebhookDeliveries(ctx context.Context, _ time.Time, limit int) (int64, error) {
+	return o.deliveries.DeleteExpired(ctx, limit)
+}
+
+func TestSweeper_PurgesWebhookEventsPastRetention(t *testing.T) {
+	repo := &expiredKeys{}
+	events := &oldWebhookEvents{expiredKeys: expiredKeys{remaining: 130}, deliveries: expiredKeys{remaining: 40}}
+	if _, err := NewSweeper(repo, time.Minute, 100).WithWebhookEvents(events, 30*24*time.Hour).RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events.remaining != 0 || events.calls != 2 || events.deliveries.remaining != 0 {
+		t.Errorf("expected the events purged in 2 batches and the deliveries purged, got %+v", events)
+	}
+	if age := time.Since(events.before); age < 30*24*time.Hour || age > 30*24*time.Hour+time.Minute {
+		t.Errorf("expected the purge cutoff 30 days ago, got %s", events.before)
+	}
+}
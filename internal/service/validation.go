@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// MaxIdempotencyKeyLength bounds idempotency keys, in bytes.
+const MaxIdempotencyKeyLength = 255
+
+// AmountLimit bounds a currency's payment amounts, in minor units. A zero
+// Min or Max leaves that side open.
+type AmountLimit struct {
+	Min int64
+	Max int64
+}
+
+// WithAmountLimits bounds each currency's amounts. Amounts must be positive
+// in every currency, limited or not.
+func (s *IdempotencyService) WithAmountLimits(limits map[string]AmountLimit) *IdempotencyService {
+	s.amountLimits = limits
+	return s
+}
+
+// validateRequest upper-cases req's currency, so "brl" is BRL, drops null
+// metadata and checks every field, returning all the rules req fails as domain.ValidationErrors.
+func (s *IdempotencyService) validateRequest(req *domain.PaymentRequest) error {
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+
+	var errs domain.ValidationErrors
+	fail := func(field, rule string) *domain.ValidationError {
+		v := &domain.ValidationError{Field: field, Rule: rule}
+		errs = append(errs, v)
+		return v
+	}
+	switch {
+	case req.IdempotencyKey == "":
+		fail("idempotency_key", "required")
+	case len(req.IdempotencyKey) > MaxIdempotencyKeyLength:
+		fail("idempotency_key", "max_length").Max = MaxIdempotencyKeyLength
+	case !printableASCII(req.IdempotencyKey):
+		fail("idempotency_key", "charset")
+	}
+	if req.MerchantID == "" {
+		fail("merchant_id", "required")
+	}
+	if req.CustomerID == "" {
+		fail("customer_id", "required")
+	}
+	limit := s.amountLimits[req.Currency]
+	switch {
+	case req.Amount <= 0:
+		fail("amount", "positive")
+	case limit.Min > 0 && req.Amount < limit.Min:
+		fail("amount", "min").Min = int(limit.Min)
+	case limit.Max > 0 && req.Amount > limit.Max:
+		fail("amount", "max").Max = int(limit.Max)
+	}
+	switch {
+	case req.Currency == "":
+		fail("currency", "required")
+	case !domain.IsCurrency(req.Currency):
+		fail("currency", "currency")
+	}
+	if req.ExpiryHours < 0 {
+		fail("expiry_hours", "non_negative")
+	}
+	if bytes.Equal(bytes.TrimSpace(req.Metadata), []byte("null")) {
+		req.Metadata = nil
+	}
+	switch {
+	case len(req.Metadata) == 0:
+	case len(req.Metadata) > domain.MaxMetadataBytes:
+		fail("metadata", "max_size").Max = domain.MaxMetadataBytes
+	case !jsonObject(req.Metadata):
+		fail("metadata", "object")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// printableASCII reports whether s has only characters from space to tilde.
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonObject reports whether raw is a JSON object.
+func jsonObject(raw json.RawMessage) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(raw, &obj) == nil && obj != nil
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestValidateRequest_ListsEveryViolation(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour)
+	_, code, err := svc.ProcessPayment(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: "key\n1", CustomerID: "c", Amount: 0, Currency: "XYZ",
+	})
+	if code != 422 {
+		t.Fatalf("expected 422, got %d", code)
+	}
+	var errs domain.ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	var got []string
+	for _, v := range errs {
+		got = append(got, v.Field+":"+v.Rule)
+	}
+	if want := "idempotency_key:charset merchant_id:required amount:positive currency:currency"; strings.Join(got, " ") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(got, " "))
+	}
+	var first *domain.ValidationError
+	if !errors.As(err, &first) || first.Field != "idempotency_key" {
+		t.Errorf("expected errors.As to find the first violation, got %v", first)
+	}
+}
+
+func TestValidateRequest_RulesAndLimits(t *testing.T) {
+	svc := NewIdempotencyService(newMockRepo(), 24*time.Hour).
+		WithAmountLimits(map[string]AmountLimit{"BRL": {Min: 100, Max: 1000}})
+	valid := domain.PaymentRequest{IdempotencyKey: "k", MerchantID: "m", CustomerID: "c", Amount: 500, Currency: "brl "}
+
+	tests := []struct {
+		name string
+		edit func(*domain.PaymentRequest)
+		rule string
+	}{
+		{"valid, currency normalized", func(*domain.PaymentRequest) {}, ""},
+		{"key at the limit", func(r *domain.PaymentRequest) { r.IdempotencyKey = strings.Repeat("k", MaxIdempotencyKeyLength) }, ""},
+		{"key too long", func(r *domain.PaymentRequest) { r.IdempotencyKey = strings.Repeat("k", MaxIdempotencyKeyLength+1) }, "max_length"},
+		{"non-ASCII key", func(r *domain.PaymentRequest) { r.IdempotencyKey = "pedido-ñ" }, "charset"},
+		{"negative amount", func(r *domain.PaymentRequest) { r.Amount = -5 }, "positive"},
+		{"below the currency min", func(r *domain.PaymentRequest) { r.Amount = 99 }, "min"},
+		{"above the currency max", func(r *domain.PaymentRequest) { r.Amount = 1001 }, "max"},
+		{"unlimited currency", func(r *domain.PaymentRequest) { r.Amount, r.Currency = 1_000_000, "USD" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.edit(&req)
+			err := svc.validateRequest(&req)
+			var verr *domain.ValidationError
+			switch {
+			case tt.rule == "" && err != nil:
+				t.Errorf("expected valid, got %v", err)
+			case tt.rule != "" && (!errors.As(err, &verr) || verr.Rule != tt.rule):
+				t.Errorf("expected rule %s, got %v", tt.rule, err)
+			}
+			if tt.rule == "" && req.Currency != "BRL" && req.Currency != "USD" {
+				t.Errorf("expected the currency upper-cased, got %q", req.Currency)
+			}
+		})
+	}
+}
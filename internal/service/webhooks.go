@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// WebhookStore keeps webhook deliveries that failed every attempt, and the
+// merchant webhooks kept for replays.
+type WebhookStore interface {
+	ListWebhookDeadLetters(ctx context.Context, page domain.Page) ([]domain.WebhookDeadLetter, int, error)
+	GetWebhookDeadLetter(ctx context.Context, id int64) (*domain.WebhookDeadLetter, error)
+	RecordWebhookRedelivery(ctx context.Context, id int64, deliveryErr error) error
+	ListWebhookEvents(ctx context.Context, merchantID, event string, from, to time.Time, limit int) ([]domain.WebhookEvent, error)
+}
+
+// WebhookSender delivers webhooks again: a dead letter once, a replayed
+// event with the usual retries.
+type WebhookSender interface {
+	Redeliver(ctx context.Context, dl domain.WebhookDeadLetter) error
+	Replay(ctx context.Context, ev domain.WebhookEvent) error
+}
+
+// WebhookService lists dead-lettered webhooks, redelivers them and replays
+// merchants' webhooks.
+type WebhookService struct {
+	store  WebhookStore
+	sender WebhookSender
+}
+
+// NewWebhookService creates a new WebhookService.
+func NewWebhookService(store WebhookStore, sender WebhookSender) *WebhookService {
+	return &WebhookService{store: store, sender: sender}
+}
+
+// DeadLetters returns a page of dead letters, newest first, with the total.
+func (s *WebhookService) DeadLetters(ctx context.Context, page domain.Page) ([]domain.WebhookDeadLetter, int, error) {
+	dead, total, err := s.store.ListWebhookDeadLetters(ctx, page)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range dead {
+		dead[i].Endpoint = redactEndpoint(dead[i].Endpoint)
+	}
+	return dead, total, nil
+}
+
+// Redeliver posts the dead letter with id again and returns it as updated.
+// A letter already redelivered may be sent again. A failed attempt is
+// recorded on the letter and returned wrapping domain.ErrWebhookDelivery.
+func (s *WebhookService) Redeliver(ctx context.Context, id int64) (*domain.WebhookDeadLetter, error) {
+	dl, err := s.store.GetWebhookDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sendErr := s.sender.Redeliver(ctx, *dl)
+	if err := s.store.RecordWebhookRedelivery(ctx, id, sendErr); err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrWebhookDelivery, sendErr)
+	}
+	if dl, err = s.store.GetWebhookDeadLetter(ctx, id); err != nil {
+		return nil, err
+	}
+	dl.Endpoint = redactEndpoint(dl.Endpoint)
+	return dl, nil
+}
+
+// Replay delivers the merchant's webhooks of req's range again, oldest
+// first, in the background: it returns once the events are found, with
+// their count. A range holding more than domain.MaxWebhookReplay events is
+// refused with domain.ErrReplayTooLarge. Replayed events that fail every
+// attempt are dead-lettered like any delivery.
+func (s *WebhookService) Replay(ctx context.Context, req domain.WebhookReplayRequest) (*domain.WebhookReplay, error) {
+	events, err := s.store.ListWebhookEvents(ctx, req.MerchantID, req.Event, req.From, req.To, domain.MaxWebhookReplay+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > domain.MaxWebhookReplay {
+		return nil, domain.ErrReplayTooLarge
+	}
+	// The replay outlives the request.
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		for _, ev := range events {
+			if err := s.sender.Replay(ctx, ev); err != nil {
+				log.Printf("webhook replay: %s %d for merchant %s: %v", ev.Event, ev.ID, ev.MerchantID, err)
+			}
+		}
+	}()
+	return &domain.WebhookReplay{MerchantID: req.MerchantID, Event: req.Event, From: req.From, To: req.To, Events: len(events)}, nil
+}
+
+// redactEndpoint hides any password in endpoint's userinfo.
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
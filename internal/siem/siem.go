@@ -0,0 +1,313 @@
+// Package siem streams the shield's audit trail (payment attempts,
+// completions and policy changes) to a SIEM.
+package siem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// Export formats.
+const (
+	// FormatJSON posts {"events": [...]}.
+	FormatJSON = "json"
+	// FormatSplunkHEC posts to a Splunk HTTP Event Collector, one event
+	// object per line, authenticated with "Splunk <token>".
+	FormatSplunkHEC = "splunk-hec"
+	// FormatSyslog writes RFC 5424 messages to a udp:// or tcp:// address.
+	FormatSyslog = "syslog"
+)
+
+const (
+	httpTimeout   = 10 * time.Second
+	dialTimeout   = 5 * time.Second
+	writeTimeout  = 10 * time.Second
+	queueSize     = 10000
+	maxBatch      = 500
+	flushInterval = time.Second
+	// exportAttempts and retryBackoff bound how long a failing SIEM holds a
+	// batch; meanwhile new events wait in the queue.
+	exportAttempts = 3
+	retryBackoff   = time.Second
+	drainTimeout   = 5 * time.Second
+	appName        = "idempotency-shield"
+	sourcetype     = "idempotency-shield:audit"
+)
+
+// Exporter delivers a batch of events.
+type Exporter interface {
+	Export(ctx context.Context, events []domain.AuditEvent) error
+}
+
+// NewExporter creates the exporter for format.
+func NewExporter(format, url, token string) (Exporter, error) {
+	switch format {
+	case FormatJSON, FormatSplunkHEC:
+		return NewHTTPExporter(url, token, format), nil
+	case FormatSyslog:
+		return NewSyslogExporter(url)
+	}
+	return nil, fmt.Errorf("unknown format %q (want json, splunk-hec or syslog)", format)
+}
+
+// HTTPExporter posts event batches to a URL.
+type HTTPExporter struct {
+	URL    string
+	Token  string
+	Format string
+	Client *http.Client
+}
+
+// NewHTTPExporter creates an HTTPExporter. An empty token sends no
+// Authorization header.
+func NewHTTPExporter(url, token, format string) *HTTPExporter {
+	return &HTTPExporter{URL: url, Token: token, Format: format, Client: &http.Client{Timeout: httpTimeout}}
+}
+
+type hecEvent struct {
+	Time       float64           `json:"time"`
+	Sourcetype string            `json:"sourcetype"`
+	Event      domain.AuditEvent `json:"event"`
+}
+
+// Export posts events; any non-2xx response is an error.
+func (e *HTTPExporter) Export(ctx context.Context, events []domain.AuditEvent) error {
+	var body bytes.Buffer
+	auth := ""
+	switch e.Format {
+	case FormatSplunkHEC:
+		enc := json.NewEncoder(&body)
+		for _, ev := range events {
+			if err := enc.Encode(hecEvent{Time: float64(ev.Time.UnixMilli()) / 1000, Sourcetype: sourcetype, Event: ev}); err != nil {
+				return err
+			}
+		}
+		if e.Token != "" {
+			auth = "Splunk " + e.Token
+		}
+	default:
+		if err := json.NewEncoder(&body).Encode(map[string]interface{}{"events": events}); err != nil {
+			return err
+		}
+		if e.Token != "" {
+			auth = "Bearer " + e.Token
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		// The URL may carry credentials; keep only the underlying cause.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("siem export: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("siem export: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// SyslogExporter writes each event as an RFC 5424 message with a JSON body,
+// octet-counted over TCP (RFC 6587) or one datagram each over UDP. The
+// connection is redialed after a write error.
+type SyslogExporter struct {
+	network  string
+	addr     string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogExporter creates a SyslogExporter for a udp://host:port or
+// tcp://host:port URL.
+func NewSyslogExporter(rawURL string) (*SyslogExporter, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("syslog address %q must be udp://host:port or tcp://host:port", rawURL)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogExporter{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+// Export writes events in order, stopping at the first failure.
+func (e *SyslogExporter) Export(ctx context.Context, events []domain.AuditEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		var d net.Dialer
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		conn, err := d.DialContext(dctx, e.network, e.addr)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("siem export: %w", err)
+		}
+		e.conn = conn
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, ev := range events {
+		msg, err := e.message(ev)
+		if err != nil {
+			return err
+		}
+		if e.network == "tcp" {
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+		if _, err := e.conn.Write(msg); err != nil {
+			e.conn.Close()
+			e.conn = nil
+			return fmt.Errorf("siem export: %w", err)
+		}
+	}
+	return nil
+}
+
+// message formats ev as facility local0, severity notice for policy changes
+// and admin key actions, and informational otherwise.
+func (e *SyslogExporter) message(ev domain.AuditEvent) ([]byte, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	pri := 16*8 + 6
+	switch ev.Kind {
+	case domain.AuditPolicyUpdated, domain.AuditPolicyDeleted,
+		domain.AuditKeyExpired, domain.AuditKeyForceFailed, domain.AuditKeyReset, domain.AuditKeyRestored:
+		pri = 16*8 + 5
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ", pri, ev.Time.UTC().Format(time.RFC3339Nano), e.hostname, appName, os.Getpid(), ev.Kind)
+	return append([]byte(header), body...), nil
+}
+
+// Dispatcher queues events and exports them in batches in the background,
+// so a slow SIEM never delays payments. A failing batch is retried with
+// backoff while new events wait in the queue; once the queue is full, new
+// events are dropped and counted in the log.
+type Dispatcher struct {
+	exporter Exporter
+	env      string
+	queue    chan domain.AuditEvent
+	dropped  int64
+	backoff  time.Duration
+}
+
+// NewDispatcher creates a Dispatcher stamping every event with env.
+func NewDispatcher(exporter Exporter, env string) *Dispatcher {
+	return &Dispatcher{exporter: exporter, env: env, queue: make(chan domain.AuditEvent, queueSize), backoff: retryBackoff}
+}
+
+// Record queues an event without blocking.
+func (d *Dispatcher) Record(ev domain.AuditEvent) {
+	ev.Environment = d.env
+	select {
+	case d.queue <- ev:
+	default:
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
+
+// Run exports queued events until ctx is done, then flushes what is left
+// for up to drainTimeout.
+func (d *Dispatcher) Run(ctx context.Context) {
+	defer d.drain()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-d.queue:
+			d.export(ctx, d.collect(ctx, ev))
+		}
+	}
+}
+
+// collect gathers up to maxBatch events, waiting at most flushInterval
+// after the first.
+func (d *Dispatcher) collect(ctx context.Context, first domain.AuditEvent) []domain.AuditEvent {
+	batch := []domain.AuditEvent{first}
+	timer := time.NewTimer(flushInterval)
+	defer timer.Stop()
+	for len(batch) < maxBatch {
+		select {
+		case ev := <-d.queue:
+			batch = append(batch, ev)
+		case <-timer.C:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+func (d *Dispatcher) export(ctx context.Context, batch []domain.AuditEvent) {
+	err := d.exporter.Export(ctx, batch)
+	for attempt := 1; err != nil && attempt < exportAttempts && ctx.Err() == nil; attempt++ {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d.backoff << (attempt - 1)):
+			err = d.exporter.Export(ctx, batch)
+		}
+	}
+	if err != nil {
+		log.Printf("siem export: dropped %d event(s): %v", len(batch), err)
+	}
+	if n := atomic.SwapInt64(&d.dropped, 0); n > 0 {
+		log.Printf("siem export: queue full, dropped %d event(s)", n)
+	}
+}
+
+func (d *Dispatcher) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for {
+		var batch []domain.AuditEvent
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case ev := <-d.queue:
+				batch = append(batch, ev)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := d.exporter.Export(ctx, batch); err != nil {
+			log.Printf("siem export: shutdown: dropped %d event(s): %v", len(batch)+len(d.queue), err)
+			return
+		}
+	}
+}
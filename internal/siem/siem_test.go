@@ -0,0 +1,167 @@
+package siem
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+var testEvent = domain.AuditEvent{
+	Kind:       domain.AuditPaymentAttempt,
+	Time:       time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+	MerchantID: "merchant-1",
+	KeyHash:    "abc123",
+}
+
+func TestHTTPExporter_Formats(t *testing.T) {
+	var auth string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		var b strings.Builder
+		bufio.NewReader(r.Body).WriteTo(&b)
+		body = []byte(b.String())
+	}))
+	defer srv.Close()
+	events := []domain.AuditEvent{testEvent, testEvent}
+
+	if err := NewHTTPExporter(srv.URL, "secret", FormatJSON).Export(context.Background(), events); err != nil {
+		t.Fatalf("json export: %v", err)
+	}
+	var got map[string][]domain.AuditEvent
+	json.Unmarshal(body, &got)
+	if auth != "Bearer secret" || len(got["events"]) != 2 {
+		t.Errorf("unexpected json export: %s %s", auth, body)
+	}
+
+	if err := NewHTTPExporter(srv.URL, "secret", FormatSplunkHEC).Export(context.Background(), events); err != nil {
+		t.Fatalf("hec export: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	var hec hecEvent
+	json.Unmarshal([]byte(lines[0]), &hec)
+	if auth != "Splunk secret" || len(lines) != 2 || hec.Sourcetype != sourcetype || hec.Event.KeyHash != "abc123" {
+		t.Errorf("unexpected hec export: %s %s", auth, body)
+	}
+	if hec.Time != float64(testEvent.Time.Unix()) {
+		t.Errorf("expected HEC time in epoch seconds, got %v", hec.Time)
+	}
+}
+
+func TestSyslogExporter_TCPFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		n, _ := r.ReadString(' ')
+		size, _ := strconv.Atoi(strings.TrimSpace(n))
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err == nil {
+			received <- string(msg)
+		}
+	}()
+
+	exp, err := NewSyslogExporter("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Export(context.Background(), []domain.AuditEvent{testEvent}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if !strings.HasPrefix(msg, "<134>1 2026-03-10T12:00:00Z ") || !strings.Contains(msg, " idempotency-shield ") ||
+			!strings.Contains(msg, " payment_attempt - {") {
+			t.Errorf("unexpected syslog message: %q", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no syslog message received")
+	}
+
+	if _, err := NewSyslogExporter("http://siem.example:514"); err == nil {
+		t.Error("expected an error for a non-udp/tcp syslog address")
+	}
+}
+
+type flakyExporter struct {
+	mu       sync.Mutex
+	failures int
+	events   []domain.AuditEvent
+}
+
+func (e *flakyExporter) Export(_ context.Context, events []domain.AuditEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures > 0 {
+		e.failures--
+		return errors.New("siem unavailable")
+	}
+	e.events = append(e.events, events...)
+	return nil
+}
+
+func (e *flakyExporter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.events)
+}
+
+func TestDispatcher_RetriesAndStampsEnvironment(t *testing.T) {
+	exp := &flakyExporter{failures: 2}
+	d := NewDispatcher(exp, domain.EnvironmentSandbox)
+	d.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Record(testEvent)
+	d.Record(testEvent)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for exp.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if exp.count() != 2 {
+		t.Fatalf("expected 2 exported events after retries, got %d", exp.count())
+	}
+	for _, ev := range exp.events {
+		if ev.Environment != domain.EnvironmentSandbox {
+			t.Errorf("expected sandbox environment, got %q", ev.Environment)
+		}
+	}
+}
+
+func TestDispatcher_FlushesOnShutdown(t *testing.T) {
+	exp := &flakyExporter{}
+	d := NewDispatcher(exp, domain.EnvironmentProduction)
+	d.Record(testEvent)
+	d.Record(testEvent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+	if exp.count() != 2 {
+		t.Errorf("expected queued events flushed on shutdown, got %d", exp.count())
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// The helpers below compute reports in Go for the backends without SQL. Each
+// matches what the corresponding Postgres query returns.
+
+// pageDuplicates sorts duplicates like the Postgres query, most attempts
+// first with ID as the tiebreaker, and returns one page of them with the total.
+func pageDuplicates(records []domain.IdempotencyRecord, page domain.Page) ([]domain.IdempotencyRecord, int) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].AttemptCount != records[j].AttemptCount {
+			return records[i].AttemptCount > records[j].AttemptCount
+		}
+		return records[i].ID < records[j].ID
+	})
+	total := len(records)
+	if page.Offset >= total {
+		return nil, total
+	}
+	records = records[page.Offset:]
+	if page.Limit > 0 && len(records) > page.Limit {
+		records = records[:page.Limit]
+	}
+	return records, total
+}
+
+// streamDuplicates calls fn for each of the duplicates, sorted like
+// pageDuplicates, for stores that read them all at once anyway.
+func streamDuplicates(records []domain.IdempotencyRecord, fn func(domain.IdempotencyRecord) error) error {
+	records, _ = pageDuplicates(records, domain.Page{})
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageSearch filters records like the Postgres search, sorts them newest
+// first with ID as the tiebreaker, and returns one page with the total.
+func pageSearch(records []domain.IdempotencyRecord, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int) {
+	var matched []domain.IdempotencyRecord
+	for _, rec := range records {
+		if filter.Matches(rec) {
+			matched = append(matched, rec)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].FirstSeenAt.Equal(matched[j].FirstSeenAt) {
+			return matched[i].FirstSeenAt.After(matched[j].FirstSeenAt)
+		}
+		return matched[i].ID > matched[j].ID
+	})
+	total := len(matched)
+	if page.Offset >= total {
+		return nil, total
+	}
+	matched = matched[page.Offset:]
+	if page.Limit > 0 && len(matched) > page.Limit {
+		matched = matched[:page.Limit]
+	}
+	return matched, total
+}
+
+// pagePolicies sorts policies by merchant_id like ListPolicies and returns
+// one page of them with the total.
+func pagePolicies(policies []domain.MerchantPolicy, page domain.Page) ([]domain.MerchantPolicy, int) {
+	sort.Slice(policies, func(i, j int) bool { return policies[i].MerchantID < policies[j].MerchantID })
+	total := len(policies)
+	if page.Offset >= total {
+		return nil, total
+	}
+	policies = policies[page.Offset:]
+	if page.Limit > 0 && len(policies) > page.Limit {
+		policies = policies[:page.Limit]
+	}
+	return policies, total
+}
+
+// amountAtRisk sums amount × (attempt_count - 1) per currency.
+func amountAtRisk(duplicates []domain.IdempotencyRecord) map[string]int64 {
+	atRisk := make(map[string]int64)
+	for _, rec := range duplicates {
+		atRisk[rec.Currency] += rec.Amount * int64(rec.AttemptCount-1)
+	}
+	return atRisk
+}
+
+// merchantStats returns the attempts across records and how many there are.
+func merchantStats(records []domain.IdempotencyRecord) (int, int) {
+	total := 0
+	for _, rec := range records {
+		total += rec.AttemptCount
+	}
+	return total, len(records)
+}
+
+// merchantOutcomes counts retried keys and statuses, and averages how long
+// completed keys took from processing_since.
+func merchantOutcomes(records []domain.IdempotencyRecord) domain.MerchantOutcomes {
+	var o domain.MerchantOutcomes
+	var completed int
+	var took time.Duration
+	for _, rec := range records {
+		if rec.AttemptCount > 1 {
+			o.RetriedKeys++
+		}
+		switch rec.Status {
+		case domain.StatusSucceeded:
+			o.Succeeded++
+		case domain.StatusFailed:
+			o.Failed++
+		case domain.StatusProcessing:
+			o.Processing++
+		}
+		if rec.CompletedAt != nil {
+			completed++
+			took += rec.CompletedAt.Sub(rec.ProcessingSince)
+		}
+	}
+	if completed > 0 {
+		avg := float64(took) / float64(completed) / float64(time.Millisecond)
+		o.AvgCompletionMs = &avg
+	}
+	return o
+}
+
+// duplicateTrends buckets records by first_seen_at like the Postgres query,
+// oldest first.
+func duplicateTrends(records []domain.IdempotencyRecord, bucket time.Duration) []domain.TrendBucket {
+	counts := make(map[int64]*domain.TrendBucket)
+	var starts []int64
+	for _, rec := range records {
+		n := rec.FirstSeenAt.UnixNano() / int64(bucket)
+		b, ok := counts[n]
+		if !ok {
+			b = &domain.TrendBucket{Start: time.Unix(0, n*int64(bucket)).UTC()}
+			counts[n] = b
+			starts = append(starts, n)
+		}
+		b.TotalRequests += rec.AttemptCount
+		b.UniquePayments++
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	buckets := make([]domain.TrendBucket, 0, len(starts))
+	for _, n := range starts {
+		buckets = append(buckets, *counts[n])
+	}
+	return buckets
+}
+
+// amountStats returns the amount distribution per currency.
+func amountStats(records []domain.IdempotencyRecord) map[string]domain.AmountStats {
+	sums := make(map[string][2]float64)
+	stats := make(map[string]domain.AmountStats)
+	for _, rec := range records {
+		s := sums[rec.Currency]
+		s[0] += float64(rec.Amount)
+		s[1] += float64(rec.Amount) * float64(rec.Amount)
+		sums[rec.Currency] = s
+		st := stats[rec.Currency]
+		st.Count++
+		stats[rec.Currency] = st
+	}
+	for currency, st := range stats {
+		n := float64(st.Count)
+		st.Mean = sums[currency][0] / n
+		// Population standard deviation, matching STDDEV_POP.
+		st.StdDev = math.Sqrt(math.Max(0, sums[currency][1]/n-st.Mean*st.Mean))
+		stats[currency] = st
+	}
+	return stats
+}
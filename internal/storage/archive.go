@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ArchiveExpired moves one batch of this environment's expired keys, with
+// their payment attempts, to the archive tables (migration 022) and returns
+// how many keys it moved, skipping restorable keys as DeleteExpired does.
+// Every part of the statement reads the same snapshot, so the attempts are
+// copied before the delete cascades to them.
+func (r *PostgresRepository) ArchiveExpired(ctx context.Context, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		WITH expired AS (
+			DELETE FROM idempotency_keys WHERE id IN (
+				SELECT id FROM idempotency_keys WHERE expires_at < NOW() AND environment = $2
+					AND (restorable_until IS NULL OR restorable_until <= NOW()) LIMIT $1
+			)
+			RETURNING id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash,
+				response_body, payment_id, attempt_count, first_seen_at, last_seen_at, completed_at, expires_at,
+				environment, version, response_status, response_headers, processing_since, body_hash, metadata
+		), attempts AS (
+			INSERT INTO payment_attempts_archive (id, idempotency_key, source_ip, user_agent, request_id, attempted_at, environment,
+				request_hash, outcome)
+			SELECT a.id, a.idempotency_key, a.source_ip, a.user_agent, a.request_id, a.attempted_at, a.environment,
+				a.request_hash, a.outcome
+			FROM payment_attempts a
+			JOIN expired k ON a.environment = k.environment AND a.idempotency_key = k.idempotency_key
+		)
+		INSERT INTO idempotency_keys_archive (id, idempotency_key, merchant_id, customer_id, amount, currency, status,
+			request_hash, response_body, payment_id, attempt_count, first_seen_at, last_seen_at, completed_at, expires_at,
+			environment, version, response_status, response_headers, processing_since, body_hash, metadata)
+		SELECT * FROM expired
+	`, limit, r.env)
+	if err != nil {
+		return 0, wrap(ctx, "archive expired", err)
+	}
+	return res.RowsAffected()
+}
+
+// PurgeArchive deletes up to limit keys archived before the given time, with
+// the attempts archived alongside them, and returns how many keys it deleted.
+// Archived IDs stay unique since the live table never reuses one.
+func (r *PostgresRepository) PurgeArchive(ctx context.Context, before time.Time, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var n int64
+	err := r.db.QueryRowContext(ctx, `
+		WITH purged AS (
+			DELETE FROM idempotency_keys_archive WHERE id IN (
+				SELECT id FROM idempotency_keys_archive WHERE archived_at < $1 LIMIT $2
+			)
+			RETURNING environment, idempotency_key, archived_at
+		), attempts AS (
+			DELETE FROM payment_attempts_archive a USING purged p
+			WHERE a.environment = p.environment AND a.idempotency_key = p.idempotency_key
+				AND a.archived_at = p.archived_at
+		)
+		SELECT COUNT(*) FROM purged
+	`, before, limit).Scan(&n)
+	if err != nil {
+		return 0, wrap(ctx, "purge archive", err)
+	}
+	return n, nil
+}
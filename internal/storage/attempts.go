@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// GetAttempts reads the key's latest attempts through idx_attempts_key. A
+// key with no attempts, such as one stored before migration 005, is told
+// apart from a missing key by a second lookup.
+func (r *PostgresRepository) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT attempted_at, request_hash, source_ip, user_agent, request_id, outcome FROM (
+			SELECT id, attempted_at, COALESCE(request_hash, '') AS request_hash, COALESCE(source_ip, '') AS source_ip,
+				COALESCE(user_agent, '') AS user_agent, COALESCE(request_id, '') AS request_id, COALESCE(outcome, '') AS outcome
+			FROM payment_attempts
+			WHERE environment = $1 AND idempotency_key = $2
+			ORDER BY attempted_at DESC, id DESC
+			LIMIT $3
+		) latest
+		ORDER BY attempted_at, id
+	`, r.env, key, domain.MaxAttemptHistory)
+	if err != nil {
+		return nil, wrap(ctx, "get attempts", err)
+	}
+	attempts, err := scanAttempts(rows, func(dst *domain.Attempt) interface{} { return &dst.AttemptedAt })
+	if err != nil {
+		return nil, wrap(ctx, "get attempts", err)
+	}
+	if len(attempts) > 0 {
+		return attempts, nil
+	}
+	var exists bool
+	err = r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM idempotency_keys WHERE environment = $1 AND idempotency_key = $2)
+	`, r.env, key).Scan(&exists)
+	if err != nil {
+		return nil, wrap(ctx, "get attempts", err)
+	}
+	if !exists {
+		return nil, domain.ErrKeyNotFound
+	}
+	return attempts, nil
+}
+
+// scanAttempts reads rows of attempted_at, request_hash, source_ip,
+// user_agent, request_id and outcome, closing rows. at returns where the
+// backend's attempted_at is scanned to for an attempt.
+func scanAttempts(rows *sql.Rows, at func(*domain.Attempt) interface{}) ([]domain.Attempt, error) {
+	defer rows.Close()
+	attempts := []domain.Attempt{}
+	for rows.Next() {
+		var a domain.Attempt
+		if err := rows.Scan(at(&a), &a.RequestHash, &a.SourceIP, &a.UserAgent, &a.RequestID, &a.Outcome); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
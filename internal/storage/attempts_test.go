@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestGetAttempts(t *testing.T) {
+	backends := map[string]func(*testing.T) Repository{
+		"memory": func(*testing.T) Repository { return NewMemoryRepository(0) },
+		"sqlite": func(t *testing.T) Repository { return newTestSQLite(t) },
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			repo := open(t)
+			ctx := context.Background()
+			if _, err := repo.GetAttempts(ctx, "k1"); !errors.Is(err, domain.ErrKeyNotFound) {
+				t.Fatalf("expected ErrKeyNotFound, got %v", err)
+			}
+
+			req := memoryRequest("k1")
+			req.Source.UserAgent = "client/1.0"
+			expires := time.Now().Add(time.Hour)
+			repo.InsertOrGet(ctx, req, "pay_a", expires)
+			req.Source.IP = "10.0.0.2"
+			repo.InsertOrGet(ctx, req, "pay_b", expires)
+			changed := req
+			changed.Amount = 2000
+			repo.InsertOrGet(ctx, changed, "pay_c", expires)
+
+			attempts, err := repo.GetAttempts(ctx, "k1")
+			if err != nil || len(attempts) != 3 {
+				t.Fatalf("expected 3 attempts, got %+v %v", attempts, err)
+			}
+			want := []string{domain.AttemptNew, domain.AttemptDuplicate, domain.AttemptMismatch}
+			for i, a := range attempts {
+				if a.Outcome != want[i] {
+					t.Errorf("attempt %d outcome = %q, want %q", i, a.Outcome, want[i])
+				}
+			}
+			if attempts[0].SourceIP != "10.0.0.1" || attempts[1].SourceIP != "10.0.0.2" || attempts[0].UserAgent != "client/1.0" {
+				t.Errorf("unexpected sources: %+v", attempts)
+			}
+			if attempts[0].RequestHash != req.Hash() || attempts[2].RequestHash != changed.Hash() {
+				t.Errorf("unexpected hashes: %+v", attempts)
+			}
+			if attempts[0].AttemptedAt.IsZero() || attempts[2].AttemptedAt.Before(attempts[0].AttemptedAt) {
+				t.Errorf("expected attempts oldest first: %+v", attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// probeRetryAfter is suggested to callers rejected while a half-open probe is in flight.
+const probeRetryAfter = time.Second
+
+// CircuitOpenError is returned while the breaker rejects calls.
+// It matches domain.ErrUnavailable with errors.Is.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v: circuit open, retry after %s", domain.ErrUnavailable, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Unwrap() error { return domain.ErrUnavailable }
+
+// CircuitObserver is notified whenever the breaker changes state.
+type CircuitObserver interface {
+	RecordCircuitState(state string)
+}
+
+// CircuitBreaker fails fast after consecutive failures and probes for recovery.
+//
+//	closed    → threshold consecutive failures → open
+//	open      → cooldown elapsed, next call becomes the probe → half_open
+//	half_open → probe succeeds → closed; probe fails → open
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+	observer  CircuitObserver
+	now       func() time.Time
+}
+
+// NewCircuitBreaker creates a closed breaker. observer may be nil.
+func NewCircuitBreaker(threshold int, cooldown time.Duration, observer CircuitObserver) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		state:     CircuitClosed,
+		threshold: threshold,
+		cooldown:  cooldown,
+		observer:  observer,
+		now:       time.Now,
+	}
+}
+
+// State returns the current breaker state.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Do runs fn if the breaker allows it and records the outcome.
+func (b *CircuitBreaker) Do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.cooldown {
+			return &CircuitOpenError{RetryAfter: b.cooldown - elapsed}
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{RetryAfter: probeRetryAfter}
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := isBreakerFailure(err)
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.trip()
+			return
+		}
+		b.failures = 0
+		b.setState(CircuitClosed)
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.trip()
+	}
+}
+
+func (b *CircuitBreaker) trip() {
+	b.openedAt = b.now()
+	b.failures = 0
+	b.setState(CircuitOpen)
+}
+
+func (b *CircuitBreaker) setState(s CircuitState) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	if b.observer != nil {
+		b.observer.RecordCircuitState(string(s))
+	}
+}
+
+// isBreakerFailure reports whether err indicates an unhealthy database.
+// Business outcomes, waits on another request's key and caller
+// cancellations do not count.
+func isBreakerFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, domain.ErrKeyNotFound),
+		errors.Is(err, domain.ErrPaymentNotFound),
+		errors.Is(err, domain.ErrAlreadyCompleted),
+		errors.Is(err, domain.ErrMerchantNotFound),
+		errors.Is(err, domain.ErrPaymentIDConflict),
+		errors.Is(err, domain.ErrConcurrentUpdate),
+		errors.Is(err, domain.ErrStoreFull),
+		errors.Is(err, domain.ErrLockTimeout),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+	return true
+}
+
+// BreakerRepository wraps a Repository with a CircuitBreaker.
+type BreakerRepository struct {
+	next    Repository
+	breaker *CircuitBreaker
+}
+
+// NewBreakerRepository creates a new BreakerRepository.
+func NewBreakerRepository(next Repository, breaker *CircuitBreaker) *BreakerRepository {
+	return &BreakerRepository{next: next, breaker: breaker}
+}
+
+func (r *BreakerRepository) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	var rec *domain.IdempotencyRecord
+	var isNew bool
+	err := r.breaker.Do(func() (err error) {
+		rec, isNew, err = r.next.InsertOrGet(ctx, req, paymentID, expiresAt)
+		return err
+	})
+	return rec, isNew, err
+}
+
+func (r *BreakerRepository) GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	var rec *domain.IdempotencyRecord
+	err := r.breaker.Do(func() (err error) {
+		rec, err = r.next.GetByKey(ctx, key)
+		return err
+	})
+	return rec, err
+}
+
+func (r *BreakerRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	var rec *domain.IdempotencyRecord
+	err := r.breaker.Do(func() (err error) {
+		rec, err = r.next.GetByKeyPrimary(ctx, key)
+		return err
+	})
+	return rec, err
+}
+
+func (r *BreakerRepository) GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	var rec *domain.IdempotencyRecord
+	err := r.breaker.Do(func() (err error) {
+		rec, err = r.next.GetByPaymentID(ctx, paymentID)
+		return err
+	})
+	return rec, err
+}
+
+func (r *BreakerRepository) MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	return r.breaker.Do(func() error {
+		return r.next.MarkComplete(ctx, key, status, resp)
+	})
+}
+
+func (r *BreakerRepository) ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	return r.breaker.Do(func() error {
+		return r.next.ResetToProcessing(ctx, key, version, newPaymentID, expiresAt)
+	})
+}
+
+func (r *BreakerRepository) UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error {
+	return r.breaker.Do(func() error {
+		return r.next.UpdateParams(ctx, key, version, req)
+	})
+}
+
+func (r *BreakerRepository) ExpireKey(ctx context.Context, key string) error {
+	return r.breaker.Do(func() error {
+		return r.next.ExpireKey(ctx, key)
+	})
+}
+
+func (r *BreakerRepository) ResetKey(ctx context.Context, key string, version int64) error {
+	return r.breaker.Do(func() error {
+		return r.next.ResetKey(ctx, key, version)
+	})
+}
+
+func (r *BreakerRepository) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	var n int64
+	err := r.breaker.Do(func() (err error) {
+		n, err = r.next.DeleteExpired(ctx, limit)
+		return err
+	})
+	return n, err
+}
+
+func (r *BreakerRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	var recs []domain.IdempotencyRecord
+	var total int
+	err := r.breaker.Do(func() (err error) {
+		recs, total, err = r.next.GetDuplicates(ctx, merchantID, from, to, page)
+		return err
+	})
+	return recs, total, err
+}
+
+// StreamDuplicates keeps errors from fn, such as a client that went away
+// mid-export, from counting against the breaker.
+func (r *BreakerRepository) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	var fnErr error
+	err := r.breaker.Do(func() error {
+		err := r.next.StreamDuplicates(ctx, merchantID, from, to, func(rec domain.IdempotencyRecord) error {
+			fnErr = fn(rec)
+			return fnErr
+		})
+		if fnErr != nil {
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (r *BreakerRepository) GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	var atRisk map[string]int64
+	err := r.breaker.Do(func() (err error) {
+		atRisk, err = r.next.GetAmountAtRisk(ctx, merchantID, from, to)
+		return err
+	})
+	return atRisk, err
+}
+
+func (r *BreakerRepository) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	var total, unique int
+	err := r.breaker.Do(func() (err error) {
+		total, unique, err = r.next.GetMerchantStats(ctx, merchantID, from, to)
+		return err
+	})
+	return total, unique, err
+}
+
+func (r *BreakerRepository) GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	var o domain.MerchantOutcomes
+	err := r.breaker.Do(func() (err error) {
+		o, err = r.next.GetMerchantOutcomes(ctx, merchantID, from, to)
+		return err
+	})
+	return o, err
+}
+
+func (r *BreakerRepository) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	var buckets []domain.TrendBucket
+	err := r.breaker.Do(func() (err error) {
+		buckets, err = r.next.GetDuplicateTrends(ctx, merchantID, from, to, bucket)
+		return err
+	})
+	return buckets, err
+}
+
+func (r *BreakerRepository) GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	var p *domain.MerchantPolicy
+	err := r.breaker.Do(func() (err error) {
+		p, err = r.next.GetPolicy(ctx, merchantID)
+		return err
+	})
+	return p, err
+}
+
+func (r *BreakerRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
+	return r.breaker.Do(func() error {
+		return r.next.UpsertPolicy(ctx, policy)
+	})
+}
+
+func (r *BreakerRepository) ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	var policies []domain.MerchantPolicy
+	var total int
+	err := r.breaker.Do(func() (err error) {
+		policies, total, err = r.next.ListPolicies(ctx, page)
+		return err
+	})
+	return policies, total, err
+}
+
+func (r *BreakerRepository) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	return r.breaker.Do(func() error {
+		return r.next.UpsertPolicies(ctx, policies)
+	})
+}
+
+func (r *BreakerRepository) DeletePolicy(ctx context.Context, merchantID string) error {
+	return r.breaker.Do(func() error {
+		return r.next.DeletePolicy(ctx, merchantID)
+	})
+}
+
+func (r *BreakerRepository) GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error) {
+	var stats map[string][2]int
+	err := r.breaker.Do(func() (err error) {
+		stats, err = r.next.GetAllMerchantStats(ctx, from, to)
+		return err
+	})
+	return stats, err
+}
+
+func (r *BreakerRepository) GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	var stats map[string]domain.AmountStats
+	err := r.breaker.Do(func() (err error) {
+		stats, err = r.next.GetAmountStats(ctx, merchantID, from, to)
+		return err
+	})
+	return stats, err
+}
+
+func (r *BreakerRepository) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	var records []domain.IdempotencyRecord
+	var total int
+	err := r.breaker.Do(func() (err error) {
+		records, total, err = r.next.SearchRecords(ctx, filter, page)
+		return err
+	})
+	return records, total, err
+}
+
+func (r *BreakerRepository) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	var attempts []domain.Attempt
+	err := r.breaker.Do(func() (err error) {
+		attempts, err = r.next.GetAttempts(ctx, key)
+		return err
+	})
+	return attempts, err
+}
+
+var _ Repository = (*BreakerRepository)(nil)
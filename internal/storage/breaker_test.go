@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+var errDBDown = errors.New("connection refused")
+
+type stateLog struct {
+	states []string
+}
+
+func (s *stateLog) RecordCircuitState(state string) { s.states = append(s.states, state) }
+
+func newTestBreaker(threshold int, cooldown time.Duration) (*CircuitBreaker, *stateLog, *time.Time) {
+	obs := &stateLog{}
+	b := NewCircuitBreaker(threshold, cooldown, obs)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	return b, obs, &now
+}
+
+func fail() error    { return errDBDown }
+func succeed() error { return nil }
+
+func TestCircuitBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	b, obs, _ := newTestBreaker(3, 10*time.Second)
+
+	for i := 0; i < 3; i++ {
+		if err := b.Do(fail); !errors.Is(err, errDBDown) {
+			t.Fatalf("call %d: expected db error, got %v", i, err)
+		}
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("expected open, got %s", b.State())
+	}
+
+	called := false
+	err := b.Do(func() error { called = true; return nil })
+	if called {
+		t.Error("open breaker must not run the call")
+	}
+	var open *CircuitOpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+	if !errors.Is(err, domain.ErrUnavailable) {
+		t.Error("CircuitOpenError should match ErrUnavailable")
+	}
+	if open.RetryAfter != 10*time.Second {
+		t.Errorf("expected 10s retry after, got %v", open.RetryAfter)
+	}
+	if len(obs.states) != 1 || obs.states[0] != "open" {
+		t.Errorf("expected [open] transitions, got %v", obs.states)
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailureCount(t *testing.T) {
+	b, _, _ := newTestBreaker(2, time.Second)
+
+	b.Do(fail)
+	b.Do(succeed)
+	b.Do(fail)
+
+	if b.State() != CircuitClosed {
+		t.Errorf("non-consecutive failures should not trip, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_BusinessErrorsDoNotTrip(t *testing.T) {
+	b, _, _ := newTestBreaker(1, time.Second)
+
+	b.Do(func() error { return domain.ErrKeyNotFound })
+	b.Do(func() error { return domain.ErrAlreadyCompleted })
+	b.Do(func() error { return context.Canceled })
+
+	if b.State() != CircuitClosed {
+		t.Errorf("expected closed, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	b, obs, now := newTestBreaker(1, 5*time.Second)
+	b.Do(fail)
+
+	*now = now.Add(5 * time.Second)
+
+	// A second caller arriving during the probe is rejected.
+	err := b.Do(func() error {
+		if b.State() != CircuitHalfOpen {
+			t.Errorf("expected half_open during probe, got %s", b.State())
+		}
+		if err := b.Do(succeed); !errors.Is(err, domain.ErrUnavailable) {
+			t.Errorf("concurrent call during probe should fail fast, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("probe should run, got %v", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("successful probe should close, got %s", b.State())
+	}
+	want := []string{"open", "half_open", "closed"}
+	if len(obs.states) != len(want) {
+		t.Fatalf("expected %v, got %v", want, obs.states)
+	}
+	for i := range want {
+		if obs.states[i] != want[i] {
+			t.Errorf("transition %d: expected %s, got %s", i, want[i], obs.states[i])
+		}
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	b, _, now := newTestBreaker(1, 5*time.Second)
+	b.Do(fail)
+
+	*now = now.Add(5 * time.Second)
+	b.Do(fail)
+
+	if b.State() != CircuitOpen {
+		t.Errorf("failed probe should reopen, got %s", b.State())
+	}
+}
+
+func TestBreakerRepository_FailsFast(t *testing.T) {
+	b, _, _ := newTestBreaker(1, time.Minute)
+	repo := NewBreakerRepository(&failingRepo{}, b)
+
+	if _, err := repo.GetByKey(context.Background(), "k"); !errors.Is(err, errDBDown) {
+		t.Fatalf("expected db error, got %v", err)
+	}
+	if _, err := repo.GetByKey(context.Background(), "k"); !errors.Is(err, domain.ErrUnavailable) {
+		t.Errorf("expected fail-fast ErrUnavailable, got %v", err)
+	}
+}
+
+func TestBreakerRepository_StreamCallbackErrorsDoNotTrip(t *testing.T) {
+	b, _, _ := newTestBreaker(1, time.Minute)
+	mem := NewMemoryRepository(0)
+	mem.InsertOrGet(context.Background(), memoryRequest("k"), "pay_k", time.Now().Add(time.Hour))
+	mem.InsertOrGet(context.Background(), memoryRequest("k"), "pay_k", time.Now().Add(time.Hour))
+	repo := NewBreakerRepository(mem, b)
+
+	err := repo.StreamDuplicates(context.Background(), "m1", time.Now().Add(-time.Hour), time.Now(),
+		func(domain.IdempotencyRecord) error { return errDBDown })
+	if !errors.Is(err, errDBDown) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("callback errors should not trip the breaker, got %s", b.State())
+	}
+}
+
+// failingRepo fails GetByKey; other methods are not exercised.
+type failingRepo struct {
+	Repository
+}
+
+func (r *failingRepo) GetByKey(_ context.Context, _ string) (*domain.IdempotencyRecord, error) {
+	return nil, errDBDown
+}
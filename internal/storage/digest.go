@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// digestDateLayout is how digest days are written in the API and the DB.
+const digestDateLayout = "2006-01-02"
+
+// SaveDigest stores a merchant digest, replacing any earlier one for that day.
+func (r *PostgresRepository) SaveDigest(ctx context.Context, d domain.MerchantDigest) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	amounts, err := json.Marshal(d.AmountProtected)
+	if err != nil {
+		return wrap(ctx, "encode digest amounts", err)
+	}
+	var normalized []byte
+	if d.Normalized != nil {
+		if normalized, err = json.Marshal(d.Normalized); err != nil {
+			return wrap(ctx, "encode digest normalized amount", err)
+		}
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO merchant_digests (merchant_id, digest_date, total_requests, duplicates_blocked,
+			amount_protected, normalized, new_suspicious_keys, generated_at, environment)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (environment, merchant_id, digest_date) DO UPDATE SET
+			total_requests = $3, duplicates_blocked = $4, amount_protected = $5,
+			normalized = $6, new_suspicious_keys = $7, generated_at = $8
+	`, d.MerchantID, d.Date, d.TotalRequests, d.DuplicatesBlocked,
+		amounts, nullableJSON(normalized), pq.Array(d.NewSuspiciousKeys), d.GeneratedAt, r.env)
+	return wrap(ctx, "save digest", err)
+}
+
+// GetDigest returns the stored digest for a merchant and UTC day.
+func (r *PostgresRepository) GetDigest(ctx context.Context, merchantID string, day time.Time) (*domain.MerchantDigest, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var d domain.MerchantDigest
+	var date time.Time
+	var amounts []byte
+	var normalized sql.NullString
+	err := r.db.QueryRowContext(ctx, `
+		SELECT merchant_id, digest_date, total_requests, duplicates_blocked,
+			amount_protected, normalized, new_suspicious_keys, generated_at
+		FROM merchant_digests WHERE environment = $3 AND merchant_id = $1 AND digest_date = $2
+	`, merchantID, day.Format(digestDateLayout), r.env).Scan(
+		&d.MerchantID, &date, &d.TotalRequests, &d.DuplicatesBlocked,
+		&amounts, &normalized, pq.Array(&d.NewSuspiciousKeys), &d.GeneratedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrDigestNotFound
+	}
+	if err != nil {
+		return nil, wrap(ctx, "get digest", err)
+	}
+	d.Date = date.Format(digestDateLayout)
+	if err := json.Unmarshal(amounts, &d.AmountProtected); err != nil {
+		return nil, wrap(ctx, "decode digest amounts", err)
+	}
+	if normalized.Valid {
+		d.Normalized = &domain.NormalizedAmount{}
+		if err := json.Unmarshal([]byte(normalized.String), d.Normalized); err != nil {
+			return nil, wrap(ctx, "decode digest normalized amount", err)
+		}
+	}
+	return &d, nil
+}
+
+func nullableJSON(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return b
+}
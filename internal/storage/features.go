@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// StreamKeyActivity calls fn for every key first seen in [from, to], oldest
+// first, optionally limited to one merchant. Rows are streamed, so exports of
+// any size use constant memory; an error from fn stops the stream. It reads
+// from a replica when one is configured, like StreamDuplicates.
+func (r *PostgresRepository) StreamKeyActivity(ctx context.Context, from, to time.Time, merchantID string, fn func(domain.KeyActivity) error) error {
+	return r.reportRead(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT k.idempotency_key, k.merchant_id, k.customer_id, k.amount, k.currency, k.status,
+				k.attempt_count, k.first_seen_at, k.last_seen_at,
+				COALESCE(a.sources, 0), COALESCE(a.agents, 0), COALESCE(a.times, '{}')
+			FROM idempotency_keys k
+			LEFT JOIN LATERAL (
+				SELECT COUNT(DISTINCT source_ip) AS sources, COUNT(DISTINCT user_agent) AS agents,
+					array_agg((EXTRACT(EPOCH FROM attempted_at) * 1000)::BIGINT ORDER BY attempted_at) AS times
+				FROM payment_attempts pa
+				WHERE pa.environment = k.environment AND pa.idempotency_key = k.idempotency_key
+			) a ON TRUE
+			WHERE k.environment = $1 AND k.first_seen_at >= $2 AND k.first_seen_at <= $3
+				AND ($4 = '' OR k.merchant_id = $4)
+			ORDER BY k.first_seen_at
+		`, r.env, from, to, merchantID)
+		if err != nil {
+			return wrap(ctx, "stream key activity", err)
+		}
+		defer rows.Close()
+
+		streamed := false
+		for rows.Next() {
+			var a domain.KeyActivity
+			var millis pq.Int64Array
+			rec := &a.Record
+			if err := rows.Scan(
+				&rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID, &rec.Amount, &rec.Currency, &rec.Status,
+				&rec.AttemptCount, &rec.FirstSeenAt, &rec.LastSeenAt,
+				&a.DistinctSources, &a.DistinctUserAgents, &millis,
+			); err != nil {
+				return partialRead(streamed, wrap(ctx, "scan key activity", err))
+			}
+			a.AttemptTimes = make([]time.Time, len(millis))
+			for i, ms := range millis {
+				a.AttemptTimes[i] = time.UnixMilli(ms).UTC()
+			}
+			streamed = true
+			if err := fn(a); err != nil {
+				return &partialReadError{err: err}
+			}
+		}
+		return partialRead(streamed, wrap(ctx, "stream key activity", rows.Err()))
+	})
+}
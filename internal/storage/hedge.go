@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// hedgedRead runs first and, if it has not answered within delay (or fails),
+// runs second as well. The first usable answer wins and the other is cancelled.
+// ErrKeyNotFound counts as an answer; any other error falls through to the
+// remaining attempt.
+func hedgedRead[T any](ctx context.Context, delay time.Duration, first, second func(context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		val T
+		err error
+	}
+	results := make(chan result, 2)
+	run := func(fn func(context.Context) (T, error)) {
+		v, err := fn(ctx)
+		results <- result{val: v, err: err}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	go run(first)
+	inFlight, hedged := 1, false
+	hedge := func() {
+		if !hedged {
+			hedged = true
+			inFlight++
+			go run(second)
+		}
+	}
+
+	var zero T
+	var lastErr error
+	for {
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err == nil || errors.Is(res.err, domain.ErrKeyNotFound) {
+				return res.val, res.err
+			}
+			lastErr = res.err
+			hedge()
+			if inFlight == 0 {
+				return zero, lastErr
+			}
+		case <-timer.C:
+			hedge()
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func delayed(d time.Duration, v string, err error) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		select {
+		case <-time.After(d):
+			return v, err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func TestHedgedRead_FastFirstNoHedge(t *testing.T) {
+	hedgeRan := false
+	v, err := hedgedRead(context.Background(), 50*time.Millisecond,
+		delayed(0, "first", nil),
+		func(context.Context) (string, error) { hedgeRan = true; return "second", nil },
+	)
+	if err != nil || v != "first" {
+		t.Fatalf("expected first, got %q %v", v, err)
+	}
+	if hedgeRan {
+		t.Error("hedge should not run when first answers before the delay")
+	}
+}
+
+func TestHedgedRead_SlowFirstUsesHedge(t *testing.T) {
+	v, err := hedgedRead(context.Background(), 5*time.Millisecond,
+		delayed(time.Second, "slow", nil),
+		delayed(0, "hedge", nil),
+	)
+	if err != nil || v != "hedge" {
+		t.Fatalf("expected hedge, got %q %v", v, err)
+	}
+}
+
+func TestHedgedRead_FirstErrorHedgesImmediately(t *testing.T) {
+	start := time.Now()
+	v, err := hedgedRead(context.Background(), time.Second,
+		delayed(0, "", errors.New("replica down")),
+		delayed(0, "hedge", nil),
+	)
+	if err != nil || v != "hedge" {
+		t.Fatalf("expected hedge, got %q %v", v, err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("hedge should start immediately after a failure")
+	}
+}
+
+func TestHedgedRead_NotFoundIsAnAnswer(t *testing.T) {
+	_, err := hedgedRead(context.Background(), time.Second,
+		delayed(0, "", domain.ErrKeyNotFound),
+		delayed(0, "hedge", nil),
+	)
+	if !errors.Is(err, domain.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestHedgedRead_BothFail(t *testing.T) {
+	_, err := hedgedRead(context.Background(), time.Millisecond,
+		delayed(0, "", errors.New("first down")),
+		delayed(0, "", errors.New("second down")),
+	)
+	if err == nil || err.Error() != "second down" {
+		t.Errorf("expected last error, got %v", err)
+	}
+}
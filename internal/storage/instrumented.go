@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// SlowQueryRecorder counts repository calls that exceed the slow query threshold.
+type SlowQueryRecorder interface {
+	RecordSlowQuery(op string)
+}
+
+// InstrumentedRepository wraps a Repository and logs any call slower than the threshold.
+type InstrumentedRepository struct {
+	next      Repository
+	threshold time.Duration
+	recorder  SlowQueryRecorder
+}
+
+// NewInstrumentedRepository creates a new InstrumentedRepository.
+// A zero threshold disables slow query reporting.
+func NewInstrumentedRepository(next Repository, threshold time.Duration, recorder SlowQueryRecorder) *InstrumentedRepository {
+	return &InstrumentedRepository{next: next, threshold: threshold, recorder: recorder}
+}
+
+// observe reports the call if it ran longer than the threshold.
+// key may be empty for calls that are not scoped to a single idempotency key.
+func (r *InstrumentedRepository) observe(ctx context.Context, op, key string, start time.Time) {
+	elapsed := time.Since(start)
+	if r.threshold <= 0 || elapsed < r.threshold {
+		return
+	}
+	ctx, fields := logging.NewContext(ctx)
+	if key != "" && fields.KeyHash == "" {
+		fields.KeyHash = logging.HashKey(key)
+	}
+	logging.From(ctx).Warnf("slow query: op=%s duration=%s threshold=%s", op, elapsed.Round(time.Microsecond), r.threshold)
+	if r.recorder != nil {
+		r.recorder.RecordSlowQuery(op)
+	}
+}
+
+func (r *InstrumentedRepository) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	defer r.observe(ctx, "insert_or_get", req.IdempotencyKey, time.Now())
+	return r.next.InsertOrGet(ctx, req, paymentID, expiresAt)
+}
+
+func (r *InstrumentedRepository) GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	defer r.observe(ctx, "get_by_key", key, time.Now())
+	return r.next.GetByKey(ctx, key)
+}
+
+func (r *InstrumentedRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	defer r.observe(ctx, "get_by_key_primary", key, time.Now())
+	return r.next.GetByKeyPrimary(ctx, key)
+}
+
+func (r *InstrumentedRepository) GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	defer r.observe(ctx, "get_by_payment_id", "", time.Now())
+	return r.next.GetByPaymentID(ctx, paymentID)
+}
+
+func (r *InstrumentedRepository) MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	defer r.observe(ctx, "mark_complete", key, time.Now())
+	return r.next.MarkComplete(ctx, key, status, resp)
+}
+
+func (r *InstrumentedRepository) ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	defer r.observe(ctx, "reset_to_processing", key, time.Now())
+	return r.next.ResetToProcessing(ctx, key, version, newPaymentID, expiresAt)
+}
+
+func (r *InstrumentedRepository) UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error {
+	defer r.observe(ctx, "update_params", key, time.Now())
+	return r.next.UpdateParams(ctx, key, version, req)
+}
+
+func (r *InstrumentedRepository) ExpireKey(ctx context.Context, key string) error {
+	defer r.observe(ctx, "expire_key", key, time.Now())
+	return r.next.ExpireKey(ctx, key)
+}
+
+func (r *InstrumentedRepository) ResetKey(ctx context.Context, key string, version int64) error {
+	defer r.observe(ctx, "reset_key", key, time.Now())
+	return r.next.ResetKey(ctx, key, version)
+}
+
+func (r *InstrumentedRepository) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	defer r.observe(ctx, "delete_expired", "", time.Now())
+	return r.next.DeleteExpired(ctx, limit)
+}
+
+func (r *InstrumentedRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	defer r.observe(ctx, "get_duplicates", "", time.Now())
+	return r.next.GetDuplicates(ctx, merchantID, from, to, page)
+}
+
+func (r *InstrumentedRepository) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	defer r.observe(ctx, "stream_duplicates", "", time.Now())
+	return r.next.StreamDuplicates(ctx, merchantID, from, to, fn)
+}
+
+func (r *InstrumentedRepository) GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	defer r.observe(ctx, "get_amount_at_risk", "", time.Now())
+	return r.next.GetAmountAtRisk(ctx, merchantID, from, to)
+}
+
+func (r *InstrumentedRepository) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	defer r.observe(ctx, "get_merchant_stats", "", time.Now())
+	return r.next.GetMerchantStats(ctx, merchantID, from, to)
+}
+
+func (r *InstrumentedRepository) GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	defer r.observe(ctx, "get_merchant_outcomes", "", time.Now())
+	return r.next.GetMerchantOutcomes(ctx, merchantID, from, to)
+}
+
+func (r *InstrumentedRepository) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	defer r.observe(ctx, "get_duplicate_trends", "", time.Now())
+	return r.next.GetDuplicateTrends(ctx, merchantID, from, to, bucket)
+}
+
+func (r *InstrumentedRepository) GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	defer r.observe(ctx, "get_policy", "", time.Now())
+	return r.next.GetPolicy(ctx, merchantID)
+}
+
+func (r *InstrumentedRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
+	defer r.observe(ctx, "upsert_policy", "", time.Now())
+	return r.next.UpsertPolicy(ctx, policy)
+}
+
+func (r *InstrumentedRepository) ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	defer r.observe(ctx, "list_policies", "", time.Now())
+	return r.next.ListPolicies(ctx, page)
+}
+
+func (r *InstrumentedRepository) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	defer r.observe(ctx, "upsert_policies", "", time.Now())
+	return r.next.UpsertPolicies(ctx, policies)
+}
+
+func (r *InstrumentedRepository) DeletePolicy(ctx context.Context, merchantID string) error {
+	defer r.observe(ctx, "delete_policy", "", time.Now())
+	return r.next.DeletePolicy(ctx, merchantID)
+}
+
+func (r *InstrumentedRepository) GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error) {
+	defer r.observe(ctx, "get_all_merchant_stats", "", time.Now())
+	return r.next.GetAllMerchantStats(ctx, from, to)
+}
+
+func (r *InstrumentedRepository) GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	defer r.observe(ctx, "get_amount_stats", "", time.Now())
+	return r.next.GetAmountStats(ctx, merchantID, from, to)
+}
+
+func (r *InstrumentedRepository) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	defer r.observe(ctx, "search_records", "", time.Now())
+	return r.next.SearchRecords(ctx, filter, page)
+}
+
+func (r *InstrumentedRepository) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	defer r.observe(ctx, "get_attempts", key, time.Now())
+	return r.next.GetAttempts(ctx, key)
+}
+
+var _ Repository = (*InstrumentedRepository)(nil)
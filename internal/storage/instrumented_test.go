@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// sleepyRepo delays GetByKey; other methods are not exercised.
+type sleepyRepo struct {
+	Repository
+	delay time.Duration
+}
+
+func (r *sleepyRepo) GetByKey(_ context.Context, key string) (*domain.IdempotencyRecord, error) {
+	time.Sleep(r.delay)
+	return &domain.IdempotencyRecord{IdempotencyKey: key}, nil
+}
+
+type countingRecorder struct {
+	ops []string
+}
+
+func (c *countingRecorder) RecordSlowQuery(op string) { c.ops = append(c.ops, op) }
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(orig) })
+	return &buf
+}
+
+func TestInstrumentedRepository_SlowCallLogged(t *testing.T) {
+	buf := captureLog(t)
+	rec := &countingRecorder{}
+	repo := NewInstrumentedRepository(&sleepyRepo{delay: 5 * time.Millisecond}, time.Millisecond, rec)
+
+	if _, err := repo.GetByKey(context.Background(), "slow-key"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rec.ops) != 1 || rec.ops[0] != "get_by_key" {
+		t.Errorf("expected one get_by_key slow query, got %v", rec.ops)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "op=get_by_key") {
+		t.Errorf("expected op in log, got %q", out)
+	}
+	if !strings.Contains(out, "key_hash="+logging.HashKey("slow-key")) {
+		t.Errorf("expected key hash in log, got %q", out)
+	}
+	if strings.Contains(out, "slow-key") {
+		t.Error("raw key must not be logged")
+	}
+}
+
+func TestInstrumentedRepository_FastCallSilent(t *testing.T) {
+	buf := captureLog(t)
+	rec := &countingRecorder{}
+	repo := NewInstrumentedRepository(&sleepyRepo{}, time.Second, rec)
+
+	repo.GetByKey(context.Background(), "fast-key")
+
+	if len(rec.ops) != 0 {
+		t.Errorf("expected no slow queries, got %v", rec.ops)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no log output, got %q", buf.String())
+	}
+}
+
+func TestInstrumentedRepository_ZeroThresholdDisabled(t *testing.T) {
+	rec := &countingRecorder{}
+	repo := NewInstrumentedRepository(&sleepyRepo{delay: time.Millisecond}, 0, rec)
+
+	repo.GetByKey(context.Background(), "any-key")
+
+	if len(rec.ops) != 0 {
+		t.Errorf("expected reporting disabled, got %v", rec.ops)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"os"
 	"sync"
 	"testing"
@@ -151,7 +152,8 @@ func TestIntegration_MarkComplete(t *testing.T) {
 	repo.InsertOrGet(context.Background(), req, "pay_mc", time.Now().Add(24*time.Hour))
 
 	body := json.RawMessage(`{"tx":"abc"}`)
-	err := repo.MarkComplete(context.Background(), key, domain.StatusSucceeded, &body)
+	err := repo.MarkComplete(context.Background(), key, domain.StatusSucceeded,
+		domain.StoredResponse{Status: 201, Headers: map[string]string{"Location": "/payments/abc"}, Body: &body})
 	if err != nil {
 		t.Fatalf("MarkComplete: %v", err)
 	}
@@ -160,6 +162,12 @@ func TestIntegration_MarkComplete(t *testing.T) {
 	if rec.Status != domain.StatusSucceeded {
 		t.Errorf("expected succeeded, got %s", rec.Status)
 	}
+	if rec.ResponseStatus != 201 || rec.ResponseHeaders["Location"] != "/payments/abc" {
+		t.Errorf("expected the stored response, got %d %v", rec.ResponseStatus, rec.ResponseHeaders)
+	}
+	if again, _, _ := repo.InsertOrGet(context.Background(), req, "pay_mc2", time.Now().Add(24*time.Hour)); again.ResponseStatus != 201 {
+		t.Errorf("expected a duplicate to read the stored response, got %+v", again)
+	}
 }
 
 func TestIntegration_MarkComplete_NotFound(t *testing.T) {
@@ -167,7 +175,7 @@ func TestIntegration_MarkComplete_NotFound(t *testing.T) {
 	defer db.Close()
 	repo := NewPostgresRepository(db)
 
-	err := repo.MarkComplete(context.Background(), "nonexistent_key_xyz", domain.StatusSucceeded, nil)
+	err := repo.MarkComplete(context.Background(), "nonexistent_key_xyz", domain.StatusSucceeded, domain.StoredResponse{})
 	if err != domain.ErrKeyNotFound {
 		t.Errorf("expected ErrKeyNotFound, got %v", err)
 	}
@@ -189,9 +197,9 @@ func TestIntegration_MarkComplete_AlreadyCompleted(t *testing.T) {
 		Currency:       "BRL",
 	}
 	repo.InsertOrGet(context.Background(), req, "pay_ac", time.Now().Add(24*time.Hour))
-	repo.MarkComplete(context.Background(), key, domain.StatusSucceeded, nil)
+	repo.MarkComplete(context.Background(), key, domain.StatusSucceeded, domain.StoredResponse{})
 
-	err := repo.MarkComplete(context.Background(), key, domain.StatusSucceeded, nil)
+	err := repo.MarkComplete(context.Background(), key, domain.StatusSucceeded, domain.StoredResponse{})
 	if err != domain.ErrAlreadyCompleted {
 		t.Errorf("expected ErrAlreadyCompleted, got %v", err)
 	}
@@ -208,6 +216,27 @@ func TestIntegration_GetByKey_NotFound(t *testing.T) {
 	}
 }
 
+func TestIntegration_GetByPaymentID(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+
+	key := "inttest_bypayment_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+	paymentID := "pay_" + key
+	repo.InsertOrGet(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: key, MerchantID: "test-merchant", CustomerID: "test-customer", Amount: 5000, Currency: "BRL",
+	}, paymentID, time.Now().Add(24*time.Hour))
+
+	rec, err := repo.GetByPaymentID(context.Background(), paymentID)
+	if err != nil || rec.IdempotencyKey != key {
+		t.Fatalf("expected %s, got %+v, %v", key, rec, err)
+	}
+	if _, err := repo.GetByPaymentID(context.Background(), "pay_absolutely_nonexistent"); err != domain.ErrPaymentNotFound {
+		t.Errorf("expected ErrPaymentNotFound, got %v", err)
+	}
+}
+
 func TestIntegration_ResetToProcessing(t *testing.T) {
 	db := getTestDB(t)
 	defer db.Close()
@@ -224,9 +253,10 @@ func TestIntegration_ResetToProcessing(t *testing.T) {
 		Currency:       "BRL",
 	}
 	repo.InsertOrGet(context.Background(), req, "pay_r1", time.Now().Add(24*time.Hour))
-	repo.MarkComplete(context.Background(), key, domain.StatusFailed, nil)
+	repo.MarkComplete(context.Background(), key, domain.StatusFailed, domain.StoredResponse{})
 
-	err := repo.ResetToProcessing(context.Background(), key, "pay_r2", time.Now().Add(24*time.Hour))
+	failed, _ := repo.GetByKey(context.Background(), key)
+	err := repo.ResetToProcessing(context.Background(), key, failed.Version, "pay_r2", time.Now().Add(24*time.Hour))
 	if err != nil {
 		t.Fatalf("ResetToProcessing: %v", err)
 	}
@@ -235,6 +265,15 @@ func TestIntegration_ResetToProcessing(t *testing.T) {
 	if rec.Status != domain.StatusProcessing {
 		t.Errorf("expected processing after reset, got %s", rec.Status)
 	}
+	if rec.Version != failed.Version+1 {
+		t.Errorf("expected version %d after reset, got %d", failed.Version+1, rec.Version)
+	}
+
+	// A duplicate that read the failed record lost the race.
+	err = repo.ResetToProcessing(context.Background(), key, failed.Version, "pay_r3", time.Now().Add(24*time.Hour))
+	if err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate for a stale version, got %v", err)
+	}
 }
 
 func TestIntegration_DeleteExpired(t *testing.T) {
@@ -253,7 +292,7 @@ func TestIntegration_DeleteExpired(t *testing.T) {
 	}
 	repo.InsertOrGet(context.Background(), req, "pay_exp", time.Now().Add(-1*time.Hour))
 
-	deleted, err := repo.DeleteExpired(context.Background())
+	deleted, err := repo.DeleteExpired(context.Background(), 1000)
 	if err != nil {
 		t.Fatalf("DeleteExpired: %v", err)
 	}
@@ -282,12 +321,21 @@ func TestIntegration_GetDuplicates(t *testing.T) {
 	repo.InsertOrGet(context.Background(), req, "pay_d1", time.Now().Add(24*time.Hour))
 	repo.InsertOrGet(context.Background(), req, "pay_d2", time.Now().Add(24*time.Hour))
 
-	dups, err := repo.GetDuplicates(context.Background(), "inttest-merchant-dup", time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+	dups, total, err := repo.GetDuplicates(context.Background(), "inttest-merchant-dup", time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour), domain.Page{})
 	if err != nil {
 		t.Fatalf("GetDuplicates: %v", err)
 	}
-	if len(dups) < 1 {
-		t.Error("expected at least 1 duplicate")
+	if len(dups) < 1 || total != len(dups) {
+		t.Errorf("expected at least 1 duplicate and a matching total, got %d of %d", len(dups), total)
+	}
+
+	page, pageTotal, err := repo.GetDuplicates(context.Background(), "inttest-merchant-dup", time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour), domain.Page{Limit: 1, Offset: total})
+	if err != nil || len(page) != 0 || pageTotal != total {
+		t.Errorf("expected an empty page past the end with the total, got %d of %d: %v", len(page), pageTotal, err)
+	}
+	atRisk, err := repo.GetAmountAtRisk(context.Background(), "inttest-merchant-dup", time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+	if err != nil || atRisk["BRL"] < 5000 {
+		t.Errorf("expected at least 5000 BRL at risk, got %v: %v", atRisk, err)
 	}
 }
 
@@ -367,6 +415,265 @@ func TestIntegration_GetAllMerchantStats(t *testing.T) {
 	_ = stats
 }
 
+func TestIntegration_GetAmountStats(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+
+	key := "inttest_amount_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+
+	_, _, err := repo.InsertOrGet(context.Background(), domain.PaymentRequest{
+		IdempotencyKey: key,
+		MerchantID:     "inttest-amount-merchant",
+		CustomerID:     "c1",
+		Amount:         4200,
+		Currency:       "BRL",
+	}, "pay_amount", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("InsertOrGet: %v", err)
+	}
+
+	stats, err := repo.GetAmountStats(context.Background(), "inttest-amount-merchant", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("GetAmountStats: %v", err)
+	}
+	if st := stats["BRL"]; st.Count < 1 || st.Mean <= 0 {
+		t.Errorf("unexpected BRL stats: %+v", st)
+	}
+}
+
+func TestIntegration_AttemptSources(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+
+	key := "inttest_sources_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+
+	req := domain.PaymentRequest{
+		IdempotencyKey: key,
+		MerchantID:     "inttest-sources-merchant",
+		CustomerID:     "c1",
+		Amount:         1000,
+		Currency:       "MXN",
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.2"} {
+		req.Source = domain.AttemptSource{IP: ip, UserAgent: "pos/1.0", RequestID: "req_" + ip}
+		if _, _, err := repo.InsertOrGet(context.Background(), req, "pay_sources", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("InsertOrGet: %v", err)
+		}
+	}
+
+	dups, _, err := repo.GetDuplicates(context.Background(), "inttest-sources-merchant", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), domain.Page{})
+	if err != nil {
+		t.Fatalf("GetDuplicates: %v", err)
+	}
+	for _, d := range dups {
+		if d.IdempotencyKey == key {
+			if d.AttemptCount != 3 || d.DistinctSources != 2 {
+				t.Errorf("expected 3 attempts from 2 sources, got %d from %d", d.AttemptCount, d.DistinctSources)
+			}
+			return
+		}
+	}
+	t.Errorf("key %s not in duplicates", key)
+}
+
+func TestIntegration_EnvironmentsDoNotCollide(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	prod := NewPostgresRepository(db)
+	sandbox := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentSandbox)
+
+	key := "inttest_env_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+
+	req := domain.PaymentRequest{
+		IdempotencyKey: key,
+		MerchantID:     "inttest-env-merchant",
+		CustomerID:     "c1",
+		Amount:         1000,
+		Currency:       "BRL",
+	}
+	if _, isNew, err := prod.InsertOrGet(context.Background(), req, "pay_prod", time.Now().Add(time.Hour)); err != nil || !isNew {
+		t.Fatalf("production insert: new=%v err=%v", isNew, err)
+	}
+	rec, isNew, err := sandbox.InsertOrGet(context.Background(), req, "pay_sandbox", time.Now().Add(time.Hour))
+	if err != nil || !isNew {
+		t.Fatalf("sandbox insert should be new: new=%v err=%v", isNew, err)
+	}
+	if rec.PaymentID != "pay_sandbox" {
+		t.Errorf("expected sandbox payment, got %s", rec.PaymentID)
+	}
+
+	if err := sandbox.MarkComplete(context.Background(), key, domain.StatusSucceeded, domain.StoredResponse{}); err != nil {
+		t.Fatalf("sandbox MarkComplete: %v", err)
+	}
+	got, err := prod.GetByKey(context.Background(), key)
+	if err != nil {
+		t.Fatalf("production GetByKey: %v", err)
+	}
+	if got.Status != domain.StatusProcessing || got.PaymentID != "pay_prod" {
+		t.Errorf("production key changed by sandbox: %s %s", got.Status, got.PaymentID)
+	}
+}
+
+func TestIntegration_DeleteExpiredReservationsKeepsOtherEnvironments(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	sandbox := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentSandbox)
+
+	key := "inttest_resv_env_" + time.Now().Format("20060102150405.000")
+	defer db.Exec("DELETE FROM key_reservations WHERE idempotency_key = $1", key)
+	for _, env := range []string{domain.EnvironmentProduction, domain.EnvironmentSandbox} {
+		if _, err := db.Exec(`
+			INSERT INTO key_reservations (environment, idempotency_key, merchant_id, reserved_at, expires_at)
+			VALUES ($1, $2, 'inttest-resv-merchant', NOW() - INTERVAL '2 hours', NOW() - INTERVAL '1 hour')
+		`, env, key); err != nil {
+			t.Fatalf("insert %s reservation: %v", env, err)
+		}
+	}
+
+	if _, err := sandbox.DeleteExpiredReservations(context.Background(), 1000); err != nil {
+		t.Fatalf("sandbox DeleteExpiredReservations: %v", err)
+	}
+	var envs []string
+	rows, err := db.Query("SELECT environment FROM key_reservations WHERE idempotency_key = $1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var env string
+		rows.Scan(&env)
+		envs = append(envs, env)
+	}
+	if len(envs) != 1 || envs[0] != domain.EnvironmentProduction {
+		t.Errorf("expected only the production reservation left, got %v", envs)
+	}
+}
+
+func TestIntegration_WebhookDeadLetters(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentSandbox)
+	ctx := context.Background()
+
+	merchant := "inttest_webhook_" + time.Now().Format("20060102150405.000")
+	defer db.Exec("DELETE FROM webhook_dead_letters WHERE merchant_id = $1", merchant)
+	err := repo.SaveWebhookDeadLetter(ctx, domain.WebhookDeadLetter{
+		MerchantID: merchant, Event: "duplicate_threshold_exceeded", Endpoint: "https://merchant.example/hooks",
+		Payload: json.RawMessage(`{"merchant_id":"` + merchant + `"}`), Attempts: 3, LastError: "webhook: unexpected status 500",
+	})
+	if err != nil {
+		t.Fatalf("SaveWebhookDeadLetter: %v", err)
+	}
+
+	dead, total, err := repo.ListWebhookDeadLetters(ctx, domain.Page{Limit: 1})
+	if err != nil || len(dead) != 1 || total < 1 || dead[0].MerchantID != merchant {
+		t.Fatalf("expected the new dead letter first, got %+v %d %v", dead, total, err)
+	}
+	id := dead[0].ID
+	if err := repo.RecordWebhookRedelivery(ctx, id, errors.New("still down")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RecordWebhookRedelivery(ctx, id, nil); err != nil {
+		t.Fatal(err)
+	}
+	dl, err := repo.GetWebhookDeadLetter(ctx, id)
+	if err != nil || dl.Attempts != 4 || dl.LastError != "still down" || dl.RedeliveredAt == nil {
+		t.Errorf("expected 4 attempts and a redelivery, got %+v %v", dl, err)
+	}
+
+	production := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentProduction)
+	if _, err := production.GetWebhookDeadLetter(ctx, id); !errors.Is(err, domain.ErrDeadLetterNotFound) {
+		t.Errorf("expected another environment's dead letter to be hidden, got %v", err)
+	}
+}
+
+func TestIntegration_WebhookEvents(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentSandbox)
+	ctx := context.Background()
+
+	merchant := "inttest_outbox_" + time.Now().Format("20060102150405.000")
+	defer db.Exec("DELETE FROM webhook_events WHERE merchant_id = $1", merchant)
+	for _, event := range []string{domain.DuplicateAlertEvent, "other_event"} {
+		err := repo.SaveWebhookEvent(ctx, domain.WebhookEvent{
+			MerchantID: merchant, Event: event, Endpoint: "https://merchant.example/hooks", Payload: json.RawMessage(`{}`),
+		})
+		if err != nil {
+			t.Fatalf("SaveWebhookEvent: %v", err)
+		}
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	events, err := repo.ListWebhookEvents(ctx, merchant, domain.DuplicateAlertEvent, from, to, 10)
+	if err != nil || len(events) != 1 || events[0].Event != domain.DuplicateAlertEvent {
+		t.Fatalf("expected the one duplicate alert, got %+v %v", events, err)
+	}
+	if events, _ := repo.ListWebhookEvents(ctx, merchant, "", from, to, 10); len(events) != 2 {
+		t.Errorf("expected both events without an event filter, got %d", len(events))
+	}
+	production := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentProduction)
+	if events, _ := production.ListWebhookEvents(ctx, merchant, "", from, to, 10); len(events) != 0 {
+		t.Errorf("expected another environment's events hidden, got %d", len(events))
+	}
+
+	if _, err := production.PurgeWebhookEvents(ctx, to, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := repo.ListWebhookEvents(ctx, merchant, "", from, to, 10); len(events) != 2 {
+		t.Errorf("expected another environment's purge to keep the events, got %d", len(events))
+	}
+	if _, err := repo.PurgeWebhookEvents(ctx, to, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := repo.ListWebhookEvents(ctx, merchant, "", from, to, 10); len(events) != 0 {
+		t.Errorf("expected the events purged, got %d", len(events))
+	}
+}
+
+func TestIntegration_WebhookDeliveries(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db).WithEnvironment(domain.EnvironmentSandbox)
+	ctx := context.Background()
+
+	eventID := "evt_inttest_" + time.Now().Format("20060102150405.000")
+	endpoint := "https://merchant.example/hooks"
+	defer db.Exec("DELETE FROM webhook_deliveries WHERE event_id = $1", eventID)
+	defer db.Exec("DELETE FROM webhook_events WHERE event_id = $1", eventID)
+
+	if err := repo.RecordWebhookDelivery(ctx, eventID, endpoint, errors.New("unexpected status 502")); err != nil {
+		t.Fatalf("RecordWebhookDelivery: %v", err)
+	}
+	if delivered, err := repo.WebhookDelivered(ctx, eventID, endpoint); err != nil || delivered {
+		t.Fatalf("expected a failed attempt not to count as delivered, got %v %v", delivered, err)
+	}
+	repo.RecordWebhookDelivery(ctx, eventID, endpoint, nil)
+	repo.RecordWebhookDelivery(ctx, eventID, endpoint, errors.New("replay failed"))
+	var attempts int
+	db.QueryRow("SELECT attempts FROM webhook_deliveries WHERE event_id = $1", eventID).Scan(&attempts)
+	if delivered, _ := repo.WebhookDelivered(ctx, eventID, endpoint); !delivered || attempts != 3 {
+		t.Errorf("expected 3 attempts and the event to stay delivered, got %d %v", attempts, delivered)
+	}
+
+	ev := domain.WebhookEvent{EventID: eventID, MerchantID: "inttest-outbox", Event: domain.DuplicateAlertEvent, Endpoint: endpoint, Payload: json.RawMessage(`{}`)}
+	for i := 0; i < 2; i++ {
+		if err := repo.SaveWebhookEvent(ctx, ev); err != nil {
+			t.Fatalf("SaveWebhookEvent: %v", err)
+		}
+	}
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM webhook_events WHERE event_id = $1", eventID).Scan(&stored)
+	if stored != 1 {
+		t.Errorf("expected an event saved twice to be kept once, got %d", stored)
+	}
+}
+
 func TestIntegration_ConcurrentInserts(t *testing.T) {
 	db := getTestDB(t)
 	defer db.Close()
@@ -427,3 +734,94 @@ func TestIntegration_NewPostgresDB(t *testing.T) {
 		t.Errorf("expected successful ping, got %v", err)
 	}
 }
+
+func TestIntegration_InsertOrGet_LockTimeout(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db).WithTimeouts(5*time.Second, 100*time.Millisecond)
+
+	key := "inttest_lock_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+
+	// Another session holds the key's lock, as a stuck request would.
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock($1)", advisoryLockKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey(key))
+
+	req := domain.PaymentRequest{
+		IdempotencyKey: key,
+		MerchantID:     "test-merchant",
+		CustomerID:     "test-customer",
+		Amount:         5000,
+		Currency:       "BRL",
+	}
+	start := time.Now()
+	_, _, err = repo.InsertOrGet(context.Background(), req, "pay_lock", time.Now().Add(24*time.Hour))
+	if !errors.Is(err, domain.ErrLockTimeout) {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("lock wait took %s, budget was 100ms", elapsed)
+	}
+
+	// Without a lock budget the query timeout still ends the wait.
+	repo.WithTimeouts(200*time.Millisecond, 0)
+	_, _, err = repo.InsertOrGet(context.Background(), req, "pay_lock", time.Now().Add(24*time.Hour))
+	if !errors.Is(err, domain.ErrTimeout) || errors.Is(err, domain.ErrLockTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestIntegration_RestoreKey(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+	ctx := context.Background()
+
+	key := "inttest_restore_" + time.Now().Format("20060102150405.000")
+	defer cleanupKey(t, db, key)
+	req := domain.PaymentRequest{IdempotencyKey: key, MerchantID: "test-merchant", CustomerID: "test-customer", Amount: 5000, Currency: "BRL"}
+	prior, _, err := repo.InsertOrGet(ctx, req, "pay_restore_1", time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("InsertOrGet: %v", err)
+	}
+	if err := repo.RestoreKey(ctx, key); !errors.Is(err, domain.ErrNothingToRestore) {
+		t.Errorf("expected ErrNothingToRestore before any admin action, got %v", err)
+	}
+
+	if err := repo.ResetKey(ctx, key, prior.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveRestorePoint(ctx, key, domain.AuditKeyReset, *prior, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SaveRestorePoint: %v", err)
+	}
+	if err := repo.RestoreKey(ctx, key); err != nil {
+		t.Fatalf("RestoreKey: %v", err)
+	}
+	rec, err := repo.GetByKeyPrimary(ctx, key)
+	if err != nil || rec.Status != domain.StatusProcessing || rec.CompletedAt != nil || !rec.ExpiresAt.After(time.Now()) {
+		t.Fatalf("expected the key processing and unexpired again, got %+v %v", rec, err)
+	}
+
+	// A payment reusing the key after the action moves its version on.
+	repo.ExpireKey(ctx, key)
+	if err := repo.SaveRestorePoint(ctx, key, domain.AuditKeyExpired, *rec, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	reused, _ := repo.GetByKeyPrimary(ctx, key)
+	if err := repo.ResetToProcessing(ctx, key, reused.Version, "pay_restore_2", time.Now().Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RestoreKey(ctx, key); !errors.Is(err, domain.ErrKeyReused) {
+		t.Errorf("expected ErrKeyReused, got %v", err)
+	}
+	if err := repo.RestoreKey(ctx, "inttest_restore_missing"); !errors.Is(err, domain.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
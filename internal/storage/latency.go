@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// CompletionLatency returns the 90th percentile of the time the merchant's
+// keys first seen since the given time spent processing before completing,
+// and how many completions it is based on. It reads through idx_merchant_time,
+// from a replica when one is configured.
+func (r *PostgresRepository) CompletionLatency(ctx context.Context, merchantID string, since time.Time) (time.Duration, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var seconds sql.NullFloat64
+	var n int
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, `
+			SELECT percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM completed_at - processing_since)), COUNT(*)
+			FROM idempotency_keys
+			WHERE environment = $1 AND merchant_id = $2 AND first_seen_at >= $3
+				AND completed_at IS NOT NULL AND completed_at >= processing_since
+		`, r.env, merchantID, since).Scan(&seconds, &n)
+	})
+	if err != nil {
+		return 0, 0, wrap(ctx, "completion latency", err)
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), n, nil
+}
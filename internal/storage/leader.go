@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+// AdvisoryLeaderLock is a Postgres session advisory lock that at most one
+// instance holds at a time. The lock lives as long as the session, so the
+// holder keeps one pooled connection pinned; if that connection dies,
+// Postgres releases the lock and another instance can take it.
+type AdvisoryLeaderLock struct {
+	db  *sql.DB
+	key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// LeaderLock returns the advisory lock named name, scoped to the
+// repository's environment like the per-key locks.
+func (r *PostgresRepository) LeaderLock(name string) *AdvisoryLeaderLock {
+	return &AdvisoryLeaderLock{db: r.db, key: advisoryLockKey(r.lockName("leader:" + name))}
+}
+
+// TryAcquire takes the lock with pg_try_advisory_lock if it is free. When
+// this instance already holds it, it reports whether the session holding it
+// is still alive.
+func (l *AdvisoryLeaderLock) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		if _, err := l.conn.ExecContext(ctx, "SELECT 1"); err == nil {
+			return true, nil
+		} else if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		discard(l.conn)
+		l.conn = nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("leader lock: %w", err)
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired); err != nil {
+		discard(conn)
+		return false, fmt.Errorf("leader lock: %w", err)
+	}
+	if !acquired {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+// Release unlocks the lock if this instance holds it and returns the
+// connection to the pool. A connection that could not unlock is closed
+// instead, which ends its session and the lock with it.
+func (l *AdvisoryLeaderLock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+	conn := l.conn
+	l.conn = nil
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key); err != nil {
+		discard(conn)
+		return fmt.Errorf("leader unlock: %w", err)
+	}
+	return conn.Close()
+}
+
+// discard closes conn's underlying connection rather than returning it to
+// the pool, so no session lock it may still hold outlives it.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
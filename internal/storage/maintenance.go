@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaintainedTables are the tables subject to scheduled maintenance.
+var MaintainedTables = []string{"idempotency_keys", "merchant_policies"}
+
+// TableStats are the planner and bloat statistics of one table.
+type TableStats struct {
+	Table            string
+	LiveTuples       int64
+	DeadTuples       int64
+	ModsSinceAnalyze int64
+	LastAnalyzed     *time.Time
+}
+
+// DeadRatio is the fraction of dead tuples among all tuples in the table.
+func (t TableStats) DeadRatio() float64 {
+	total := t.LiveTuples + t.DeadTuples
+	if total == 0 {
+		return 0
+	}
+	return float64(t.DeadTuples) / float64(total)
+}
+
+// ModifiedRatio is the fraction of rows changed since the last analyze.
+func (t TableStats) ModifiedRatio() float64 {
+	if t.LiveTuples == 0 {
+		if t.ModsSinceAnalyze > 0 {
+			return 1
+		}
+		return 0
+	}
+	return float64(t.ModsSinceAnalyze) / float64(t.LiveTuples)
+}
+
+// TableStats returns statistics for the maintained tables from pg_stat_user_tables.
+func (r *PostgresRepository) TableStats(ctx context.Context) ([]TableStats, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT relname, n_live_tup, n_dead_tup, n_mod_since_analyze,
+			GREATEST(last_analyze, last_autoanalyze)
+		FROM pg_stat_user_tables
+		WHERE schemaname = current_schema() AND relname = ANY($1)
+		ORDER BY relname
+	`, pq.Array(MaintainedTables))
+	if err != nil {
+		return nil, fmt.Errorf("table stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []TableStats
+	for rows.Next() {
+		var ts TableStats
+		var lastAnalyzed sql.NullTime
+		if err := rows.Scan(&ts.Table, &ts.LiveTuples, &ts.DeadTuples, &ts.ModsSinceAnalyze, &lastAnalyzed); err != nil {
+			return nil, fmt.Errorf("scan table stats: %w", err)
+		}
+		if lastAnalyzed.Valid {
+			ts.LastAnalyzed = &lastAnalyzed.Time
+		}
+		stats = append(stats, ts)
+	}
+	return stats, rows.Err()
+}
+
+// Analyze refreshes planner statistics for one of the maintained tables.
+func (r *PostgresRepository) Analyze(ctx context.Context, table string) error {
+	if !isMaintainedTable(table) {
+		return fmt.Errorf("analyze: %q is not a maintained table", table)
+	}
+	if _, err := r.db.ExecContext(ctx, "ANALYZE "+pq.QuoteIdentifier(table)); err != nil {
+		return fmt.Errorf("analyze %s: %w", table, err)
+	}
+	return nil
+}
+
+func isMaintainedTable(table string) bool {
+	for _, t := range MaintainedTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,481 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// MemoryRepository implements Repository in process memory, for local
+// development, demos and tests of services that sit in front of the shield.
+// One mutex guards everything, so each method is atomic the way the Postgres
+// statements are. Keys are kept in a min-heap by expires_at: DeleteExpired
+// pops from it, and an insert into a full store first drops expired keys.
+// When maxKeys live keys remain, InsertOrGet returns domain.ErrStoreFull
+// rather than evict a key that still guards a payment.
+type MemoryRepository struct {
+	mu       sync.Mutex
+	maxKeys  int
+	seq      int64
+	keys     map[string]*memoryKey
+	payments map[string]string // payment ID → idempotency key
+	expiry   expiryHeap
+	policies map[string]domain.MerchantPolicy
+	now      func() time.Time
+}
+
+// memoryKey is a stored record with the source IPs and latest attempts
+// seen for it.
+type memoryKey struct {
+	rec      domain.IdempotencyRecord
+	sources  map[string]struct{}
+	attempts []domain.Attempt
+	index    int // position in the expiry heap
+}
+
+// NewMemoryRepository creates an empty MemoryRepository that holds at most
+// maxKeys keys; zero or less means no limit.
+func NewMemoryRepository(maxKeys int) *MemoryRepository {
+	return &MemoryRepository{
+		maxKeys:  maxKeys,
+		keys:     make(map[string]*memoryKey),
+		payments: make(map[string]string),
+		policies: make(map[string]domain.MerchantPolicy),
+		now:      time.Now,
+	}
+}
+
+// Ping always succeeds; it lets the repository stand in for the database in
+// health checks.
+func (r *MemoryRepository) Ping() error { return nil }
+
+func (r *MemoryRepository) InsertOrGet(_ context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if k, ok := r.keys[req.IdempotencyKey]; ok {
+		k.rec.AttemptCount++
+		k.rec.LastSeenAt = now
+		k.addSource(req.Source.IP)
+		k.addAttempt(req, now, domain.AttemptOutcome(&k.rec, req, false))
+		rec := k.rec
+		return &rec, false, nil
+	}
+	if _, taken := r.payments[paymentID]; taken {
+		return nil, false, domain.ErrPaymentIDConflict
+	}
+	if r.maxKeys > 0 && len(r.keys) >= r.maxKeys {
+		r.deleteExpired(now, len(r.keys)-r.maxKeys+1)
+		if len(r.keys) >= r.maxKeys {
+			return nil, false, domain.ErrStoreFull
+		}
+	}
+
+	r.seq++
+	k := &memoryKey{
+		rec: domain.IdempotencyRecord{
+			ID:              r.seq,
+			IdempotencyKey:  req.IdempotencyKey,
+			MerchantID:      req.MerchantID,
+			CustomerID:      req.CustomerID,
+			Amount:          req.Amount,
+			Currency:        req.Currency,
+			Status:          domain.StatusProcessing,
+			RequestHash:     req.Hash(),
+			BodyHash:        req.BodyHash,
+			Metadata:        append(json.RawMessage(nil), req.Metadata...),
+			PaymentID:       paymentID,
+			AttemptCount:    1,
+			Version:         1,
+			FirstSeenAt:     now,
+			LastSeenAt:      now,
+			ProcessingSince: now,
+			ExpiresAt:       expiresAt,
+		},
+		sources: make(map[string]struct{}),
+	}
+	k.addSource(req.Source.IP)
+	k.addAttempt(req, now, domain.AttemptNew)
+	r.keys[req.IdempotencyKey] = k
+	r.payments[paymentID] = req.IdempotencyKey
+	heap.Push(&r.expiry, k)
+	rec := k.rec
+	return &rec, true, nil
+}
+
+func (k *memoryKey) addSource(ip string) {
+	if ip != "" {
+		k.sources[ip] = struct{}{}
+	}
+}
+
+// addAttempt records an attempt, keeping the latest domain.MaxAttemptHistory.
+func (k *memoryKey) addAttempt(req domain.PaymentRequest, now time.Time, outcome string) {
+	if len(k.attempts) == domain.MaxAttemptHistory {
+		k.attempts = append(k.attempts[:0], k.attempts[1:]...)
+	}
+	k.attempts = append(k.attempts, domain.Attempt{
+		AttemptedAt: now,
+		RequestHash: req.Hash(),
+		SourceIP:    req.Source.IP,
+		UserAgent:   req.Source.UserAgent,
+		RequestID:   req.Source.RequestID,
+		Outcome:     outcome,
+	})
+}
+
+func (r *MemoryRepository) GetByKey(_ context.Context, key string) (*domain.IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok {
+		return nil, domain.ErrKeyNotFound
+	}
+	rec := k.rec
+	return &rec, nil
+}
+
+// GetByKeyPrimary is GetByKey: this backend has no replicas.
+func (r *MemoryRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	return r.GetByKey(ctx, key)
+}
+
+func (r *MemoryRepository) GetByPaymentID(_ context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.payments[paymentID]
+	if !ok {
+		return nil, domain.ErrPaymentNotFound
+	}
+	rec := r.keys[key].rec
+	return &rec, nil
+}
+
+// MarkComplete copies the response, so the caller may reuse its buffers.
+func (r *MemoryRepository) MarkComplete(_ context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok {
+		return domain.ErrKeyNotFound
+	}
+	if k.rec.Status != domain.StatusProcessing {
+		return domain.ErrAlreadyCompleted
+	}
+	k.rec.ResponseBody = nil
+	if resp.Body != nil {
+		body := append(json.RawMessage(nil), *resp.Body...)
+		k.rec.ResponseBody = &body
+	}
+	k.rec.ResponseStatus = resp.Status
+	k.rec.ResponseHeaders = nil
+	if len(resp.Headers) > 0 {
+		k.rec.ResponseHeaders = make(map[string]string, len(resp.Headers))
+		for name, value := range resp.Headers {
+			k.rec.ResponseHeaders[name] = value
+		}
+	}
+	now := r.now()
+	k.rec.Status = status
+	k.rec.CompletedAt = &now
+	k.rec.Version++
+	return nil
+}
+
+// ResetToProcessing compares and swaps on version like the Postgres
+// implementation. The old payment ID stops resolving.
+func (r *MemoryRepository) ResetToProcessing(_ context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok || k.rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	if owner, taken := r.payments[newPaymentID]; taken && owner != key {
+		return domain.ErrPaymentIDConflict
+	}
+	delete(r.payments, k.rec.PaymentID)
+	r.payments[newPaymentID] = key
+	k.rec.Status = domain.StatusProcessing
+	k.rec.PaymentID = newPaymentID
+	k.rec.CompletedAt = nil
+	k.rec.ExpiresAt = expiresAt
+	k.rec.LastSeenAt = r.now()
+	k.rec.ProcessingSince = k.rec.LastSeenAt
+	k.rec.Version++
+	heap.Fix(&r.expiry, k.index)
+	return nil
+}
+
+// UpdateParams compares and swaps on version like the Postgres
+// implementation.
+func (r *MemoryRepository) UpdateParams(_ context.Context, key string, version int64, req domain.PaymentRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok || k.rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	k.rec.CustomerID = req.CustomerID
+	k.rec.Amount = req.Amount
+	k.rec.Currency = req.Currency
+	k.rec.RequestHash = req.Hash()
+	k.rec.BodyHash = req.BodyHash
+	k.rec.Metadata = append(json.RawMessage(nil), req.Metadata...)
+	k.rec.LastSeenAt = r.now()
+	k.rec.Version++
+	return nil
+}
+
+// ExpireKey keeps an earlier expiry and bumps the version like the Postgres
+// implementation.
+func (r *MemoryRepository) ExpireKey(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok {
+		return domain.ErrKeyNotFound
+	}
+	if now := r.now(); k.rec.ExpiresAt.After(now) {
+		k.rec.ExpiresAt = now
+		heap.Fix(&r.expiry, k.index)
+	}
+	k.rec.Version++
+	return nil
+}
+
+// ResetKey compares and swaps on version like the Postgres implementation.
+func (r *MemoryRepository) ResetKey(_ context.Context, key string, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok || k.rec.Version != version {
+		return domain.ErrConcurrentUpdate
+	}
+	now := r.now()
+	k.rec.Status = domain.StatusFailed
+	if k.rec.CompletedAt == nil {
+		k.rec.CompletedAt = &now
+	}
+	if k.rec.ExpiresAt.After(now) {
+		k.rec.ExpiresAt = now
+		heap.Fix(&r.expiry, k.index)
+	}
+	k.rec.Version++
+	return nil
+}
+
+func (r *MemoryRepository) DeleteExpired(_ context.Context, limit int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteExpired(r.now(), limit), nil
+}
+
+// deleteExpired removes up to limit keys that expired before now, soonest
+// first. The caller holds mu.
+func (r *MemoryRepository) deleteExpired(now time.Time, limit int) int64 {
+	var n int64
+	for int(n) < limit && len(r.expiry) > 0 && r.expiry[0].rec.ExpiresAt.Before(now) {
+		k := heap.Pop(&r.expiry).(*memoryKey)
+		delete(r.keys, k.rec.IdempotencyKey)
+		delete(r.payments, k.rec.PaymentID)
+		n++
+	}
+	return n
+}
+
+// keysInRange returns copies of the merchant's records first seen within
+// [from, to], with DistinctSources filled in. The caller holds mu.
+func (r *MemoryRepository) keysInRange(merchantID string, from, to time.Time) []domain.IdempotencyRecord {
+	var records []domain.IdempotencyRecord
+	for _, k := range r.keys {
+		if k.rec.MerchantID != merchantID || k.rec.FirstSeenAt.Before(from) || k.rec.FirstSeenAt.After(to) {
+			continue
+		}
+		rec := k.rec
+		rec.DistinctSources = len(k.sources)
+		records = append(records, rec)
+	}
+	return records
+}
+
+func (r *MemoryRepository) duplicatesInRange(merchantID string, from, to time.Time) []domain.IdempotencyRecord {
+	var records []domain.IdempotencyRecord
+	for _, rec := range r.keysInRange(merchantID, from, to) {
+		if rec.AttemptCount > 1 {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func (r *MemoryRepository) GetDuplicates(_ context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	r.mu.Lock()
+	records := r.duplicatesInRange(merchantID, from, to)
+	r.mu.Unlock()
+	records, total := pageDuplicates(records, page)
+	return records, total, nil
+}
+
+func (r *MemoryRepository) StreamDuplicates(_ context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	r.mu.Lock()
+	records := r.duplicatesInRange(merchantID, from, to)
+	r.mu.Unlock()
+	return streamDuplicates(records, fn)
+}
+
+func (r *MemoryRepository) GetAmountAtRisk(_ context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return amountAtRisk(r.duplicatesInRange(merchantID, from, to)), nil
+}
+
+func (r *MemoryRepository) GetMerchantStats(_ context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total, unique := merchantStats(r.keysInRange(merchantID, from, to))
+	return total, unique, nil
+}
+
+func (r *MemoryRepository) GetMerchantOutcomes(_ context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return merchantOutcomes(r.keysInRange(merchantID, from, to)), nil
+}
+
+func (r *MemoryRepository) GetDuplicateTrends(_ context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return duplicateTrends(r.keysInRange(merchantID, from, to), bucket), nil
+}
+
+func (r *MemoryRepository) GetPolicy(_ context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.policies[merchantID]
+	if !ok {
+		return nil, domain.ErrMerchantNotFound
+	}
+	p.TolerantFields = append([]string{}, p.TolerantFields...)
+	return &p, nil
+}
+
+// UpsertPolicy keeps the original created_at when replacing a policy.
+func (r *MemoryRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
+	return r.UpsertPolicies(ctx, []domain.MerchantPolicy{policy})
+}
+
+func (r *MemoryRepository) ListPolicies(_ context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	policies := make([]domain.MerchantPolicy, 0, len(r.policies))
+	for _, p := range r.policies {
+		p.TolerantFields = append([]string{}, p.TolerantFields...)
+		policies = append(policies, p)
+	}
+	policies, total := pagePolicies(policies, page)
+	return policies, total, nil
+}
+
+// UpsertPolicies replaces every policy under one lock, as UpsertPolicy does.
+func (r *MemoryRepository) UpsertPolicies(_ context.Context, policies []domain.MerchantPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, policy := range policies {
+		policy.CreatedAt, policy.UpdatedAt = now, now
+		if existing, ok := r.policies[policy.MerchantID]; ok {
+			policy.CreatedAt = existing.CreatedAt
+		}
+		policy.TolerantFields = append([]string{}, policy.TolerantFields...)
+		r.policies[policy.MerchantID] = policy
+	}
+	return nil
+}
+
+func (r *MemoryRepository) DeletePolicy(_ context.Context, merchantID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.policies[merchantID]; !ok {
+		return domain.ErrMerchantNotFound
+	}
+	delete(r.policies, merchantID)
+	return nil
+}
+
+func (r *MemoryRepository) GetAllMerchantStats(_ context.Context, from, to time.Time) (map[string][2]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string][2]int)
+	for _, k := range r.keys {
+		if k.rec.FirstSeenAt.Before(from) || k.rec.FirstSeenAt.After(to) {
+			continue
+		}
+		s := stats[k.rec.MerchantID]
+		s[0] += k.rec.AttemptCount
+		s[1]++
+		stats[k.rec.MerchantID] = s
+	}
+	return stats, nil
+}
+
+func (r *MemoryRepository) GetAmountStats(_ context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return amountStats(r.keysInRange(merchantID, from, to)), nil
+}
+
+func (r *MemoryRepository) SearchRecords(_ context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var records []domain.IdempotencyRecord
+	for _, k := range r.keys {
+		if filter.Matches(k.rec) {
+			records = append(records, k.rec)
+		}
+	}
+	records, total := pageSearch(records, filter, page)
+	return records, total, nil
+}
+
+func (r *MemoryRepository) GetAttempts(_ context.Context, key string) ([]domain.Attempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[key]
+	if !ok {
+		return nil, domain.ErrKeyNotFound
+	}
+	return append([]domain.Attempt{}, k.attempts...), nil
+}
+
+// expiryHeap orders keys by expires_at, soonest first.
+type expiryHeap []*memoryKey
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].rec.ExpiresAt.Before(h[j].rec.ExpiresAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	k := x.(*memoryKey)
+	k.index = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return k
+}
+
+var _ Repository = (*MemoryRepository)(nil)
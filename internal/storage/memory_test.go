@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func memoryRequest(key string) domain.PaymentRequest {
+	return domain.PaymentRequest{IdempotencyKey: key, MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD",
+		Source: domain.AttemptSource{IP: "10.0.0.1"}}
+}
+
+func TestMemoryRepository_Lifecycle(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	ctx := context.Background()
+	req := memoryRequest("k1")
+
+	rec, isNew, err := repo.InsertOrGet(ctx, req, "pay_a", time.Now().Add(time.Hour))
+	if err != nil || !isNew || rec.Version != 1 || rec.Status != domain.StatusProcessing {
+		t.Fatalf("insert: %+v %v %v", rec, isNew, err)
+	}
+	req.Source.IP = "10.0.0.2"
+	if rec, isNew, _ = repo.InsertOrGet(ctx, req, "pay_b", time.Now().Add(time.Hour)); isNew || rec.AttemptCount != 2 || rec.PaymentID != "pay_a" {
+		t.Fatalf("expected the existing record, got %+v", rec)
+	}
+	if _, _, err := repo.InsertOrGet(ctx, memoryRequest("k2"), "pay_a", time.Now().Add(time.Hour)); err != domain.ErrPaymentIDConflict {
+		t.Errorf("expected a payment ID conflict, got %v", err)
+	}
+
+	body := json.RawMessage(`{"ok":true}`)
+	headers := map[string]string{"Location": "/payments/1"}
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{Status: 402, Headers: headers, Body: &body}); err != nil {
+		t.Fatal(err)
+	}
+	body[2] = 'X'
+	headers["Location"] = "changed"
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{}); err != domain.ErrAlreadyCompleted {
+		t.Errorf("expected ErrAlreadyCompleted, got %v", err)
+	}
+	if err := repo.MarkComplete(ctx, "missing", domain.StatusFailed, domain.StoredResponse{}); err != domain.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if rec, _ := repo.GetByKey(ctx, "k1"); string(*rec.ResponseBody) != `{"ok":true}` || rec.ResponseHeaders["Location"] != "/payments/1" ||
+		rec.ResponseStatus != 402 || rec.CompletedAt == nil {
+		t.Errorf("expected the stored response to be a copy, got %+v", rec)
+	}
+
+	if err := repo.ResetToProcessing(ctx, "k1", 1, "pay_c", time.Now().Add(time.Hour)); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected a stale version to lose, got %v", err)
+	}
+	before, _ := repo.GetByKey(ctx, "k1")
+	if err := repo.ResetToProcessing(ctx, "k1", 2, "pay_c", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := repo.GetByKey(ctx, "k1"); !rec.ProcessingSince.After(before.ProcessingSince) {
+		t.Errorf("expected a reset to restart processing_since, got %s", rec.ProcessingSince)
+	}
+	if _, err := repo.GetByPaymentID(ctx, "pay_a"); err != domain.ErrPaymentNotFound {
+		t.Errorf("expected the old payment ID to stop resolving, got %v", err)
+	}
+	if rec, err := repo.GetByPaymentID(ctx, "pay_c"); err != nil || rec.Status != domain.StatusProcessing || rec.Version != 3 || rec.CompletedAt != nil {
+		t.Errorf("unexpected record after reset: %+v %v", rec, err)
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now()
+	dups, total, _ := repo.GetDuplicates(ctx, "m1", from, to, domain.Page{Limit: 10})
+	if len(dups) != 1 || total != 1 || dups[0].DistinctSources != 2 {
+		t.Errorf("unexpected duplicates: %+v %d", dups, total)
+	}
+	if atRisk, _ := repo.GetAmountAtRisk(ctx, "m1", from, to); atRisk["USD"] != 1000 {
+		t.Errorf("unexpected amount at risk: %v", atRisk)
+	}
+	if total, unique, _ := repo.GetMerchantStats(ctx, "m1", from, to); total != 2 || unique != 1 {
+		t.Errorf("unexpected stats: %d %d", total, unique)
+	}
+	if o, err := repo.GetMerchantOutcomes(ctx, "m1", from, to); err != nil || o.RetriedKeys != 1 || o.Processing != 1 || o.AvgCompletionMs != nil {
+		t.Errorf("unexpected outcomes: %+v %v", o, err)
+	}
+	if trends, _ := repo.GetDuplicateTrends(ctx, "m1", from, to, time.Minute); len(trends) != 1 || trends[0].TotalRequests != 2 || trends[0].UniquePayments != 1 || trends[0].Start.Second() != 0 {
+		t.Errorf("unexpected trends: %+v", trends)
+	}
+	if all, _ := repo.GetAllMerchantStats(ctx, from, to); all["m1"] != [2]int{2, 1} {
+		t.Errorf("unexpected merchant stats: %v", all)
+	}
+}
+
+func TestMemoryRepository_ExpiryAndBound(t *testing.T) {
+	repo := NewMemoryRepository(2)
+	ctx := context.Background()
+	now := time.Now()
+
+	repo.InsertOrGet(ctx, memoryRequest("old"), "pay_1", now.Add(-time.Minute))
+	repo.InsertOrGet(ctx, memoryRequest("live"), "pay_2", now.Add(time.Hour))
+	if _, isNew, err := repo.InsertOrGet(ctx, memoryRequest("new"), "pay_3", now.Add(time.Hour)); err != nil || !isNew {
+		t.Fatalf("expected the expired key to make room, got %v", err)
+	}
+	if _, err := repo.GetByPaymentID(ctx, "pay_1"); err != domain.ErrPaymentNotFound {
+		t.Errorf("expected the expired key dropped, got %v", err)
+	}
+	if _, _, err := repo.InsertOrGet(ctx, memoryRequest("more"), "pay_4", now.Add(time.Hour)); !errors.Is(err, domain.ErrUnavailable) {
+		t.Errorf("expected a full store to refuse new keys, got %v", err)
+	}
+	if _, isNew, err := repo.InsertOrGet(ctx, memoryRequest("live"), "pay_5", now.Add(time.Hour)); err != nil || isNew {
+		t.Errorf("expected retries of stored keys to succeed when full, got %v", err)
+	}
+
+	// A reset moves the key in the expiry order.
+	if err := repo.ResetToProcessing(ctx, "live", 1, "pay_6", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := repo.DeleteExpired(ctx, 10); n != 1 {
+		t.Errorf("expected one expired key, got %d", n)
+	}
+	if _, err := repo.GetByKey(ctx, "live"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected the reset key swept, got %v", err)
+	}
+}
+
+func TestMemoryRepository_ConcurrentInsertCreatesOnce(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	var wg sync.WaitGroup
+	created := make(chan bool, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, isNew, err := repo.InsertOrGet(context.Background(), memoryRequest("race"), "pay_"+string(rune('a'+i)), time.Now().Add(time.Hour))
+			if err == nil {
+				created <- isNew
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(created)
+	n := 0
+	for isNew := range created {
+		if isNew {
+			n++
+		}
+	}
+	if rec, _ := repo.GetByKey(context.Background(), "race"); n != 1 || rec.AttemptCount != 50 {
+		t.Errorf("expected one insert and 50 attempts, got %d inserts and %+v", n, rec)
+	}
+}
+
+func TestMemoryRepository_Policies(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	ctx := context.Background()
+	if _, err := repo.GetPolicy(ctx, "m1"); err != domain.ErrMerchantNotFound {
+		t.Errorf("expected ErrMerchantNotFound, got %v", err)
+	}
+	repo.UpsertPolicy(ctx, domain.MerchantPolicy{MerchantID: "m1", RetryPolicy: "standard", ExpiryHours: 24})
+	first, _ := repo.GetPolicy(ctx, "m1")
+	repo.UpsertPolicy(ctx, domain.MerchantPolicy{MerchantID: "m1", RetryPolicy: "lenient", ExpiryHours: 48})
+	p, _ := repo.GetPolicy(ctx, "m1")
+	if p.RetryPolicy != "lenient" || !p.CreatedAt.Equal(first.CreatedAt) || p.TolerantFields == nil {
+		t.Errorf("unexpected policy after update: %+v", p)
+	}
+}
+
+func TestMemoryRepository_SearchRecords(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	ctx := context.Background()
+	for _, key := range []string{"pos-1", "pos-2", "web-1"} {
+		repo.InsertOrGet(ctx, memoryRequest(key), "pay_"+key, time.Now().Add(time.Hour))
+	}
+	repo.MarkComplete(ctx, "pos-2", domain.StatusFailed, domain.StoredResponse{})
+
+	records, total, err := repo.SearchRecords(ctx, domain.RecordFilter{KeyPrefix: "pos-"}, domain.Page{Limit: 1})
+	if err != nil || total != 2 || len(records) != 1 || records[0].IdempotencyKey != "pos-2" {
+		t.Errorf("expected the newest pos- key of 2, got %+v %d %v", records, total, err)
+	}
+	records, total, _ = repo.SearchRecords(ctx, domain.RecordFilter{Status: domain.StatusProcessing}, domain.Page{Limit: 10, Offset: 5})
+	if len(records) != 0 || total != 2 {
+		t.Errorf("expected an empty page past the end with the total, got %+v %d", records, total)
+	}
+}
+
+func TestMemoryRepository_ExpireAndResetKey(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	ctx := context.Background()
+	repo.InsertOrGet(ctx, memoryRequest("stuck"), "pay_1", time.Now().Add(time.Hour))
+
+	if err := repo.ExpireKey(ctx, "stuck"); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := repo.GetByKey(ctx, "stuck")
+	if !rec.IsExpired() || rec.Version != 2 {
+		t.Errorf("expected the key expired at version 2, got %+v", rec)
+	}
+	if n, _ := repo.DeleteExpired(ctx, 10); n != 1 {
+		t.Errorf("expected the expired key swept, got %d", n)
+	}
+
+	rec, _, _ = repo.InsertOrGet(ctx, memoryRequest("stuck"), "pay_2", time.Now().Add(time.Hour))
+	if err := repo.ResetKey(ctx, "stuck", rec.Version+1); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate at a stale version, got %v", err)
+	}
+	if err := repo.ResetKey(ctx, "stuck", rec.Version); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = repo.GetByKey(ctx, "stuck")
+	if rec.Status != domain.StatusFailed || !rec.IsExpired() || rec.CompletedAt == nil {
+		t.Errorf("expected the key failed and expired in place, got %+v", rec)
+	}
+	if err := repo.ExpireKey(ctx, "missing"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := repo.ResetKey(ctx, "missing", 1); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate, got %v", err)
+	}
+}
+
+func TestMemoryRepository_UpdateParams(t *testing.T) {
+	repo := NewMemoryRepository(0)
+	ctx := context.Background()
+	repo.InsertOrGet(ctx, memoryRequest("k1"), "pay_1", time.Now().Add(time.Hour))
+
+	latest := memoryRequest("k1")
+	latest.CustomerID, latest.Amount = "c2", 2500
+	if err := repo.UpdateParams(ctx, "k1", 1, latest); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := repo.GetByKey(ctx, "k1")
+	if rec.CustomerID != "c2" || rec.Amount != 2500 || rec.RequestHash != latest.Hash() || rec.Version != 2 {
+		t.Errorf("expected the latest params at version 2, got %+v", rec)
+	}
+	if err := repo.UpdateParams(ctx, "k1", 1, memoryRequest("k1")); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate for a stale version, got %v", err)
+	}
+}
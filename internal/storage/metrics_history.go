@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// SaveMetricsSample appends a metrics sample for this environment.
+func (r *PostgresRepository) SaveMetricsSample(ctx context.Context, s domain.MetricsSample) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO metrics_history (environment, instance, recorded_at, period_start, total_requests, new_payments,
+			duplicate_blocked, retry_allowed, cached_responses, param_mismatches, slow_queries,
+			window_duplicate_rate, latency_p95_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`, r.env, s.Instance, s.RecordedAt, s.PeriodStart, s.TotalRequests, s.NewPayments,
+		s.DuplicateBlocked, s.RetryAllowed, s.CachedResponses, s.ParamMismatches, s.SlowQueries,
+		s.WindowDuplicateRate, s.LatencyP95Ms)
+	return wrap(ctx, "save metrics sample", err)
+}
+
+// ListMetricsSamples returns up to limit samples recorded in [from, to],
+// oldest first, optionally for one instance.
+func (r *PostgresRepository) ListMetricsSamples(ctx context.Context, from, to time.Time, instance string, limit int) ([]domain.MetricsSample, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT instance, recorded_at, period_start, total_requests, new_payments, duplicate_blocked,
+			retry_allowed, cached_responses, param_mismatches, slow_queries, window_duplicate_rate, latency_p95_ms
+		FROM metrics_history
+		WHERE environment = $1 AND recorded_at >= $2 AND recorded_at <= $3 AND ($4::text = '' OR instance = $4)
+		ORDER BY recorded_at
+		LIMIT $5
+	`, r.env, from, to, instance, limit)
+	if err != nil {
+		return nil, wrap(ctx, "list metrics samples", err)
+	}
+	defer rows.Close()
+
+	samples := []domain.MetricsSample{}
+	for rows.Next() {
+		var s domain.MetricsSample
+		if err := rows.Scan(&s.Instance, &s.RecordedAt, &s.PeriodStart, &s.TotalRequests, &s.NewPayments,
+			&s.DuplicateBlocked, &s.RetryAllowed, &s.CachedResponses, &s.ParamMismatches, &s.SlowQueries,
+			&s.WindowDuplicateRate, &s.LatencyP95Ms); err != nil {
+			return nil, wrap(ctx, "scan metrics sample", err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// DeleteMetricsSamples removes samples recorded before the given time.
+func (r *PostgresRepository) DeleteMetricsSamples(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `DELETE FROM metrics_history WHERE environment = $1 AND recorded_at < $2`, r.env, before)
+	if err != nil {
+		return 0, wrap(ctx, "delete metrics samples", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// policyColumns are the merchant_policies columns scanPolicy reads.
+const policyColumns = `merchant_id, retry_policy, expiry_hours, response_schema, duplicate_status_code, tolerant_fields, base_currency,
+	fraud_export, payment_id_format, duplicate_alert_threshold, duplicate_alert_url, rate_limit_rps, rate_limit_burst,
+	max_expiry_hours, signing_secret, hash_metadata, storm_threshold, mismatch_behavior, created_at, updated_at`
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// scanPolicy scans policyColumns, then any extra columns into extra.
+func scanPolicy(row rowScanner, extra ...interface{}) (*domain.MerchantPolicy, error) {
+	var p domain.MerchantPolicy
+	var responseSchema, baseCurrency, paymentIDFormat, alertURL, signingSecret, mismatchBehavior sql.NullString
+	var alertThreshold, rateLimitBurst, maxExpiryHours, stormThreshold sql.NullInt64
+	var rateLimitRPS sql.NullFloat64
+	dest := append([]interface{}{
+		&p.MerchantID, &p.RetryPolicy, &p.ExpiryHours, &responseSchema, &p.DuplicateStatusCode,
+		pq.Array(&p.TolerantFields), &baseCurrency, &p.FraudExport, &paymentIDFormat, &alertThreshold, &alertURL,
+		&rateLimitRPS, &rateLimitBurst, &maxExpiryHours, &signingSecret, &p.HashMetadata, &stormThreshold, &mismatchBehavior, &p.CreatedAt, &p.UpdatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if responseSchema.Valid {
+		raw := json.RawMessage(responseSchema.String)
+		p.ResponseSchema = &raw
+	}
+	p.BaseCurrency = baseCurrency.String
+	p.PaymentIDFormat = paymentIDFormat.String
+	p.DuplicateAlertThreshold = int(alertThreshold.Int64)
+	p.DuplicateAlertURL = alertURL.String
+	p.RateLimitRPS = rateLimitRPS.Float64
+	p.RateLimitBurst = int(rateLimitBurst.Int64)
+	p.MaxExpiryHours = int(maxExpiryHours.Int64)
+	p.SigningSecret = signingSecret.String
+	p.StormThreshold = int(stormThreshold.Int64)
+	p.MismatchBehavior = mismatchBehavior.String
+	return &p, nil
+}
+
+// upsertPolicy creates or replaces policy, keeping its created_at.
+func upsertPolicy(ctx context.Context, db execer, policy domain.MerchantPolicy) error {
+	tolerant := policy.TolerantFields
+	if tolerant == nil {
+		tolerant = []string{}
+	}
+	var responseSchema interface{}
+	if policy.ResponseSchema != nil {
+		responseSchema = []byte(*policy.ResponseSchema)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO merchant_policies (merchant_id, retry_policy, expiry_hours, response_schema, duplicate_status_code, tolerant_fields, base_currency,
+			fraud_export, payment_id_format, duplicate_alert_threshold, duplicate_alert_url, rate_limit_rps, rate_limit_burst, max_expiry_hours, signing_secret,
+			hash_metadata, storm_threshold, mismatch_behavior, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, NULLIF($9, ''), NULLIF($10, 0), NULLIF($11, ''), NULLIF($12::float8, 0), NULLIF($13, 0), NULLIF($14, 0), NULLIF($15, ''), $16, NULLIF($17, 0), NULLIF($18, ''), NOW(), NOW())
+		ON CONFLICT (merchant_id) DO UPDATE SET
+			retry_policy = $2, expiry_hours = $3, response_schema = $4, duplicate_status_code = $5, tolerant_fields = $6,
+			base_currency = NULLIF($7, ''), fraud_export = $8, payment_id_format = NULLIF($9, ''),
+			duplicate_alert_threshold = NULLIF($10, 0), duplicate_alert_url = NULLIF($11, ''),
+			rate_limit_rps = NULLIF($12::float8, 0), rate_limit_burst = NULLIF($13, 0), max_expiry_hours = NULLIF($14, 0),
+			signing_secret = NULLIF($15, ''), hash_metadata = $16, storm_threshold = NULLIF($17, 0), mismatch_behavior = NULLIF($18, ''),
+			updated_at = NOW()
+	`, policy.MerchantID, policy.RetryPolicy, policy.ExpiryHours, responseSchema, policy.DuplicateStatusCode, pq.Array(tolerant),
+		policy.BaseCurrency, policy.FraudExport, policy.PaymentIDFormat, policy.DuplicateAlertThreshold, policy.DuplicateAlertURL,
+		policy.RateLimitRPS, policy.RateLimitBurst, policy.MaxExpiryHours, policy.SigningSecret, policy.HashMetadata, policy.StormThreshold, policy.MismatchBehavior)
+	return err
+}
+
+// ListPolicies orders by merchant_id. The total comes from a window count;
+// a page past the end counts separately.
+func (r *PostgresRepository) ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	query := `SELECT ` + policyColumns + `, COUNT(*) OVER () FROM merchant_policies ORDER BY merchant_id`
+	var args []interface{}
+	if page.Limit > 0 {
+		query += ` LIMIT $1 OFFSET $2`
+		args = append(args, page.Limit, page.Offset)
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, wrap(ctx, "list policies", err)
+	}
+	defer rows.Close()
+
+	var policies []domain.MerchantPolicy
+	total := 0
+	for rows.Next() {
+		p, err := scanPolicy(rows, &total)
+		if err != nil {
+			return nil, 0, wrap(ctx, "list policies", err)
+		}
+		policies = append(policies, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, wrap(ctx, "list policies", err)
+	}
+	if len(policies) == 0 && page.Offset > 0 {
+		if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM merchant_policies`).Scan(&total); err != nil {
+			return nil, 0, wrap(ctx, "count policies", err)
+		}
+	}
+	return policies, total, nil
+}
+
+// UpsertPolicies writes every policy in one transaction.
+func (r *PostgresRepository) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrap(ctx, "upsert policies", err)
+	}
+	defer tx.Rollback()
+	for _, policy := range policies {
+		if err := upsertPolicy(ctx, tx, policy); err != nil {
+			return wrap(ctx, "upsert policies", err)
+		}
+	}
+	return wrap(ctx, "upsert policies", tx.Commit())
+}
+
+func (r *PostgresRepository) DeletePolicy(ctx context.Context, merchantID string) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `DELETE FROM merchant_policies WHERE merchant_id = $1`, merchantID)
+	if err != nil {
+		return wrap(ctx, "delete policy", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrMerchantNotFound
+	}
+	return nil
+}
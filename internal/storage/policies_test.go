@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestBulkPolicies(t *testing.T) {
+	backends := map[string]func(*testing.T) Repository{
+		"memory": func(*testing.T) Repository { return NewMemoryRepository(0) },
+		"sqlite": func(t *testing.T) Repository { return newTestSQLite(t) },
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			repo := open(t)
+			ctx := context.Background()
+			if err := repo.UpsertPolicy(ctx, domain.MerchantPolicy{MerchantID: "m-b", RetryPolicy: "standard", ExpiryHours: 24, SigningSecret: "s3cret"}); err != nil {
+				t.Fatal(err)
+			}
+			err := repo.UpsertPolicies(ctx, []domain.MerchantPolicy{
+				{MerchantID: "m-c", RetryPolicy: "lenient", ExpiryHours: 48, TolerantFields: []string{"currency"}},
+				{MerchantID: "m-a", RetryPolicy: "standard", ExpiryHours: 24},
+				{MerchantID: "m-b", RetryPolicy: "strict_no_retry", ExpiryHours: 72, SigningSecret: "s3cret"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			policies, total, err := repo.ListPolicies(ctx, domain.Page{Limit: 2})
+			if err != nil || total != 3 || len(policies) != 2 {
+				t.Fatalf("expected 2 of 3 policies, got %d of %d: %v", len(policies), total, err)
+			}
+			if policies[0].MerchantID != "m-a" || policies[1].MerchantID != "m-b" {
+				t.Errorf("expected policies by merchant_id, got %s, %s", policies[0].MerchantID, policies[1].MerchantID)
+			}
+			if policies[1].RetryPolicy != "strict_no_retry" || policies[1].SigningSecret != "s3cret" {
+				t.Errorf("expected the bulk update to replace m-b, got %+v", policies[1])
+			}
+			rest, total, _ := repo.ListPolicies(ctx, domain.Page{Limit: 2, Offset: 2})
+			if total != 3 || len(rest) != 1 || rest[0].MerchantID != "m-c" || len(rest[0].TolerantFields) != 1 {
+				t.Errorf("unexpected last page: %+v (total %d)", rest, total)
+			}
+			if past, total, _ := repo.ListPolicies(ctx, domain.Page{Limit: 2, Offset: 10}); len(past) != 0 || total != 3 {
+				t.Errorf("expected an empty page past the end with the total, got %d of %d", len(past), total)
+			}
+
+			if err := repo.DeletePolicy(ctx, "m-a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.GetPolicy(ctx, "m-a"); !errors.Is(err, domain.ErrMerchantNotFound) {
+				t.Errorf("expected the policy gone, got %v", err)
+			}
+			if err := repo.DeletePolicy(ctx, "m-a"); !errors.Is(err, domain.ErrMerchantNotFound) {
+				t.Errorf("expected ErrMerchantNotFound deleting twice, got %v", err)
+			}
+		})
+	}
+}
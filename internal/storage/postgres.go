@@ -1,13 +1,23 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	_ "github.com/lib/pq"
 )
 
+// SchemaVersion is the latest migration version this binary expects to be applied.
+const SchemaVersion = 32
+
+const migrationsDir = "migrations"
+
 // NewPostgresDB creates a connection pool and runs the migration.
 func NewPostgresDB(dsn string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", dsn)
@@ -27,11 +37,125 @@ func NewPostgresDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// OpenReplica connects to a read replica. Migrations are not run against replicas.
+func OpenReplica(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open replica: %w", err)
+	}
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(10)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping replica: %w", err)
+	}
+	return db, nil
+}
+
+// migrationLockKey serializes migration runs across replicas booting together.
+const migrationLockKey = 0x69646d70 // "idmp"
+
+// runMigrations applies every migrations/NNN_*.sql file not yet recorded in
+// schema_migrations, in version order, inside a single transaction.
 func runMigrations(db *sql.DB) error {
-	migration, err := os.ReadFile("migrations/001_init.sql")
+	files, err := migrationFiles(migrationsDir)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("migration lock: %w", err)
+	}
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	for _, f := range files {
+		var applied bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)", f.version).Scan(&applied); err != nil {
+			return fmt.Errorf("check migration %d: %w", f.version, err)
+		}
+		if applied {
+			continue
+		}
+		migration, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("read migration file: %w", err)
+		}
+		if _, err := tx.Exec(string(migration)); err != nil {
+			return fmt.Errorf("apply migration %d: %w", f.version, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", f.version); err != nil {
+			return fmt.Errorf("record migration %d: %w", f.version, err)
+		}
+	}
+	return tx.Commit()
+}
+
+type migrationFile struct {
+	version int
+	path    string
+}
+
+// migrationFiles lists NNN_name.sql files in dir sorted by version.
+func migrationFiles(dir string) ([]migrationFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no migration files found in %s", dir)
+	}
+
+	files := make([]migrationFile, 0, len(paths))
+	for _, p := range paths {
+		prefix, _, ok := strings.Cut(filepath.Base(p), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must be NNN_description.sql", p)
+		}
+		v, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version prefix", p)
+		}
+		files = append(files, migrationFile{version: v, path: p})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].version < files[j].version })
+	return files, nil
+}
+
+// Schema reports migration state for readiness checks.
+type Schema struct {
+	db *sql.DB
+}
+
+// NewSchema creates a new Schema.
+func NewSchema(db *sql.DB) *Schema {
+	return &Schema{db: db}
+}
+
+// ExpectedVersion returns the schema version this binary was built for.
+func (s *Schema) ExpectedVersion() int {
+	return SchemaVersion
+}
+
+// AppliedVersion returns the highest applied migration version, or 0 if none.
+func (s *Schema) AppliedVersion(ctx context.Context) (int, error) {
+	var v int
+	err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v)
 	if err != nil {
-		return fmt.Errorf("read migration file: %w", err)
+		return 0, fmt.Errorf("applied schema version: %w", err)
 	}
-	_, err = db.Exec(string(migration))
-	return err
+	return v, nil
 }
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationFiles_SortedByVersion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"010_later.sql", "002_second.sql", "001_init.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("SELECT 1;"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := migrationFiles(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []int{1, 2, 10}
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(files))
+	}
+	for i, v := range want {
+		if files[i].version != v {
+			t.Errorf("position %d: expected version %d, got %d", i, v, files[i].version)
+		}
+	}
+}
+
+func TestMigrationFiles_InvalidName(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "init.sql"), []byte("SELECT 1;"), 0o644)
+
+	if _, err := migrationFiles(dir); err == nil {
+		t.Error("expected error for migration without version prefix")
+	}
+}
+
+func TestMigrationFiles_Empty(t *testing.T) {
+	if _, err := migrationFiles(t.TempDir()); err == nil {
+		t.Error("expected error for empty migrations directory")
+	}
+}
+
+func TestSchemaVersion_MatchesMigrations(t *testing.T) {
+	files, err := migrationFiles(filepath.Join("..", "..", migrationsDir))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if latest := files[len(files)-1].version; latest != SchemaVersion {
+		t.Errorf("SchemaVersion is %d but latest migration is %d", SchemaVersion, latest)
+	}
+}
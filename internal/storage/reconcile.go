@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// ListStuckProcessing returns unexpired payments still processing whose last
+// attempt is older than before, oldest first.
+func (r *PostgresRepository) ListStuckProcessing(ctx context.Context, before time.Time, limit int) ([]domain.IdempotencyRecord, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT idempotency_key, merchant_id, customer_id, amount, currency, payment_id, attempt_count, first_seen_at, last_seen_at, expires_at
+		FROM idempotency_keys
+		WHERE environment = $3 AND status = 'processing' AND last_seen_at < $1 AND expires_at > NOW()
+		ORDER BY last_seen_at
+		LIMIT $2
+	`, before, limit, r.env)
+	if err != nil {
+		return nil, wrap(ctx, "list stuck processing", err)
+	}
+	defer rows.Close()
+
+	var records []domain.IdempotencyRecord
+	for rows.Next() {
+		rec := domain.IdempotencyRecord{Status: domain.StatusProcessing}
+		if err := rows.Scan(
+			&rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID, &rec.Amount, &rec.Currency,
+			&rec.PaymentID, &rec.AttemptCount, &rec.FirstSeenAt, &rec.LastSeenAt, &rec.ExpiresAt,
+		); err != nil {
+			return nil, wrap(ctx, "scan stuck processing", err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 5 * time.Second
+)
+
+// RedisError is an error reply from the server. The connection stays usable.
+type RedisError string
+
+func (e RedisError) Error() string { return "redis: " + string(e) }
+
+// RedisClient is a minimal RESP2 client with a small connection pool, enough
+// for the commands and scripts RedisRepository runs.
+type RedisClient struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisClient creates a client for a redis://[:password@]host:port[/db]
+// URL (rediss:// for TLS), keeping up to poolSize idle connections.
+// Connections are dialed lazily.
+func NewRedisClient(rawURL string, poolSize int) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("redis url must be redis://host:port[/db] or rediss://")
+	}
+	c := &RedisClient{addr: u.Host, tls: u.Scheme == "rediss", pool: make(chan *redisConn, poolSize)}
+	if !strings.Contains(u.Host, ":") {
+		c.addr = u.Host + ":6379"
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis url: invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do sends one command and returns its reply: string, int64, nil,
+// []interface{} or, for error replies, a RedisError.
+func (c *RedisClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(redisIOTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.do(args...)
+	var rerr RedisError
+	if err != nil && !errors.As(err, &rerr) {
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// Ping checks connectivity.
+func (c *RedisClient) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisIOTimeout)
+	defer cancel()
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Close closes the idle connections.
+func (c *RedisClient) Close() error {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *RedisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+	d := net.Dialer{Timeout: redisDialTimeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		nc, err = (&tls.Dialer{NetDialer: &d}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(redisIOTimeout))
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", c.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *RedisClient) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (conn *redisConn) do(args ...interface{}) (interface{}, error) {
+	if _, err := conn.Write(encodeCommand(args...)); err != nil {
+		return nil, err
+	}
+	return readReply(conn.r)
+}
+
+// encodeCommand encodes args as a RESP array of bulk strings.
+func encodeCommand(args ...interface{}) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		var s string
+		switch v := a.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			s = fmt.Sprint(v)
+		}
+		buf = append(buf, "$"+strconv.Itoa(len(s))+"\r\n"+s+"\r\n"...)
+	}
+	return buf
+}
+
+// readReply reads one RESP2 reply.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			// Error replies nested in an array (from scripts) become values.
+			if out[i], err = readReply(r); err != nil {
+				var rerr RedisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				out[i] = rerr
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
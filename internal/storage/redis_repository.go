@@ -0,0 +1,757 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// RedisRepository implements Repository on Redis. Each key is a hash; the
+// writes InsertOrGet, MarkComplete and ResetToProcessing make are Lua scripts,
+// so Redis runs each atomically. Keys are laid out under shield:{<env>}:
+//
+//	key:<idempotency key>      hash with the record's fields
+//	pid:<payment id>           idempotency key, claimed with SET NX
+//	sources:<idempotency key>  set of source IPs
+//	attempts:<idempotency key> list of the latest attempts as JSON, oldest first
+//	merchant:<merchant id>     zset of idempotency keys by first_seen_at (ms)
+//	merchants                  set of merchant IDs
+//	expiry                     zset of idempotency keys by expires_at (ms)
+//	seq                        record ID counter
+//
+// The {<env>} hash tag keeps an environment's keys in one cluster slot so the
+// scripts can touch all of them. Policies are shared by both environments and
+// live at shield:policy:<merchant id> as JSON. Reports read a merchant's keys
+// in range and aggregate in Go.
+type RedisRepository struct {
+	client *RedisClient
+	prefix string
+}
+
+// NewRedisRepository creates a new RedisRepository.
+func NewRedisRepository(client *RedisClient) *RedisRepository {
+	return (&RedisRepository{client: client}).WithEnvironment(domain.EnvironmentProduction)
+}
+
+// WithEnvironment scopes every key and report to env.
+func (r *RedisRepository) WithEnvironment(env string) *RedisRepository {
+	r.prefix = "shield:{" + env + "}:"
+	return r
+}
+
+// insertOrGetScript inserts a processing record, or counts another attempt
+// on an existing one, and appends the attempt to its history with the
+// outcome domain.AttemptOutcome would give. It returns {1, fields} for a
+// new record, {0, fields} for an existing one and {-1} when the payment ID
+// is already taken.
+const insertOrGetScript = `
+local rec, pid, sources = KEYS[1], KEYS[2], KEYS[3]
+local now, ip = ARGV[8], ARGV[12]
+local function attempt(outcome)
+	redis.call('RPUSH', KEYS[8], cjson.encode({at = now, hash = ARGV[6], ip = ip, ua = ARGV[14], rid = ARGV[15], outcome = outcome}))
+	redis.call('LTRIM', KEYS[8], -tonumber(ARGV[16]), -1)
+end
+if redis.call('EXISTS', rec) == 1 then
+	redis.call('HINCRBY', rec, 'attempt_count', 1)
+	redis.call('HSET', rec, 'last_seen_at', now)
+	if ip ~= '' then redis.call('SADD', sources, ip) end
+	local outcome = 'duplicate'
+	local body = redis.call('HGET', rec, 'body_hash')
+	if redis.call('HGET', rec, 'request_hash') ~= ARGV[6] or (body and ARGV[13] ~= '' and body ~= ARGV[13]) then
+		outcome = 'mismatch'
+	end
+	attempt(outcome)
+	return {0, redis.call('HGETALL', rec)}
+end
+if not redis.call('SET', pid, ARGV[1], 'NX') then
+	return {-1}
+end
+local id = redis.call('INCR', KEYS[7])
+redis.call('HSET', rec, 'id', id, 'idempotency_key', ARGV[1], 'merchant_id', ARGV[2], 'customer_id', ARGV[3],
+	'amount', ARGV[4], 'currency', ARGV[5], 'status', 'processing', 'request_hash', ARGV[6], 'payment_id', ARGV[7],
+	'attempt_count', 1, 'version', 1, 'first_seen_at', now, 'last_seen_at', now, 'processing_since', now, 'expires_at', ARGV[9])
+redis.call('ZADD', KEYS[4], ARGV[10], ARGV[1])
+redis.call('SADD', KEYS[5], ARGV[2])
+redis.call('ZADD', KEYS[6], ARGV[11], ARGV[1])
+if ARGV[13] ~= '' then redis.call('HSET', rec, 'body_hash', ARGV[13]) end
+if ARGV[17] ~= '' then redis.call('HSET', rec, 'metadata', ARGV[17]) end
+if ip ~= '' then redis.call('SADD', sources, ip) end
+attempt('new')
+return {1, redis.call('HGETALL', rec)}
+`
+
+// markCompleteScript returns 1 when the record moved out of processing, 0
+// when it does not exist and -1 when it already completed. An empty
+// ARGV[5] or ARGV[6] clears the response status or headers.
+const markCompleteScript = `
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status then return 0 end
+if status ~= 'processing' then return -1 end
+redis.call('HSET', KEYS[1], 'status', ARGV[1], 'completed_at', ARGV[4])
+if ARGV[3] == '1' then
+	redis.call('HSET', KEYS[1], 'response_body', ARGV[2])
+else
+	redis.call('HDEL', KEYS[1], 'response_body')
+end
+for i, field in ipairs({'response_status', 'response_headers'}) do
+	if ARGV[4 + i] ~= '' then
+		redis.call('HSET', KEYS[1], field, ARGV[4 + i])
+	else
+		redis.call('HDEL', KEYS[1], field)
+	end
+end
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1
+`
+
+// resetScript compares and swaps on version like the Postgres UPDATE. It
+// returns 1 on success, 0 when the version moved on and -1 when the new
+// payment ID is taken. The old payment ID stops resolving.
+const resetScript = `
+if redis.call('HGET', KEYS[1], 'version') ~= ARGV[1] then return 0 end
+if not redis.call('SET', KEYS[2], ARGV[5], 'NX') then return -1 end
+local old = redis.call('HGET', KEYS[1], 'payment_id')
+if old then redis.call('DEL', ARGV[6] .. 'pid:' .. old) end
+redis.call('HSET', KEYS[1], 'status', 'processing', 'payment_id', ARGV[2], 'expires_at', ARGV[3], 'last_seen_at', ARGV[4], 'processing_since', ARGV[4])
+redis.call('HDEL', KEYS[1], 'completed_at')
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+redis.call('ZADD', KEYS[3], ARGV[7], ARGV[5])
+return 1
+`
+
+// deleteExpiredScript removes up to ARGV[3] keys expired by ARGV[1] (ms)
+// with everything that points at them, returning how many it removed.
+const deleteExpiredScript = `
+local keys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, k in ipairs(keys) do
+	local rec = ARGV[2] .. 'key:' .. k
+	local f = redis.call('HMGET', rec, 'payment_id', 'merchant_id')
+	if f[1] then redis.call('DEL', ARGV[2] .. 'pid:' .. f[1]) end
+	if f[2] then redis.call('ZREM', ARGV[2] .. 'merchant:' .. f[2], k) end
+	redis.call('DEL', rec, ARGV[2] .. 'sources:' .. k, ARGV[2] .. 'attempts:' .. k)
+	redis.call('ZREM', KEYS[1], k)
+end
+return #keys
+`
+
+// updateParamsScript compares and swaps on version like resetScript,
+// replacing the record's parameters with ARGV[2..8] (customer_id, amount,
+// currency, request_hash, body_hash, metadata, last_seen_at). Empty hashes
+// and metadata are removed. It returns 0 when the version moved on.
+const updateParamsScript = `
+if redis.call('HGET', KEYS[1], 'version') ~= ARGV[1] then return 0 end
+redis.call('HSET', KEYS[1], 'customer_id', ARGV[2], 'amount', ARGV[3], 'currency', ARGV[4], 'request_hash', ARGV[5], 'last_seen_at', ARGV[8])
+if ARGV[6] ~= '' then redis.call('HSET', KEYS[1], 'body_hash', ARGV[6]) else redis.call('HDEL', KEYS[1], 'body_hash') end
+if ARGV[7] ~= '' then redis.call('HSET', KEYS[1], 'metadata', ARGV[7]) else redis.call('HDEL', KEYS[1], 'metadata') end
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1
+`
+
+// expireKeyScript moves KEYS[1]'s expiry back to ARGV[1] (ns), ARGV[2] (ms)
+// in the expiry zset, unless it is earlier, and bumps its version. It returns
+// 0 when the record does not exist.
+const expireKeyScript = `
+local expires = redis.call('HGET', KEYS[1], 'expires_at')
+if not expires then return 0 end
+if tonumber(expires) > tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'expires_at', ARGV[1])
+	redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+end
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1
+`
+
+// resetKeyScript compares and swaps on version like resetScript, then fails
+// KEYS[1] and expires it as expireKeyScript does. It returns 1 on success and
+// 0 when the version moved on.
+const resetKeyScript = `
+if redis.call('HGET', KEYS[1], 'version') ~= ARGV[1] then return 0 end
+redis.call('HSET', KEYS[1], 'status', 'failed')
+if not redis.call('HGET', KEYS[1], 'completed_at') then
+	redis.call('HSET', KEYS[1], 'completed_at', ARGV[2])
+end
+if tonumber(redis.call('HGET', KEYS[1], 'expires_at')) > tonumber(ARGV[2]) then
+	redis.call('HSET', KEYS[1], 'expires_at', ARGV[2])
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[4])
+end
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1
+`
+
+// rangeScript returns {fields, distinct sources, ...} for a merchant's keys
+// first seen between ARGV[1] and ARGV[2] (ms).
+const rangeScript = `
+local out = {}
+for _, k in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2])) do
+	local fields = redis.call('HGETALL', ARGV[3] .. 'key:' .. k)
+	if #fields > 0 then
+		table.insert(out, fields)
+		table.insert(out, redis.call('SCARD', ARGV[3] .. 'sources:' .. k))
+	end
+end
+return out
+`
+
+func (r *RedisRepository) recordKey(key string) string   { return r.prefix + "key:" + key }
+func (r *RedisRepository) attemptsKey(key string) string { return r.prefix + "attempts:" + key }
+func (r *RedisRepository) paymentKey(id string) string   { return r.prefix + "pid:" + id }
+
+// policyKey is global: both environments share merchant policies.
+func policyKey(merchantID string) string { return "shield:policy:" + merchantID }
+
+func (r *RedisRepository) eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	cmd := []interface{}{"EVAL", script, len(keys)}
+	for _, k := range keys {
+		cmd = append(cmd, k)
+	}
+	return r.client.Do(ctx, append(cmd, args...)...)
+}
+
+// InsertOrGet claims the payment ID with SET NX and creates the record in
+// one script, so concurrent requests for a key see exactly one insert.
+func (r *RedisRepository) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	now := time.Now()
+	reply, err := r.eval(ctx, insertOrGetScript,
+		[]string{
+			r.recordKey(req.IdempotencyKey), r.paymentKey(paymentID), r.prefix + "sources:" + req.IdempotencyKey,
+			r.prefix + "merchant:" + req.MerchantID, r.prefix + "merchants", r.prefix + "expiry", r.prefix + "seq",
+			r.attemptsKey(req.IdempotencyKey),
+		},
+		req.IdempotencyKey, req.MerchantID, req.CustomerID, req.Amount, req.Currency, req.Hash(), paymentID,
+		now.UnixNano(), expiresAt.UnixNano(), now.UnixMilli(), expiresAt.UnixMilli(), req.Source.IP, req.BodyHash,
+		req.Source.UserAgent, req.Source.RequestID, domain.MaxAttemptHistory, string(req.Metadata),
+	)
+	if err != nil {
+		return nil, false, logging.Wrap(ctx, "upsert", err)
+	}
+	res, _ := reply.([]interface{})
+	if len(res) == 0 {
+		return nil, false, logging.Wrap(ctx, "upsert", fmt.Errorf("unexpected reply %v", reply))
+	}
+	if res[0] == int64(-1) {
+		return nil, false, logging.Wrap(ctx, "upsert", domain.ErrPaymentIDConflict)
+	}
+	if len(res) < 2 {
+		return nil, false, logging.Wrap(ctx, "upsert", fmt.Errorf("unexpected reply %v", reply))
+	}
+	rec, err := parseRedisRecord(res[1])
+	if err != nil {
+		return nil, false, logging.Wrap(ctx, "upsert", err)
+	}
+	return rec, res[0] == int64(1), nil
+}
+
+func (r *RedisRepository) GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	reply, err := r.client.Do(ctx, "HGETALL", r.recordKey(key))
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get by key", err)
+	}
+	if fields, _ := reply.([]interface{}); len(fields) == 0 {
+		return nil, domain.ErrKeyNotFound
+	}
+	rec, err := parseRedisRecord(reply)
+	return rec, logging.Wrap(ctx, "get by key", err)
+}
+
+// GetByKeyPrimary is GetByKey: this backend has no replicas.
+func (r *RedisRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	return r.GetByKey(ctx, key)
+}
+
+// GetByPaymentID resolves the payment ID to its key, then reads the record.
+func (r *RedisRepository) GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	reply, err := r.client.Do(ctx, "GET", r.paymentKey(paymentID))
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get by payment id", err)
+	}
+	key, ok := reply.(string)
+	if !ok {
+		return nil, domain.ErrPaymentNotFound
+	}
+	rec, err := r.GetByKey(ctx, key)
+	if err == domain.ErrKeyNotFound {
+		return nil, domain.ErrPaymentNotFound
+	}
+	return rec, err
+}
+
+func (r *RedisRepository) MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	body, hasBody := "", "0"
+	if resp.Body != nil {
+		body, hasBody = string(*resp.Body), "1"
+	}
+	responseStatus, headers := "", ""
+	if resp.Status != 0 {
+		responseStatus = strconv.Itoa(resp.Status)
+	}
+	if len(resp.Headers) > 0 {
+		data, err := json.Marshal(resp.Headers)
+		if err != nil {
+			return logging.Wrap(ctx, "mark complete", err)
+		}
+		headers = string(data)
+	}
+	reply, err := r.eval(ctx, markCompleteScript, []string{r.recordKey(key)},
+		string(status), body, hasBody, time.Now().UnixNano(), responseStatus, headers)
+	if err != nil {
+		return logging.Wrap(ctx, "mark complete", err)
+	}
+	switch reply {
+	case int64(0):
+		return domain.ErrKeyNotFound
+	case int64(-1):
+		return domain.ErrAlreadyCompleted
+	}
+	return nil
+}
+
+// ResetToProcessing compares and swaps on version like the Postgres
+// implementation, returning domain.ErrConcurrentUpdate when it moved on.
+func (r *RedisRepository) ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	reply, err := r.eval(ctx, resetScript,
+		[]string{r.recordKey(key), r.paymentKey(newPaymentID), r.prefix + "expiry"},
+		version, newPaymentID, expiresAt.UnixNano(), time.Now().UnixNano(), key, r.prefix, expiresAt.UnixMilli())
+	if err != nil {
+		return logging.Wrap(ctx, "reset to processing", err)
+	}
+	switch reply {
+	case int64(0):
+		return domain.ErrConcurrentUpdate
+	case int64(-1):
+		return logging.Wrap(ctx, "reset to processing", domain.ErrPaymentIDConflict)
+	}
+	return nil
+}
+
+// UpdateParams compares and swaps on version like the Postgres
+// implementation.
+func (r *RedisRepository) UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error {
+	reply, err := r.eval(ctx, updateParamsScript, []string{r.recordKey(key)},
+		version, req.CustomerID, req.Amount, req.Currency, req.Hash(), req.BodyHash, string(req.Metadata), time.Now().UnixNano())
+	if err != nil {
+		return logging.Wrap(ctx, "update params", err)
+	}
+	if reply == int64(0) {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// ExpireKey keeps an earlier expiry and bumps the version like the Postgres
+// implementation.
+func (r *RedisRepository) ExpireKey(ctx context.Context, key string) error {
+	now := time.Now()
+	reply, err := r.eval(ctx, expireKeyScript, []string{r.recordKey(key), r.prefix + "expiry"},
+		now.UnixNano(), now.UnixMilli(), key)
+	if err != nil {
+		return logging.Wrap(ctx, "expire key", err)
+	}
+	if reply == int64(0) {
+		return domain.ErrKeyNotFound
+	}
+	return nil
+}
+
+// ResetKey compares and swaps on version like the Postgres implementation;
+// the key's sources and attempts stay until it is swept.
+func (r *RedisRepository) ResetKey(ctx context.Context, key string, version int64) error {
+	now := time.Now()
+	reply, err := r.eval(ctx, resetKeyScript, []string{r.recordKey(key), r.prefix + "expiry"},
+		version, now.UnixNano(), now.UnixMilli(), key)
+	if err != nil {
+		return logging.Wrap(ctx, "reset key", err)
+	}
+	if reply == int64(0) {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// DeleteExpired removes up to limit of this environment's expired keys.
+func (r *RedisRepository) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	reply, err := r.eval(ctx, deleteExpiredScript, []string{r.prefix + "expiry"}, time.Now().UnixMilli(), r.prefix, limit)
+	if err != nil {
+		return 0, logging.Wrap(ctx, "delete expired", err)
+	}
+	n, _ := reply.(int64)
+	return n, nil
+}
+
+// keysInRange returns the merchant's records first seen within [from, to],
+// with DistinctSources filled in.
+func (r *RedisRepository) keysInRange(ctx context.Context, merchantID string, from, to time.Time) ([]domain.IdempotencyRecord, error) {
+	reply, err := r.eval(ctx, rangeScript, []string{r.prefix + "merchant:" + merchantID},
+		from.UnixMilli(), to.UnixMilli(), r.prefix)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	var records []domain.IdempotencyRecord
+	for i := 0; i+1 < len(items); i += 2 {
+		rec, err := parseRedisRecord(items[i])
+		if err != nil {
+			return nil, err
+		}
+		// Scores are milliseconds; apply the exact bounds here.
+		if rec.FirstSeenAt.Before(from) || rec.FirstSeenAt.After(to) {
+			continue
+		}
+		sources, _ := items[i+1].(int64)
+		rec.DistinctSources = int(sources)
+		records = append(records, *rec)
+	}
+	return records, nil
+}
+
+func (r *RedisRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	records, err := r.duplicatesInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, 0, logging.Wrap(ctx, "get duplicates", err)
+	}
+	records, total := pageDuplicates(records, page)
+	return records, total, nil
+}
+
+func (r *RedisRepository) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	records, err := r.duplicatesInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return logging.Wrap(ctx, "stream duplicates", err)
+	}
+	return streamDuplicates(records, fn)
+}
+
+func (r *RedisRepository) GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	records, err := r.duplicatesInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get amount at risk", err)
+	}
+	return amountAtRisk(records), nil
+}
+
+func (r *RedisRepository) duplicatesInRange(ctx context.Context, merchantID string, from, to time.Time) ([]domain.IdempotencyRecord, error) {
+	all, err := r.keysInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var records []domain.IdempotencyRecord
+	for _, rec := range all {
+		if rec.AttemptCount > 1 {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func (r *RedisRepository) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	records, err := r.keysInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return 0, 0, logging.Wrap(ctx, "get merchant stats", err)
+	}
+	total, unique := merchantStats(records)
+	return total, unique, nil
+}
+
+func (r *RedisRepository) GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	records, err := r.keysInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return domain.MerchantOutcomes{}, logging.Wrap(ctx, "get merchant outcomes", err)
+	}
+	return merchantOutcomes(records), nil
+}
+
+func (r *RedisRepository) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	records, err := r.keysInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get duplicate trends", err)
+	}
+	return duplicateTrends(records, bucket), nil
+}
+
+func (r *RedisRepository) GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	reply, err := r.client.Do(ctx, "GET", policyKey(merchantID))
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get policy", err)
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, domain.ErrMerchantNotFound
+	}
+	var p domain.MerchantPolicy
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, logging.Wrap(ctx, "get policy", err)
+	}
+	return &p, nil
+}
+
+// UpsertPolicy keeps the original created_at when replacing a policy.
+func (r *RedisRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
+	return r.UpsertPolicies(ctx, []domain.MerchantPolicy{policy})
+}
+
+// UpsertPolicies writes the policies one SET at a time: they live in
+// different cluster slots, so one failing leaves the earlier ones written.
+// Repeating the whole upsert is safe.
+func (r *RedisRepository) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	now := time.Now()
+	for _, policy := range policies {
+		policy.CreatedAt, policy.UpdatedAt = now, now
+		existing, err := r.GetPolicy(ctx, policy.MerchantID)
+		if err == nil {
+			policy.CreatedAt = existing.CreatedAt
+		} else if err != domain.ErrMerchantNotFound {
+			return err
+		}
+		if policy.TolerantFields == nil {
+			policy.TolerantFields = []string{}
+		}
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return logging.Wrap(ctx, "upsert policy", err)
+		}
+		if _, err := r.client.Do(ctx, "SET", policyKey(policy.MerchantID), data); err != nil {
+			return logging.Wrap(ctx, "upsert policy", err)
+		}
+	}
+	return nil
+}
+
+// ListPolicies scans for every policy key, then pages in Go.
+func (r *RedisRepository) ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	var keys []interface{}
+	cursor := "0"
+	for {
+		reply, err := r.client.Do(ctx, "SCAN", cursor, "MATCH", policyKey("*"), "COUNT", 500)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "list policies", err)
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, 0, logging.Wrap(ctx, "list policies", fmt.Errorf("unexpected SCAN reply %T", reply))
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		keys = append(keys, batch...)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	var policies []domain.MerchantPolicy
+	for start := 0; start < len(keys); start += 500 {
+		end := min(start+500, len(keys))
+		reply, err := r.client.Do(ctx, append([]interface{}{"MGET"}, keys[start:end]...)...)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "list policies", err)
+		}
+		values, _ := reply.([]interface{})
+		for _, v := range values {
+			data, ok := v.(string)
+			if !ok {
+				continue // deleted since the scan
+			}
+			var p domain.MerchantPolicy
+			if err := json.Unmarshal([]byte(data), &p); err != nil {
+				return nil, 0, logging.Wrap(ctx, "list policies", err)
+			}
+			policies = append(policies, p)
+		}
+	}
+	policies, total := pagePolicies(policies, page)
+	return policies, total, nil
+}
+
+func (r *RedisRepository) DeletePolicy(ctx context.Context, merchantID string) error {
+	reply, err := r.client.Do(ctx, "DEL", policyKey(merchantID))
+	if err != nil {
+		return logging.Wrap(ctx, "delete policy", err)
+	}
+	if reply == int64(0) {
+		return domain.ErrMerchantNotFound
+	}
+	return nil
+}
+
+func (r *RedisRepository) GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error) {
+	reply, err := r.client.Do(ctx, "SMEMBERS", r.prefix+"merchants")
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get all merchant stats", err)
+	}
+	members, _ := reply.([]interface{})
+	stats := make(map[string][2]int)
+	for _, m := range members {
+		mid, _ := m.(string)
+		total, unique, err := r.GetMerchantStats(ctx, mid, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if unique > 0 {
+			stats[mid] = [2]int{total, unique}
+		}
+	}
+	return stats, nil
+}
+
+func (r *RedisRepository) GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	records, err := r.keysInRange(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get amount stats", err)
+	}
+	return amountStats(records), nil
+}
+
+// SearchRecords reads the merchant's keys in range, or every merchant's
+// without a merchant filter, and filters them in Go.
+func (r *RedisRepository) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	merchants := []string{filter.MerchantID}
+	if filter.MerchantID == "" {
+		reply, err := r.client.Do(ctx, "SMEMBERS", r.prefix+"merchants")
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "search records", err)
+		}
+		members, _ := reply.([]interface{})
+		merchants = merchants[:0]
+		for _, m := range members {
+			mid, _ := m.(string)
+			merchants = append(merchants, mid)
+		}
+	}
+	to := filter.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	var records []domain.IdempotencyRecord
+	for _, mid := range merchants {
+		inRange, err := r.keysInRange(ctx, mid, filter.From, to)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "search records", err)
+		}
+		records = append(records, inRange...)
+	}
+	records, total := pageSearch(records, filter, page)
+	return records, total, nil
+}
+
+// parseRedisRecord decodes an HGETALL reply.
+func parseRedisRecord(reply interface{}) (*domain.IdempotencyRecord, error) {
+	items, _ := reply.([]interface{})
+	fields := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		k, _ := items[i].(string)
+		v, _ := items[i+1].(string)
+		fields[k] = v
+	}
+	if fields["idempotency_key"] == "" {
+		return nil, fmt.Errorf("malformed record")
+	}
+
+	var rec domain.IdempotencyRecord
+	var err error
+	num := func(name string) int64 {
+		if err != nil {
+			return 0
+		}
+		var n int64
+		n, err = strconv.ParseInt(fields[name], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("record field %s: %w", name, err)
+		}
+		return n
+	}
+	rec.ID = num("id")
+	rec.IdempotencyKey = fields["idempotency_key"]
+	rec.MerchantID = fields["merchant_id"]
+	rec.CustomerID = fields["customer_id"]
+	rec.Amount = num("amount")
+	rec.Currency = fields["currency"]
+	rec.Status = domain.Status(fields["status"])
+	rec.RequestHash = fields["request_hash"]
+	rec.BodyHash = fields["body_hash"]
+	if metadata, ok := fields["metadata"]; ok {
+		rec.Metadata = json.RawMessage(metadata)
+	}
+	rec.PaymentID = fields["payment_id"]
+	rec.AttemptCount = int(num("attempt_count"))
+	rec.Version = num("version")
+	rec.FirstSeenAt = time.Unix(0, num("first_seen_at"))
+	rec.LastSeenAt = time.Unix(0, num("last_seen_at"))
+	// Records written before processing_since existed fall back to
+	// first_seen_at.
+	rec.ProcessingSince = rec.FirstSeenAt
+	if _, ok := fields["processing_since"]; ok {
+		rec.ProcessingSince = time.Unix(0, num("processing_since"))
+	}
+	rec.ExpiresAt = time.Unix(0, num("expires_at"))
+	if body, ok := fields["response_body"]; ok {
+		raw := json.RawMessage(body)
+		rec.ResponseBody = &raw
+	}
+	if _, ok := fields["completed_at"]; ok {
+		t := time.Unix(0, num("completed_at"))
+		rec.CompletedAt = &t
+	}
+	if _, ok := fields["response_status"]; ok {
+		rec.ResponseStatus = int(num("response_status"))
+	}
+	if headers, ok := fields["response_headers"]; ok && err == nil {
+		if jerr := json.Unmarshal([]byte(headers), &rec.ResponseHeaders); jerr != nil {
+			err = fmt.Errorf("record field response_headers: %w", jerr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// redisAttempt is an attempt as insertOrGetScript stores it; at is Unix
+// nanoseconds, kept a string so cjson does not round it.
+type redisAttempt struct {
+	At      string `json:"at"`
+	Hash    string `json:"hash"`
+	IP      string `json:"ip"`
+	UA      string `json:"ua"`
+	RID     string `json:"rid"`
+	Outcome string `json:"outcome"`
+}
+
+func (r *RedisRepository) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	reply, err := r.client.Do(ctx, "LRANGE", r.attemptsKey(key), 0, -1)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get attempts", err)
+	}
+	items, _ := reply.([]interface{})
+	if len(items) == 0 {
+		exists, err := r.client.Do(ctx, "EXISTS", r.recordKey(key))
+		if err != nil {
+			return nil, logging.Wrap(ctx, "get attempts", err)
+		}
+		if exists != int64(1) {
+			return nil, domain.ErrKeyNotFound
+		}
+	}
+	attempts := make([]domain.Attempt, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		var a redisAttempt
+		if err := json.Unmarshal([]byte(s), &a); err != nil {
+			return nil, logging.Wrap(ctx, "get attempts", err)
+		}
+		ns, err := strconv.ParseInt(a.At, 10, 64)
+		if err != nil {
+			return nil, logging.Wrap(ctx, "get attempts", err)
+		}
+		attempts = append(attempts, domain.Attempt{
+			AttemptedAt: time.Unix(0, ns).UTC(),
+			RequestHash: a.Hash,
+			SourceIP:    a.IP,
+			UserAgent:   a.UA,
+			RequestID:   a.RID,
+			Outcome:     a.Outcome,
+		})
+	}
+	return attempts, nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestEncodeCommand(t *testing.T) {
+	got := string(encodeCommand("SET", "k", int64(42)))
+	if got != "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\n42\r\n" {
+		t.Errorf("unexpected encoding: %q", got)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*4\r\n+OK\r\n:7\r\n$-1\r\n-NOSCRIPT missing\r\n$5\r\nhello\r\n-ERR boom\r\n"))
+	reply, err := readReply(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := reply.([]interface{})
+	if items[0] != "OK" || items[1] != int64(7) || items[2] != nil || items[3] != RedisError("NOSCRIPT missing") {
+		t.Errorf("unexpected array reply: %#v", items)
+	}
+	if reply, _ := readReply(r); reply != "hello" {
+		t.Errorf("expected bulk string, got %#v", reply)
+	}
+	var rerr RedisError
+	if _, err := readReply(r); !errors.As(err, &rerr) || string(rerr) != "ERR boom" {
+		t.Errorf("expected error reply, got %v", err)
+	}
+}
+
+func TestRedisClient_AuthAndReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var cmds []string
+		for len(cmds) < 3 {
+			cmd, err := readReply(r)
+			if err != nil {
+				return
+			}
+			args := cmd.([]interface{})
+			cmds = append(cmds, args[0].(string))
+			if args[0] == "GET" {
+				conn.Write([]byte("$-1\r\n"))
+			} else {
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+		accepted <- cmds
+	}()
+
+	client, err := NewRedisClient("redis://:secret@"+ln.Addr().String()+"/2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if reply, err := client.Do(context.Background(), "GET", "missing"); err != nil || reply != nil {
+		t.Fatalf("expected a nil reply, got %v %v", reply, err)
+	}
+	select {
+	case cmds := <-accepted:
+		if strings.Join(cmds, ",") != "AUTH,SELECT,GET" {
+			t.Errorf("unexpected command sequence: %v", cmds)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server saw no commands")
+	}
+
+	if _, err := NewRedisClient("http://localhost:6379", 1); err == nil {
+		t.Error("expected an error for a non-redis URL")
+	}
+}
+
+func TestParseRedisRecord(t *testing.T) {
+	reply := []interface{}{
+		"id", "3", "idempotency_key", "k1", "merchant_id", "m1", "customer_id", "c1", "amount", "1500",
+		"currency", "USD", "status", "succeeded", "request_hash", "h", "payment_id", "pay_1",
+		"attempt_count", "2", "version", "2", "first_seen_at", "1000", "last_seen_at", "2000",
+		"expires_at", "3000", "completed_at", "2500", "response_body", `{"ok":true}`,
+		"response_status", "201", "response_headers", `{"Location":"/p/1"}`,
+	}
+	rec, err := parseRedisRecord(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != 3 || rec.Amount != 1500 || rec.Status != domain.StatusSucceeded || rec.AttemptCount != 2 ||
+		rec.Version != 2 || rec.FirstSeenAt.UnixNano() != 1000 || rec.CompletedAt == nil || string(*rec.ResponseBody) != `{"ok":true}` ||
+		rec.ResponseStatus != 201 || rec.ResponseHeaders["Location"] != "/p/1" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	if _, err := parseRedisRecord([]interface{}{"idempotency_key", "k1", "amount", "x"}); err == nil {
+		t.Error("expected an error for a malformed field")
+	}
+}
+
+func getTestRedis(t *testing.T) *RedisRepository {
+	t.Helper()
+	url := os.Getenv("REDIS_TEST_URL")
+	if url == "" {
+		url = "redis://localhost:6379/15"
+	}
+	client, err := NewRedisClient(url, 4)
+	if err != nil {
+		t.Skipf("skipping redis integration test: %v", err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Skipf("skipping redis integration test (Redis not available): %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewRedisRepository(client).WithEnvironment("inttest" + time.Now().Format("150405.000000"))
+}
+
+func TestIntegration_Redis_Lifecycle(t *testing.T) {
+	repo := getTestRedis(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "k1", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD",
+		Source: domain.AttemptSource{IP: "10.0.0.1"}}
+
+	rec, isNew, err := repo.InsertOrGet(ctx, req, "pay_a", time.Now().Add(time.Hour))
+	if err != nil || !isNew || rec.Version != 1 {
+		t.Fatalf("insert: %+v %v %v", rec, isNew, err)
+	}
+	req.Source.IP = "10.0.0.2"
+	if rec, isNew, _ = repo.InsertOrGet(ctx, req, "pay_b", time.Now().Add(time.Hour)); isNew || rec.AttemptCount != 2 || rec.PaymentID != "pay_a" {
+		t.Fatalf("expected the existing record, got %+v", rec)
+	}
+	other := req
+	other.IdempotencyKey = "k2"
+	if _, _, err := repo.InsertOrGet(ctx, other, "pay_a", time.Now().Add(time.Hour)); !errors.Is(err, domain.ErrPaymentIDConflict) {
+		t.Errorf("expected a payment ID conflict, got %v", err)
+	}
+
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{Status: 402, Headers: map[string]string{"X-Reason": "declined"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := repo.GetByKey(ctx, "k1"); rec.ResponseStatus != 402 || rec.ResponseHeaders["X-Reason"] != "declined" {
+		t.Errorf("expected the stored response, got %+v", rec)
+	}
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{}); err != domain.ErrAlreadyCompleted {
+		t.Errorf("expected ErrAlreadyCompleted, got %v", err)
+	}
+	if err := repo.ResetToProcessing(ctx, "k1", 1, "pay_c", time.Now().Add(time.Hour)); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected a stale version to lose, got %v", err)
+	}
+	if err := repo.ResetToProcessing(ctx, "k1", 2, "pay_c", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetByPaymentID(ctx, "pay_a"); err != domain.ErrPaymentNotFound {
+		t.Errorf("expected the old payment ID to stop resolving, got %v", err)
+	}
+	if rec, err := repo.GetByPaymentID(ctx, "pay_c"); err != nil || rec.Status != domain.StatusProcessing || rec.Version != 3 {
+		t.Errorf("unexpected record after reset: %+v %v", rec, err)
+	}
+
+	dups, total, err := repo.GetDuplicates(ctx, "m1", time.Now().Add(-time.Hour), time.Now(), domain.Page{Limit: 10})
+	if err != nil || len(dups) != 1 || total != 1 || dups[0].DistinctSources != 2 {
+		t.Errorf("unexpected duplicates: %+v %d %v", dups, total, err)
+	}
+	if atRisk, err := repo.GetAmountAtRisk(ctx, "m1", time.Now().Add(-time.Hour), time.Now()); err != nil || atRisk["USD"] != 1000 {
+		t.Errorf("unexpected amount at risk: %v %v", atRisk, err)
+	}
+	if total, unique, err := repo.GetMerchantStats(ctx, "m1", time.Now().Add(-time.Hour), time.Now()); total != 2 || unique != 1 || err != nil {
+		t.Errorf("unexpected stats: %d %d %v", total, unique, err)
+	}
+
+	if err := repo.ResetToProcessing(ctx, "k1", 3, "pay_d", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.DeleteExpired(ctx, 100); n != 1 || err != nil {
+		t.Errorf("expected one expired key, got %d %v", n, err)
+	}
+	if _, err := repo.GetByKey(ctx, "k1"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected the expired key gone, got %v", err)
+	}
+}
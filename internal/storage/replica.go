@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// replicaCooldown is how long a replica that failed a read is skipped.
+const replicaCooldown = 30 * time.Second
+
+// upReplica returns the index of the next replica not cooling down after a
+// failure, round robin, or -1 when none is.
+func (r *PostgresRepository) upReplica() int {
+	n := len(r.replicas)
+	if n == 0 {
+		return -1
+	}
+	start := int(atomic.AddUint32(&r.nextRead, 1) - 1)
+	now := time.Now().UnixNano()
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		if r.replicaDown[i].Load() <= now {
+			return i
+		}
+	}
+	return -1
+}
+
+// readTargets picks the database for the first read, replica i, and the
+// one to hedge against: the next replica that is up, else the primary.
+func (r *PostgresRepository) readTargets(i int) (*sql.DB, *sql.DB) {
+	n := len(r.replicas)
+	now := time.Now().UnixNano()
+	for k := 1; k < n; k++ {
+		if j := (i + k) % n; r.replicaDown[j].Load() <= now {
+			return r.replicas[i], r.replicas[j]
+		}
+	}
+	return r.replicas[i], r.db
+}
+
+// replicaFailed reports whether err from replica i means the replica is
+// unhealthy and, if so, skips it for replicaCooldown. Not-found results and
+// the caller giving up do not count.
+func (r *PostgresRepository) replicaFailed(ctx context.Context, i int, err error) bool {
+	if err == nil || err == sql.ErrNoRows || ctx.Err() != nil || !isBreakerFailure(err) {
+		return false
+	}
+	r.replicaDown[i].Store(time.Now().Add(replicaCooldown).UnixNano())
+	return true
+}
+
+// partialReadError is a streamed read that failed after handing rows to its
+// caller, so it cannot be run again elsewhere. The failure may be the
+// caller's own, so it does not count against the replica either.
+type partialReadError struct{ err error }
+
+func (e *partialReadError) Error() string { return e.err.Error() }
+func (e *partialReadError) Unwrap() error { return e.err }
+
+// reportRead runs fn, a read-only reporting query, on a replica that is up,
+// so reports stay off the primary that serves payments. It runs on the
+// primary when there is none, and again there when the replica fails. A
+// failure the query timeout caused is reported as domain.ErrTimeout.
+func (r *PostgresRepository) reportRead(ctx context.Context, fn func(db *sql.DB) error) error {
+	i := r.upReplica()
+	if i < 0 {
+		return timedOut(ctx, fn(r.db))
+	}
+	err := fn(r.replicas[i])
+	if partial, ok := err.(*partialReadError); ok {
+		return timedOut(ctx, partial.err)
+	}
+	if !r.replicaFailed(ctx, i, err) {
+		return timedOut(ctx, err)
+	}
+	logging.From(ctx).Warnf("read replica failed, reading from the primary: %v", err)
+	return timedOut(ctx, fn(r.db))
+}
+
+// partialRead marks err as a partialReadError once rows were handed over.
+func partialRead(streamed bool, err error) error {
+	if streamed && err != nil {
+		return &partialReadError{err: err}
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// openTestDB opens an in-memory database standing in for a Postgres pool.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReportRead_UsesReplica(t *testing.T) {
+	primary, replica := openTestDB(t), openTestDB(t)
+	r := NewPostgresRepository(primary).WithReplicas(0, replica)
+
+	var used *sql.DB
+	err := r.reportRead(context.Background(), func(db *sql.DB) error {
+		used = db
+		return db.QueryRow("SELECT 1").Scan(new(int))
+	})
+	if err != nil || used != replica {
+		t.Fatalf("expected the report read from the replica, got %v", err)
+	}
+}
+
+func TestReportRead_FallsBackToPrimary(t *testing.T) {
+	primary, replica := openTestDB(t), openTestDB(t)
+	replica.Close()
+	r := NewPostgresRepository(primary).WithReplicas(0, replica)
+
+	var used []*sql.DB
+	read := func(db *sql.DB) error {
+		used = append(used, db)
+		return db.QueryRow("SELECT 1").Scan(new(int))
+	}
+	if err := r.reportRead(context.Background(), read); err != nil {
+		t.Fatalf("expected the primary to answer, got %v", err)
+	}
+	if len(used) != 2 || used[0] != replica || used[1] != primary {
+		t.Fatalf("expected the replica then the primary, got %d reads", len(used))
+	}
+
+	used = nil
+	if err := r.reportRead(context.Background(), read); err != nil || len(used) != 1 || used[0] != primary {
+		t.Errorf("expected the failed replica skipped while cooling down, got %d reads %v", len(used), err)
+	}
+	if r.upReplica() != -1 {
+		t.Error("expected no replica up")
+	}
+}
+
+func TestReportRead_PartialReadNotRetried(t *testing.T) {
+	primary, replica := openTestDB(t), openTestDB(t)
+	r := NewPostgresRepository(primary).WithReplicas(0, replica)
+
+	stop := errors.New("client went away")
+	reads := 0
+	err := r.reportRead(context.Background(), func(db *sql.DB) error {
+		reads++
+		return &partialReadError{err: stop}
+	})
+	if !errors.Is(err, stop) || reads != 1 {
+		t.Fatalf("expected the partial read returned as is, got %v after %d reads", err, reads)
+	}
+	if r.upReplica() != 0 {
+		t.Error("expected the replica to stay up after the caller's own error")
+	}
+}
+
+func TestReportRead_NoReplicas(t *testing.T) {
+	primary := openTestDB(t)
+	r := NewPostgresRepository(primary)
+	var used *sql.DB
+	r.reportRead(context.Background(), func(db *sql.DB) error { used = db; return nil })
+	if used != primary {
+		t.Error("expected the primary without replicas")
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"sync/atomic"
 	"time"
 
+	"github.com/lib/pq"
+
 	"github.com/kubo-market/idempotency-shield/internal/domain"
 )
 
@@ -17,42 +21,167 @@ type Repository interface {
 	// Returns the record, a bool indicating if it was newly created, and any error.
 	InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error)
 
-	// GetByKey retrieves a record by its idempotency key.
+	// GetByKey retrieves a record by its idempotency key. It may be read
+	// from a replica, so it is for lookups whose answer is only shown.
 	GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error)
 
-	// MarkComplete updates a record's status and stores the response body.
-	MarkComplete(ctx context.Context, key string, status domain.Status, responseBody *json.RawMessage) error
+	// GetByKeyPrimary is GetByKey read where writes go, never from a
+	// replica, for callers that act on the record: it sees every write
+	// already acknowledged.
+	GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error)
+
+	// GetByPaymentID retrieves a record by the payment ID the shield issued.
+	GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error)
+
+	// MarkComplete updates a record's status and stores the response it
+	// completed with.
+	MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error
+
+	// ResetToProcessing resets a failed or expired record back to processing
+	// for retry, provided it is still at version. Otherwise it returns
+	// domain.ErrConcurrentUpdate.
+	ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error
+
+	// UpdateParams replaces a record's customer, amount, currency, hashes
+	// and metadata with req's, provided it is still at version. Otherwise it
+	// returns domain.ErrConcurrentUpdate.
+	UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error
 
-	// ResetToProcessing resets a failed record back to processing for retry.
-	ResetToProcessing(ctx context.Context, key string, newPaymentID string, expiresAt time.Time) error
+	// ExpireKey moves a key's expiry to now, so its next payment starts
+	// afresh as after its TTL, or returns domain.ErrKeyNotFound.
+	ExpireKey(ctx context.Context, key string) error
 
-	// DeleteExpired removes records past their expiration.
-	DeleteExpired(ctx context.Context) (int64, error)
+	// ResetKey fails a key and moves its expiry to now, keeping its
+	// attempts, provided it is still at version. Otherwise it returns
+	// domain.ErrConcurrentUpdate.
+	ResetKey(ctx context.Context, key string, version int64) error
 
-	// GetDuplicates returns records with attempt_count > 1 for a merchant within a time range.
-	GetDuplicates(ctx context.Context, merchantID string, from, to time.Time) ([]domain.IdempotencyRecord, error)
+	// DeleteExpired removes up to limit records past their expiration and
+	// returns how many it removed.
+	DeleteExpired(ctx context.Context, limit int) (int64, error)
+
+	// GetDuplicates returns one page of the records with attempt_count > 1 for a
+	// merchant within a time range, most attempts first, and how many there are
+	// in all.
+	GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error)
+
+	// StreamDuplicates calls fn for every record GetDuplicates would return
+	// without a page limit, in the same order, without holding them all in
+	// memory. An error from fn stops the stream and is returned as is.
+	StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error
+
+	// GetAmountAtRisk returns, per currency, the amount of a merchant's extra
+	// attempts (amount × (attempt_count - 1)) within a time range.
+	GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error)
 
 	// GetMerchantStats returns aggregate stats for a merchant within a time range.
 	GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (total int, unique int, err error)
 
+	// GetMerchantOutcomes returns how a merchant's keys first seen within a
+	// time range ended.
+	GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error)
+
+	// GetDuplicateTrends returns GetMerchantStats per bucket of keys first
+	// seen within a time range, with Start aligned to a multiple of bucket
+	// since the Unix epoch. Only buckets with keys are returned, oldest first,
+	// with TotalRequests and UniquePayments set.
+	GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error)
+
 	// GetPolicy retrieves a merchant's idempotency policy.
 	GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error)
 
 	// UpsertPolicy creates or updates a merchant policy.
 	UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error
 
+	// ListPolicies returns one page of the merchant policies by merchant ID
+	// and how many there are in all.
+	ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error)
+
+	// UpsertPolicies creates or updates several merchant policies, in one
+	// transaction where the backend has them.
+	UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error
+
+	// DeletePolicy removes a merchant's policy, or returns
+	// domain.ErrMerchantNotFound.
+	DeletePolicy(ctx context.Context, merchantID string) error
+
 	// GetAllMerchantStats returns stats for all merchants within a time range.
 	GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error)
+
+	// GetAmountStats returns a merchant's payment amount distribution per currency.
+	GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error)
+
+	// SearchRecords returns one page of the records matching filter, newest
+	// first with ID as the tiebreaker, and how many match in all.
+	SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error)
+
+	// GetAttempts returns the latest domain.MaxAttemptHistory attempts
+	// recorded for a key, oldest first, or domain.ErrKeyNotFound.
+	GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error)
 }
 
 // PostgresRepository implements Repository using PostgreSQL.
 type PostgresRepository struct {
-	db *sql.DB
+	db  *sql.DB
+	env string
+
+	// Optional read replicas for hedged read-only lookups and reports.
+	// replicaDown holds when each replica may be read again after a
+	// failure, in Unix nanoseconds.
+	replicas    []*sql.DB
+	replicaDown []atomic.Int64
+	hedgeDelay  time.Duration
+	nextRead    uint32
+
+	// queryTimeout bounds each call; lockTimeout bounds the wait for a
+	// key's advisory lock within it. Zero leaves either unbounded.
+	queryTimeout time.Duration
+	lockTimeout  time.Duration
 }
 
 // NewPostgresRepository creates a new PostgresRepository.
 func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+	return &PostgresRepository{db: db, env: domain.EnvironmentProduction}
+}
+
+// WithEnvironment scopes every key, report and digest to env. Deployments
+// sharing a database keep sandbox and production keys apart this way.
+func (r *PostgresRepository) WithEnvironment(env string) *PostgresRepository {
+	r.env = env
+	return r
+}
+
+// WithReplicas routes read-only key lookups and reports to the given
+// replicas. A lookup that has not answered within hedgeDelay is hedged with
+// a second read against another replica (or the primary when there is only
+// one replica). A replica that fails is skipped for a while and its reads
+// go to the primary.
+func (r *PostgresRepository) WithReplicas(hedgeDelay time.Duration, replicas ...*sql.DB) *PostgresRepository {
+	r.replicas = replicas
+	r.replicaDown = make([]atomic.Int64, len(replicas))
+	r.hedgeDelay = hedgeDelay
+	return r
+}
+
+// WithTimeouts bounds every call with query, so a stuck query fails with
+// domain.ErrTimeout instead of holding its request until the server gives
+// up. An insert waiting longer than lock for another request of the same key
+// to finish fails with domain.ErrLockTimeout. Streams, seeding and ANALYZE
+// run as long as their caller allows. Zero disables either bound.
+func (r *PostgresRepository) WithTimeouts(query, lock time.Duration) *PostgresRepository {
+	r.queryTimeout = query
+	r.lockTimeout = lock
+	return r
+}
+
+// lockName is what the advisory lock for key is derived from. Production keeps
+// the bare key so instances from before environments existed still contend
+// for the same lock during a rolling deploy.
+func (r *PostgresRepository) lockName(key string) string {
+	if r.env == domain.EnvironmentProduction {
+		return key
+	}
+	return r.env + ":" + key
 }
 
 // advisoryLockKey generates a consistent int64 hash for pg_advisory_xact_lock.
@@ -63,20 +192,22 @@ func advisoryLockKey(idempotencyKey string) int64 {
 }
 
 // InsertOrGet uses the 3-layer concurrency defense:
-// Layer 1: UNIQUE constraint on idempotency_key
+// Layer 1: UNIQUE constraint on (environment, idempotency_key)
 // Layer 2: INSERT ... ON CONFLICT in a single atomic statement
 // Layer 3: pg_advisory_xact_lock to serialize same-key concurrent requests
 func (r *PostgresRepository) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, false, fmt.Errorf("begin tx: %w", err)
+		return nil, false, wrap(ctx, "begin tx", err)
 	}
 	defer tx.Rollback()
 
 	// Layer 3: Advisory lock serializes concurrent requests for the same key
-	lockKey := advisoryLockKey(req.IdempotencyKey)
-	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", lockKey); err != nil {
-		return nil, false, fmt.Errorf("advisory lock: %w", err)
+	lockKey := advisoryLockKey(r.lockName(req.IdempotencyKey))
+	if err := r.advisoryLock(ctx, tx, lockKey); err != nil {
+		return nil, false, wrap(ctx, "advisory lock", err)
 	}
 
 	hash := req.Hash()
@@ -86,24 +217,41 @@ func (r *PostgresRepository) InsertOrGet(ctx context.Context, req domain.Payment
 	var rec domain.IdempotencyRecord
 	var responseBody sql.NullString
 	var completedAt sql.NullTime
+	var responseStatus sql.NullInt64
+	var responseHeaders, metadata []byte
 
 	err = tx.QueryRowContext(ctx, `
-		INSERT INTO idempotency_keys (idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, payment_id, first_seen_at, last_seen_at, expires_at)
-		VALUES ($1, $2, $3, $4, $5, 'processing', $6, $7, $8, $8, $9)
-		ON CONFLICT (idempotency_key) DO UPDATE SET
+		INSERT INTO idempotency_keys (idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, body_hash, metadata, payment_id, first_seen_at, last_seen_at, processing_since, expires_at, environment)
+		VALUES ($1, $2, $3, $4, $5, 'processing', $6, NULLIF($11, ''), $12, $7, $8, $8, $8, $9, $10)
+		ON CONFLICT (environment, idempotency_key) DO UPDATE SET
 			last_seen_at = $8,
 			attempt_count = idempotency_keys.attempt_count + 1
-		RETURNING id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, first_seen_at, last_seen_at, completed_at, expires_at
+		RETURNING id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, version, first_seen_at, last_seen_at, completed_at, expires_at, response_status, response_headers, processing_since, COALESCE(body_hash, ''), metadata
 	`, req.IdempotencyKey, req.MerchantID, req.CustomerID, req.Amount, req.Currency,
-		hash, paymentID, now, expiresAt,
+		hash, paymentID, now, expiresAt, r.env, req.BodyHash, jsonValue(req.Metadata),
 	).Scan(
 		&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
 		&rec.Amount, &rec.Currency, &rec.Status, &rec.RequestHash,
-		&responseBody, &rec.PaymentID, &rec.AttemptCount,
+		&responseBody, &rec.PaymentID, &rec.AttemptCount, &rec.Version,
 		&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &rec.ExpiresAt,
+		&responseStatus, &responseHeaders, &rec.ProcessingSince, &rec.BodyHash, &metadata,
 	)
+	if isPaymentIDConflict(err) {
+		return nil, false, wrap(ctx, "upsert", domain.ErrPaymentIDConflict)
+	}
 	if err != nil {
-		return nil, false, fmt.Errorf("upsert: %w", err)
+		return nil, false, wrap(ctx, "upsert", err)
+	}
+
+	// attempt_count == 1 means this was a new insert
+	isNew := rec.AttemptCount == 1
+	src := req.Source
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_attempts (environment, idempotency_key, source_ip, user_agent, request_id, attempted_at, request_hash, outcome)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
+	`, r.env, req.IdempotencyKey, src.IP, src.UserAgent, src.RequestID, now,
+		hash, domain.AttemptOutcome(&rec, req, isNew)); err != nil {
+		return nil, false, wrap(ctx, "record attempt", err)
 	}
 
 	if responseBody.Valid {
@@ -113,35 +261,119 @@ func (r *PostgresRepository) InsertOrGet(ctx context.Context, req domain.Payment
 	if completedAt.Valid {
 		rec.CompletedAt = &completedAt.Time
 	}
+	rec.Metadata = json.RawMessage(metadata)
+	if err := setStoredResponse(&rec, responseStatus, responseHeaders); err != nil {
+		return nil, false, wrap(ctx, "upsert", err)
+	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, false, fmt.Errorf("commit: %w", err)
+		return nil, false, wrap(ctx, "commit", err)
 	}
-
-	// attempt_count == 1 means this was a new insert
-	isNew := rec.AttemptCount == 1
 	return &rec, isNew, nil
 }
 
+// advisoryLock takes the transaction's lock on key, giving up after the
+// lock timeout. The timeout is set and the lock taken in one round trip;
+// both values are integers, so they are formatted into the statement.
+func (r *PostgresRepository) advisoryLock(ctx context.Context, tx *sql.Tx, key int64) error {
+	if r.lockTimeout <= 0 {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", key)
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d; SELECT pg_advisory_xact_lock(%d)",
+		max(r.lockTimeout.Milliseconds(), 1), key))
+	if isLockTimeout(err) {
+		return fmt.Errorf("%w: %w", domain.ErrLockTimeout, err)
+	}
+	return err
+}
+
+// GetByKey reads from the primary, or hedges across replicas when configured.
+// With every replica down it reads from the primary alone.
 func (r *PostgresRepository) GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	i := r.upReplica()
+	if i < 0 {
+		return getByKey(ctx, r.db, r.env, key)
+	}
+	first, second := r.readTargets(i)
+	return hedgedRead(ctx, r.hedgeDelay,
+		func(ctx context.Context) (*domain.IdempotencyRecord, error) {
+			rec, err := getByKey(ctx, first, r.env, key)
+			r.replicaFailed(ctx, i, err)
+			return rec, err
+		},
+		func(ctx context.Context) (*domain.IdempotencyRecord, error) { return getByKey(ctx, second, r.env, key) },
+	)
+}
+
+// GetByKeyPrimary reads the record from the primary, never hedging across
+// replicas, whose lag could hide a key just inserted or its latest status.
+func (r *PostgresRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	return getByKey(ctx, r.db, r.env, key)
+}
+
+// GetByPaymentID reads through the payment_id unique index, from the
+// primary or hedged across replicas like GetByKey.
+func (r *PostgresRepository) GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	i := r.upReplica()
+	if i < 0 {
+		return getByPaymentID(ctx, r.db, r.env, paymentID)
+	}
+	first, second := r.readTargets(i)
+	return hedgedRead(ctx, r.hedgeDelay,
+		func(ctx context.Context) (*domain.IdempotencyRecord, error) {
+			rec, err := getByPaymentID(ctx, first, r.env, paymentID)
+			r.replicaFailed(ctx, i, err)
+			return rec, err
+		},
+		func(ctx context.Context) (*domain.IdempotencyRecord, error) {
+			return getByPaymentID(ctx, second, r.env, paymentID)
+		},
+	)
+}
+
+func getByKey(ctx context.Context, db *sql.DB, env, key string) (*domain.IdempotencyRecord, error) {
+	rec, err := getRecord(ctx, db, "idempotency_key", env, key)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrKeyNotFound
+	}
+	return rec, wrap(ctx, "get by key", err)
+}
+
+func getByPaymentID(ctx context.Context, db *sql.DB, env, paymentID string) (*domain.IdempotencyRecord, error) {
+	rec, err := getRecord(ctx, db, "payment_id", env, paymentID)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrPaymentNotFound
+	}
+	return rec, wrap(ctx, "get by payment id", err)
+}
+
+// getRecord reads the record whose column, a unique key, equals value.
+func getRecord(ctx context.Context, db *sql.DB, column, env, value string) (*domain.IdempotencyRecord, error) {
 	var rec domain.IdempotencyRecord
 	var responseBody sql.NullString
 	var completedAt sql.NullTime
+	var responseStatus sql.NullInt64
+	var responseHeaders, metadata []byte
 
-	err := r.db.QueryRowContext(ctx, `
-		SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, first_seen_at, last_seen_at, completed_at, expires_at
-		FROM idempotency_keys WHERE idempotency_key = $1
-	`, key).Scan(
+	err := db.QueryRowContext(ctx, `
+		SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, version, first_seen_at, last_seen_at, completed_at, expires_at, response_status, response_headers, processing_since, COALESCE(body_hash, ''), metadata
+		FROM idempotency_keys WHERE environment = $1 AND `+column+` = $2
+	`, env, value).Scan(
 		&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
 		&rec.Amount, &rec.Currency, &rec.Status, &rec.RequestHash,
-		&responseBody, &rec.PaymentID, &rec.AttemptCount,
+		&responseBody, &rec.PaymentID, &rec.AttemptCount, &rec.Version,
 		&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &rec.ExpiresAt,
+		&responseStatus, &responseHeaders, &rec.ProcessingSince, &rec.BodyHash, &metadata,
 	)
-	if err == sql.ErrNoRows {
-		return nil, domain.ErrKeyNotFound
-	}
 	if err != nil {
-		return nil, fmt.Errorf("get by key: %w", err)
+		return nil, err
 	}
 	if responseBody.Valid {
 		raw := json.RawMessage(responseBody.String)
@@ -150,27 +382,64 @@ func (r *PostgresRepository) GetByKey(ctx context.Context, key string) (*domain.
 	if completedAt.Valid {
 		rec.CompletedAt = &completedAt.Time
 	}
+	rec.Metadata = json.RawMessage(metadata)
+	if err := setStoredResponse(&rec, responseStatus, responseHeaders); err != nil {
+		return nil, err
+	}
 	return &rec, nil
 }
 
-func (r *PostgresRepository) MarkComplete(ctx context.Context, key string, status domain.Status, responseBody *json.RawMessage) error {
-	var bodyVal interface{}
-	if responseBody != nil {
-		bodyVal = string(*responseBody)
+// jsonValue is raw as a query argument, NULL when it is empty.
+func jsonValue(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// setStoredResponse fills in the response status and headers scanned from
+// the response_status and response_headers columns.
+func setStoredResponse(rec *domain.IdempotencyRecord, status sql.NullInt64, headers []byte) error {
+	rec.ResponseStatus = int(status.Int64)
+	if headers == nil {
+		return nil
+	}
+	if err := json.Unmarshal(headers, &rec.ResponseHeaders); err != nil {
+		return fmt.Errorf("decode response headers: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var bodyVal, headersVal interface{}
+	if resp.Body != nil {
+		bodyVal = string(*resp.Body)
+	}
+	if len(resp.Headers) > 0 {
+		headers, err := json.Marshal(resp.Headers)
+		if err != nil {
+			return wrap(ctx, "mark complete", err)
+		}
+		headersVal = string(headers)
 	}
 
 	res, err := r.db.ExecContext(ctx, `
-		UPDATE idempotency_keys SET status = $1, response_body = $2, completed_at = NOW()
-		WHERE idempotency_key = $3 AND status = 'processing'
-	`, string(status), bodyVal, key)
+		UPDATE idempotency_keys SET status = $1, response_body = $2, response_status = NULLIF($5, 0), response_headers = $6,
+			completed_at = NOW(), version = version + 1
+		WHERE environment = $3 AND idempotency_key = $4 AND status = 'processing'
+	`, string(status), bodyVal, r.env, key, resp.Status, headersVal)
 	if err != nil {
-		return fmt.Errorf("mark complete: %w", err)
+		return wrap(ctx, "mark complete", err)
 	}
 	rows, _ := res.RowsAffected()
 	if rows == 0 {
 		// Check if the key exists at all
 		var exists bool
-		r.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE idempotency_key = $1)", key).Scan(&exists)
+		if err := r.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE environment = $1 AND idempotency_key = $2)", r.env, key).Scan(&exists); err != nil {
+			return wrap(ctx, "mark complete", err)
+		}
 		if !exists {
 			return domain.ErrKeyNotFound
 		}
@@ -179,111 +448,433 @@ func (r *PostgresRepository) MarkComplete(ctx context.Context, key string, statu
 	return nil
 }
 
-func (r *PostgresRepository) ResetToProcessing(ctx context.Context, key string, newPaymentID string, expiresAt time.Time) error {
-	_, err := r.db.ExecContext(ctx, `
-		UPDATE idempotency_keys SET status = 'processing', payment_id = $1, completed_at = NULL, expires_at = $2, last_seen_at = NOW()
-		WHERE idempotency_key = $3 AND status = 'failed'
-	`, newPaymentID, expiresAt, key)
-	return err
+// ResetToProcessing compares and swaps on version: a duplicate that read the
+// record before a concurrent reset or completion finds the version moved on
+// and gets domain.ErrConcurrentUpdate instead of starting a second attempt.
+func (r *PostgresRepository) ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = 'processing', payment_id = $1, completed_at = NULL, expires_at = $2, last_seen_at = NOW(),
+			processing_since = NOW(), version = version + 1
+		WHERE environment = $3 AND idempotency_key = $4 AND version = $5
+	`, newPaymentID, expiresAt, r.env, key, version)
+	if isPaymentIDConflict(err) {
+		err = domain.ErrPaymentIDConflict
+	}
+	if err != nil {
+		return wrap(ctx, "reset to processing", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
 }
 
-func (r *PostgresRepository) DeleteExpired(ctx context.Context) (int64, error) {
-	res, err := r.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+// UpdateParams compares and swaps on version like ResetToProcessing, so of
+// two differing retries racing for a key only one replaces its parameters.
+func (r *PostgresRepository) UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET customer_id = $1, amount = $2, currency = $3, request_hash = $4, body_hash = NULLIF($5, ''),
+			metadata = $6, last_seen_at = NOW(), version = version + 1
+		WHERE environment = $7 AND idempotency_key = $8 AND version = $9
+	`, req.CustomerID, req.Amount, req.Currency, req.Hash(), req.BodyHash, jsonValue(req.Metadata), r.env, key, version)
 	if err != nil {
-		return 0, err
+		return wrap(ctx, "update params", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// ExpireKey keeps an earlier expiry and bumps the version, so a duplicate
+// that read the key before fails its reset with domain.ErrConcurrentUpdate.
+func (r *PostgresRepository) ExpireKey(ctx context.Context, key string) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET expires_at = LEAST(expires_at, NOW()), version = version + 1
+		WHERE environment = $1 AND idempotency_key = $2
+	`, r.env, key)
+	if err != nil {
+		return wrap(ctx, "expire key", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrKeyNotFound
+	}
+	return nil
+}
+
+// ResetKey compares and swaps on version like ResetToProcessing. The row and
+// its payment attempts stay until the sweeper deletes or archives them.
+func (r *PostgresRepository) ResetKey(ctx context.Context, key string, version int64) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = 'failed', completed_at = COALESCE(completed_at, NOW()),
+			expires_at = LEAST(expires_at, NOW()), version = version + 1
+		WHERE environment = $1 AND idempotency_key = $2 AND version = $3
+	`, r.env, key, version)
+	if err != nil {
+		return wrap(ctx, "reset key", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// paymentIDConstraint keeps payment IDs unique (migration 013).
+const paymentIDConstraint = "idempotency_keys_payment_id_key"
+
+// isPaymentIDConflict reports whether err is a unique violation on payment_id.
+func isPaymentIDConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == paymentIDConstraint
+}
+
+// DeleteExpired deletes one batch of this environment's keys through
+// idx_expires_at; payment attempts go with their keys by cascade. Keys an
+// admin action left restorable wait until their restore window passes.
+func (r *PostgresRepository) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE id IN (
+			SELECT id FROM idempotency_keys WHERE expires_at < NOW() AND environment = $2
+				AND (restorable_until IS NULL OR restorable_until <= NOW()) LIMIT $1
+		)
+	`, limit, r.env)
+	if err != nil {
+		return 0, wrap(ctx, "delete expired", err)
 	}
 	return res.RowsAffected()
 }
 
-func (r *PostgresRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time) ([]domain.IdempotencyRecord, error) {
-	rows, err := r.db.QueryContext(ctx, `
-		SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, first_seen_at, last_seen_at, completed_at, expires_at
-		FROM idempotency_keys
-		WHERE merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3 AND attempt_count > 1
-		ORDER BY attempt_count DESC
-	`, merchantID, from, to)
+// CountExpired counts this environment's expired keys the sweeper would
+// remove, stopping at limit so a large backlog costs no more than a small
+// one.
+func (r *PostgresRepository) CountExpired(ctx context.Context, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var n int64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM idempotency_keys WHERE expires_at < NOW() AND environment = $2
+				AND (restorable_until IS NULL OR restorable_until <= NOW()) LIMIT $1
+		) expired
+	`, limit, r.env).Scan(&n)
 	if err != nil {
-		return nil, fmt.Errorf("get duplicates: %w", err)
+		return 0, wrap(ctx, "count expired", err)
+	}
+	return n, nil
+}
+
+// GetDuplicates orders by id after attempt_count so pages are stable. The
+// total comes from a window count; a page past the end counts separately.
+// Like the other reports it reads from a replica when one is configured.
+func (r *PostgresRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	query := `
+		SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, version, first_seen_at, last_seen_at, completed_at, expires_at, metadata,
+			(SELECT COUNT(DISTINCT a.source_ip) FROM payment_attempts a
+			 WHERE a.environment = k.environment AND a.idempotency_key = k.idempotency_key),
+			COUNT(*) OVER ()
+		FROM idempotency_keys k
+		WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3 AND attempt_count > 1
+		ORDER BY attempt_count DESC, id`
+	args := []interface{}{merchantID, from, to, r.env}
+	if page.Limit > 0 {
+		query += ` LIMIT $5 OFFSET $6`
+		args = append(args, page.Limit, page.Offset)
 	}
-	defer rows.Close()
 
 	var records []domain.IdempotencyRecord
-	for rows.Next() {
-		var rec domain.IdempotencyRecord
-		var responseBody sql.NullString
-		var completedAt sql.NullTime
-		if err := rows.Scan(
-			&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
-			&rec.Amount, &rec.Currency, &rec.Status, &rec.RequestHash,
-			&responseBody, &rec.PaymentID, &rec.AttemptCount,
-			&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &rec.ExpiresAt,
-		); err != nil {
-			return nil, fmt.Errorf("scan duplicate: %w", err)
+	total := 0
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		records, total = nil, 0
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return wrap(ctx, "get duplicates", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var rec domain.IdempotencyRecord
+			var responseBody sql.NullString
+			var completedAt sql.NullTime
+			var metadata []byte
+			if err := rows.Scan(
+				&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
+				&rec.Amount, &rec.Currency, &rec.Status, &rec.RequestHash,
+				&responseBody, &rec.PaymentID, &rec.AttemptCount, &rec.Version,
+				&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &rec.ExpiresAt,
+				&metadata, &rec.DistinctSources, &total,
+			); err != nil {
+				return wrap(ctx, "scan duplicate", err)
+			}
+			rec.Metadata = json.RawMessage(metadata)
+			if responseBody.Valid {
+				raw := json.RawMessage(responseBody.String)
+				rec.ResponseBody = &raw
+			}
+			if completedAt.Valid {
+				rec.CompletedAt = &completedAt.Time
+			}
+			records = append(records, rec)
+		}
+		if err := rows.Err(); err != nil {
+			return wrap(ctx, "get duplicates", err)
+		}
+		if len(records) == 0 && page.Offset > 0 {
+			err = db.QueryRowContext(ctx, `
+				SELECT COUNT(*) FROM idempotency_keys
+				WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3 AND attempt_count > 1
+			`, merchantID, from, to, r.env).Scan(&total)
+		}
+		return wrap(ctx, "count duplicates", err)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// StreamDuplicates runs the GetDuplicates query without the window count and
+// hands each row to fn as it is scanned. A replica failing after rows were
+// handed over is not retried on the primary, which would repeat them.
+func (r *PostgresRepository) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	return r.reportRead(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, payment_id, attempt_count,
+				first_seen_at, last_seen_at, completed_at, metadata,
+				(SELECT COUNT(DISTINCT a.source_ip) FROM payment_attempts a
+				 WHERE a.environment = k.environment AND a.idempotency_key = k.idempotency_key)
+			FROM idempotency_keys k
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3 AND attempt_count > 1
+			ORDER BY attempt_count DESC, id
+		`, merchantID, from, to, r.env)
+		if err != nil {
+			return wrap(ctx, "stream duplicates", err)
 		}
-		if responseBody.Valid {
-			raw := json.RawMessage(responseBody.String)
-			rec.ResponseBody = &raw
+		defer rows.Close()
+
+		streamed := false
+		for rows.Next() {
+			var rec domain.IdempotencyRecord
+			var completedAt sql.NullTime
+			var metadata []byte
+			if err := rows.Scan(
+				&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
+				&rec.Amount, &rec.Currency, &rec.Status, &rec.PaymentID, &rec.AttemptCount,
+				&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &metadata, &rec.DistinctSources,
+			); err != nil {
+				return partialRead(streamed, wrap(ctx, "scan duplicate", err))
+			}
+			rec.Metadata = json.RawMessage(metadata)
+			if completedAt.Valid {
+				rec.CompletedAt = &completedAt.Time
+			}
+			streamed = true
+			if err := fn(rec); err != nil {
+				return &partialReadError{err: err}
+			}
 		}
-		if completedAt.Valid {
-			rec.CompletedAt = &completedAt.Time
+		return partialRead(streamed, wrap(ctx, "stream duplicates", rows.Err()))
+	})
+}
+
+func (r *PostgresRepository) GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var atRisk map[string]int64
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT currency, SUM(amount * (attempt_count - 1))::bigint
+			FROM idempotency_keys
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3 AND attempt_count > 1
+			GROUP BY currency
+		`, merchantID, from, to, r.env)
+		if err != nil {
+			return wrap(ctx, "get amount at risk", err)
 		}
-		records = append(records, rec)
+		defer rows.Close()
+
+		atRisk = make(map[string]int64)
+		for rows.Next() {
+			var currency string
+			var amount int64
+			if err := rows.Scan(&currency, &amount); err != nil {
+				return wrap(ctx, "scan amount at risk", err)
+			}
+			atRisk[currency] = amount
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
-	return records, rows.Err()
+	return atRisk, nil
 }
 
 func (r *PostgresRepository) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
 	var total, unique int
-	err := r.db.QueryRowContext(ctx, `
-		SELECT COALESCE(SUM(attempt_count), 0), COUNT(*)
-		FROM idempotency_keys
-		WHERE merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3
-	`, merchantID, from, to).Scan(&total, &unique)
-	return total, unique, err
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(attempt_count), 0), COUNT(*)
+			FROM idempotency_keys
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3
+		`, merchantID, from, to, r.env).Scan(&total, &unique)
+	})
+	return total, unique, wrap(ctx, "get merchant stats", err)
+}
+
+func (r *PostgresRepository) GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var o domain.MerchantOutcomes
+	var avg sql.NullFloat64
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FILTER (WHERE attempt_count > 1),
+			       COUNT(*) FILTER (WHERE status = 'succeeded'),
+			       COUNT(*) FILTER (WHERE status = 'failed'),
+			       COUNT(*) FILTER (WHERE status = 'processing'),
+			       AVG(EXTRACT(EPOCH FROM completed_at - processing_since) * 1000) FILTER (WHERE completed_at IS NOT NULL)
+			FROM idempotency_keys
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3
+		`, merchantID, from, to, r.env).Scan(&o.RetriedKeys, &o.Succeeded, &o.Failed, &o.Processing, &avg)
+	})
+	if avg.Valid {
+		o.AvgCompletionMs = &avg.Float64
+	}
+	return o, wrap(ctx, "get merchant outcomes", err)
+}
+
+// GetDuplicateTrends groups through idx_merchant_time; bucket is whole seconds.
+func (r *PostgresRepository) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	width := int64(bucket / time.Second)
+	var buckets []domain.TrendBucket
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		buckets = nil
+		rows, err := db.QueryContext(ctx, `
+			SELECT FLOOR(EXTRACT(EPOCH FROM first_seen_at) / $5)::BIGINT AS b, SUM(attempt_count), COUNT(*)
+			FROM idempotency_keys
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3
+			GROUP BY b
+			ORDER BY b
+		`, merchantID, from, to, r.env, width)
+		if err != nil {
+			return wrap(ctx, "get duplicate trends", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var n int64
+			var b domain.TrendBucket
+			if err := rows.Scan(&n, &b.TotalRequests, &b.UniquePayments); err != nil {
+				return wrap(ctx, "scan duplicate trend", err)
+			}
+			b.Start = time.Unix(n*width, 0).UTC()
+			buckets = append(buckets, b)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
 }
 
 func (r *PostgresRepository) GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error) {
-	var p domain.MerchantPolicy
-	err := r.db.QueryRowContext(ctx, `
-		SELECT merchant_id, retry_policy, expiry_hours, created_at, updated_at
-		FROM merchant_policies WHERE merchant_id = $1
-	`, merchantID).Scan(&p.MerchantID, &p.RetryPolicy, &p.ExpiryHours, &p.CreatedAt, &p.UpdatedAt)
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	p, err := scanPolicy(r.db.QueryRowContext(ctx, `SELECT `+policyColumns+` FROM merchant_policies WHERE merchant_id = $1`, merchantID))
 	if err == sql.ErrNoRows {
 		return nil, domain.ErrMerchantNotFound
 	}
-	return &p, err
+	if err != nil {
+		return nil, wrap(ctx, "get policy", err)
+	}
+	return p, nil
 }
 
 func (r *PostgresRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
-	_, err := r.db.ExecContext(ctx, `
-		INSERT INTO merchant_policies (merchant_id, retry_policy, expiry_hours, created_at, updated_at)
-		VALUES ($1, $2, $3, NOW(), NOW())
-		ON CONFLICT (merchant_id) DO UPDATE SET
-			retry_policy = $2, expiry_hours = $3, updated_at = NOW()
-	`, policy.MerchantID, policy.RetryPolicy, policy.ExpiryHours)
-	return err
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	return wrap(ctx, "upsert policy", upsertPolicy(ctx, r.db, policy))
 }
 
 func (r *PostgresRepository) GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error) {
-	rows, err := r.db.QueryContext(ctx, `
-		SELECT merchant_id, COALESCE(SUM(attempt_count), 0), COUNT(*)
-		FROM idempotency_keys
-		WHERE first_seen_at >= $1 AND first_seen_at <= $2
-		GROUP BY merchant_id
-	`, from, to)
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var stats map[string][2]int
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT merchant_id, COALESCE(SUM(attempt_count), 0), COUNT(*)
+			FROM idempotency_keys
+			WHERE environment = $3 AND first_seen_at >= $1 AND first_seen_at <= $2
+			GROUP BY merchant_id
+		`, from, to, r.env)
+		if err != nil {
+			return wrap(ctx, "get all merchant stats", err)
+		}
+		defer rows.Close()
+
+		stats = make(map[string][2]int)
+		for rows.Next() {
+			var mid string
+			var total, unique int
+			if err := rows.Scan(&mid, &total, &unique); err != nil {
+				return wrap(ctx, "scan merchant stats", err)
+			}
+			stats[mid] = [2]int{total, unique}
+		}
+		return rows.Err()
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return stats, nil
+}
 
-	stats := make(map[string][2]int)
-	for rows.Next() {
-		var mid string
-		var total, unique int
-		if err := rows.Scan(&mid, &total, &unique); err != nil {
-			return nil, err
+func (r *PostgresRepository) GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var stats map[string]domain.AmountStats
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT currency, COUNT(*), AVG(amount)::float8, COALESCE(STDDEV_POP(amount), 0)::float8
+			FROM idempotency_keys
+			WHERE environment = $4 AND merchant_id = $1 AND first_seen_at >= $2 AND first_seen_at <= $3
+			GROUP BY currency
+		`, merchantID, from, to, r.env)
+		if err != nil {
+			return wrap(ctx, "get amount stats", err)
+		}
+		defer rows.Close()
+
+		stats = make(map[string]domain.AmountStats)
+		for rows.Next() {
+			var currency string
+			var st domain.AmountStats
+			if err := rows.Scan(&currency, &st.Count, &st.Mean, &st.StdDev); err != nil {
+				return wrap(ctx, "scan amount stats", err)
+			}
+			stats[currency] = st
 		}
-		stats[mid] = [2]int{total, unique}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
-	return stats, rows.Err()
+	return stats, nil
 }
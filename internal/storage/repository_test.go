@@ -66,3 +66,27 @@ func TestRecordIsExpired(t *testing.T) {
 		t.Error("zero time should be expired")
 	}
 }
+
+func TestTableStats_Ratios(t *testing.T) {
+	ts := TableStats{LiveTuples: 80, DeadTuples: 20, ModsSinceAnalyze: 40}
+	if ts.DeadRatio() != 0.2 {
+		t.Errorf("expected 0.2 dead ratio, got %v", ts.DeadRatio())
+	}
+	if ts.ModifiedRatio() != 0.5 {
+		t.Errorf("expected 0.5 modified ratio, got %v", ts.ModifiedRatio())
+	}
+
+	empty := TableStats{}
+	if empty.DeadRatio() != 0 || empty.ModifiedRatio() != 0 {
+		t.Error("empty table should have zero ratios")
+	}
+}
+
+func TestIsMaintainedTable(t *testing.T) {
+	if !isMaintainedTable("idempotency_keys") {
+		t.Error("idempotency_keys should be maintained")
+	}
+	if isMaintainedTable("users; DROP TABLE x") {
+		t.Error("unknown tables must be rejected")
+	}
+}
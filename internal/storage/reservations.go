@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// ReserveKey reserves key for merchantID until expiresAt. Reserving a key
+// the merchant already holds extends it; an expired reservation of another
+// merchant is taken over. A key held by another merchant is
+// domain.ErrKeyReserved and one a live payment uses is domain.ErrKeyInUse.
+func (r *PostgresRepository) ReserveKey(ctx context.Context, key, merchantID string, expiresAt time.Time) (*domain.KeyReservation, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res := domain.KeyReservation{IdempotencyKey: key, MerchantID: merchantID}
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO key_reservations (environment, idempotency_key, merchant_id, reserved_at, expires_at)
+		SELECT $1, $2, $3, NOW(), $4
+		WHERE NOT EXISTS (
+			SELECT 1 FROM idempotency_keys
+			WHERE environment = $1 AND idempotency_key = $2 AND expires_at > NOW()
+		)
+		ON CONFLICT (environment, idempotency_key) DO UPDATE SET
+			merchant_id = EXCLUDED.merchant_id, reserved_at = EXCLUDED.reserved_at, expires_at = EXCLUDED.expires_at
+		WHERE key_reservations.merchant_id = EXCLUDED.merchant_id OR key_reservations.expires_at <= NOW()
+		RETURNING reserved_at, expires_at
+	`, r.env, key, merchantID, expiresAt).Scan(&res.ReservedAt, &res.ExpiresAt)
+	if err == sql.ErrNoRows {
+		var used bool
+		err = r.db.QueryRowContext(ctx, `
+			SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE environment = $1 AND idempotency_key = $2 AND expires_at > NOW())
+		`, r.env, key).Scan(&used)
+		if err == nil && used {
+			return nil, domain.ErrKeyInUse
+		}
+		if err == nil {
+			return nil, domain.ErrKeyReserved
+		}
+	}
+	if err != nil {
+		return nil, wrap(ctx, "reserve key", err)
+	}
+	return &res, nil
+}
+
+// CheckReservation reports whether merchantID holds a reservation of key.
+// A live reservation of another merchant is domain.ErrKeyReserved; a lapsed
+// one is ignored and left for the sweeper.
+func (r *PostgresRepository) CheckReservation(ctx context.Context, key, merchantID string) (bool, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var own, live bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT merchant_id = $3, expires_at > NOW() FROM key_reservations
+		WHERE environment = $1 AND idempotency_key = $2
+	`, r.env, key, merchantID).Scan(&own, &live)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, wrap(ctx, "check reservation", err)
+	case own:
+		return true, nil
+	case live:
+		return false, domain.ErrKeyReserved
+	}
+	return false, nil
+}
+
+// ClaimReservation deletes merchantID's reservation of key, if it still
+// holds one, after its payment was stored.
+func (r *PostgresRepository) ClaimReservation(ctx context.Context, key, merchantID string) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, `
+		DELETE FROM key_reservations WHERE environment = $1 AND idempotency_key = $2 AND merchant_id = $3
+	`, r.env, key, merchantID)
+	if err != nil {
+		return wrap(ctx, "claim reservation", err)
+	}
+	return nil
+}
+
+// DeleteExpiredReservations deletes one batch of this environment's
+// reservations that expired unclaimed, through
+// idx_key_reservations_expires_at.
+func (r *PostgresRepository) DeleteExpiredReservations(ctx context.Context, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM key_reservations WHERE ctid IN (
+			SELECT ctid FROM key_reservations WHERE expires_at <= NOW() AND environment = $2 LIMIT $1
+		)
+	`, limit, r.env)
+	if err != nil {
+		return 0, wrap(ctx, "delete expired reservations", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// SaveRestorePoint keeps on key's row what the admin action undid: prior's
+// status, completion, expiry and version, restorable until until. The
+// action must have left the row at prior's version plus one; a row that
+// moved on since returns domain.ErrConcurrentUpdate and keeps no restore
+// point.
+func (r *PostgresRepository) SaveRestorePoint(ctx context.Context, key, action string, prior domain.IdempotencyRecord, until time.Time) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var completedAt interface{}
+	if prior.CompletedAt != nil {
+		completedAt = *prior.CompletedAt
+	}
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET admin_action = $3, admin_action_at = NOW(), prior_status = $4, prior_completed_at = $5,
+			prior_expires_at = $6, prior_version = $7, restorable_until = $8
+		WHERE environment = $1 AND idempotency_key = $2 AND version = $7 + 1
+	`, r.env, key, action, string(prior.Status), completedAt, prior.ExpiresAt, prior.Version, until)
+	if err != nil {
+		return wrap(ctx, "save restore point", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// RestoreKey puts back the status, completion and expiry key had before its
+// last admin action and bumps the version. It returns domain.ErrKeyNotFound
+// for a key that is gone, domain.ErrNothingToRestore when no restore point
+// is left or its window passed, and domain.ErrKeyReused when the key's
+// version moved on since the action, as when a new payment used it.
+func (r *PostgresRepository) RestoreKey(ctx context.Context, key string) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrap(ctx, "begin tx", err)
+	}
+	defer tx.Rollback()
+
+	var restorable, unchanged bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(admin_action IS NOT NULL AND restorable_until > NOW(), false), COALESCE(version = prior_version + 1, false)
+		FROM idempotency_keys WHERE environment = $1 AND idempotency_key = $2
+		FOR UPDATE
+	`, r.env, key).Scan(&restorable, &unchanged)
+	if err == sql.ErrNoRows {
+		return domain.ErrKeyNotFound
+	}
+	if err != nil {
+		return wrap(ctx, "restore key", err)
+	}
+	if !restorable {
+		return domain.ErrNothingToRestore
+	}
+	if !unchanged {
+		return domain.ErrKeyReused
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = prior_status, completed_at = prior_completed_at, expires_at = prior_expires_at,
+			version = version + 1, admin_action = NULL, admin_action_at = NULL, prior_status = NULL, prior_completed_at = NULL,
+			prior_expires_at = NULL, prior_version = NULL, restorable_until = NULL
+		WHERE environment = $1 AND idempotency_key = $2
+	`, r.env, key); err != nil {
+		return wrap(ctx, "restore key", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return wrap(ctx, "commit", err)
+	}
+	return nil
+}
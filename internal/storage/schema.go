@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// requiredColumns lists every column the repository reads or writes.
+var requiredColumns = map[string][]string{
+	"idempotency_keys": {
+		"id", "idempotency_key", "merchant_id", "customer_id", "amount", "currency",
+		"status", "request_hash", "response_body", "payment_id", "attempt_count",
+		"first_seen_at", "last_seen_at", "completed_at", "expires_at", "environment", "version",
+		"response_status", "response_headers", "processing_since", "body_hash", "metadata",
+		"admin_action", "admin_action_at", "prior_status", "prior_completed_at", "prior_expires_at",
+		"prior_version", "restorable_until",
+	},
+	"merchant_policies": {
+		"merchant_id", "retry_policy", "expiry_hours", "created_at", "updated_at",
+		"response_schema", "duplicate_status_code", "tolerant_fields", "base_currency",
+		"fraud_export", "payment_id_format", "duplicate_alert_threshold", "duplicate_alert_url",
+		"rate_limit_rps", "rate_limit_burst", "max_expiry_hours", "signing_secret", "hash_metadata",
+		"storm_threshold", "mismatch_behavior",
+	},
+	"merchant_digests": {
+		"merchant_id", "digest_date", "total_requests", "duplicates_blocked",
+		"amount_protected", "normalized", "new_suspicious_keys", "generated_at", "environment",
+	},
+	"payment_attempts": {
+		"id", "idempotency_key", "source_ip", "user_agent", "request_id", "attempted_at", "environment",
+		"request_hash", "outcome",
+	},
+	"metrics_history": {
+		"id", "environment", "instance", "recorded_at", "period_start", "total_requests", "new_payments",
+		"duplicate_blocked", "retry_allowed", "cached_responses", "param_mismatches", "slow_queries",
+		"window_duplicate_rate", "latency_p95_ms",
+	},
+	"idempotency_keys_archive": {
+		"id", "idempotency_key", "merchant_id", "customer_id", "amount", "currency",
+		"status", "request_hash", "response_body", "payment_id", "attempt_count",
+		"first_seen_at", "last_seen_at", "completed_at", "expires_at", "environment", "version",
+		"response_status", "response_headers", "processing_since", "body_hash", "metadata", "archived_at",
+	},
+	"payment_attempts_archive": {
+		"id", "idempotency_key", "source_ip", "user_agent", "request_id", "attempted_at", "environment",
+		"request_hash", "outcome", "archived_at",
+	},
+	"key_reservations": {
+		"environment", "idempotency_key", "merchant_id", "reserved_at", "expires_at",
+	},
+	"webhook_dead_letters": {
+		"id", "environment", "merchant_id", "event", "endpoint", "payload", "attempts", "last_error",
+		"failed_at", "redelivered_at", "event_id",
+	},
+	"webhook_events": {
+		"id", "environment", "merchant_id", "event", "endpoint", "payload", "created_at", "event_id",
+	},
+	"webhook_deliveries": {
+		"environment", "event_id", "endpoint", "attempts", "last_attempt_at", "delivered_at", "last_error",
+	},
+}
+
+// requiredConstraints are the unique keys ON CONFLICT clauses and payment ID
+// regeneration depend on, written as "TYPE(column)".
+var requiredConstraints = map[string][]string{
+	"idempotency_keys":   {"UNIQUE(environment)", "UNIQUE(idempotency_key)", "UNIQUE(payment_id)"},
+	"merchant_policies":  {"PRIMARY KEY(merchant_id)"},
+	"merchant_digests":   {"PRIMARY KEY(environment)", "PRIMARY KEY(merchant_id)", "PRIMARY KEY(digest_date)"},
+	"key_reservations":   {"PRIMARY KEY(environment)", "PRIMARY KEY(idempotency_key)"},
+	"webhook_deliveries": {"PRIMARY KEY(environment)", "PRIMARY KEY(event_id)", "PRIMARY KEY(endpoint)"},
+}
+
+// expectedIndexes are not required for correctness but their absence hurts
+// reporting and expiry queries.
+var expectedIndexes = map[string][]string{
+	"idempotency_keys": {"idx_merchant_time", "idx_expires_at", "idx_merchant_attempts", "idx_processing_last_seen", "idx_merchant_hash", "idx_key_prefix"},
+	"payment_attempts": {"idx_attempts_key"},
+	"metrics_history":  {"idx_metrics_history_time"},
+
+	"idempotency_keys_archive": {"idx_keys_archive_archived_at", "idx_keys_archive_key"},
+	"payment_attempts_archive": {"idx_attempts_archive_archived_at", "idx_attempts_archive_key"},
+	"key_reservations":         {"idx_key_reservations_expires_at"},
+	"webhook_dead_letters":     {"idx_webhook_dead_letters_failed_at"},
+	"webhook_events":           {"idx_webhook_events_merchant", "idx_webhook_events_created_at", "idx_webhook_events_event_id"},
+	"webhook_deliveries":       {"idx_webhook_deliveries_last_attempt"},
+}
+
+// schemaSnapshot is what was found in the database, keyed by table name.
+type schemaSnapshot struct {
+	columns     map[string]map[string]bool
+	constraints map[string]map[string]bool
+	indexes     map[string]map[string]bool
+}
+
+// Validate checks that the tables, columns, and constraints the repository
+// relies on exist. Missing indexes are returned as warnings rather than errors.
+func (s *Schema) Validate(ctx context.Context) ([]string, error) {
+	snap, err := s.inspect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("inspect schema: %w", err)
+	}
+	problems, warnings := checkSchema(snap)
+	if len(problems) > 0 {
+		return warnings, fmt.Errorf("database schema is incomplete (is DATABASE_DSN pointing at the right database?): %s",
+			strings.Join(problems, "; "))
+	}
+	return warnings, nil
+}
+
+func (s *Schema) inspect(ctx context.Context) (schemaSnapshot, error) {
+	snap := schemaSnapshot{
+		columns:     make(map[string]map[string]bool),
+		constraints: make(map[string]map[string]bool),
+		indexes:     make(map[string]map[string]bool),
+	}
+	add := func(m map[string]map[string]bool, table, item string) {
+		if m[table] == nil {
+			m[table] = make(map[string]bool)
+		}
+		m[table][item] = true
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()
+	`)
+	if err != nil {
+		return snap, err
+	}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return snap, err
+		}
+		add(snap.columns, table, column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return snap, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT tc.table_name, tc.constraint_type, kcu.column_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+			ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema
+		WHERE tc.table_schema = current_schema() AND tc.constraint_type IN ('UNIQUE', 'PRIMARY KEY')
+	`)
+	if err != nil {
+		return snap, err
+	}
+	for rows.Next() {
+		var table, kind, column string
+		if err := rows.Scan(&table, &kind, &column); err != nil {
+			rows.Close()
+			return snap, err
+		}
+		add(snap.constraints, table, kind+"("+column+")")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return snap, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT tablename, indexname FROM pg_indexes WHERE schemaname = current_schema()
+	`)
+	if err != nil {
+		return snap, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, index string
+		if err := rows.Scan(&table, &index); err != nil {
+			return snap, err
+		}
+		add(snap.indexes, table, index)
+	}
+	return snap, rows.Err()
+}
+
+// checkSchema compares a snapshot against the requirements above.
+func checkSchema(snap schemaSnapshot) (problems, warnings []string) {
+	for _, table := range sortedKeys(requiredColumns) {
+		cols, ok := snap.columns[table]
+		if !ok {
+			problems = append(problems, "missing table "+table+" (run migrations)")
+			continue
+		}
+		for _, col := range requiredColumns[table] {
+			if !cols[col] {
+				problems = append(problems, "missing column "+table+"."+col)
+			}
+		}
+		for _, c := range requiredConstraints[table] {
+			if !snap.constraints[table][c] {
+				problems = append(problems, "missing constraint "+c+" on "+table)
+			}
+		}
+	}
+	for _, table := range sortedKeys(expectedIndexes) {
+		if _, ok := snap.columns[table]; !ok {
+			continue
+		}
+		for _, idx := range expectedIndexes[table] {
+			if !snap.indexes[table][idx] {
+				warnings = append(warnings, "missing index "+idx+" on "+table+" (queries will be slower)")
+			}
+		}
+	}
+	return problems, warnings
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+// completeSnapshot returns a snapshot satisfying every requirement.
+func completeSnapshot() schemaSnapshot {
+	snap := schemaSnapshot{
+		columns:     make(map[string]map[string]bool),
+		constraints: make(map[string]map[string]bool),
+		indexes:     make(map[string]map[string]bool),
+	}
+	for table, cols := range requiredColumns {
+		snap.columns[table] = make(map[string]bool)
+		for _, c := range cols {
+			snap.columns[table][c] = true
+		}
+	}
+	for table, cs := range requiredConstraints {
+		snap.constraints[table] = make(map[string]bool)
+		for _, c := range cs {
+			snap.constraints[table][c] = true
+		}
+	}
+	for table, idxs := range expectedIndexes {
+		snap.indexes[table] = make(map[string]bool)
+		for _, i := range idxs {
+			snap.indexes[table][i] = true
+		}
+	}
+	return snap
+}
+
+func TestCheckSchema_Complete(t *testing.T) {
+	problems, warnings := checkSchema(completeSnapshot())
+	if len(problems) != 0 || len(warnings) != 0 {
+		t.Errorf("expected no findings, got problems=%v warnings=%v", problems, warnings)
+	}
+}
+
+func TestCheckSchema_MissingTable(t *testing.T) {
+	snap := completeSnapshot()
+	delete(snap.columns, "merchant_policies")
+
+	problems, _ := checkSchema(snap)
+	if len(problems) != 1 || !strings.Contains(problems[0], "missing table merchant_policies") {
+		t.Errorf("expected missing table problem, got %v", problems)
+	}
+}
+
+func TestCheckSchema_MissingColumnAndConstraint(t *testing.T) {
+	snap := completeSnapshot()
+	delete(snap.columns["idempotency_keys"], "attempt_count")
+	delete(snap.constraints["idempotency_keys"], "UNIQUE(idempotency_key)")
+
+	problems, _ := checkSchema(snap)
+	joined := strings.Join(problems, "; ")
+	if !strings.Contains(joined, "idempotency_keys.attempt_count") {
+		t.Errorf("expected missing column, got %v", problems)
+	}
+	if !strings.Contains(joined, "UNIQUE(idempotency_key)") {
+		t.Errorf("expected missing constraint, got %v", problems)
+	}
+}
+
+func TestCheckSchema_MissingIndexIsWarning(t *testing.T) {
+	snap := completeSnapshot()
+	delete(snap.indexes["idempotency_keys"], "idx_expires_at")
+
+	problems, warnings := checkSchema(snap)
+	if len(problems) != 0 {
+		t.Errorf("missing index should not be a problem, got %v", problems)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "idx_expires_at") {
+		t.Errorf("expected index warning, got %v", warnings)
+	}
+}
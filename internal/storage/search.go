@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// likeEscaper escapes LIKE wildcards so a key prefix matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchRecords builds its WHERE clause from the filter's non-zero fields.
+// Key prefixes use idx_key_prefix.
+func (r *PostgresRepository) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	where := []string{"environment = $1"}
+	args := []interface{}{r.env}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.MerchantID != "" {
+		add("merchant_id = $%d", filter.MerchantID)
+	}
+	if filter.CustomerID != "" {
+		add("customer_id = $%d", filter.CustomerID)
+	}
+	if filter.Status != "" {
+		add("status = $%d", string(filter.Status))
+	}
+	if filter.MinAmount != nil {
+		add("amount >= $%d", *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		add("amount <= $%d", *filter.MaxAmount)
+	}
+	if !filter.From.IsZero() {
+		add("first_seen_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("first_seen_at <= $%d", filter.To)
+	}
+	if filter.KeyPrefix != "" {
+		add(`idempotency_key LIKE $%d ESCAPE '\'`, likeEscaper.Replace(filter.KeyPrefix)+"%")
+	}
+	cond := strings.Join(where, " AND ")
+
+	query := `
+		SELECT id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash, response_body, payment_id, attempt_count, version, first_seen_at, last_seen_at, completed_at, expires_at, response_status, response_headers, processing_since, COALESCE(body_hash, ''), metadata,
+			COUNT(*) OVER ()
+		FROM idempotency_keys
+		WHERE ` + cond + `
+		ORDER BY first_seen_at DESC, id DESC`
+	queryArgs := args
+	if page.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+		queryArgs = append(append([]interface{}(nil), args...), page.Limit, page.Offset)
+	}
+	var records []domain.IdempotencyRecord
+	total := 0
+	err := r.reportRead(ctx, func(db *sql.DB) error {
+		records, total = nil, 0
+		rows, err := db.QueryContext(ctx, query, queryArgs...)
+		if err != nil {
+			return wrap(ctx, "search records", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var rec domain.IdempotencyRecord
+			var responseBody sql.NullString
+			var completedAt sql.NullTime
+			var responseStatus sql.NullInt64
+			var responseHeaders, metadata []byte
+			if err := rows.Scan(
+				&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID,
+				&rec.Amount, &rec.Currency, &rec.Status, &rec.RequestHash,
+				&responseBody, &rec.PaymentID, &rec.AttemptCount, &rec.Version,
+				&rec.FirstSeenAt, &rec.LastSeenAt, &completedAt, &rec.ExpiresAt,
+				&responseStatus, &responseHeaders, &rec.ProcessingSince, &rec.BodyHash, &metadata, &total,
+			); err != nil {
+				return wrap(ctx, "scan record", err)
+			}
+			if responseBody.Valid {
+				raw := json.RawMessage(responseBody.String)
+				rec.ResponseBody = &raw
+			}
+			if completedAt.Valid {
+				rec.CompletedAt = &completedAt.Time
+			}
+			rec.Metadata = json.RawMessage(metadata)
+			if err := setStoredResponse(&rec, responseStatus, responseHeaders); err != nil {
+				return wrap(ctx, "scan record", err)
+			}
+			records = append(records, rec)
+		}
+		if err := rows.Err(); err != nil {
+			return wrap(ctx, "search records", err)
+		}
+		// Past the last page the window count has no row to ride on.
+		if len(records) == 0 && page.Offset > 0 {
+			if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM idempotency_keys WHERE `+cond, args...).Scan(&total); err != nil {
+				return wrap(ctx, "count records", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
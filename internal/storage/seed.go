@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/kubo-market/idempotency-shield/internal/seed"
+)
+
+// Seed loads the sample merchants and payments. Rows that already exist are
+// left alone, so seeding twice is harmless.
+func (r *PostgresRepository) Seed(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, seed.GenerateSQL()); err != nil {
+		return wrap(ctx, "seed", err)
+	}
+	return nil
+}
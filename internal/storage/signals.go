@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// CountSameParams counts the merchant's other keys with the same request hash
+// first seen since the given time.
+func (r *PostgresRepository) CountSameParams(ctx context.Context, merchantID, requestHash, excludeKey string, since time.Time) (int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var n int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM idempotency_keys
+		WHERE environment = $1 AND merchant_id = $2 AND request_hash = $3
+			AND first_seen_at >= $4 AND idempotency_key <> $5
+	`, r.env, merchantID, requestHash, since, excludeKey).Scan(&n)
+	return n, wrap(ctx, "count same params", err)
+}
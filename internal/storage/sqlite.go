@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// sqliteSchema creates what SQLiteRepository needs. It mirrors the Postgres
+// tables the repository uses, with times stored as Unix nanoseconds and
+// tolerant_fields as a JSON array. Statements are idempotent, so it runs on
+// every open instead of through the migrations directory.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    environment      TEXT NOT NULL,
+    idempotency_key  TEXT NOT NULL,
+    merchant_id      TEXT NOT NULL,
+    customer_id      TEXT NOT NULL,
+    amount           INTEGER NOT NULL,
+    currency         TEXT NOT NULL,
+    status           TEXT NOT NULL CHECK(status IN ('processing','succeeded','failed')),
+    request_hash     TEXT NOT NULL,
+    body_hash        TEXT,
+    metadata         TEXT,
+    response_body    TEXT,
+    response_status  INTEGER,
+    response_headers TEXT,
+    payment_id       TEXT NOT NULL UNIQUE,
+    attempt_count    INTEGER NOT NULL DEFAULT 1,
+    version          INTEGER NOT NULL DEFAULT 1,
+    first_seen_at    INTEGER NOT NULL,
+    last_seen_at     INTEGER NOT NULL,
+    processing_since INTEGER NOT NULL,
+    completed_at     INTEGER,
+    expires_at       INTEGER NOT NULL,
+    UNIQUE (environment, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_merchant_time ON idempotency_keys(environment, merchant_id, first_seen_at);
+CREATE INDEX IF NOT EXISTS idx_expires_at ON idempotency_keys(expires_at);
+
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    environment     TEXT NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    source_ip       TEXT,
+    user_agent      TEXT,
+    request_id      TEXT,
+    attempted_at    INTEGER NOT NULL,
+    request_hash    TEXT,
+    outcome         TEXT,
+    FOREIGN KEY (environment, idempotency_key)
+        REFERENCES idempotency_keys(environment, idempotency_key) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_attempts_key ON payment_attempts(environment, idempotency_key);
+
+CREATE TABLE IF NOT EXISTS merchant_policies (
+    merchant_id               TEXT PRIMARY KEY,
+    retry_policy              TEXT NOT NULL,
+    expiry_hours              INTEGER NOT NULL,
+    response_schema           TEXT,
+    duplicate_status_code     INTEGER NOT NULL DEFAULT 0,
+    tolerant_fields           TEXT NOT NULL DEFAULT '[]',
+    base_currency             TEXT,
+    fraud_export              INTEGER NOT NULL DEFAULT 0,
+    payment_id_format         TEXT,
+    duplicate_alert_threshold INTEGER,
+    duplicate_alert_url       TEXT,
+    rate_limit_rps            REAL,
+    rate_limit_burst          INTEGER,
+    max_expiry_hours          INTEGER,
+    signing_secret            TEXT,
+    hash_metadata             INTEGER NOT NULL DEFAULT 0,
+    storm_threshold           INTEGER,
+    mismatch_behavior         TEXT,
+    created_at                INTEGER NOT NULL,
+    updated_at                INTEGER NOT NULL
+);
+`
+
+// sqliteAddedColumns are columns added to sqliteSchema's tables after they
+// were first released. CREATE TABLE IF NOT EXISTS leaves older databases
+// without them, so OpenSQLite adds any that are missing.
+var sqliteAddedColumns = []struct{ table, column, def string }{
+	{"merchant_policies", "signing_secret", "TEXT"},
+	{"payment_attempts", "request_hash", "TEXT"},
+	{"payment_attempts", "outcome", "TEXT"},
+	{"idempotency_keys", "metadata", "TEXT"},
+	{"merchant_policies", "hash_metadata", "INTEGER NOT NULL DEFAULT 0"},
+	{"merchant_policies", "storm_threshold", "INTEGER"},
+	{"merchant_policies", "mismatch_behavior", "TEXT"},
+}
+
+// sqliteBusyTimeoutMs is how long a connection waits for another one's write
+// lock before failing with SQLITE_BUSY.
+const sqliteBusyTimeoutMs = 5000
+
+// OpenSQLite opens, creating it if needed, the SQLite database at path and
+// applies sqliteSchema. Every connection runs in WAL mode, so reads do not
+// wait for writes, with foreign keys on for the attempts cascade.
+func OpenSQLite(path string) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeoutMs))
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "foreign_keys(1)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create sqlite schema: %w", err)
+	}
+	for _, c := range sqliteAddedColumns {
+		if err := addSQLiteColumn(db, c.table, c.column, c.def); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("add sqlite column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return db, nil
+}
+
+// addSQLiteColumn adds column to table unless it is already there; SQLite's
+// ADD COLUMN has no IF NOT EXISTS.
+func addSQLiteColumn(db *sql.DB, table, column, def string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?1) WHERE name = ?2`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def))
+	return err
+}
@@ -0,0 +1,776 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// sqliteKeyLocks is how many mutexes same-key inserts are striped across.
+const sqliteKeyLocks = 256
+
+// sqliteRecordColumns are the idempotency_keys columns scanSQLiteRecord reads.
+const sqliteRecordColumns = `id, idempotency_key, merchant_id, customer_id, amount, currency, status, request_hash,
+	COALESCE(body_hash, ''), metadata, response_body, response_status, response_headers, payment_id, attempt_count, version,
+	first_seen_at, last_seen_at, processing_since, completed_at, expires_at`
+
+// SQLiteRepository implements Repository on a local SQLite file, so the
+// shield can run as a sidecar with no database server. It keeps the same
+// concurrency defense as PostgresRepository, with a per-key mutex in place of
+// the advisory lock: only instances in one process may share a file. Like the
+// Redis and memory backends it stores keys, attempts and policies only.
+type SQLiteRepository struct {
+	db    *sql.DB
+	env   string
+	locks [sqliteKeyLocks]sync.Mutex
+	now   func() time.Time
+}
+
+// NewSQLiteRepository creates a new SQLiteRepository on a database opened
+// with OpenSQLite.
+func NewSQLiteRepository(db *sql.DB) *SQLiteRepository {
+	return &SQLiteRepository{db: db, env: domain.EnvironmentProduction, now: time.Now}
+}
+
+// WithEnvironment scopes every key and report to env, like
+// PostgresRepository.WithEnvironment.
+func (r *SQLiteRepository) WithEnvironment(env string) *SQLiteRepository {
+	r.env = env
+	return r
+}
+
+// lock serializes inserts of one key, standing in for pg_advisory_xact_lock.
+func (r *SQLiteRepository) lock(key string) func() {
+	mu := &r.locks[uint64(advisoryLockKey(r.env+":"+key))%sqliteKeyLocks]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// InsertOrGet uses the same layers as PostgresRepository.InsertOrGet: the
+// UNIQUE (environment, idempotency_key) constraint, one INSERT ... ON
+// CONFLICT statement, and a per-key mutex serializing same-key requests.
+func (r *SQLiteRepository) InsertOrGet(ctx context.Context, req domain.PaymentRequest, paymentID string, expiresAt time.Time) (*domain.IdempotencyRecord, bool, error) {
+	defer r.lock(req.IdempotencyKey)()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, logging.Wrap(ctx, "begin tx", err)
+	}
+	defer tx.Rollback()
+
+	now := r.now().UnixNano()
+	rec, err := scanSQLiteRecord(tx.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys (environment, idempotency_key, merchant_id, customer_id, amount, currency, status,
+			request_hash, body_hash, metadata, payment_id, first_seen_at, last_seen_at, processing_since, expires_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, 'processing', ?7, NULLIF(?8, ''), ?12, ?9, ?10, ?10, ?10, ?11)
+		ON CONFLICT (environment, idempotency_key) DO UPDATE SET
+			last_seen_at = excluded.last_seen_at,
+			attempt_count = attempt_count + 1
+		RETURNING `+sqliteRecordColumns,
+		r.env, req.IdempotencyKey, req.MerchantID, req.CustomerID, req.Amount, req.Currency,
+		req.Hash(), req.BodyHash, paymentID, now, expiresAt.UnixNano(), jsonValue(req.Metadata)))
+	if isSQLitePaymentIDConflict(err) {
+		return nil, false, logging.Wrap(ctx, "upsert", domain.ErrPaymentIDConflict)
+	}
+	if err != nil {
+		return nil, false, logging.Wrap(ctx, "upsert", err)
+	}
+
+	isNew := rec.AttemptCount == 1
+	src := req.Source
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_attempts (environment, idempotency_key, source_ip, user_agent, request_id, attempted_at, request_hash, outcome)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?)
+	`, r.env, req.IdempotencyKey, src.IP, src.UserAgent, src.RequestID, now,
+		req.Hash(), domain.AttemptOutcome(rec, req, isNew)); err != nil {
+		return nil, false, logging.Wrap(ctx, "record attempt", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, logging.Wrap(ctx, "commit", err)
+	}
+	return rec, isNew, nil
+}
+
+func (r *SQLiteRepository) GetByKey(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	rec, err := r.getRecord(ctx, "idempotency_key", key)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrKeyNotFound
+	}
+	return rec, logging.Wrap(ctx, "get by key", err)
+}
+
+// GetByKeyPrimary is GetByKey: this backend has no replicas.
+func (r *SQLiteRepository) GetByKeyPrimary(ctx context.Context, key string) (*domain.IdempotencyRecord, error) {
+	return r.GetByKey(ctx, key)
+}
+
+func (r *SQLiteRepository) GetByPaymentID(ctx context.Context, paymentID string) (*domain.IdempotencyRecord, error) {
+	rec, err := r.getRecord(ctx, "payment_id", paymentID)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrPaymentNotFound
+	}
+	return rec, logging.Wrap(ctx, "get by payment id", err)
+}
+
+// getRecord reads the record whose column, a unique key, equals value.
+func (r *SQLiteRepository) getRecord(ctx context.Context, column, value string) (*domain.IdempotencyRecord, error) {
+	return scanSQLiteRecord(r.db.QueryRowContext(ctx, `
+		SELECT `+sqliteRecordColumns+`
+		FROM idempotency_keys WHERE environment = ? AND `+column+` = ?
+	`, r.env, value))
+}
+
+func (r *SQLiteRepository) MarkComplete(ctx context.Context, key string, status domain.Status, resp domain.StoredResponse) error {
+	var bodyVal, headersVal interface{}
+	if resp.Body != nil {
+		bodyVal = string(*resp.Body)
+	}
+	if len(resp.Headers) > 0 {
+		headers, err := json.Marshal(resp.Headers)
+		if err != nil {
+			return logging.Wrap(ctx, "mark complete", err)
+		}
+		headersVal = string(headers)
+	}
+
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = ?, response_body = ?, response_status = NULLIF(?, 0), response_headers = ?,
+			completed_at = ?, version = version + 1
+		WHERE environment = ? AND idempotency_key = ? AND status = 'processing'
+	`, string(status), bodyVal, resp.Status, headersVal, r.now().UnixNano(), r.env, key)
+	if err != nil {
+		return logging.Wrap(ctx, "mark complete", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		var exists bool
+		r.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE environment = ? AND idempotency_key = ?)", r.env, key).Scan(&exists)
+		if !exists {
+			return domain.ErrKeyNotFound
+		}
+		return domain.ErrAlreadyCompleted
+	}
+	return nil
+}
+
+// ResetToProcessing compares and swaps on version like the Postgres one.
+func (r *SQLiteRepository) ResetToProcessing(ctx context.Context, key string, version int64, newPaymentID string, expiresAt time.Time) error {
+	now := r.now().UnixNano()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = 'processing', payment_id = ?, completed_at = NULL, expires_at = ?, last_seen_at = ?,
+			processing_since = ?, version = version + 1
+		WHERE environment = ? AND idempotency_key = ? AND version = ?
+	`, newPaymentID, expiresAt.UnixNano(), now, now, r.env, key, version)
+	if isSQLitePaymentIDConflict(err) {
+		err = domain.ErrPaymentIDConflict
+	}
+	if err != nil {
+		return logging.Wrap(ctx, "reset to processing", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// UpdateParams compares and swaps on version like the Postgres one.
+func (r *SQLiteRepository) UpdateParams(ctx context.Context, key string, version int64, req domain.PaymentRequest) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET customer_id = ?, amount = ?, currency = ?, request_hash = ?, body_hash = NULLIF(?, ''),
+			metadata = ?, last_seen_at = ?, version = version + 1
+		WHERE environment = ? AND idempotency_key = ? AND version = ?
+	`, req.CustomerID, req.Amount, req.Currency, req.Hash(), req.BodyHash, jsonValue(req.Metadata), r.now().UnixNano(), r.env, key, version)
+	if err != nil {
+		return logging.Wrap(ctx, "update params", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// ExpireKey keeps an earlier expiry and bumps the version like the Postgres
+// implementation.
+func (r *SQLiteRepository) ExpireKey(ctx context.Context, key string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET expires_at = MIN(expires_at, ?), version = version + 1
+		WHERE environment = ? AND idempotency_key = ?
+	`, r.now().UnixNano(), r.env, key)
+	if err != nil {
+		return logging.Wrap(ctx, "expire key", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrKeyNotFound
+	}
+	return nil
+}
+
+// ResetKey compares and swaps on version like the Postgres one.
+func (r *SQLiteRepository) ResetKey(ctx context.Context, key string, version int64) error {
+	now := r.now().UnixNano()
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = 'failed', completed_at = COALESCE(completed_at, ?),
+			expires_at = MIN(expires_at, ?), version = version + 1
+		WHERE environment = ? AND idempotency_key = ? AND version = ?
+	`, now, now, r.env, key, version)
+	if err != nil {
+		return logging.Wrap(ctx, "reset key", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return domain.ErrConcurrentUpdate
+	}
+	return nil
+}
+
+// isSQLitePaymentIDConflict reports whether err is a unique violation on
+// payment_id. The driver reports constraints by message only.
+func isSQLitePaymentIDConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: idempotency_keys.payment_id")
+}
+
+// DeleteExpired deletes one batch of this environment's keys; payment
+// attempts go with their keys by cascade.
+func (r *SQLiteRepository) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE id IN (
+			SELECT id FROM idempotency_keys WHERE expires_at < ? AND environment = ? LIMIT ?
+		)
+	`, r.now().UnixNano(), r.env, limit)
+	if err != nil {
+		return 0, logging.Wrap(ctx, "delete expired", err)
+	}
+	return res.RowsAffected()
+}
+
+// sqliteDuplicatesWhere selects a merchant's duplicates first seen in a
+// range, taking the environment, merchant, from and to as ?1 to ?4.
+const sqliteDuplicatesWhere = `environment = ?1 AND merchant_id = ?2 AND first_seen_at >= ?3 AND first_seen_at <= ?4 AND attempt_count > 1`
+
+// sqliteDistinctSources counts the source IPs seen for the key k.
+const sqliteDistinctSources = `(SELECT COUNT(DISTINCT a.source_ip) FROM payment_attempts a
+	WHERE a.environment = k.environment AND a.idempotency_key = k.idempotency_key)`
+
+// GetDuplicates pages like the Postgres query, with a window count for the
+// total.
+func (r *SQLiteRepository) GetDuplicates(ctx context.Context, merchantID string, from, to time.Time, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	query := `
+		SELECT ` + sqliteRecordColumns + `, ` + sqliteDistinctSources + `, COUNT(*) OVER ()
+		FROM idempotency_keys k
+		WHERE ` + sqliteDuplicatesWhere + `
+		ORDER BY attempt_count DESC, id`
+	args := []interface{}{r.env, merchantID, from.UnixNano(), to.UnixNano()}
+	if page.Limit > 0 {
+		query += ` LIMIT ?5 OFFSET ?6`
+		args = append(args, page.Limit, page.Offset)
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, logging.Wrap(ctx, "get duplicates", err)
+	}
+	defer rows.Close()
+
+	var records []domain.IdempotencyRecord
+	total := 0
+	for rows.Next() {
+		var sources int
+		rec, err := scanSQLiteRecord(rows, &sources, &total)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "scan duplicate", err)
+		}
+		rec.DistinctSources = sources
+		records = append(records, *rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, logging.Wrap(ctx, "get duplicates", err)
+	}
+	if len(records) == 0 && page.Offset > 0 {
+		err = r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM idempotency_keys WHERE `+sqliteDuplicatesWhere,
+			r.env, merchantID, from.UnixNano(), to.UnixNano()).Scan(&total)
+	}
+	return records, total, logging.Wrap(ctx, "count duplicates", err)
+}
+
+// StreamDuplicates runs the GetDuplicates query without the window count and
+// hands each row to fn as it is scanned.
+func (r *SQLiteRepository) StreamDuplicates(ctx context.Context, merchantID string, from, to time.Time, fn func(domain.IdempotencyRecord) error) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+sqliteRecordColumns+`, `+sqliteDistinctSources+`
+		FROM idempotency_keys k
+		WHERE `+sqliteDuplicatesWhere+`
+		ORDER BY attempt_count DESC, id
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return logging.Wrap(ctx, "stream duplicates", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sources int
+		rec, err := scanSQLiteRecord(rows, &sources)
+		if err != nil {
+			return logging.Wrap(ctx, "scan duplicate", err)
+		}
+		rec.DistinctSources = sources
+		if err := fn(*rec); err != nil {
+			return err
+		}
+	}
+	return logging.Wrap(ctx, "stream duplicates", rows.Err())
+}
+
+func (r *SQLiteRepository) GetAmountAtRisk(ctx context.Context, merchantID string, from, to time.Time) (map[string]int64, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT currency, SUM(amount * (attempt_count - 1))
+		FROM idempotency_keys
+		WHERE `+sqliteDuplicatesWhere+`
+		GROUP BY currency
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get amount at risk", err)
+	}
+	defer rows.Close()
+
+	atRisk := make(map[string]int64)
+	for rows.Next() {
+		var currency string
+		var amount int64
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, logging.Wrap(ctx, "scan amount at risk", err)
+		}
+		atRisk[currency] = amount
+	}
+	return atRisk, rows.Err()
+}
+
+func (r *SQLiteRepository) GetMerchantStats(ctx context.Context, merchantID string, from, to time.Time) (int, int, error) {
+	var total, unique int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(attempt_count), 0), COUNT(*)
+		FROM idempotency_keys
+		WHERE environment = ? AND merchant_id = ? AND first_seen_at >= ? AND first_seen_at <= ?
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano()).Scan(&total, &unique)
+	return total, unique, logging.Wrap(ctx, "get merchant stats", err)
+}
+
+// GetMerchantOutcomes averages in nanoseconds, the unit times are stored in.
+func (r *SQLiteRepository) GetMerchantOutcomes(ctx context.Context, merchantID string, from, to time.Time) (domain.MerchantOutcomes, error) {
+	var o domain.MerchantOutcomes
+	var avg sql.NullFloat64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(attempt_count > 1), 0),
+		       COALESCE(SUM(status = 'succeeded'), 0),
+		       COALESCE(SUM(status = 'failed'), 0),
+		       COALESCE(SUM(status = 'processing'), 0),
+		       AVG(completed_at - processing_since)
+		FROM idempotency_keys
+		WHERE environment = ? AND merchant_id = ? AND first_seen_at >= ? AND first_seen_at <= ?
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano()).Scan(&o.RetriedKeys, &o.Succeeded, &o.Failed, &o.Processing, &avg)
+	if avg.Valid {
+		ms := avg.Float64 / float64(time.Millisecond)
+		o.AvgCompletionMs = &ms
+	}
+	return o, logging.Wrap(ctx, "get merchant outcomes", err)
+}
+
+// GetDuplicateTrends groups on first_seen_at, which is already in the
+// nanoseconds bucket is measured in.
+func (r *SQLiteRepository) GetDuplicateTrends(ctx context.Context, merchantID string, from, to time.Time, bucket time.Duration) ([]domain.TrendBucket, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT first_seen_at / ?5 AS b, SUM(attempt_count), COUNT(*)
+		FROM idempotency_keys
+		WHERE environment = ?1 AND merchant_id = ?2 AND first_seen_at >= ?3 AND first_seen_at <= ?4
+		GROUP BY b
+		ORDER BY b
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano(), int64(bucket))
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get duplicate trends", err)
+	}
+	defer rows.Close()
+
+	var buckets []domain.TrendBucket
+	for rows.Next() {
+		var n int64
+		var b domain.TrendBucket
+		if err := rows.Scan(&n, &b.TotalRequests, &b.UniquePayments); err != nil {
+			return nil, logging.Wrap(ctx, "scan duplicate trend", err)
+		}
+		b.Start = time.Unix(0, n*int64(bucket)).UTC()
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func (r *SQLiteRepository) GetPolicy(ctx context.Context, merchantID string) (*domain.MerchantPolicy, error) {
+	p, err := scanSQLitePolicy(r.db.QueryRowContext(ctx, `SELECT `+policyColumns+` FROM merchant_policies WHERE merchant_id = ?`, merchantID))
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrMerchantNotFound
+	}
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get policy", err)
+	}
+	return p, nil
+}
+
+func (r *SQLiteRepository) UpsertPolicy(ctx context.Context, policy domain.MerchantPolicy) error {
+	return logging.Wrap(ctx, "upsert policy", upsertSQLitePolicy(ctx, r.db, policy, r.now()))
+}
+
+// ListPolicies mirrors the Postgres query.
+func (r *SQLiteRepository) ListPolicies(ctx context.Context, page domain.Page) ([]domain.MerchantPolicy, int, error) {
+	query := `SELECT ` + policyColumns + `, COUNT(*) OVER () FROM merchant_policies ORDER BY merchant_id`
+	var args []interface{}
+	if page.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, page.Limit, page.Offset)
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, logging.Wrap(ctx, "list policies", err)
+	}
+	defer rows.Close()
+
+	var policies []domain.MerchantPolicy
+	total := 0
+	for rows.Next() {
+		p, err := scanSQLitePolicy(rows, &total)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "list policies", err)
+		}
+		policies = append(policies, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, logging.Wrap(ctx, "list policies", err)
+	}
+	if len(policies) == 0 && page.Offset > 0 {
+		if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM merchant_policies`).Scan(&total); err != nil {
+			return nil, 0, logging.Wrap(ctx, "count policies", err)
+		}
+	}
+	return policies, total, nil
+}
+
+// UpsertPolicies writes every policy in one transaction, all with the same
+// updated_at.
+func (r *SQLiteRepository) UpsertPolicies(ctx context.Context, policies []domain.MerchantPolicy) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return logging.Wrap(ctx, "upsert policies", err)
+	}
+	defer tx.Rollback()
+	now := r.now()
+	for _, policy := range policies {
+		if err := upsertSQLitePolicy(ctx, tx, policy, now); err != nil {
+			return logging.Wrap(ctx, "upsert policies", err)
+		}
+	}
+	return logging.Wrap(ctx, "upsert policies", tx.Commit())
+}
+
+func (r *SQLiteRepository) DeletePolicy(ctx context.Context, merchantID string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM merchant_policies WHERE merchant_id = ?`, merchantID)
+	if err != nil {
+		return logging.Wrap(ctx, "delete policy", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrMerchantNotFound
+	}
+	return nil
+}
+
+// scanSQLitePolicy scans policyColumns, then any extra columns into extra.
+// tolerant_fields is a JSON array and the times are Unix nanoseconds.
+func scanSQLitePolicy(row rowScanner, extra ...interface{}) (*domain.MerchantPolicy, error) {
+	var p domain.MerchantPolicy
+	var responseSchema, baseCurrency, paymentIDFormat, alertURL, signingSecret, mismatchBehavior sql.NullString
+	var alertThreshold, rateLimitBurst, maxExpiryHours, stormThreshold sql.NullInt64
+	var rateLimitRPS sql.NullFloat64
+	var tolerant string
+	var createdAt, updatedAt int64
+	dest := append([]interface{}{
+		&p.MerchantID, &p.RetryPolicy, &p.ExpiryHours, &responseSchema, &p.DuplicateStatusCode,
+		&tolerant, &baseCurrency, &p.FraudExport, &paymentIDFormat, &alertThreshold, &alertURL,
+		&rateLimitRPS, &rateLimitBurst, &maxExpiryHours, &signingSecret, &p.HashMetadata, &stormThreshold, &mismatchBehavior, &createdAt, &updatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tolerant), &p.TolerantFields); err != nil {
+		return nil, fmt.Errorf("decode tolerant fields: %w", err)
+	}
+	if responseSchema.Valid {
+		raw := json.RawMessage(responseSchema.String)
+		p.ResponseSchema = &raw
+	}
+	p.BaseCurrency = baseCurrency.String
+	p.PaymentIDFormat = paymentIDFormat.String
+	p.DuplicateAlertThreshold = int(alertThreshold.Int64)
+	p.DuplicateAlertURL = alertURL.String
+	p.RateLimitRPS = rateLimitRPS.Float64
+	p.RateLimitBurst = int(rateLimitBurst.Int64)
+	p.MaxExpiryHours = int(maxExpiryHours.Int64)
+	p.SigningSecret = signingSecret.String
+	p.StormThreshold = int(stormThreshold.Int64)
+	p.MismatchBehavior = mismatchBehavior.String
+	p.CreatedAt = time.Unix(0, createdAt).UTC()
+	p.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return &p, nil
+}
+
+// upsertSQLitePolicy creates or replaces policy as of now, keeping its
+// created_at.
+func upsertSQLitePolicy(ctx context.Context, db execer, policy domain.MerchantPolicy, now time.Time) error {
+	tolerant := policy.TolerantFields
+	if tolerant == nil {
+		tolerant = []string{}
+	}
+	tolerantJSON, err := json.Marshal(tolerant)
+	if err != nil {
+		return err
+	}
+	var responseSchema interface{}
+	if policy.ResponseSchema != nil {
+		responseSchema = string(*policy.ResponseSchema)
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO merchant_policies (merchant_id, retry_policy, expiry_hours, response_schema, duplicate_status_code, tolerant_fields, base_currency,
+			fraud_export, payment_id_format, duplicate_alert_threshold, duplicate_alert_url, rate_limit_rps, rate_limit_burst, max_expiry_hours, signing_secret,
+			hash_metadata, storm_threshold, mismatch_behavior, created_at, updated_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, NULLIF(?7, ''), ?8, NULLIF(?9, ''), NULLIF(?10, 0), NULLIF(?11, ''), NULLIF(?12, 0.0), NULLIF(?13, 0), NULLIF(?14, 0), NULLIF(?16, ''), ?17, NULLIF(?18, 0), NULLIF(?19, ''), ?15, ?15)
+		ON CONFLICT (merchant_id) DO UPDATE SET
+			retry_policy = excluded.retry_policy, expiry_hours = excluded.expiry_hours, response_schema = excluded.response_schema,
+			duplicate_status_code = excluded.duplicate_status_code, tolerant_fields = excluded.tolerant_fields,
+			base_currency = excluded.base_currency, fraud_export = excluded.fraud_export, payment_id_format = excluded.payment_id_format,
+			duplicate_alert_threshold = excluded.duplicate_alert_threshold, duplicate_alert_url = excluded.duplicate_alert_url,
+			rate_limit_rps = excluded.rate_limit_rps, rate_limit_burst = excluded.rate_limit_burst,
+			max_expiry_hours = excluded.max_expiry_hours, signing_secret = excluded.signing_secret,
+			hash_metadata = excluded.hash_metadata, storm_threshold = excluded.storm_threshold,
+			mismatch_behavior = excluded.mismatch_behavior, updated_at = excluded.updated_at
+	`, policy.MerchantID, policy.RetryPolicy, policy.ExpiryHours, responseSchema, policy.DuplicateStatusCode, string(tolerantJSON),
+		policy.BaseCurrency, policy.FraudExport, policy.PaymentIDFormat, policy.DuplicateAlertThreshold, policy.DuplicateAlertURL,
+		policy.RateLimitRPS, policy.RateLimitBurst, policy.MaxExpiryHours, now.UnixNano(), policy.SigningSecret, policy.HashMetadata, policy.StormThreshold, policy.MismatchBehavior)
+	return err
+}
+
+func (r *SQLiteRepository) GetAllMerchantStats(ctx context.Context, from, to time.Time) (map[string][2]int, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT merchant_id, COALESCE(SUM(attempt_count), 0), COUNT(*)
+		FROM idempotency_keys
+		WHERE environment = ? AND first_seen_at >= ? AND first_seen_at <= ?
+		GROUP BY merchant_id
+	`, r.env, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get all merchant stats", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[string][2]int)
+	for rows.Next() {
+		var mid string
+		var total, unique int
+		if err := rows.Scan(&mid, &total, &unique); err != nil {
+			return nil, logging.Wrap(ctx, "scan merchant stats", err)
+		}
+		stats[mid] = [2]int{total, unique}
+	}
+	return stats, rows.Err()
+}
+
+// GetAmountStats derives the population standard deviation, STDDEV_POP in
+// Postgres, from the mean of squares since SQLite has no such aggregate.
+func (r *SQLiteRepository) GetAmountStats(ctx context.Context, merchantID string, from, to time.Time) (map[string]domain.AmountStats, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT currency, COUNT(*), AVG(amount), AVG(CAST(amount AS REAL) * amount)
+		FROM idempotency_keys
+		WHERE environment = ? AND merchant_id = ? AND first_seen_at >= ? AND first_seen_at <= ?
+		GROUP BY currency
+	`, r.env, merchantID, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get amount stats", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[string]domain.AmountStats)
+	for rows.Next() {
+		var currency string
+		var st domain.AmountStats
+		var meanSquare float64
+		if err := rows.Scan(&currency, &st.Count, &st.Mean, &meanSquare); err != nil {
+			return nil, logging.Wrap(ctx, "scan amount stats", err)
+		}
+		st.StdDev = math.Sqrt(math.Max(0, meanSquare-st.Mean*st.Mean))
+		stats[currency] = st
+	}
+	return stats, rows.Err()
+}
+
+// SearchRecords builds its WHERE clause from the filter's non-zero fields,
+// like the Postgres one. Key prefixes compare with substr, since LIKE is
+// case-insensitive in SQLite.
+func (r *SQLiteRepository) SearchRecords(ctx context.Context, filter domain.RecordFilter, page domain.Page) ([]domain.IdempotencyRecord, int, error) {
+	where := []string{"environment = ?1"}
+	args := []interface{}{r.env}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.MerchantID != "" {
+		add("merchant_id = ?%d", filter.MerchantID)
+	}
+	if filter.CustomerID != "" {
+		add("customer_id = ?%d", filter.CustomerID)
+	}
+	if filter.Status != "" {
+		add("status = ?%d", string(filter.Status))
+	}
+	if filter.MinAmount != nil {
+		add("amount >= ?%d", *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		add("amount <= ?%d", *filter.MaxAmount)
+	}
+	if !filter.From.IsZero() {
+		add("first_seen_at >= ?%d", filter.From.UnixNano())
+	}
+	if !filter.To.IsZero() {
+		add("first_seen_at <= ?%d", filter.To.UnixNano())
+	}
+	if filter.KeyPrefix != "" {
+		args = append(args, filter.KeyPrefix)
+		where = append(where, fmt.Sprintf("substr(idempotency_key, 1, length(?%d)) = ?%[1]d", len(args)))
+	}
+	cond := strings.Join(where, " AND ")
+
+	query := `
+		SELECT ` + sqliteRecordColumns + `, COUNT(*) OVER ()
+		FROM idempotency_keys
+		WHERE ` + cond + `
+		ORDER BY first_seen_at DESC, id DESC`
+	queryArgs := args
+	if page.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT ?%d OFFSET ?%d`, len(args)+1, len(args)+2)
+		queryArgs = append(append([]interface{}(nil), args...), page.Limit, page.Offset)
+	}
+	rows, err := r.db.QueryContext(ctx, query, queryArgs...)
+	if err != nil {
+		return nil, 0, logging.Wrap(ctx, "search records", err)
+	}
+	defer rows.Close()
+
+	var records []domain.IdempotencyRecord
+	total := 0
+	for rows.Next() {
+		rec, err := scanSQLiteRecord(rows, &total)
+		if err != nil {
+			return nil, 0, logging.Wrap(ctx, "scan record", err)
+		}
+		records = append(records, *rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, logging.Wrap(ctx, "search records", err)
+	}
+	// Past the last page the window count has no row to ride on.
+	if len(records) == 0 && page.Offset > 0 {
+		if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM idempotency_keys WHERE `+cond, args...).Scan(&total); err != nil {
+			return nil, 0, logging.Wrap(ctx, "count records", err)
+		}
+	}
+	return records, total, nil
+}
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSQLiteRecord scans sqliteRecordColumns, then any extra columns into
+// extra.
+func scanSQLiteRecord(row rowScanner, extra ...interface{}) (*domain.IdempotencyRecord, error) {
+	var rec domain.IdempotencyRecord
+	var metadata, responseBody sql.NullString
+	var responseStatus, completedAt sql.NullInt64
+	var responseHeaders []byte
+	var firstSeen, lastSeen, processingSince, expires int64
+	dest := append([]interface{}{
+		&rec.ID, &rec.IdempotencyKey, &rec.MerchantID, &rec.CustomerID, &rec.Amount, &rec.Currency, &rec.Status,
+		&rec.RequestHash, &rec.BodyHash, &metadata, &responseBody, &responseStatus, &responseHeaders, &rec.PaymentID,
+		&rec.AttemptCount, &rec.Version, &firstSeen, &lastSeen, &processingSince, &completedAt, &expires,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if metadata.Valid {
+		rec.Metadata = json.RawMessage(metadata.String)
+	}
+	if responseBody.Valid {
+		raw := json.RawMessage(responseBody.String)
+		rec.ResponseBody = &raw
+	}
+	if completedAt.Valid {
+		t := time.Unix(0, completedAt.Int64).UTC()
+		rec.CompletedAt = &t
+	}
+	rec.FirstSeenAt = time.Unix(0, firstSeen).UTC()
+	rec.LastSeenAt = time.Unix(0, lastSeen).UTC()
+	rec.ProcessingSince = time.Unix(0, processingSince).UTC()
+	rec.ExpiresAt = time.Unix(0, expires).UTC()
+	if err := setStoredResponse(&rec, responseStatus, responseHeaders); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// GetAttempts mirrors the Postgres query; attempted_at is Unix nanoseconds.
+func (r *SQLiteRepository) GetAttempts(ctx context.Context, key string) ([]domain.Attempt, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT attempted_at, request_hash, source_ip, user_agent, request_id, outcome FROM (
+			SELECT id, attempted_at, COALESCE(request_hash, '') AS request_hash, COALESCE(source_ip, '') AS source_ip,
+				COALESCE(user_agent, '') AS user_agent, COALESCE(request_id, '') AS request_id, COALESCE(outcome, '') AS outcome
+			FROM payment_attempts
+			WHERE environment = ?1 AND idempotency_key = ?2
+			ORDER BY attempted_at DESC, id DESC
+			LIMIT ?3
+		)
+		ORDER BY attempted_at, id
+	`, r.env, key, domain.MaxAttemptHistory)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get attempts", err)
+	}
+	attempts, err := scanAttempts(rows, func(dst *domain.Attempt) interface{} { return unixNanoTime{&dst.AttemptedAt} })
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get attempts", err)
+	}
+	if len(attempts) > 0 {
+		return attempts, nil
+	}
+	var exists bool
+	err = r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM idempotency_keys WHERE environment = ? AND idempotency_key = ?)
+	`, r.env, key).Scan(&exists)
+	if err != nil {
+		return nil, logging.Wrap(ctx, "get attempts", err)
+	}
+	if !exists {
+		return nil, domain.ErrKeyNotFound
+	}
+	return attempts, nil
+}
+
+// unixNanoTime scans a Unix nanosecond column into t, in UTC.
+type unixNanoTime struct{ t *time.Time }
+
+func (u unixNanoTime) Scan(v interface{}) error {
+	n, ok := v.(int64)
+	if !ok {
+		return fmt.Errorf("unix nanoseconds: unexpected %T", v)
+	}
+	*u.t = time.Unix(0, n).UTC()
+	return nil
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func newTestSQLite(t *testing.T) *SQLiteRepository {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "shield.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewSQLiteRepository(db)
+}
+
+func TestSQLiteRepository_Lifecycle(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "k1", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD",
+		Source: domain.AttemptSource{IP: "10.0.0.1"}}
+
+	rec, isNew, err := repo.InsertOrGet(ctx, req, "pay_a", time.Now().Add(time.Hour))
+	if err != nil || !isNew || rec.Version != 1 || rec.Status != domain.StatusProcessing {
+		t.Fatalf("insert: %+v %v %v", rec, isNew, err)
+	}
+	req.Source.IP = "10.0.0.2"
+	if rec, isNew, _ = repo.InsertOrGet(ctx, req, "pay_b", time.Now().Add(time.Hour)); isNew || rec.AttemptCount != 2 || rec.PaymentID != "pay_a" {
+		t.Fatalf("expected the existing record, got %+v", rec)
+	}
+	other := req
+	other.IdempotencyKey = "k2"
+	if _, _, err := repo.InsertOrGet(ctx, other, "pay_a", time.Now().Add(time.Hour)); !errors.Is(err, domain.ErrPaymentIDConflict) {
+		t.Errorf("expected a payment ID conflict, got %v", err)
+	}
+
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{Status: 402, Headers: map[string]string{"X-Reason": "declined"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := repo.GetByKey(ctx, "k1"); rec.ResponseStatus != 402 || rec.ResponseHeaders["X-Reason"] != "declined" || rec.CompletedAt == nil {
+		t.Errorf("expected the stored response, got %+v", rec)
+	}
+	if err := repo.MarkComplete(ctx, "k1", domain.StatusFailed, domain.StoredResponse{}); err != domain.ErrAlreadyCompleted {
+		t.Errorf("expected ErrAlreadyCompleted, got %v", err)
+	}
+	if err := repo.MarkComplete(ctx, "missing", domain.StatusFailed, domain.StoredResponse{}); err != domain.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := repo.ResetToProcessing(ctx, "k1", 1, "pay_c", time.Now().Add(time.Hour)); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected a stale version to lose, got %v", err)
+	}
+	if err := repo.ResetToProcessing(ctx, "k1", 2, "pay_c", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetByPaymentID(ctx, "pay_a"); err != domain.ErrPaymentNotFound {
+		t.Errorf("expected the old payment ID to stop resolving, got %v", err)
+	}
+	if rec, err := repo.GetByPaymentID(ctx, "pay_c"); err != nil || rec.Status != domain.StatusProcessing || rec.Version != 3 || rec.CompletedAt != nil {
+		t.Errorf("unexpected record after reset: %+v %v", rec, err)
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now()
+	dups, total, err := repo.GetDuplicates(ctx, "m1", from, to, domain.Page{Limit: 10})
+	if err != nil || len(dups) != 1 || total != 1 || dups[0].DistinctSources != 2 {
+		t.Errorf("unexpected duplicates: %+v %d %v", dups, total, err)
+	}
+	if _, total, _ := repo.GetDuplicates(ctx, "m1", from, to, domain.Page{Limit: 10, Offset: 10}); total != 1 {
+		t.Errorf("expected the total past the last page, got %d", total)
+	}
+	var streamed int
+	if err := repo.StreamDuplicates(ctx, "m1", from, to, func(domain.IdempotencyRecord) error { streamed++; return nil }); err != nil || streamed != 1 {
+		t.Errorf("expected one streamed duplicate, got %d %v", streamed, err)
+	}
+	if atRisk, err := repo.GetAmountAtRisk(ctx, "m1", from, to); err != nil || atRisk["USD"] != 1000 {
+		t.Errorf("unexpected amount at risk: %v %v", atRisk, err)
+	}
+	if total, unique, err := repo.GetMerchantStats(ctx, "m1", from, to); total != 2 || unique != 1 || err != nil {
+		t.Errorf("unexpected stats: %d %d %v", total, unique, err)
+	}
+	if o, err := repo.GetMerchantOutcomes(ctx, "m1", from, to); err != nil || o.RetriedKeys != 1 || o.Processing != 1 || o.AvgCompletionMs != nil {
+		t.Errorf("unexpected outcomes: %+v %v", o, err)
+	}
+	if all, _ := repo.GetAllMerchantStats(ctx, from, to); all["m1"] != [2]int{2, 1} {
+		t.Errorf("unexpected merchant stats: %v", all)
+	}
+	if trends, err := repo.GetDuplicateTrends(ctx, "m1", from, to, time.Minute); err != nil || len(trends) != 1 || trends[0].TotalRequests != 2 {
+		t.Errorf("unexpected trends: %+v %v", trends, err)
+	}
+	if amounts, err := repo.GetAmountStats(ctx, "m1", from, to); err != nil || amounts["USD"].Count != 1 || amounts["USD"].Mean != 1000 || amounts["USD"].StdDev != 0 {
+		t.Errorf("unexpected amount stats: %+v %v", amounts, err)
+	}
+	if recs, total, err := repo.SearchRecords(ctx, domain.RecordFilter{KeyPrefix: "K"}, domain.Page{Limit: 10}); err != nil || total != 0 || len(recs) != 0 {
+		t.Errorf("expected key prefixes to be case sensitive, got %d %v", total, err)
+	}
+	if recs, total, err := repo.SearchRecords(ctx, domain.RecordFilter{MerchantID: "m1", KeyPrefix: "k"}, domain.Page{Limit: 10}); err != nil || total != 1 || recs[0].IdempotencyKey != "k1" {
+		t.Errorf("unexpected search: %+v %d %v", recs, total, err)
+	}
+
+	if err := repo.ResetToProcessing(ctx, "k1", 3, "pay_d", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.DeleteExpired(ctx, 100); n != 1 || err != nil {
+		t.Errorf("expected one expired key, got %d %v", n, err)
+	}
+	if _, err := repo.GetByKey(ctx, "k1"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected the expired key gone, got %v", err)
+	}
+	var attempts int
+	repo.db.QueryRow("SELECT COUNT(*) FROM payment_attempts").Scan(&attempts)
+	if attempts != 0 {
+		t.Errorf("expected the attempts deleted by cascade, got %d", attempts)
+	}
+}
+
+func TestSQLiteRepository_Policy(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	if _, err := repo.GetPolicy(ctx, "m1"); err != domain.ErrMerchantNotFound {
+		t.Fatalf("expected ErrMerchantNotFound, got %v", err)
+	}
+	policy := domain.MerchantPolicy{MerchantID: "m1", RetryPolicy: "lenient", ExpiryHours: 48,
+		TolerantFields: []string{"currency"}, RateLimitRPS: 2.5, MaxExpiryHours: 72, SigningSecret: "s3cret"}
+	if err := repo.UpsertPolicy(ctx, policy); err != nil {
+		t.Fatal(err)
+	}
+	policy.FraudExport = true
+	policy.HashMetadata = true
+	policy.MismatchBehavior = domain.MismatchAcceptLatest
+	if err := repo.UpsertPolicy(ctx, policy); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetPolicy(ctx, "m1")
+	if err != nil || got.RetryPolicy != "lenient" || got.ExpiryHours != 48 || !got.FraudExport || !got.HashMetadata || len(got.TolerantFields) != 1 ||
+		got.RateLimitRPS != 2.5 || got.MaxExpiryHours != 72 || got.SigningSecret != "s3cret" || got.BaseCurrency != "" || got.ResponseSchema != nil ||
+		got.MismatchBehavior != domain.MismatchAcceptLatest {
+		t.Errorf("unexpected policy: %+v %v", got, err)
+	}
+}
+
+func TestSQLiteRepository_Metadata(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "k1", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD",
+		Metadata: json.RawMessage(`{"order_id":"A1"}`)}
+	for _, id := range []string{"pay_a", "pay_b"} {
+		if _, _, err := repo.InsertOrGet(ctx, req, id, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec, err := repo.GetByKey(ctx, "k1"); err != nil || string(rec.Metadata) != `{"order_id":"A1"}` {
+		t.Errorf("expected the metadata back, got %+v %v", rec, err)
+	}
+	dups, _, err := repo.GetDuplicates(ctx, "m1", time.Now().Add(-time.Hour), time.Now(), domain.Page{})
+	if err != nil || len(dups) != 1 || string(dups[0].Metadata) != `{"order_id":"A1"}` {
+		t.Errorf("expected the metadata in duplicates, got %+v %v", dups, err)
+	}
+
+	req.IdempotencyKey, req.Metadata = "k2", nil
+	if rec, _, err := repo.InsertOrGet(ctx, req, "pay_c", time.Now().Add(time.Hour)); err != nil || rec.Metadata != nil {
+		t.Errorf("expected no metadata, got %+v %v", rec, err)
+	}
+}
+
+func TestSQLiteRepository_ConcurrentInserts(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "race", MerchantID: "m1", CustomerID: "c1", Amount: 500, Currency: "USD"}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, isNew, err := repo.InsertOrGet(ctx, req, "pay_"+string(rune('a'+i)), time.Now().Add(time.Hour))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if isNew {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rec, _ := repo.GetByKey(ctx, "race"); created != 1 || rec.AttemptCount != 20 {
+		t.Errorf("expected one insert and 20 attempts, got %d and %+v", created, rec)
+	}
+}
+
+func TestSQLiteRepository_MerchantOutcomes(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	for _, key := range []string{"ok", "declined", "pending"} {
+		req := domain.PaymentRequest{IdempotencyKey: key, MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD"}
+		if _, _, err := repo.InsertOrGet(ctx, req, "pay_"+key, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo.MarkComplete(ctx, "ok", domain.StatusSucceeded, domain.StoredResponse{})
+	repo.MarkComplete(ctx, "declined", domain.StatusFailed, domain.StoredResponse{})
+
+	o, err := repo.GetMerchantOutcomes(ctx, "m1", time.Now().Add(-time.Hour), time.Now())
+	if err != nil || o.Succeeded != 1 || o.Failed != 1 || o.Processing != 1 || o.RetriedKeys != 0 {
+		t.Fatalf("unexpected outcomes: %+v %v", o, err)
+	}
+	if o.AvgCompletionMs == nil || *o.AvgCompletionMs < 0 || *o.AvgCompletionMs > 1000 {
+		t.Errorf("expected a short average completion, got %v", o.AvgCompletionMs)
+	}
+}
+
+func TestSQLiteRepository_ExpireAndResetKey(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "stuck", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD"}
+	if _, _, err := repo.InsertOrGet(ctx, req, "pay_1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.ExpireKey(ctx, "stuck"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByKey(ctx, "stuck")
+	if err != nil || !rec.IsExpired() || rec.Version != 2 {
+		t.Fatalf("expected the key expired at version 2, got %+v %v", rec, err)
+	}
+
+	if err := repo.ResetKey(ctx, "stuck", 1); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate at a stale version, got %v", err)
+	}
+	if err := repo.ResetKey(ctx, "stuck", 2); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = repo.GetByKey(ctx, "stuck")
+	if err != nil || rec.Status != domain.StatusFailed || !rec.IsExpired() || rec.Version != 3 {
+		t.Fatalf("expected the key failed and expired in place at version 3, got %+v %v", rec, err)
+	}
+	if _, err := repo.GetAttempts(ctx, "stuck"); err != nil {
+		t.Errorf("expected the attempts kept with the key, got %v", err)
+	}
+	if err := repo.ExpireKey(ctx, "missing"); err != domain.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteRepository_DeleteExpiredKeepsOtherEnvironments(t *testing.T) {
+	live := newTestSQLite(t)
+	sandbox := NewSQLiteRepository(live.db).WithEnvironment(domain.EnvironmentSandbox)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "old", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD"}
+	for _, repo := range []*SQLiteRepository{live, sandbox} {
+		if _, _, err := repo.InsertOrGet(ctx, req, "pay_"+repo.env, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := sandbox.DeleteExpired(ctx, 10); n != 1 || err != nil {
+		t.Fatalf("expected the sandbox key deleted, got %d %v", n, err)
+	}
+	if _, err := live.GetByKey(ctx, "old"); err != nil {
+		t.Errorf("expected the production key left for its own sweeper, got %v", err)
+	}
+}
+
+func TestSQLiteRepository_UpdateParams(t *testing.T) {
+	repo := newTestSQLite(t)
+	ctx := context.Background()
+	req := domain.PaymentRequest{IdempotencyKey: "k1", MerchantID: "m1", CustomerID: "c1", Amount: 1000, Currency: "USD"}
+	repo.InsertOrGet(ctx, req, "pay_1", time.Now().Add(time.Hour))
+
+	latest := req
+	latest.Amount, latest.Metadata = 2500, json.RawMessage(`{"order_id":"A2"}`)
+	if err := repo.UpdateParams(ctx, "k1", 1, latest); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByKey(ctx, "k1")
+	if err != nil || rec.Amount != 2500 || rec.RequestHash != latest.Hash() || string(rec.Metadata) != `{"order_id":"A2"}` || rec.Version != 2 {
+		t.Errorf("expected the latest params at version 2, got %+v %v", rec, err)
+	}
+	if err := repo.UpdateParams(ctx, "k1", 1, req); err != domain.ErrConcurrentUpdate {
+		t.Errorf("expected ErrConcurrentUpdate for a stale version, got %v", err)
+	}
+}
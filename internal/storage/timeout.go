@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/logging"
+)
+
+// bound limits ctx to the repository's query timeout, when it has one.
+// Callers defer the returned cancel.
+func (r *PostgresRepository) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, r.queryTimeout, domain.ErrTimeout)
+}
+
+// timedOut reports err as domain.ErrTimeout when the query timeout bound
+// ctx expired. A caller that gave up, or a deadline of its own, keeps err as
+// it is.
+func timedOut(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, domain.ErrTimeout) || !errors.Is(context.Cause(ctx), domain.ErrTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", domain.ErrTimeout, err)
+}
+
+// wrap is logging.Wrap for PostgresRepository calls, with timedOut applied.
+func wrap(ctx context.Context, op string, err error) error {
+	return logging.Wrap(ctx, op, timedOut(ctx, err))
+}
+
+// lockNotAvailable is the SQLSTATE of a lock wait cut short by lock_timeout.
+const lockNotAvailable = "55P03"
+
+// isLockTimeout reports whether err is a lock wait that exceeded lock_timeout.
+func isLockTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == lockNotAvailable
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestBound_ReportsExpiryAsTimeout(t *testing.T) {
+	repo := NewPostgresRepository(nil).WithTimeouts(time.Millisecond, 0)
+	ctx, cancel := repo.bound(context.Background())
+	defer cancel()
+	<-ctx.Done()
+
+	err := wrap(ctx, "get by key", errors.New("pq: canceling statement due to user request"))
+	if !errors.Is(err, domain.ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if errors.Is(err, domain.ErrUnavailable) {
+		t.Error("a timeout should not read as an outage")
+	}
+}
+
+func TestBound_CallerCancelIsNotTimeout(t *testing.T) {
+	repo := NewPostgresRepository(nil).WithTimeouts(time.Minute, 0)
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := repo.bound(parent)
+	defer cancel()
+	cancelParent()
+
+	if err := timedOut(ctx, context.Canceled); errors.Is(err, domain.ErrTimeout) {
+		t.Errorf("caller cancellation reported as timeout: %v", err)
+	}
+}
+
+func TestBound_ZeroLeavesContext(t *testing.T) {
+	repo := NewPostgresRepository(nil)
+	ctx, cancel := repo.bound(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a query timeout")
+	}
+}
+
+func TestIsLockTimeout(t *testing.T) {
+	if !isLockTimeout(&pq.Error{Code: lockNotAvailable}) {
+		t.Error("expected 55P03 to be a lock timeout")
+	}
+	if isLockTimeout(&pq.Error{Code: "57014"}) || isLockTimeout(errors.New("boom")) {
+		t.Error("only 55P03 is a lock timeout")
+	}
+}
+
+func TestLockTimeout_IsNotBreakerFailure(t *testing.T) {
+	if isBreakerFailure(domain.ErrLockTimeout) {
+		t.Error("a key held by another request says nothing about the database's health")
+	}
+	if !isBreakerFailure(domain.ErrTimeout) {
+		t.Error("query timeouts should count toward the breaker")
+	}
+}
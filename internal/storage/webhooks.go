@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// webhookDeadLetterColumns are scanned by scanWebhookDeadLetter.
+const webhookDeadLetterColumns = `id, event_id, merchant_id, event, endpoint, payload, attempts, last_error, failed_at, redelivered_at`
+
+// SaveWebhookDeadLetter stores a delivery that failed every attempt.
+func (r *PostgresRepository) SaveWebhookDeadLetter(ctx context.Context, dl domain.WebhookDeadLetter) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO webhook_dead_letters (environment, event_id, merchant_id, event, endpoint, payload, attempts, last_error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, r.env, dl.EventID, dl.MerchantID, dl.Event, dl.Endpoint, []byte(dl.Payload), dl.Attempts, dl.LastError)
+	return wrap(ctx, "save webhook dead letter", err)
+}
+
+// ListWebhookDeadLetters returns a page of dead letters, newest first, with
+// the total.
+func (r *PostgresRepository) ListWebhookDeadLetters(ctx context.Context, page domain.Page) ([]domain.WebhookDeadLetter, int, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	query := `SELECT ` + webhookDeadLetterColumns + `, COUNT(*) OVER () FROM webhook_dead_letters
+		WHERE environment = $1 ORDER BY failed_at DESC, id DESC`
+	args := []interface{}{r.env}
+	if page.Limit > 0 {
+		query += ` LIMIT $2 OFFSET $3`
+		args = append(args, page.Limit, page.Offset)
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, wrap(ctx, "list webhook dead letters", err)
+	}
+	defer rows.Close()
+
+	var dead []domain.WebhookDeadLetter
+	total := 0
+	for rows.Next() {
+		dl, err := scanWebhookDeadLetter(rows, &total)
+		if err != nil {
+			return nil, 0, wrap(ctx, "list webhook dead letters", err)
+		}
+		dead = append(dead, *dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, wrap(ctx, "list webhook dead letters", err)
+	}
+	if len(dead) == 0 && page.Offset > 0 {
+		if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhook_dead_letters WHERE environment = $1`, r.env).Scan(&total); err != nil {
+			return nil, 0, wrap(ctx, "count webhook dead letters", err)
+		}
+	}
+	return dead, total, nil
+}
+
+// GetWebhookDeadLetter returns the dead letter with id, or
+// domain.ErrDeadLetterNotFound.
+func (r *PostgresRepository) GetWebhookDeadLetter(ctx context.Context, id int64) (*domain.WebhookDeadLetter, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	row := r.db.QueryRowContext(ctx, `SELECT `+webhookDeadLetterColumns+` FROM webhook_dead_letters
+		WHERE environment = $1 AND id = $2`, r.env, id)
+	dl, err := scanWebhookDeadLetter(row, nil)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, wrap(ctx, "get webhook dead letter", err)
+	}
+	return dl, nil
+}
+
+// RecordWebhookRedelivery records one manual redelivery of the dead letter
+// with id: the time it went through, or the attempt and why it failed.
+func (r *PostgresRepository) RecordWebhookRedelivery(ctx context.Context, id int64, deliveryErr error) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	query := `UPDATE webhook_dead_letters SET redelivered_at = NOW() WHERE environment = $1 AND id = $2`
+	args := []interface{}{r.env, id}
+	if deliveryErr != nil {
+		query = `UPDATE webhook_dead_letters SET attempts = attempts + 1, last_error = $3, failed_at = NOW()
+			WHERE environment = $1 AND id = $2`
+		args = append(args, deliveryErr.Error())
+	}
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return wrap(ctx, "record webhook redelivery", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return domain.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// scanWebhookDeadLetter scans webhookDeadLetterColumns, followed by the
+// window count into total when it is not nil.
+func scanWebhookDeadLetter(row interface{ Scan(...interface{}) error }, total *int) (*domain.WebhookDeadLetter, error) {
+	var dl domain.WebhookDeadLetter
+	var payload []byte
+	var redelivered sql.NullTime
+	dest := []interface{}{&dl.ID, &dl.EventID, &dl.MerchantID, &dl.Event, &dl.Endpoint, &payload, &dl.Attempts, &dl.LastError, &dl.FailedAt, &redelivered}
+	if total != nil {
+		dest = append(dest, total)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	dl.Payload = payload
+	if redelivered.Valid {
+		dl.RedeliveredAt = &redelivered.Time
+	}
+	return &dl, nil
+}
+
+// SaveWebhookEvent keeps a merchant webhook in the outbox for replays. An
+// event whose ID is already kept is not stored again.
+func (r *PostgresRepository) SaveWebhookEvent(ctx context.Context, ev domain.WebhookEvent) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO webhook_events (environment, event_id, merchant_id, event, endpoint, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (environment, event_id) WHERE event_id <> '' DO NOTHING
+	`, r.env, ev.EventID, ev.MerchantID, ev.Event, ev.Endpoint, []byte(ev.Payload))
+	return wrap(ctx, "save webhook event", err)
+}
+
+// ListWebhookEvents returns up to limit of the merchant's events created in
+// [from, to], oldest first; an empty event matches every kind.
+func (r *PostgresRepository) ListWebhookEvents(ctx context.Context, merchantID, event string, from, to time.Time, limit int) ([]domain.WebhookEvent, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, event_id, merchant_id, event, endpoint, payload, created_at FROM webhook_events
+		WHERE environment = $1 AND merchant_id = $2 AND created_at BETWEEN $3 AND $4
+			AND ($5 = '' OR event = $5)
+		ORDER BY created_at, id
+		LIMIT $6
+	`, r.env, merchantID, from, to, event, limit)
+	if err != nil {
+		return nil, wrap(ctx, "list webhook events", err)
+	}
+	defer rows.Close()
+
+	var events []domain.WebhookEvent
+	for rows.Next() {
+		var ev domain.WebhookEvent
+		var payload []byte
+		if err := rows.Scan(&ev.ID, &ev.EventID, &ev.MerchantID, &ev.Event, &ev.Endpoint, &payload, &ev.CreatedAt); err != nil {
+			return nil, wrap(ctx, "list webhook events", err)
+		}
+		ev.Payload = payload
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrap(ctx, "list webhook events", err)
+	}
+	return events, nil
+}
+
+// PurgeWebhookEvents deletes up to limit of this environment's outbox
+// events created before before.
+func (r *PostgresRepository) PurgeWebhookEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM webhook_events WHERE id IN (
+			SELECT id FROM webhook_events WHERE environment = $1 AND created_at < $2 LIMIT $3
+		)
+	`, r.env, before, limit)
+	if err != nil {
+		return 0, wrap(ctx, "purge webhook events", err)
+	}
+	return res.RowsAffected()
+}
+
+// WebhookDelivered reports whether the event was delivered to endpoint.
+func (r *PostgresRepository) WebhookDelivered(ctx context.Context, eventID, endpoint string) (bool, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	var delivered bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT delivered_at IS NOT NULL FROM webhook_deliveries
+		WHERE environment = $1 AND event_id = $2 AND endpoint = $3
+	`, r.env, eventID, endpoint).Scan(&delivered)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrap(ctx, "get webhook delivery", err)
+	}
+	return delivered, nil
+}
+
+// RecordWebhookDelivery records one attempt to deliver the event to
+// endpoint, and why it failed. Once delivered, an event stays delivered.
+func (r *PostgresRepository) RecordWebhookDelivery(ctx context.Context, eventID, endpoint string, deliveryErr error) error {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	lastError := ""
+	if deliveryErr != nil {
+		lastError = deliveryErr.Error()
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (environment, event_id, endpoint, attempts, delivered_at, last_error)
+		VALUES ($1, $2, $3, 1, CASE WHEN $4 = '' THEN NOW() END, $4)
+		ON CONFLICT (environment, event_id, endpoint) DO UPDATE SET
+			attempts = webhook_deliveries.attempts + 1,
+			last_attempt_at = NOW(),
+			delivered_at = COALESCE(webhook_deliveries.delivered_at, EXCLUDED.delivered_at),
+			last_error = EXCLUDED.last_error
+	`, r.env, eventID, endpoint, lastError)
+	return wrap(ctx, "record webhook delivery", err)
+}
+
+// PurgeWebhookDeliveries deletes up to limit of this environment's delivery
+// records last attempted before before.
+func (r *PostgresRepository) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int64, error) {
+	ctx, cancel := r.bound(ctx)
+	defer cancel()
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries WHERE (environment, event_id, endpoint) IN (
+			SELECT environment, event_id, endpoint FROM webhook_deliveries
+			WHERE environment = $1 AND last_attempt_at < $2 LIMIT $3
+		)
+	`, r.env, before, limit)
+	if err != nil {
+		return 0, wrap(ctx, "purge webhook deliveries", err)
+	}
+	return res.RowsAffected()
+}
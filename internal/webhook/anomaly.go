@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+// AnomalySink posts merchant anomaly alerts to an operator URL, either as
+// the alert itself or as a Slack incoming-webhook message.
+type AnomalySink struct {
+	client *Client
+	url    string
+	slack  bool
+}
+
+// NewAnomalySink creates a sink posting each alert as JSON to url.
+func (c *Client) NewAnomalySink(url string) *AnomalySink {
+	return &AnomalySink{client: c, url: url}
+}
+
+// NewSlackSink creates a sink posting each alert as a message to a Slack
+// incoming-webhook url.
+func (c *Client) NewSlackSink(url string) *AnomalySink {
+	return &AnomalySink{client: c, url: url, slack: true}
+}
+
+// SendAnomalyAlert posts alert; it returns the last error once every
+// attempt failed.
+func (s *AnomalySink) SendAnomalyAlert(ctx context.Context, alert domain.AnomalyAlert) error {
+	if s.slack {
+		return s.client.post(ctx, alert.EventID, alert.MerchantID, s.url, alert.Event, map[string]string{"text": slackText(alert)})
+	}
+	return s.client.post(ctx, alert.EventID, alert.MerchantID, s.url, alert.Event, alert)
+}
+
+func slackText(alert domain.AnomalyAlert) string {
+	if alert.Event == domain.AnomalyResolvedEvent {
+		return fmt.Sprintf(":white_check_mark: Merchant %s is back below its duplicate rate threshold: %.1f%% (threshold %.1f%%, %d of %d requests in the last %ds).",
+			alert.MerchantID, alert.DuplicateRate, alert.Threshold, alert.WindowDuplicates, alert.WindowRequests, alert.WindowSeconds)
+	}
+	return fmt.Sprintf(":rotating_light: Merchant %s duplicate rate is %.1f%%, above its %.1f%% threshold (%d of %d requests in the last %ds).",
+		alert.MerchantID, alert.DuplicateRate, alert.Threshold, alert.WindowDuplicates, alert.WindowRequests, alert.WindowSeconds)
+}
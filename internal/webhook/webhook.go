@@ -0,0 +1,230 @@
+// Package webhook posts notifications to URLs merchants configure in their
+// policies.
+//
+// Delivery is at least once: every event carries an event_id, in its
+// payload and the X-Shield-Event-ID header, that stays the same across
+// retries, redeliveries and replays, so receivers dedupe on it.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+const (
+	httpTimeout = 10 * time.Second
+	// deliveryAttempts and retryBackoff bound how long a failing endpoint
+	// holds its sender; the backoff doubles after each attempt.
+	deliveryAttempts = 3
+	retryBackoff     = time.Second
+)
+
+// DeadLetterStore keeps deliveries that failed every attempt.
+type DeadLetterStore interface {
+	SaveWebhookDeadLetter(ctx context.Context, dl domain.WebhookDeadLetter) error
+}
+
+// EventStore keeps merchant webhooks after delivery, for replays.
+type EventStore interface {
+	SaveWebhookEvent(ctx context.Context, ev domain.WebhookEvent) error
+}
+
+// DeliveryStore records every attempt to deliver an event to an endpoint.
+type DeliveryStore interface {
+	WebhookDelivered(ctx context.Context, eventID, endpoint string) (bool, error)
+	RecordWebhookDelivery(ctx context.Context, eventID, endpoint string, deliveryErr error) error
+}
+
+// Client delivers webhooks as JSON POSTs, retrying failed deliveries.
+type Client struct {
+	HTTP *http.Client
+
+	attempts   int
+	backoff    time.Duration
+	dead       DeadLetterStore
+	outbox     EventStore
+	deliveries DeliveryStore
+}
+
+// NewClient creates a Client making up to 3 attempts per delivery.
+func NewClient() *Client {
+	return &Client{HTTP: &http.Client{Timeout: httpTimeout}, attempts: deliveryAttempts, backoff: retryBackoff}
+}
+
+// WithRetries makes up to attempts attempts per delivery, waiting backoff
+// before the first retry and doubling it for each one after.
+func (c *Client) WithRetries(attempts int, backoff time.Duration) *Client {
+	if attempts > 0 {
+		c.attempts = attempts
+	}
+	c.backoff = backoff
+	return c
+}
+
+// WithDeadLetters keeps deliveries that failed every attempt in store, for
+// an admin to redeliver, instead of only logging them.
+func (c *Client) WithDeadLetters(store DeadLetterStore) *Client {
+	c.dead = store
+	return c
+}
+
+// WithOutbox keeps every merchant webhook in store before it is delivered,
+// so the merchant can have it replayed.
+func (c *Client) WithOutbox(store EventStore) *Client {
+	c.outbox = store
+	return c
+}
+
+// WithDeliveries records every delivery attempt per event and endpoint in
+// store, and skips events it already delivered.
+func (c *Client) WithDeliveries(store DeliveryStore) *Client {
+	c.deliveries = store
+	return c
+}
+
+// SendDuplicateAlert posts alert to url; it returns the last error once
+// every attempt failed. With WithOutbox the alert is stored first; failing
+// to store it is logged and does not hold back the delivery.
+func (c *Client) SendDuplicateAlert(ctx context.Context, url string, alert domain.DuplicateAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	if c.outbox != nil {
+		ev := domain.WebhookEvent{EventID: alert.EventID, MerchantID: alert.MerchantID, Event: alert.Event, Endpoint: url, Payload: body}
+		if err := c.outbox.SaveWebhookEvent(ctx, ev); err != nil {
+			log.Printf("webhook: %s for merchant %s not stored for replay: %v", alert.Event, alert.MerchantID, err)
+		}
+	}
+	return c.deliver(ctx, delivery{eventID: alert.EventID, merchantID: alert.MerchantID, url: url, event: alert.Event, body: body}, false)
+}
+
+// Replay delivers a stored event again, retrying and dead-lettering it as
+// a new delivery. It is sent even if it was delivered before.
+func (c *Client) Replay(ctx context.Context, ev domain.WebhookEvent) error {
+	return c.deliver(ctx, delivery{eventID: ev.EventID, merchantID: ev.MerchantID, url: ev.Endpoint, event: ev.Event, body: ev.Payload}, true)
+}
+
+// Redeliver posts a dead letter's payload to its endpoint once.
+func (c *Client) Redeliver(ctx context.Context, dl domain.WebhookDeadLetter) error {
+	return c.attempt(ctx, delivery{eventID: dl.EventID, merchantID: dl.MerchantID, url: dl.Endpoint, event: dl.Event, body: dl.Payload})
+}
+
+// delivery is one event on its way to one endpoint.
+type delivery struct {
+	eventID    string
+	merchantID string
+	url        string
+	event      string
+	body       []byte
+}
+
+// post delivers payload as JSON; see deliver.
+func (c *Client) post(ctx context.Context, eventID, merchantID, url, event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.deliver(ctx, delivery{eventID: eventID, merchantID: merchantID, url: url, event: event, body: body}, false)
+}
+
+// deliver posts d, retrying per WithRetries, and dead-letters it when every
+// attempt failed. Unless force is set, an event already delivered to the
+// endpoint, as when a digest is regenerated, is skipped.
+func (c *Client) deliver(ctx context.Context, d delivery, force bool) error {
+	if !force && c.deliveries != nil && d.eventID != "" {
+		delivered, err := c.deliveries.WebhookDelivered(ctx, d.eventID, d.url)
+		if err != nil {
+			log.Printf("webhook: %s %s: delivery lookup failed, sending anyway: %v", d.event, d.eventID, err)
+		}
+		if delivered {
+			log.Printf("webhook: %s %s already delivered for merchant %s", d.event, d.eventID, d.merchantID)
+			return nil
+		}
+	}
+	var err error
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		err = c.attempt(ctx, d)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.attempts || ctx.Err() != nil {
+			c.deadLetter(ctx, domain.WebhookDeadLetter{
+				EventID: d.eventID, MerchantID: d.merchantID, Event: d.event, Endpoint: d.url, Payload: d.body,
+				Attempts: attempt, LastError: err.Error(),
+			})
+			return err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// attempt sends d once and records the attempt with WithDeliveries; a
+// record that cannot be stored is only logged.
+func (c *Client) attempt(ctx context.Context, d delivery) error {
+	err := c.send(ctx, d)
+	if c.deliveries != nil && d.eventID != "" {
+		if rerr := c.deliveries.RecordWebhookDelivery(ctx, d.eventID, d.url, err); rerr != nil {
+			log.Printf("webhook: %s %s: attempt not recorded: %v", d.event, d.eventID, rerr)
+		}
+	}
+	return err
+}
+
+// deadLetter stores dl. A delivery that cannot be stored either is only
+// logged; the caller logs the delivery error itself.
+func (c *Client) deadLetter(ctx context.Context, dl domain.WebhookDeadLetter) {
+	if c.dead == nil {
+		return
+	}
+	// Store it even when ctx ended the delivery, as at shutdown.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), httpTimeout)
+	defer cancel()
+	if err := c.dead.SaveWebhookDeadLetter(ctx, dl); err != nil {
+		log.Printf("webhook: %s for merchant %s lost, dead letter not stored: %v", dl.Event, dl.MerchantID, err)
+	}
+}
+
+// send makes one attempt; any non-2xx response is an error.
+func (c *Client) send(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Shield-Event", d.event)
+	if d.eventID != "" {
+		req.Header.Set("X-Shield-Event-ID", d.eventID)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		// The URL may carry credentials; keep only the underlying cause.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+	return nil
+}
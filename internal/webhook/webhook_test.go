@@ -0,0 +1,222 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+)
+
+func TestClient_SendDuplicateAlert(t *testing.T) {
+	var event string
+	var got domain.DuplicateAlert
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event = r.Header.Get("X-Shield-Event")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	alert := domain.DuplicateAlert{Event: domain.DuplicateAlertEvent, MerchantID: "merchant-1", Date: "2026-03-10", DuplicatesBlocked: 12, Threshold: 10}
+	if err := NewClient().SendDuplicateAlert(context.Background(), srv.URL, alert); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if event != domain.DuplicateAlertEvent || got != alert {
+		t.Errorf("unexpected delivery: %s %+v", event, got)
+	}
+
+	status = http.StatusInternalServerError
+	if err := NewClient().WithRetries(1, 0).SendDuplicateAlert(context.Background(), srv.URL, alert); err == nil {
+		t.Error("expected an error for a non-2xx response")
+	}
+}
+
+// deadLetters records the dead letters a Client stores.
+type deadLetters []domain.WebhookDeadLetter
+
+func (d *deadLetters) SaveWebhookDeadLetter(_ context.Context, dl domain.WebhookDeadLetter) error {
+	*d = append(*d, dl)
+	return nil
+}
+
+func TestClient_RetriesAndDeadLetters(t *testing.T) {
+	var calls int
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	dead := &deadLetters{}
+	client := NewClient().WithRetries(3, time.Millisecond).WithDeadLetters(dead)
+	alert := domain.DuplicateAlert{Event: domain.DuplicateAlertEvent, MerchantID: "merchant-1", Date: "2026-03-10", DuplicatesBlocked: 12, Threshold: 10}
+	if err := client.SendDuplicateAlert(context.Background(), srv.URL, alert); err != nil || calls != 3 {
+		t.Fatalf("expected delivery on the third attempt, got %d calls: %v", calls, err)
+	}
+	if len(*dead) != 0 {
+		t.Errorf("expected nothing dead-lettered, got %+v", *dead)
+	}
+
+	calls, failures = 0, 3
+	if err := client.SendDuplicateAlert(context.Background(), srv.URL, alert); err == nil {
+		t.Fatal("expected an error once every attempt failed")
+	}
+	if len(*dead) != 1 {
+		t.Fatalf("expected one dead letter, got %+v", *dead)
+	}
+	dl := (*dead)[0]
+	var payload domain.DuplicateAlert
+	json.Unmarshal(dl.Payload, &payload)
+	if dl.MerchantID != "merchant-1" || dl.Event != domain.DuplicateAlertEvent || dl.Endpoint != srv.URL ||
+		dl.Attempts != 3 || !strings.Contains(dl.LastError, "502") || payload != alert {
+		t.Errorf("unexpected dead letter: %+v", dl)
+	}
+
+	calls, failures = 0, 0
+	if err := client.Redeliver(context.Background(), dl); err != nil || calls != 1 {
+		t.Errorf("expected the dead letter redelivered once, got %d calls: %v", calls, err)
+	}
+}
+
+// outbox records the events a Client stores for replays.
+type outbox []domain.WebhookEvent
+
+func (o *outbox) SaveWebhookEvent(_ context.Context, ev domain.WebhookEvent) error {
+	*o = append(*o, ev)
+	return nil
+}
+
+func TestClient_OutboxAndReplay(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	events, dead := &outbox{}, &deadLetters{}
+	client := NewClient().WithRetries(2, 0).WithDeadLetters(dead).WithOutbox(events)
+	alert := domain.DuplicateAlert{Event: domain.DuplicateAlertEvent, MerchantID: "merchant-1", Date: "2026-03-10", DuplicatesBlocked: 12, Threshold: 10}
+	if err := client.SendDuplicateAlert(context.Background(), srv.URL, alert); err == nil {
+		t.Fatal("expected an error once every attempt failed")
+	}
+	if len(*events) != 1 {
+		t.Fatalf("expected the alert kept in the outbox despite the failure, got %+v", *events)
+	}
+	ev := (*events)[0]
+	var payload domain.DuplicateAlert
+	json.Unmarshal(ev.Payload, &payload)
+	if ev.MerchantID != "merchant-1" || ev.Event != domain.DuplicateAlertEvent || ev.Endpoint != srv.URL || payload != alert {
+		t.Errorf("unexpected outbox event: %+v", ev)
+	}
+
+	calls = 0
+	if err := client.Replay(context.Background(), ev); err == nil || calls != 2 {
+		t.Errorf("expected a replay retried like a delivery, got %d calls: %v", calls, err)
+	}
+	if len(*dead) != 2 || len(*events) != 1 {
+		t.Errorf("expected the failed replay dead-lettered and not stored again, got %d %d", len(*dead), len(*events))
+	}
+}
+
+// deliveries is an in-memory DeliveryStore.
+type deliveries struct {
+	attempts  map[string]int
+	delivered map[string]bool
+}
+
+func (d *deliveries) WebhookDelivered(_ context.Context, eventID, endpoint string) (bool, error) {
+	return d.delivered[eventID+" "+endpoint], nil
+}
+
+func (d *deliveries) RecordWebhookDelivery(_ context.Context, eventID, endpoint string, deliveryErr error) error {
+	d.attempts[eventID+" "+endpoint]++
+	if deliveryErr == nil {
+		d.delivered[eventID+" "+endpoint] = true
+	}
+	return nil
+}
+
+func TestClient_EventIDsAndDeliveries(t *testing.T) {
+	var ids []string
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Shield-Event-ID"))
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	store := &deliveries{attempts: map[string]int{}, delivered: map[string]bool{}}
+	dead, events := &deadLetters{}, &outbox{}
+	client := NewClient().WithRetries(2, 0).WithDeadLetters(dead).WithOutbox(events).WithDeliveries(store)
+	alert := domain.DuplicateAlert{EventID: domain.DuplicateAlertEventID("merchant-1", "2026-03-10"), Event: domain.DuplicateAlertEvent, MerchantID: "merchant-1", Date: "2026-03-10"}
+	key := alert.EventID + " " + srv.URL
+
+	client.SendDuplicateAlert(context.Background(), srv.URL, alert)
+	if store.attempts[key] != 2 || (*dead)[0].EventID != alert.EventID || (*events)[0].EventID != alert.EventID {
+		t.Fatalf("expected 2 recorded attempts and the ID kept, got %v %+v %+v", store.attempts, *dead, *events)
+	}
+
+	fail = false
+	if err := client.Redeliver(context.Background(), (*dead)[0]); err != nil {
+		t.Fatal(err)
+	}
+	// A regenerated digest sends the same alert again; it was delivered.
+	if err := client.SendDuplicateAlert(context.Background(), srv.URL, alert); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Replay(context.Background(), (*events)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 4 || store.attempts[key] != 4 {
+		t.Errorf("expected the delivered alert skipped but replayed, got %d requests and %d attempts", len(ids), store.attempts[key])
+	}
+	for _, id := range ids {
+		if id != alert.EventID {
+			t.Errorf("expected every request to carry %s, got %s", alert.EventID, id)
+		}
+	}
+}
+
+func TestAnomalySinks(t *testing.T) {
+	var bodies []map[string]interface{}
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		events = append(events, r.Header.Get("X-Shield-Event"))
+	}))
+	defer srv.Close()
+
+	alert := domain.AnomalyAlert{Event: domain.AnomalyDetectedEvent, MerchantID: "merchant-1", DuplicateRate: 42.5, Threshold: 20, WindowRequests: 40, WindowDuplicates: 17, WindowSeconds: 300}
+	client := NewClient()
+	if err := client.NewAnomalySink(srv.URL).SendAnomalyAlert(context.Background(), alert); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := client.NewSlackSink(srv.URL).SendAnomalyAlert(context.Background(), alert); err != nil {
+		t.Fatalf("send slack: %v", err)
+	}
+
+	if len(bodies) != 2 || events[0] != domain.AnomalyDetectedEvent || events[1] != domain.AnomalyDetectedEvent {
+		t.Fatalf("unexpected deliveries: %v %v", events, bodies)
+	}
+	if bodies[0]["merchant_id"] != "merchant-1" || bodies[0]["duplicate_rate"] != 42.5 {
+		t.Errorf("webhook body = %v", bodies[0])
+	}
+	text, _ := bodies[1]["text"].(string)
+	if !strings.Contains(text, "merchant-1") || !strings.Contains(text, "42.5%") {
+		t.Errorf("slack text = %q", text)
+	}
+}
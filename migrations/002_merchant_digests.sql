@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS merchant_digests (
+    merchant_id         TEXT NOT NULL,
+    digest_date         DATE NOT NULL,
+    total_requests      INT NOT NULL,
+    duplicates_blocked  INT NOT NULL,
+    amount_protected    JSONB NOT NULL DEFAULT '{}',
+    normalized          JSONB,
+    new_suspicious_keys TEXT[] NOT NULL DEFAULT '{}',
+    generated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (merchant_id, digest_date)
+);
@@ -0,0 +1 @@
+ALTER TABLE merchant_policies ADD COLUMN IF NOT EXISTS response_schema JSONB;
@@ -0,0 +1,2 @@
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS duplicate_status_code INT NOT NULL DEFAULT 409 CHECK(duplicate_status_code IN (200, 409));
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id              BIGSERIAL PRIMARY KEY,
+    idempotency_key TEXT NOT NULL REFERENCES idempotency_keys(idempotency_key) ON DELETE CASCADE,
+    source_ip       TEXT,
+    user_agent      TEXT,
+    request_id      TEXT,
+    attempted_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attempts_key ON payment_attempts(idempotency_key);
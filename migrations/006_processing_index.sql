@@ -0,0 +1,2 @@
+-- Lets the reconciliation worker find stuck payments without scanning every key.
+CREATE INDEX IF NOT EXISTS idx_processing_last_seen ON idempotency_keys(last_seen_at) WHERE status = 'processing';
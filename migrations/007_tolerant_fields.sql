@@ -0,0 +1,2 @@
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS tolerant_fields TEXT[] NOT NULL DEFAULT '{}';
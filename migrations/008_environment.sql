@@ -0,0 +1,23 @@
+-- Scope keys, attempts and digests by environment so sandbox traffic sharing
+-- a database with production can never collide with production keys.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT 'production'
+    CHECK (environment IN ('sandbox', 'production'));
+ALTER TABLE payment_attempts
+    ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT 'production';
+ALTER TABLE merchant_digests
+    ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT 'production';
+
+ALTER TABLE payment_attempts DROP CONSTRAINT IF EXISTS payment_attempts_idempotency_key_fkey;
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_idempotency_key_key;
+ALTER TABLE idempotency_keys
+    ADD CONSTRAINT idempotency_keys_environment_key_key UNIQUE (environment, idempotency_key);
+ALTER TABLE payment_attempts
+    ADD CONSTRAINT payment_attempts_key_fkey FOREIGN KEY (environment, idempotency_key)
+    REFERENCES idempotency_keys(environment, idempotency_key) ON DELETE CASCADE;
+
+DROP INDEX IF EXISTS idx_attempts_key;
+CREATE INDEX IF NOT EXISTS idx_attempts_key ON payment_attempts(environment, idempotency_key);
+
+ALTER TABLE merchant_digests DROP CONSTRAINT IF EXISTS merchant_digests_pkey;
+ALTER TABLE merchant_digests ADD PRIMARY KEY (environment, merchant_id, digest_date);
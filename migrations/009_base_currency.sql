@@ -0,0 +1,5 @@
+-- Merchant's base currency for consolidated report amounts; NULL falls back
+-- to REPORT_CURRENCY.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS base_currency TEXT
+    CHECK (base_currency ~ '^[A-Z]{3}$');
@@ -0,0 +1,7 @@
+-- Per-merchant opt-in for forwarding fraud signals, and an index for finding
+-- other recent keys with the same parameters (cross-key duplicates).
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS fraud_export BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_merchant_hash
+    ON idempotency_keys(environment, merchant_id, request_hash, first_seen_at);
@@ -0,0 +1,20 @@
+-- Periodic copies of each instance's in-memory metrics. Counters are
+-- cumulative since period_start (the instance's last reset or rotation).
+CREATE TABLE IF NOT EXISTS metrics_history (
+    id                    BIGSERIAL PRIMARY KEY,
+    environment           TEXT NOT NULL DEFAULT 'production',
+    instance              TEXT NOT NULL,
+    recorded_at           TIMESTAMPTZ NOT NULL,
+    period_start          TIMESTAMPTZ NOT NULL,
+    total_requests        BIGINT NOT NULL,
+    new_payments          BIGINT NOT NULL,
+    duplicate_blocked     BIGINT NOT NULL,
+    retry_allowed         BIGINT NOT NULL,
+    cached_responses      BIGINT NOT NULL,
+    param_mismatches      BIGINT NOT NULL,
+    slow_queries          BIGINT NOT NULL,
+    window_duplicate_rate DOUBLE PRECISION NOT NULL,
+    latency_p95_ms        DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_metrics_history_time ON metrics_history(environment, recorded_at);
@@ -0,0 +1,5 @@
+-- Template for a merchant's payment IDs, e.g. kubo_<ulid>; NULL keeps the
+-- default pay_<nanos>.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS payment_id_format TEXT
+    CHECK (length(payment_id_format) <= 64);
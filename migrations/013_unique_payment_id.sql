@@ -0,0 +1,9 @@
+-- Payment IDs were nanosecond timestamps, so concurrent requests could share
+-- one. Disambiguate any existing collisions, then make them impossible.
+UPDATE idempotency_keys k SET payment_id = k.payment_id || '_' || k.id
+WHERE EXISTS (
+    SELECT 1 FROM idempotency_keys o WHERE o.payment_id = k.payment_id AND o.id < k.id
+);
+
+ALTER TABLE idempotency_keys
+    ADD CONSTRAINT idempotency_keys_payment_id_key UNIQUE (payment_id);
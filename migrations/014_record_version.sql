@@ -0,0 +1,4 @@
+-- Bumped on every status change, so a reset can check that the record is
+-- still in the state it was read in.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
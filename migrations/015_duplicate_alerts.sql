@@ -0,0 +1,5 @@
+-- A merchant's own duplicate alert: POST to duplicate_alert_url when a
+-- day's digest counts more than duplicate_alert_threshold duplicates.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS duplicate_alert_threshold INTEGER CHECK (duplicate_alert_threshold > 0),
+    ADD COLUMN IF NOT EXISTS duplicate_alert_url TEXT;
@@ -0,0 +1,6 @@
+-- The HTTP status and headers of a completed payment's response, so
+-- succeeded duplicates replay it exactly. NULL for completions that sent
+-- only a response_body.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS response_status INTEGER CHECK (response_status BETWEEN 200 AND 599),
+    ADD COLUMN IF NOT EXISTS response_headers JSONB;
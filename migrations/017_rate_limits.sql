@@ -0,0 +1,5 @@
+-- A merchant's own limit on POST /v1/payments, replacing RATE_LIMIT_RPS
+-- and RATE_LIMIT_BURST for it. NULL uses the deployment's limit.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS rate_limit_rps DOUBLE PRECISION CHECK (rate_limit_rps > 0),
+    ADD COLUMN IF NOT EXISTS rate_limit_burst INTEGER CHECK (rate_limit_burst > 0);
@@ -0,0 +1,5 @@
+-- When the record last entered processing: set on insert and on every reset,
+-- so a stale-processing timeout runs from the attempt in flight rather than
+-- the last duplicate. Rows already processing start their clock now.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS processing_since TIMESTAMPTZ NOT NULL DEFAULT NOW();
@@ -0,0 +1,3 @@
+-- Lets admin key searches match idempotency_key prefixes with LIKE, which
+-- the unique constraint's index cannot serve outside the C collation.
+CREATE INDEX IF NOT EXISTS idx_key_prefix ON idempotency_keys(environment, idempotency_key text_pattern_ops);
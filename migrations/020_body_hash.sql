@@ -0,0 +1,5 @@
+-- Canonical hash of the full request body, stored next to request_hash when
+-- body hashing is enabled. Rows without one keep being compared by
+-- request_hash.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS body_hash TEXT;
@@ -0,0 +1,4 @@
+-- A merchant's cap on the expiry_hours its payments may ask for, below
+-- MAX_KEY_EXPIRY_HOURS. NULL uses the deployment's maximum.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS max_expiry_hours INTEGER CHECK (max_expiry_hours > 0);
@@ -0,0 +1,44 @@
+-- Expired keys and their payment attempts, moved here by the sweeper when
+-- ARCHIVE_EXPIRED_KEYS is set instead of being deleted, so every payment
+-- attempt stays traceable for ARCHIVE_RETENTION_DAYS. No unique keys: a key
+-- reused after expiring is archived once per lifetime.
+CREATE TABLE IF NOT EXISTS idempotency_keys_archive (
+    id               BIGINT NOT NULL,
+    idempotency_key  TEXT NOT NULL,
+    merchant_id      TEXT NOT NULL,
+    customer_id      TEXT NOT NULL,
+    amount           BIGINT NOT NULL,
+    currency         TEXT NOT NULL,
+    status           TEXT NOT NULL,
+    request_hash     TEXT NOT NULL,
+    response_body    JSONB,
+    payment_id       TEXT NOT NULL,
+    attempt_count    INT NOT NULL,
+    first_seen_at    TIMESTAMPTZ NOT NULL,
+    last_seen_at     TIMESTAMPTZ NOT NULL,
+    completed_at     TIMESTAMPTZ,
+    expires_at       TIMESTAMPTZ NOT NULL,
+    environment      TEXT NOT NULL,
+    version          BIGINT NOT NULL,
+    response_status  INTEGER,
+    response_headers JSONB,
+    processing_since TIMESTAMPTZ NOT NULL,
+    body_hash        TEXT,
+    archived_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS payment_attempts_archive (
+    id              BIGINT NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    source_ip       TEXT,
+    user_agent      TEXT,
+    request_id      TEXT,
+    attempted_at    TIMESTAMPTZ NOT NULL,
+    environment     TEXT NOT NULL,
+    archived_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_keys_archive_archived_at ON idempotency_keys_archive(archived_at);
+CREATE INDEX IF NOT EXISTS idx_keys_archive_key ON idempotency_keys_archive(environment, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_attempts_archive_archived_at ON payment_attempts_archive(archived_at);
+CREATE INDEX IF NOT EXISTS idx_attempts_archive_key ON payment_attempts_archive(environment, idempotency_key);
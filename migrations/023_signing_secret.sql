@@ -0,0 +1,4 @@
+-- The HMAC key a merchant's payment requests must be signed with when
+-- request signing is on. NULL leaves the merchant's requests unsigned.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS signing_secret TEXT;
@@ -0,0 +1,8 @@
+-- Each attempt's request hash and how InsertOrGet saw it (new, duplicate or
+-- mismatch), for GET /v1/payments/{key}/attempts. Attempts recorded before
+-- this migration keep both NULL.
+ALTER TABLE payment_attempts ADD COLUMN IF NOT EXISTS request_hash TEXT;
+ALTER TABLE payment_attempts ADD COLUMN IF NOT EXISTS outcome TEXT;
+
+ALTER TABLE payment_attempts_archive ADD COLUMN IF NOT EXISTS request_hash TEXT;
+ALTER TABLE payment_attempts_archive ADD COLUMN IF NOT EXISTS outcome TEXT;
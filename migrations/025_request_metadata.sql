@@ -0,0 +1,11 @@
+-- The caller's metadata object, stored with the key and returned with it.
+-- It is part of request_hash only for merchants whose policy sets
+-- hash_metadata.
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS metadata JSONB;
+
+ALTER TABLE idempotency_keys_archive
+    ADD COLUMN IF NOT EXISTS metadata JSONB;
+
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS hash_metadata BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,13 @@
+-- Keys reserved ahead of their payment by POST /v1/idempotency-keys. The
+-- merchant's first payment with the key deletes its reservation; the sweeper
+-- deletes the ones that expire unused.
+CREATE TABLE IF NOT EXISTS key_reservations (
+    environment     TEXT NOT NULL DEFAULT 'production',
+    idempotency_key TEXT NOT NULL,
+    merchant_id     TEXT NOT NULL,
+    reserved_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at      TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (environment, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_reservations_expires_at ON key_reservations(expires_at);
@@ -0,0 +1,5 @@
+-- Attempts a single key may take within the storm window before further
+-- duplicates are answered 429 instead of reaching the database. NULL uses
+-- the deployment's STORM_THRESHOLD.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS storm_threshold INTEGER CHECK (storm_threshold > 0);
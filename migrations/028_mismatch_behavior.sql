@@ -0,0 +1,7 @@
+-- What a retry whose parameters differ from its key's does: NULL rejects it
+-- with 422, accept_latest replaces the stored parameters (restarting a
+-- completed payment) and accept_if_not_completed replaces them only while
+-- the payment is still processing.
+ALTER TABLE merchant_policies
+    ADD COLUMN IF NOT EXISTS mismatch_behavior TEXT
+        CHECK (mismatch_behavior IN ('reject', 'accept_latest', 'accept_if_not_completed'));
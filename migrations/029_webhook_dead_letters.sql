@@ -0,0 +1,16 @@
+-- Webhook deliveries that failed every attempt, kept with their payload
+-- until an admin redelivers them from /v1/admin/webhooks/dead-letters.
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id             BIGSERIAL PRIMARY KEY,
+    environment    TEXT NOT NULL DEFAULT 'production',
+    merchant_id    TEXT NOT NULL DEFAULT '',
+    event          TEXT NOT NULL,
+    endpoint       TEXT NOT NULL,
+    payload        JSONB NOT NULL,
+    attempts       INTEGER NOT NULL,
+    last_error     TEXT NOT NULL,
+    failed_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    redelivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_failed_at ON webhook_dead_letters(environment, failed_at);
@@ -0,0 +1,15 @@
+-- Merchant webhooks kept after delivery, so a merchant whose endpoint was
+-- down can have a time range replayed. The sweeper purges rows older than
+-- WEBHOOK_EVENT_RETENTION_DAYS.
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id          BIGSERIAL PRIMARY KEY,
+    environment TEXT NOT NULL DEFAULT 'production',
+    merchant_id TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    endpoint    TEXT NOT NULL,
+    payload     JSONB NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_merchant ON webhook_events(environment, merchant_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_events_created_at ON webhook_events(environment, created_at);
@@ -0,0 +1,22 @@
+-- Every webhook event carries a stable event_id. Delivery attempts are
+-- recorded per event and endpoint, so an event already delivered is not
+-- sent again by a regenerated digest, and dead letters and the outbox keep
+-- the ID their redeliveries and replays reuse.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    environment     TEXT NOT NULL DEFAULT 'production',
+    event_id        TEXT NOT NULL,
+    endpoint        TEXT NOT NULL,
+    attempts        INTEGER NOT NULL,
+    last_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ,
+    last_error      TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (environment, event_id, endpoint)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_last_attempt ON webhook_deliveries(environment, last_attempt_at);
+
+ALTER TABLE webhook_dead_letters ADD COLUMN IF NOT EXISTS event_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE webhook_events ADD COLUMN IF NOT EXISTS event_id TEXT NOT NULL DEFAULT '';
+
+-- An event regenerated under the same ID is kept once.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_events_event_id ON webhook_events(environment, event_id) WHERE event_id <> '';
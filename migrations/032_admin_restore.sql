@@ -0,0 +1,12 @@
+-- Admin expire, force-fail and reset actions keep what they changed on the
+-- row, so POST /v1/admin/payments/{key}/restore can undo them until
+-- restorable_until. The action leaves the row at prior_version + 1; a row
+-- at any other version was used again since and is not restored. The
+-- sweeper leaves rows alone while they can be restored.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS admin_action TEXT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS admin_action_at TIMESTAMPTZ;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS prior_status TEXT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS prior_completed_at TIMESTAMPTZ;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS prior_expires_at TIMESTAMPTZ;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS prior_version BIGINT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS restorable_until TIMESTAMPTZ;
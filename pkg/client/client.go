@@ -0,0 +1,351 @@
+// Package client calls the idempotency shield API from Go services. It
+// generates idempotency keys, retries what the server reports as retryable
+// with backoff, and decodes responses into the API's types.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	httpTimeout    = 10 * time.Second
+	defaultRetries = 3
+	defaultBackoff = 200 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Client calls one idempotency shield server. Its methods are safe for
+// concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+	secret  string
+	newKey  func() string
+}
+
+// New creates a Client for the server at baseURL, such as
+// "http://shield:8080". It retries 3 times, starting at 200ms.
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: httpTimeout},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+		newKey:  newUUID,
+	}
+}
+
+// WithHTTPClient sends requests through hc instead of a client with a 10s
+// timeout.
+func (c *Client) WithHTTPClient(hc *http.Client) *Client {
+	c.http = hc
+	return c
+}
+
+// WithRetries sets how often a retryable failure is retried and the first
+// wait, which doubles on each retry up to 5s. Zero retries sends each
+// request once.
+func (c *Client) WithRetries(retries int, backoff time.Duration) *Client {
+	c.retries = retries
+	c.backoff = backoff
+	return c
+}
+
+// WithSigningSecret signs every request with a body, payments and
+// completions, with the merchant's signing_secret, as servers running with
+// REQUEST_SIGNING require. Each attempt is signed afresh, so retries stay
+// within the server's tolerance.
+func (c *Client) WithSigningSecret(secret string) *Client {
+	c.secret = secret
+	return c
+}
+
+// Error is a response the server refused, with the code and message of its
+// error body.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Retryable is the server's own verdict or, when the body gives none,
+	// whether the status was 5xx or 429. The client already retried such
+	// errors before returning one.
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("shield: unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("shield: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Payment is the answer to ProcessPayment.
+type Payment struct {
+	PaymentResponse
+	// StatusCode is 201 for a new payment, 202 when it was queued, and 200
+	// or 409 for a duplicate, as the merchant's policy chooses.
+	StatusCode int
+	// Replayed is set when a succeeded duplicate was answered with the
+	// response stored at completion, which is then in Body and
+	// PaymentResponse is empty.
+	Replayed bool
+	Body     json.RawMessage
+}
+
+// ProcessPayment submits req. An empty IdempotencyKey is filled with a
+// random UUID, which req carries back so the caller can complete the
+// payment. Duplicates are answers, not errors: a duplicate still processing
+// is retried until it completes or the retries run out, and then returned
+// with status processing.
+func (c *Client) ProcessPayment(ctx context.Context, req *PaymentRequest) (*Payment, error) {
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = c.newKey()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, raw, err := c.do(ctx, http.MethodPost, "/v1/payments", nil, body)
+	if err != nil && !isDuplicate(resp, raw) {
+		return nil, err
+	}
+
+	payment := &Payment{StatusCode: resp.StatusCode}
+	if resp.Header.Get("Idempotency-Replayed") == "true" {
+		payment.Replayed = true
+		payment.Body = raw
+		return payment, nil
+	}
+	if err := json.Unmarshal(raw, &payment.PaymentResponse); err != nil {
+		return nil, fmt.Errorf("shield: decode payment: %w", err)
+	}
+	return payment, nil
+}
+
+// Complete records the outcome of the payment under key. Sending the same
+// completion again succeeds; a different one returns an *Error with code
+// already_completed.
+func (c *Client) Complete(ctx context.Context, key string, req CompleteRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPatch, "/v1/payments/"+neturl.PathEscape(key)+"/complete", nil, body)
+	return err
+}
+
+// DuplicatesQuery narrows GetDuplicates. Zero times leave the server's
+// default range, the last 24h; a zero Limit returns every suspicious key.
+type DuplicatesQuery struct {
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+// GetDuplicates returns the merchant's duplicate report.
+func (c *Client) GetDuplicates(ctx context.Context, merchantID string, q DuplicatesQuery) (*DuplicateReport, error) {
+	params := neturl.Values{}
+	if !q.From.IsZero() {
+		params.Set("from", q.From.UTC().Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		params.Set("to", q.To.UTC().Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+		params.Set("offset", strconv.Itoa(q.Offset))
+	}
+	var report DuplicateReport
+	if err := c.get(ctx, "/v1/merchants/"+neturl.PathEscape(merchantID)+"/duplicates", params, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetPolicy returns the merchant's policy, without its signing secret. A
+// merchant without one returns an *Error with code policy_not_found.
+func (c *Client) GetPolicy(ctx context.Context, merchantID string) (*MerchantPolicy, error) {
+	var policy MerchantPolicy
+	if err := c.get(ctx, "/v1/merchants/"+neturl.PathEscape(merchantID)+"/policy", nil, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, params neturl.Values, out interface{}) error {
+	_, raw, err := c.do(ctx, http.MethodGet, path, params, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("shield: decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// errorBody is the part of an error body, or of a duplicate's
+// PaymentResponse, that decides whether to retry.
+type errorBody struct {
+	Error             string `json:"error"`
+	Message           string `json:"message"`
+	Code              string `json:"code"`
+	Retryable         *bool  `json:"retryable"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// retryable is the body's verdict, or without one, whether status is a
+// server error or a rate limit, as from a proxy in front of the shield.
+func (eb errorBody) retryable(status int) bool {
+	if eb.Retryable != nil {
+		return *eb.Retryable
+	}
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// do sends the request, retrying transport errors and retryable responses,
+// and returns the last response with its body. Any non-2xx response is an
+// *Error, returned along with that response.
+func (c *Client) do(ctx context.Context, method, path string, params neturl.Values, body []byte) (*http.Response, []byte, error) {
+	url := c.baseURL + path
+	if len(params) > 0 {
+		url += "?" + params.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		resp, raw, err := c.send(ctx, method, url, body)
+		wait := c.wait(attempt)
+		if err == nil {
+			if resp.StatusCode/100 == 2 {
+				return resp, raw, nil
+			}
+			var eb errorBody
+			json.Unmarshal(raw, &eb)
+			msg := eb.Error
+			if msg == "" {
+				msg = eb.Message
+			}
+			retryable := eb.retryable(resp.StatusCode)
+			err = &Error{StatusCode: resp.StatusCode, Code: eb.Code, Message: msg, Retryable: retryable}
+			if !retryable || attempt >= c.retries {
+				return resp, raw, err
+			}
+			if after := retryAfter(resp, eb); after > wait {
+				wait = after
+			}
+		} else if ctx.Err() != nil || attempt >= c.retries {
+			return nil, nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt.
+func (c *Client) send(ctx context.Context, method, url string, body []byte) (*http.Response, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if c.secret != "" {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("X-Signature-Timestamp", ts)
+			req.Header.Set("X-Signature", sign(c.secret, ts, body))
+		}
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("shield: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("shield: read response: %w", err)
+	}
+	return resp, raw, nil
+}
+
+// wait is the backoff before retry attempt+1: the base doubled per attempt,
+// capped, with up to a fifth of jitter so retrying clients spread out.
+func (c *Client) wait(attempt int) time.Duration {
+	d := time.Duration(float64(c.backoff) * math.Pow(2, float64(attempt)))
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d + time.Duration(mrand.Int63n(int64(d)/5+1))
+}
+
+// retryAfter is the wait the server asked for, from Retry-After or the body.
+func retryAfter(resp *http.Response, eb errorBody) time.Duration {
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Duration(eb.RetryAfterSeconds) * time.Second
+}
+
+// isDuplicate reports whether a refused payment was a duplicate, whose 409
+// body is the PaymentResponse of the original payment rather than an error.
+func isDuplicate(resp *http.Response, raw []byte) bool {
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		return false
+	}
+	var dup struct {
+		PaymentID string `json:"payment_id"`
+	}
+	return json.Unmarshal(raw, &dup) == nil && dup.PaymentID != ""
+}
+
+// sign is the server's signature: the hex HMAC-SHA256, keyed with secret,
+// of the timestamp, a "." and the body.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// IsCode reports whether err is an *Error with the given code, such as
+// "already_completed" or "params_mismatch".
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kubo-market/idempotency-shield/internal/domain"
+	"github.com/kubo-market/idempotency-shield/internal/handler"
+	"github.com/kubo-market/idempotency-shield/internal/service"
+	"github.com/kubo-market/idempotency-shield/internal/storage"
+)
+
+// newServer serves the client's routes from a memory-backed shield.
+func newServer(t *testing.T) *Client {
+	repo := storage.NewMemoryRepository(0)
+	payments := handler.NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+	reports := handler.NewReportingHandler(service.NewReportingService(repo))
+	policies := handler.NewPolicyHandler(repo)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/payments", payments.ProcessPayment)
+	mux.HandleFunc("PATCH /v1/payments/{key}/complete", payments.CompletePayment)
+	mux.HandleFunc("GET /v1/merchants/{id}/duplicates", reports.GetDuplicates)
+	mux.HandleFunc("GET /v1/merchants/{id}/policy", policies.UpdatePolicy)
+	mux.HandleFunc("PUT /v1/merchants/{id}/policy", policies.UpdatePolicy)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return New(srv.URL).WithRetries(1, time.Millisecond)
+}
+
+func TestClient_PaymentLifecycle(t *testing.T) {
+	c := newServer(t)
+	ctx := context.Background()
+	req := &PaymentRequest{MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+
+	first, err := c.ProcessPayment(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.IdempotencyKey == "" || first.StatusCode != http.StatusCreated || first.PaymentID == "" {
+		t.Fatalf("expected a new payment under a generated key, got %q %+v", req.IdempotencyKey, first)
+	}
+
+	dup, err := c.ProcessPayment(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup.StatusCode != http.StatusConflict || dup.Status != StatusProcessing || dup.PaymentID != first.PaymentID {
+		t.Errorf("expected the processing duplicate returned after retrying, got %+v", dup)
+	}
+
+	if err := c.Complete(ctx, req.IdempotencyKey, CompleteRequest{Status: StatusSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Complete(ctx, req.IdempotencyKey, CompleteRequest{Status: StatusFailed})
+	if !IsCode(err, "already_completed") {
+		t.Errorf("expected already_completed, got %v", err)
+	}
+
+	report, err := c.GetDuplicates(ctx, "merchant-1", DuplicatesQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MerchantID != "merchant-1" || report.DuplicateCount == 0 {
+		t.Errorf("expected the retries reported as duplicates, got %+v", report)
+	}
+
+	if _, err := c.GetPolicy(ctx, "merchant-1"); !IsCode(err, "policy_not_found") {
+		t.Errorf("expected policy_not_found, got %v", err)
+	}
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"storage unavailable","code":"storage_unavailable","retryable":true}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"payment_id":"pay_1","status":"processing","code":"payment_accepted"}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL).WithRetries(3, time.Millisecond)
+	payment, err := c.ProcessPayment(context.Background(), &PaymentRequest{IdempotencyKey: "k1"})
+	if err != nil || payment.PaymentID != "pay_1" || calls.Load() != 3 {
+		t.Errorf("expected success on the third attempt, got %+v %v after %d calls", payment, err, calls.Load())
+	}
+}
+
+func TestClient_RetriesBareServerErrorsAndRateLimits(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusTooManyRequests} {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 2 {
+				// A proxy's answer, without the shield's error body.
+				w.WriteHeader(status)
+				w.Write([]byte("upstream unavailable"))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"payment_id":"pay_1","status":"processing"}`))
+		}))
+
+		c := New(srv.URL).WithRetries(3, time.Millisecond)
+		payment, err := c.ProcessPayment(context.Background(), &PaymentRequest{IdempotencyKey: "k1"})
+		if err != nil || payment.PaymentID != "pay_1" || calls.Load() != 2 {
+			t.Errorf("%d: expected a retry, got %+v %v after %d calls", status, payment, err, calls.Load())
+		}
+		srv.Close()
+	}
+}
+
+func TestClient_DoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"error":"parameters differ","code":"params_mismatch"}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL).WithRetries(3, time.Millisecond)
+	_, err := c.ProcessPayment(context.Background(), &PaymentRequest{IdempotencyKey: "k1"})
+	if !IsCode(err, "params_mismatch") || calls.Load() != 1 {
+		t.Errorf("expected one attempt failing with params_mismatch, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestClient_SignsRequests(t *testing.T) {
+	repo := storage.NewMemoryRepository(0)
+	repo.UpsertPolicy(context.Background(), domain.MerchantPolicy{MerchantID: "merchant-1", RetryPolicy: "standard", ExpiryHours: 24, SigningSecret: "s3cret"})
+	payments := handler.NewPaymentHandler(service.NewIdempotencyService(repo, 24*time.Hour))
+	verifier := service.NewSignatureVerifier(repo, 5*time.Minute)
+	owner := func(ctx context.Context, key string) (string, error) {
+		rec, err := repo.GetByKeyPrimary(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		return rec.MerchantID, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/payments", handler.RequireSignature(verifier, http.HandlerFunc(payments.ProcessPayment)))
+	mux.Handle("PATCH /v1/payments/{key}/complete", handler.RequireKeySignature(verifier, owner, http.HandlerFunc(payments.CompletePayment)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	ctx := context.Background()
+	req := &PaymentRequest{MerchantID: "merchant-1", CustomerID: "customer-1", Amount: 5000, Currency: "BRL"}
+
+	if _, err := New(srv.URL).ProcessPayment(ctx, req); !IsCode(err, "signature_expired") {
+		t.Fatalf("expected an unsigned payment refused, got %v", err)
+	}
+	c := New(srv.URL).WithSigningSecret("s3cret")
+	if payment, err := c.ProcessPayment(ctx, req); err != nil || payment.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the signed payment accepted, got %+v %v", payment, err)
+	}
+	if err := c.Complete(ctx, req.IdempotencyKey, CompleteRequest{Status: StatusSucceeded}); err != nil {
+		t.Errorf("expected the signed completion accepted, got %v", err)
+	}
+}
+
+func TestClient_StopsRetryingWhenContextEnds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"code":"storage_unavailable","retryable":true}`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c := New(srv.URL).WithRetries(10, time.Second)
+	if _, err := c.GetPolicy(ctx, "merchant-1"); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to end the backoff, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The request and response bodies of the API. They mirror the server's own
+// types field for field; TestWireTypes fails when the two drift apart.
+
+// Status is a payment's state.
+type Status string
+
+// Payment statuses.
+const (
+	StatusProcessing Status = "processing"
+	StatusSucceeded  Status = "succeeded"
+	StatusFailed     Status = "failed"
+)
+
+// PaymentRequest is the body of POST /v1/payments.
+type PaymentRequest struct {
+	IdempotencyKey string `json:"idempotency_key"`
+	MerchantID     string `json:"merchant_id"`
+	CustomerID     string `json:"customer_id"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	// ExpiryHours, when positive, asks the server to keep the key this long
+	// instead of its default, up to the merchant's maximum.
+	ExpiryHours int `json:"expiry_hours,omitempty"`
+	// Metadata is an optional JSON object of the caller's own, such as an
+	// order ID, stored with the key.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// PaymentResponse is the answer to a payment, new or duplicate.
+type PaymentResponse struct {
+	PaymentID         string           `json:"payment_id"`
+	IdempotencyKey    string           `json:"idempotency_key"`
+	Status            Status           `json:"status"`
+	Code              string           `json:"code"`
+	Message           string           `json:"message"`
+	Duplicate         bool             `json:"duplicate,omitempty"`
+	Retryable         bool             `json:"retryable,omitempty"`
+	RetryAfterSeconds int              `json:"retry_after_seconds,omitempty"`
+	AttemptCount      int              `json:"attempt_count"`
+	ResponseBody      *json.RawMessage `json:"response_body,omitempty"`
+	// EstimatedCompletionAt is when a payment still processing is expected
+	// to complete, from the merchant's recent completion latency.
+	EstimatedCompletionAt *time.Time `json:"estimated_completion_at,omitempty"`
+	// Metadata is the key's stored metadata; only lookups fill it in.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// CompleteRequest is the body of PATCH /v1/payments/{key}/complete. With a
+// ResponseStatus, succeeded duplicates are answered with the stored
+// response instead of a PaymentResponse.
+type CompleteRequest struct {
+	Status          Status            `json:"status"`
+	ResponseBody    *json.RawMessage  `json:"response_body,omitempty"`
+	ResponseStatus  int               `json:"response_status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+}
+
+// DuplicateReport summarizes a merchant's duplicate activity over a range.
+type DuplicateReport struct {
+	MerchantID     string          `json:"merchant_id"`
+	TotalRequests  int             `json:"total_requests"`
+	UniquePayments int             `json:"unique_payments"`
+	DuplicateCount int             `json:"duplicate_count"`
+	DuplicateRate  float64         `json:"duplicate_rate"`
+	SuspiciousKeys []SuspiciousKey `json:"suspicious_keys"`
+	TimeRange      TimeRange       `json:"time_range"`
+	// AmountAtRisk totals the amounts at risk in ReportingCurrency, minor
+	// units. It is nil when the duplicates are in several currencies that
+	// cannot all be converted; CurrencyBreakdown has them per currency.
+	AmountAtRisk      *int64           `json:"amount_at_risk,omitempty"`
+	ReportingCurrency string           `json:"reporting_currency,omitempty"`
+	CurrencyBreakdown map[string]int64 `json:"currency_breakdown"`
+	// Normalized is the amount at risk converted to the reporting currency,
+	// nil when the server has no FX rates.
+	Normalized *NormalizedAmount `json:"normalized_amount_at_risk,omitempty"`
+	// Page is set when the report was paginated; SuspiciousKeys then holds
+	// only this page, while the totals cover the whole range.
+	Page *PageInfo `json:"page,omitempty"`
+}
+
+// SuspiciousKey is a key of a DuplicateReport that was attempted more than
+// once.
+type SuspiciousKey struct {
+	IdempotencyKey string    `json:"idempotency_key"`
+	MerchantID     string    `json:"merchant_id,omitempty"`
+	AttemptCount   int       `json:"attempt_count"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Status         Status    `json:"status"`
+	FirstSeenAt    time.Time `json:"first_seen_at"`
+	LastSeenAt     time.Time `json:"last_seen_at"`
+	// HighPriority marks keys whose amount is an outlier for the merchant.
+	HighPriority bool    `json:"high_priority"`
+	AmountZScore float64 `json:"amount_zscore,omitempty"`
+	// DistinctSources counts the source IPs behind the attempts.
+	DistinctSources int             `json:"distinct_sources"`
+	Metadata        json.RawMessage `json:"metadata,omitempty"`
+}
+
+// TimeRange is the range a report covers.
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// NormalizedAmount is an amount at risk converted to one currency.
+type NormalizedAmount struct {
+	Currency       string    `json:"currency"`
+	Amount         int64     `json:"amount"`
+	RatesSource    string    `json:"rates_source"`
+	RatesUpdatedAt time.Time `json:"rates_updated_at"`
+	// Unconverted lists currencies with no known rate, excluded from Amount.
+	Unconverted []string `json:"unconverted_currencies,omitempty"`
+	// Percentages is each converted currency's share of Amount, in percent.
+	Percentages map[string]float64 `json:"currency_percentages,omitempty"`
+}
+
+// PageInfo describes the part of a listing a response holds. NextOffset is
+// nil on the last page.
+type PageInfo struct {
+	Limit      int  `json:"limit"`
+	Offset     int  `json:"offset"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// MerchantPolicy is a merchant's idempotency configuration, as the server
+// returns it: its signing secret is never included.
+type MerchantPolicy struct {
+	MerchantID  string `json:"merchant_id"`
+	RetryPolicy string `json:"retry_policy"`
+	ExpiryHours int    `json:"expiry_hours"`
+	// ResponseSchema is the JSON Schema succeeded responses must satisfy.
+	ResponseSchema *json.RawMessage `json:"response_schema,omitempty"`
+	// DuplicateStatusCode is returned for a duplicate of a payment still
+	// processing: 409 or 200.
+	DuplicateStatusCode int       `json:"duplicate_status_code"`
+	TolerantFields      []string  `json:"tolerant_fields"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	BaseCurrency        string    `json:"base_currency,omitempty"`
+	FraudExport         bool      `json:"fraud_export"`
+	PaymentIDFormat     string    `json:"payment_id_format,omitempty"`
+	// DuplicateAlertThreshold, when positive, posts an alert to
+	// DuplicateAlertURL for each day with more duplicates.
+	DuplicateAlertThreshold int     `json:"duplicate_alert_threshold,omitempty"`
+	DuplicateAlertURL       string  `json:"duplicate_alert_url,omitempty"`
+	RateLimitRPS            float64 `json:"rate_limit_rps,omitempty"`
+	RateLimitBurst          int     `json:"rate_limit_burst,omitempty"`
+	MaxExpiryHours          int     `json:"max_expiry_hours,omitempty"`
+	HashMetadata            bool    `json:"hash_metadata"`
+	StormThreshold          int     `json:"storm_threshold,omitempty"`
+	MismatchBehavior        string  `json:"mismatch_behavior,omitempty"`
+}